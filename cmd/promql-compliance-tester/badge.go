@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+
+	"github.com/promlabs/promql-compliance-tester/output"
+)
+
+// badgeFiles writes the compliance badge of a run, showing its pass rate.
+type badgeFiles struct {
+	// svgFile and endpointFile are the files to write the SVG badge and the shields.io endpoint
+	// badge file to, if set.
+	svgFile, endpointFile string
+	opts                  output.BadgeOptions
+	// informational also writes the badges of interrupted and chaos runs, whose pass rates are
+	// not compliance data.
+	informational bool
+}
+
+// write writes the badge files of a run. Interrupted and chaos runs keep the badges of the
+// previous run unless informational is set, and so do runs without results.
+func (b *badgeFiles) write(stats *runStats) error {
+	if b == nil || stats.total == 0 || ((stats.interrupted || stats.chaos) && !b.informational) {
+		return nil
+	}
+	rate := stats.percent(stats.successful())
+	if b.svgFile != "" {
+		if err := ioutil.WriteFile(b.svgFile, output.BadgeSVG(rate, b.opts), 0644); err != nil {
+			return err
+		}
+	}
+	if b.endpointFile != "" {
+		buf, err := output.BadgeEndpoint(rate, b.opts)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(b.endpointFile, buf, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/output"
+)
+
+func TestBadgeFiles(t *testing.T) {
+	thresholds, err := output.ParseBadgeThresholds(output.DefaultBadgeColors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name                       string
+		interrupted, chaos, noRuns bool
+		informational              bool
+		wantWritten                bool
+	}{
+		{name: "complete run", wantWritten: true},
+		{name: "interrupted run", interrupted: true},
+		{name: "chaos run", chaos: true},
+		{name: "informational interrupted run", interrupted: true, informational: true, wantWritten: true},
+		{name: "informational chaos run", chaos: true, informational: true, wantWritten: true},
+		{name: "run without results", noRuns: true, informational: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, cleanup := tempDir(t)
+			defer cleanup()
+			b := &badgeFiles{svgFile: filepath.Join(dir, "badge.svg"), endpointFile: filepath.Join(dir, "badge.json"), opts: output.BadgeOptions{Precision: 1, Thresholds: thresholds}, informational: tc.informational}
+
+			stats := newRunStats(0)
+			if !tc.noRuns {
+				// 3 of 4 test cases pass.
+				for i, res := range []*comparer.Result{{}, {}, {}, {Diff: "different values"}} {
+					res.TestCase = &comparer.TestCase{Query: "demo"}
+					stats.add(i, res)
+				}
+			}
+			stats.interrupted, stats.chaos = tc.interrupted, tc.chaos
+			if err := b.write(stats); err != nil {
+				t.Fatal(err)
+			}
+
+			svg, err := ioutil.ReadFile(b.svgFile)
+			if !tc.wantWritten {
+				if !os.IsNotExist(err) {
+					t.Errorf("expected no badge to be written, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(svg), "PromQL compliance: 75.0%") {
+				t.Errorf("expected a badge of 75.0%%, got:\n%s", svg)
+			}
+			endpoint, err := ioutil.ReadFile(b.endpointFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(endpoint), `"message": "75.0%"`) || !strings.Contains(string(endpoint), `"color": "orange"`) {
+				t.Errorf("expected an endpoint badge of 75.0%% in orange, got:\n%s", endpoint)
+			}
+		})
+	}
+
+	var nilBadges *badgeFiles
+	if err := nilBadges.write(newRunStats(0)); err != nil {
+		t.Errorf("expected no badges to be written without badge files, got %v", err)
+	}
+}
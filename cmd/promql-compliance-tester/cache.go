@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/prometheus/common/log"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// cacheReferenceTarget returns a target answering repeated queries of the reference target from the
+// response cache in dir. Caching is disabled without a fixed end time, since the time parameters of
+// the queries would change with every run.
+func cacheReferenceTarget(cfg *config.Config, target comparer.QueryTarget, dir string, refresh bool) comparer.QueryTarget {
+	for _, p := range cfg.QueryTimeParameters.Sets() {
+		if p.EndTime == "" {
+			log.Warnf("Not caching reference responses, since query_time_parameters sets no end_time")
+			return target
+		}
+	}
+	if cfg.ReferenceTargetConfig.FixtureFile != "" {
+		return target
+	}
+	// Responses for the same query differ between reference targets and may differ with the query tweaks.
+	tweaks, err := json.Marshal(cfg.QueryTweaks)
+	if err != nil {
+		log.Fatalf("Error hashing query tweaks: %v", err)
+	}
+	cached, err := comparer.NewCachingTarget(target, dir, cfg.ReferenceTargetConfig.QueryURL+"\x00"+string(tweaks), refresh)
+	if err != nil {
+		log.Fatalf("Error creating -reference-cache-dir: %v", err)
+	}
+	return cached
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/common/log"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// hiddenFlags are not listed in the usage, since they are only meant for testing the tester itself.
+var hiddenFlags = map[string]bool{"chaos": true}
+
+// printDefaults prints the defaults of the flags like flag.PrintDefaults, without the hidden flags.
+func printDefaults() {
+	fs := flag.NewFlagSet(flag.CommandLine.Name(), flag.ContinueOnError)
+	fs.SetOutput(flag.CommandLine.Output())
+	flag.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		fs.Var(f.Value, f.Name, f.Usage)
+		// The value may already be set when the usage is printed for a later flag.
+		fs.Lookup(f.Name).DefValue = f.DefValue
+	})
+	fs.PrintDefaults()
+}
+
+// setupChaos checks the chaos sections of the targets against -chaos. Without -chaos, they are
+// dropped, so that a configuration copied from the tester's own tests cannot inject faults into a
+// compliance run.
+func setupChaos(cfg *config.Config, enabled bool) {
+	targets := []*config.TargetConfig{&cfg.ReferenceTargetConfig}
+	for i := range cfg.TestTargetConfigs {
+		targets = append(targets, &cfg.TestTargetConfigs[i])
+	}
+	for i := range cfg.ReferenceFallbackTargetConfigs {
+		targets = append(targets, &cfg.ReferenceFallbackTargetConfigs[i])
+	}
+	var names []string
+	for _, t := range targets {
+		if t.Chaos == nil {
+			continue
+		}
+		names = append(names, t.DisplayName())
+		if !enabled {
+			t.Chaos = nil
+		}
+	}
+	switch {
+	case !enabled && len(names) > 0:
+		log.Warnf("Ignoring the chaos configuration of %q, since -chaos is not set", names)
+	case enabled && len(names) == 0:
+		log.Fatalf("-chaos requires a chaos section in the configuration of at least one target")
+	case enabled:
+		log.Warnf("Injecting faults into the requests to %q, the results are not compliance data", names)
+	}
+}
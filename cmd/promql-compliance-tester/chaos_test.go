@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+func TestSetupChaos(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		cfg := &config.Config{
+			ReferenceTargetConfig: config.TargetConfig{QueryURL: "http://localhost:9090"},
+			TestTargetConfigs: []config.TargetConfig{
+				{Name: "a", QueryURL: "http://localhost:4000", Chaos: &config.ChaosConfig{FaultRate: 0.1}},
+				{Name: "b", QueryURL: "http://localhost:4001"},
+			},
+		}
+		setupChaos(cfg, enabled)
+		// Without -chaos, the chaos sections are dropped, so that no faults are injected.
+		if got := cfg.TestTargetConfigs[0].Chaos != nil; got != enabled {
+			t.Errorf("-chaos=%v: expected the chaos section to be kept %v, got %v", enabled, enabled, got)
+		}
+		if cfg.ReferenceTargetConfig.Chaos != nil || cfg.TestTargetConfigs[1].Chaos != nil {
+			t.Errorf("-chaos=%v: expected no chaos sections on the other targets", enabled)
+		}
+	}
+}
+
+func TestChaosTarget(t *testing.T) {
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer srv.Close()
+
+	// Every other request is dropped, and the breaker opens after two failed queries.
+	targetConfig := config.TargetConfig{QueryURL: srv.URL, Chaos: &config.ChaosConfig{DropEvery: 2}}
+	retries := config.RetryConfig{MaxRetries: 1, BaseDelaySeconds: 0.001, BreakerFailures: 2, BreakerCooldownSeconds: 60}
+	target, err := newQueryTarget(targetConfig, retries, nil, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := target.InstantQuery(context.Background(), "demo", time.Unix(1, 0)); err != nil {
+			t.Fatalf("query %d: expected the dropped request to be retried, got %v", i+1, err)
+		}
+	}
+	// Of the 5 requests, the dropped 2nd and 4th did not reach the server.
+	if got := atomic.LoadInt64(&requests); got != 3 {
+		t.Errorf("expected 3 requests to reach the server, got %d", got)
+	}
+
+	targetConfig.Chaos = &config.ChaosConfig{FaultRate: 1, Faults: []string{config.ChaosFaultUnavailable}}
+	if target, err = newQueryTarget(targetConfig, retries, nil, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"server error: 503", "server error: 503", "circuit breaker open"} {
+		if _, err := target.InstantQuery(context.Background(), "demo", time.Unix(1, 0)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("query %d: expected an error containing %q, got %v", i+1, want, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// skewedTarget is a QueryTarget whose clock is skew ahead of the local clock, and which records the
+// timestamps of the queries other than time().
+type skewedTarget struct {
+	skew    time.Duration
+	queried []time.Time
+}
+
+func (t *skewedTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*comparer.QueryResult, error) {
+	if query == "time()" {
+		now := time.Now().Add(t.skew)
+		return &comparer.QueryResult{Value: &model.Scalar{Value: model.SampleValue(float64(now.UnixNano()) / 1e9)}}, nil
+	}
+	t.queried = append(t.queried, ts)
+	return &comparer.QueryResult{Value: model.Vector{}}, nil
+}
+
+func (t *skewedTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*comparer.QueryResult, error) {
+	t.queried = append(t.queried, r.Start)
+	return &comparer.QueryResult{Value: model.Matrix{}}, nil
+}
+
+func TestCheckClockDrift(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		skew          time.Duration
+		autoCorrect   bool
+		fixture       bool
+		wantExceeded  bool
+		wantCorrected bool
+	}{
+		{name: "within the maximum", skew: 2 * time.Second, autoCorrect: true},
+		{name: "exceeded", skew: 45 * time.Second, wantExceeded: true},
+		{name: "exceeded behind", skew: -45 * time.Second, wantExceeded: true},
+		{name: "corrected", skew: 45 * time.Second, autoCorrect: true, wantExceeded: true, wantCorrected: true},
+		{name: "fixture target", skew: 45 * time.Second, autoCorrect: true, fixture: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inner := &skewedTarget{skew: tc.skew}
+			var targetConfig config.TargetConfig
+			if tc.fixture {
+				targetConfig.FixtureFile = "fixtures.json"
+			}
+			target, drift := checkClockDrift("test", targetConfig, inner, 5*time.Second, tc.autoCorrect)
+
+			if tc.fixture {
+				if drift != nil || target != comparer.QueryTarget(inner) {
+					t.Errorf("expected the clock of a fixture target not to be checked, got %+v", drift)
+				}
+				return
+			}
+			if drift == nil {
+				t.Fatal("expected the drift to be estimated")
+			}
+			if math.Abs(drift.DriftSeconds-tc.skew.Seconds()) > 0.1 || drift.Target != "test" {
+				t.Errorf("expected a drift of %v of the test target, got %+v", tc.skew, drift)
+			}
+			if drift.Exceeded != tc.wantExceeded || drift.Corrected != tc.wantCorrected {
+				t.Errorf("expected exceeded %v and corrected %v, got %+v", tc.wantExceeded, tc.wantCorrected, drift)
+			}
+
+			ts := time.Unix(3600, 0)
+			if _, err := target.InstantQuery(context.Background(), "demo", ts); err != nil {
+				t.Fatal(err)
+			}
+			want := ts
+			if tc.wantCorrected {
+				want = ts.Add(tc.skew)
+			}
+			if shift := inner.queried[0].Sub(want); shift < -time.Millisecond || shift > time.Millisecond {
+				t.Errorf("expected the query at %v, got %v", want, inner.queried[0])
+			}
+		})
+	}
+}
+
+func TestSummaryFileClockDrifts(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	filename := filepath.Join(dir, "summary.json")
+	drifts := []clockDrift{{Target: "reference", DriftSeconds: 0.01}, {Target: "test", DriftSeconds: 45, Exceeded: true, Corrected: true}}
+	if err := writeSummaryFile(filename, newRunStats(0), nil, drifts, 0, nil, nil, nil, nil, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s runSummary
+	if err := json.Unmarshal(content, &s); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.ClockDrifts, drifts) {
+		t.Errorf("expected the clock drifts %+v in the summary file, got %+v", drifts, s.ClockDrifts)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+const (
+	// concurrencyAuto is the value of -concurrency that adapts the concurrency to the test target.
+	concurrencyAuto = "auto"
+	// initialAutoConcurrency is the number of concurrent test cases that -concurrency auto starts at.
+	initialAutoConcurrency = 2
+	// minConcurrencySamples is the smallest number of test cases that the adaptive concurrency
+	// observes before it is increased. At higher concurrency, it observes as many as it runs at once.
+	minConcurrencySamples = 5
+	// concurrencyBackoffFactor scales the concurrency down when the test target is overloaded.
+	concurrencyBackoffFactor = 0.5
+)
+
+// overloadErrorRegexp matches the test query errors that show an overloaded test target, as
+// opposed to queries that the test target rejects.
+var overloadErrorRegexp = regexp.MustCompile(`(?i)client error: 429|server error: 5\d\d|too.many.requests|timed out`)
+
+// parseConcurrency parses the value of -concurrency. It returns 0 for auto.
+func parseConcurrency(s string) (int, error) {
+	if s == concurrencyAuto {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, errors.Errorf("invalid concurrency %q, must be auto or at least 1", s)
+	}
+	return n, nil
+}
+
+// A concurrencyDecision is a change of the adaptive concurrency, after Sample test cases were observed.
+type concurrencyDecision struct {
+	Sample int    `json:"sample"`
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Reason string `json:"reason"`
+}
+
+// concurrencyController is an AIMD controller of the number of test cases that are compared
+// concurrently. It is fed with the test query latency of each compared test case and whether the
+// test target was overloaded, i.e. a query timed out, was rate limited, or failed with a 5xx
+// response. Each overload decreases the concurrency multiplicatively. Once it observed a window of
+// test cases without overloads, it increases the concurrency by one if their p95 latency is at most
+// the ceiling, and decreases it multiplicatively otherwise. After a decrease, as many test cases as
+// were in flight before it are not reacted to, since they still ran at the higher concurrency. It does not depend on the
+// clock, and is not safe for concurrent use.
+type concurrencyController struct {
+	limit, max int
+	ceiling    time.Duration
+
+	window []time.Duration
+	// cooldown is the number of test cases that are still observed without reacting to them, since
+	// they may have been started before the last decrease.
+	cooldown int
+
+	samples   int
+	peak      int
+	limitSum  int
+	decisions []concurrencyDecision
+}
+
+func newConcurrencyController(max int, ceiling time.Duration) *concurrencyController {
+	limit := initialAutoConcurrency
+	if limit > max {
+		limit = max
+	}
+	return &concurrencyController{limit: limit, max: max, ceiling: ceiling, peak: limit}
+}
+
+// observe records the test query latency of a compared test case, and whether it overloaded the
+// test target. It returns the decision if the concurrency changed.
+func (c *concurrencyController) observe(latency time.Duration, overloaded bool) *concurrencyDecision {
+	c.samples++
+	c.limitSum += c.limit
+	if c.cooldown > 0 {
+		c.cooldown--
+		return nil
+	}
+	if overloaded {
+		return c.decrease("test target overloaded")
+	}
+	c.window = append(c.window, latency)
+	size := c.limit
+	if size < minConcurrencySamples {
+		size = minConcurrencySamples
+	}
+	if len(c.window) < size {
+		return nil
+	}
+	p95 := latencyQuantile(c.window, 0.95)
+	c.window = c.window[:0]
+	if p95 > c.ceiling {
+		return c.decrease(fmt.Sprintf("p95 latency %v above the ceiling of %v", p95, c.ceiling))
+	}
+	if c.limit >= c.max {
+		return nil
+	}
+	return c.set(c.limit+1, fmt.Sprintf("p95 latency %v within the ceiling of %v", p95, c.ceiling))
+}
+
+func (c *concurrencyController) decrease(reason string) *concurrencyDecision {
+	c.window = c.window[:0]
+	c.cooldown = c.limit
+	limit := int(math.Floor(float64(c.limit) * concurrencyBackoffFactor))
+	if limit < 1 {
+		limit = 1
+	}
+	if limit == c.limit {
+		return nil
+	}
+	return c.set(limit, reason)
+}
+
+func (c *concurrencyController) set(limit int, reason string) *concurrencyDecision {
+	d := concurrencyDecision{Sample: c.samples, From: c.limit, To: limit, Reason: reason}
+	c.limit = limit
+	if limit > c.peak {
+		c.peak = limit
+	}
+	c.decisions = append(c.decisions, d)
+	return &d
+}
+
+// A concurrencySummary summarizes the adaptive concurrency of a run. The average is that of the
+// concurrency limit at which each test case was compared.
+type concurrencySummary struct {
+	Max       int                   `json:"max"`
+	Ceiling   time.Duration         `json:"latencyCeiling"`
+	Peak      int                   `json:"peak"`
+	Average   float64               `json:"average"`
+	Final     int                   `json:"final"`
+	Decreases int                   `json:"decreases"`
+	Decisions []concurrencyDecision `json:"decisions"`
+	// Observed is the number of compared test cases that the concurrency was adapted to.
+	Observed int `json:"observed"`
+}
+
+func (c *concurrencyController) summary() *concurrencySummary {
+	s := &concurrencySummary{Max: c.max, Ceiling: c.ceiling, Peak: c.peak, Final: c.limit, Decisions: c.decisions, Observed: c.samples}
+	if s.Decisions == nil {
+		s.Decisions = []concurrencyDecision{}
+	}
+	if c.samples > 0 {
+		s.Average = float64(c.limitSum) / float64(c.samples)
+	}
+	for _, d := range c.decisions {
+		if d.To < d.From {
+			s.Decreases++
+		}
+	}
+	return s
+}
+
+// latencyQuantile returns the q-quantile of the latencies, using the nearest rank.
+func latencyQuantile(latencies []time.Duration, q float64) time.Duration {
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// concurrencyLimiter bounds the test cases that the workers compare at once by the limit of a
+// concurrencyController. It is safe for concurrent use, and a nil limiter does not limit anything.
+type concurrencyLimiter struct {
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	ctrl     *concurrencyController
+	inFlight int
+}
+
+func newConcurrencyLimiter(ctrl *concurrencyController) *concurrencyLimiter {
+	l := &concurrencyLimiter{ctrl: ctrl}
+	l.cond = sync.NewCond(&l.mtx)
+	return l
+}
+
+// acquire blocks until another test case may be compared.
+func (l *concurrencyLimiter) acquire() {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for l.inFlight >= l.ctrl.limit {
+		l.cond.Wait()
+	}
+	l.inFlight++
+}
+
+// release feeds the results of a compared test case to the controller, and lets the next test
+// cases be compared.
+func (l *concurrencyLimiter) release(results []*comparer.Result) {
+	if l == nil {
+		return
+	}
+	latency, overloaded, ok := concurrencySample(results)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.inFlight--
+	if ok {
+		if d := l.ctrl.observe(latency, overloaded); d != nil {
+			log.Debugf("Adaptive concurrency: %d -> %d after %d test cases: %s", d.From, d.To, d.Sample, d.Reason)
+		}
+	}
+	l.cond.Broadcast()
+}
+
+func (l *concurrencyLimiter) summary() *concurrencySummary {
+	if l == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.ctrl.summary()
+}
+
+// concurrencySample returns the latency of the slowest test query of the results of a test case,
+// and whether any of them overloaded its test target. It returns false if no test query ran.
+func concurrencySample(results []*comparer.Result) (time.Duration, bool, bool) {
+	var latency time.Duration
+	overloaded, ok := false, false
+	for _, res := range results {
+		if testTargetOverloaded(res) {
+			overloaded, ok = true, true
+		}
+		if res.TestDuration > 0 {
+			ok = true
+			if res.TestDuration > latency {
+				latency = res.TestDuration
+			}
+		}
+	}
+	return latency, overloaded, ok
+}
+
+// testTargetOverloaded returns true if the test query of a result timed out, needed retries, or
+// failed since the test target was rate limiting or failing.
+func testTargetOverloaded(res *comparer.Result) bool {
+	if res.TestRetries > 0 {
+		return true
+	}
+	if res.QueryTimeout > 0 && strings.Contains(res.ExecutionError, "test API query") {
+		return true
+	}
+	return overloadErrorRegexp.MatchString(res.UnexpectedFailure) || overloadErrorRegexp.MatchString(res.TestError)
+}
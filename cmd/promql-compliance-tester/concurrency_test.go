@@ -0,0 +1,201 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+func TestParseConcurrency(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "auto", want: 0},
+		{value: "1", want: 1},
+		{value: "12", want: 12},
+		{value: "0", wantErr: true},
+		{value: "-3", wantErr: true},
+		{value: "Auto", wantErr: true},
+		{value: "fast", wantErr: true},
+	} {
+		got, err := parseConcurrency(tc.value)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("%q: expected %d and an error %v, got %d and %v", tc.value, tc.want, tc.wantErr, got, err)
+		}
+	}
+}
+
+// feed observes a synthetic stream of n test cases with the given latency, and returns the
+// concurrency limits at which each of them was observed.
+func feed(c *concurrencyController, n int, latency time.Duration, overloaded bool) []int {
+	var limits []int
+	for i := 0; i < n; i++ {
+		limits = append(limits, c.limit)
+		c.observe(latency, overloaded)
+	}
+	return limits
+}
+
+func TestConcurrencyControllerIncreases(t *testing.T) {
+	c := newConcurrencyController(6, time.Second)
+	if c.limit != initialAutoConcurrency {
+		t.Fatalf("expected to start at %d, got %d", initialAutoConcurrency, c.limit)
+	}
+	// Each window of at least minConcurrencySamples test cases within the ceiling adds one.
+	limits := feed(c, 30, 100*time.Millisecond, false)
+	want := []int{2, 2, 2, 2, 2, 3, 3, 3, 3, 3, 4, 4, 4, 4, 4, 5, 5, 5, 5, 5, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6}
+	if !reflect.DeepEqual(limits, want) {
+		t.Errorf("expected the limits %v, got %v", want, limits)
+	}
+	for _, d := range c.decisions {
+		if d.To != d.From+1 {
+			t.Errorf("expected additive increases only, got %+v", d)
+		}
+	}
+	if s := c.summary(); s.Peak != 6 || s.Final != 6 || s.Decreases != 0 || s.Observed != 30 || len(s.Decisions) != 4 {
+		t.Errorf("expected a peak of 6 after 4 increases, got %+v", s)
+	}
+}
+
+func TestConcurrencyControllerBacksOff(t *testing.T) {
+	c := newConcurrencyController(6, time.Second)
+	limits := feed(c, 30, 100*time.Millisecond, false)
+	if c.limit != 6 {
+		t.Fatalf("expected to have ramped up to 6, got %d", c.limit)
+	}
+
+	// An overload halves the concurrency, and the test cases still in flight are not reacted to.
+	limits = append(limits, c.limit)
+	if d := c.observe(time.Second, true); d == nil || d.From != 6 || d.To != 3 || d.Reason != "test target overloaded" {
+		t.Fatalf("expected a decrease from 6 to 3, got %+v", d)
+	}
+	cooldown := feed(c, 6, 10*time.Second, true)
+	if !reflect.DeepEqual(cooldown, []int{3, 3, 3, 3, 3, 3}) || c.limit != 3 {
+		t.Errorf("expected no reaction during the cooldown, got the limits %v", cooldown)
+	}
+	limits = append(append(limits, cooldown...), c.limit)
+	if d := c.observe(time.Second, true); d == nil || d.To != 1 {
+		t.Fatalf("expected a decrease from 3 to 1, got %+v", d)
+	}
+
+	// The concurrency does not drop below 1, and a slow window then changes nothing.
+	limits = append(limits, feed(c, 13, 5*time.Second, false)...)
+	if c.limit != 1 || len(c.decisions) != 6 {
+		t.Errorf("expected the concurrency to stay at 1 without further decisions, got %d and %+v", c.limit, c.decisions)
+	}
+
+	s := c.summary()
+	if s.Peak != 6 || s.Final != 1 || s.Decreases != 2 || s.Observed != len(limits) {
+		t.Errorf("expected a peak of 6 and 2 decreases to 1 over %d test cases, got %+v", len(limits), s)
+	}
+	var sum int
+	for _, l := range limits {
+		sum += l
+	}
+	if want := float64(sum) / float64(len(limits)); s.Average != want {
+		t.Errorf("expected the average concurrency %v, got %v", want, s.Average)
+	}
+}
+
+func TestConcurrencyControllerLatencyCeiling(t *testing.T) {
+	c := newConcurrencyController(16, time.Second)
+	feed(c, 15, 100*time.Millisecond, false)
+	if c.limit != 5 {
+		t.Fatalf("expected to have ramped up to 5, got %d", c.limit)
+	}
+	// A single slow test case of a window of 5 makes up its p95 latency.
+	feed(c, 4, 100*time.Millisecond, false)
+	d := c.observe(3*time.Second, false)
+	if d == nil || d.To != 2 || d.Reason != "p95 latency 3s above the ceiling of 1s" {
+		t.Fatalf("expected a decrease to 2 for the latency, got %+v", d)
+	}
+
+	if c := newConcurrencyController(1, time.Second); c.limit != 1 {
+		t.Errorf("expected to start at the maximum of 1, got %d", c.limit)
+	}
+	if s := newConcurrencyController(4, time.Second).summary(); s.Decisions == nil || s.Average != 0 {
+		t.Errorf("expected an empty summary without observations, got %+v", s)
+	}
+}
+
+func TestLatencyQuantile(t *testing.T) {
+	latencies := []time.Duration{5, 1, 4, 2, 3, 10, 9, 8, 7, 6}
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{q: 0, want: 1},
+		{q: 0.5, want: 5},
+		{q: 0.95, want: 10},
+		{q: 1, want: 10},
+	} {
+		if got := latencyQuantile(latencies, tc.q); got != tc.want {
+			t.Errorf("q %v: expected %v, got %v", tc.q, tc.want, got)
+		}
+	}
+	if latencies[0] != 5 {
+		t.Error("expected the latencies not to be sorted in place")
+	}
+}
+
+func TestConcurrencySample(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		results        []*comparer.Result
+		wantLatency    time.Duration
+		wantOverloaded bool
+		wantOK         bool
+	}{
+		{name: "no test queries", results: []*comparer.Result{{}}},
+		{name: "slowest test query", results: []*comparer.Result{{TestDuration: time.Second}, {TestDuration: 3 * time.Second}}, wantLatency: 3 * time.Second, wantOK: true},
+		{name: "rate limited", results: []*comparer.Result{{UnexpectedFailure: "client_error: client error: 429"}}, wantOverloaded: true, wantOK: true},
+		{name: "server error", results: []*comparer.Result{{TestDuration: time.Second, TestError: "server_error: server error: 503"}}, wantLatency: time.Second, wantOverloaded: true, wantOK: true},
+		{name: "retried", results: []*comparer.Result{{TestDuration: time.Second, TestRetries: 1}}, wantLatency: time.Second, wantOverloaded: true, wantOK: true},
+		{name: "test query timed out", results: []*comparer.Result{{QueryTimeout: time.Second, ExecutionError: "test API query timed out after 1s"}}, wantOverloaded: true, wantOK: true},
+		{name: "reference query timed out", results: []*comparer.Result{{QueryTimeout: time.Second, ExecutionError: "reference API query timed out after 1s"}}},
+		{name: "rejected query", results: []*comparer.Result{{TestDuration: time.Second, UnexpectedFailure: "bad_data: parse error"}}, wantLatency: time.Second, wantOK: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			latency, overloaded, ok := concurrencySample(tc.results)
+			if latency != tc.wantLatency || overloaded != tc.wantOverloaded || ok != tc.wantOK {
+				t.Errorf("expected %v, %v, %v, got %v, %v, %v", tc.wantLatency, tc.wantOverloaded, tc.wantOK, latency, overloaded, ok)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	var nilLimiter *concurrencyLimiter
+	nilLimiter.acquire()
+	nilLimiter.release(nil)
+	if nilLimiter.summary() != nil {
+		t.Error("expected no summary of a nil limiter")
+	}
+
+	l := newConcurrencyLimiter(newConcurrencyController(16, time.Second))
+	l.acquire()
+	l.acquire()
+	acquired := make(chan struct{})
+	go func() {
+		l.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected the third test case to wait for the limit of 2")
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.release([]*comparer.Result{{TestDuration: time.Millisecond}})
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("expected the third test case to run after a release")
+	}
+	if s := l.summary(); s.Observed != 1 {
+		t.Errorf("expected 1 observed test case, got %d", s.Observed)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+	"github.com/promlabs/promql-compliance-tester/testcases"
+)
+
+// A dryRunDuplicate is a query that several expanded test cases would send with the same parameters.
+type dryRunDuplicate struct {
+	Query string `json:"query"`
+	// Indices are the 1-based indices of the expanded test cases that send the query.
+	Indices []int `json:"indices"`
+}
+
+// dryRunReport lists the expanded test cases of a dry run.
+type dryRunReport struct {
+	Total      int                  `json:"total"`
+	TestCases  []*comparer.TestCase `json:"testCases"`
+	Duplicates []dryRunDuplicate    `json:"duplicates,omitempty"`
+	// TopExpansions are the test case templates that expand into the most test cases.
+	TopExpansions []testcases.TemplateExpansion `json:"topExpansions,omitempty"`
+	// Requirements lists the data that the configuration file and the included test case files
+	// declare they require.
+	Requirements []*config.Requirements `json:"requirements,omitempty"`
+	// PlaceholderOverrides lists the placeholders whose values the configuration restricted.
+	PlaceholderOverrides []testcases.PlaceholderCoverage `json:"placeholderOverrides,omitempty"`
+	// Filtered lists the test cases of the configuration that the filter flags left out, with why.
+	Filtered []filteredTestCase `json:"filtered,omitempty"`
+	// TimeJitterSeed is the -time-jitter-seed that the windows of the test cases were shifted with.
+	TimeJitterSeed int64 `json:"timeJitterSeed,omitempty"`
+}
+
+// newDryRunReport returns the dry run report of the expanded test cases.
+func newDryRunReport(tcs []*comparer.TestCase) *dryRunReport {
+	r := &dryRunReport{Total: len(tcs), TestCases: tcs}
+	var keys []string
+	indices := map[string][]int{}
+	for i, tc := range tcs {
+		key := testcases.TestCaseKey(tc)
+		if _, ok := indices[key]; !ok {
+			keys = append(keys, key)
+		}
+		indices[key] = append(indices[key], i+1)
+	}
+	for _, key := range keys {
+		if is := indices[key]; len(is) > 1 {
+			r.Duplicates = append(r.Duplicates, dryRunDuplicate{Query: tcs[is[0]-1].Query, Indices: is})
+		}
+	}
+	return r
+}
+
+// writeDryRun writes the expanded test cases in the given output format, which must be text or json.
+func writeDryRun(w io.Writer, format string, tcs []*comparer.TestCase, top []testcases.TemplateExpansion, requirements []*config.Requirements, placeholders []testcases.PlaceholderCoverage, filtered []filteredTestCase, timeJitterSeed int64) error {
+	r := newDryRunReport(tcs)
+	r.TopExpansions = top
+	r.Requirements = requirements
+	r.PlaceholderOverrides = placeholders
+	r.Filtered = filtered
+	r.TimeJitterSeed = timeJitterSeed
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "text":
+	default:
+		return fmt.Errorf("unsupported output format %q, only text and json are supported", format)
+	}
+
+	for i, tc := range r.TestCases {
+		jitter := ""
+		if tc.TimeJitter != 0 {
+			jitter = fmt.Sprintf(", jitter: -%v", tc.TimeJitter)
+		}
+		if tc.Instant() {
+			fmt.Fprintf(w, "%d: %s (instant query, time: %v%s)\n", i+1, tc.Name(), tc.Time.Format(time.RFC3339Nano), jitter)
+		} else {
+			fmt.Fprintf(w, "%d: %s (range query, start: %v, end: %v, step: %v%s)\n", i+1, tc.Name(), tc.Start.Format(time.RFC3339Nano), tc.End.Format(time.RFC3339Nano), tc.Resolution, jitter)
+		}
+		if tc.NotExpanded != "" {
+			fmt.Fprintf(w, "    NOT EXPANDED: placeholder %s has no values\n", tc.NotExpanded)
+		}
+		for _, t := range dryRunTweaks(tc) {
+			fmt.Fprintf(w, "    %s\n", t)
+		}
+	}
+	fmt.Fprintf(w, "Total: %d expanded test cases\n", r.Total)
+	for _, f := range r.Filtered {
+		fmt.Fprintf(w, "FILTERED (%s): %s: %s\n", f.Cause, f.Query, f.Reason)
+	}
+	if r.TimeJitterSeed != 0 {
+		fmt.Fprintf(w, "Time jitter seed: %d\n", r.TimeJitterSeed)
+	}
+	for _, d := range r.Duplicates {
+		strs := make([]string, 0, len(d.Indices))
+		for _, i := range d.Indices {
+			strs = append(strs, fmt.Sprint(i))
+		}
+		fmt.Fprintf(w, "DUPLICATE: %s (test cases %s)\n", d.Query, strings.Join(strs, ", "))
+	}
+	if len(r.TopExpansions) > 0 {
+		fmt.Fprintf(w, "Most expanding test case templates:\n")
+		for _, e := range r.TopExpansions {
+			fmt.Fprintf(w, "    %d: %s\n", e.Count, e.Query)
+		}
+	}
+	for _, req := range r.Requirements {
+		if req.Dataset != "" {
+			fmt.Fprintf(w, "Requirements of %s (%s):\n", req.Source, req.Dataset)
+		} else {
+			fmt.Fprintf(w, "Requirements of %s:\n", req.Source)
+		}
+		for _, m := range req.Metrics {
+			fmt.Fprintf(w, "    %s\n", describeMetricRequirement(m))
+		}
+	}
+	if len(r.PlaceholderOverrides) > 0 {
+		fmt.Fprintf(w, "Restricted placeholders:\n")
+		for _, c := range r.PlaceholderOverrides {
+			fmt.Fprintf(w, "    %s: %s (left out: %s)\n", c.Placeholder, strings.Join(c.Values, ", "), strings.Join(c.Omitted, ", "))
+		}
+	}
+	return nil
+}
+
+// dryRunTweaks describes the per-case settings of an expanded test case.
+func dryRunTweaks(tc *comparer.TestCase) []string {
+	var tweaks []string
+	if tc.TestQuery != "" {
+		tweaks = append(tweaks, fmt.Sprintf("test query: %s", tc.TestQuery))
+	}
+	if tc.Category != "" {
+		tweaks = append(tweaks, fmt.Sprintf("category: %s", tc.Category))
+	}
+	if len(tc.Tags) > 0 {
+		tweaks = append(tweaks, fmt.Sprintf("tags: %s", strings.Join(tc.Tags, ", ")))
+	}
+	if tc.ShouldFail {
+		tweaks = append(tweaks, "should_fail: true")
+	}
+	if tc.SkipComparison {
+		tweaks = append(tweaks, "skip_comparison: true")
+	}
+	if t := tc.ValueTolerance; t != nil {
+		if t.Fraction != nil {
+			tweaks = append(tweaks, fmt.Sprintf("adjust_value_tolerance fraction: %v", *t.Fraction))
+		}
+		if t.Margin != nil {
+			tweaks = append(tweaks, fmt.Sprintf("adjust_value_tolerance margin: %v", *t.Margin))
+		}
+	}
+	for _, lt := range tc.LabelTweaks {
+		if len(lt.DropResultLabels) > 0 {
+			tweaks = append(tweaks, fmt.Sprintf("drop_result_labels: %v", lt.DropResultLabels))
+		}
+		if len(lt.RenameResultLabels) > 0 {
+			tweaks = append(tweaks, fmt.Sprintf("rename_result_labels: %v", lt.RenameResultLabels))
+		}
+	}
+	if ra := tc.WithinReferenceRange; ra != nil {
+		tweaks = append(tweaks, fmt.Sprintf("within_reference_range: lookback %vs, margin %v, relative margin %v", ra.LookbackSeconds, ra.Margin, ra.RelativeMargin))
+	}
+	if tc.SameAs != "" {
+		tweaks = append(tweaks, fmt.Sprintf("same_as: %s", tc.SameAs))
+	}
+	if a := tc.SeriesAllowance; a != nil {
+		tweaks = append(tweaks, fmt.Sprintf("series_allowance: max %v extra, max %v missing series", a.MaxExtraSeries, a.MaxMissingSeries))
+	}
+	return tweaks
+}
+
+// describeMetricRequirement describes a metric requirement for the -dry-run output.
+func describeMetricRequirement(m *config.MetricRequirement) string {
+	desc := m.Name
+	if m.Type != "" {
+		desc += " (" + string(m.Type) + ")"
+	}
+	if len(m.Labels) > 0 {
+		desc += " with labels " + strings.Join(m.Labels, ", ")
+	}
+	if m.MinSeries > 1 {
+		desc += fmt.Sprintf(", at least %d series", m.MinSeries)
+	}
+	return desc
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+	"github.com/promlabs/promql-compliance-tester/testcases"
+)
+
+// A filteredExpansion is an expanded test case of a test case that the filter left out.
+type filteredExpansion struct {
+	testCase *comparer.TestCase
+	filtered filteredTestCase
+}
+
+// expandFiltered expands the test cases that the filter left out, so that -explain-case can tell
+// why the expanded test cases of a query do not run.
+func expandFiltered(filtered []filteredTestCase, placeholders testcases.Placeholders, tweaks []*config.QueryTweak, ranges []testcases.TimeRange, allowRawBraces bool) ([]filteredExpansion, error) {
+	var expansions []filteredExpansion
+	for _, f := range filtered {
+		tcs, err := testcases.ExpandTestCases([]*config.TestCase{f.testCase}, placeholders, tweaks, ranges, allowRawBraces)
+		if err != nil {
+			return nil, err
+		}
+		for _, tc := range tcs {
+			expansions = append(expansions, filteredExpansion{testCase: tc, filtered: f})
+		}
+	}
+	return expansions, nil
+}
+
+// explainTestCase writes the effective settings of the expanded test case identified by id, which is
+// either its 1-based index among the expanded test cases or its exact query. A query that only
+// expanded test cases of filtered out test cases have is explained by why they were filtered out.
+func explainTestCase(w io.Writer, comp *comparer.Comparer, tcs []*comparer.TestCase, filtered []filteredExpansion, budgets *timeBudgets, id string) error {
+	var matches []int
+	if n, err := strconv.Atoi(id); err == nil {
+		if n < 1 || n > len(tcs) {
+			return fmt.Errorf("test case index %d out of range, there are %d expanded test cases", n, len(tcs))
+		}
+		matches = append(matches, n-1)
+	} else {
+		for i, tc := range tcs {
+			if tc.Query == id {
+				matches = append(matches, i)
+			}
+		}
+		if len(matches) == 0 {
+			return explainFiltered(w, filtered, id)
+		}
+	}
+
+	for _, i := range matches {
+		tc := tcs[i]
+		fmt.Fprintf(w, "Test case %d: %s (%s query)\n", i+1, tc.Query, tc.Type)
+		fmt.Fprintf(w, "Planned to run, unless a target lacks data for its window (%s), the run stops early (%s), or a time budget that applies to it is exhausted (%s)", comparer.SkipPreconditionNotMet, comparer.SkipAbortedEarly, comparer.SkipBudgetExhausted)
+		if b := budgets.describe(tc); len(b) > 0 {
+			fmt.Fprintf(w, ": the %s", strings.Join(b, ", the "))
+		}
+		fmt.Fprintln(w)
+		comp.EffectiveSettings(tc).Explain(w)
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// explainFiltered writes why the expanded test cases with the query were filtered out.
+func explainFiltered(w io.Writer, filtered []filteredExpansion, query string) error {
+	found := false
+	for _, f := range filtered {
+		if f.testCase.Query != query {
+			continue
+		}
+		found = true
+		fmt.Fprintf(w, "Test case %s (%s query, template %s)\n", f.testCase.Query, f.testCase.Type, f.filtered.Query)
+		fmt.Fprintf(w, "Not run (%s): %s\n\n", f.filtered.Cause, f.filtered.Reason)
+	}
+	if !found {
+		return fmt.Errorf("no expanded test case has the query %q", query)
+	}
+	return nil
+}
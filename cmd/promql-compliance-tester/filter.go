@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// compileOptionalRegexp compiles the given regular expression, returning nil for an empty string.
+func compileOptionalRegexp(flagName, expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid regular expression for -%s", flagName)
+	}
+	return re, nil
+}
+
+// parseTags parses a comma-separated list of tags.
+func parseTags(flagName, list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	tags := strings.Split(list, ",")
+	for i, tag := range tags {
+		tags[i] = strings.TrimSpace(tag)
+		if !config.TagRegexp.MatchString(tags[i]) {
+			return nil, errors.Errorf("invalid tag %q for -%s", tags[i], flagName)
+		}
+	}
+	return tags, nil
+}
+
+// testCaseFilter selects test cases by their raw query template and tags.
+type testCaseFilter struct {
+	include, exclude         *regexp.Regexp
+	includeTags, excludeTags []string
+}
+
+// A filteredTestCase is a test case of the configuration that the filter left out, with why.
+type filteredTestCase struct {
+	Query string   `json:"query"`
+	Tags  []string `json:"tags,omitempty"`
+	// Cause is comparer.SkipFilteredByRegex or comparer.SkipExcludedTag, which Reason details.
+	Cause  string `json:"cause"`
+	Reason string `json:"reason"`
+
+	testCase *config.TestCase
+}
+
+// filterTestCases returns the test cases whose raw query template matches the include expression
+// (if any) and does not match the exclude expression (if any), and that have one of the included
+// tags (if any) and none of the excluded tags. The others are returned as filtered, with the first
+// of these conditions that they do not meet.
+func filterTestCases(cases []*config.TestCase, f testCaseFilter) (selected []*config.TestCase, filtered []filteredTestCase) {
+	selected = make([]*config.TestCase, 0, len(cases))
+	for _, tc := range cases {
+		if cause, reason := f.reject(tc); cause != "" {
+			filtered = append(filtered, filteredTestCase{Query: tc.Query, Tags: tc.Tags, Cause: cause, Reason: reason, testCase: tc})
+			continue
+		}
+		selected = append(selected, tc)
+	}
+	return selected, filtered
+}
+
+// reject returns the cause and reason for filtering out a test case, or empty strings if it is selected.
+func (f testCaseFilter) reject(tc *config.TestCase) (cause, reason string) {
+	switch {
+	case f.include != nil && !f.include.MatchString(tc.Query):
+		return comparer.SkipFilteredByRegex, fmt.Sprintf("the query template does not match -query-include %q", f.include)
+	case f.exclude != nil && f.exclude.MatchString(tc.Query):
+		return comparer.SkipFilteredByRegex, fmt.Sprintf("the query template matches -query-exclude %q", f.exclude)
+	case len(f.includeTags) > 0 && !hasAnyTag(tc, f.includeTags):
+		return comparer.SkipExcludedTag, fmt.Sprintf("none of the tags %v is in -include-tags %s", tc.Tags, strings.Join(f.includeTags, ","))
+	case hasAnyTag(tc, f.excludeTags):
+		return comparer.SkipExcludedTag, fmt.Sprintf("a tag of %v is in -exclude-tags %s", tc.Tags, strings.Join(f.excludeTags, ","))
+	}
+	return "", ""
+}
+
+func hasAnyTag(tc *config.TestCase, tags []string) bool {
+	for _, t := range tc.Tags {
+		for _, want := range tags {
+			if t == want {
+				return true
+			}
+		}
+	}
+	return false
+}
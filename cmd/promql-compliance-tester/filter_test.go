@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+	"github.com/promlabs/promql-compliance-tester/testcases"
+)
+
+func TestFilterTestCases(t *testing.T) {
+	cases := []*config.TestCase{
+		{Query: "rate(demo[5m])", Tags: []string{"rate"}},
+		{Query: "sum(demo)", Tags: []string{"aggregation"}},
+		{Query: "sum(rate(demo[5m]))", Tags: []string{"aggregation", "slow"}},
+		{Query: "demo"},
+	}
+	for _, tc := range []struct {
+		name         string
+		filter       testCaseFilter
+		wantSelected []string
+		// wantFiltered maps the queries of the filtered test cases to their causes.
+		wantFiltered map[string]string
+		wantReason   map[string]string
+	}{
+		{
+			name:         "no filter",
+			wantSelected: []string{"rate(demo[5m])", "sum(demo)", "sum(rate(demo[5m]))", "demo"},
+		},
+		{
+			name:         "include regex",
+			filter:       testCaseFilter{include: regexp.MustCompile(`^sum`)},
+			wantSelected: []string{"sum(demo)", "sum(rate(demo[5m]))"},
+			wantFiltered: map[string]string{"rate(demo[5m])": comparer.SkipFilteredByRegex, "demo": comparer.SkipFilteredByRegex},
+			wantReason:   map[string]string{"demo": `the query template does not match -query-include "^sum"`},
+		},
+		{
+			name:         "exclude regex",
+			filter:       testCaseFilter{exclude: regexp.MustCompile(`rate`)},
+			wantSelected: []string{"sum(demo)", "demo"},
+			wantFiltered: map[string]string{"rate(demo[5m])": comparer.SkipFilteredByRegex, "sum(rate(demo[5m]))": comparer.SkipFilteredByRegex},
+			wantReason:   map[string]string{"rate(demo[5m])": `the query template matches -query-exclude "rate"`},
+		},
+		{
+			name:         "include tags",
+			filter:       testCaseFilter{includeTags: []string{"aggregation"}},
+			wantSelected: []string{"sum(demo)", "sum(rate(demo[5m]))"},
+			wantFiltered: map[string]string{"rate(demo[5m])": comparer.SkipExcludedTag, "demo": comparer.SkipExcludedTag},
+			wantReason:   map[string]string{"rate(demo[5m])": "none of the tags [rate] is in -include-tags aggregation"},
+		},
+		{
+			name:         "exclude tags",
+			filter:       testCaseFilter{excludeTags: []string{"slow", "rate"}},
+			wantSelected: []string{"sum(demo)", "demo"},
+			wantFiltered: map[string]string{"rate(demo[5m])": comparer.SkipExcludedTag, "sum(rate(demo[5m]))": comparer.SkipExcludedTag},
+			wantReason:   map[string]string{"sum(rate(demo[5m]))": "a tag of [aggregation slow] is in -exclude-tags slow,rate"},
+		},
+		{
+			// The regular expressions are applied before the tags, and only the first condition
+			// that a test case does not meet is its cause.
+			name:         "regex and tags combined",
+			filter:       testCaseFilter{include: regexp.MustCompile(`demo`), exclude: regexp.MustCompile(`^rate`), includeTags: []string{"aggregation"}, excludeTags: []string{"slow"}},
+			wantSelected: []string{"sum(demo)"},
+			wantFiltered: map[string]string{"rate(demo[5m])": comparer.SkipFilteredByRegex, "sum(rate(demo[5m]))": comparer.SkipExcludedTag, "demo": comparer.SkipExcludedTag},
+			wantReason:   map[string]string{"demo": "none of the tags [] is in -include-tags aggregation"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			selected, filtered := filterTestCases(cases, tc.filter)
+			var got []string
+			for _, s := range selected {
+				got = append(got, s.Query)
+			}
+			if !reflect.DeepEqual(got, tc.wantSelected) {
+				t.Errorf("expected the selected test cases %q, got %q", tc.wantSelected, got)
+			}
+			gotFiltered := map[string]string{}
+			for _, f := range filtered {
+				gotFiltered[f.Query] = f.Cause
+				if want, ok := tc.wantReason[f.Query]; ok && f.Reason != want {
+					t.Errorf("%s: expected the reason %q, got %q", f.Query, want, f.Reason)
+				}
+			}
+			if len(tc.wantFiltered) == 0 && len(gotFiltered) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(gotFiltered, tc.wantFiltered) {
+				t.Errorf("expected the filtered test cases %v, got %v", tc.wantFiltered, gotFiltered)
+			}
+		})
+	}
+}
+
+func TestExplainFilteredTestCase(t *testing.T) {
+	cases := []*config.TestCase{
+		{Query: "rate(demo[{{.range}}])", Type: config.QueryTypeRange, VariantArgs: []string{"range"}, Tags: []string{"rate"}},
+		{Query: "sum(demo)", Type: config.QueryTypeRange},
+	}
+	selected, filtered := filterTestCases(cases, testCaseFilter{excludeTags: []string{"rate"}})
+	ranges := []testcases.TimeRange{{End: time.Unix(3600, 0), Start: time.Unix(0, 0), Resolution: time.Minute}}
+	placeholders := testcases.Placeholders{"range": {"1m", "5m"}}
+	tcs, err := testcases.ExpandTestCases(selected, placeholders, nil, ranges, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expansions, err := expandFiltered(filtered, placeholders, nil, ranges, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expansions) != 2 {
+		t.Fatalf("expected an expansion per placeholder value of the filtered test case, got %d", len(expansions))
+	}
+	comp := comparer.New(nil, nil, nil, comparer.Options{})
+	budgets := newTimeBudgets(nil, nil)
+
+	var buf bytes.Buffer
+	if err := explainTestCase(&buf, comp, tcs, expansions, budgets, "rate(demo[5m])"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Test case rate(demo[5m]) (range query, template rate(demo[{{.range}}]))",
+		"Not run (excluded-tag): a tag of [rate] is in -exclude-tags rate",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected the explanation to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := explainTestCase(&buf, comp, tcs, expansions, budgets, "sum(demo)"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Test case 1: sum(demo) (range query)\nPlanned to run, unless a target lacks data for its window (precondition-not-met), the run stops early (aborted-early), or a time budget that applies to it is exhausted (budget-exhausted)\n"; !strings.HasPrefix(buf.String(), want) {
+		t.Errorf("expected the explanation to start with %q, got:\n%s", want, buf.String())
+	}
+
+	if err := explainTestCase(&buf, comp, tcs, expansions, budgets, "max(demo)"); err == nil || !strings.Contains(err.Error(), `no expanded test case has the query "max(demo)"`) {
+		t.Errorf("expected an unknown query to be an error, got %v", err)
+	}
+}
+
+func TestDryRunListsFilteredTestCases(t *testing.T) {
+	_, filtered := filterTestCases([]*config.TestCase{{Query: "demo"}, {Query: "sum(demo)"}}, testCaseFilter{include: regexp.MustCompile(`sum`)})
+	var buf bytes.Buffer
+	if err := writeDryRun(&buf, "json", nil, nil, nil, nil, filtered, 0); err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Filtered []filteredTestCase `json:"filtered"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	want := []filteredTestCase{{Query: "demo", Cause: comparer.SkipFilteredByRegex, Reason: `the query template does not match -query-include "sum"`}}
+	if !reflect.DeepEqual(report.Filtered, want) {
+		t.Errorf("expected the filtered test cases %+v in the plan, got %+v", want, report.Filtered)
+	}
+
+	buf.Reset()
+	if err := writeDryRun(&buf, "text", nil, nil, nil, nil, filtered, 0); err != nil {
+		t.Fatal(err)
+	}
+	if want := `FILTERED (filtered-by-regex): demo: the query template does not match -query-include "sum"`; !strings.Contains(buf.String(), want) {
+		t.Errorf("expected the text plan to contain %q, got:\n%s", want, buf.String())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// exitCodeIngestionParity is the exit status of runs whose test cases were not run, since the
+// ingestion parity was too low.
+const exitCodeIngestionParity = 5
+
+// minIngestionWindow is the shortest window that the ingestion parity is compared over by default,
+// e.g. if all test cases are instant queries.
+const minIngestionWindow = time.Hour
+
+// maxLoggedIngestionMetrics bounds the metrics with low parity that are logged per test target.
+const maxLoggedIngestionMetrics = 10
+
+// checkIngestionParity compares the data ingested by the test targets of the comparers with the
+// reference target over window, which ends at end and is at least minIngestionWindow unless
+// configured, and logs the metrics whose counts did not match. It returns the reports and whether
+// the test cases may run.
+func checkIngestionParity(ctx context.Context, ip *config.IngestionParityConfig, comps []*comparer.Comparer, window time.Duration, end time.Time) ([]*comparer.IngestionReport, bool) {
+	if ip.WindowSeconds > 0 {
+		window = secondsToDuration(ip.WindowSeconds)
+	} else if window < minIngestionWindow {
+		window = minIngestionWindow
+	}
+	start := end.Add(-window)
+	var reports []*comparer.IngestionReport
+	ok := true
+	for _, c := range comps {
+		r, err := c.CheckIngestionParity(ctx, ip.Selectors, start, end)
+		if err != nil {
+			log.Warnf("Unable to check the ingestion parity: %v", err)
+			continue
+		}
+		reports = append(reports, r)
+		target := "the test target"
+		if r.TestTarget != "" {
+			target = "test target " + r.TestTarget
+		}
+		log.Infof("Ingestion parity of %s over %v: %.2f%% of the samples of %d metrics", target, window, r.ParityPercent, len(r.Metrics))
+		if r.OmittedMetrics > 0 {
+			log.Warnf("  %d more metrics were not checked", r.OmittedMetrics)
+		}
+		logged := 0
+		for _, m := range r.Metrics {
+			if m.Matched {
+				continue
+			}
+			if logged++; logged > maxLoggedIngestionMetrics {
+				log.Warnf("  ... and more metrics whose counts differ")
+				break
+			}
+			log.Warnf("  %s: %.2f%%: reference %v series, %v samples, test %v series, %v samples", m.Metric, m.ParityPercent, m.RefSeries, m.RefSamples, m.TestSeries, m.TestSamples)
+		}
+		if r.ParityPercent < ip.MinParityPercent {
+			log.Warnf("The ingestion parity of %s is below the min_parity_percent of %v%%, compliance failures may be ingestion gaps", target, ip.MinParityPercent)
+			if ip.OnLowParity == config.IngestionParityGate {
+				ok = false
+			}
+		}
+	}
+	return reports, ok
+}
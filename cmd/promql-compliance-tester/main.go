@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cheggaaa/pb/v3"
@@ -17,12 +26,61 @@ import (
 	"github.com/promlabs/promql-compliance-tester/config"
 	"github.com/promlabs/promql-compliance-tester/output"
 	"github.com/promlabs/promql-compliance-tester/testcases"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
 )
 
 func newPromAPI(targetConfig config.TargetConfig) (v1.API, error) {
-	apiConfig := api.Config{Address: targetConfig.QueryURL}
-	if len(targetConfig.Headers) > 0 || targetConfig.BasicAuthUser != "" {
-		apiConfig.RoundTripper = roundTripperWithSettings{headers: targetConfig.Headers, basicAuthUser: targetConfig.BasicAuthUser, basicAuthPass: targetConfig.BasicAuthPass}
+	address := targetConfig.QueryURL
+	if targetConfig.PathPrefix != "" {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing query URL %q", targetConfig.QueryURL)
+		}
+		u.Path = path.Join(u.Path, targetConfig.PathPrefix)
+		address = u.String()
+	}
+	apiConfig := api.Config{Address: address}
+	transport := http.DefaultTransport
+	if targetConfig.TLSConfig.Enabled() {
+		tlsConfig, err := newTLSConfig(targetConfig.TLSConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "setting up TLS for %q", targetConfig.QueryURL)
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		transport = t
+	}
+	// Tokens are fetched through the TLS-configured transport only, without the faults, capturing,
+	// and response limits of queries.
+	tokenTransport := transport
+	if targetConfig.Chaos != nil {
+		transport = comparer.NewChaosRoundTripper(transport, *targetConfig.Chaos)
+	}
+	transport = comparer.NewCapturingRoundTripper(comparer.NewLimitingRoundTripper(transport, responseLimits(targetConfig)))
+	apiConfig.RoundTripper = transport
+	if o := targetConfig.OAuth2; o != nil {
+		ccConfig := clientcredentials.Config{
+			ClientID:     o.ClientID,
+			ClientSecret: o.ClientSecret,
+			TokenURL:     o.TokenURL,
+			Scopes:       o.Scopes,
+		}
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: tokenTransport})
+		transport = &oauth2.Transport{Source: ccConfig.TokenSource(ctx), Base: transport}
+		apiConfig.RoundTripper = transport
+	}
+	if len(targetConfig.Headers) > 0 || targetConfig.BasicAuthUser != "" || targetConfig.BearerToken != "" {
+		apiConfig.RoundTripper = roundTripperWithSettings{
+			next:          transport,
+			headers:       targetConfig.Headers,
+			basicAuthUser: targetConfig.BasicAuthUser,
+			basicAuthPass: targetConfig.BasicAuthPass,
+			bearerToken:   targetConfig.BearerToken,
+		}
+	}
+	if targetConfig.HTTPMethod != "" {
+		apiConfig.RoundTripper = httpMethodRoundTripper{next: apiConfig.RoundTripper, method: targetConfig.HTTPMethod}
 	}
 	client, err := api.NewClient(apiConfig)
 	if err != nil {
@@ -32,10 +90,34 @@ func newPromAPI(targetConfig config.TargetConfig) (v1.API, error) {
 	return v1.NewAPI(client), nil
 }
 
+func responseLimits(targetConfig config.TargetConfig) comparer.ResponseLimits {
+	return comparer.ResponseLimits{
+		MaxBytes:             targetConfig.MaxResponseBytes,
+		MaxDecompressedBytes: targetConfig.MaxDecompressedResponseBytes,
+	}
+}
+
+func newQueryTarget(targetConfig config.TargetConfig, retryConfig config.RetryConfig, waits *comparer.WaitBudget, name string) (comparer.QueryTarget, error) {
+	if targetConfig.FixtureFile != "" {
+		return comparer.NewFixtureTarget(targetConfig.FixtureFile)
+	}
+	api, err := newPromAPI(targetConfig)
+	if err != nil {
+		return nil, err
+	}
+	if targetConfig.RetryConfig != nil {
+		retryConfig = *targetConfig.RetryConfig
+	}
+	retrying := comparer.NewRetryingAPI(comparer.NewRateLimitedAPI(api, targetConfig.MaxQueriesPerSecond, waits, name), retryConfig, waits, name)
+	return comparer.NewAPITarget(comparer.NewCircuitBreakerAPI(retrying, retryConfig, name)), nil
+}
+
 type roundTripperWithSettings struct {
+	next          http.RoundTripper
 	headers       map[string]string
 	basicAuthUser string
 	basicAuthPass string
+	bearerToken   string
 }
 
 func (rt roundTripperWithSettings) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -46,118 +128,749 @@ func (rt roundTripperWithSettings) RoundTrip(req *http.Request) (*http.Response,
 	if rt.basicAuthUser != "" {
 		req.SetBasicAuth(rt.basicAuthUser, rt.basicAuthPass)
 	}
+	if rt.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+rt.bearerToken)
+	}
 
 	for key, value := range rt.headers {
 		req.Header.Add(key, value)
 	}
-	return http.DefaultTransport.RoundTrip(req)
+	return rt.next.RoundTrip(req)
+}
+
+// httpMethodRoundTripper sends query requests with a fixed HTTP method, moving the query parameters
+// between the URL of GET requests and the form-encoded body of POST requests.
+type httpMethodRoundTripper struct {
+	next   http.RoundTripper
+	method config.HTTPMethod
+}
+
+func (rt httpMethodRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case rt.method == config.HTTPMethodGet && req.Method == http.MethodPost:
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		get := req.Clone(req.Context())
+		get.Method, get.Body, get.ContentLength = http.MethodGet, nil, 0
+		get.Header.Del("Content-Type")
+		get.URL.RawQuery = string(body)
+		if req.URL.RawQuery != "" {
+			get.URL.RawQuery = req.URL.RawQuery + "&" + string(body)
+		}
+		return rt.next.RoundTrip(get)
+	case rt.method == config.HTTPMethodPost && req.Method == http.MethodGet:
+		post := req.Clone(req.Context())
+		post.Method = http.MethodPost
+		post.URL.RawQuery = ""
+		post.Body = ioutil.NopCloser(strings.NewReader(req.URL.RawQuery))
+		post.ContentLength = int64(len(req.URL.RawQuery))
+		post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return rt.next.RoundTrip(post)
+	}
+	return rt.next.RoundTrip(req)
 }
 
 func main() {
 	configFile := flag.String("config-file", "promql-compliance-tester.yml", "The path to the configuration file.")
-	outputFormat := flag.String("output-format", "text", "The comparison output format. Valid values: [text, html, json]")
+	outputFormat := flag.String("output-format", "text", "The comparison output format. Valid values: [text, html, json, tsv, junit, sqlite, markdown]")
+	outputFile := flag.String("output-file", "", "The file to write the comparison output to. Defaults to stdout. Required for the sqlite output format, which appends a run to the database file.")
 	outputHTMLTemplate := flag.String("output-html-template", "./output/example-output.html", "The HTML template to use when using HTML as the output format.")
+	htmlPaginate := flag.Int("html-paginate", 0, "If positive, split HTML output into pages with this many test cases each, written to -html-output-dir.")
+	htmlOutputDir := flag.String("html-output-dir", "", "The directory to write paginated HTML output to.")
+	validateTemplate := flag.Bool("validate-template", false, "Execute -output-html-template against a synthetic report covering all outcomes, with -html-paginate if set, report any errors, and exit. Flags set in the configuration file do not apply, since it is not read. HTML output validates the template the same way before running the test cases.")
+	locale := flag.String("locale", "", "The locale whose number formatting to use in the text and html reports, e.g. de_DE. Other output formats are not localized.")
+	historyFile := flag.String("history-file", "", "If set, append the pass counts and the failing test cases of the run to this file, and chart the pass rate trends of the recorded runs in the html report.")
+	historyRuns := flag.Int("history-runs", 20, "The number of recorded runs to chart in the html report, including the current run.")
+	historyRegressionWindow := flag.Int("history-regression-window", 7, "The number of recorded runs in -history-file whose mean pass rates, overall, per category, and per query template, the current run is compared with. Drops are reported as regressions in the text, html, and json reports and in notifications. Zero disables the comparison.")
+	historyRegressionThreshold := flag.Float64("history-regression-threshold", 5, "The drop in percentage points below the trailing mean pass rate that counts as a regression.")
+	baselineFile := flag.String("baseline", "", "The JSON report of an earlier run, as written by -output-format json with or without -incremental-output, to compare the outcomes of the test cases with. Newly failing, newly erroring, and newly passing test cases are logged and included in -summary-file, and the run only fails, with exit status 4, if test cases regressed. -fail-threshold does not apply.")
+	failOnDeadRules := flag.Bool("fail-on-dead-rules", false, "Exit with a non-zero status if any result label tweak or query rename of the query tweaks, or any recording rule, never applied during the run, unless -no-fail is set.")
+	failOnHistoryRegression := flag.Bool("fail-on-history-regression", false, "Exit with status 3 if any pass rate regressed against -history-file, unless -no-fail is set.")
 	outputPassing := flag.Bool("output-passing", false, "Whether to also include passing test cases in the output.")
+	allowRawBraces := flag.Bool("allow-raw-braces", false, "Pass queries with unresolvable template placeholders through literally instead of failing.")
+	histogramDiagnostics := flag.Bool("histogram-diagnostics", true, "Whether to check the raw buckets of failing histogram_quantile() queries for non-monotonic counts.")
+	selectorDiagnostics := flag.Int("selector-diagnostics", 20, "The number of failing bare selector queries per test target for which the test target is probed for the missing series, to tell whether they exist only outside the queried window, exist with different labels, or are absent entirely. Each probe takes up to two extra queries. Zero disables the probes.")
+	var queryInclude, queryExclude string
+	flag.StringVar(&queryInclude, "query-include", "", "If set, only run test cases whose query template matches this regular expression.")
+	flag.StringVar(&queryInclude, "query-filter", "", "Alias for -query-include.")
+	flag.StringVar(&queryExclude, "query-exclude", "", "If set, skip test cases whose query template matches this regular expression. Applied after -query-include.")
+	flag.StringVar(&queryExclude, "query-skip", "", "Alias for -query-exclude.")
+	includeTags := flag.String("include-tags", "", "If set, only run test cases with at least one of these comma-separated tags.")
+	excludeTags := flag.String("exclude-tags", "", "If set, skip test cases with any of these comma-separated tags.")
+	diffMaxSamples := flag.Int("diff-max-samples", 10, "The maximum number of mismatched samples to list per series for failing test cases.")
+	diffMaxLines := flag.Int("diff-max-lines", 100, "The maximum number of lines of the result diff and of the list of differing series and samples shown for failing test cases.")
+	maxClockDrift := flag.Duration("max-clock-drift", 5*time.Second, "Warn if a target's clock is estimated to drift from the local clock by more than this. The estimated drift of each target is included in -summary-file.")
+	autoCorrectClockSkew := flag.Bool("auto-correct-clock-skew", false, "Shift the query timestamps of targets whose clock drift exceeds -max-clock-drift by the estimated drift.")
+	badgeFile := flag.String("badge-file", "", "If set, write an SVG badge showing the pass rate of the run to this file.")
+	badgeEndpointFile := flag.String("badge-endpoint-file", "", "If set, write a shields.io endpoint badge file showing the pass rate of the run to this file.")
+	badgePrecision := flag.Int("badge-precision", 1, "The number of decimals of the pass rate shown by -badge-file and -badge-endpoint-file. The pass rate is rounded down.")
+	badgeColors := flag.String("badge-colors", output.DefaultBadgeColors, "The comma-separated <percent>:<color> thresholds of -badge-file and -badge-endpoint-file. A badge gets the color of the highest threshold that the pass rate reaches. Colors are shields.io color names or hex values.")
+	badgeInformationalRuns := flag.Bool("badge-informational-runs", false, "Also write -badge-file and -badge-endpoint-file for interrupted runs and runs with -chaos, whose pass rates are not compliance data.")
+	summaryFile := flag.String("summary-file", "", "If set, write a JSON summary of the run with the outcome counts and the failed queries to this file.")
+	failedQueryOrder := flag.String("failed-query-order", failedQueryOrderIndex, fmt.Sprintf("The order of the failed queries listed after the run and in -summary-file. Valid values: %s (the order of the test cases), %s (alphabetical).", failedQueryOrderIndex, failedQueryOrderQuery))
+	notificationWebhookURL := flag.String("notification-webhook-url", "", "If set, post a JSON notification with the outcome counts, the most common failure fingerprints, and the newly failing test cases since the previous -history-file run to this URL after the run.")
+	notificationReportLink := flag.String("notification-report-link", "", "The URL of the full report to include in notifications. Defaults to -output-file.")
+	notificationMaxBytes := flag.Int("notification-max-bytes", 64*1024, "The maximum size of notification payloads, which are truncated progressively to fit.")
+	notificationMaxBuckets := flag.Int("notification-max-buckets", 10, "The maximum number of failure fingerprints listed in notifications.")
+	notificationMaxNewlyFailing := flag.Int("notification-max-newly-failing", 50, "The maximum number of newly failing test cases listed in notifications.")
+	noFail := flag.Bool("no-fail", false, "Exit with a zero status even if -fail-threshold is exceeded.")
+	failThreshold := flag.Float64("fail-threshold", 100, "Exit with a non-zero status if the percentage of test cases that failed or could not be executed exceeds this.")
+	forbidCachedResponses := flag.Bool("forbid-cached-responses", false, "Exit with a non-zero status if any test response shows evidence of being served from a cache, see response_headers.")
+	maxRequestDrift := flag.Float64("max-request-drift", 100, "Exit with a non-zero status if the percentage of test cases checked for request parity (see request_parity_sample_rate) that sent differing query parameters to the targets exceeds this.")
+	metricsListenAddress := flag.String("metrics-listen-address", "", "If set, serve Prometheus metrics about the progress and outcomes of the run on this address, e.g. :9099, under /metrics. The server stops when the run ends.")
+	timeJitter := flag.Duration("time-jitter", 0, "If positive, shift the window of each test case back by a pseudo-random amount of less than this, so that window boundaries do not always fall on the same offset within scrape intervals. The reference and test queries of a test case are shifted alike. Test cases with pin_window are not shifted.")
+	timeJitterSeed := flag.Int64("time-jitter-seed", 0, "The seed that the -time-jitter of each test case is derived from, to reproduce the windows of an earlier run. If zero, a seed is picked at random, logged, and written to -summary-file.")
+	maxRetryWait := flag.Duration("max-retry-wait", 0, "If positive, stop retrying queries for the remainder of the run once the backoff and failed attempts of retried queries against all targets added up to this. Concurrent retries add up.")
+	runTimeout := flag.Duration("run-timeout", 0, "If positive, stop starting comparisons once the run took this long, like on SIGINT: the in-flight comparisons complete, the remaining test cases are reported as not run, and the report is written for the completed ones.")
+	slowQueryThreshold := flag.Duration("slow-query-threshold", 0, "If positive, log the test cases whose test query took longer than this after the run, slowest first.")
+	warnHeadroom := flag.Float64("warn-headroom", 0, "If positive, warn about passing test cases that used up more than this fraction of their value tolerance, e.g. 0.8 for 80%, to spot numeric drift before it makes them fail.")
+	latencyWarnRatio := flag.Float64("latency-warn-ratio", 0, "If positive, warn about passing test cases whose test query took more than this many times as long as the reference query.")
+	ignoreRetentionCheck := flag.Bool("ignore-retention-check", false, "Run test cases even if their window starts before the earliest sample of a target, instead of skipping them as outside retention.")
+	parallelism := flag.Int("parallelism", 1, "The number of test cases to compare concurrently.")
+	concurrency := flag.String("concurrency", "", "The number of test cases to compare concurrently, overriding -parallelism, or auto to start at 2 and adapt it to the test target: it increases while the p95 latency of the test queries stays within -concurrency-latency-ceiling, and backs off multiplicatively on timeouts, retries, 429 and 5xx responses, up to -max-concurrency.")
+	maxConcurrency := flag.Int("max-concurrency", 16, "The maximum number of test cases to compare concurrently with -concurrency auto.")
+	concurrencyLatencyCeiling := flag.Duration("concurrency-latency-ceiling", 2*time.Second, "The p95 latency of the test queries up to which -concurrency auto increases the concurrency.")
+	explainCase := flag.String("explain-case", "", "Print the resolved settings of the expanded test case with this 1-based index or exact query, showing which configuration layer set each of them, and exit. For a query that the filter flags left out, print why instead.")
+	referenceCacheDir := flag.String("reference-cache-dir", "", "If set, cache the responses of the reference target in this directory and answer repeated queries from it in later runs. Requires a fixed end_time in query_time_parameters.")
+	referenceCacheRefresh := flag.Bool("reference-cache-refresh", false, "Query the reference target again and replace the responses cached in -reference-cache-dir.")
+	recordDir := flag.String("record-dir", "", "If set, record the responses of the reference and test targets to fixture files in this directory for -recompare-dir.")
+	recompareDir := flag.String("recompare-dir", "", "If set, compare the responses recorded in this directory by -record-dir again with the current configuration instead of querying the targets.")
+	noDedup := flag.Bool("no-dedup", false, "Run expanded test cases that send the same query with the same time parameters as an earlier test case, instead of skipping them.")
+	dryRun := flag.Bool("dry-run", false, "Print the expanded test cases and the test case templates expanding into the most queries in the text or json -output-format and exit without querying the targets.")
+	streamWindow := flag.Int("stream-window", 0, "If positive, stream test cases and results instead of holding all of them in memory, with at most this many test cases in flight. Only supported by the text, tsv, and json output formats, which then writes JSON lines like -incremental-output.")
+	incrementalOutput := flag.Bool("incremental-output", false, "Write the json output as JSON lines, appending a record to it as soon as each comparison completes and a summary record at the end, so that the output of a run that dies still holds all completed results. Streams the test cases like -stream-window, with a window of 4 times -parallelism if that is not set.")
+	targetVersion := flag.String("target-version", "", "The version of the test target, e.g. v0.9.0, that the json output is stamped with for -version-matrix.")
+	stableOutput := flag.Bool("stable-output", false, "Sort the results of the json, tsv, junit, and sqlite outputs by test case ID, and the keys of all objects of the json output, -history-file, and -summary-file by name, so that the outputs of runs with the same results are byte-identical. Results streamed with -stream-window or -incremental-output stay in the order of the test cases.")
+	versionMatrix := flag.String("version-matrix", "", "Compare the comma-separated JSON reports of earlier runs against different versions of the test target, ordered from the oldest to the newest, and exit. Writes the pass rates of the test case categories per version and the newly fixed and newly broken test cases between adjacent versions in the markdown, html, or csv -output-format. Only the test cases in all reports are compared. Versions are read from -target-version, or default to the file names.")
+	lenientConfig := flag.Bool("lenient-config", false, "Skip invalid test case entries of the configuration file and its included test case files, and report them, instead of failing to load the configuration. Same as on_invalid_case: skip.")
+	validateOnly := flag.Bool("validate-only", false, "Load and validate the configuration file, including that no test case template expands into more than max_expansions_per_case queries, print the test case templates expanding into the most queries, and exit without querying the targets.")
+	printConfig := flag.Bool("print-config", false, "Print the resolved value of each flag and whether it was set by its default, the flags section of the configuration file, its PROMQL_COMPLIANCE_ environment variable, or the command line, and exit.")
+	chaos := flag.Bool("chaos", false, "Inject the faults configured in the chaos sections of the targets into their requests. For testing the tester itself, the results are marked as chaos and not recorded in -history-file.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		printDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), exitCodeHelp)
+	}
 	flag.Parse()
+	// The configuration file to load may be set by an environment variable, so the environment
+	// is applied before loading it, and again with the flags section of the configuration file.
+	opts := newOptions(flag.CommandLine, os.LookupEnv)
+	if err := opts.resolve(nil); err != nil {
+		log.Fatalf("Error resolving flags: %v", err)
+	}
+	if *versionMatrix != "" {
+		// The version matrix only reads earlier reports, so that no configuration file is needed.
+		if err := output.SetLocale(*locale); err != nil {
+			log.Fatalf("Invalid -locale: %v", err)
+		}
+		if err := writeVersionMatrix(*versionMatrix, *outputFormat, *outputFile); err != nil {
+			log.Fatalf("Error writing the version matrix: %v", err)
+		}
+		return
+	}
+	if *validateTemplate {
+		// Like the version matrix, validating a template needs no valid configuration file.
+		if err := output.ValidateHTMLTemplate(*outputHTMLTemplate, *htmlPaginate); err != nil {
+			log.Fatalf("Invalid HTML template: %v", err)
+		}
+		log.Infof("HTML template %q is valid.", *outputHTMLTemplate)
+		return
+	}
+	cfg, placeholders, placeholderCoverage, err := loadConfig(*configFile, *lenientConfig)
+	if err != nil {
+		log.Fatalf("Error loading configuration file: %v", err)
+	}
+	logInvalidTestCases(cfg.InvalidTestCases)
+	for _, u := range cfg.UnsetEnvVars {
+		log.Warnf("Environment variable %q in %s is not set and expanded to an empty string, write $$ for a literal $ or set strict_env_expansion to make this an error", u.Variable, u.Field)
+	}
+	for _, c := range placeholderCoverage {
+		log.Warnf("Placeholder %s is restricted to %d of its %d values, leaving out %s", c.Placeholder, len(c.Values), len(c.Values)+len(c.Omitted), strings.Join(c.Omitted, ", "))
+	}
+	for _, e := range testcases.EmptyExpansions(cfg.TestCases, placeholders) {
+		log.Warnf("Test case template %q is not expanded, since placeholder %s has no values", e.Query, e.Placeholder)
+	}
+	if err := opts.resolve(cfg.Flags); err != nil {
+		log.Fatalf("Error resolving flags: %v", err)
+	}
+	if *printConfig {
+		if err := opts.print(os.Stdout); err != nil {
+			log.Fatalf("Error printing the resolved flags: %v", err)
+		}
+		return
+	}
+	if *validateOnly {
+		writeValidation(os.Stdout, *configFile, cfg, placeholders)
+		return
+	}
+	runStart := time.Now()
+	var runDeadline time.Time
+	if *runTimeout > 0 {
+		runDeadline = runStart.Add(*runTimeout)
+	}
+
+	if *failedQueryOrder != failedQueryOrderIndex && *failedQueryOrder != failedQueryOrderQuery {
+		log.Fatalf("Invalid -failed-query-order %q", *failedQueryOrder)
+	}
+	if err := output.SetLocale(*locale); err != nil {
+		log.Fatalf("Invalid -locale: %v", err)
+	}
+	output.SetTargetVersion(*targetVersion)
+	output.SetStableOutput(*stableOutput)
+	var badges *badgeFiles
+	if *badgeFile != "" || *badgeEndpointFile != "" {
+		if *badgePrecision < 0 {
+			log.Fatalf("Invalid -badge-precision %d, must not be negative", *badgePrecision)
+		}
+		thresholds, err := output.ParseBadgeThresholds(*badgeColors)
+		if err != nil {
+			log.Fatalf("Invalid -badge-colors: %v", err)
+		}
+		badges = &badgeFiles{svgFile: *badgeFile, endpointFile: *badgeEndpointFile, opts: output.BadgeOptions{Precision: *badgePrecision, Thresholds: thresholds}, informational: *badgeInformationalRuns}
+	}
+
+	var baseline *output.HistoryBaseline
+	if *historyFile != "" && *historyRegressionWindow > 0 {
+		runs, err := output.ReadHistory(*historyFile, *historyRegressionWindow)
+		if err != nil {
+			log.Fatalf("Error reading history file: %v", err)
+		}
+		baseline = &output.HistoryBaseline{Runs: runs, Threshold: *historyRegressionThreshold}
+	}
+	var baselineOutcomes []output.CaseOutcome
+	if *baselineFile != "" {
+		var err error
+		if baselineOutcomes, err = output.ReadBaseline(*baselineFile); err != nil {
+			log.Fatalf("Error reading baseline: %v", err)
+		}
+	}
 
 	var outp output.Outputter
 	switch *outputFormat {
 	case "text":
-		outp = output.Text
+		outp = output.TextWithHistory(baseline)
 	case "html":
+		var history []*output.HistoryRecord
+		if *historyFile != "" {
+			var err error
+			history, err = output.ReadHistory(*historyFile, *historyRuns-1)
+			if err != nil {
+				log.Fatalf("Error reading history file: %v", err)
+			}
+		}
 		var err error
-		outp, err = output.HTML(*outputHTMLTemplate)
+		outp, err = output.HTML(*outputHTMLTemplate, *htmlPaginate, *htmlOutputDir, history, baseline)
 		if err != nil {
-			log.Fatalf("Error reading output HTML template: %v", err)
+			log.Fatalf("Error setting up HTML output: %v", err)
 		}
 	case "json":
-		outp = output.JSON
+		outp = output.JSONWithHistory(baseline)
 	case "tsv":
 		outp = output.TSV
+	case "markdown":
+		outp = output.Markdown
+	case "junit":
+		outp = output.JUnit
+	case "sqlite":
+		// The SQLite database is written by output.WriteSQLite instead of an outputter.
+		if *outputFile == "" {
+			log.Fatalf("-output-format sqlite requires -output-file")
+		}
 	default:
 		log.Fatalf("Invalid output format %q", *outputFormat)
 	}
 
-	cfg, err := config.LoadFromFile(*configFile)
+	if *dryRun && *outputFormat != "text" && *outputFormat != "json" {
+		log.Fatalf("Invalid output format %q for -dry-run, must be text or json", *outputFormat)
+	}
+	if *recordDir != "" && *recompareDir != "" {
+		log.Fatalf("-record-dir and -recompare-dir are mutually exclusive")
+	}
+	var limiter *concurrencyLimiter
+	if *concurrency != "" {
+		n, err := parseConcurrency(*concurrency)
+		if err != nil {
+			log.Fatalf("Error parsing flags: %v", err)
+		}
+		*parallelism = n
+		if n == 0 {
+			if *maxConcurrency < 1 {
+				log.Fatalf("Invalid max concurrency %d, must be at least 1", *maxConcurrency)
+			}
+			if *concurrencyLatencyCeiling <= 0 {
+				log.Fatalf("Invalid concurrency latency ceiling %v, must be positive", *concurrencyLatencyCeiling)
+			}
+			// Run as many workers as the concurrency may grow to, of which the limiter lets some compare.
+			*parallelism = *maxConcurrency
+			limiter = newConcurrencyLimiter(newConcurrencyController(*maxConcurrency, *concurrencyLatencyCeiling))
+		}
+	}
+	if *warnHeadroom < 0 || *warnHeadroom > 1 {
+		log.Fatalf("Invalid -warn-headroom %v, must be between 0 and 1", *warnHeadroom)
+	}
+	if *parallelism < 1 {
+		log.Fatalf("Invalid parallelism %d, must be at least 1", *parallelism)
+	}
+	if *incrementalOutput {
+		if *outputFormat != "json" {
+			log.Fatalf("-incremental-output requires -output-format json")
+		}
+		if *streamWindow <= 0 {
+			*streamWindow = 4 * *parallelism
+		}
+	}
+	if *streamWindow > 0 {
+		if _, err := output.NewStreamOutputter(*outputFormat, ioutil.Discard, false, nil); err != nil {
+			log.Fatalf("Invalid -stream-window: %v", err)
+		}
+	}
+
+	includeRe, err := compileOptionalRegexp("query-include", queryInclude)
 	if err != nil {
-		log.Fatalf("Error loading configuration file: %v", err)
+		log.Fatalf("Error parsing flags: %v", err)
+	}
+	excludeRe, err := compileOptionalRegexp("query-exclude", queryExclude)
+	if err != nil {
+		log.Fatalf("Error parsing flags: %v", err)
 	}
-	refAPI, err := newPromAPI(cfg.ReferenceTargetConfig)
+
+	includeTagList, err := parseTags("include-tags", *includeTags)
 	if err != nil {
-		log.Fatalf("Error creating reference API: %v", err)
+		log.Fatalf("Error parsing flags: %v", err)
 	}
-	testAPI, err := newPromAPI(cfg.TestTargetConfig)
+	excludeTagList, err := parseTags("exclude-tags", *excludeTags)
 	if err != nil {
-		log.Fatalf("Error creating test API: %v", err)
+		log.Fatalf("Error parsing flags: %v", err)
 	}
 
-	comp := comparer.New(refAPI, testAPI, cfg.QueryTweaks)
+	setupChaos(cfg, *chaos)
+	if *recompareDir != "" {
+		if err := useRecordedFixtures(cfg, *recompareDir); err != nil {
+			log.Fatalf("Error reading recorded responses: %v", err)
+		}
+	}
+	selectedTestCases, filteredTestCases := filterTestCases(cfg.TestCases, testCaseFilter{
+		include:     includeRe,
+		exclude:     excludeRe,
+		includeTags: includeTagList,
+		excludeTags: excludeTagList,
+	})
+	if len(selectedTestCases) == 0 && *explainCase == "" {
+		log.Fatalf("No test cases selected out of %d, check -query-include, -query-exclude, -include-tags, and -exclude-tags", len(cfg.TestCases))
+	}
+	log.Infof("Selected %d of %d test cases, %d filtered out", len(selectedTestCases), len(cfg.TestCases), len(cfg.TestCases)-len(selectedTestCases))
 
-	end := getTime(cfg.QueryTimeParameters.EndTime, time.Now().UTC().Add(-2*time.Minute))
-	start := end.Add(
-		-getNonZeroDuration(cfg.QueryTimeParameters.RangeInSeconds, 10*time.Minute))
-	resolution := getNonZeroDuration(
-		cfg.QueryTimeParameters.ResolutionInSeconds, 10*time.Second)
-	expandedTestCases := testcases.ExpandTestCases(cfg.TestCases, cfg.QueryTweaks, start, end, resolution)
+	ranges := timeRanges(cfg.QueryTimeParameters, time.Now().UTC().Add(-2*time.Minute))
+	if *timeJitter < 0 {
+		log.Fatalf("-time-jitter %v must not be negative", *timeJitter)
+	}
+	var jitterSeed int64
+	if *timeJitter > 0 {
+		jitterSeed = *timeJitterSeed
+		for jitterSeed == 0 {
+			jitterSeed = rand.New(rand.NewSource(time.Now().UnixNano())).Int63()
+		}
+		log.Infof("Shifting test case windows back by up to %v with -time-jitter-seed %d", *timeJitter, jitterSeed)
+		for i := range ranges {
+			ranges[i].Jitter = *timeJitter
+			ranges[i].JitterSeed = jitterSeed
+		}
+	}
+	if *dryRun {
+		expandedTestCases, err := testcases.ExpandTestCases(selectedTestCases, placeholders, cfg.QueryTweaks, ranges, *allowRawBraces)
+		if err != nil {
+			log.Fatalf("Error expanding test cases: %v", err)
+		}
+		if err := writeDryRun(os.Stdout, *outputFormat, expandedTestCases, testcases.TopExpansions(selectedTestCases, placeholders, maxListedExpansions), cfg.Requirements(), placeholderCoverage, filteredTestCases, jitterSeed); err != nil {
+			log.Fatalf("Error writing dry run output: %v", err)
+		}
+		return
+	}
 
-	progressBar := pb.StartNew(len(expandedTestCases))
-	results := make([]*comparer.Result, 0, len(cfg.TestCases))
-	var errors []error
-	var failedQueries []string
-	for _, tc := range expandedTestCases {
-		res, err := comp.Compare(tc)
+	waits := comparer.NewWaitBudget(*maxRetryWait)
+	ruleUsage := comparer.NewRuleUsage(cfg.QueryTweaks, cfg.RecordingRules)
+	refTarget, err := newQueryTarget(cfg.ReferenceTargetConfig, cfg.RetryConfig, waits, "reference")
+	if err != nil {
+		log.Fatalf("Error creating reference target: %v", err)
+	}
+	if len(cfg.ReferenceFallbackTargetConfigs) > 0 {
+		var names []string
+		var fallbacks []comparer.QueryTarget
+		for i, fc := range cfg.ReferenceFallbackTargetConfigs {
+			fallback, err := newQueryTarget(fc, cfg.RetryConfig, waits, "reference fallback "+fc.DisplayName())
+			if err != nil {
+				log.Fatalf("Error creating fallback reference target %d: %v", i+1, err)
+			}
+			names = append(names, fc.DisplayName())
+			fallbacks = append(fallbacks, fallback)
+		}
+		refTarget = comparer.NewFallbackTarget(refTarget, names, fallbacks)
+	}
+	var clockDrifts []clockDrift
+	refTarget, drift := checkClockDrift("reference", cfg.ReferenceTargetConfig, refTarget, *maxClockDrift, *autoCorrectClockSkew)
+	if drift != nil {
+		clockDrifts = append(clockDrifts, *drift)
+	}
+	if *referenceCacheDir != "" {
+		refTarget = cacheReferenceTarget(cfg, refTarget, *referenceCacheDir, *referenceCacheRefresh)
+	}
+	var recorder *fixtureRecorder
+	if *recordDir != "" {
+		if recorder, err = newFixtureRecorder(*recordDir); err != nil {
+			log.Fatalf("Error creating -record-dir: %v", err)
+		}
+		refTarget = recorder.wrap(fixtureFileName(*recordDir, false, cfg, 0), refTarget)
+	}
+
+	// With several test targets, each comparer is named after its test target and they share the reference results.
+	var (
+		comps       []*comparer.Comparer
+		testTargets []comparer.QueryTarget
+	)
+	var errorMatchRe *regexp.Regexp
+	if cfg.ErrorMatchRegexp != "" {
+		// The configuration validates the regular expression.
+		errorMatchRe = regexp.MustCompile(cfg.ErrorMatchRegexp)
+	}
+	cacheHitPatterns := map[string]*regexp.Regexp{}
+	for name, p := range cfg.ResponseHeaders.CacheHitPatterns {
+		// The configuration validates the regular expressions.
+		cacheHitPatterns[name] = regexp.MustCompile(p)
+	}
+	for i, tc := range cfg.TestTargetConfigs {
+		name, driftName := "", "test"
+		if len(cfg.TestTargetConfigs) > 1 {
+			name, driftName = tc.DisplayName(), fmt.Sprintf("test %q", tc.DisplayName())
+		}
+		testTarget, err := newQueryTarget(tc, cfg.RetryConfig, waits, driftName)
+		if err != nil {
+			log.Fatalf("Error creating test target %q: %v", tc.DisplayName(), err)
+		}
+		testTarget, drift := checkClockDrift(driftName, tc, testTarget, *maxClockDrift, *autoCorrectClockSkew)
+		if drift != nil {
+			clockDrifts = append(clockDrifts, *drift)
+		}
+		if recorder != nil {
+			testTarget = recorder.wrap(fixtureFileName(*recordDir, true, cfg, i), testTarget)
+		}
+		testTargets = append(testTargets, testTarget)
+
+		comps = append(comps, comparer.New(refTarget, testTarget, cfg.QueryTweaks, comparer.Options{
+			DifferingErrorsPolicy:      cfg.DifferingErrorsPolicy,
+			ErrorMatchRegexp:           errorMatchRe,
+			RefQueryTimeout:            secondsToDuration(cfg.ReferenceTargetConfig.QueryTimeoutSeconds),
+			TestQueryTimeout:           secondsToDuration(tc.QueryTimeoutSeconds),
+			TestTargetName:             name,
+			RefResponseLimits:          responseLimits(cfg.ReferenceTargetConfig),
+			TestResponseLimits:         responseLimits(tc),
+			Tolerance:                  cfg.Tolerance,
+			MaxDiffSamples:             *diffMaxSamples,
+			MaxDiffLines:               *diffMaxLines,
+			NaNMissingPolicy:           cfg.InstantNaNVsMissing,
+			OutOfOrderPolicy:           cfg.OutOfOrderSamples,
+			RecordingRules:             cfg.RecordingRules,
+			HistogramDiagnostics:       *histogramDiagnostics,
+			SelectorDiagnosticsLimit:   *selectorDiagnostics,
+			LatencyWarnRatio:           *latencyWarnRatio,
+			HeadroomWarnRatio:          *warnHeadroom,
+			LabelConformanceSampleRate: cfg.LabelConformanceSampleRate,
+			ExactnessSampleRate:        cfg.ExactnessAuditSampleRate,
+			SeriesAllowance:            cfg.SeriesAllowance,
+			CompareWarnings:            cfg.CompareWarnings,
+			RequestParitySampleRate:    cfg.RequestParitySampleRate,
+			Chaos:                      *chaos,
+			ResponseHeaders:            cfg.ResponseHeaders.Capture,
+			CacheHitPatterns:           cacheHitPatterns,
+			RuleUsage:                  ruleUsage,
+		}))
+	}
+
+	budgets := newTimeBudgets(cfg.CategoryTimeBudgets, cfg.TagTimeBudgets)
+	var retention *retentionHorizons
+	if !*ignoreRetentionCheck && *explainCase == "" {
+		retention = probeRetentionHorizons(cfg, refTarget, testTargets, earliestWindowStart(selectedTestCases, ranges), latestEnd(ranges))
+	}
+	ctx := withRunTimeout(interruptContext(), runDeadline, *runTimeout)
+	gate := runGate{summaryFile: *summaryFile, historyFile: *historyFile, failThreshold: *failThreshold, noFail: *noFail, maxRequestDrift: *maxRequestDrift, forbidCachedResponses: *forbidCachedResponses, baseline: baseline, failOnHistoryRegression: *failOnHistoryRegression, baselineOutcomes: baselineOutcomes, timeJitterSeed: jitterSeed, waits: waits, ruleUsage: ruleUsage, failOnDeadRules: *failOnDeadRules, runStart: runStart, options: opts.resolved(), failedQueryOrder: *failedQueryOrder, retentionHorizons: retention.summary(), clockDrifts: clockDrifts, recorder: recorder, placeholders: placeholderCoverage, invalidTestCases: cfg.InvalidTestCases, filteredTestCases: filteredTestCases, badges: badges}
+	if *notificationWebhookURL != "" {
+		gate.notifier = &webhookNotifier{
+			url:        *notificationWebhookURL,
+			reportLink: reportLink(*notificationReportLink, *outputFile),
+			limits: output.NotificationLimits{
+				MaxBytes:        *notificationMaxBytes,
+				MaxBuckets:      *notificationMaxBuckets,
+				MaxNewlyFailing: *notificationMaxNewlyFailing,
+			},
+			baseline: baseline,
+		}
+	}
+	if *explainCase != "" {
+		expandedTestCases, err := testcases.ExpandTestCases(selectedTestCases, placeholders, cfg.QueryTweaks, ranges, *allowRawBraces)
+		if err != nil {
+			log.Fatalf("Error expanding test cases: %v", err)
+		}
+		filteredExpansions, err := expandFiltered(filteredTestCases, placeholders, cfg.QueryTweaks, ranges, *allowRawBraces)
 		if err != nil {
-			log.Errorf("Error running comparison: %v", err)
-			errors = append(errors, err)
-			failedQueries = append(failedQueries, tc.Query)
+			log.Fatalf("Error expanding test cases: %v", err)
+		}
+		if err := explainTestCase(os.Stdout, comps[0], expandedTestCases, filteredExpansions, budgets, *explainCase); err != nil {
+			log.Fatalf("Error explaining test case: %v", err)
+		}
+		return
+	}
+	if reqs := cfg.Requirements(); len(reqs) > 0 {
+		if *recompareDir != "" {
+			log.Infof("Not checking the declared requirements, since the responses are replayed from -recompare-dir")
 		} else {
-			results = append(results, res)
+			end := latestEnd(ranges)
+			var ok bool
+			gate.requirements, ok = checkRequirements(ctx, reqs, comps[0], end.Sub(earliestWindowStart(selectedTestCases, ranges)), end)
+			if !ok {
+				gate.exitOnUnmetRequirements()
+			}
 		}
-		progressBar.Increment()
 	}
-	progressBar.Finish()
+	if ip := cfg.IngestionParity; ip != nil {
+		end := latestEnd(ranges)
+		var ok bool
+		gate.ingestion, ok = checkIngestionParity(ctx, ip, comps, end.Sub(earliestWindowStart(selectedTestCases, ranges)), end)
+		if !ok {
+			gate.exitOnIngestionParity()
+		}
+	}
+	var metrics *liveMetrics
+	if *metricsListenAddress != "" {
+		if metrics, err = serveMetrics(*metricsListenAddress); err != nil {
+			log.Fatalf("Error serving metrics: %v", err)
+		}
+	}
+	if *streamWindow > 0 {
+		removed := 0
+		produce := func(fn func(*comparer.TestCase) error) error {
+			dedup := testcases.NewDeduplicator()
+			defer func() { removed = dedup.Removed }()
+			return testcases.StreamTestCases(selectedTestCases, placeholders, cfg.QueryTweaks, ranges, *allowRawBraces, func(tc *comparer.TestCase) error {
+				if !*noDedup && !dedup.Keep(tc) {
+					return nil
+				}
+				return fn(tc)
+			})
+		}
+		total := 0
+		if err := produce(func(*comparer.TestCase) error { total++; return nil }); err != nil {
+			log.Fatalf("Error expanding test cases: %v", err)
+		}
+		logDuplicates(removed)
+		metrics.setTestCases(total)
+		runStreaming(ctx, comps, produce, total, *parallelism, limiter, *streamWindow, budgets, retention, metrics, *outputFormat, *outputFile, *outputPassing, cfg.QueryTweaks, gate, *slowQueryThreshold)
+		return
+	}
 
-	totalTests := len(expandedTestCases)
-	successfulTests := len(results)
-	errorCount := len(errors)
-	successRate := float64(successfulTests) / float64(totalTests) * 100
-	errorRate := float64(errorCount) / float64(totalTests) * 100
+	expandedTestCases, err := testcases.ExpandTestCases(selectedTestCases, placeholders, cfg.QueryTweaks, ranges, *allowRawBraces)
+	if err != nil {
+		log.Fatalf("Error expanding test cases: %v", err)
+	}
+	if !*noDedup {
+		var removed int
+		expandedTestCases, removed = testcases.DedupTestCases(expandedTestCases)
+		logDuplicates(removed)
+	}
 
-	log.Infof("Test execution summary:")
-	log.Infof("  Total test cases: %d", totalTests)
-	log.Infof("  Successful: %d (%.2f%%)", successfulTests, successRate)
-	log.Infof("  Failed: %d (%.2f%%)", errorCount, errorRate)
+	metrics.setTestCases(len(expandedTestCases))
+	progressBar := pb.StartNew(len(expandedTestCases))
+	caseResults := runComparisons(ctx, comps, expandedTestCases, *parallelism, limiter, budgets, retention, metrics, progressBar)
+	progressBar.Finish()
 
-	if len(errors) > 0 {
-		log.Errorf("Found %d error(s) during test execution:", len(errors))
-		for i, err := range errors {
-			log.Errorf("  Error %d: %v", i+1, err)
+	results := make([]*comparer.Result, 0, len(expandedTestCases)*len(comps))
+	stats := newRunStats(*slowQueryThreshold)
+	stats.trackOutcomes = gate.baselineOutcomes != nil
+	stats.invalid = gate.invalidTestCases
+	stats.filtered = gate.filteredTestCases
+	stats.concurrency = limiter.summary()
+	stats.interrupted = ctx.Err() != nil
+	for i, rs := range caseResults {
+		if rs == nil {
+			// Test cases that were not compared because the run was interrupted have no results.
+			rs = notRunResults(comps, expandedTestCases[i], notRunReason(ctx))
 		}
-
-		log.Errorf("")
-		log.Errorf("Failed queries summary:")
-		log.Errorf("===================")
-		for i, query := range failedQueries {
-			log.Errorf("%d. %s", i+1, query)
+		for j, res := range rs {
+			results = append(results, res)
+			stats.add(i*len(comps)+j, res)
 		}
-		log.Errorf("")
-		log.Errorf("Complete PromQL queries that failed (copy-paste ready):")
-		log.Errorf("=====================================================")
-		for _, query := range failedQueries {
-			log.Errorf("%s", query)
+	}
+
+	logSummary(stats, budgets)
+
+	if *outputFormat == "sqlite" {
+		err = output.WriteSQLite(*outputFile, results)
+	} else {
+		err = writeOutput(*outputFile, outp, results, *outputPassing, cfg.QueryTweaks)
+	}
+	if err != nil {
+		log.Fatalf("Error writing output: %v", err)
+	}
+	gate.finish(stats)
+}
+
+// runStreaming compares the generated test cases and writes each result to the streaming outputter
+// for the given format as soon as it is available, without retaining all results.
+func runStreaming(ctx context.Context, comps []*comparer.Comparer, produce func(func(*comparer.TestCase) error) error, total, parallelism int, limiter *concurrencyLimiter, window int, budgets *timeBudgets, retention *retentionHorizons, metrics *liveMetrics, format, filename string, includePassing bool, tweaks []*config.QueryTweak, gate runGate, slowQueryThreshold time.Duration) {
+	w, err := createOutput(filename)
+	if err != nil {
+		log.Fatalf("Error writing output: %v", err)
+	}
+	outp, err := output.NewStreamOutputter(format, w, includePassing, gate.baseline)
+	if err != nil {
+		log.Fatalf("Error setting up output: %v", err)
+	}
+
+	stats := newRunStats(slowQueryThreshold)
+	stats.trackOutcomes = gate.baselineOutcomes != nil
+	stats.invalid = gate.invalidTestCases
+	stats.filtered = gate.filteredTestCases
+	progressBar := pb.StartNew(total)
+	err = streamComparisons(ctx, comps, produce, parallelism, window, limiter, budgets, retention, metrics, progressBar, func(idx int, results []*comparer.Result) {
+		for j, res := range results {
+			stats.add(idx*len(comps)+j, res)
+			outp.WriteResult(res)
 		}
+	})
+	progressBar.Finish()
+	stats.concurrency = limiter.summary()
+	if err == errInterrupted {
+		stats.interrupted = true
+		// Streamed test cases are generated as they are compared, so that only their number is known.
+		stats.notRun = total*len(comps) - stats.total
+	} else if err != nil {
+		log.Fatalf("Error expanding test cases: %v", err)
+	}
+
+	logSummary(stats, budgets)
+
+	outp.Finish(tweaks)
+	if err := w.Close(); err != nil {
+		log.Fatalf("Error writing output: %v", err)
+	}
+	gate.finish(stats)
+}
+
+// A clockDrift is the estimated drift of a target's clock ahead of the local clock.
+type clockDrift struct {
+	Target       string  `json:"target"`
+	DriftSeconds float64 `json:"driftSeconds"`
+	// Exceeded is set if the drift exceeded -max-clock-drift, and Corrected if the query timestamps
+	// of the target were shifted by it.
+	Exceeded  bool `json:"exceeded,omitempty"`
+	Corrected bool `json:"corrected,omitempty"`
+}
+
+// checkClockDrift estimates the clock drift of an API target. If the drift exceeds the maximum, it
+// warns and, if autoCorrect is set, returns the target corrected for the drift. The estimated drift
+// is returned for the summary file, or nil if it was not estimated.
+func checkClockDrift(name string, targetConfig config.TargetConfig, target comparer.QueryTarget, maxDrift time.Duration, autoCorrect bool) (comparer.QueryTarget, *clockDrift) {
+	if targetConfig.FixtureFile != "" {
+		return target, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	drift, err := comparer.EstimateClockDrift(ctx, target)
+	if err != nil {
+		log.Warnf("Unable to estimate clock drift of %s target: %v", name, err)
+		return target, nil
+	}
+	log.Infof("Estimated clock drift of %s target: %v", name, drift)
+	cd := &clockDrift{Target: name, DriftSeconds: drift.Seconds()}
+	if drift <= maxDrift && drift >= -maxDrift {
+		return target, cd
+	}
+	log.Warnf("Clock drift of %s target exceeds %v", name, maxDrift)
+	cd.Exceeded = true
+	if autoCorrect {
+		// Sample timestamps have millisecond precision.
+		drift = drift.Round(time.Millisecond)
+		log.Infof("Correcting %s target query timestamps by %v", name, drift)
+		cd.Corrected = true
+		return comparer.NewTimeOffsetTarget(target, drift), cd
+	}
+	return target, cd
+}
+
+// writeOutput writes the results to the given file, or to stdout if no file is given.
+func writeOutput(filename string, outp output.Outputter, results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak) error {
+	w, err := createOutput(filename)
+	if err != nil {
+		return err
+	}
+	outp(w, results, includePassing, tweaks)
+	return w.Close()
+}
+
+// createOutput opens the given output file, or stdout if no file is given.
+func createOutput(filename string) (*outputWriter, error) {
+	if filename == "" {
+		return &outputWriter{w: os.Stdout}, nil
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &outputWriter{w: f, f: f}, nil
+}
+
+// outputWriter records the first write error, since outputters do not return errors.
+type outputWriter struct {
+	w   io.Writer
+	f   *os.File
+	err error
+}
 
-		// 同时输出到标准输出，便于复制
-		fmt.Printf("\n\n=== FAILED PROMQL QUERIES (Copy-paste ready) ===\n")
-		for _, query := range failedQueries {
-			fmt.Printf("%s\n", query)
+func (ow *outputWriter) Write(p []byte) (int, error) {
+	if ow.err != nil {
+		return 0, ow.err
+	}
+	n, err := ow.w.Write(p)
+	ow.err = err
+	return n, err
+}
+
+// Close returns the first write error, if any, and closes the output file.
+func (ow *outputWriter) Close() error {
+	if ow.f != nil {
+		if err := ow.f.Close(); err != nil && ow.err == nil {
+			ow.err = err
 		}
-		fmt.Printf("=== END OF FAILED QUERIES ===\n\n")
+	}
+	return ow.err
+}
 
-		log.Fatalf("Test execution completed with %d error(s) - Error rate: %.2f%%", len(errors), errorRate)
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// logDuplicates logs the number of expanded test cases that were skipped as duplicates.
+func logDuplicates(removed int) {
+	if removed > 0 {
+		log.Infof("Skipping %d expanded test cases that send the same query as an earlier one, set -no-dedup to run them", removed)
 	}
+}
 
-	outp(results, *outputPassing, cfg.QueryTweaks)
+// timeRanges returns the time ranges of the query time parameter sets. Sets without an end time end
+// at defaultEnd.
+func timeRanges(sets config.QueryTimeParameterSets, defaultEnd time.Time) []testcases.TimeRange {
+	var ranges []testcases.TimeRange
+	for _, p := range sets.Sets() {
+		end := getTime(p.EndTime, defaultEnd)
+		ranges = append(ranges, testcases.TimeRange{
+			Name:       p.Name,
+			Start:      end.Add(-getNonZeroDuration(p.RangeInSeconds, 10*time.Minute)),
+			End:        end,
+			Resolution: getNonZeroDuration(p.ResolutionInSeconds, 10*time.Second),
+		})
+	}
+	return ranges
 }
 
 func getTime(timeStr string, defaultTime time.Time) time.Time {
@@ -173,7 +886,7 @@ func getNonZeroDuration(
 	if seconds == 0.0 {
 		return defaultDuration
 	}
-	return time.Duration(seconds * float64(time.Second))
+	return secondsToDuration(seconds)
 }
 
 func parseTime(s string) (time.Time, error) {
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/log"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/output"
+)
+
+// liveMetrics exposes the progress and outcomes of a run as Prometheus metrics, which are updated
+// as each comparison completes. A nil *liveMetrics records nothing.
+type liveMetrics struct {
+	testCases         prometheus.Gauge
+	results           *prometheus.CounterVec
+	successRate       *prometheus.GaugeVec
+	testQueryDuration *prometheus.HistogramVec
+
+	mtx sync.Mutex
+	// completed and passed count the results of each test target for the success rate.
+	completed map[string]int
+	passed    map[string]int
+}
+
+func newLiveMetrics(reg prometheus.Registerer) *liveMetrics {
+	m := &liveMetrics{
+		testCases: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "promql_compliance_tester_test_cases",
+			Help: "Number of expanded test cases in the current run.",
+		}),
+		results: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promql_compliance_tester_results_total",
+			Help: "Number of completed comparisons by test target and outcome (pass, fail, unsupported, error, skipped).",
+		}, []string{"target", "outcome"}),
+		successRate: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promql_compliance_tester_success_rate",
+			Help: "Fraction of the completed comparisons of a test target that passed.",
+		}, []string{"target"}),
+		testQueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "promql_compliance_tester_test_query_duration_seconds",
+			Help:    "Duration of the queries against a test target.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"target"}),
+		completed: map[string]int{},
+		passed:    map[string]int{},
+	}
+	reg.MustRegister(m.testCases, m.results, m.successRate, m.testQueryDuration)
+	return m
+}
+
+// serveMetrics registers the run metrics with the default registry and serves them on
+// addr/metrics until the process exits.
+func serveMetrics(addr string) (*liveMetrics, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := newLiveMetrics(prometheus.DefaultRegisterer)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Errorf("Error serving metrics: %v", err)
+		}
+	}()
+	log.Infof("Serving metrics on http://%s/metrics", ln.Addr())
+	return m, nil
+}
+
+// setTestCases records the number of test cases in the run.
+func (m *liveMetrics) setTestCases(n int) {
+	if m == nil {
+		return
+	}
+	m.testCases.Set(float64(n))
+}
+
+// observe records a completed comparison.
+func (m *liveMetrics) observe(res *comparer.Result) {
+	if m == nil {
+		return
+	}
+	outcome := output.Outcome(res)
+	m.results.WithLabelValues(res.TestTarget, outcome).Inc()
+	if res.TestDuration > 0 {
+		m.testQueryDuration.WithLabelValues(res.TestTarget).Observe(res.TestDuration.Seconds())
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.completed[res.TestTarget]++
+	if outcome == "pass" {
+		m.passed[res.TestTarget]++
+	}
+	m.successRate.WithLabelValues(res.TestTarget).Set(float64(m.passed[res.TestTarget]) / float64(m.completed[res.TestTarget]))
+}
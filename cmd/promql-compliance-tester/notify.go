@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/output"
+)
+
+// notificationTimeout bounds the duration of a webhook notification.
+const notificationTimeout = 30 * time.Second
+
+// webhookNotifier posts the shaped notification of a finished run to a webhook.
+type webhookNotifier struct {
+	url        string
+	reportLink string
+	limits     output.NotificationLimits
+	// baseline, if set, holds the earlier runs whose pass rates regressions are reported against.
+	baseline *output.HistoryBaseline
+}
+
+// notify posts the notification of the run. The previous run's failures are read from the history
+// file, if any, before the current run is appended to it. Failures are logged, since they should
+// not change the outcome of the run.
+func (n *webhookNotifier) notify(stats *runStats, historyFile string) {
+	r := output.NotificationReport{
+		Total:       stats.total,
+		Passed:      stats.successful(),
+		Failed:      len(stats.failed),
+		Errored:     len(stats.errored),
+		Skipped:     len(stats.skipped),
+		Interrupted: stats.interrupted,
+		Chaos:       stats.chaos,
+		Failures:    append(append([]*comparer.Result{}, stats.failed...), stats.errored...),
+		ReportLink:  n.reportLink,
+		Regressions: n.baseline.Regressions(stats.history),
+	}
+	if historyFile != "" {
+		history, err := output.ReadHistory(historyFile, 1)
+		if err != nil {
+			log.Warnf("Unable to read the previous run from the history file, not listing newly failing test cases: %v", err)
+		} else if len(history) > 0 {
+			r.Previous = history[0]
+		}
+	}
+	payload, err := output.ShapeNotification(r, n.limits)
+	if err != nil {
+		log.Errorf("Error building notification: %v", err)
+		return
+	}
+	if err := postNotification(n.url, payload); err != nil {
+		log.Errorf("Error sending notification: %v", err)
+	}
+}
+
+// postNotification posts a JSON payload to url.
+func postNotification(url string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("webhook returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// reportLink returns the link to the full report, which defaults to the path of the output file.
+func reportLink(link, outputFile string) string {
+	if link != "" {
+		return link
+	}
+	return outputFile
+}
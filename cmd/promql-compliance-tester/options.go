@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// envPrefix prefixes the names of the environment variables that set flags, e.g.
+// PROMQL_COMPLIANCE_OUTPUT_FORMAT for -output-format.
+const envPrefix = "PROMQL_COMPLIANCE_"
+
+// Sources of the resolved value of a flag, from the lowest to the highest precedence.
+const (
+	sourceDefault    = "default"
+	sourceConfigFile = "config file"
+	sourceEnv        = "environment"
+	sourceFlag       = "command line"
+)
+
+// flagAliases maps the alias flags to the flags that they set.
+var flagAliases = map[string]string{
+	"query-filter": "query-include",
+	"query-skip":   "query-exclude",
+}
+
+// secretFlags are flags whose values are not printed, since they may carry credentials.
+var secretFlags = map[string]bool{"notification-webhook-url": true}
+
+// A resolvedOption is the value of a flag after resolution, with the source that set it.
+type resolvedOption struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// options resolves the values of the flags of a FlagSet from their defaults, the flags section of
+// the configuration file, environment variables, and the command line, in increasing precedence.
+// Values are set on the flags themselves, so that the variables they are bound to hold the
+// resolved values. Options that take lists are replaced as a whole, not merged across sources.
+type options struct {
+	fs        *flag.FlagSet
+	lookupEnv func(string) (string, bool)
+	// onCommandLine holds the flags set on the command line, with aliases resolved.
+	onCommandLine map[string]bool
+	sources       map[string]string
+}
+
+// newOptions returns the options of a parsed FlagSet.
+func newOptions(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) *options {
+	o := &options{fs: fs, lookupEnv: lookupEnv, onCommandLine: map[string]bool{}, sources: map[string]string{}}
+	fs.Visit(func(f *flag.Flag) {
+		o.onCommandLine[canonicalFlag(f.Name)] = true
+	})
+	return o
+}
+
+// canonicalFlag returns the name of the flag that an alias sets, or name itself.
+func canonicalFlag(name string) string {
+	if c, ok := flagAliases[name]; ok {
+		return c
+	}
+	return name
+}
+
+// envName returns the name of the environment variable that sets the named flag.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// resolve sets each flag that is not set on the command line from its environment variable or,
+// failing that, from fileFlags, the flags section of the configuration file. It may be called
+// again once the configuration file is loaded, since the configuration file to load can itself
+// be set by an environment variable.
+func (o *options) resolve(fileFlags map[string]string) error {
+	names := make([]string, 0, len(fileFlags))
+	for name := range fileFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fromFile := make(map[string]string, len(fileFlags))
+	for _, name := range names {
+		v, c := fileFlags[name], canonicalFlag(name)
+		switch {
+		case o.fs.Lookup(c) == nil:
+			return errors.Errorf("unknown flag %q in the flags section of the configuration file", name)
+		case c == "config-file" || c == "print-config":
+			return errors.Errorf("flag %q cannot be set in the configuration file", name)
+		case c == "lenient-config":
+			return errors.Errorf("flag %q cannot be set in the configuration file, set on_invalid_case: skip instead", name)
+		}
+		if _, ok := fromFile[c]; ok {
+			return errors.Errorf("flag %q is set twice in the flags section of the configuration file, also through its alias", c)
+		}
+		fromFile[c] = v
+	}
+
+	var err error
+	o.fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || flagAliases[f.Name] != "" {
+			return
+		}
+		if o.onCommandLine[f.Name] {
+			o.sources[f.Name] = sourceFlag
+			return
+		}
+		if v, ok := o.lookupEnv(envName(f.Name)); ok {
+			if setErr := f.Value.Set(v); setErr != nil {
+				err = errors.Wrapf(setErr, "invalid value %q of %s", v, envName(f.Name))
+			}
+			o.sources[f.Name] = sourceEnv
+			return
+		}
+		if v, ok := fromFile[f.Name]; ok {
+			if setErr := f.Value.Set(v); setErr != nil {
+				err = errors.Wrapf(setErr, "invalid value %q of flag %q in the configuration file", v, f.Name)
+			}
+			o.sources[f.Name] = sourceConfigFile
+			return
+		}
+		o.sources[f.Name] = sourceDefault
+	})
+	return err
+}
+
+// resolved returns the resolved options sorted by name, without aliases and hidden flags that are
+// left at their defaults. The values of secret flags are redacted.
+func (o *options) resolved() []resolvedOption {
+	var opts []resolvedOption
+	o.fs.VisitAll(func(f *flag.Flag) {
+		source := o.sources[f.Name]
+		if flagAliases[f.Name] != "" || (hiddenFlags[f.Name] && source == sourceDefault) {
+			return
+		}
+		if source == "" {
+			source = sourceDefault
+		}
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = "<secret>"
+		}
+		opts = append(opts, resolvedOption{Name: f.Name, Value: v, Source: source})
+	})
+	sort.Slice(opts, func(i, j int) bool { return opts[i].Name < opts[j].Name })
+	return opts
+}
+
+// print writes the resolved options for -print-config.
+func (o *options) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FLAG\tVALUE\tSOURCE")
+	for _, opt := range o.resolved() {
+		fmt.Fprintf(tw, "-%s\t%q\t%s\n", opt.Name, opt.Value, opt.Source)
+	}
+	return tw.Flush()
+}
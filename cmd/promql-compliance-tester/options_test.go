@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testFlagSet returns a FlagSet with representative flags, parsed from args.
+func testFlagSet(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("promql-compliance-tester", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.String("config-file", "promql-compliance-tester.yml", "")
+	fs.String("output-format", "text", "")
+	fs.Bool("output-passing", false, "")
+	fs.Bool("output-unsupported", true, "")
+	fs.Int("parallelism", 4, "")
+	fs.String("include-tags", "", "")
+	var queryInclude string
+	fs.StringVar(&queryInclude, "query-include", "", "")
+	fs.StringVar(&queryInclude, "query-filter", "", "")
+	fs.String("notification-webhook-url", "", "")
+	fs.Bool("chaos", false, "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// env returns a lookup function of the given environment variables.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestOptionsPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		args       []string
+		env        map[string]string
+		file       map[string]string
+		flag       string
+		wantValue  string
+		wantSource string
+	}{
+		{name: "default", flag: "output-format", wantValue: "text", wantSource: sourceDefault},
+		{name: "config file over default", file: map[string]string{"output-format": "json"}, flag: "output-format", wantValue: "json", wantSource: sourceConfigFile},
+		{
+			name: "environment over config file",
+			env:  map[string]string{"PROMQL_COMPLIANCE_OUTPUT_FORMAT": "tsv"}, file: map[string]string{"output-format": "json"},
+			flag: "output-format", wantValue: "tsv", wantSource: sourceEnv,
+		},
+		{
+			name: "command line over environment and config file",
+			args: []string{"-output-format=html"}, env: map[string]string{"PROMQL_COMPLIANCE_OUTPUT_FORMAT": "tsv"}, file: map[string]string{"output-format": "json"},
+			flag: "output-format", wantValue: "html", wantSource: sourceFlag,
+		},
+		{name: "integer from the environment", env: map[string]string{"PROMQL_COMPLIANCE_PARALLELISM": "16"}, flag: "parallelism", wantValue: "16", wantSource: sourceEnv},
+		{name: "boolean from the config file", file: map[string]string{"output-passing": "true"}, flag: "output-passing", wantValue: "true", wantSource: sourceConfigFile},
+		{
+			// A boolean set to its default on the command line still wins.
+			name: "boolean set to false on the command line",
+			args: []string{"-output-passing=false"}, env: map[string]string{"PROMQL_COMPLIANCE_OUTPUT_PASSING": "true"}, file: map[string]string{"output-passing": "true"},
+			flag: "output-passing", wantValue: "false", wantSource: sourceFlag,
+		},
+		{
+			name: "boolean set to false in the environment",
+			env:  map[string]string{"PROMQL_COMPLIANCE_OUTPUT_UNSUPPORTED": "false"}, file: map[string]string{"output-unsupported": "true"},
+			flag: "output-unsupported", wantValue: "false", wantSource: sourceEnv,
+		},
+		{
+			// Lists are replaced as a whole, not merged.
+			name: "list from the command line",
+			args: []string{"-include-tags=histograms"}, env: map[string]string{"PROMQL_COMPLIANCE_INCLUDE_TAGS": "aggregations,functions"},
+			flag: "include-tags", wantValue: "histograms", wantSource: sourceFlag,
+		},
+		{
+			name: "list from the environment",
+			env:  map[string]string{"PROMQL_COMPLIANCE_INCLUDE_TAGS": "aggregations,functions"}, file: map[string]string{"include-tags": "histograms"},
+			flag: "include-tags", wantValue: "aggregations,functions", wantSource: sourceEnv,
+		},
+		{
+			name: "alias on the command line",
+			args: []string{"-query-filter=rate"}, env: map[string]string{"PROMQL_COMPLIANCE_QUERY_INCLUDE": "sum"},
+			flag: "query-include", wantValue: "rate", wantSource: sourceFlag,
+		},
+		{name: "alias in the config file", file: map[string]string{"query-filter": "rate"}, flag: "query-include", wantValue: "rate", wantSource: sourceConfigFile},
+		{
+			name: "config file selected by the environment",
+			env:  map[string]string{"PROMQL_COMPLIANCE_CONFIG_FILE": "other.yml"},
+			flag: "config-file", wantValue: "other.yml", wantSource: sourceEnv,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := testFlagSet(t, tc.args...)
+			o := newOptions(fs, env(tc.env))
+			// Like main, the options are resolved before and after loading the configuration file.
+			if err := o.resolve(nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := o.resolve(tc.file); err != nil {
+				t.Fatal(err)
+			}
+			if got := fs.Lookup(tc.flag).Value.String(); got != tc.wantValue {
+				t.Errorf("expected -%s to be %q, got %q", tc.flag, tc.wantValue, got)
+			}
+			var got *resolvedOption
+			for _, opt := range o.resolved() {
+				opt := opt
+				if opt.Name == tc.flag {
+					got = &opt
+				}
+			}
+			if want := (resolvedOption{Name: tc.flag, Value: tc.wantValue, Source: tc.wantSource}); got == nil || *got != want {
+				t.Errorf("expected the resolved option %+v, got %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestOptionsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		env     map[string]string
+		file    map[string]string
+		wantErr string
+	}{
+		{name: "unknown flag", file: map[string]string{"ouput-format": "json"}, wantErr: `unknown flag "ouput-format"`},
+		{name: "config file in the config file", file: map[string]string{"config-file": "other.yml"}, wantErr: `flag "config-file" cannot be set in the configuration file`},
+		{name: "flag and alias", file: map[string]string{"query-filter": "rate", "query-include": "sum"}, wantErr: `flag "query-include" is set twice`},
+		{name: "invalid environment value", env: map[string]string{"PROMQL_COMPLIANCE_PARALLELISM": "many"}, wantErr: `invalid value "many" of PROMQL_COMPLIANCE_PARALLELISM`},
+		{name: "invalid config file value", file: map[string]string{"output-passing": "yes please"}, wantErr: `invalid value "yes please" of flag "output-passing" in the configuration file`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := newOptions(testFlagSet(t), env(tc.env)).resolve(tc.file)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestResolvedOptions(t *testing.T) {
+	fs := testFlagSet(t, "-notification-webhook-url=https://hooks.example.com/secret-token")
+	o := newOptions(fs, env(nil))
+	if err := o.resolve(nil); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, opt := range o.resolved() {
+		names = append(names, opt.Name)
+		if opt.Name == "notification-webhook-url" && opt.Value != "<secret>" {
+			t.Errorf("expected the webhook URL to be redacted, got %q", opt.Value)
+		}
+	}
+	// Aliases and hidden flags left at their defaults are not listed.
+	want := []string{"config-file", "include-tags", "notification-webhook-url", "output-format", "output-passing", "output-unsupported", "parallelism", "query-include"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("expected the options %q, got %q", want, names)
+	}
+
+	var buf bytes.Buffer
+	if err := o.print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{"FLAG", "-parallelism", `"4"`, "default", "command line"} {
+		if !strings.Contains(buf.String(), w) {
+			t.Errorf("expected -print-config to contain %q, got:\n%s", w, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "secret-token") {
+		t.Errorf("expected -print-config not to print the webhook URL, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+var fixtureNameRe = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// fixtureFileName returns the file in dir that records the responses of the reference target, if
+// test is false, or of the test target with the given index and name.
+func fixtureFileName(dir string, test bool, cfg *config.Config, i int) string {
+	if !test {
+		return filepath.Join(dir, "reference.json")
+	}
+	if len(cfg.TestTargetConfigs) == 1 {
+		return filepath.Join(dir, "test.json")
+	}
+	return filepath.Join(dir, "test-"+fixtureNameRe.ReplaceAllString(cfg.TestTargetConfigs[i].DisplayName(), "_")+".json")
+}
+
+// fixtureRecorder records the responses of the reference and test targets to fixture files in a
+// directory, from which -recompare-dir replays them.
+type fixtureRecorder struct {
+	dir     string
+	files   []string
+	targets []*comparer.RecordingTarget
+}
+
+func newFixtureRecorder(dir string) (*fixtureRecorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fixtureRecorder{dir: dir}, nil
+}
+
+// wrap returns a target recording the responses of target to filename.
+func (r *fixtureRecorder) wrap(filename string, target comparer.QueryTarget) comparer.QueryTarget {
+	rt := comparer.NewRecordingTarget(target)
+	r.files = append(r.files, filename)
+	r.targets = append(r.targets, rt)
+	return rt
+}
+
+// write writes the recorded responses of all targets.
+func (r *fixtureRecorder) write() error {
+	for i, t := range r.targets {
+		if err := t.WriteFixtures(r.files[i]); err != nil {
+			return errors.Wrapf(err, "writing fixture file %s", r.files[i])
+		}
+	}
+	return nil
+}
+
+// useRecordedFixtures makes the reference and test targets replay the responses recorded in dir
+// by -record-dir. The reference fallback targets are dropped, since the recorded reference
+// responses already include the results they provided.
+func useRecordedFixtures(cfg *config.Config, dir string) error {
+	targets := []*config.TargetConfig{&cfg.ReferenceTargetConfig}
+	files := []string{fixtureFileName(dir, false, cfg, 0)}
+	for i := range cfg.TestTargetConfigs {
+		targets = append(targets, &cfg.TestTargetConfigs[i])
+		files = append(files, fixtureFileName(dir, true, cfg, i))
+	}
+	for i, t := range targets {
+		if _, err := os.Stat(files[i]); err != nil {
+			return err
+		}
+		// Keep the names of the targets in reports.
+		t.Name = t.DisplayName()
+		t.FixtureFile = files[i]
+	}
+	cfg.ReferenceFallbackTargetConfigs = nil
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// recordedRequest is a query request as received by a test server.
+type recordedRequest struct {
+	method, path, contentType, rawQuery string
+	form                                url.Values
+	user, pass                          string
+	header                              string
+}
+
+// newRecordingServer returns a server that answers any request with an empty vector or matrix and
+// records the requests in reqs.
+func newRecordingServer(t *testing.T, reqs *[]recordedRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			t.Error(err)
+		}
+		user, pass, _ := r.BasicAuth()
+		*reqs = append(*reqs, recordedRequest{
+			method:      r.Method,
+			path:        r.URL.Path,
+			contentType: r.Header.Get("Content-Type"),
+			rawQuery:    r.URL.RawQuery,
+			form:        form,
+			user:        user,
+			pass:        pass,
+			header:      r.Header.Get("X-Scope-OrgID"),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		resultType := "vector"
+		if r.URL.Path == "/prometheus/api/v1/query_range" || r.URL.Path == "/api/v1/query_range" {
+			resultType = "matrix"
+		}
+		w.Write([]byte(`{"status":"success","data":{"resultType":"` + resultType + `","result":[]}}`))
+	}))
+}
+
+func TestHTTPMethodAndPathPrefix(t *testing.T) {
+	var reqs []recordedRequest
+	srv := newRecordingServer(t, &reqs)
+	defer srv.Close()
+
+	rng := v1.Range{Start: time.Unix(0, 0), End: time.Unix(3600, 0), Step: time.Minute}
+	for _, tc := range []struct {
+		name         string
+		targetConfig config.TargetConfig
+		wantMethod   string
+		wantPath     string
+	}{
+		{
+			name: "post with path prefix",
+			targetConfig: config.TargetConfig{
+				HTTPMethod:    config.HTTPMethodPost,
+				PathPrefix:    "/prometheus",
+				BasicAuthUser: "tester",
+				BasicAuthPass: "secret",
+				Headers:       map[string]string{"X-Scope-OrgID": "greptime"},
+			},
+			wantMethod: http.MethodPost,
+			wantPath:   "/prometheus/api/v1/query_range",
+		},
+		{
+			name: "get",
+			targetConfig: config.TargetConfig{
+				HTTPMethod:    config.HTTPMethodGet,
+				BasicAuthUser: "tester",
+				BasicAuthPass: "secret",
+				Headers:       map[string]string{"X-Scope-OrgID": "greptime"},
+			},
+			wantMethod: http.MethodGet,
+			wantPath:   "/api/v1/query_range",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reqs = nil
+			tc.targetConfig.QueryURL = srv.URL
+			api, err := newPromAPI(tc.targetConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := api.QueryRange(context.Background(), `rate(demo{job="a"}[5m])`, rng); err != nil {
+				t.Fatal(err)
+			}
+			if len(reqs) != 1 {
+				t.Fatalf("expected one request, got %+v", reqs)
+			}
+			req := reqs[0]
+			if req.method != tc.wantMethod || req.path != tc.wantPath {
+				t.Errorf("expected %s %s, got %s %s", tc.wantMethod, tc.wantPath, req.method, req.path)
+			}
+			params := req.form
+			if tc.wantMethod == http.MethodPost {
+				if req.contentType != "application/x-www-form-urlencoded" || req.rawQuery != "" {
+					t.Errorf("expected the query parameters in a form-encoded body only, got content type %q and URL query %q", req.contentType, req.rawQuery)
+				}
+			} else {
+				if len(req.form) != 0 {
+					t.Errorf("expected no request body, got %v", req.form)
+				}
+				if params, err = url.ParseQuery(req.rawQuery); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if params.Get("query") != `rate(demo{job="a"}[5m])` || params.Get("start") != "0" || params.Get("end") != "3600" || params.Get("step") != "60" {
+				t.Errorf("expected the query parameters to be sent, got %v", params)
+			}
+			if req.user != "tester" || req.pass != "secret" || req.header != "greptime" {
+				t.Errorf("expected basic auth and the custom header to apply, got %q:%q and %q", req.user, req.pass, req.header)
+			}
+		})
+	}
+}
+
+func TestHTTPMethodPerTarget(t *testing.T) {
+	var refReqs, testReqs []recordedRequest
+	refSrv, testSrv := newRecordingServer(t, &refReqs), newRecordingServer(t, &testReqs)
+	defer refSrv.Close()
+	defer testSrv.Close()
+
+	cfg, err := config.Load([]byte(`
+reference_target_config:
+  query_url: ` + refSrv.URL + `
+  http_method: get
+test_target_config:
+  query_url: ` + testSrv.URL + `
+  http_method: post
+  path_prefix: /prometheus
+test_cases:
+- query: demo
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, targetConfig := range []config.TargetConfig{cfg.ReferenceTargetConfig, cfg.TestTargetConfigs[0]} {
+		api, err := newPromAPI(targetConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := api.Query(context.Background(), "demo", time.Unix(1, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(refReqs) != 1 || refReqs[0].method != http.MethodGet || refReqs[0].path != "/api/v1/query" {
+		t.Errorf("expected a GET /api/v1/query request to the reference target, got %+v", refReqs)
+	}
+	if len(testReqs) != 1 || testReqs[0].method != http.MethodPost || testReqs[0].path != "/prometheus/api/v1/query" || testReqs[0].form.Get("query") != "demo" {
+		t.Errorf("expected a POST /prometheus/api/v1/query request to the test target, got %+v", testReqs)
+	}
+}
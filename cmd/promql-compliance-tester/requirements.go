@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// exitCodeUnmetRequirements is the exit status of runs whose test cases were not run, since the
+// reference target lacks data that they require.
+const exitCodeUnmetRequirements = 6
+
+// minRequirementsWindow is the shortest window that the required metrics are looked for in, e.g.
+// if all test cases are instant queries. It is the lookback of instant vector selectors.
+const minRequirementsWindow = 5 * time.Minute
+
+// checkRequirements checks the declared requirements against the reference target of comp over
+// window, which ends at end and is at least minRequirementsWindow, and logs the unmet ones. It
+// returns the reports and whether the test cases may run.
+func checkRequirements(ctx context.Context, reqs []*config.Requirements, comp *comparer.Comparer, window time.Duration, end time.Time) ([]*comparer.RequirementsReport, bool) {
+	if window < minRequirementsWindow {
+		window = minRequirementsWindow
+	}
+	var reports []*comparer.RequirementsReport
+	ok := true
+	for _, req := range reqs {
+		r, err := comp.CheckRequirements(ctx, req, end.Add(-window), end)
+		if err != nil {
+			log.Warnf("Unable to check the requirements of %s: %v", req.Source, err)
+			continue
+		}
+		reports = append(reports, r)
+		if r.Satisfied {
+			log.Infof("The reference target has the %d metrics that %s requires", len(r.Metrics), req.Source)
+			continue
+		}
+		logf := log.Warnf
+		if req.OnUnmet != config.RequirementsWarn {
+			logf, ok = log.Errorf, false
+		}
+		logf("%s", unmetRequirementsMessage(r))
+		for _, m := range r.Metrics {
+			if m.Problem != "" {
+				logf("  %s %s", m.Metric, m.Problem)
+			}
+		}
+	}
+	return reports, ok
+}
+
+// unmetRequirementsMessage describes the unmet requirements of a report, e.g. "test-cases/demo.yml
+// needs the PromLabs demo dataset (missing: demo_disk_usage_bytes)".
+func unmetRequirementsMessage(r *comparer.RequirementsReport) string {
+	dataset := r.Dataset
+	if dataset == "" {
+		dataset = "data that the reference target lacks"
+	}
+	return fmt.Sprintf("%s needs %s (missing: %s)", r.Source, dataset, strings.Join(r.Missing(), ", "))
+}
+
+// exitOnUnmetRequirements exits with exitCodeUnmetRequirements without running the test cases,
+// after writing the summary file with the requirements reports.
+func (g runGate) exitOnUnmetRequirements() {
+	g.writeGateSummary()
+	log.Errorf("Not running the test cases, since the reference target lacks data that they require and on_unmet is %s", config.RequirementsFail)
+	os.Exit(exitCodeUnmetRequirements)
+}
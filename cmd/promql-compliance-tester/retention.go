@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+	"github.com/promlabs/promql-compliance-tester/testcases"
+)
+
+// maxRetentionProbes bounds the number of queries used to probe the retention of each target.
+const maxRetentionProbes = 8
+
+// retentionHorizons holds the earliest times from which on the targets are known to have samples.
+// A zero time means that the target's retention is unknown and test cases are not checked against it.
+type retentionHorizons struct {
+	ref  time.Time
+	test []time.Time
+	// byName maps the target names to their known horizons for the run summary.
+	byName map[string]time.Time
+}
+
+// probeRetentionHorizons probes the retention horizon of the reference target and of each test target
+// in [lo, hi]. Fixture targets are not probed.
+func probeRetentionHorizons(cfg *config.Config, refTarget comparer.QueryTarget, testTargets []comparer.QueryTarget, lo, hi time.Time) *retentionHorizons {
+	canary := cfg.RetentionCanary
+	if canary == "" {
+		canary = comparer.DefaultRetentionCanary
+	}
+	h := &retentionHorizons{byName: map[string]time.Time{}}
+	probe := func(name string, tc config.TargetConfig, target comparer.QueryTarget) time.Time {
+		if tc.FixtureFile != "" {
+			return time.Time{}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		horizon, err := comparer.ProbeRetention(ctx, target, canary, lo, hi, maxRetentionProbes)
+		if err != nil {
+			log.Warnf("Unable to probe retention of %s target, not checking test case windows against it: %v", name, err)
+			return time.Time{}
+		}
+		if horizon.After(lo) {
+			log.Warnf("The %s target has no samples of %s before about %v", name, canary, horizon.Format(time.RFC3339))
+		}
+		h.byName[name] = horizon
+		return horizon
+	}
+	h.ref = probe("reference", cfg.ReferenceTargetConfig, refTarget)
+	for i, tc := range cfg.TestTargetConfigs {
+		name := "test"
+		if len(cfg.TestTargetConfigs) > 1 {
+			name = tc.DisplayName()
+		}
+		h.test = append(h.test, probe(name, tc, testTargets[i]))
+	}
+	return h
+}
+
+// earliestWindowStart returns the earliest time that the queries of the test cases evaluate at in
+// any of the time ranges that apply to them.
+func earliestWindowStart(cases []*config.TestCase, ranges []testcases.TimeRange) time.Time {
+	earliest := latestEnd(ranges)
+	for _, r := range ranges {
+		for _, tc := range cases {
+			if !r.AppliesTo(tc) {
+				continue
+			}
+			t := r.Start
+			evalTime := r.End
+			if !tc.PinWindow {
+				// Jitter shifts the window back by less than r.Jitter.
+				t = t.Add(-r.Jitter)
+				evalTime = evalTime.Add(-r.Jitter)
+			}
+			if tc.Type == config.QueryTypeInstant {
+				evalTime = evalTime.Add(-time.Duration(tc.EvalTimeOffsetSeconds * float64(time.Second)))
+				t = evalTime
+			}
+			if ra := tc.WithinReferenceRange; ra != nil {
+				t = evalTime.Add(-time.Duration(ra.LookbackSeconds * float64(time.Second)))
+			}
+			if t.Before(earliest) {
+				earliest = t
+			}
+		}
+	}
+	return earliest
+}
+
+// latestEnd returns the latest end time of the time ranges.
+func latestEnd(ranges []testcases.TimeRange) time.Time {
+	var latest time.Time
+	for _, r := range ranges {
+		if r.End.After(latest) {
+			latest = r.End
+		}
+	}
+	return latest
+}
+
+// windowStart returns the earliest time that the queries of a test case evaluate at.
+func windowStart(tc *comparer.TestCase) time.Time {
+	evalTime, t := tc.End, tc.Start
+	if tc.Instant() {
+		evalTime, t = tc.Time, tc.Time
+	}
+	if ra := tc.WithinReferenceRange; ra != nil {
+		t = evalTime.Add(-time.Duration(ra.LookbackSeconds * float64(time.Second)))
+	}
+	return t
+}
+
+// outside returns why the test case's window predates the retention of the reference target or of
+// the i-th test target, or an empty string if it does not.
+func (h *retentionHorizons) outside(tc *comparer.TestCase, i int) string {
+	if h == nil {
+		return ""
+	}
+	start := windowStart(tc)
+	for _, t := range []struct {
+		name    string
+		horizon time.Time
+	}{{"reference", h.ref}, {"test", h.test[i]}} {
+		if !t.horizon.IsZero() && start.Before(t.horizon) {
+			return fmt.Sprintf("outside retention: the window starts at %v, but the %s target has no samples before about %v", start.Format(time.RFC3339), t.name, t.horizon.Format(time.RFC3339))
+		}
+	}
+	return ""
+}
+
+// summary returns the known retention horizons by target name, or nil if there are none.
+func (h *retentionHorizons) summary() map[string]time.Time {
+	if h == nil || len(h.byName) == 0 {
+		return nil
+	}
+	return h.byName
+}
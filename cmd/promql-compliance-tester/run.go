@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// compareTestCase compares a test case against the test target of each comparer and returns their
+// results in the same order. When there are several comparers, the reference query only runs once.
+// Comparisons that could not be executed yield errored results, test cases that were not expanded and
+// comparisons whose window predates the retention of a target skipped ones, and comparisons whose
+// time budget is exhausted not run ones.
+// Each result is recorded in metrics.
+func compareTestCase(comps []*comparer.Comparer, tc *comparer.TestCase, budgets *timeBudgets, retention *retentionHorizons, metrics *liveMetrics) []*comparer.Result {
+	ctx := context.Background()
+	if len(comps) > 1 {
+		ctx = comparer.WithSharedReference(ctx)
+	}
+	results := make([]*comparer.Result, 0, len(comps))
+	for i, comp := range comps {
+		if tc.NotExpanded != "" {
+			results = append(results, &comparer.Result{TestCase: tc, SkipReason: fmt.Sprintf("not expanded, since placeholder %s has no values", tc.NotExpanded), SkipCause: comparer.SkipNotExpanded, TestTarget: comp.TestTargetName()})
+			continue
+		}
+		if reason := retention.outside(tc, i); reason != "" {
+			results = append(results, &comparer.Result{TestCase: tc, SkipReason: reason, SkipCause: comparer.SkipPreconditionNotMet, TestTarget: comp.TestTargetName()})
+			continue
+		}
+		if reason := budgets.exceeded(tc); reason != "" {
+			results = append(results, &comparer.Result{TestCase: tc, SkipReason: reason, SkipCause: comparer.SkipBudgetExhausted, NotRun: true, TestTarget: comp.TestTargetName()})
+			continue
+		}
+		start := time.Now()
+		res, err := comp.CompareContext(ctx, tc)
+		budgets.spend(tc, time.Since(start))
+		if err != nil {
+			log.Errorf("Error running comparison: %v", err)
+			res = &comparer.Result{TestCase: tc, ExecutionError: err.Error(), EffectiveSettings: comp.EffectiveSettings(tc), TestTarget: comp.TestTargetName()}
+			var timeoutErr *comparer.TimeoutError
+			if errors.As(err, &timeoutErr) {
+				res.QueryTimeout = timeoutErr.Timeout
+			}
+		}
+		results = append(results, res)
+	}
+	for _, res := range results {
+		metrics.observe(res)
+	}
+	return results
+}
+
+// notRunResults returns the results of a test case that was not compared before the run stopped.
+func notRunResults(comps []*comparer.Comparer, tc *comparer.TestCase, reason string) []*comparer.Result {
+	results := make([]*comparer.Result, 0, len(comps))
+	for _, comp := range comps {
+		results = append(results, &comparer.Result{TestCase: tc, SkipReason: reason, SkipCause: comparer.SkipAbortedEarly, NotRun: true, TestTarget: comp.TestTargetName()})
+	}
+	return results
+}
+
+// runComparisons compares all test cases using the given number of concurrent workers, of which
+// limiter may only let some compare at once.
+// The returned slice is indexed like the input test cases, so its ordering does not
+// depend on the order in which the comparisons complete. Once ctx is canceled, no further
+// comparisons are started and the results of the remaining test cases are nil.
+func runComparisons(ctx context.Context, comps []*comparer.Comparer, tcs []*comparer.TestCase, parallelism int, limiter *concurrencyLimiter, budgets *timeBudgets, retention *retentionHorizons, metrics *liveMetrics, progressBar *pb.ProgressBar) [][]*comparer.Result {
+	results := make([][]*comparer.Result, len(tcs))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				limiter.acquire()
+				results[i] = compareTestCase(comps, tcs[i], budgets, retention, metrics)
+				limiter.release(results[i])
+				progressBar.Increment()
+			}
+		}()
+	}
+dispatch:
+	for i := range tcs {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+// streamComparisons compares the test cases generated by produce using the given number of concurrent
+// workers, of which limiter may only let some compare at once, and passes the results of each test case to emit in the order in which the test cases were generated.
+// At most window test cases are in flight or waiting to be emitted at any time, so memory usage does
+// not grow with the number of test cases. Once ctx is canceled, no further comparisons are started
+// and errInterrupted is returned after the in-flight ones were emitted. Emitted results are passed along
+// with the index of their test case in generation order.
+func streamComparisons(ctx context.Context, comps []*comparer.Comparer, produce func(func(*comparer.TestCase) error) error, parallelism, window int, limiter *concurrencyLimiter, budgets *timeBudgets, retention *retentionHorizons, metrics *liveMetrics, progressBar *pb.ProgressBar, emit func(int, []*comparer.Result)) error {
+	type job struct {
+		idx     int
+		tc      *comparer.TestCase
+		results []*comparer.Result
+	}
+
+	slots := make(chan struct{}, window)
+	jobs := make(chan *job)
+	done := make(chan *job)
+
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				limiter.acquire()
+				j.results = compareTestCase(comps, j.tc, budgets, retention, metrics)
+				limiter.release(j.results)
+				progressBar.Increment()
+				done <- j
+			}
+		}()
+	}
+
+	// Reorder completed jobs so that they are emitted in generation order.
+	emitted := make(chan struct{})
+	go func() {
+		defer close(emitted)
+		pending := map[int]*job{}
+		next := 0
+		for j := range done {
+			pending[j.idx] = j
+			for {
+				p, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				emit(p.idx, p.results)
+				<-slots
+				next++
+			}
+		}
+	}()
+
+	idx := 0
+	err := produce(func(tc *comparer.TestCase) error {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return errInterrupted
+		}
+		if ctx.Err() != nil {
+			<-slots
+			return errInterrupted
+		}
+		jobs <- &job{idx: idx, tc: tc}
+		idx++
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+	close(done)
+	<-emitted
+	return err
+}
+
+// defaultBudget is the key of category_time_budgets whose budget caps the test cases that no
+// other category or tag budget applies to.
+const defaultBudget = "default"
+
+// A budgetGroup is a group of test cases that shares a time budget: those of a category, those
+// with a tag, or those without a budget of their own if kind is defaultBudget.
+type budgetGroup struct {
+	kind, name string
+}
+
+func (g budgetGroup) String() string {
+	if g.kind == defaultBudget {
+		return "default"
+	}
+	return fmt.Sprintf("%s %q", g.kind, g.name)
+}
+
+// timeBudgets tracks the time spent comparing the test cases of each category and tag against
+// their time budgets, so that the test cases of a slow area cannot use up the run. Once a budget
+// is exhausted, the remaining test cases it applies to are not run, while those of other groups
+// are. It is safe for concurrent use.
+type timeBudgets struct {
+	mtx    sync.Mutex
+	budget map[budgetGroup]time.Duration
+	spent  map[budgetGroup]time.Duration
+	// exhausted counts the comparisons that were not run because a budget of the group was exhausted.
+	exhausted map[budgetGroup]int
+	// catSpent and counts are the time spent on and the number of compared test cases of each category.
+	catSpent map[string]time.Duration
+	counts   map[string]int
+}
+
+func newTimeBudgets(categories, tags map[string]model.Duration) *timeBudgets {
+	tb := &timeBudgets{
+		budget:    make(map[budgetGroup]time.Duration, len(categories)+len(tags)),
+		spent:     map[budgetGroup]time.Duration{},
+		exhausted: map[budgetGroup]int{},
+		catSpent:  map[string]time.Duration{},
+		counts:    map[string]int{},
+	}
+	for cat, b := range categories {
+		g := budgetGroup{kind: "category", name: cat}
+		if cat == defaultBudget {
+			g = budgetGroup{kind: defaultBudget}
+		}
+		tb.budget[g] = time.Duration(b)
+	}
+	for tag, b := range tags {
+		tb.budget[budgetGroup{kind: "tag", name: tag}] = time.Duration(b)
+	}
+	return tb
+}
+
+// groups returns the budgets that apply to a test case: those of its category and tags, or the
+// default budget if none of them has one. It must be called with the mutex held.
+func (tb *timeBudgets) groups(tc *comparer.TestCase) []budgetGroup {
+	var groups []budgetGroup
+	if _, ok := tb.budget[budgetGroup{kind: "category", name: tc.Category}]; ok && tc.Category != "" {
+		groups = append(groups, budgetGroup{kind: "category", name: tc.Category})
+	}
+	for _, tag := range tc.Tags {
+		g := budgetGroup{kind: "tag", name: tag}
+		if _, ok := tb.budget[g]; ok {
+			groups = append(groups, g)
+		}
+	}
+	if _, ok := tb.budget[budgetGroup{kind: defaultBudget}]; ok && len(groups) == 0 {
+		groups = append(groups, budgetGroup{kind: defaultBudget})
+	}
+	return groups
+}
+
+// exceeded returns a not run reason if a time budget that applies to the test case has been used up.
+func (tb *timeBudgets) exceeded(tc *comparer.TestCase) string {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	for _, g := range tb.groups(tc) {
+		if budget := tb.budget[g]; tb.spent[g] >= budget {
+			tb.exhausted[g]++
+			return fmt.Sprintf("not run: the %v time budget of %v was exhausted", g, budget)
+		}
+	}
+	return ""
+}
+
+// describe describes the time budgets that apply to a test case.
+func (tb *timeBudgets) describe(tc *comparer.TestCase) []string {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+	var budgets []string
+	for _, g := range tb.groups(tc) {
+		budgets = append(budgets, fmt.Sprintf("%v time budget of %v", g, tb.budget[g]))
+	}
+	return budgets
+}
+
+// spend charges the time spent comparing a test case to its category and the budgets that apply to it.
+func (tb *timeBudgets) spend(tc *comparer.TestCase, d time.Duration) {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+	for _, g := range tb.groups(tc) {
+		tb.spent[g] += d
+	}
+	tb.catSpent[tc.Category] += d
+	tb.counts[tc.Category]++
+}
+
+// stats describes the number of compared test cases and the time spent on them for each category,
+// followed by the use of each time budget.
+func (tb *timeBudgets) stats() []string {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+
+	cats := make([]string, 0, len(tb.counts))
+	for cat := range tb.counts {
+		if cat != "" {
+			cats = append(cats, cat)
+		}
+	}
+	sort.Strings(cats)
+
+	stats := make([]string, 0, len(cats)+len(tb.budget))
+	for _, cat := range cats {
+		spent, n := tb.catSpent[cat], tb.counts[cat]
+		stats = append(stats, fmt.Sprintf("%s: %d test cases in %v (%v on average)", cat, n, spent, spent/time.Duration(n)))
+	}
+
+	groups := make([]budgetGroup, 0, len(tb.budget))
+	for g := range tb.budget {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].String() < groups[j].String() })
+	for _, g := range groups {
+		s := fmt.Sprintf("%v time budget: spent %v of %v", g, tb.spent[g], tb.budget[g])
+		if n := tb.exhausted[g]; n > 0 {
+			s += fmt.Sprintf(", exhausted with %d comparisons not run", n)
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
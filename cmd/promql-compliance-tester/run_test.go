@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+	"github.com/promlabs/promql-compliance-tester/testcases"
+)
+
+func TestCompareNotExpandedTestCase(t *testing.T) {
+	// The targets are never queried for test cases that were not expanded.
+	comps := []*comparer.Comparer{
+		comparer.New(nil, nil, nil, comparer.Options{TestTargetName: "a"}),
+		comparer.New(nil, nil, nil, comparer.Options{TestTargetName: "b"}),
+	}
+	budgets := newTimeBudgets(nil, nil)
+	stats := newRunStats(0)
+	for i, set := range []string{"1h", "1d"} {
+		tc := &comparer.TestCase{Query: "demo offset {{.offset}}", Type: config.QueryTypeInstant, Time: time.Unix(3600, 0), TimeParameterSet: set, NotExpanded: "offset"}
+		results := compareTestCase(comps, tc, budgets, nil, nil)
+		if len(results) != len(comps) {
+			t.Fatalf("expected a result per test target, got %d", len(results))
+		}
+		for j, res := range results {
+			if !res.Skipped() || res.SkipCause != comparer.SkipNotExpanded || res.SkipReason != "not expanded, since placeholder offset has no values" {
+				t.Errorf("expected a not expanded result, got %+v", res)
+			}
+			if res.TestTarget != comps[j].TestTargetName() {
+				t.Errorf("expected the result of test target %q, got %q", comps[j].TestTargetName(), res.TestTarget)
+			}
+			stats.add(i*len(comps)+j, res)
+		}
+	}
+
+	if stats.total != 4 || len(stats.skipped) != 4 {
+		t.Errorf("expected the not expanded results to count as 4 skipped results, got %d of %d", len(stats.skipped), stats.total)
+	}
+	if got := stats.causes()[comparer.SkipNotExpanded]; got != 4 {
+		t.Errorf("expected 4 results with the not-expanded cause, got %d", got)
+	}
+	want := []testcases.EmptyExpansion{{Query: "demo offset {{.offset}}", Placeholder: "offset"}}
+	if !reflect.DeepEqual(stats.notExpanded, want) {
+		t.Errorf("expected the template to be listed as not expanded once, got %+v", stats.notExpanded)
+	}
+}
+
+func TestLoadConfigOnEmptyExpansion(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	content := `
+placeholder_overrides:
+  offset:
+    include_only: [1m]
+    exclude: [1m]
+test_cases:
+- query: demo offset {{.offset}}
+  variant_args: [offset]
+- query: demo
+`
+	if _, _, _, err := loadConfig(writeConfig(t, dir, content), false); err == nil {
+		t.Fatal("expected the placeholder without values to fail loading the configuration")
+	}
+	cfg, placeholders, _, err := loadConfig(writeConfig(t, dir, content+"on_empty_expansion: skip_with_warning\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []testcases.EmptyExpansion{{Query: "demo offset {{.offset}}", Placeholder: "offset"}}
+	if got := testcases.EmptyExpansions(cfg.TestCases, placeholders); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the empty expansions %+v, got %+v", want, got)
+	}
+}
+
+// budgetTestCase returns a test case of a category with the given tags.
+func budgetTestCase(query, category string, tags ...string) *comparer.TestCase {
+	return &comparer.TestCase{Query: query, Category: category, Tags: tags}
+}
+
+func TestTimeBudgetsFairness(t *testing.T) {
+	budgets := newTimeBudgets(map[string]model.Duration{
+		"subqueries": model.Duration(10 * time.Minute),
+		"default":    model.Duration(40 * time.Minute),
+	}, nil)
+	// Slow subqueries alternate with fast test cases of other categories, as in a prioritized order.
+	ran := map[string]int{}
+	notRun := map[string]int{}
+	for i := 0; i < 20; i++ {
+		for _, c := range []struct {
+			category string
+			duration time.Duration
+		}{{"subqueries", 3 * time.Minute}, {"histograms", time.Minute}, {"selectors", time.Minute}} {
+			tc := budgetTestCase(fmt.Sprintf("%s_%d", c.category, i), c.category)
+			if reason := budgets.exceeded(tc); reason != "" {
+				notRun[c.category]++
+				continue
+			}
+			ran[c.category]++
+			budgets.spend(tc, c.duration)
+		}
+	}
+	// The subqueries run until they spent their 10 minutes, and the other categories share the
+	// default budget until they spent its 40 minutes.
+	if want := map[string]int{"subqueries": 4, "histograms": 20, "selectors": 20}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("expected the compared test cases %v, got %v", want, ran)
+	}
+	if want := map[string]int{"subqueries": 16}; !reflect.DeepEqual(notRun, want) {
+		t.Errorf("expected the test cases not run %v, got %v", want, notRun)
+	}
+
+	want := []string{
+		"histograms: 20 test cases in 20m0s (1m0s on average)",
+		"selectors: 20 test cases in 20m0s (1m0s on average)",
+		"subqueries: 4 test cases in 12m0s (3m0s on average)",
+		`category "subqueries" time budget: spent 12m0s of 10m0s, exhausted with 16 comparisons not run`,
+		"default time budget: spent 40m0s of 40m0s",
+	}
+	if got := budgets.stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the budget stats\n%q\ngot\n%q", want, got)
+	}
+	if reason := budgets.exceeded(budgetTestCase("up", "selectors")); reason != "not run: the default time budget of 40m0s was exhausted" {
+		t.Errorf("expected the default budget to be exhausted, got %q", reason)
+	}
+}
+
+func TestTimeBudgetsGroups(t *testing.T) {
+	budgets := newTimeBudgets(
+		map[string]model.Duration{"histograms": model.Duration(10 * time.Minute), "default": model.Duration(time.Hour)},
+		map[string]model.Duration{"slow": model.Duration(2 * time.Minute)},
+	)
+	for _, tc := range []struct {
+		tc   *comparer.TestCase
+		want []string
+	}{
+		{tc: budgetTestCase("a", "histograms"), want: []string{`category "histograms" time budget of 10m0s`}},
+		{tc: budgetTestCase("b", "histograms", "slow"), want: []string{`category "histograms" time budget of 10m0s`, `tag "slow" time budget of 2m0s`}},
+		{tc: budgetTestCase("c", "selectors", "slow"), want: []string{`tag "slow" time budget of 2m0s`}},
+		{tc: budgetTestCase("d", "selectors"), want: []string{"default time budget of 1h0m0s"}},
+		{tc: budgetTestCase("e", ""), want: []string{"default time budget of 1h0m0s"}},
+	} {
+		if got := budgets.describe(tc.tc); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: expected the budgets %q, got %q", tc.tc.Query, tc.want, got)
+		}
+	}
+
+	// A test case with a tag budget is not run once either of its budgets is exhausted.
+	budgets.spend(budgetTestCase("c", "selectors", "slow"), 2*time.Minute)
+	if reason := budgets.exceeded(budgetTestCase("b", "histograms", "slow")); reason != `not run: the tag "slow" time budget of 2m0s was exhausted` {
+		t.Errorf("expected the tag budget to be exhausted, got %q", reason)
+	}
+	if reason := budgets.exceeded(budgetTestCase("a", "histograms")); reason != "" {
+		t.Errorf("expected the histograms without the tag to still run, got %q", reason)
+	}
+	if reason := newTimeBudgets(nil, nil).exceeded(budgetTestCase("a", "histograms")); reason != "" {
+		t.Errorf("expected no budgets to apply without configured budgets, got %q", reason)
+	}
+}
+
+func TestCompareTestCaseBudgetExhausted(t *testing.T) {
+	// The targets are never queried for test cases whose budget is exhausted.
+	comps := []*comparer.Comparer{comparer.New(nil, nil, nil, comparer.Options{TestTargetName: "a"})}
+	budgets := newTimeBudgets(map[string]model.Duration{"subqueries": model.Duration(time.Minute)}, nil)
+	tc := budgetTestCase("rate(demo[5m:1m])", "subqueries")
+	budgets.spend(tc, time.Minute)
+
+	results := compareTestCase(comps, tc, budgets, nil, nil)
+	if len(results) != 1 {
+		t.Fatalf("expected a result per test target, got %d", len(results))
+	}
+	res := results[0]
+	if !res.NotRun || res.SkipCause != comparer.SkipBudgetExhausted || res.SkipReason != `not run: the category "subqueries" time budget of 1m0s was exhausted` || res.TestTarget != "a" {
+		t.Errorf("expected a not run result, got %+v", res)
+	}
+	stats := newRunStats(0)
+	stats.add(0, res)
+	if stats.notRun != 1 || stats.total != 0 {
+		t.Errorf("expected the result to count as not run, got %d not run of %d", stats.notRun, stats.total)
+	}
+}
+
+func TestCompareTestCaseSkipCauses(t *testing.T) {
+	comps := []*comparer.Comparer{
+		comparer.New(nil, nil, nil, comparer.Options{TestTargetName: "a"}),
+		comparer.New(nil, nil, nil, comparer.Options{TestTargetName: "b"}),
+	}
+	budgets := newTimeBudgets(map[string]model.Duration{"subqueries": model.Duration(time.Minute)}, nil)
+	// Only the test target b lacks data before 01:00.
+	retention := &retentionHorizons{test: []time.Time{{}, time.Unix(3600, 0)}}
+	window := func(tc *comparer.TestCase) *comparer.TestCase {
+		tc.Type, tc.Start, tc.End, tc.Resolution = config.QueryTypeRange, time.Unix(0, 0), time.Unix(7200, 0), time.Minute
+		return tc
+	}
+	exhausted := window(budgetTestCase("rate(demo[5m:1m])", "subqueries"))
+	budgets.spend(exhausted, time.Minute)
+
+	// That test target b cannot answer the test case takes precedence over the exhausted budget.
+	var got [][2]string
+	for _, res := range compareTestCase(comps, exhausted, budgets, retention, nil) {
+		got = append(got, [2]string{res.TestTarget, res.SkipCause})
+	}
+	if want := [][2]string{{"a", comparer.SkipBudgetExhausted}, {"b", comparer.SkipPreconditionNotMet}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the skip causes %v, got %v", want, got)
+	}
+
+	stats := newRunStats(0)
+	results := compareTestCase(comps, exhausted, budgets, retention, nil)
+	results = append(results, notRunResults(comps, window(budgetTestCase("sum(demo)", "aggregations")), "not run: the run was interrupted")...)
+	for i, res := range results {
+		if res.SkipCause == comparer.SkipAbortedEarly && (!res.NotRun || res.SkipReason != "not run: the run was interrupted") {
+			t.Errorf("expected a not run result of the interrupted run, got %+v", res)
+		}
+		stats.add(i, res)
+	}
+	stats.filtered = []filteredTestCase{{Query: "demo", Cause: comparer.SkipFilteredByRegex}, {Query: "max(demo)", Cause: comparer.SkipExcludedTag}, {Query: "min(demo)", Cause: comparer.SkipExcludedTag}}
+	want := map[string]int{
+		comparer.SkipBudgetExhausted:    1,
+		comparer.SkipPreconditionNotMet: 1,
+		comparer.SkipAbortedEarly:       2,
+		comparer.SkipFilteredByRegex:    1,
+		comparer.SkipExcludedTag:        2,
+	}
+	if got := stats.causes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the skip causes %v, got %v", want, got)
+	}
+	logSummary(stats, budgets)
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	filename := filepath.Join(dir, "summary.json")
+	if err := writeSummaryFile(filename, stats, nil, nil, 0, nil, nil, nil, nil, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary struct {
+		SkipCauses map[string]int `json:"skipCauses"`
+	}
+	if err := json.Unmarshal(content, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(summary.SkipCauses, want) {
+		t.Errorf("expected the skip causes %v in the summary file, got %v", want, summary.SkipCauses)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// exitCodeInterrupted is the exit status of runs that were interrupted by SIGINT or SIGTERM.
+const exitCodeInterrupted = 130
+
+// errInterrupted stops the generation of test cases once the run was interrupted.
+var errInterrupted = errors.New("run interrupted")
+
+// interruptContext returns a context that is canceled on the first SIGINT or SIGTERM, after which the
+// run stops starting new comparisons and writes the results collected so far. A second signal exits
+// immediately.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Warnf("Received %v, waiting for in-flight test cases and writing partial results. Repeat to exit immediately.", sig)
+		cancel()
+		<-sigs
+		os.Exit(exitCodeInterrupted)
+	}()
+	return ctx
+}
+
+// withRunTimeout returns a context that is also canceled at the deadline, if it is set, after which
+// the run stops like an interrupted one.
+func withRunTimeout(ctx context.Context, deadline time.Time, timeout time.Duration) context.Context {
+	if deadline.IsZero() {
+		return ctx
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Warnf("The -run-timeout of %v expired, waiting for in-flight test cases and writing partial results.", timeout)
+		}
+		cancel()
+	}()
+	return ctx
+}
+
+// notRunReason returns why the test cases that were not compared before ctx was canceled were not run.
+func notRunReason(ctx context.Context) string {
+	if ctx.Err() == context.DeadlineExceeded {
+		return "not run: the -run-timeout expired"
+	}
+	return "not run: the run was interrupted"
+}
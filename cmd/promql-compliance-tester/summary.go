@@ -0,0 +1,815 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+	"github.com/promlabs/promql-compliance-tester/output"
+	"github.com/promlabs/promql-compliance-tester/testcases"
+)
+
+const exitCodeHelp = `
+Exit codes:
+  0	The run completed, and the percentages of failed test cases and of test cases
+	that could not be executed are both at most -fail-threshold.
+  1	The configuration or flags are invalid, the output could not be written, or
+	either of the above percentages exceeds -fail-threshold and -no-fail is not set.
+  3	-fail-on-history-regression is set, -no-fail is not, and a pass rate dropped by
+	more than -history-regression-threshold points below its mean over the recorded runs.
+  4	-baseline is set, -no-fail is not, and test cases that passed in the baseline run
+	failed or could not be executed. -fail-threshold does not apply with -baseline.
+  5	The ingestion parity of a test target is below ingestion_parity.min_parity_percent
+	and on_low_parity is gate. The test cases were not run.
+  6	The reference target lacks data that a requires section declares, and its on_unmet
+	is fail. The test cases were not run.
+  130	The run was interrupted by SIGINT or SIGTERM, or -run-timeout expired. The
+	results collected until then were written.
+`
+
+// exitCodeHistoryRegression is the exit status of runs that fail -fail-on-history-regression.
+const exitCodeHistoryRegression = 3
+
+// exitCodeBaselineRegression is the exit status of runs with test cases that regressed against -baseline.
+const exitCodeBaselineRegression = 4
+
+// maxLoggedBaselineChanges bounds the test cases logged per kind of change against -baseline.
+const maxLoggedBaselineChanges = 20
+
+// maxLoggedCachedResponses bounds the test cases with cached test responses that are logged.
+const maxLoggedCachedResponses = 20
+
+// Valid -failed-query-order values.
+const (
+	failedQueryOrderIndex = "index"
+	failedQueryOrderQuery = "query"
+)
+
+// runStats tracks the outcomes of a test run without retaining passing results.
+type runStats struct {
+	total   int
+	failed  []*comparer.Result
+	skipped []*comparer.Result
+	errored []*comparer.Result
+	// interrupted is set if the run was interrupted before all test cases were compared.
+	interrupted bool
+	// chaos is set if a result was produced with injected faults.
+	chaos bool
+	// notRun counts the results of test cases that were not compared because the run was interrupted
+	// or their time budget was exhausted.
+	// They are not included in the other counts.
+	notRun  int
+	history *output.HistoryRecord
+	// slow holds the results whose test query took longer than slowThreshold, if it is positive.
+	slow          []*comparer.Result
+	slowThreshold time.Duration
+	// index maps the retained results to their stable index in the run, which does not depend on
+	// the order in which concurrent comparisons complete.
+	index map[*comparer.Result]int
+	// parityChecked and parityDrifted count the test cases whose requests were checked for request
+	// parity, and those that sent differing query parameters to the targets.
+	parityChecked int
+	parityDrifted int
+	// cached holds the results whose test responses show evidence of being served from a cache.
+	cached []*comparer.Result
+	// invalid lists the test case entries that were skipped when loading the configuration. They
+	// are not included in the other counts.
+	invalid []config.InvalidTestCase
+	// filtered lists the test cases of the configuration that the filter flags left out. They are
+	// not expanded and not included in the other counts.
+	filtered []filteredTestCase
+	// skipCauses counts the skipped and not run results by their SkipCause.
+	skipCauses map[string]int
+	// notExpanded lists the test case templates that were not expanded, once each.
+	notExpanded []testcases.EmptyExpansion
+	// concurrency summarizes the adaptive concurrency of -concurrency auto.
+	concurrency *concurrencySummary
+	// outcomes holds the outcomes of all results by their stable index if trackOutcomes is set,
+	// for the comparison with -baseline.
+	trackOutcomes bool
+	outcomes      map[int]output.CaseOutcome
+}
+
+func newRunStats(slowThreshold time.Duration) *runStats {
+	return &runStats{history: &output.HistoryRecord{Time: time.Now().UTC()}, slowThreshold: slowThreshold, index: map[*comparer.Result]int{}, skipCauses: map[string]int{}}
+}
+
+// add records a result with its stable index in the run.
+func (s *runStats) add(idx int, res *comparer.Result) {
+	if res.SkipCause != "" {
+		s.skipCauses[res.SkipCause]++
+	}
+	if p := res.TestCase.NotExpanded; p != "" {
+		s.addNotExpanded(testcases.EmptyExpansion{Query: res.TestCase.Query, Placeholder: p})
+	}
+	if res.NotRun {
+		s.notRun++
+		return
+	}
+	s.total++
+	s.chaos = s.chaos || res.Chaos
+	s.history.Add(res)
+	if s.slowThreshold > 0 && res.TestDuration > s.slowThreshold {
+		s.slow = append(s.slow, res)
+	}
+	if s.trackOutcomes {
+		if s.outcomes == nil {
+			s.outcomes = map[int]output.CaseOutcome{}
+		}
+		s.outcomes[idx] = output.NewCaseOutcome(res)
+	}
+	if p := res.RequestParity; p != nil {
+		s.parityChecked++
+		if len(p.Drift) > 0 {
+			s.parityDrifted++
+		}
+	}
+	if res.CacheHit != "" {
+		s.cached = append(s.cached, res)
+	}
+	switch {
+	case res.Skipped(), res.Errored(), res.Failed():
+		s.index[res] = idx
+	}
+	switch {
+	case res.Skipped():
+		s.skipped = append(s.skipped, res)
+	case res.Errored():
+		s.errored = append(s.errored, res)
+	case res.Failed():
+		s.failed = append(s.failed, res)
+	}
+}
+
+// causes returns the numbers of filtered out test cases and of skipped and not run results by cause.
+func (s *runStats) causes() map[string]int {
+	causes := make(map[string]int, len(s.skipCauses)+2)
+	for cause, n := range s.skipCauses {
+		causes[cause] = n
+	}
+	for _, f := range s.filtered {
+		causes[f.Cause]++
+	}
+	return causes
+}
+
+// addNotExpanded records a test case template that was not expanded, unless it was already, e.g.
+// for another time parameter set or test target.
+func (s *runStats) addNotExpanded(e testcases.EmptyExpansion) {
+	for _, seen := range s.notExpanded {
+		if seen == e {
+			return
+		}
+	}
+	s.notExpanded = append(s.notExpanded, e)
+}
+
+// sortResults orders the retained results by their stable index, or alphabetically by query and
+// test target if order is failedQueryOrderQuery, so that repeated runs list them identically.
+func (s *runStats) sortResults(order string) {
+	less := func(rs []*comparer.Result) func(i, j int) bool {
+		return func(i, j int) bool {
+			if order == failedQueryOrderQuery {
+				if rs[i].TestCase.Query != rs[j].TestCase.Query {
+					return rs[i].TestCase.Query < rs[j].TestCase.Query
+				}
+				if rs[i].TestTarget != rs[j].TestTarget {
+					return rs[i].TestTarget < rs[j].TestTarget
+				}
+			}
+			return s.index[rs[i]] < s.index[rs[j]]
+		}
+	}
+	for _, rs := range [][]*comparer.Result{s.failed, s.errored, s.skipped} {
+		sort.SliceStable(rs, less(rs))
+	}
+}
+
+// caseOutcomes returns the tracked outcomes in the order of their stable index.
+func (s *runStats) caseOutcomes() []output.CaseOutcome {
+	idxs := make([]int, 0, len(s.outcomes))
+	for idx := range s.outcomes {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+	outcomes := make([]output.CaseOutcome, 0, len(idxs))
+	for _, idx := range idxs {
+		outcomes = append(outcomes, s.outcomes[idx])
+	}
+	return outcomes
+}
+
+// timedOut returns the errored results whose queries exceeded their timeout.
+func (s *runStats) timedOut() []*comparer.Result {
+	var res []*comparer.Result
+	for _, r := range s.errored {
+		if r.QueryTimeout > 0 {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+func (s *runStats) percent(n int) float64 {
+	// Runs without results, e.g. gated by their ingestion parity, have no rates.
+	if s.total == 0 {
+		return 0
+	}
+	return float64(n) / float64(s.total) * 100
+}
+
+func (s *runStats) successful() int {
+	return s.total - len(s.failed) - len(s.errored) - len(s.skipped)
+}
+
+// runSummary is the machine-readable summary of a test run written to -summary-file.
+type runSummary struct {
+	Total         int           `json:"total"`
+	Successful    int           `json:"successful"`
+	Failed        int           `json:"failed"`
+	Errored       int           `json:"errored"`
+	Skipped       int           `json:"skipped"`
+	SuccessRate   float64       `json:"successRate"`
+	FailureRate   float64       `json:"failureRate"`
+	ErrorRate     float64       `json:"errorRate"`
+	FailedQueries []failedQuery `json:"failedQueries"`
+	Interrupted   bool          `json:"interrupted"`
+	// NotRun is the number of results of test cases that were not compared because the run was
+	// interrupted, -run-timeout expired, or their time budget was exhausted.
+	NotRun int `json:"notRun,omitempty"`
+	// Chaos is set if faults were injected into the requests of the run with -chaos.
+	Chaos bool `json:"chaos,omitempty"`
+	// RetentionHorizons are the earliest times from which on the targets were found to have samples.
+	// Targets with samples at the start of the earliest test case window report that start.
+	RetentionHorizons map[string]time.Time `json:"retentionHorizons,omitempty"`
+	// ClockDrifts are the estimated drifts of the clocks of the targets from the local clock.
+	ClockDrifts []clockDrift `json:"clockDrifts,omitempty"`
+	// TimeJitterSeed is the -time-jitter-seed that the windows of the test cases were shifted with.
+	TimeJitterSeed int64 `json:"timeJitterSeed,omitempty"`
+	// Waits is the time that the queries spent waiting on each target, by cause.
+	Waits []comparer.WaitTime `json:"waits,omitempty"`
+	// RetriesExhausted is set if -max-retry-wait was exhausted and later queries were not retried.
+	RetriesExhausted bool `json:"retriesExhausted,omitempty"`
+	// Baseline lists the test cases whose outcomes changed against -baseline, if set.
+	Baseline *output.BaselineDiff `json:"baseline,omitempty"`
+	// Options lists the resolved flags of the run with their sources.
+	Options []resolvedOption `json:"options,omitempty"`
+	// Requirements holds the outcomes of checking the data that the test case files declare they
+	// require against the reference target.
+	Requirements []*comparer.RequirementsReport `json:"requirements,omitempty"`
+	// IngestionParity compares the data ingested by the targets, apart from the compliance of the
+	// test cases.
+	IngestionParity []*comparer.IngestionReport `json:"ingestionParity,omitempty"`
+	// PlaceholderOverrides lists the placeholders whose values the configuration restricted, which
+	// reduces the coverage of the test cases.
+	PlaceholderOverrides []testcases.PlaceholderCoverage `json:"placeholderOverrides,omitempty"`
+	// Invalid counts the test case entries that were skipped since they were invalid, which
+	// InvalidTestCases lists. They are not included in Total.
+	Invalid          int                      `json:"invalid,omitempty"`
+	InvalidTestCases []config.InvalidTestCase `json:"invalidTestCases,omitempty"`
+	// Concurrency summarizes the concurrency that -concurrency auto adapted to the test target.
+	Concurrency *concurrencySummary `json:"concurrency,omitempty"`
+	// UnusedRules lists the rules of the configuration that never applied during the run.
+	UnusedRules []comparer.RuleHits `json:"unusedRules,omitempty"`
+	// SkipCauses counts the planned test cases that were not compared by cause, see the Skip
+	// constants of the comparer package. The causes of filtered out test cases count test cases
+	// of the configuration, the others count results.
+	SkipCauses map[string]int `json:"skipCauses,omitempty"`
+	// NotExpanded lists the test case templates that expanded into no queries, since a placeholder
+	// that they use has no values. Their results are skipped as not-expanded.
+	NotExpanded []testcases.EmptyExpansion `json:"notExpanded,omitempty"`
+}
+
+type failedQuery struct {
+	Query string `json:"query"`
+	// TimeParameterSet is the name of the query time parameter set that the query failed with.
+	TimeParameterSet string `json:"timeParameterSet,omitempty"`
+	// Outcome is "failed" for non-compliant results and "error" for test cases that could not be executed.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error"`
+	// Timeout is the query timeout that the query exceeded, if it timed out.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// failureReason returns a one-line description of why a failed or errored result did not pass.
+func failureReason(res *comparer.Result) string {
+	switch {
+	case res.Errored():
+		return res.ExecutionError
+	case res.UnexpectedFailure != "":
+		return "test API failed: " + res.UnexpectedFailure
+	case res.ConsistencyViolation:
+		return fmt.Sprintf("internal consistency violation: the test API returned a different result for same_as %q", res.TestCase.SameAs)
+	case res.UnexpectedSuccess && res.RefError != "":
+		return "query succeeded, but the reference API rejected it: " + res.RefError
+	case res.UnexpectedSuccess:
+		return "query succeeded, but should have failed"
+	case res.ErrorMismatch:
+		return fmt.Sprintf("query failed with different errors: reference: %s, test: %s", res.RefError, res.TestError)
+	case res.StructuredDiff != nil:
+		return "query returned different results: " + res.StructuredDiff.Summary()
+	case res.Diff != "":
+		return "query returned different results: " + strings.SplitN(strings.TrimSpace(res.Diff), "\n", 2)[0]
+	case res.WarningsMismatch:
+		return fmt.Sprintf("query returned different warnings: reference: %q, test: %q", res.RefAPIWarnings, res.TestAPIWarnings)
+	default:
+		return "query returned different results"
+	}
+}
+
+// writeSummaryFile writes the machine-readable summary of a test run to filename.
+func writeSummaryFile(filename string, stats *runStats, retentionHorizons map[string]time.Time, clockDrifts []clockDrift, timeJitterSeed int64, waits *comparer.WaitBudget, rules *comparer.RuleUsage, baselineDiff *output.BaselineDiff, options []resolvedOption, requirements []*comparer.RequirementsReport, ingestion []*comparer.IngestionReport, placeholders []testcases.PlaceholderCoverage) error {
+	s := runSummary{
+		Total:         stats.total,
+		Successful:    stats.successful(),
+		Failed:        len(stats.failed),
+		Errored:       len(stats.errored),
+		Skipped:       len(stats.skipped),
+		SuccessRate:   stats.percent(stats.successful()),
+		FailureRate:   stats.percent(len(stats.failed)),
+		ErrorRate:     stats.percent(len(stats.errored)),
+		FailedQueries: []failedQuery{},
+		Interrupted:   stats.interrupted,
+		NotRun:        stats.notRun,
+		Chaos:         stats.chaos,
+	}
+	s.RetentionHorizons = retentionHorizons
+	s.ClockDrifts = clockDrifts
+	s.TimeJitterSeed = timeJitterSeed
+	s.Waits = waits.Waits()
+	if stats.total > 0 && !stats.interrupted {
+		s.UnusedRules = rules.Unused()
+	}
+	s.RetriesExhausted = waits.RetriesExhausted()
+	s.Baseline = baselineDiff
+	s.Options = options
+	s.Requirements = requirements
+	s.IngestionParity = ingestion
+	s.PlaceholderOverrides = placeholders
+	s.Invalid, s.InvalidTestCases = len(stats.invalid), stats.invalid
+	s.Concurrency = stats.concurrency
+	s.SkipCauses = stats.causes()
+	s.NotExpanded = stats.notExpanded
+	for _, res := range stats.failed {
+		s.FailedQueries = append(s.FailedQueries, failedQuery{Query: res.TestCase.Query, TimeParameterSet: res.TestCase.TimeParameterSet, Outcome: "failed", Error: failureReason(res)})
+	}
+	for _, res := range stats.errored {
+		fq := failedQuery{Query: res.TestCase.Query, TimeParameterSet: res.TestCase.TimeParameterSet, Outcome: "error", Error: failureReason(res)}
+		if res.QueryTimeout > 0 {
+			fq.Timeout = res.QueryTimeout.String()
+		}
+		s.FailedQueries = append(s.FailedQueries, fq)
+	}
+	buf, err := output.MarshalJSON(s, "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(buf, '\n'), 0644)
+}
+
+// runGate decides how a finished test run is reported and whether it fails the process.
+type runGate struct {
+	summaryFile   string
+	historyFile   string
+	failThreshold float64
+	noFail        bool
+	// maxRequestDrift is the percentage of test cases checked for request parity that may send
+	// differing query parameters to the targets.
+	maxRequestDrift float64
+	// forbidCachedResponses fails the run if any test response was served from a cache.
+	forbidCachedResponses bool
+	// baseline, if set, holds the earlier runs whose pass rates regressions are reported against,
+	// and failOnHistoryRegression fails the run on any regression.
+	baseline                *output.HistoryBaseline
+	failOnHistoryRegression bool
+	// baselineOutcomes, if set, are the test case outcomes of the -baseline run. The run then only
+	// fails on test cases that regressed against them, instead of on -fail-threshold.
+	baselineOutcomes []output.CaseOutcome
+	// failedQueryOrder is the -failed-query-order that failed queries are listed in.
+	failedQueryOrder string
+	// retentionHorizons and clockDrifts are included in the summary file.
+	retentionHorizons map[string]time.Time
+	clockDrifts       []clockDrift
+	// timeJitterSeed, if set, is the -time-jitter-seed included in the summary file.
+	timeJitterSeed int64
+	// waits holds the time that the queries of the run spent waiting on the targets, which is
+	// logged and included in the summary file, and runStart is when the run started.
+	waits    *comparer.WaitBudget
+	runStart time.Time
+	// ruleUsage counts how often the rules of the configuration applied, and failOnDeadRules fails
+	// the run if any never did.
+	ruleUsage       *comparer.RuleUsage
+	failOnDeadRules bool
+	// options are the resolved flags of the run, which are included in the summary file.
+	options []resolvedOption
+	// requirements holds the outcomes of checking the declared requirements against the reference target.
+	requirements []*comparer.RequirementsReport
+	// ingestion holds the ingestion parity of the test targets, if it was checked.
+	ingestion []*comparer.IngestionReport
+	// placeholders are the placeholders restricted by the configuration, which are included in the
+	// summary file.
+	placeholders []testcases.PlaceholderCoverage
+	// invalidTestCases are the test case entries skipped when loading the configuration.
+	invalidTestCases []config.InvalidTestCase
+	// filteredTestCases are the test cases of the configuration that the filter flags left out.
+	filteredTestCases []filteredTestCase
+	// badges, if set, are the badge files to write with the pass rate of the run.
+	badges *badgeFiles
+	// notifier, if set, is notified of the outcome of the run.
+	notifier *webhookNotifier
+	// recorder, if set, holds the recorded target responses to write.
+	recorder *fixtureRecorder
+}
+
+// finish orders the failed queries, writes the recorded responses, the summary file, the badge files, and the notification,
+// if configured, and exits according to
+// the failure threshold, or with exitCodeInterrupted if the run was interrupted.
+func (g runGate) finish(stats *runStats) {
+	stats.sortResults(g.failedQueryOrder)
+	var baselineDiff *output.BaselineDiff
+	if g.baselineOutcomes != nil {
+		baselineDiff = output.CompareBaseline(g.baselineOutcomes, stats.caseOutcomes())
+	}
+	if g.recorder != nil {
+		if err := g.recorder.write(); err != nil {
+			log.Fatalf("Error recording target responses: %v", err)
+		}
+	}
+	logWaits(g.waits, time.Since(g.runStart))
+	logUnusedRules(stats, g.ruleUsage)
+	if g.summaryFile != "" {
+		if err := writeSummaryFile(g.summaryFile, stats, g.retentionHorizons, g.clockDrifts, g.timeJitterSeed, g.waits, g.ruleUsage, baselineDiff, g.options, g.requirements, g.ingestion, g.placeholders); err != nil {
+			log.Fatalf("Error writing summary file: %v", err)
+		}
+	}
+	if err := g.badges.write(stats); err != nil {
+		log.Fatalf("Error writing badge file: %v", err)
+	}
+	if g.notifier != nil {
+		g.notifier.notify(stats, g.historyFile)
+	}
+	// Interrupted and chaos runs are not recorded, since their pass rates are not comparable.
+	if g.historyFile != "" && !stats.interrupted && !stats.chaos {
+		if err := output.AppendHistory(g.historyFile, stats.history); err != nil {
+			log.Fatalf("Error writing history file: %v", err)
+		}
+	}
+	if stats.interrupted {
+		log.Warnf("The run was interrupted, the results only cover the %d comparisons completed until then, %d were not run", stats.total, stats.notRun)
+		os.Exit(exitCodeInterrupted)
+	}
+	exitOnRequestDrift(stats, g.maxRequestDrift, g.noFail)
+	exitOnCachedResponses(stats, g.forbidCachedResponses, g.noFail)
+	exitOnUnusedRules(stats, g.ruleUsage, g.failOnDeadRules, g.noFail)
+	if baselineDiff != nil {
+		// The rates cannot exceed 100%, so that only the queries that could not be executed are logged.
+		exitOnThreshold(stats, 100, g.noFail)
+	} else {
+		exitOnThreshold(stats, g.failThreshold, g.noFail)
+	}
+	exitOnHistoryRegression(stats, g.baseline, g.failOnHistoryRegression, g.noFail)
+	exitOnBaselineRegression(baselineDiff, g.noFail)
+}
+
+// writeGateSummary writes the summary file of a run whose test cases are not run, with the
+// outcomes of the checks that ran before them.
+func (g runGate) writeGateSummary() {
+	if g.summaryFile == "" {
+		return
+	}
+	stats := newRunStats(0)
+	stats.invalid = g.invalidTestCases
+	stats.filtered = g.filteredTestCases
+	if err := writeSummaryFile(g.summaryFile, stats, g.retentionHorizons, g.clockDrifts, g.timeJitterSeed, g.waits, g.ruleUsage, nil, g.options, g.requirements, g.ingestion, g.placeholders); err != nil {
+		log.Fatalf("Error writing summary file: %v", err)
+	}
+}
+
+// exitOnIngestionParity exits with exitCodeIngestionParity without running the test cases, after
+// writing the summary file with the ingestion parity.
+func (g runGate) exitOnIngestionParity() {
+	g.writeGateSummary()
+	log.Errorf("Not running the test cases, since the ingestion parity is too low and ingestion_parity.on_low_parity is %s", config.IngestionParityGate)
+	os.Exit(exitCodeIngestionParity)
+}
+
+// logSummary logs the outcome of a test run.
+func logSummary(stats *runStats, budgets *timeBudgets) {
+	successfulTests := stats.successful()
+
+	log.Infof("Test execution summary:")
+	log.Infof("  Total test cases: %d", stats.total)
+	log.Infof("  Passed: %d (%.2f%%)", successfulTests, stats.percent(successfulTests))
+	log.Infof("  Failed: %d (%.2f%%)", len(stats.failed), stats.percent(len(stats.failed)))
+	log.Infof("  Execution errors: %d (%.2f%%)", len(stats.errored), stats.percent(len(stats.errored)))
+	if timedOut := stats.timedOut(); len(timedOut) > 0 {
+		log.Warnf("  Timed out: %d", len(timedOut))
+		for _, res := range timedOut {
+			log.Warnf("    %s: exceeded the query timeout of %v", res.TestCase.Name(), res.QueryTimeout)
+		}
+	}
+	if stats.notRun > 0 {
+		log.Warnf("  Not run: %d", stats.notRun)
+	}
+	if len(stats.invalid) > 0 {
+		log.Warnf("  Invalid test case entries, not run: %d", len(stats.invalid))
+	}
+	if len(stats.notExpanded) > 0 {
+		log.Warnf("  Test case templates not expanded: %d", len(stats.notExpanded))
+		for _, e := range stats.notExpanded {
+			log.Warnf("    %s: placeholder %s has no values", e.Query, e.Placeholder)
+		}
+	}
+	if causes := stats.causes(); len(causes) > 0 {
+		names := make([]string, 0, len(causes))
+		for cause := range causes {
+			names = append(names, cause)
+		}
+		sort.Strings(names)
+		for i, cause := range names {
+			names[i] = fmt.Sprintf("%s %d", cause, causes[cause])
+		}
+		log.Infof("  Not compared by cause: %s", strings.Join(names, ", "))
+	}
+	if len(stats.skipped) > 0 {
+		log.Infof("  Skipped: %d", len(stats.skipped))
+		for _, res := range stats.skipped {
+			log.Infof("    %s: %s", res.TestCase.Query, res.SkipReason)
+		}
+	}
+	if stats := budgets.stats(); len(stats) > 0 {
+		log.Infof("  Categories:")
+		for _, s := range stats {
+			log.Infof("    %s", s)
+		}
+	}
+	if stats.parityChecked > 0 {
+		log.Infof("  Request parity: %d of %d sampled test cases sent differing query parameters to the targets", stats.parityDrifted, stats.parityChecked)
+	}
+	if c := stats.concurrency; c != nil {
+		log.Infof("  Adaptive concurrency: peak %d, average %.1f, final %d of at most %d, decreased %d times", c.Peak, c.Average, c.Final, c.Max, c.Decreases)
+	}
+	logSlowQueries(stats)
+	logCachedResponses(stats)
+}
+
+// logInvalidTestCases warns about the test case entries that were skipped when loading the
+// configuration, since they were invalid.
+func logInvalidTestCases(invalid []config.InvalidTestCase) {
+	if len(invalid) == 0 {
+		return
+	}
+	log.Warnf("Invalid test cases: skipped %d test case entries that could not be loaded:", len(invalid))
+	for _, tc := range invalid {
+		log.Warnf("  %s", tc)
+	}
+}
+
+// logCachedResponses warns about the test cases whose test responses show evidence of being served
+// from a cache, since their results may be stale rather than non-compliant.
+func logCachedResponses(stats *runStats) {
+	if len(stats.cached) == 0 {
+		return
+	}
+	log.Warnf("%d test responses show evidence of being served from a cache, their results may be stale:", len(stats.cached))
+	for i, res := range stats.cached {
+		if i == maxLoggedCachedResponses {
+			log.Warnf("  ... and %d more", len(stats.cached)-i)
+			break
+		}
+		target := ""
+		if res.TestTarget != "" {
+			target = fmt.Sprintf(" [%s]", res.TestTarget)
+		}
+		log.Warnf("  %s%s: %s", res.TestCase.Query, target, res.CacheHit)
+	}
+}
+
+// exitOnCachedResponses exits with a non-zero status if forbid is set and any test response showed
+// evidence of being served from a cache, unless noFail is set.
+func exitOnCachedResponses(stats *runStats, forbid, noFail bool) {
+	if !forbid || len(stats.cached) == 0 {
+		return
+	}
+	log.Errorf("%d test responses were served from a cache and -forbid-cached-responses is set", len(stats.cached))
+	if noFail {
+		log.Warnf("Exiting successfully anyway because -no-fail is set")
+		return
+	}
+	os.Exit(1)
+}
+
+// logUnusedRules warns about the rules of the configuration that never applied during a run, since
+// stale rules can hide future differences. Interrupted runs may not have reached the test cases
+// that the rules apply to.
+func logUnusedRules(stats *runStats, rules *comparer.RuleUsage) {
+	if stats.total == 0 || stats.interrupted {
+		return
+	}
+	unused := rules.Unused()
+	if len(unused) == 0 {
+		return
+	}
+	log.Warnf("Config hygiene: %d rules of the configuration never applied during the run and may be stale:", len(unused))
+	for _, r := range unused {
+		log.Warnf("  %s", r)
+	}
+}
+
+// exitOnUnusedRules exits with a non-zero status if failOnDeadRules is set and any rule of the
+// configuration never applied during a run, unless noFail is set.
+func exitOnUnusedRules(stats *runStats, rules *comparer.RuleUsage, failOnDeadRules, noFail bool) {
+	if !failOnDeadRules || stats.total == 0 {
+		return
+	}
+	unused := rules.Unused()
+	if len(unused) == 0 {
+		return
+	}
+	log.Errorf("%d rules of the configuration never applied during the run and -fail-on-dead-rules is set", len(unused))
+	if noFail {
+		log.Warnf("Exiting successfully anyway because -no-fail is set")
+		return
+	}
+	os.Exit(1)
+}
+
+// logSlowQueries logs the test cases whose test query exceeded the slow query threshold, slowest first,
+// with the ratio of their test to reference query duration.
+func logSlowQueries(stats *runStats) {
+	if len(stats.slow) == 0 {
+		return
+	}
+	sort.SliceStable(stats.slow, func(i, j int) bool { return stats.slow[i].TestDuration > stats.slow[j].TestDuration })
+	log.Warnf("%d test queries took longer than %v:", len(stats.slow), stats.slowThreshold)
+	for i, res := range stats.slow {
+		ratio := "no successful reference query"
+		if res.RefDuration > 0 {
+			ratio = fmt.Sprintf("%.1fx reference %v", float64(res.TestDuration)/float64(res.RefDuration), res.RefDuration)
+		}
+		target := ""
+		if res.TestTarget != "" {
+			target = fmt.Sprintf(" [%s]", res.TestTarget)
+		}
+		log.Warnf("  %d. %v (%s)%s: %s", i+1, res.TestDuration, ratio, target, res.TestCase.Query)
+	}
+}
+
+// exitOnRequestDrift exits with a non-zero status if the percentage of test cases checked for request
+// parity that sent differing query parameters to the targets exceeds the threshold, unless noFail is set.
+func exitOnRequestDrift(stats *runStats, threshold float64, noFail bool) {
+	if stats.parityChecked == 0 {
+		return
+	}
+	driftRate := 100 * float64(stats.parityDrifted) / float64(stats.parityChecked)
+	if driftRate <= threshold {
+		return
+	}
+	log.Errorf("Request drift rate %.2f%% exceeds threshold of %.2f%%, the targets were not queried with equivalent parameters", driftRate, threshold)
+	if noFail {
+		log.Warnf("Exiting successfully anyway because -no-fail is set")
+		return
+	}
+	os.Exit(1)
+}
+
+// exitOnHistoryRegression logs the pass rates that regressed against the baseline and, if fail is
+// set, exits with exitCodeHistoryRegression if there are any, unless noFail is set.
+func exitOnHistoryRegression(stats *runStats, baseline *output.HistoryBaseline, fail, noFail bool) {
+	regressions := baseline.Regressions(stats.history)
+	if len(regressions) == 0 {
+		return
+	}
+	for _, r := range regressions {
+		log.Warnf("Pass rate of %s regressed: %.2f%%, %.2f points below the mean of %.2f%% over the last %d runs", r.Title(), r.Rate, r.Drop, r.TrailingMean, r.Runs)
+	}
+	if !fail {
+		return
+	}
+	if noFail {
+		log.Warnf("Exiting successfully anyway because -no-fail is set")
+		return
+	}
+	os.Exit(exitCodeHistoryRegression)
+}
+
+// exitOnBaselineRegression logs the test cases whose outcomes changed against the baseline run and
+// exits with exitCodeBaselineRegression if any newly failed or could not be executed, unless noFail
+// is set.
+func exitOnBaselineRegression(diff *output.BaselineDiff, noFail bool) {
+	if diff == nil {
+		return
+	}
+	logChanges := func(logf func(string, ...interface{}), title string, outcomes []output.CaseOutcome) {
+		if len(outcomes) == 0 {
+			return
+		}
+		logf("%s: %d", title, len(outcomes))
+		for i, o := range outcomes {
+			if i == maxLoggedBaselineChanges {
+				logf("  ... and %d more", len(outcomes)-i)
+				break
+			}
+			name := o.Query
+			if o.TimeParameterSet != "" {
+				name += " (" + o.TimeParameterSet + ")"
+			}
+			if o.TestTarget != "" {
+				name += " [" + o.TestTarget + "]"
+			}
+			logf("  %s %s", o.ID, name)
+		}
+	}
+	log.Infof("Comparison with the baseline run:")
+	logChanges(log.Errorf, "  Newly failing test cases", diff.NewlyFailing)
+	logChanges(log.Errorf, "  Newly erroring test cases", diff.NewlyErroring)
+	logChanges(log.Infof, "  Newly passing test cases", diff.NewlyPassing)
+	logChanges(log.Infof, "  Test cases only in the baseline run", diff.OnlyInBaseline)
+	logChanges(log.Infof, "  Test cases only in this run", diff.OnlyInCurrent)
+	if !diff.Regressed() {
+		log.Infof("  No test cases regressed")
+		return
+	}
+	if noFail {
+		log.Warnf("Exiting successfully anyway because -no-fail is set")
+		return
+	}
+	os.Exit(exitCodeBaselineRegression)
+}
+
+// exitOnThreshold prints the queries that could not be executed and exits with a non-zero status
+// if the failure or execution error rate exceeds the threshold percentage, unless noFail is set.
+func exitOnThreshold(stats *runStats, threshold float64, noFail bool) {
+	if len(stats.errored) > 0 {
+		log.Errorf("Found %d error(s) during test execution:", len(stats.errored))
+		for i, res := range stats.errored {
+			log.Errorf("  Error %d: %v", i+1, res.ExecutionError)
+		}
+
+		log.Errorf("")
+		log.Errorf("Failed queries summary:")
+		log.Errorf("===================")
+		for i, res := range stats.errored {
+			log.Errorf("%d. %s", i+1, res.TestCase.Query)
+		}
+		log.Errorf("")
+		log.Errorf("Complete PromQL queries that failed (copy-paste ready):")
+		log.Errorf("=====================================================")
+		for _, res := range stats.errored {
+			log.Errorf("%s", res.TestCase.Query)
+		}
+
+		// 同时输出到标准输出，便于复制
+		fmt.Printf("\n\n=== FAILED PROMQL QUERIES (Copy-paste ready) ===\n")
+		for _, res := range stats.errored {
+			fmt.Printf("%s\n", res.TestCase.Query)
+		}
+		fmt.Printf("=== END OF FAILED QUERIES ===\n\n")
+	}
+
+	errorRate := stats.percent(len(stats.errored))
+	failureRate := stats.percent(len(stats.failed))
+	if errorRate > threshold || failureRate > threshold {
+		log.Errorf("Failure rate %.2f%% or error rate %.2f%% exceeds threshold of %.2f%%", failureRate, errorRate, threshold)
+		if noFail {
+			log.Warnf("Exiting successfully anyway because -no-fail is set")
+			return
+		}
+		os.Exit(1)
+	}
+}
+
+// logWaits logs the time that the queries of a run spent waiting on each target, and whether the
+// retries were cut short by -max-retry-wait.
+func logWaits(waits *comparer.WaitBudget, runDuration time.Duration) {
+	byTarget := map[string][]comparer.WaitTime{}
+	var targets []string
+	for _, w := range waits.Waits() {
+		if _, ok := byTarget[w.Target]; !ok {
+			targets = append(targets, w.Target)
+		}
+		byTarget[w.Target] = append(byTarget[w.Target], w)
+	}
+	if len(targets) == 0 {
+		return
+	}
+	log.Infof("Time spent waiting in the %v run, adding up concurrent queries:", runDuration.Round(time.Second))
+	for _, t := range targets {
+		var total time.Duration
+		causes := make([]string, 0, len(byTarget[t]))
+		for _, w := range byTarget[t] {
+			total += w.Total
+			causes = append(causes, fmt.Sprintf("%s %v (%d)", w.Cause, w.Total.Round(time.Millisecond), w.Count))
+		}
+		log.Infof("  %s: %v: %s", t, total.Round(time.Millisecond), strings.Join(causes, ", "))
+	}
+	if waits.RetriesExhausted() {
+		log.Warnf("  The -max-retry-wait of %v was exhausted, later queries were not retried after transient errors.", waits.MaxRetryWait())
+	}
+}
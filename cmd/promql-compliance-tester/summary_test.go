@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+	"github.com/promlabs/promql-compliance-tester/output"
+)
+
+// jitteryTarget is a QueryTarget that answers after a random delay, so that concurrent comparisons
+// complete in a shuffled order. Queries starting with "error" fail, and the test target returns a
+// different value for queries starting with "fail".
+type jitteryTarget struct {
+	test bool
+}
+
+func (t *jitteryTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*comparer.QueryResult, error) {
+	time.Sleep(time.Duration(rand.Intn(2000)) * time.Microsecond)
+	if strings.HasPrefix(query, "error") {
+		return nil, errors.New("connection refused")
+	}
+	v := model.SampleValue(1)
+	if t.test && strings.HasPrefix(query, "fail") {
+		v = 2
+	}
+	return &comparer.QueryResult{Value: model.Vector{&model.Sample{Metric: model.Metric{"job": "demo"}, Value: v, Timestamp: 1000}}}, nil
+}
+
+func (t *jitteryTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*comparer.QueryResult, error) {
+	return nil, errors.New("not implemented")
+}
+
+// orderTestCases returns instant test cases whose queries are not in alphabetical order.
+func orderTestCases() []*comparer.TestCase {
+	var tcs []*comparer.TestCase
+	for i := 0; i < 40; i++ {
+		prefix := []string{"pass", "fail", "error"}[i%3]
+		tcs = append(tcs, &comparer.TestCase{Query: fmt.Sprintf("%s_%02d", prefix, 40-i), Type: config.QueryTypeInstant, Time: time.Unix(1, 0)})
+	}
+	return tcs
+}
+
+func TestFailedQueryOrder(t *testing.T) {
+	tcs := orderTestCases()
+	comps := []*comparer.Comparer{comparer.New(&jitteryTarget{}, &jitteryTarget{test: true}, nil, comparer.Options{})}
+	caseResults := runComparisons(context.Background(), comps, tcs, 8, nil, newTimeBudgets(nil, nil), nil, nil, pb.New(len(tcs)))
+
+	var wantFailed, wantErrored []string
+	for _, tc := range tcs {
+		switch {
+		case strings.HasPrefix(tc.Query, "fail"):
+			wantFailed = append(wantFailed, tc.Query)
+		case strings.HasPrefix(tc.Query, "error"):
+			wantErrored = append(wantErrored, tc.Query)
+		}
+	}
+	queries := func(rs []*comparer.Result) []string {
+		var qs []string
+		for _, res := range rs {
+			qs = append(qs, res.TestCase.Query)
+		}
+		return qs
+	}
+
+	var summaries []string
+	for seed := int64(1); seed <= 3; seed++ {
+		// Record the results in a shuffled order, like concurrent comparisons could complete in.
+		stats := newRunStats(0)
+		for _, i := range rand.New(rand.NewSource(seed)).Perm(len(caseResults)) {
+			stats.add(i, caseResults[i][0])
+		}
+
+		stats.sortResults(failedQueryOrderIndex)
+		if got := queries(stats.failed); !reflect.DeepEqual(got, wantFailed) {
+			t.Errorf("seed %d: expected the failed queries in test case order %v, got %v", seed, wantFailed, got)
+		}
+		// The copy-paste block lists the queries that could not be executed.
+		if got := queries(stats.errored); !reflect.DeepEqual(got, wantErrored) {
+			t.Errorf("seed %d: expected the errored queries in test case order %v, got %v", seed, wantErrored, got)
+		}
+
+		dir, cleanup := tempDir(t)
+		filename := filepath.Join(dir, "summary.json")
+		if err := writeSummaryFile(filename, stats, nil, nil, 0, nil, nil, nil, nil, nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(filename)
+		cleanup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		summaries = append(summaries, string(content))
+
+		stats.sortResults(failedQueryOrderQuery)
+		sorted := append([]string(nil), wantFailed...)
+		sort.Strings(sorted)
+		if got := queries(stats.failed); !reflect.DeepEqual(got, sorted) {
+			t.Errorf("seed %d: expected the failed queries in alphabetical order %v, got %v", seed, sorted, got)
+		}
+	}
+	for i, s := range summaries[1:] {
+		if s != summaries[0] {
+			t.Errorf("expected the summary files of all runs to be identical, run %d differs:\n%s\n%s", i+2, summaries[0], s)
+		}
+	}
+}
+
+func TestCachedResponsesStats(t *testing.T) {
+	stats := newRunStats(0)
+	for i, res := range []*comparer.Result{
+		{TestCase: &comparer.TestCase{Query: "fresh"}},
+		{TestCase: &comparer.TestCase{Query: "cached"}, CacheHit: "Age: 42"},
+		{TestCase: &comparer.TestCase{Query: "cached failure"}, CacheHit: "X-Cache: HIT", Diff: "different values"},
+		// Test cases that were not run have no responses to inspect.
+		{TestCase: &comparer.TestCase{Query: "not run"}, CacheHit: "Age: 1", NotRun: true},
+	} {
+		stats.add(i, res)
+	}
+	var got []string
+	for _, res := range stats.cached {
+		got = append(got, res.TestCase.Query)
+	}
+	if want := []string{"cached", "cached failure"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the cached test responses %q, got %q", want, got)
+	}
+	// Neither logging nor a run without -forbid-cached-responses exits.
+	logCachedResponses(stats)
+	exitOnCachedResponses(stats, false, false)
+	exitOnCachedResponses(stats, true, true)
+}
+
+func TestUnusedRulesInSummary(t *testing.T) {
+	rules := comparer.NewRuleUsage([]*config.QueryTweak{{DropResultLabels: []model.LabelName{"__tenant__"}}}, nil)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for _, tc := range []struct {
+		name        string
+		total       int
+		interrupted bool
+		want        bool
+	}{
+		{name: "complete run", total: 3, want: true},
+		// Interrupted runs may not have reached the test cases that the rules apply to.
+		{name: "interrupted run", total: 3, interrupted: true},
+		{name: "no test cases", total: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stats := newRunStats(0)
+			stats.total, stats.interrupted = tc.total, tc.interrupted
+			filename := filepath.Join(dir, "summary.json")
+			if err := writeSummaryFile(filename, stats, nil, nil, 0, nil, rules, nil, nil, nil, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			content, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listed := strings.Contains(string(content), `"rule": "drop_result_labels: __tenant__"`)
+			if listed != tc.want {
+				t.Errorf("expected the unused rule to be listed %v, got:\n%s", tc.want, content)
+			}
+		})
+	}
+	// Without -fail-on-dead-rules, unused rules only warn.
+	stats := newRunStats(0)
+	stats.total = 3
+	logUnusedRules(stats, rules)
+	exitOnUnusedRules(stats, rules, false, false)
+	exitOnUnusedRules(stats, rules, true, true)
+}
+
+func TestStableSummaryFile(t *testing.T) {
+	output.SetStableOutput(true)
+	defer output.SetStableOutput(false)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	stats := newRunStats(0)
+	for i, res := range []*comparer.Result{
+		{TestCase: &comparer.TestCase{Query: "fail_b"}, Diff: "different values"},
+		{TestCase: &comparer.TestCase{Query: "fail_a"}, Diff: "different values"},
+		{TestCase: &comparer.TestCase{Query: "passing"}},
+	} {
+		stats.add(i, res)
+	}
+	stats.total = 3
+	stats.sortResults(failedQueryOrderIndex)
+	filename := filepath.Join(dir, "summary.json")
+	var summaries []string
+	for i := 0; i < 2; i++ {
+		if err := writeSummaryFile(filename, stats, nil, nil, 0, nil, nil, nil, nil, nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		summaries = append(summaries, string(content))
+	}
+	if summaries[0] != summaries[1] {
+		t.Errorf("expected identical summary files, got:\n%s\n%s", summaries[0], summaries[1])
+	}
+	// The keys are sorted by name rather than in the order of the summary fields.
+	keys := []string{`"errorRate"`, `"failedQueries"`, `"interrupted"`, `"successRate"`, `"total"`}
+	for i := 1; i < len(keys); i++ {
+		if a, b := strings.Index(summaries[0], keys[i-1]), strings.Index(summaries[0], keys[i]); a < 0 || a > b {
+			t.Errorf("expected %s before %s, got:\n%s", keys[i-1], keys[i], summaries[0])
+		}
+	}
+	// The failed queries stay in the order of the test cases.
+	if strings.Index(summaries[0], `"fail_b"`) > strings.Index(summaries[0], `"fail_a"`) {
+		t.Errorf("expected the failed queries in test case order, got:\n%s", summaries[0])
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/promlabs/promql-compliance-tester/config"
+	"github.com/promlabs/promql-compliance-tester/testcases"
+)
+
+// maxListedExpansions is the number of test case templates expanding into the most queries that
+// -dry-run and -validate-only list.
+const maxListedExpansions = 10
+
+// loadConfig loads the configuration file, restricts the placeholders by its placeholder_overrides,
+// and checks that no test case template expands into more than max_expansions_per_case queries
+// with them, or into none unless on_empty_expansion allows it, without expanding any. It returns
+// the placeholders with their coverage.
+func loadConfig(filename string, lenient bool) (*config.Config, testcases.Placeholders, []testcases.PlaceholderCoverage, error) {
+	cfg, err := config.LoadFromFileLenient(filename, lenient)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	placeholders, coverage, err := testcases.OverridePlaceholders(cfg.PlaceholderOverrides, cfg.OnEmptyExpansion)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := testcases.CheckExpansions(cfg.TestCases, placeholders, cfg.MaxExpansionsPerCase, cfg.OnEmptyExpansion); err != nil {
+		return nil, nil, nil, err
+	}
+	return cfg, placeholders, coverage, nil
+}
+
+// writeValidation writes the outcome of -validate-only for a configuration file that loadConfig
+// loaded, with the test case templates expanding into the most queries.
+func writeValidation(w io.Writer, filename string, cfg *config.Config, placeholders testcases.Placeholders) {
+	fmt.Fprintf(w, "Configuration file %s is valid, with %d test case templates", filename, len(cfg.TestCases))
+	if n := len(cfg.InvalidTestCases); n > 0 {
+		fmt.Fprintf(w, " and %d invalid test cases skipped", n)
+	}
+	fmt.Fprintln(w, ".")
+	for _, e := range testcases.EmptyExpansions(cfg.TestCases, placeholders) {
+		fmt.Fprintf(w, "NOT EXPANDED (placeholder %s has no values): %s\n", e.Placeholder, e.Query)
+	}
+	if top := testcases.TopExpansions(cfg.TestCases, placeholders, maxListedExpansions); len(top) > 0 {
+		fmt.Fprintf(w, "Most expanding test case templates (max_expansions_per_case: %d):\n", cfg.MaxExpansionsPerCase)
+		for _, e := range top {
+			fmt.Fprintf(w, "    %d: %s\n", e.Count, e.Query)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tempDir returns a new temporary directory and a function removing it.
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "promql-compliance-tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// writeConfig writes a configuration file to dir with the given settings and test cases after the
+// minimal settings of a valid configuration, and returns its name.
+func writeConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+	file := filepath.Join(dir, "config.yml")
+	content = `
+reference_target_config:
+  query_url: http://localhost:9090
+test_target_config:
+  query_url: http://localhost:4000
+` + content
+	if err := ioutil.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+const expandingTestCases = `
+test_cases:
+- query: quantile_over_time({{.quantile}}, demo_memory_usage_bytes[{{.range}}])
+  variant_args: [quantile, range]
+- query: '{{.simpleAggrOp}}(demo_memory_usage_bytes)'
+  variant_args: [simpleAggrOp]
+- query: demo_memory_usage_bytes
+`
+
+func TestLoadConfigChecksExpansions(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	_, _, _, err := loadConfig(writeConfig(t, dir, "max_expansions_per_case: 50\n"+expandingTestCases), false)
+	if err == nil || !strings.Contains(err.Error(), "expands into 54 queries, more than max_expansions_per_case 50") {
+		t.Fatalf("expected the template with 54 expansions to fail loading, got %v", err)
+	}
+
+	overridden := "max_expansions_per_case: 50\nplaceholder_overrides:\n  range:\n    include_only: [1m, 5m]\n" + expandingTestCases
+	cfg, placeholders, coverage, err := loadConfig(writeConfig(t, dir, overridden), false)
+	if err != nil {
+		t.Fatalf("expected the overrides to bring the expansions below the maximum, got %v", err)
+	}
+	if len(coverage) != 1 || coverage[0].Placeholder != "range" {
+		t.Errorf("expected the coverage of the range placeholder, got %+v", coverage)
+	}
+
+	var buf bytes.Buffer
+	writeValidation(&buf, "config.yml", cfg, placeholders)
+	want := `Configuration file config.yml is valid, with 3 test case templates.
+Most expanding test case templates (max_expansions_per_case: 50):
+    18: quantile_over_time({{.quantile}}, demo_memory_usage_bytes[{{.range}}])
+    7: {{.simpleAggrOp}}(demo_memory_usage_bytes)
+    1: demo_memory_usage_bytes
+`
+	if buf.String() != want {
+		t.Fatalf("expected the validation output\n%s\ngot\n%s", want, buf.String())
+	}
+}
+
+func TestLoadConfigEmptyPlaceholderOverride(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	overrides := "placeholder_overrides:\n  range:\n    include_only: [1m]\n    exclude: [1m]\n"
+	_, _, _, err := loadConfig(writeConfig(t, dir, overrides+expandingTestCases), false)
+	if err == nil || !strings.Contains(err.Error(), `no values of "range" are left`) {
+		t.Fatalf("expected the override leaving range without values to fail loading, got %v", err)
+	}
+
+	cfg, placeholders, coverage, err := loadConfig(writeConfig(t, dir, "on_empty_expansion: skip_with_warning\n"+overrides+expandingTestCases), false)
+	if err != nil {
+		t.Fatalf("expected skip_with_warning to allow the override, got %v", err)
+	}
+	if len(coverage) != 1 || len(coverage[0].Values) != 0 {
+		t.Errorf("expected the coverage to show that range has no values, got %+v", coverage)
+	}
+	var buf bytes.Buffer
+	writeValidation(&buf, "config.yml", cfg, placeholders)
+	want := `Configuration file config.yml is valid, with 3 test case templates.
+NOT EXPANDED (placeholder range has no values): quantile_over_time({{.quantile}}, demo_memory_usage_bytes[{{.range}}])
+Most expanding test case templates (max_expansions_per_case: 500):
+    7: {{.simpleAggrOp}}(demo_memory_usage_bytes)
+    1: demo_memory_usage_bytes
+`
+	if buf.String() != want {
+		t.Fatalf("expected the validation output\n%s\ngot\n%s", want, buf.String())
+	}
+}
+
+func TestLoadConfigReportsInvalidConfig(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	_, _, _, err := loadConfig(writeConfig(t, dir, "max_expansions_per_case: -1\ntest_cases:\n- query: ''\n"), false)
+	if err == nil || !strings.Contains(err.Error(), "found 2 problems") {
+		t.Fatalf("expected both problems of the configuration to be reported, got %v", err)
+	}
+}
+
+func TestLoadConfigLenient(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	file := writeConfig(t, dir, `test_cases:
+- query: demo_memory_usage_bytes
+- query: up
+  unknown_field: true
+- query: sum(demo_memory_usage_bytes)
+  type: matrix
+`)
+	if _, _, _, err := loadConfig(file, false); err == nil {
+		t.Fatal("expected strict loading to fail at the invalid entries")
+	}
+	cfg, placeholders, _, err := loadConfig(file, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writeValidation(&buf, "config.yml", cfg, placeholders)
+	if want := "Configuration file config.yml is valid, with 1 test case templates and 2 invalid test cases skipped.\n"; !strings.HasPrefix(buf.String(), want) {
+		t.Errorf("expected the validation output to start with %q, got %q", want, buf.String())
+	}
+
+	// The invalid entries are counted separately from the test cases that ran.
+	stats := newRunStats(0)
+	stats.invalid = cfg.InvalidTestCases
+	summaryFile := filepath.Join(dir, "summary.json")
+	if err := writeSummaryFile(summaryFile, stats, nil, nil, 0, nil, nil, nil, nil, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(summaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s struct {
+		Total            int `json:"total"`
+		Invalid          int `json:"invalid"`
+		InvalidTestCases []struct {
+			File   string `json:"file"`
+			Line   int    `json:"line"`
+			Index  int    `json:"index"`
+			Reason string `json:"reason"`
+		} `json:"invalidTestCases"`
+	}
+	if err := json.Unmarshal(content, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Total != 0 || s.Invalid != 2 || len(s.InvalidTestCases) != 2 {
+		t.Fatalf("expected 2 invalid test cases outside of the total, got %s", content)
+	}
+	if got := s.InvalidTestCases[0]; got.File != file || got.Line != 8 || got.Index != 2 || !strings.Contains(got.Reason, "unknown_field") {
+		t.Errorf("expected the unknown field at %s:8, got %+v", file, got)
+	}
+}
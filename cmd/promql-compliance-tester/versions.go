@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/promlabs/promql-compliance-tester/output"
+)
+
+// writeVersionMatrix writes the version matrix of the comma-separated JSON reports, ordered from
+// the oldest to the newest version, in the given format to filename, or stdout if it is empty.
+func writeVersionMatrix(reports, format, filename string) error {
+	var vrs []*output.VersionReport
+	for _, f := range strings.Split(reports, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		vr, err := output.ReadVersionReport(f)
+		if err != nil {
+			return err
+		}
+		vrs = append(vrs, vr)
+	}
+	if len(vrs) < 2 {
+		return errors.New("-version-matrix needs at least two reports")
+	}
+	m := output.NewVersionMatrix(vrs)
+
+	w, err := createOutput(filename)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "text", "markdown":
+		output.VersionMatrixMarkdown(w, m)
+	case "html":
+		err = output.VersionMatrixHTML(w, m)
+	case "csv":
+		err = output.VersionMatrixCSV(w, m)
+	default:
+		err = errors.Errorf("invalid output format %q for -version-matrix, must be markdown, html, or csv", format)
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
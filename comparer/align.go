@@ -0,0 +1,184 @@
+package comparer
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// alignSamples pairs up the samples of reference and test series with identical label sets
+// according to the given strategy. It returns the label sets of the series whose samples
+// were changed by the alignment.
+func alignSamples(strategy config.SampleAlignment, ref, test model.Matrix, step time.Duration) []string {
+	if strategy == "" || strategy == config.SampleAlignmentStrict {
+		return nil
+	}
+
+	testByFP := make(map[model.Fingerprint]*model.SampleStream, len(test))
+	for _, ss := range test {
+		testByFP[ss.Metric.Fingerprint()] = ss
+	}
+
+	var aligned []string
+	for _, refSS := range ref {
+		testSS, ok := testByFP[refSS.Metric.Fingerprint()]
+		if !ok {
+			continue
+		}
+		changed := false
+		switch strategy {
+		case config.SampleAlignmentNearest:
+			testSS.Values, changed = nearestSamples(refSS.Values, testSS.Values, step/2)
+		case config.SampleAlignmentInterpolate:
+			refSS.Values, changed = interpolateSamples(refSS.Values, testSS.Values, step/2)
+		}
+		if changed {
+			aligned = append(aligned, refSS.Metric.String())
+		}
+	}
+	return aligned
+}
+
+// snapSamples moves the samples of all series onto the nearest step of the range that starts at
+// start. It returns the label sets of the series whose samples were moved, prefixed by side, and a
+// description of each sample that landed on the same step as an earlier sample of its series. A
+// series with collisions keeps its original samples, so that none of them is silently dropped.
+func snapSamples(m model.Matrix, side string, start model.Time, step time.Duration) (snapped, collisions []string) {
+	stepMS := int64(step / time.Millisecond)
+	if stepMS <= 0 {
+		return nil, nil
+	}
+	for _, ss := range m {
+		values := make([]model.SamplePair, len(ss.Values))
+		byStep := make(map[model.Time]model.Time, len(ss.Values))
+		changed, collided := false, false
+		for i, s := range ss.Values {
+			offset := int64(s.Timestamp - start)
+			steps := offset / stepMS
+			if rem := offset % stepMS; 2*rem >= stepMS {
+				steps++
+			} else if -2*rem > stepMS {
+				steps--
+			}
+			ts := start + model.Time(steps*stepMS)
+			if orig, ok := byStep[ts]; ok {
+				collisions = append(collisions, fmt.Sprintf("%s %s: samples at %s and %s both snap to %s", side, ss.Metric, orig.Time().UTC().Format(time.RFC3339Nano), s.Timestamp.Time().UTC().Format(time.RFC3339Nano), ts.Time().UTC().Format(time.RFC3339Nano)))
+				collided = true
+				continue
+			}
+			byStep[ts] = s.Timestamp
+			values[i] = model.SamplePair{Timestamp: ts, Value: s.Value}
+			if ts != s.Timestamp {
+				changed = true
+			}
+		}
+		if changed && !collided {
+			ss.Values = values
+			snapped = append(snapped, side+" "+ss.Metric.String())
+		}
+	}
+	return snapped, collisions
+}
+
+// snapCollisionDiff describes the collisions found by snapSamples.
+func snapCollisionDiff(collisions []string) string {
+	return fmt.Sprintf("snapping sample timestamps to the query steps made samples collide, so they cannot be compared (%d collisions)", len(collisions))
+}
+
+// nearestSamples moves each test sample that lies within maxDist of a reference sample
+// onto that reference sample's timestamp. Unmatched test samples are kept as they are.
+func nearestSamples(ref, test []model.SamplePair, maxDist time.Duration) ([]model.SamplePair, bool) {
+	res := make([]model.SamplePair, len(test))
+	copy(res, test)
+	changed := false
+	j := 0
+	for _, r := range ref {
+		// Skip test samples that are too early to match this or any later reference sample.
+		for j < len(res) && r.Timestamp.Sub(res[j].Timestamp) > maxDist {
+			j++
+		}
+		best := -1
+		for k := j; k < len(res) && res[k].Timestamp.Sub(r.Timestamp) <= maxDist; k++ {
+			if best == -1 || absDuration(res[k].Timestamp.Sub(r.Timestamp)) < absDuration(res[best].Timestamp.Sub(r.Timestamp)) {
+				best = k
+			}
+		}
+		if best == -1 {
+			continue
+		}
+		if res[best].Timestamp != r.Timestamp {
+			res[best].Timestamp = r.Timestamp
+			changed = true
+		}
+		j = best + 1
+	}
+	if !changed {
+		return test, false
+	}
+	return res, true
+}
+
+// interpolateSamples moves each reference sample that lies within maxDist of a test sample
+// onto that test sample's timestamp, linearly interpolating its value between the bracketing
+// reference samples. Reference samples without a nearby test sample are kept as they are.
+func interpolateSamples(ref, test []model.SamplePair, maxDist time.Duration) ([]model.SamplePair, bool) {
+	res := make([]model.SamplePair, len(ref))
+	copy(res, ref)
+	changed := false
+	for i, r := range ref {
+		t, ok := nearestSample(test, r.Timestamp, maxDist)
+		if !ok || t.Timestamp == r.Timestamp {
+			continue
+		}
+		lo, hi := r, r
+		if t.Timestamp < r.Timestamp && i > 0 {
+			lo = ref[i-1]
+		}
+		if t.Timestamp > r.Timestamp && i+1 < len(ref) {
+			hi = ref[i+1]
+		}
+		if lo.Timestamp == hi.Timestamp {
+			// No bracketing sample on the test sample's side, so there is nothing to interpolate with.
+			continue
+		}
+		frac := float64(t.Timestamp-lo.Timestamp) / float64(hi.Timestamp-lo.Timestamp)
+		res[i] = model.SamplePair{
+			Timestamp: t.Timestamp,
+			Value:     lo.Value + model.SampleValue(frac)*(hi.Value-lo.Value),
+		}
+		changed = true
+	}
+	if !changed {
+		return ref, false
+	}
+	return res, true
+}
+
+// nearestSample returns the sample closest to ts, if there is one within maxDist.
+func nearestSample(samples []model.SamplePair, ts model.Time, maxDist time.Duration) (model.SamplePair, bool) {
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].Timestamp >= ts })
+	var (
+		best  model.SamplePair
+		found bool
+	)
+	for _, k := range []int{i - 1, i} {
+		if k < 0 || k >= len(samples) {
+			continue
+		}
+		d := absDuration(samples[k].Timestamp.Sub(ts))
+		if d <= maxDist && (!found || d < absDuration(best.Timestamp.Sub(ts))) {
+			best, found = samples[k], true
+		}
+	}
+	return best, found
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,113 @@
+package comparer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// demoMatrix returns a range query result with one series with samples at the given timestamps
+// in milliseconds, whose values are their indexes.
+func demoMatrix(timestamps ...model.Time) model.Matrix {
+	ss := &model.SampleStream{Metric: model.Metric{"job": "demo"}}
+	for i, ts := range timestamps {
+		ss.Values = append(ss.Values, model.SamplePair{Timestamp: ts, Value: model.SampleValue(i)})
+	}
+	return model.Matrix{ss}
+}
+
+func TestSnapSamples(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		start          model.Time
+		timestamps     []model.Time
+		want           []model.Time
+		wantSnapped    bool
+		wantCollisions []string
+	}{
+		{
+			name:       "on the steps",
+			timestamps: []model.Time{0, 10000, 20000},
+			want:       []model.Time{0, 10000, 20000},
+		},
+		{
+			name:        "offset from the steps",
+			timestamps:  []model.Time{300, 9600, 24999, 25000},
+			want:        []model.Time{0, 10000, 20000, 30000},
+			wantSnapped: true,
+		},
+		{
+			name:        "before the start",
+			start:       10000,
+			timestamps:  []model.Time{4000, 6000},
+			want:        []model.Time{0, 10000},
+			wantSnapped: true,
+		},
+		{
+			name:           "collision",
+			timestamps:     []model.Time{0, 9000, 11000},
+			want:           []model.Time{0, 9000, 11000},
+			wantCollisions: []string{`test {job="demo"}: samples at 1970-01-01T00:00:09Z and 1970-01-01T00:00:11Z both snap to 1970-01-01T00:00:10Z`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := demoMatrix(tc.timestamps...)
+			snapped, collisions := snapSamples(m, "test", tc.start, 10*time.Second)
+			var got []model.Time
+			for _, s := range m[0].Values {
+				got = append(got, s.Timestamp)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected the timestamps %v, got %v", tc.want, got)
+			}
+			if (len(snapped) == 1) != tc.wantSnapped {
+				t.Errorf("expected snapped %v, got the snapped series %q", tc.wantSnapped, snapped)
+			}
+			if !reflect.DeepEqual(collisions, tc.wantCollisions) {
+				t.Errorf("expected the collisions %q, got %q", tc.wantCollisions, collisions)
+			}
+		})
+	}
+}
+
+func TestCompareSnapAlignment(t *testing.T) {
+	tc := &TestCase{Query: "demo", Type: config.QueryTypeRange, Start: time.Unix(0, 0), End: time.Unix(20, 0), Resolution: 10 * time.Second}
+	snap := []*config.QueryTweak{{SampleAlignment: config.SampleAlignmentSnap}}
+	ref := &fakeTarget{value: demoMatrix(0, 10000, 20000)}
+
+	// Samples a few hundred milliseconds off the steps fail without the alignment.
+	offset := &fakeTarget{value: demoMatrix(300, 9600, 20250)}
+	res, err := New(ref, offset, nil, Options{}).Compare(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Failed() {
+		t.Error("expected the offset samples to fail without the snap alignment")
+	}
+
+	res, err = New(ref, offset, snap, Options{}).Compare(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Success() {
+		t.Errorf("expected the offset to align away, got diff %q", res.Diff)
+	}
+	if want := []string{`test {job="demo"}`}; !reflect.DeepEqual(res.AlignedSeries, want) {
+		t.Errorf("expected the aligned series %q, got %q", want, res.AlignedSeries)
+	}
+
+	colliding := &fakeTarget{value: demoMatrix(0, 9000, 11000)}
+	res, err = New(ref, colliding, snap, Options{}).Compare(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Failed() || res.Diff != snapCollisionDiff(res.SnapCollisions) {
+		t.Errorf("expected the collision to fail the test case, got diff %q", res.Diff)
+	}
+	if len(res.SnapCollisions) != 1 {
+		t.Errorf("expected one collision, got %q", res.SnapCollisions)
+	}
+}
@@ -0,0 +1,101 @@
+package comparer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// errCircuitOpen is returned for the queries that an open circuit breaker rejects.
+var errCircuitOpen = errors.New("circuit breaker open after consecutive transient errors")
+
+// circuitBreakerAPI wraps a PromAPI and fails queries right away while the target keeps failing
+// with transient errors.
+type circuitBreakerAPI struct {
+	api      PromAPI
+	failures int
+	cooldown time.Duration
+	target   string
+
+	mtx sync.Mutex
+	// consecutive counts the queries that failed with transient errors since the last one that did not.
+	consecutive int
+	openUntil   time.Time
+}
+
+// NewCircuitBreakerAPI returns a PromAPI that opens a circuit breaker once cfg.BreakerFailures
+// consecutive queries against the given API failed with transient errors, after their retries if
+// api retries them. While the breaker is open, queries fail without being sent. After the cooldown,
+// queries are sent again, and the first one that fails with a transient error opens the breaker
+// again, while one that does not closes it.
+func NewCircuitBreakerAPI(api PromAPI, cfg config.RetryConfig, target string) PromAPI {
+	if cfg.BreakerFailures <= 0 {
+		return api
+	}
+	return &circuitBreakerAPI{
+		api:      api,
+		failures: cfg.BreakerFailures,
+		cooldown: time.Duration(cfg.BreakerCooldownSeconds * float64(time.Second)),
+		target:   target,
+	}
+}
+
+// Query implements PromAPI.
+func (b *circuitBreakerAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error) {
+	var (
+		val      model.Value
+		warnings v1.Warnings
+	)
+	err := b.do(ctx, func() error {
+		var err error
+		val, warnings, err = b.api.Query(ctx, query, ts)
+		return err
+	})
+	return val, warnings, err
+}
+
+// QueryRange implements PromAPI.
+func (b *circuitBreakerAPI) QueryRange(ctx context.Context, query string, rng v1.Range) (model.Value, v1.Warnings, error) {
+	var (
+		val      model.Value
+		warnings v1.Warnings
+	)
+	err := b.do(ctx, func() error {
+		var err error
+		val, warnings, err = b.api.QueryRange(ctx, query, rng)
+		return err
+	})
+	return val, warnings, err
+}
+
+func (b *circuitBreakerAPI) do(ctx context.Context, f func() error) error {
+	b.mtx.Lock()
+	if until := b.openUntil; time.Now().Before(until) {
+		b.mtx.Unlock()
+		return errors.Wrapf(errCircuitOpen, "not querying %s until %s", b.target, until.Format(time.RFC3339))
+	}
+	b.mtx.Unlock()
+
+	err := f()
+	// Queries that were canceled say nothing about the target.
+	if ctx.Err() != nil {
+		return err
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if err == nil || !isTransient(err) {
+		b.consecutive = 0
+		return err
+	}
+	if b.consecutive++; b.consecutive >= b.failures {
+		b.openUntil = time.Now().Add(b.cooldown)
+		log.Warnf("Opening the circuit breaker of %s for %v after %d consecutive queries failed with transient errors: %v", b.target, b.cooldown, b.consecutive, err)
+	}
+	return err
+}
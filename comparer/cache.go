@@ -0,0 +1,121 @@
+package comparer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/log"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// cachingTarget is a QueryTarget that stores the successful responses of another target in a
+// directory, one JSON file in the fixture format per query, and answers repeated queries from it.
+type cachingTarget struct {
+	next    QueryTarget
+	dir     string
+	salt    string
+	refresh bool
+}
+
+// NewCachingTarget returns a QueryTarget that answers queries from the response cache in dir and
+// queries next on a cache miss, storing its successful responses. Cache entries are keyed by the
+// query, its type, its time parameters, and the salt, which should change whenever the responses
+// for the same query may change, e.g. with the query tweaks. If refresh is set, cached responses are
+// not used, but replaced.
+func NewCachingTarget(next QueryTarget, dir, salt string, refresh bool) (QueryTarget, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &cachingTarget{next: next, dir: dir, salt: salt, refresh: refresh}, nil
+}
+
+// InstantQuery implements QueryTarget.
+func (t *cachingTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*QueryResult, error) {
+	file := t.file(config.QueryTypeInstant, query, ts.UnixNano())
+	if res := t.load(file, query, config.QueryTypeInstant); res != nil {
+		return res, nil
+	}
+	res, err := t.next.InstantQuery(ctx, query, ts)
+	if err == nil {
+		t.store(file, query, config.QueryTypeInstant, res)
+	}
+	return res, err
+}
+
+// RangeQuery implements QueryTarget.
+func (t *cachingTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*QueryResult, error) {
+	file := t.file(config.QueryTypeRange, query, r.Start.UnixNano(), r.End.UnixNano(), int64(r.Step))
+	if res := t.load(file, query, config.QueryTypeRange); res != nil {
+		return res, nil
+	}
+	res, err := t.next.RangeQuery(ctx, query, r)
+	if err == nil {
+		t.store(file, query, config.QueryTypeRange, res)
+	}
+	return res, err
+}
+
+// file returns the cache file of a query with the given type and time parameters.
+func (t *cachingTarget) file(typ config.QueryType, query string, params ...int64) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", t.salt, typ, query)
+	for _, p := range params {
+		fmt.Fprintf(h, "\x00%d", p)
+	}
+	return filepath.Join(t.dir, hex.EncodeToString(h.Sum(nil))+".json")
+}
+
+// load returns the cached response in file, or nil if there is none. Unreadable entries are
+// treated as cache misses.
+func (t *cachingTarget) load(file, query string, typ config.QueryType) *QueryResult {
+	if t.refresh {
+		return nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Error reading cached response for %q: %v", query, err)
+		}
+		return nil
+	}
+	var f Fixture
+	if err := json.Unmarshal(content, &f); err != nil || f.Query != query || f.Type != typ {
+		log.Warnf("Ignoring invalid cached response for %q in %s", query, file)
+		return nil
+	}
+	val, err := decodeValue(f.Data.ResultType, f.Data.Result)
+	if err != nil {
+		log.Warnf("Ignoring invalid cached response for %q in %s: %v", query, file, err)
+		return nil
+	}
+	return &QueryResult{Value: val, Warnings: f.Warnings, Metadata: map[string]string{"source": "cache", "file": file}}
+}
+
+// store writes a response to file. Failures are logged, since they only make later runs query the target again.
+func (t *cachingTarget) store(file, query string, typ config.QueryType, res *QueryResult) {
+	f := Fixture{Query: query, Type: typ, Warnings: res.Warnings}
+	raw, err := json.Marshal(res.Value)
+	if err == nil {
+		f.Data.ResultType = res.Value.Type()
+		f.Data.Result = raw
+		var content []byte
+		if content, err = json.Marshal(f); err == nil {
+			// Write to a temporary file first, so that concurrent or interrupted runs never read partial entries.
+			tmp := file + ".tmp"
+			if err = ioutil.WriteFile(tmp, content, 0644); err == nil {
+				err = os.Rename(tmp, file)
+			}
+		}
+	}
+	if err != nil {
+		log.Warnf("Error caching response for %q: %v", query, err)
+	}
+}
@@ -0,0 +1,125 @@
+package comparer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// errChaosDropped is returned for the requests that a chaos RoundTripper drops.
+var errChaosDropped = errors.New("chaos: request dropped")
+
+// Bodies of the responses that a chaos RoundTripper injects.
+const (
+	chaosUnavailableBody = `{"status":"error","errorType":"unavailable","error":"chaos: injected 503 Service Unavailable"}`
+	chaosRateLimitedBody = `{"status":"error","errorType":"too_many_requests","error":"chaos: injected 429 Too Many Requests"}`
+	chaosMalformedBody   = `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"val`
+)
+
+// chaosRoundTripper injects faults into the requests sent through it.
+type chaosRoundTripper struct {
+	next   http.RoundTripper
+	cfg    config.ChaosConfig
+	faults []string
+
+	// sent counts the requests for DropEvery.
+	sent int64
+
+	mtx sync.Mutex
+	// attempts counts the requests by key, so that retries of a request get faults of their own.
+	attempts map[string]int
+}
+
+// NewChaosRoundTripper returns a RoundTripper that injects the faults of cfg into the requests sent
+// through next. Whether a request gets a fault depends on the seed, the request itself, and the
+// number of times it was sent before, so that the schedule does not depend on the order of
+// concurrent requests. Only the requests that DropEvery drops depend on that order.
+func NewChaosRoundTripper(next http.RoundTripper, cfg config.ChaosConfig) http.RoundTripper {
+	faults := cfg.Faults
+	if len(faults) == 0 {
+		faults = []string{config.ChaosFaultUnavailable, config.ChaosFaultRateLimited, config.ChaosFaultMalformed}
+	}
+	return &chaosRoundTripper{next: next, cfg: cfg, faults: faults, attempts: map[string]int{}}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *chaosRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if d := time.Duration(rt.cfg.DelaySeconds * float64(time.Second)); d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	if n := rt.cfg.DropEvery; n > 0 && atomic.AddInt64(&rt.sent, 1)%int64(n) == 0 {
+		return nil, errChaosDropped
+	}
+	if rt.cfg.FaultRate <= 0 {
+		return rt.next.RoundTrip(req)
+	}
+
+	key := req.Method + " " + req.URL.String()
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		// Per RoundTrip's documentation, RoundTrip should not modify the request.
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		key += " " + string(body)
+	}
+	rt.mtx.Lock()
+	attempt := rt.attempts[key]
+	rt.attempts[key]++
+	rt.mtx.Unlock()
+
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(rt.cfg.Seed))
+	h.Write(buf[:])
+	h.Write([]byte(key))
+	binary.LittleEndian.PutUint64(buf[:], uint64(attempt))
+	h.Write(buf[:])
+	sum := h.Sum64()
+	if float64(sum>>11)/(1<<53) >= rt.cfg.FaultRate {
+		return rt.next.RoundTrip(req)
+	}
+
+	switch rt.faults[sum%uint64(len(rt.faults))] {
+	case config.ChaosFaultUnavailable:
+		return chaosResponse(req, http.StatusServiceUnavailable, chaosUnavailableBody), nil
+	case config.ChaosFaultRateLimited:
+		resp := chaosResponse(req, http.StatusTooManyRequests, chaosRateLimitedBody)
+		resp.Header.Set("Retry-After", "1")
+		return resp, nil
+	default:
+		return chaosResponse(req, http.StatusOK, chaosMalformedBody), nil
+	}
+}
+
+func chaosResponse(req *http.Request, code int, body string) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
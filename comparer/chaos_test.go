@@ -0,0 +1,254 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// countingRoundTripper counts the requests sent through it.
+type countingRoundTripper struct {
+	next     http.RoundTripper
+	requests int64
+}
+
+func (rt *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&rt.requests, 1)
+	return rt.next.RoundTrip(req)
+}
+
+// chaosTarget returns a test target whose requests to a healthy server get the faults of cfg,
+// wrapped like the targets of a run, and the counter of the requests that the target sent.
+func chaosTarget(t *testing.T, srv *httptest.Server, cfg config.ChaosConfig, retries config.RetryConfig) (QueryTarget, *countingRoundTripper) {
+	counter := &countingRoundTripper{next: NewChaosRoundTripper(http.DefaultTransport, cfg)}
+	client, err := api.NewClient(api.Config{Address: srv.URL, RoundTripper: counter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retrying := NewRetryingAPI(v1.NewAPI(client), retries, nil, "test")
+	return NewAPITarget(NewCircuitBreakerAPI(retrying, retries, "test")), counter
+}
+
+func healthyServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"demo"},"value":[1,"1"]}]}}`)
+	}))
+}
+
+func TestChaosFaults(t *testing.T) {
+	srv := healthyServer()
+	defer srv.Close()
+
+	retries := config.RetryConfig{MaxRetries: 2, BaseDelaySeconds: 0.001}
+	for _, tc := range []struct {
+		name         string
+		chaos        config.ChaosConfig
+		queries      int
+		wantRequests int64
+		wantFailed   bool
+		wantFailure  string
+		wantRetries  int
+	}{
+		{
+			name:    "no faults",
+			chaos:   config.ChaosConfig{Seed: 1},
+			queries: 1, wantRequests: 1,
+		},
+		{
+			// 503s are server errors, which are retried until the retries are exhausted.
+			name:    "503",
+			chaos:   config.ChaosConfig{Seed: 1, FaultRate: 1, Faults: []string{config.ChaosFaultUnavailable}},
+			queries: 1, wantRequests: 3, wantFailed: true, wantFailure: "server_error: server error: 503", wantRetries: 2,
+		},
+		{
+			// 429s are client errors, which are not retried.
+			name:    "429",
+			chaos:   config.ChaosConfig{Seed: 1, FaultRate: 1, Faults: []string{config.ChaosFaultRateLimited}},
+			queries: 1, wantRequests: 1, wantFailed: true, wantFailure: "client_error: client error: 429",
+		},
+		{
+			name:    "malformed JSON",
+			chaos:   config.ChaosConfig{Seed: 1, FaultRate: 1, Faults: []string{config.ChaosFaultMalformed}},
+			queries: 1, wantRequests: 1, wantFailed: true, wantFailure: "bad_response",
+		},
+		{
+			// The second request is dropped and retried as the third.
+			name:    "drop every 2nd request",
+			chaos:   config.ChaosConfig{Seed: 1, DropEvery: 2},
+			queries: 2, wantRequests: 3, wantRetries: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			test, counter := chaosTarget(t, srv, tc.chaos, retries)
+			c := New(&fakeTarget{value: fakeVector(1)}, test, nil, Options{Chaos: true})
+			var res *Result
+			retried := 0
+			for i := 0; i < tc.queries; i++ {
+				var err error
+				if res, err = c.Compare(instantTestCase("demo")); err != nil {
+					t.Fatal(err)
+				}
+				retried += res.TestRetries
+				if !res.Chaos {
+					t.Error("expected the result to be marked as chaos")
+				}
+			}
+			if got := atomic.LoadInt64(&counter.requests); got != tc.wantRequests {
+				t.Errorf("expected %d requests, got %d", tc.wantRequests, got)
+			}
+			// Failing test queries fail the test case, classified by the kind of error.
+			if res.Failed() != tc.wantFailed || !strings.HasPrefix(res.UnexpectedFailure, tc.wantFailure) {
+				t.Errorf("expected failed %v with a failure starting with %q, got %q", tc.wantFailed, tc.wantFailure, res.UnexpectedFailure)
+			}
+			if retried != tc.wantRetries {
+				t.Errorf("expected %d retries, got %d", tc.wantRetries, retried)
+			}
+		})
+	}
+}
+
+func TestChaosDelay(t *testing.T) {
+	srv := healthyServer()
+	defer srv.Close()
+
+	test, _ := chaosTarget(t, srv, config.ChaosConfig{DelaySeconds: 0.05}, config.RetryConfig{})
+	start := time.Now()
+	res, err := New(&fakeTarget{value: fakeVector(1)}, test, nil, Options{}).Compare(instantTestCase("demo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Success() {
+		t.Errorf("expected a delayed query to pass, got %+v", res)
+	}
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Errorf("expected the query to be delayed by 50ms, it took %v", took)
+	}
+}
+
+func TestChaosSchedule(t *testing.T) {
+	// faulted returns the queries that get a fault with the seed, sent in the given order.
+	faulted := func(seed int64, order []int) []string {
+		rt := NewChaosRoundTripper(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return chaosResponse(req, http.StatusOK, "{}"), nil
+		}), config.ChaosConfig{Seed: seed, FaultRate: 0.5, Faults: []string{config.ChaosFaultUnavailable}})
+		got := make([]string, 40)
+		for _, i := range order {
+			req := httptest.NewRequest("GET", fmt.Sprintf("http://localhost/api/v1/query?query=demo_%d", i), nil)
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				got[i] = req.URL.Query().Get("query")
+			}
+		}
+		return got
+	}
+	var forward, backward []int
+	for i := 0; i < 40; i++ {
+		forward = append(forward, i)
+		backward = append([]int{i}, backward...)
+	}
+
+	first := faulted(1, forward)
+	if again := faulted(1, backward); !reflect.DeepEqual(first, again) {
+		t.Errorf("expected the same faults for the same seed in any order, got %q and %q", first, again)
+	}
+	n := 0
+	for _, q := range first {
+		if q != "" {
+			n++
+		}
+	}
+	if n == 0 || n == 40 {
+		t.Errorf("expected some but not all of 40 requests to get faults, got %d", n)
+	}
+	if other := faulted(2, forward); reflect.DeepEqual(first, other) {
+		t.Errorf("expected another seed to give other faults, got %q for both", first)
+	}
+}
+
+// roundTripperFunc adapts a function to an http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestCircuitBreaker(t *testing.T) {
+	srv := healthyServer()
+	defer srv.Close()
+
+	retries := config.RetryConfig{MaxRetries: 1, BaseDelaySeconds: 0.001, BreakerFailures: 2, BreakerCooldownSeconds: 0.1}
+	test, counter := chaosTarget(t, srv, config.ChaosConfig{FaultRate: 1, Faults: []string{config.ChaosFaultUnavailable}}, retries)
+	c := New(&fakeTarget{value: fakeVector(1)}, test, nil, Options{})
+	compare := func() *Result {
+		res, err := c.Compare(instantTestCase("demo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Two queries fail after their retries, which opens the breaker.
+	for i := 0; i < 2; i++ {
+		if res := compare(); !strings.HasPrefix(res.UnexpectedFailure, "server_error: server error: 503") {
+			t.Fatalf("query %d: expected the injected 503 to fail the query, got %q", i+1, res.UnexpectedFailure)
+		}
+	}
+	if got := atomic.LoadInt64(&counter.requests); got != 4 {
+		t.Fatalf("expected 4 requests, got %d", got)
+	}
+	res := compare()
+	if !res.Failed() || !strings.Contains(res.UnexpectedFailure, errCircuitOpen.Error()) {
+		t.Errorf("expected the open breaker to fail the query, got %q", res.UnexpectedFailure)
+	}
+	if got := atomic.LoadInt64(&counter.requests); got != 4 {
+		t.Errorf("expected the open breaker not to send requests, got %d requests", got)
+	}
+
+	// After the cooldown, the next query is sent again and reopens the breaker.
+	time.Sleep(150 * time.Millisecond)
+	compare()
+	if got := atomic.LoadInt64(&counter.requests); got != 6 {
+		t.Errorf("expected the query after the cooldown to be sent with its retry, got %d requests", got)
+	}
+	if res := compare(); !strings.Contains(res.UnexpectedFailure, errCircuitOpen.Error()) {
+		t.Errorf("expected the breaker to open again, got %q", res.UnexpectedFailure)
+	}
+}
+
+func TestCircuitBreakerResets(t *testing.T) {
+	transient := &v1.Error{Type: v1.ErrServer, Msg: "503 Service Unavailable"}
+	for _, tc := range []struct {
+		name string
+		errs []error
+		open bool
+	}{
+		{name: "consecutive transient errors", errs: []error{transient, transient, transient}, open: true},
+		{name: "interrupted by a success", errs: []error{transient, transient, nil, transient, transient}},
+		{name: "interrupted by a query error", errs: []error{transient, transient, &v1.Error{Type: v1.ErrBadData, Msg: "parse error"}, transient, transient}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := NewCircuitBreakerAPI(&flakyAPI{}, config.RetryConfig{BreakerFailures: 3, BreakerCooldownSeconds: 60}, "test").(*circuitBreakerAPI)
+			for _, err := range tc.errs {
+				err := err
+				b.do(context.Background(), func() error { return err })
+			}
+			err := b.do(context.Background(), func() error { return nil })
+			if open := errors.Cause(err) == errCircuitOpen; open != tc.open {
+				t.Errorf("expected the breaker to be open %v, got %v", tc.open, err)
+			}
+		})
+	}
+}
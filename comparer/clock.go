@@ -0,0 +1,87 @@
+package comparer
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// EstimateClockDrift estimates how far the target's clock is ahead of the local clock by evaluating
+// time() at the target's current time. The local time is taken as the midpoint of the request's
+// round trip, so the estimate is accurate to within half the round-trip latency.
+func EstimateClockDrift(ctx context.Context, target QueryTarget) (time.Duration, error) {
+	before := time.Now()
+	// A zero evaluation timestamp lets the target evaluate the query at its own current time.
+	res, err := target.InstantQuery(ctx, "time()", time.Time{})
+	after := time.Now()
+	if err != nil {
+		return 0, errors.Wrap(err, "querying time()")
+	}
+	scalar, ok := res.Value.(*model.Scalar)
+	if !ok {
+		return 0, errors.Errorf("unexpected result type %s for time()", res.Value.Type())
+	}
+	sec, frac := math.Modf(float64(scalar.Value))
+	targetTime := time.Unix(int64(sec), int64(frac*float64(time.Second)))
+	midpoint := before.Add(after.Sub(before) / 2)
+	return targetTime.Sub(midpoint), nil
+}
+
+// timeOffsetTarget is a QueryTarget whose clock is offset from the local clock. It shifts query
+// timestamps by the offset, and the timestamps of results back, so that results line up with those
+// of other targets.
+type timeOffsetTarget struct {
+	target QueryTarget
+	offset time.Duration
+}
+
+// NewTimeOffsetTarget returns a QueryTarget that corrects for the target's clock being offset
+// ahead of the local clock.
+func NewTimeOffsetTarget(target QueryTarget, offset time.Duration) QueryTarget {
+	return &timeOffsetTarget{target: target, offset: offset}
+}
+
+// InstantQuery implements QueryTarget.
+func (t *timeOffsetTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*QueryResult, error) {
+	setRequestTimeOffset(ctx, t.offset)
+	res, err := t.target.InstantQuery(ctx, query, ts.Add(t.offset))
+	if err != nil {
+		return nil, err
+	}
+	shiftTimestamps(res.Value, -t.offset)
+	return res, nil
+}
+
+// RangeQuery implements QueryTarget.
+func (t *timeOffsetTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*QueryResult, error) {
+	setRequestTimeOffset(ctx, t.offset)
+	r.Start = r.Start.Add(t.offset)
+	r.End = r.End.Add(t.offset)
+	res, err := t.target.RangeQuery(ctx, query, r)
+	if err != nil {
+		return nil, err
+	}
+	shiftTimestamps(res.Value, -t.offset)
+	return res, nil
+}
+
+func shiftTimestamps(v model.Value, d time.Duration) {
+	switch v := v.(type) {
+	case model.Matrix:
+		for _, ss := range v {
+			for i := range ss.Values {
+				ss.Values[i].Timestamp = ss.Values[i].Timestamp.Add(d)
+			}
+		}
+	case model.Vector:
+		for _, s := range v {
+			s.Timestamp = s.Timestamp.Add(d)
+		}
+	case *model.Scalar:
+		v.Timestamp = v.Timestamp.Add(d)
+	}
+}
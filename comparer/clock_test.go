@@ -0,0 +1,108 @@
+package comparer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// skewedClockTarget is a QueryTarget whose clock is skew ahead of the local clock. It answers
+// time() with its current time, read after half of the latency, as if the request took half of the
+// latency to reach it and the response the other half. Other queries return a vector at the query
+// timestamp.
+type skewedClockTarget struct {
+	skew, latency time.Duration
+	// queried records the timestamps of the queries.
+	queried []time.Time
+}
+
+func (t *skewedClockTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*QueryResult, error) {
+	t.queried = append(t.queried, ts)
+	time.Sleep(t.latency / 2)
+	now := time.Now().Add(t.skew)
+	time.Sleep(t.latency / 2)
+	if query == "time()" {
+		return &QueryResult{Value: &model.Scalar{Value: model.SampleValue(float64(now.UnixNano()) / 1e9), Timestamp: model.TimeFromUnixNano(now.UnixNano())}}, nil
+	}
+	return &QueryResult{Value: model.Vector{&model.Sample{Metric: model.Metric{"job": "demo"}, Value: 1, Timestamp: model.TimeFromUnixNano(ts.UnixNano())}}}, nil
+}
+
+func (t *skewedClockTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*QueryResult, error) {
+	t.queried = append(t.queried, r.Start, r.End)
+	return &QueryResult{Value: model.Matrix{&model.SampleStream{Metric: model.Metric{"job": "demo"}, Values: []model.SamplePair{
+		{Timestamp: model.TimeFromUnixNano(r.Start.UnixNano()), Value: 1},
+		{Timestamp: model.TimeFromUnixNano(r.End.UnixNano()), Value: 2},
+	}}}}, nil
+}
+
+func TestEstimateClockDrift(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		skew, latency time.Duration
+	}{
+		{name: "in sync", latency: 10 * time.Millisecond},
+		{name: "ahead", skew: 45 * time.Second, latency: 10 * time.Millisecond},
+		{name: "behind", skew: -45 * time.Second},
+		// The midpoint of the round trip excludes the latency, however long it is.
+		{name: "ahead with high latency", skew: 45 * time.Second, latency: 200 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := &skewedClockTarget{skew: tc.skew, latency: tc.latency}
+			drift, err := EstimateClockDrift(context.Background(), target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Only the time between the sleeps and the overshoot of timers are not accounted for.
+			if d := drift - tc.skew; d < -20*time.Millisecond || d > 20*time.Millisecond {
+				t.Errorf("expected a drift of %v, got %v", tc.skew, drift)
+			}
+			if len(target.queried) != 1 || !target.queried[0].IsZero() {
+				t.Errorf("expected time() to be evaluated at the target's current time, got the timestamps %v", target.queried)
+			}
+		})
+	}
+}
+
+func TestEstimateClockDriftErrors(t *testing.T) {
+	if _, err := EstimateClockDrift(context.Background(), &fakeTarget{err: errors.New("connection refused")}); err == nil || err.Error() != "querying time(): connection refused" {
+		t.Errorf("expected the query error, got %v", err)
+	}
+	if _, err := EstimateClockDrift(context.Background(), &fakeTarget{value: fakeVector(1)}); err == nil || err.Error() != "unexpected result type vector for time()" {
+		t.Errorf("expected an error for a vector result, got %v", err)
+	}
+}
+
+func TestTimeOffsetTarget(t *testing.T) {
+	skew := 45 * time.Second
+	inner := &skewedClockTarget{skew: skew}
+	target := NewTimeOffsetTarget(inner, skew)
+	ts := time.Unix(3600, 0)
+
+	res, err := target.InstantQuery(context.Background(), "demo", ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inner.queried[0].Equal(ts.Add(skew)) {
+		t.Errorf("expected the query timestamp to be shifted to %v, got %v", ts.Add(skew), inner.queried[0])
+	}
+	if got := res.Value.(model.Vector)[0].Timestamp.Time(); !got.Equal(ts) {
+		t.Errorf("expected the sample timestamp to be shifted back to %v, got %v", ts, got)
+	}
+
+	res, err = target.RangeQuery(context.Background(), "demo", v1.Range{Start: ts.Add(-time.Hour), End: ts, Step: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inner.queried[1].Equal(ts.Add(-time.Hour+skew)) || !inner.queried[2].Equal(ts.Add(skew)) {
+		t.Errorf("expected the query range to be shifted by %v, got %v", skew, inner.queried[1:])
+	}
+	values := res.Value.(model.Matrix)[0].Values
+	if !values[0].Timestamp.Time().Equal(ts.Add(-time.Hour)) || !values[1].Timestamp.Time().Equal(ts) {
+		t.Errorf("expected the sample timestamps to be shifted back, got %v", values)
+	}
+
+}
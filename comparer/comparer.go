@@ -3,12 +3,13 @@ package comparer
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
-	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/pkg/errors"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
@@ -18,6 +19,11 @@ import (
 const (
 	defaultFraction = 0.00001
 	defaultMargin   = 0.0
+
+	// defaultMaxDiffSamples is the default number of mismatched samples listed per series in a structured diff.
+	defaultMaxDiffSamples = 10
+	// defaultMaxDiffLines is the default number of lines that diffs are cut to.
+	defaultMaxDiffLines = 100
 )
 
 // PromAPI allows running instant and range queries against a Prometheus-compatible API.
@@ -30,33 +36,194 @@ type PromAPI interface {
 
 // TestCase represents a fully expanded query to be tested.
 type TestCase struct {
-	Query          string        `json:"query"`
-	SkipComparison bool          `json:"skipComparison"`
-	ShouldFail     bool          `json:"shouldFail"`
-	Start          time.Time     `json:"start"`
-	End            time.Time     `json:"end"`
-	Resolution     time.Duration `json:"resolution"`
+	Query          string           `json:"query"`
+	SkipComparison bool             `json:"skipComparison"`
+	ShouldFail     bool             `json:"shouldFail"`
+	Type           config.QueryType `json:"type"`
+	Category       string           `json:"category,omitempty"`
+	// Template is the query template of the configuration that the test case was expanded from, if
+	// it has placeholders.
+	Template   string        `json:"template,omitempty"`
+	Tags       []string      `json:"tags,omitempty"`
+	Start      time.Time     `json:"start"`
+	End        time.Time     `json:"end"`
+	Resolution time.Duration `json:"resolution"`
+	// Time is the evaluation timestamp of instant queries.
+	Time time.Time `json:"time"`
+	// ValueTolerance overrides the value tolerance of the query tweaks for this test case.
+	ValueTolerance *config.AdjustValueTolerance `json:"valueTolerance,omitempty"`
+	// LabelTweaks drop and rename result labels for this test case in addition to the query tweaks.
+	LabelTweaks []*config.LabelTweak `json:"labelTweaks,omitempty"`
+	// WithinReferenceRange checks the test target's current values against the reference's recent
+	// range of values instead of comparing the results.
+	WithinReferenceRange *config.RangeAssertion `json:"withinReferenceRange,omitempty"`
+	// SeriesAllowance overrides the default series allowance for this test case.
+	SeriesAllowance *config.SeriesAllowance `json:"seriesAllowance,omitempty"`
+	// TimeParameterSet is the name of the query time parameter set that the test case runs with.
+	TimeParameterSet string `json:"timeParameterSet,omitempty"`
+	// TimeJitter is the amount by which -time-jitter shifted the window of the test case back.
+	TimeJitter time.Duration `json:"timeJitter,omitempty"`
+	// TestQuery, if set, is the query sent to the test targets instead of Query, as rewritten by the
+	// rename query tweaks.
+	TestQuery string `json:"testQuery,omitempty"`
+	// ExpectNativeHistograms compares the native histogram samples of the results, which are read
+	// from the raw responses.
+	ExpectNativeHistograms bool `json:"expectNativeHistograms,omitempty"`
+	// SameAs, if set, is a query whose result on the test target must equal that of the test query,
+	// which is checked instead of comparing with the reference. The rename query tweaks were
+	// applied to it already.
+	SameAs string `json:"sameAs,omitempty"`
+	// NotExpanded, if set, is the placeholder without values that kept the query template of the
+	// test case from expanding. Such test cases are not compared.
+	NotExpanded string `json:"notExpanded,omitempty"`
+}
+
+// Instant returns true if the test case runs an instant query instead of a range query.
+func (tc *TestCase) Instant() bool {
+	return tc.Type == config.QueryTypeInstant
+}
+
+// Name returns the query of the test case, followed by the name of its time parameter set if it has one.
+func (tc *TestCase) Name() string {
+	if tc.TimeParameterSet != "" {
+		return fmt.Sprintf("%s (%s)", tc.Query, tc.TimeParameterSet)
+	}
+	return tc.Query
+}
+
+// Options configures optional Comparer behavior.
+type Options struct {
+	// DifferingErrorsPolicy decides the outcome when both APIs fail a query with different errors.
+	DifferingErrorsPolicy config.ErrorPolicy
+	// ErrorMatchRegexp, if set, selects the parts of the error messages that are compared when both
+	// APIs fail a query. If it has capturing groups, only their matches are compared.
+	ErrorMatchRegexp *regexp.Regexp
+	// RefQueryTimeout and TestQueryTimeout bound the duration of each query against the
+	// respective API. If zero, queries against the API are not bounded.
+	RefQueryTimeout  time.Duration
+	TestQueryTimeout time.Duration
+	// TestTargetName identifies the test target in results when several test targets are compared.
+	TestTargetName string
+	// RefResponseLimits and TestResponseLimits are the response size limits of the targets,
+	// which are enforced by their HTTP clients and recorded in the effective settings.
+	RefResponseLimits  ResponseLimits
+	TestResponseLimits ResponseLimits
+	// Tolerance is the default value tolerance, which query tweaks and test cases may override.
+	Tolerance *config.Tolerance
+	// MaxDiffSamples is the maximum number of mismatched samples listed per series in a structured diff.
+	MaxDiffSamples int
+	// MaxDiffLines is the maximum number of lines of the textual and structured diffs of a result.
+	MaxDiffLines int
+	// NaNMissingPolicy decides whether a NaN series in an instant vector equals an absent series.
+	NaNMissingPolicy config.NaNMissingPolicy
+	// OutOfOrderPolicy decides whether range query results with out-of-order samples are compared.
+	OutOfOrderPolicy config.OutOfOrderPolicy
+	// LabelConformanceSampleRate is the fraction of test cases whose raw test responses are checked
+	// for unsorted or duplicate label names if they pass. Checking requires the test target's API
+	// client to use a RoundTripper returned by NewCapturingRoundTripper.
+	LabelConformanceSampleRate float64
+	// ExactnessSampleRate is the fraction of test cases whose raw reference and test responses are
+	// compared for sample values that are not bit-identical, if they pass. Auditing requires the
+	// targets' API clients to use a capturing RoundTripper.
+	ExactnessSampleRate float64
+	// LatencyWarnRatio, if positive, adds a warning to passing results whose test query took more
+	// than this many times as long as the reference query.
+	LatencyWarnRatio float64
+	// HeadroomWarnRatio, if positive, adds a warning to passing results that used up more than this
+	// fraction of their value tolerance.
+	HeadroomWarnRatio float64
+	// SeriesAllowance is the default number of series that may only be present in one of the results
+	// of a passing test case. If nil, comparisons are strict.
+	SeriesAllowance *config.SeriesAllowance
+	// RecordingRules lists metrics that are recording-rule-backed on the reference API.
+	RecordingRules []*config.RecordingRule
+	// HistogramDiagnostics enables fetching the raw buckets of failing histogram_quantile() queries
+	// to diagnose the failure.
+	HistogramDiagnostics bool
+	// SelectorDiagnosticsLimit is the number of failing bare selector queries for which the test target
+	// is probed for the series missing in its result. Each probe takes up to two extra queries.
+	SelectorDiagnosticsLimit int
+	// CompareWarnings fails test cases whose reference and test APIs returned different sets of warnings.
+	CompareWarnings bool
+	// RequestParitySampleRate is the fraction of test cases whose query parameters, as sent to
+	// both targets, are recorded and compared. Checking requires the targets' API clients to use a
+	// capturing RoundTripper.
+	RequestParitySampleRate float64
+	// Chaos marks the results as produced with faults injected into the requests to the targets.
+	Chaos bool
+	// ResponseHeaders lists the response headers recorded with the results. Recording them requires
+	// the targets' API clients to use a capturing RoundTripper.
+	ResponseHeaders []string
+	// CacheHitPatterns maps header names to the patterns whose matches in the headers of test
+	// responses show that they were served from a cache. Their headers are recorded, too.
+	CacheHitPatterns map[string]*regexp.Regexp
+	// RuleUsage, if set, counts how often the rules of the configuration applied. It is shared by
+	// the comparers of a run.
+	RuleUsage *RuleUsage
 }
 
 // A Comparer allows comparing query results for test cases between a reference API and a test API.
 type Comparer struct {
-	refAPI         PromAPI
-	testAPI        PromAPI
+	refTarget      QueryTarget
+	testTarget     QueryTarget
 	queryTweaks    []*config.QueryTweak
 	compareOptions cmp.Options
+	// exactCompareOptions compare sample values without any tolerance.
+	exactCompareOptions cmp.Options
+	// fraction and margin are the value tolerance resulting from the query tweaks.
+	fraction, margin float64
+	opts             Options
+	// recordingRuleOptions holds the comparison options for each of opts.RecordingRules.
+	recordingRuleOptions []cmp.Options
+	// selectorProbes counts the failing bare selector queries that were diagnosed, up to
+	// opts.SelectorDiagnosticsLimit.
+	selectorProbes int32
 }
 
 // New returns a new Comparer.
-func New(refAPI, testAPI PromAPI, queryTweaks []*config.QueryTweak) *Comparer {
+func New(refTarget, testTarget QueryTarget, queryTweaks []*config.QueryTweak, opts Options) *Comparer {
+	var options cmp.Options
+	fraction, margin := addFloatCompareOptions(opts.Tolerance, queryTweaks, &options)
+	var exactOptions cmp.Options
+	addFloatOptions(0, 0, &exactOptions)
+
+	c := &Comparer{
+		refTarget:           refTarget,
+		testTarget:          testTarget,
+		queryTweaks:         queryTweaks,
+		compareOptions:      options,
+		exactCompareOptions: exactOptions,
+		fraction:            fraction,
+		margin:              margin,
+		opts:                opts,
+	}
+	for _, rr := range opts.RecordingRules {
+		c.recordingRuleOptions = append(c.recordingRuleOptions, c.toleranceOptions(rr.AdjustValueTolerance))
+	}
+	return c
+}
+
+// toleranceOptions returns the comparison options for a tolerance that overrides the query
+// tweaks' tolerance. Unset fields of the override keep the query tweaks' values.
+func (c *Comparer) toleranceOptions(t *config.AdjustValueTolerance) cmp.Options {
+	fraction, margin := c.tolerance(t)
 	var options cmp.Options
-	addFloatCompareOptions(queryTweaks, &options)
-	addDropResultLabelsOptions(queryTweaks, &options)
-	return &Comparer{
-		refAPI:         refAPI,
-		testAPI:        testAPI,
-		queryTweaks:    queryTweaks,
-		compareOptions: options,
+	addFloatOptions(fraction, margin, &options)
+	return options
+}
+
+// tolerance returns the value tolerance after applying the given override to the query tweaks' tolerance.
+func (c *Comparer) tolerance(t *config.AdjustValueTolerance) (fraction, margin float64) {
+	fraction, margin = c.fraction, c.margin
+	if t != nil {
+		if t.Fraction != nil {
+			fraction = *t.Fraction
+		}
+		if t.Margin != nil {
+			margin = *t.Margin
+		}
 	}
+	return fraction, margin
 }
 
 // Result tracks a single test case's query comparison result.
@@ -66,27 +233,354 @@ type Result struct {
 	UnexpectedFailure string    `json:"unexpectedFailure"`
 	UnexpectedSuccess bool      `json:"unexpectedSuccess"`
 	Unsupported       bool      `json:"unsupported"`
+	// RefQueryCanceled is set if the reference query was canceled, since the test API reported the
+	// query as unsupported.
+	RefQueryCanceled bool `json:"refQueryCanceled,omitempty"`
+	// RefError and TestError are only set when both APIs failed with differing errors.
+	RefError      string   `json:"refError,omitempty"`
+	TestError     string   `json:"testError,omitempty"`
+	ErrorMismatch bool     `json:"errorMismatch,omitempty"`
+	Warnings      []string `json:"warnings,omitempty"`
+	// TestQuery is the query sent to the test target, if the rename query tweaks rewrote it.
+	TestQuery string `json:"testQuery,omitempty"`
+	// RefAPIWarnings and TestAPIWarnings are the warnings that the APIs returned with their results.
+	RefAPIWarnings  []string `json:"refApiWarnings,omitempty"`
+	TestAPIWarnings []string `json:"testApiWarnings,omitempty"`
+	// WarningsMismatch is set when the APIs returned different sets of warnings and warnings are compared.
+	WarningsMismatch bool `json:"warningsMismatch,omitempty"`
+	// SampleAlignment is the alignment strategy that was applied to AlignedSeries.
+	SampleAlignment config.SampleAlignment `json:"sampleAlignment,omitempty"`
+	AlignedSeries   []string               `json:"alignedSeries,omitempty"`
+	// LimitAggregation is the limitk() or limit_ratio() aggregation of the query, whose results
+	// are compared by properties instead of exactly.
+	LimitAggregation string `json:"limitAggregation,omitempty"`
+	// NativeHistogramSamples is the number of native histogram samples of both results, which were
+	// compared structurally since the test case expects native histograms.
+	NativeHistogramSamples int `json:"nativeHistogramSamples,omitempty"`
+	// HistogramMismatches lists the kinds of differences between the native histogram samples.
+	HistogramMismatches []string `json:"histogramMismatches,omitempty"`
+	// SnapCollisions lists the samples that the snap sample alignment moved onto a step that
+	// another sample of the same series was moved onto, too.
+	SnapCollisions []string `json:"snapCollisions,omitempty"`
+	// Diagnostics contains additional findings about the cause of a failure.
+	Diagnostics []string `json:"diagnostics,omitempty"`
+	// PassedWithinTolerance is set when the results only matched within the value tolerance,
+	// in which case ToleranceDiff shows the raw differences.
+	PassedWithinTolerance bool   `json:"passedWithinTolerance,omitempty"`
+	ToleranceDiff         string `json:"toleranceDiff,omitempty"`
+	// MaxAbsoluteDeviation and MaxRelativeDeviation are the largest differences between the compared
+	// sample values of a passing result, and ToleranceUsage the largest fraction of the value
+	// tolerance that a pair of them used up.
+	MaxAbsoluteDeviation float64 `json:"maxAbsoluteDeviation,omitempty"`
+	MaxRelativeDeviation float64 `json:"maxRelativeDeviation,omitempty"`
+	ToleranceUsage       float64 `json:"toleranceUsage,omitempty"`
+	// Notes describes adjustments that were applied to the comparison.
+	Notes []string `json:"notes,omitempty"`
+	// SkipReason explains why the test case was not run. Skipped test cases are neither successes nor failures.
+	SkipReason string `json:"skipReason,omitempty"`
+	// SkipCause is the machine-readable cause of SkipReason, one of the Skip constants.
+	SkipCause string `json:"skipCause,omitempty"`
+	// StructuredDiff lists the differing series and samples when the results differ.
+	StructuredDiff *StructuredDiff `json:"structuredDiff,omitempty"`
+	// ExecutionError is set when the comparison could not be executed, e.g. because a query timed out.
+	// Errored test cases are neither successes nor failures.
+	ExecutionError string `json:"executionError,omitempty"`
+	// QueryTimeout is the timeout that a query of an errored comparison exceeded, if it timed out.
+	QueryTimeout time.Duration `json:"queryTimeout,omitempty"`
+	// NotRun is set for skipped test cases that were not compared because the run was interrupted
+	// or a time budget that applies to them was exhausted.
+	NotRun bool `json:"notRun,omitempty"`
+	// EffectiveSettings is set for failing and errored test cases to make them reproducible.
+	EffectiveSettings *EffectiveSettings `json:"effectiveSettings,omitempty"`
+	// OutOfOrderSeries lists the series whose samples were not in ascending timestamp order.
+	OutOfOrderSeries []string `json:"outOfOrderSeries,omitempty"`
+	// TestTarget names the test target when several test targets are compared in one run.
+	TestTarget string `json:"testTarget,omitempty"`
+	// CollapsedSeries lists the label sets that several series collapsed into after applying the
+	// result label tweaks.
+	CollapsedSeries []string `json:"collapsedSeries,omitempty"`
+	// OutOfRangeValues lists the test values that fell outside the reference's recent range of values.
+	OutOfRangeValues []string `json:"outOfRangeValues,omitempty"`
+	// RefDuration and TestDuration are the wall-clock durations of the successful reference and test queries.
+	RefDuration  time.Duration `json:"refDuration,omitempty"`
+	TestDuration time.Duration `json:"testDuration,omitempty"`
+	// ConformanceFindings lists deviations of the raw test response from the Prometheus API format.
+	ConformanceFindings []ConformanceFinding `json:"conformanceFindings,omitempty"`
+	// Exactness compares the textual sample values of the raw responses of passing results that
+	// were sampled for the exactness audit.
+	Exactness *ExactnessAudit `json:"exactness,omitempty"`
+	// RequestParity records the query parameters sent to both targets if the test case was sampled for it.
+	RequestParity *RequestParity `json:"requestParity,omitempty"`
+	// RefRetries and TestRetries are the numbers of retries the reference and test queries needed.
+	RefRetries  int `json:"refRetries,omitempty"`
+	TestRetries int `json:"testRetries,omitempty"`
+	// RetriesExhausted is set if a query was not retried after a transient error, since the maximum
+	// retry wait of the run was exhausted.
+	RetriesExhausted bool `json:"retriesExhausted,omitempty"`
+	// ExtraSeries and MissingSeries count the series that were only in the test or reference result,
+	// respectively. They are only counted for test cases with a series allowance.
+	ExtraSeries   int `json:"extraSeries,omitempty"`
+	MissingSeries int `json:"missingSeries,omitempty"`
+	// Chaos is set if faults were injected into the requests of the run, so that the result does not
+	// tell anything about compliance.
+	Chaos bool `json:"chaos,omitempty"`
+	// RefResponseHeaders and TestResponseHeaders hold the recorded headers of the responses.
+	RefResponseHeaders  map[string]string `json:"refResponseHeaders,omitempty"`
+	TestResponseHeaders map[string]string `json:"testResponseHeaders,omitempty"`
+	// CacheHit lists the headers of the test response that show it was served from a cache.
+	CacheHit string `json:"cacheHit,omitempty"`
+	// ConsistencyViolation is set if the test target's results of the test query and its same_as
+	// query differ, which Diff describes.
+	ConsistencyViolation bool `json:"consistencyViolation,omitempty"`
+}
+
+// checkLatency warns about passing results whose test query took more than LatencyWarnRatio times
+// as long as the reference query. Retried queries are not judged, since their durations only cover
+// the final attempt.
+func (c *Comparer) checkLatency(res *Result) {
+	if c.opts.LatencyWarnRatio <= 0 || !res.Success() || res.RefDuration <= 0 || res.TestDuration <= 0 || res.RefRetries > 0 || res.TestRetries > 0 {
+		return
+	}
+	if ratio := float64(res.TestDuration) / float64(res.RefDuration); ratio > c.opts.LatencyWarnRatio {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("test query took %.1fx as long as the reference query (%v vs. %v)", ratio, res.TestDuration, res.RefDuration))
+	}
+}
+
+// setDurations records the durations of the queries behind a result, if they succeeded.
+func setDurations(res *Result, ref, test *QueryResult) {
+	if res == nil {
+		return
+	}
+	if ref != nil {
+		res.RefDuration = ref.Duration
+	}
+	if test != nil {
+		res.TestDuration = test.Duration
+	}
+}
+
+// setAPIWarnings records the warnings that the APIs returned with their results, if they succeeded,
+// and flags differing sets of warnings if warnings are compared.
+func (c *Comparer) setAPIWarnings(res *Result, ref, test *QueryResult) {
+	if res == nil {
+		return
+	}
+	if ref != nil {
+		res.RefAPIWarnings = ref.Warnings
+	}
+	if test != nil {
+		res.TestAPIWarnings = test.Warnings
+	}
+	if c.opts.CompareWarnings && ref != nil && test != nil && !sameWarnings(ref.Warnings, test.Warnings) {
+		res.WarningsMismatch = true
+	}
+}
+
+// sameWarnings returns true if both lists contain the same warnings, regardless of order and repetitions.
+func sameWarnings(a, b []string) bool {
+	set := func(ws []string) map[string]bool {
+		m := make(map[string]bool, len(ws))
+		for _, w := range ws {
+			m[w] = true
+		}
+		return m
+	}
+	as, bs := set(a), set(b)
+	if len(as) != len(bs) {
+		return false
+	}
+	for w := range as {
+		if !bs[w] {
+			return false
+		}
+	}
+	return true
 }
 
 // Success returns true if the comparison result was successful.
 func (r *Result) Success() bool {
-	return r.Diff == "" && !r.UnexpectedSuccess && r.UnexpectedFailure == ""
+	return !r.Skipped() && !r.Errored() && r.Diff == "" && !r.UnexpectedSuccess && r.UnexpectedFailure == "" && !r.ErrorMismatch && !r.WarningsMismatch && len(r.OutOfOrderSeries) == 0
+}
+
+// Skipped returns true if the test case was not run.
+func (r *Result) Skipped() bool {
+	return r.SkipReason != ""
+}
+
+// Errored returns true if the comparison could not be executed.
+func (r *Result) Errored() bool {
+	return r.ExecutionError != ""
+}
+
+// Failed returns true if the test case was run and the comparison was not successful.
+func (r *Result) Failed() bool {
+	return !r.Skipped() && !r.Errored() && !r.Success()
+}
+
+// A TimeoutError is returned when a query did not complete within its configured timeout.
+type TimeoutError struct {
+	API     string
+	Query   string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s API query %q timed out after %v", e.API, e.Query, e.Timeout)
+}
+
+// TestTargetName returns the name that identifies the test target in results, if any.
+func (c *Comparer) TestTargetName() string {
+	return c.opts.TestTargetName
 }
 
 // Compare runs a test case query against the reference API and the test API and compares the results.
 func (c *Comparer) Compare(tc *TestCase) (*Result, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	return c.CompareContext(context.Background(), tc)
+}
+
+// CompareContext is like Compare, but runs the queries with the given context, e.g. one returned by WithSharedReference.
+func (c *Comparer) CompareContext(ctx context.Context, tc *TestCase) (res *Result, err error) {
+	defer func() {
+		if res != nil {
+			res.TestTarget = c.opts.TestTargetName
+			res.Chaos = c.opts.Chaos
+			if la, ok := parseLimitAggregation(tc.Query); ok {
+				res.LimitAggregation = la.op
+			}
+			if q := c.testQuery(tc); q != tc.Query {
+				res.TestQuery = q
+			}
+		}
+		if res != nil && res.Failed() {
+			res.EffectiveSettings = c.EffectiveSettings(tc)
+		}
+	}()
+
+	refCtx, refRetries := withRetryCount(ctx)
+	testCtx, testRetries := withRetryCount(ctx)
+	defer func() {
+		if res == nil {
+			return
+		}
+		res.RefRetries, res.TestRetries = int(atomic.LoadInt32(&refRetries.retries)), int(atomic.LoadInt32(&testRetries.retries))
+		res.RetriesExhausted = atomic.LoadInt32(&refRetries.exhausted) != 0 || atomic.LoadInt32(&testRetries.exhausted) != 0
+		for _, note := range []string{retryNote("reference", refRetries), retryNote("test", testRetries)} {
+			if note != "" {
+				res.Notes = append(res.Notes, note)
+			}
+		}
+		c.checkLatency(res)
+	}()
+
+	if sampledForConformance(tc, c.opts.LabelConformanceSampleRate) {
+		var capture *rawCapture
+		testCtx, capture = withRawCapture(testCtx)
+		defer func() {
+			if res == nil || !res.Success() || len(capture.bytes()) == 0 {
+				return
+			}
+			findings, err := checkLabelConformance(capture.bytes())
+			if err != nil {
+				res.Notes = append(res.Notes, fmt.Sprintf("API conformance check failed: %v", err))
+			}
+			res.ConformanceFindings = findings
+		}()
+	}
 
-	r := v1.Range{
-		Start: tc.Start,
-		End:   tc.End,
-		Step:  tc.Resolution,
+	if sampledForConformance(tc, c.opts.RequestParitySampleRate) {
+		var refRequest, testRequest *requestCapture
+		refCtx, refRequest = withRequestCapture(refCtx)
+		testCtx, testRequest = withRequestCapture(testCtx)
+		defer func() {
+			if res == nil {
+				return
+			}
+			res.RequestParity = checkRequestParity(refRequest, testRequest, c.testQuery(tc) != tc.Query)
+			if p := res.RequestParity; p != nil && len(p.Drift) > 0 {
+				res.Warnings = append(res.Warnings, "the targets were sent unexplained differing query parameters: "+strings.Join(p.Drift, "; "))
+			}
+		}()
 	}
 
-	// TODO: Handle warnings (second, ignored return value).
-	refResult, _, refErr := c.refAPI.QueryRange(ctx, tc.Query, r)
-	testResult, _, testErr := c.testAPI.QueryRange(ctx, tc.Query, r)
+	c.opts.RuleUsage.observeQuery(tc.Query)
+	c.opts.RuleUsage.observeQuery(tc.SameAs)
+	if tc.WithinReferenceRange != nil {
+		return c.compareWithinReferenceRange(refCtx, testCtx, tc)
+	}
+	if tc.SameAs != "" {
+		return c.compareConsistency(testCtx, tc)
+	}
+
+	if sampledForConformance(tc, c.opts.ExactnessSampleRate) {
+		var refBody, testBody *rawCapture
+		refCtx, refBody = withExactnessCapture(refCtx)
+		testCtx, testBody = withExactnessCapture(testCtx)
+		defer func() {
+			if res != nil && res.Success() {
+				res.Exactness = auditExactness(refBody.bytes(), testBody.bytes())
+			}
+		}()
+	}
+
+	f := c.fetch(refCtx, testCtx, tc)
+	refQueryResult, refErr, testQueryResult, testErr := f.ref, f.refErr, f.test, f.testErr
+	var refResult, testResult model.Value
+	defer func() {
+		setDurations(res, refQueryResult, testQueryResult)
+		c.setAPIWarnings(res, refQueryResult, testQueryResult)
+		c.setResponseHeaders(res, refQueryResult, testQueryResult)
+	}()
+	if f.refCanceled {
+		return &Result{
+			TestCase:          tc,
+			UnexpectedFailure: testErr.Error(),
+			Unsupported:       true,
+			RefQueryCanceled:  true,
+			Notes:             []string{"the reference query was canceled, since the test API reported the query as unsupported"},
+		}, nil
+	}
+	if refErr == nil {
+		refResult = refQueryResult.Value
+		if name := refQueryResult.Metadata[fallbackMetadataKey]; name != "" {
+			defer func() {
+				if res != nil {
+					res.Notes = append(res.Notes, fmt.Sprintf("reference result was provided by fallback reference target %q", name))
+				}
+			}()
+		}
+	}
+	if testErr == nil {
+		testResult = testQueryResult.Value
+	}
+
+	var timeoutErr *TimeoutError
+	if errors.As(refErr, &timeoutErr) {
+		timeoutErr.API = "reference"
+		return nil, timeoutErr
+	}
+	if errors.As(testErr, &timeoutErr) {
+		timeoutErr.API = "test"
+		return nil, timeoutErr
+	}
+	var tooLargeErr *ResponseTooLargeError
+	if errors.As(refErr, &tooLargeErr) {
+		return nil, errors.Wrapf(refErr, "querying reference API for %q", tc.Query)
+	}
+	if errors.As(testErr, &tooLargeErr) {
+		return nil, errors.Wrapf(testErr, "querying test API for %q", tc.Query)
+	}
+
+	// Queries that both APIs reject, e.g. because they are invalid, pass like expected failures.
+	if !tc.ShouldFail && isQueryRejection(refErr) {
+		if isQueryRejection(testErr) {
+			res := c.compareErrors(tc, refErr, testErr)
+			res.Notes = append(res.Notes, "both the reference and the test API rejected the query")
+			return res, nil
+		}
+		if testErr == nil {
+			return &Result{TestCase: tc, UnexpectedSuccess: true, RefError: refErr.Error()}, nil
+		}
+	}
 
 	if (refErr != nil) != tc.ShouldFail {
 		if refErr != nil {
@@ -97,15 +591,103 @@ func (c *Comparer) Compare(tc *TestCase) (*Result, error) {
 
 	if (testErr != nil) != tc.ShouldFail {
 		if testErr != nil {
-			return &Result{TestCase: tc, UnexpectedFailure: testErr.Error(), Unsupported: strings.Contains(testErr.Error(), "501")}, nil
+			return &Result{TestCase: tc, UnexpectedFailure: testErr.Error(), Unsupported: isUnsupported(testErr)}, nil
 		}
 		return &Result{TestCase: tc, UnexpectedSuccess: true}, nil
 	}
 
-	if tc.SkipComparison || tc.ShouldFail {
+	if tc.ShouldFail {
+		return c.compareErrors(tc, refErr, testErr), nil
+	}
+
+	var mismatches []string
+	if m := refQueryResult.ResultTypeMismatch; m != "" {
+		mismatches = append(mismatches, "reference API "+m)
+	}
+	if m := testQueryResult.ResultTypeMismatch; m != "" {
+		mismatches = append(mismatches, "test API "+m)
+	}
+	if len(mismatches) > 0 {
+		return &Result{TestCase: tc, Diff: "result type mismatch: " + strings.Join(mismatches, "; ")}, nil
+	}
+
+	if tc.SkipComparison {
 		return &Result{TestCase: tc}, nil
 	}
 
+	if refResult.Type() != testResult.Type() {
+		return &Result{
+			TestCase: tc,
+			Diff:     fmt.Sprintf("result type mismatch: reference returned %s, test returned %s", refResult.Type(), testResult.Type()),
+		}, nil
+	}
+
+	if tweaks := c.labelTweaks(tc); len(tweaks) > 0 {
+		c.opts.RuleUsage.observeResult(refResult, "reference")
+		c.opts.RuleUsage.observeResult(testResult, "test")
+		collapsed := append(applyLabelTweaks(refResult, tweaks, "reference"), applyLabelTweaks(testResult, tweaks, "test")...)
+		if len(collapsed) > 0 {
+			return &Result{TestCase: tc, Diff: collapsedSeriesDiff(collapsed), CollapsedSeries: collapsed}, nil
+		}
+	}
+
+	var quantileNotes []string
+	for _, qt := range c.queryTweaks {
+		if qt.CanonicalizeQuantileLabel {
+			quantileNotes = append(canonicalizeQuantileLabels(refResult, "reference"), canonicalizeQuantileLabels(testResult, "test")...)
+			break
+		}
+	}
+
+	options, rr := c.compareOptionsFor(tc.Query)
+	fraction, margin := c.fraction, c.margin
+	if rr != nil {
+		fraction, margin = c.tolerance(rr.AdjustValueTolerance)
+	}
+	if tc.ValueTolerance != nil {
+		options = c.toleranceOptions(tc.ValueTolerance)
+		fraction, margin = c.tolerance(tc.ValueTolerance)
+	}
+	if tc.ExpectNativeHistograms {
+		histogramRes := c.compareNativeHistograms(tc, refQueryResult, testQueryResult, fraction, margin)
+		if histogramRes.Diff != "" {
+			histogramRes.Notes = append(histogramRes.Notes, quantileNotes...)
+			return histogramRes, nil
+		}
+		defer func() {
+			if res != nil {
+				res.NativeHistogramSamples = histogramRes.NativeHistogramSamples
+				res.Warnings = append(res.Warnings, histogramRes.Warnings...)
+			}
+		}()
+	}
+	if la, ok := parseLimitAggregation(tc.Query); ok {
+		res, err := c.compareLimitAggregation(ctx, tc, la, refResult, testResult, fraction, margin)
+		if res != nil {
+			res.Notes = append(res.Notes, quantileNotes...)
+		}
+		return res, err
+	}
+	if tc.Instant() {
+		res = c.compareInstant(ctx, tc, refResult, testResult, options, fraction, margin)
+		if rr != nil {
+			res.Notes = append(res.Notes, recordingRuleNote(rr))
+		}
+		res.Notes = append(res.Notes, quantileNotes...)
+		return res, nil
+	}
+
+	sortSamples := c.opts.OutOfOrderPolicy == config.OutOfOrderPolicySort
+	outOfOrder := append(
+		checkSampleOrder(refResult.(model.Matrix), "reference", sortSamples),
+		checkSampleOrder(testResult.(model.Matrix), "test", sortSamples)...,
+	)
+	if len(outOfOrder) > 0 && !sortSamples {
+		return &Result{TestCase: tc, Diff: outOfOrderDiff(outOfOrder), OutOfOrderSeries: outOfOrder}, nil
+	}
+
+	// Dropping or renaming labels can change the order of the reference series, too.
+	sort.Sort(refResult.(model.Matrix))
 	sort.Sort(testResult.(model.Matrix))
 
 	for _, qt := range c.queryTweaks {
@@ -118,15 +700,199 @@ func (c *Comparer) Compare(tc *TestCase) (*Result, error) {
 		}
 	}
 
-	return &Result{
-		TestCase: tc,
-		Diff:     cmp.Diff(refResult, testResult, c.compareOptions),
-	}, nil
+	res = &Result{TestCase: tc, Notes: quantileNotes, OutOfOrderSeries: outOfOrder}
+	if rr != nil {
+		applyFreshnessGrace(rr, tc.End, refResult.(model.Matrix), testResult.(model.Matrix))
+		res.Notes = append(res.Notes, recordingRuleNote(rr))
+	}
+	for _, qt := range c.queryTweaks {
+		if qt.SampleAlignment != "" {
+			res.SampleAlignment = qt.SampleAlignment
+		}
+	}
+	refResult, testResult = c.allowUnmatchedSeries(res, refResult, testResult)
+	if res.SampleAlignment == config.SampleAlignmentSnap {
+		start := model.TimeFromUnixNano(tc.Start.UnixNano())
+		refSnapped, refCollisions := snapSamples(refResult.(model.Matrix), "reference", start, tc.Resolution)
+		testSnapped, testCollisions := snapSamples(testResult.(model.Matrix), "test", start, tc.Resolution)
+		res.AlignedSeries = append(refSnapped, testSnapped...)
+		if collisions := append(refCollisions, testCollisions...); len(collisions) > 0 {
+			res.SnapCollisions = collisions
+			res.Diff = snapCollisionDiff(collisions)
+			return res, nil
+		}
+	} else {
+		res.AlignedSeries = alignSamples(res.SampleAlignment, refResult.(model.Matrix), testResult.(model.Matrix), tc.Resolution)
+	}
+	res.Diff = c.capDiff(cmp.Diff(refResult, testResult, options))
+	if res.Diff != "" {
+		res.StructuredDiff = c.structuredDiff(refResult, testResult, fraction, margin)
+	}
+	c.checkTolerance(res, refResult, testResult, fraction, margin)
+	if res.Diff != "" && c.opts.HistogramDiagnostics {
+		if d := c.diagnoseHistogramQuantile(ctx, tc); d != "" {
+			res.Diagnostics = append(res.Diagnostics, d)
+		}
+	}
+	if res.Diff != "" {
+		if d := c.diagnoseSelector(ctx, tc, refResult, testResult); d != "" {
+			res.Diagnostics = append(res.Diagnostics, d)
+		}
+	}
+	return res, nil
+}
+
+// query runs the test case's query against a target, bounded by the given timeout if it is non-zero.
+func (c *Comparer) query(ctx context.Context, target QueryTarget, timeout time.Duration, tc *TestCase) (*QueryResult, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ctx, attempt := withAttemptDuration(ctx)
+	ctx, _ = withRateLimitWait(ctx)
+	ctx, envelope := withEnvelopeCapture(ctx)
+	var headers *headerCapture
+	if names := c.capturedHeaders(); len(names) > 0 {
+		ctx, headers = withHeaderCapture(ctx, names)
+	}
+	var histograms *rawCapture
+	if tc.ExpectNativeHistograms {
+		ctx, histograms = withHistogramCapture(ctx)
+	}
+	start := time.Now()
+	var (
+		res *QueryResult
+		err error
+	)
+	if tc.Instant() {
+		res, err = target.InstantQuery(ctx, tc.Query, tc.Time)
+	} else {
+		res, err = target.RangeQuery(ctx, tc.Query, v1.Range{
+			Start: tc.Start,
+			End:   tc.End,
+			Step:  tc.Resolution,
+		})
+	}
+	if err != nil {
+		if timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+			return nil, &TimeoutError{Query: tc.Query, Timeout: timeout}
+		}
+		return nil, err
+	}
+	timed := *res
+	timed.ResultTypeMismatch = checkResultType(envelope.bytes(), res.Value)
+	if headers != nil {
+		timed.ResponseHeaders = headers.get()
+	}
+	if histograms != nil && len(histograms.bytes()) > 0 {
+		body := histograms.bytes()
+		if timed.nativeHistograms, err = parseNativeHistograms(body); err != nil {
+			return nil, errors.Wrapf(err, "reading the native histograms of the response to %q", tc.Query)
+		}
+		timed.histogramsRead = true
+	}
+	timed.Duration = time.Since(start) - rateLimitWait(ctx)
+	if d := atomic.LoadInt64(attempt); d > 0 {
+		timed.Duration = time.Duration(d)
+	}
+	return &timed, nil
+}
+
+// compareInstant compares the vector or scalar results of an instant query.
+func (c *Comparer) compareInstant(ctx context.Context, tc *TestCase, refResult, testResult model.Value, options cmp.Options, fraction, margin float64) *Result {
+	res := &Result{TestCase: tc}
+	if v, ok := refResult.(model.Vector); ok {
+		var notes []string
+		refResult, testResult, notes = reconcileNaNSeries(c.opts.NaNMissingPolicy, v, testResult.(model.Vector))
+		res.Notes = append(res.Notes, notes...)
+		sort.Sort(refResult.(model.Vector))
+		sort.Sort(testResult.(model.Vector))
+	}
+	refResult, testResult = c.allowUnmatchedSeries(res, refResult, testResult)
+	res.Diff = c.capDiff(cmp.Diff(refResult, testResult, options))
+	if res.Diff != "" {
+		res.StructuredDiff = c.structuredDiff(refResult, testResult, fraction, margin)
+	}
+	c.checkTolerance(res, refResult, testResult, fraction, margin)
+	if res.Diff != "" && c.opts.HistogramDiagnostics {
+		if d := c.diagnoseHistogramQuantile(ctx, tc); d != "" {
+			res.Diagnostics = append(res.Diagnostics, d)
+		}
+	}
+	if res.Diff != "" {
+		if d := c.diagnoseSelector(ctx, tc, refResult, testResult); d != "" {
+			res.Diagnostics = append(res.Diagnostics, d)
+		}
+	}
+	return res
+}
+
+// checkTolerance flags passing results whose sample values only matched within the value tolerance,
+// recording the raw differences and the headroom left to the tolerance so that it can be audited.
+func (c *Comparer) checkTolerance(res *Result, refResult, testResult model.Value, fraction, margin float64) {
+	if res.Diff != "" {
+		return
+	}
+	if d := cmp.Diff(refResult, testResult, c.exactCompareOptions); d != "" {
+		res.PassedWithinTolerance = true
+		res.ToleranceDiff = c.capDiff(d)
+		c.recordHeadroom(res, refResult, testResult, fraction, margin)
+	}
 }
 
-func addFloatCompareOptions(queryTweaks []*config.QueryTweak, options *cmp.Options) {
-	fraction := defaultFraction
-	margin := defaultMargin
+// compareErrors judges a test case where both APIs failed as expected, applying the
+// configured policy when the two error messages differ.
+func (c *Comparer) compareErrors(tc *TestCase, refErr, testErr error) *Result {
+	res := &Result{TestCase: tc}
+	if c.errorKey(refErr.Error()) == c.errorKey(testErr.Error()) {
+		return res
+	}
+	switch c.opts.DifferingErrorsPolicy {
+	case config.ErrorPolicyWarn:
+		res.RefError, res.TestError = refErr.Error(), testErr.Error()
+		res.Warnings = append(res.Warnings, "reference and test API failed with different errors")
+	case config.ErrorPolicyFail:
+		res.RefError, res.TestError = refErr.Error(), testErr.Error()
+		res.ErrorMismatch = true
+	}
+	return res
+}
+
+// errorKey returns the part of an error message that is compared with the other API's error message.
+func (c *Comparer) errorKey(msg string) string {
+	re := c.opts.ErrorMatchRegexp
+	if re == nil {
+		return msg
+	}
+	m := re.FindStringSubmatch(msg)
+	switch {
+	case m == nil:
+		return msg
+	case len(m) > 1:
+		return strings.Join(m[1:], "\x00")
+	default:
+		return m[0]
+	}
+}
+
+// isQueryRejection returns true if the error is a bad_data or execution error of the Prometheus
+// API, i.e. the target rejected the query, e.g. because it failed to parse or evaluate it.
+func isQueryRejection(err error) bool {
+	var apiErr *v1.Error
+	return errors.As(err, &apiErr) && (apiErr.Type == v1.ErrBadData || apiErr.Type == v1.ErrExec)
+}
+
+// addFloatCompareOptions adds the float comparison options resulting from the query tweaks
+// and returns the effective tolerance.
+func addFloatCompareOptions(tolerance *config.Tolerance, queryTweaks []*config.QueryTweak, options *cmp.Options) (fraction, margin float64) {
+	fraction = defaultFraction
+	margin = defaultMargin
+	if tolerance != nil {
+		fraction = tolerance.Relative
+		margin = tolerance.Absolute
+	}
 	for _, rt := range queryTweaks {
 		if rt.AdjustValueTolerance != nil {
 			if rt.AdjustValueTolerance.Fraction != nil {
@@ -137,35 +903,36 @@ func addFloatCompareOptions(queryTweaks []*config.QueryTweak, options *cmp.Optio
 			}
 		}
 	}
+	addFloatOptions(fraction, margin, options)
+	return fraction, margin
+}
+
+func addFloatOptions(fraction, margin float64, options *cmp.Options) {
 	*options = append(
 		*options,
-		// Translate sample values into float64 so that cmpopts.EquateApprox() works.
+		// Translate sample values into float64 so that the float comparer applies.
 		cmp.Transformer("TranslateFloat64", func(in model.SampleValue) float64 {
 			return float64(in)
 		}),
-		cmpopts.EquateApprox(fraction, margin),
 		// A NaN is usually not treated as equal to another NaN, but we want to treat it as such here.
-		cmpopts.EquateNaNs(),
+		cmp.Comparer(floatsEqual(fraction, margin)),
+		// Vectors have an exact Equal method, which would take precedence over the float comparer.
+		cmp.Comparer(vectorsEqual(floatsEqual(fraction, margin))),
 	)
 }
 
-func addDropResultLabelsOptions(queryTweaks []*config.QueryTweak, options *cmp.Options) {
-	for _, rt := range queryTweaks {
-		if len(rt.DropResultLabels) != 0 {
-			localRt := rt
-			*options = append(
-				*options,
-				cmp.Transformer(
-					"DropResultLabels",
-					func(in model.Metric) model.Metric {
-						m := in.Clone()
-						for _, ln := range localRt.DropResultLabels {
-							delete(m, ln)
-						}
-						return m
-					},
-				),
-			)
+// vectorsEqual returns a function that considers two vectors equal if their samples have the same
+// metrics and timestamps, and values that are equal according to valuesEqual.
+func vectorsEqual(valuesEqual func(a, b float64) bool) func(a, b model.Vector) bool {
+	return func(a, b model.Vector) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !a[i].Metric.Equal(b[i].Metric) || !a[i].Timestamp.Equal(b[i].Timestamp) || !valuesEqual(float64(a[i].Value), float64(b[i].Value)) {
+				return false
+			}
 		}
+		return true
 	}
 }
@@ -0,0 +1,89 @@
+package comparer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// sleepingAPI is a PromAPI that answers each query with a fixed vector after a delay, unless the
+// query's context is done first.
+type sleepingAPI struct {
+	delay time.Duration
+	// hadDeadline records whether the context of the last query had a deadline.
+	hadDeadline bool
+}
+
+func (a *sleepingAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error) {
+	_, a.hadDeadline = ctx.Deadline()
+	select {
+	case <-time.After(a.delay):
+		return fakeVector(1), nil, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+func (a *sleepingAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, v1.Warnings, error) {
+	return a.Query(ctx, query, r.End)
+}
+
+func TestCompareQueryTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		ref, test        *sleepingAPI
+		refTimeout       time.Duration
+		testTimeout      time.Duration
+		wantAPI          string
+		wantQueryTimeout time.Duration
+	}{
+		{
+			name:        "slow test API",
+			ref:         &sleepingAPI{},
+			test:        &sleepingAPI{delay: time.Minute},
+			testTimeout: 20 * time.Millisecond,
+			wantAPI:     "test", wantQueryTimeout: 20 * time.Millisecond,
+		},
+		{
+			name:       "slow reference API",
+			ref:        &sleepingAPI{delay: time.Minute},
+			test:       &sleepingAPI{},
+			refTimeout: 20 * time.Millisecond, testTimeout: time.Minute,
+			wantAPI: "reference", wantQueryTimeout: 20 * time.Millisecond,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New(NewAPITarget(tc.ref), NewAPITarget(tc.test), nil, Options{RefQueryTimeout: tc.refTimeout, TestQueryTimeout: tc.testTimeout})
+			_, err := c.Compare(instantTestCase("demo"))
+			var timeoutErr *TimeoutError
+			if !errors.As(err, &timeoutErr) {
+				t.Fatalf("expected a timeout error, got %v", err)
+			}
+			if timeoutErr.API != tc.wantAPI || timeoutErr.Timeout != tc.wantQueryTimeout {
+				t.Fatalf("expected the %s API query to time out after %v, got %v", tc.wantAPI, tc.wantQueryTimeout, timeoutErr)
+			}
+		})
+	}
+}
+
+func TestCompareWithoutTimeoutIsUnbounded(t *testing.T) {
+	ref, test := &sleepingAPI{}, &sleepingAPI{delay: 50 * time.Millisecond}
+	c := New(NewAPITarget(ref), NewAPITarget(test), nil, Options{RefQueryTimeout: time.Minute})
+	res, err := c.Compare(instantTestCase("demo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Success() {
+		t.Fatalf("expected the comparison to pass, got diff %q", res.Diff)
+	}
+	if !ref.hadDeadline {
+		t.Error("expected the reference query to be bounded by its timeout")
+	}
+	if test.hadDeadline {
+		t.Error("expected the test query without a timeout to be unbounded")
+	}
+}
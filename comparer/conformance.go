@@ -0,0 +1,209 @@
+package comparer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// maxConformanceExamples bounds the number of findings recorded per kind and result.
+const maxConformanceExamples = 3
+
+// ConformanceFinding kinds.
+const (
+	ConformanceUnsortedLabels  = "unsorted label names"
+	ConformanceDuplicateLabels = "duplicate label names"
+)
+
+// A ConformanceFinding is a deviation of a test target's raw API response from the format that
+// Prometheus emits, which decoding into the Go model hides.
+type ConformanceFinding struct {
+	Kind string `json:"kind"`
+	// Example is the offending "metric" object as returned by the test target.
+	Example string `json:"example"`
+}
+
+type rawCaptureKey struct{}
+
+// rawCapture holds the body of the last response read through a capturing RoundTripper.
+type rawCapture struct {
+	// limit, if positive, is the number of leading bytes of the body that are kept.
+	limit int
+
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+// withRawCapture returns a context that makes capturing RoundTrippers record the response bodies
+// of requests made with it.
+func withRawCapture(ctx context.Context) (context.Context, *rawCapture) {
+	rc := &rawCapture{}
+	return context.WithValue(ctx, rawCaptureKey{}, rc), rc
+}
+
+func (rc *rawCapture) Write(p []byte) (int, error) {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	if rc.limit > 0 {
+		if room := rc.limit - rc.buf.Len(); room < len(p) {
+			if room > 0 {
+				rc.buf.Write(p[:room])
+			}
+			return len(p), nil
+		}
+	}
+	return rc.buf.Write(p)
+}
+
+func (rc *rawCapture) reset() {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.buf.Reset()
+}
+
+func (rc *rawCapture) bytes() []byte {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	return rc.buf.Bytes()
+}
+
+// capturingRoundTripper records the response bodies of requests whose context asks for it.
+type capturingRoundTripper struct {
+	next http.RoundTripper
+}
+
+// NewCapturingRoundTripper returns a RoundTripper that records the response bodies read from next
+// for the comparer's API conformance checks and exactness audits. Requests of comparisons that are not sampled for the
+// checks only have the start of their response bodies recorded, to check their declared result type.
+// The query parameters of requests are recorded for the request parity checks, and the selected
+// response headers for the results.
+func NewCapturingRoundTripper(next http.RoundTripper) http.RoundTripper {
+	return &capturingRoundTripper{next: next}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *capturingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rc, ok := req.Context().Value(requestCaptureKey{}).(*requestCapture); ok {
+		rc.record(req)
+	}
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if hc, ok := req.Context().Value(headerCaptureKey{}).(*headerCapture); ok {
+		hc.record(resp.Header)
+	}
+	var captures []io.Writer
+	for _, key := range []interface{}{rawCaptureKey{}, envelopeCaptureKey{}, histogramCaptureKey{}, exactnessCaptureKey{}} {
+		if rc, ok := req.Context().Value(key).(*rawCapture); ok {
+			// Only the body of the final attempt of retried queries is kept.
+			rc.reset()
+			captures = append(captures, rc)
+		}
+	}
+	if len(captures) == 0 {
+		return resp, nil
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(resp.Body, io.MultiWriter(captures...)), resp.Body}
+	return resp, nil
+}
+
+// sampledForConformance decides deterministically whether a test case is sampled for the API
+// conformance checks, so that repeated runs check the same test cases.
+func sampledForConformance(tc *TestCase, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s\x00%s", tc.Type, tc.Query)
+	return float64(h.Sum32())/float64(1<<32) < rate
+}
+
+// checkLabelConformance checks that the label names of each series in a raw query response body
+// are sorted and unique, as in responses from Prometheus.
+func checkLabelConformance(body []byte) ([]ConformanceFinding, error) {
+	var resp struct {
+		Data struct {
+			Result json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	var series []struct {
+		Metric json.RawMessage `json:"metric"`
+	}
+	// Scalar and string results are not lists of series and have no labels.
+	if err := json.Unmarshal(resp.Data.Result, &series); err != nil {
+		return nil, nil
+	}
+
+	var findings []ConformanceFinding
+	counts := map[string]int{}
+	report := func(kind string, metric json.RawMessage) {
+		counts[kind]++
+		if counts[kind] <= maxConformanceExamples {
+			findings = append(findings, ConformanceFinding{Kind: kind, Example: string(metric)})
+		}
+	}
+	for _, s := range series {
+		names, err := objectKeys(s.Metric)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool, len(names))
+		unsorted, duplicate := false, false
+		for i, n := range names {
+			if seen[n] {
+				duplicate = true
+			}
+			seen[n] = true
+			if i > 0 && n < names[i-1] {
+				unsorted = true
+			}
+		}
+		if unsorted {
+			report(ConformanceUnsortedLabels, s.Metric)
+		}
+		if duplicate {
+			report(ConformanceDuplicateLabels, s.Metric)
+		}
+	}
+	return findings, nil
+}
+
+// objectKeys returns the keys of a JSON object in the order in which they appear, including duplicates.
+func objectKeys(obj json.RawMessage) ([]string, error) {
+	if len(obj) == 0 {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(obj))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("expected a JSON object, got %s", obj)
+	}
+	var keys []string
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := t.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected JSON object key %v", t)
+		}
+		keys = append(keys, key)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,149 @@
+package comparer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestCheckLabelConformance(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		want []ConformanceFinding
+	}{
+		{
+			name: "sorted labels",
+			body: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"demo","a":"1","b":"2"},"value":[1,"1"]}]}}`,
+		},
+		{
+			name: "unsorted labels",
+			body: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"b":"2","a":"1"},"value":[1,"1"]},{"metric":{"a":"1","b":"3"},"value":[1,"1"]}]}}`,
+			want: []ConformanceFinding{{Kind: ConformanceUnsortedLabels, Example: `{"b":"2","a":"1"}`}},
+		},
+		{
+			name: "duplicate labels",
+			body: `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"a":"1","a":"2"},"values":[[1,"1"]]}]}}`,
+			want: []ConformanceFinding{{Kind: ConformanceDuplicateLabels, Example: `{"a":"1","a":"2"}`}},
+		},
+		{
+			name: "unsorted and duplicate labels",
+			body: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"b":"2","a":"1","b":"2"},"value":[1,"1"]}]}}`,
+			want: []ConformanceFinding{
+				{Kind: ConformanceUnsortedLabels, Example: `{"b":"2","a":"1","b":"2"}`},
+				{Kind: ConformanceDuplicateLabels, Example: `{"b":"2","a":"1","b":"2"}`},
+			},
+		},
+		{
+			name: "scalar result",
+			body: `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+		},
+		{
+			name: "empty metric",
+			body: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"1"]}]}}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := checkLabelConformance([]byte(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected the findings %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckLabelConformanceExamples(t *testing.T) {
+	var series []string
+	for i := 0; i < 10; i++ {
+		series = append(series, fmt.Sprintf(`{"metric":{"z":"%d","a":"1"},"value":[1,"1"]}`, i))
+	}
+	body := `{"status":"success","data":{"resultType":"vector","result":[` + strings.Join(series, ",") + `]}}`
+	got, err := checkLabelConformance([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != maxConformanceExamples || got[0].Example != `{"z":"0","a":"1"}` {
+		t.Errorf("expected the first %d of the unsorted series as examples, got %+v", maxConformanceExamples, got)
+	}
+
+	if _, err := checkLabelConformance([]byte(`{"data":{"result":[{"metric":["a"]}]}}`)); err == nil {
+		t.Error("expected an error for a metric that is not a JSON object")
+	}
+}
+
+func TestSampledForConformance(t *testing.T) {
+	tc := instantTestCase("demo")
+	if sampledForConformance(tc, 0) {
+		t.Error("expected no test cases to be sampled at a rate of 0")
+	}
+	if !sampledForConformance(tc, 1) {
+		t.Error("expected all test cases to be sampled at a rate of 1")
+	}
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		tc := instantTestCase(fmt.Sprintf("demo_%d", i))
+		s := sampledForConformance(tc, 0.2)
+		if s != sampledForConformance(tc, 0.2) {
+			t.Fatalf("expected sampling %q to be deterministic", tc.Query)
+		}
+		// Raising the rate only adds test cases to the sample.
+		if s && !sampledForConformance(tc, 0.5) {
+			t.Errorf("expected %q to be sampled at a rate of 0.5, since it is at a rate of 0.2", tc.Query)
+		}
+		if s {
+			sampled++
+		}
+	}
+	if sampled == 0 || sampled == 1000 {
+		t.Errorf("expected some of 1000 test cases to be sampled at a rate of 0.2, got %d", sampled)
+	}
+}
+
+func TestCompareLabelConformance(t *testing.T) {
+	// The test target returns the labels of the reference target's series in reverse order.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		value := "1"
+		if r.FormValue("query") == "failing" {
+			value = "2"
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"demo","instance":"a"},"value":[1,%q]}]}}`, value)
+	}))
+	defer srv.Close()
+	client, err := api.NewClient(api.Config{Address: srv.URL, RoundTripper: NewCapturingRoundTripper(http.DefaultTransport)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := NewAPITarget(v1.NewAPI(client))
+	ref := &fakeTarget{value: model.Vector{&model.Sample{Metric: model.Metric{"job": "demo", "instance": "a"}, Value: 1, Timestamp: 1000}}}
+
+	for _, tc := range []struct {
+		query string
+		rate  float64
+		want  []ConformanceFinding
+	}{
+		{query: "demo", rate: 1, want: []ConformanceFinding{{Kind: ConformanceUnsortedLabels, Example: `{"job":"demo","instance":"a"}`}}},
+		// Only sampled test cases are checked.
+		{query: "demo", rate: 0},
+		// Failing test cases are not checked, since their differences are reported already.
+		{query: "failing", rate: 1},
+	} {
+		res, err := New(ref, test, nil, Options{LabelConformanceSampleRate: tc.rate}).Compare(instantTestCase(tc.query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.ConformanceFindings, tc.want) {
+			t.Errorf("%s at a sample rate of %v: expected the findings %+v, got %+v", tc.query, tc.rate, tc.want, res.ConformanceFindings)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// compareConsistency checks that the test target returns the same result for the test case's
+// query and its same_as query, with the usual value tolerance and label tweaks. The reference is
+// not queried, so that inconsistencies of the test target's engine are caught even where its
+// results differ from the reference's. Differences are reported as consistency violations, whose
+// structured diff lists the result of the query as the reference and that of same_as as the test.
+func (c *Comparer) compareConsistency(ctx context.Context, tc *TestCase) (res *Result, err error) {
+	sameTC := *tc
+	sameTC.Query, sameTC.TestQuery = tc.SameAs, ""
+
+	queryRes, queryErr := c.query(ctx, c.testTarget, c.opts.TestQueryTimeout, c.testTestCase(tc))
+	sameRes, sameErr := c.query(ctx, c.testTarget, c.opts.TestQueryTimeout, &sameTC)
+	defer func() {
+		setDurations(res, nil, queryRes)
+	}()
+	var timeoutErr *TimeoutError
+	for _, err := range []error{queryErr, sameErr} {
+		if errors.As(err, &timeoutErr) {
+			timeoutErr.API = "test"
+			return nil, timeoutErr
+		}
+	}
+	if queryErr != nil {
+		return &Result{TestCase: tc, UnexpectedFailure: queryErr.Error()}, nil
+	}
+	if sameErr != nil {
+		return &Result{TestCase: tc, UnexpectedFailure: fmt.Sprintf("same_as query %q: %v", tc.SameAs, sameErr)}, nil
+	}
+
+	queryResult, sameResult := queryRes.Value, sameRes.Value
+	if queryResult.Type() != sameResult.Type() {
+		return &Result{
+			TestCase:             tc,
+			ConsistencyViolation: true,
+			Diff:                 fmt.Sprintf("result type mismatch: the test target returned %s for the query, but %s for same_as %q", queryResult.Type(), sameResult.Type(), tc.SameAs),
+		}, nil
+	}
+	if tweaks := c.labelTweaks(tc); len(tweaks) > 0 {
+		c.opts.RuleUsage.observeResult(queryResult, "test")
+		c.opts.RuleUsage.observeResult(sameResult, "test")
+		collapsed := append(applyLabelTweaks(queryResult, tweaks, "test"), applyLabelTweaks(sameResult, tweaks, "same_as")...)
+		if len(collapsed) > 0 {
+			return &Result{TestCase: tc, Diff: collapsedSeriesDiff(collapsed), CollapsedSeries: collapsed}, nil
+		}
+	}
+
+	options, fraction, margin := c.compareOptions, c.fraction, c.margin
+	if tc.ValueTolerance != nil {
+		options = c.toleranceOptions(tc.ValueTolerance)
+		fraction, margin = c.tolerance(tc.ValueTolerance)
+	}
+	switch v := queryResult.(type) {
+	case model.Vector:
+		sort.Sort(v)
+		sort.Sort(sameResult.(model.Vector))
+	case model.Matrix:
+		sort.Sort(v)
+		sort.Sort(sameResult.(model.Matrix))
+	}
+	res = &Result{TestCase: tc}
+	res.Diff = c.capDiff(cmp.Diff(queryResult, sameResult, options))
+	if res.Diff != "" {
+		res.ConsistencyViolation = true
+		res.StructuredDiff = c.structuredDiff(queryResult, sameResult, fraction, margin)
+	}
+	c.checkTolerance(res, queryResult, sameResult, fraction, margin)
+	res.Notes = append(res.Notes, fmt.Sprintf("compared the test target's results of the query and of same_as %q instead of the reference", tc.SameAs))
+	return res, nil
+}
@@ -0,0 +1,104 @@
+package comparer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// queryValueTarget is a QueryTarget that answers each query with its value, or fails it with its
+// error.
+type queryValueTarget struct {
+	values map[string]model.Value
+	errs   map[string]error
+}
+
+func (t *queryValueTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*QueryResult, error) {
+	if err := t.errs[query]; err != nil {
+		return nil, err
+	}
+	return &QueryResult{Value: t.values[query]}, nil
+}
+
+func (t *queryValueTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*QueryResult, error) {
+	return t.InstantQuery(ctx, query, r.End)
+}
+
+func TestCompareConsistency(t *testing.T) {
+	const query, sameAs = "sum(demo)", "sum without () (demo)"
+	for _, tc := range []struct {
+		name          string
+		same          model.Value
+		sameErr       error
+		wantSuccess   bool
+		wantViolation bool
+		wantDiff      string
+		wantFailure   string
+	}{
+		{name: "same results", same: fakeVector(1), wantSuccess: true},
+		{name: "within the value tolerance", same: fakeVector(1.000001), wantSuccess: true},
+		{name: "different values", same: fakeVector(2), wantViolation: true},
+		{
+			name:          "different result types",
+			same:          &model.Scalar{Value: 1, Timestamp: 1000},
+			wantViolation: true,
+			wantDiff:      `result type mismatch: the test target returned vector for the query, but scalar for same_as "sum without () (demo)"`,
+		},
+		{
+			name:        "same_as query fails",
+			sameErr:     errors.New("bad_data: parse error"),
+			wantFailure: `same_as query "sum without () (demo)": bad_data: parse error`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The reference differs from both results and must not be queried.
+			ref := &fakeTarget{value: fakeVector(10)}
+			test := &queryValueTarget{
+				values: map[string]model.Value{query: fakeVector(1), sameAs: tc.same},
+				errs:   map[string]error{sameAs: tc.sameErr},
+			}
+			testCase := instantTestCase(query)
+			testCase.SameAs = sameAs
+			res, err := New(ref, test, nil, Options{}).Compare(testCase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref.calls != 0 {
+				t.Errorf("expected the reference not to be queried, got %d queries", ref.calls)
+			}
+			if res.Success() != tc.wantSuccess || res.ConsistencyViolation != tc.wantViolation {
+				t.Errorf("expected success %v and a consistency violation %v, got %+v", tc.wantSuccess, tc.wantViolation, res)
+			}
+			if tc.wantDiff != "" && res.Diff != tc.wantDiff {
+				t.Errorf("expected the diff %q, got %q", tc.wantDiff, res.Diff)
+			}
+			if res.UnexpectedFailure != tc.wantFailure {
+				t.Errorf("expected the failure %q, got %q", tc.wantFailure, res.UnexpectedFailure)
+			}
+			if tc.wantViolation && res.Diff == "" {
+				t.Error("expected a diff of the inconsistent results")
+			}
+		})
+	}
+}
+
+func TestCompareConsistencyStructuredDiff(t *testing.T) {
+	test := &queryValueTarget{values: map[string]model.Value{"sum(demo)": fakeVector(1), "sum without () (demo)": fakeVector(2)}}
+	testCase := instantTestCase("sum(demo)")
+	testCase.SameAs = "sum without () (demo)"
+	res, err := New(&fakeTarget{}, test, nil, Options{}).Compare(testCase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StructuredDiff == nil {
+		t.Fatal("expected a structured diff of the inconsistent results")
+	}
+	if !strings.Contains(strings.Join(res.Notes, "\n"), `instead of the reference`) {
+		t.Errorf("expected a note that the reference was not compared, got %q", res.Notes)
+	}
+}
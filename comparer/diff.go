@@ -0,0 +1,267 @@
+package comparer
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// A StructuredDiff describes which series and samples differ between the reference and test results.
+type StructuredDiff struct {
+	Series []*SeriesDiff `json:"series"`
+	// MoreSeries is the number of further differing series that are not listed.
+	MoreSeries int `json:"moreSeries,omitempty"`
+}
+
+// A SeriesDiff describes the differences of a single series.
+type SeriesDiff struct {
+	Metric model.Metric `json:"metric"`
+	// OnlyIn is set to "reference" or "test" if the series is only present in one of the results.
+	OnlyIn string `json:"onlyIn,omitempty"`
+	// OnlyValue is set to "NaN" or "0" if the series is only present in one of the results and all of
+	// its samples have that value, as when one engine returns NaN or 0 for windows without samples
+	// that the other leaves out.
+	OnlyValue string `json:"onlyValue,omitempty"`
+	// Samples lists the mismatched samples, up to the configured maximum.
+	Samples []*SampleDiff `json:"samples,omitempty"`
+	// MoreSamples is the number of further mismatched samples that are not listed.
+	MoreSamples int `json:"moreSamples,omitempty"`
+}
+
+// A SampleDiff describes a mismatched sample. Expected or Actual is nil if the sample is missing
+// from the reference or test result, respectively.
+type SampleDiff struct {
+	Timestamp model.Time         `json:"timestamp"`
+	Expected  *model.SampleValue `json:"expected"`
+	Actual    *model.SampleValue `json:"actual"`
+}
+
+// String renders the diff as text, with one line per series and mismatched sample.
+func (d *StructuredDiff) String() string {
+	var b strings.Builder
+	for _, s := range d.Series {
+		if s.OnlyIn != "" && s.OnlyValue != "" {
+			fmt.Fprintf(&b, "series %v only in %s result, with all values %s (%s vs. empty result)\n", s.Metric, s.OnlyIn, s.OnlyValue, s.OnlyValue)
+			continue
+		}
+		if s.OnlyIn != "" {
+			fmt.Fprintf(&b, "series %v only in %s result\n", s.Metric, s.OnlyIn)
+			continue
+		}
+		fmt.Fprintf(&b, "series %v:\n", s.Metric)
+		for _, sd := range s.Samples {
+			note := ""
+			if sd.nanVsMissing() {
+				note = " (NaN vs. empty window)"
+			}
+			fmt.Fprintf(&b, "  @%v: expected %s, actual %s%s\n", sd.Timestamp, formatOptionalValue(sd.Expected), formatOptionalValue(sd.Actual), note)
+		}
+		if s.MoreSamples > 0 {
+			fmt.Fprintf(&b, "  ... and %d more\n", s.MoreSamples)
+		}
+	}
+	if d.MoreSeries > 0 {
+		fmt.Fprintf(&b, "... and %d more differing series\n", d.MoreSeries)
+	}
+	return b.String()
+}
+
+// Summary returns a single-line summary of the diff.
+func (d *StructuredDiff) Summary() string {
+	samples := 0
+	for _, s := range d.Series {
+		samples += len(s.Samples) + s.MoreSamples
+	}
+	return fmt.Sprintf("%d series differ, %d samples mismatched", len(d.Series)+d.MoreSeries, samples)
+}
+
+// NaNVsEmpty returns true if the diff contains NaN samples for which the other result has no
+// samples, which is how engines differ on windows without samples.
+func (d *StructuredDiff) NaNVsEmpty() bool {
+	for _, s := range d.Series {
+		if s.OnlyValue == "NaN" {
+			return true
+		}
+		for _, sd := range s.Samples {
+			if sd.nanVsMissing() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nanVsMissing returns true if the sample is NaN in one result and missing from the other.
+func (sd *SampleDiff) nanVsMissing() bool {
+	isNaN := func(v *model.SampleValue) bool { return v != nil && math.IsNaN(float64(*v)) }
+	return (sd.Expected == nil && isNaN(sd.Actual)) || (sd.Actual == nil && isNaN(sd.Expected))
+}
+
+// onlyValue returns "NaN" or "0" if all samples of a series have that value, or an empty string.
+func onlyValue(s diffSeries) string {
+	if len(s.samples) == 0 {
+		return ""
+	}
+	allNaN, allZero := true, true
+	for _, p := range s.samples {
+		allNaN = allNaN && math.IsNaN(float64(p.Value))
+		allZero = allZero && p.Value == 0
+	}
+	switch {
+	case allNaN:
+		return "NaN"
+	case allZero:
+		return "0"
+	default:
+		return ""
+	}
+}
+
+func formatOptionalValue(v *model.SampleValue) string {
+	if v == nil {
+		return "<missing>"
+	}
+	return v.String()
+}
+
+type diffSeries struct {
+	metric  model.Metric
+	samples []model.SamplePair
+}
+
+// seriesOf converts a vector, matrix, or scalar result into a list of series.
+func seriesOf(v model.Value) []diffSeries {
+	switch v := v.(type) {
+	case model.Matrix:
+		res := make([]diffSeries, 0, len(v))
+		for _, ss := range v {
+			res = append(res, diffSeries{metric: ss.Metric, samples: ss.Values})
+		}
+		return res
+	case model.Vector:
+		res := make([]diffSeries, 0, len(v))
+		for _, s := range v {
+			res = append(res, diffSeries{metric: s.Metric, samples: []model.SamplePair{{Timestamp: s.Timestamp, Value: s.Value}}})
+		}
+		return res
+	case *model.Scalar:
+		return []diffSeries{{metric: model.Metric{}, samples: []model.SamplePair{{Timestamp: v.Timestamp, Value: v.Value}}}}
+	}
+	return nil
+}
+
+// structuredDiff computes the series and samples that differ between the reference and test results,
+// using the given value tolerance. At most maxSamples mismatched samples are listed per series, and
+// series are only listed while the rendered diff stays within the configured number of lines.
+func (c *Comparer) structuredDiff(refResult, testResult model.Value, fraction, margin float64) *StructuredDiff {
+	equal := floatsEqual(fraction, margin)
+	maxSamples := c.opts.MaxDiffSamples
+	if maxSamples <= 0 {
+		maxSamples = defaultMaxDiffSamples
+	}
+
+	testByKey := map[string]diffSeries{}
+	for _, s := range seriesOf(testResult) {
+		testByKey[c.seriesKey(s.metric)] = s
+	}
+
+	d := &StructuredDiff{}
+	for _, ref := range seriesOf(refResult) {
+		key := c.seriesKey(ref.metric)
+		test, ok := testByKey[key]
+		if !ok {
+			d.Series = append(d.Series, &SeriesDiff{Metric: ref.metric, OnlyIn: "reference", OnlyValue: onlyValue(ref)})
+			continue
+		}
+		delete(testByKey, key)
+		if sd := diffSamples(ref, test, equal, maxSamples); sd != nil {
+			d.Series = append(d.Series, sd)
+		}
+	}
+	for _, test := range testByKey {
+		d.Series = append(d.Series, &SeriesDiff{Metric: test.metric, OnlyIn: "test", OnlyValue: onlyValue(test)})
+	}
+	if len(d.Series) == 0 {
+		return nil
+	}
+	sort.Slice(d.Series, func(i, j int) bool {
+		return d.Series[i].Metric.Before(d.Series[j].Metric)
+	})
+
+	lines := 0
+	for i, s := range d.Series {
+		n := 1
+		if s.OnlyIn == "" {
+			n += len(s.Samples)
+			if s.MoreSamples > 0 {
+				n++
+			}
+		}
+		// The first series is always listed, so that the diff shows at least one difference.
+		if i > 0 && lines+n > c.maxDiffLines() {
+			d.MoreSeries = len(d.Series) - i
+			d.Series = d.Series[:i]
+			break
+		}
+		lines += n
+	}
+	return d
+}
+
+func (c *Comparer) maxDiffLines() int {
+	if c.opts.MaxDiffLines <= 0 {
+		return defaultMaxDiffLines
+	}
+	return c.opts.MaxDiffLines
+}
+
+// capDiff cuts a textual diff to the configured number of lines.
+func (c *Comparer) capDiff(diff string) string {
+	lines := strings.SplitAfter(strings.TrimSuffix(diff, "\n"), "\n")
+	if max := c.maxDiffLines(); len(lines) > max {
+		return fmt.Sprintf("%s... and %d more lines\n", strings.Join(lines[:max], ""), len(lines)-max)
+	}
+	return diff
+}
+
+// diffSamples compares the timestamp-sorted samples of two series and returns their mismatches, if any.
+func diffSamples(ref, test diffSeries, equal func(a, b float64) bool, maxSamples int) *SeriesDiff {
+	sd := &SeriesDiff{Metric: ref.metric}
+	add := func(ts model.Time, expected, actual *model.SampleValue) {
+		if len(sd.Samples) < maxSamples {
+			sd.Samples = append(sd.Samples, &SampleDiff{Timestamp: ts, Expected: expected, Actual: actual})
+		} else {
+			sd.MoreSamples++
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(ref.samples) || j < len(test.samples) {
+		switch {
+		case j == len(test.samples) || (i < len(ref.samples) && ref.samples[i].Timestamp < test.samples[j].Timestamp):
+			add(ref.samples[i].Timestamp, &ref.samples[i].Value, nil)
+			i++
+		case i == len(ref.samples) || test.samples[j].Timestamp < ref.samples[i].Timestamp:
+			add(test.samples[j].Timestamp, nil, &test.samples[j].Value)
+			j++
+		default:
+			if !equal(float64(ref.samples[i].Value), float64(test.samples[j].Value)) {
+				add(ref.samples[i].Timestamp, &ref.samples[i].Value, &test.samples[j].Value)
+			}
+			i++
+			j++
+		}
+	}
+	if len(sd.Samples) == 0 {
+		return nil
+	}
+	return sd
+}
+
+// seriesKey identifies a series by its labels. The result label tweaks have already been applied.
+func (c *Comparer) seriesKey(m model.Metric) string {
+	return m.String()
+}
@@ -0,0 +1,215 @@
+package comparer
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+)
+
+// Kinds of differences found by the exactness audit.
+const (
+	// ExactnessFormat is a sample value that both targets return as the same float64 in different
+	// textual forms, e.g. "1" and "1.0".
+	ExactnessFormat = "format differs"
+	// ExactnessLastULP is a sample value that differs in the last unit in the last place.
+	ExactnessLastULP = "last ULP differs"
+	// ExactnessInexact is a sample value that differs by more than one ULP, within the value tolerance.
+	ExactnessInexact = "value differs"
+)
+
+type exactnessCaptureKey struct{}
+
+// withExactnessCapture returns a context that makes capturing RoundTrippers record the response
+// bodies of requests made with it for the exactness audit.
+func withExactnessCapture(ctx context.Context) (context.Context, *rawCapture) {
+	rc := &rawCapture{}
+	return context.WithValue(ctx, exactnessCaptureKey{}, rc), rc
+}
+
+// An ExactnessAudit compares the textual sample values of the raw responses of a passing test
+// case, to tell bit-identical results from results that are only equal within the value tolerance.
+// It does not affect the outcome of the test case.
+type ExactnessAudit struct {
+	// Samples is the number of samples of the responses that were paired up by series and
+	// timestamp, of which Identical had the same textual value.
+	Samples   int `json:"samples"`
+	Identical int `json:"identical"`
+	// FormatDiffers, LastULP, and Inexact count the paired samples whose values differed by kind.
+	FormatDiffers int                `json:"formatDiffers,omitempty"`
+	LastULP       int                `json:"lastULP,omitempty"`
+	Inexact       int                `json:"inexact,omitempty"`
+	Examples      []ExactnessFinding `json:"examples,omitempty"`
+}
+
+// BitIdentical returns true if all sample values decoded to the same float64s.
+func (a *ExactnessAudit) BitIdentical() bool {
+	return a.LastULP == 0 && a.Inexact == 0
+}
+
+// An ExactnessFinding is a sample whose textual values differ between the raw responses.
+type ExactnessFinding struct {
+	Kind      string `json:"kind"`
+	Series    string `json:"series"`
+	Timestamp string `json:"timestamp"`
+	Reference string `json:"reference"`
+	Test      string `json:"test"`
+}
+
+// rawSample is a sample of a raw query response with its textual value.
+type rawSample struct {
+	series, timestamp, value string
+}
+
+// auditExactness compares the sample values of the raw reference and test response bodies. It
+// returns nil if either body cannot be parsed or no samples pair up, e.g. since the reference
+// response was shared with another test target and not read from a target.
+func auditExactness(refBody, testBody []byte) *ExactnessAudit {
+	refSamples, err := rawSamples(refBody)
+	if err != nil {
+		return nil
+	}
+	testSamples, err := rawSamples(testBody)
+	if err != nil {
+		return nil
+	}
+	ref := make(map[[2]string]string, len(refSamples))
+	for _, s := range refSamples {
+		ref[[2]string{s.series, s.timestamp}] = s.value
+	}
+	audit := &ExactnessAudit{}
+	counts := map[string]int{}
+	for _, s := range testSamples {
+		refValue, ok := ref[[2]string{s.series, s.timestamp}]
+		if !ok {
+			continue
+		}
+		audit.Samples++
+		if refValue == s.value {
+			audit.Identical++
+			continue
+		}
+		kind := exactnessKind(refValue, s.value)
+		switch kind {
+		case ExactnessFormat:
+			audit.FormatDiffers++
+		case ExactnessLastULP:
+			audit.LastULP++
+		case ExactnessInexact:
+			audit.Inexact++
+		default:
+			continue
+		}
+		counts[kind]++
+		if counts[kind] <= maxConformanceExamples {
+			audit.Examples = append(audit.Examples, ExactnessFinding{Kind: kind, Series: s.series, Timestamp: s.timestamp, Reference: refValue, Test: s.value})
+		}
+	}
+	if audit.Samples == 0 {
+		return nil
+	}
+	return audit
+}
+
+// exactnessKind classifies the difference between two textual sample values, or returns an empty
+// string if either is not a float.
+func exactnessKind(ref, test string) string {
+	a, err := strconv.ParseFloat(ref, 64)
+	if err != nil {
+		return ""
+	}
+	b, err := strconv.ParseFloat(test, 64)
+	if err != nil {
+		return ""
+	}
+	if a == b || (math.IsNaN(a) && math.IsNaN(b)) {
+		return ExactnessFormat
+	}
+	if ulpDistance(a, b) == 1 {
+		return ExactnessLastULP
+	}
+	return ExactnessInexact
+}
+
+// ulpDistance returns the number of representable float64s between a and b, or the maximum uint64
+// if either is NaN.
+func ulpDistance(a, b float64) uint64 {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.MaxUint64
+	}
+	// Map the floats onto integers that are ordered like the floats, with -0 and +0 adjacent.
+	ordered := func(f float64) int64 {
+		bits := math.Float64bits(f)
+		if bits>>63 != 0 {
+			return -int64(bits &^ (1 << 63))
+		}
+		return int64(bits)
+	}
+	x, y := ordered(a), ordered(b)
+	if x > y {
+		return uint64(x - y)
+	}
+	return uint64(y - x)
+}
+
+// rawSamples returns the float samples of a raw query response body with their textual values,
+// identified by their series and timestamp.
+func rawSamples(body []byte) ([]rawSample, error) {
+	var resp struct {
+		Data struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	var samples []rawSample
+	add := func(metric model.Metric, pair []json.RawMessage) {
+		if len(pair) != 2 {
+			return
+		}
+		var ts float64
+		var value string
+		if json.Unmarshal(pair[0], &ts) != nil || json.Unmarshal(pair[1], &value) != nil {
+			return
+		}
+		// Timestamps are compared in milliseconds, like in the Go model.
+		samples = append(samples, rawSample{series: metric.String(), timestamp: model.TimeFromUnixNano(int64(math.Round(ts*1e3)) * 1e6).String(), value: value})
+	}
+	switch resp.Data.ResultType {
+	case "matrix":
+		var series []struct {
+			Metric model.Metric        `json:"metric"`
+			Values [][]json.RawMessage `json:"values"`
+		}
+		if err := json.Unmarshal(resp.Data.Result, &series); err != nil {
+			return nil, err
+		}
+		for _, s := range series {
+			for _, v := range s.Values {
+				add(s.Metric, v)
+			}
+		}
+	case "vector":
+		var series []struct {
+			Metric model.Metric      `json:"metric"`
+			Value  []json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(resp.Data.Result, &series); err != nil {
+			return nil, err
+		}
+		for _, s := range series {
+			add(s.Metric, s.Value)
+		}
+	case "scalar":
+		var value []json.RawMessage
+		if err := json.Unmarshal(resp.Data.Result, &value); err != nil {
+			return nil, err
+		}
+		add(model.Metric{}, value)
+	}
+	return samples, nil
+}
@@ -0,0 +1,78 @@
+package comparer
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// fallbackMetadataKey is the QueryResult metadata key under which a fallback target records the
+// name of the fallback target that answered a query. It is unset if the primary target answered.
+const fallbackMetadataKey = "fallbackTarget"
+
+// fallbackTarget is a QueryTarget that queries a chain of targets in order, falling back to the
+// next target when a target fails or returns an empty result.
+type fallbackTarget struct {
+	names   []string
+	targets []QueryTarget
+}
+
+// NewFallbackTarget returns a QueryTarget that queries the primary target first and falls back to
+// the given fallback targets in order when a query fails or returns an empty result. If no target
+// returns a non-empty result, the primary target's outcome is returned.
+func NewFallbackTarget(primary QueryTarget, fallbackNames []string, fallbacks []QueryTarget) QueryTarget {
+	return &fallbackTarget{
+		names:   append([]string{""}, fallbackNames...),
+		targets: append([]QueryTarget{primary}, fallbacks...),
+	}
+}
+
+// InstantQuery implements QueryTarget.
+func (t *fallbackTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*QueryResult, error) {
+	return t.run(ctx, func(target QueryTarget) (*QueryResult, error) {
+		return target.InstantQuery(ctx, query, ts)
+	})
+}
+
+// RangeQuery implements QueryTarget.
+func (t *fallbackTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*QueryResult, error) {
+	return t.run(ctx, func(target QueryTarget) (*QueryResult, error) {
+		return target.RangeQuery(ctx, query, r)
+	})
+}
+
+func (t *fallbackTarget) run(ctx context.Context, q func(QueryTarget) (*QueryResult, error)) (*QueryResult, error) {
+	primaryRes, primaryErr := q(t.targets[0])
+	if primaryErr == nil && !isEmptyResult(primaryRes.Value) {
+		return primaryRes, nil
+	}
+	for i, target := range t.targets[1:] {
+		if ctx.Err() != nil {
+			break
+		}
+		res, err := q(target)
+		if err != nil || isEmptyResult(res.Value) {
+			continue
+		}
+		md := make(map[string]string, len(res.Metadata)+1)
+		for k, v := range res.Metadata {
+			md[k] = v
+		}
+		md[fallbackMetadataKey] = t.names[i+1]
+		res.Metadata = md
+		return res, nil
+	}
+	return primaryRes, primaryErr
+}
+
+func isEmptyResult(v model.Value) bool {
+	switch v := v.(type) {
+	case model.Vector:
+		return len(v) == 0
+	case model.Matrix:
+		return len(v) == 0
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package comparer
+
+import (
+	"context"
+	"strings"
+)
+
+// fetched holds the responses of the reference and test targets to the queries of a test case.
+type fetched struct {
+	ref, test       *QueryResult
+	refErr, testErr error
+	// refCanceled is set if the reference query was canceled, since the test response already
+	// decided the outcome of the test case.
+	refCanceled bool
+}
+
+// fetch queries the reference and test targets for a test case concurrently. If the test target
+// reports the query as unsupported, which is the outcome of the test case whatever the reference
+// returns, the reference query is canceled if it is still in flight. Reference results that are
+// shared with the comparisons against other test targets are always awaited, since those need them.
+// Any other test response can be classified only together with the reference response.
+func (c *Comparer) fetch(refCtx, testCtx context.Context, tc *TestCase) *fetched {
+	f := &fetched{}
+	refCtx, cancel := context.WithCancel(refCtx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.ref, f.refErr = c.queryReference(refCtx, tc)
+	}()
+	f.test, f.testErr = c.query(testCtx, c.testTarget, c.opts.TestQueryTimeout, c.testTestCase(tc))
+
+	_, shared := refCtx.Value(sharedReferenceKey{}).(*sharedReference)
+	canceled := false
+	if !tc.ShouldFail && isUnsupported(f.testErr) && !shared {
+		select {
+		case <-done:
+			// A reference query that already completed is used as usual, e.g. a rejection of the
+			// query changes the outcome.
+		default:
+			cancel()
+			canceled = true
+		}
+	}
+	<-done
+	// A reference query that completed while it was canceled is still used.
+	if canceled && f.refErr != nil {
+		f.ref, f.refErr, f.refCanceled = nil, nil, true
+	}
+	return f
+}
+
+// isUnsupported returns true if a test target's query error shows that it does not implement the query.
+func isUnsupported(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "501")
+}
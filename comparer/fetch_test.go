@@ -0,0 +1,115 @@
+package comparer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+func TestFetchShortCircuit(t *testing.T) {
+	unsupported := errors.New("server_error: server error: 501")
+	for _, tc := range []struct {
+		name       string
+		ref, test  *fakeTarget
+		shouldFail bool
+		shared     bool
+		// wantCanceled is set if the reference query is canceled before it completes.
+		wantCanceled bool
+		check        func(*Result, error) bool
+	}{
+		{
+			name:         "unsupported query with a slow reference",
+			ref:          &fakeTarget{value: fakeVector(1), delay: 10 * time.Second},
+			test:         &fakeTarget{err: unsupported},
+			wantCanceled: true,
+			check: func(res *Result, err error) bool {
+				return err == nil && res.Unsupported && res.RefQueryCanceled && res.UnexpectedFailure == unsupported.Error() && len(res.Notes) == 1
+			},
+		},
+		{
+			name: "unsupported query with a completed reference",
+			ref:  &fakeTarget{value: fakeVector(1)},
+			test: &fakeTarget{err: unsupported, delay: 50 * time.Millisecond},
+			check: func(res *Result, err error) bool {
+				return err == nil && res.Unsupported && !res.RefQueryCanceled
+			},
+		},
+		{
+			// A rejection by the reference decides the outcome, so it is not dropped.
+			name: "unsupported query rejected by the reference",
+			ref:  &fakeTarget{err: &v1.Error{Type: v1.ErrBadData, Msg: "parse error"}},
+			test: &fakeTarget{err: unsupported, delay: 50 * time.Millisecond},
+			check: func(res *Result, err error) bool {
+				return err != nil && strings.Contains(err.Error(), "querying reference API")
+			},
+		},
+		{
+			// Both rejections are compared, so the reference is awaited.
+			name: "query rejected by the test API",
+			ref:  &fakeTarget{err: &v1.Error{Type: v1.ErrBadData, Msg: "parse error"}, delay: 50 * time.Millisecond},
+			test: &fakeTarget{err: &v1.Error{Type: v1.ErrBadData, Msg: "parse error"}},
+			check: func(res *Result, err error) bool {
+				return err == nil && res.Success() && !res.RefQueryCanceled
+			},
+		},
+		{
+			// Expected failures compare the errors of both APIs.
+			name:       "expected failure",
+			ref:        &fakeTarget{err: errors.New("execution: unsupported"), delay: 50 * time.Millisecond},
+			test:       &fakeTarget{err: unsupported},
+			shouldFail: true,
+			check: func(res *Result, err error) bool {
+				return err == nil && !res.RefQueryCanceled && !res.UnexpectedSuccess && res.UnexpectedFailure == ""
+			},
+		},
+		{
+			// Shared reference results are needed by the comparisons against other test targets.
+			name:   "shared reference",
+			ref:    &fakeTarget{value: fakeVector(1), delay: 50 * time.Millisecond},
+			test:   &fakeTarget{err: unsupported},
+			shared: true,
+			check: func(res *Result, err error) bool {
+				return err == nil && res.Unsupported && !res.RefQueryCanceled
+			},
+		},
+		{
+			name: "failing test query",
+			ref:  &fakeTarget{value: fakeVector(1), delay: 50 * time.Millisecond},
+			test: &fakeTarget{err: errors.New("server_error: server error: 503")},
+			check: func(res *Result, err error) bool {
+				return err == nil && !res.Unsupported && !res.RefQueryCanceled && res.UnexpectedFailure != ""
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.shared {
+				ctx = WithSharedReference(ctx)
+			}
+			testCase := instantTestCase("demo")
+			testCase.ShouldFail = tc.shouldFail
+			start := time.Now()
+			res, err := New(tc.ref, tc.test, nil, Options{}).CompareContext(ctx, testCase)
+			if !tc.check(res, err) {
+				t.Errorf("unexpected result %+v and error %v", res, err)
+			}
+			if canceled := time.Since(start) < tc.ref.delay; canceled != tc.wantCanceled {
+				t.Errorf("expected the reference query to be canceled %v, took %v of its delay of %v", tc.wantCanceled, time.Since(start), tc.ref.delay)
+			}
+		})
+	}
+}
+
+func TestFetchInterrupted(t *testing.T) {
+	// An interrupted run cancels both queries, which is not a short circuit.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	res, err := New(&fakeTarget{value: fakeVector(1), delay: 10 * time.Second}, &fakeTarget{value: fakeVector(1), delay: 10 * time.Second}, nil, Options{}).CompareContext(ctx, instantTestCase("demo"))
+	if err == nil && res.RefQueryCanceled {
+		t.Errorf("expected the interrupted comparison not to be a short circuit, got %+v", res)
+	}
+}
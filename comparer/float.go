@@ -0,0 +1,19 @@
+package comparer
+
+import "math"
+
+// floatsEqual returns a function that considers two sample values equal if they differ by at most
+// the absolute margin, or by at most the relative fraction of the larger of their magnitudes.
+// NaNs are equal to each other, and infinities are only equal to infinities of the same sign.
+func floatsEqual(fraction, margin float64) func(a, b float64) bool {
+	return func(a, b float64) bool {
+		if math.IsNaN(a) || math.IsNaN(b) {
+			return math.IsNaN(a) && math.IsNaN(b)
+		}
+		if math.IsInf(a, 0) || math.IsInf(b, 0) {
+			return a == b
+		}
+		delta := math.Abs(a - b)
+		return delta <= margin || delta <= fraction*math.Max(math.Abs(a), math.Abs(b))
+	}
+}
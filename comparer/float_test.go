@@ -0,0 +1,73 @@
+package comparer
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+func TestFloatsEqual(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	for _, tc := range []struct {
+		name             string
+		a, b             float64
+		fraction, margin float64
+		want             bool
+	}{
+		{name: "exact match", a: 1, b: 1, want: true},
+		{name: "exact match of zeros", a: 0, b: math.Copysign(0, -1), want: true},
+		{name: "last ULP without tolerance", a: 1.0000000000000002, b: 1, want: false},
+		{name: "last ULP within relative tolerance", a: 1.0000000000000002, b: 1, fraction: 1e-12, want: true},
+		{name: "within absolute tolerance", a: 0.0001, b: 0.0002, margin: 0.001, want: true},
+		{name: "within relative tolerance of the larger value", a: 100, b: 100.5, fraction: 0.005, want: true},
+		{name: "out of relative tolerance", a: 100, b: 101, fraction: 0.005, want: false},
+		{name: "out of absolute tolerance", a: 1, b: 1.1, margin: 0.01, want: false},
+		{name: "either tolerance suffices", a: 1e-9, b: 2e-9, fraction: 1e-3, margin: 1e-8, want: true},
+		{name: "NaN equals NaN", a: nan, b: nan, want: true},
+		{name: "NaN differs from a number", a: nan, b: 1, fraction: 1, margin: 1, want: false},
+		{name: "number differs from NaN", a: 0, b: nan, margin: math.MaxFloat64, want: false},
+		{name: "+Inf equals +Inf", a: inf, b: inf, want: true},
+		{name: "-Inf equals -Inf", a: -inf, b: -inf, want: true},
+		{name: "+Inf differs from -Inf", a: inf, b: -inf, fraction: 1, margin: math.MaxFloat64, want: false},
+		{name: "+Inf differs from the largest float", a: inf, b: math.MaxFloat64, fraction: 1, margin: math.MaxFloat64, want: false},
+		{name: "Inf differs from NaN", a: inf, b: nan, want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			eq := floatsEqual(tc.fraction, tc.margin)
+			if got := eq(tc.a, tc.b); got != tc.want {
+				t.Errorf("floatsEqual(%v, %v)(%v, %v) = %v, want %v", tc.fraction, tc.margin, tc.a, tc.b, got, tc.want)
+			}
+			if got := eq(tc.b, tc.a); got != tc.want {
+				t.Errorf("floatsEqual(%v, %v)(%v, %v) = %v, want %v", tc.fraction, tc.margin, tc.b, tc.a, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompareWithTolerance(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		tolerance *config.Tolerance
+		ref, test float64
+		want      bool
+	}{
+		{name: "exact", tolerance: &config.Tolerance{}, ref: 1.0000000000000002, test: 1, want: false},
+		{name: "relative", tolerance: &config.Tolerance{Relative: 1e-12}, ref: 1.0000000000000002, test: 1, want: true},
+		{name: "NaN", tolerance: &config.Tolerance{}, ref: math.NaN(), test: math.NaN(), want: true},
+		{name: "-Inf", tolerance: &config.Tolerance{}, ref: math.Inf(-1), test: math.Inf(-1), want: true},
+		{name: "opposite infinities", tolerance: &config.Tolerance{Relative: 1}, ref: math.Inf(-1), test: math.Inf(1), want: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, test := &fakeTarget{value: fakeVector(model.SampleValue(tc.ref))}, &fakeTarget{value: fakeVector(model.SampleValue(tc.test))}
+			res, err := New(ref, test, nil, Options{Tolerance: tc.tolerance}).Compare(instantTestCase("demo"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Success() != tc.want {
+				t.Errorf("expected success %v, got diff %q", tc.want, res.Diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package comparer
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/common/model"
+)
+
+// recordHeadroom records the largest deviations between the sample values of a passing result, and
+// how much of the value tolerance they used up. A pair of values uses up the smaller of its
+// absolute difference as a fraction of the margin and its relative difference as a fraction of
+// the relative tolerance, since either suffices for the values to be equal. The results must have
+// matched, so that their series and samples pair up in order.
+func (c *Comparer) recordHeadroom(res *Result, refResult, testResult model.Value, fraction, margin float64) {
+	observe := func(a, b model.SampleValue) {
+		x, y := float64(a), float64(b)
+		if math.IsNaN(x) || math.IsNaN(y) || math.IsInf(x, 0) || math.IsInf(y, 0) {
+			return
+		}
+		delta := math.Abs(x - y)
+		if delta == 0 {
+			return
+		}
+		rel := delta / math.Max(math.Abs(x), math.Abs(y))
+		res.MaxAbsoluteDeviation = math.Max(res.MaxAbsoluteDeviation, delta)
+		res.MaxRelativeDeviation = math.Max(res.MaxRelativeDeviation, rel)
+		usage := math.Inf(1)
+		if margin > 0 {
+			usage = delta / margin
+		}
+		if fraction > 0 {
+			usage = math.Min(usage, rel/fraction)
+		}
+		if !math.IsInf(usage, 0) {
+			res.ToleranceUsage = math.Max(res.ToleranceUsage, usage)
+		}
+	}
+	switch ref := refResult.(type) {
+	case model.Matrix:
+		test, ok := testResult.(model.Matrix)
+		if !ok || len(test) != len(ref) {
+			return
+		}
+		for i, s := range ref {
+			if len(test[i].Values) != len(s.Values) {
+				continue
+			}
+			for j, p := range s.Values {
+				observe(p.Value, test[i].Values[j].Value)
+			}
+		}
+	case model.Vector:
+		test, ok := testResult.(model.Vector)
+		if !ok || len(test) != len(ref) {
+			return
+		}
+		for i, s := range ref {
+			observe(s.Value, test[i].Value)
+		}
+	case *model.Scalar:
+		if test, ok := testResult.(*model.Scalar); ok {
+			observe(ref.Value, test.Value)
+		}
+	}
+	if r := c.opts.HeadroomWarnRatio; r > 0 && res.ToleranceUsage > r {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("passed using %.0f%% of the value tolerance (largest deviation %g absolute, %.3g relative)", 100*res.ToleranceUsage, res.MaxAbsoluteDeviation, res.MaxRelativeDeviation))
+	}
+}
@@ -0,0 +1,72 @@
+package comparer
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+func TestCompareHeadroom(t *testing.T) {
+	matrix := func(values ...model.SampleValue) model.Matrix {
+		s := &model.SampleStream{Metric: model.Metric{"job": "demo"}}
+		for i, v := range values {
+			s.Values = append(s.Values, model.SamplePair{Timestamp: model.Time(i * 1000), Value: v})
+		}
+		return model.Matrix{s}
+	}
+	for _, tc := range []struct {
+		name          string
+		tolerance     config.Tolerance
+		ref, test     model.Value
+		wantAbsolute  float64
+		wantRelative  float64
+		wantUsage     float64
+		wantWarning   bool
+		wantUnchanged bool
+	}{
+		{name: "exact match", tolerance: config.Tolerance{Relative: 0.01}, ref: fakeVector(100), test: fakeVector(100)},
+		{name: "relative tolerance", tolerance: config.Tolerance{Relative: 0.01}, ref: fakeVector(100), test: fakeVector(100.5), wantAbsolute: 0.5, wantRelative: 0.5 / 100.5, wantUsage: 0.5 / 100.5 / 0.01},
+		{name: "absolute margin", tolerance: config.Tolerance{Absolute: 1}, ref: fakeVector(100), test: fakeVector(100.9), wantAbsolute: 0.9, wantRelative: 0.9 / 100.9, wantUsage: 0.9, wantWarning: true},
+		// Either tolerance suffices, so the smaller usage counts.
+		{name: "both tolerances", tolerance: config.Tolerance{Relative: 0.01, Absolute: 1}, ref: fakeVector(100), test: fakeVector(100.9), wantAbsolute: 0.9, wantRelative: 0.9 / 100.9, wantUsage: 0.9 / 100.9 / 0.01, wantWarning: true},
+		{name: "largest deviation of a matrix", tolerance: config.Tolerance{Absolute: 1}, ref: matrix(1, 2, 3), test: matrix(1.1, 2.5, 3.2), wantAbsolute: 0.5, wantRelative: 0.5 / 2.5, wantUsage: 0.5},
+		{name: "beyond the tolerance", tolerance: config.Tolerance{Absolute: 1}, ref: fakeVector(100), test: fakeVector(102), wantUnchanged: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tolerance := tc.tolerance
+			c := New(&fakeTarget{value: tc.ref}, &fakeTarget{value: tc.test}, nil, Options{Tolerance: &tolerance, HeadroomWarnRatio: 0.8})
+			res, err := c.Compare(instantTestCase("demo"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantUnchanged {
+				if res.Success() || res.ToleranceUsage != 0 {
+					t.Errorf("expected a failure without a tolerance usage, got %+v", res)
+				}
+				return
+			}
+			if !res.Success() {
+				t.Fatalf("expected the results to match within the tolerance, got diff %q", res.Diff)
+			}
+			for _, v := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"absolute deviation", res.MaxAbsoluteDeviation, tc.wantAbsolute},
+				{"relative deviation", res.MaxRelativeDeviation, tc.wantRelative},
+				{"tolerance usage", res.ToleranceUsage, tc.wantUsage},
+			} {
+				if math.Abs(v.got-v.want) > 1e-9 {
+					t.Errorf("expected the %s %v, got %v", v.name, v.want, v.got)
+				}
+			}
+			warned := strings.Contains(strings.Join(res.Warnings, "\n"), "of the value tolerance")
+			if warned != tc.wantWarning {
+				t.Errorf("expected a headroom warning %v, got the warnings %q", tc.wantWarning, res.Warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	histogramQuantileRegexp = regexp.MustCompile(`\bhistogram_quantile\s*\(`)
+	bucketSelectorRegexp    = regexp.MustCompile(`[a-zA-Z_:][a-zA-Z0-9_:]*_bucket(\{[^}]*\})?`)
+)
+
+// diagnoseHistogramQuantile checks the raw buckets underlying a failing histogram_quantile()
+// query on both APIs for non-monotonic cumulative counts. Prometheus fixes up such buckets
+// before computing quantiles, so this distinguishes data problems from computation problems.
+// It returns an empty string if the query is not a histogram_quantile() query.
+func (c *Comparer) diagnoseHistogramQuantile(ctx context.Context, tc *TestCase) string {
+	if !histogramQuantileRegexp.MatchString(tc.Query) {
+		return ""
+	}
+	sel := bucketSelectorRegexp.FindString(tc.Query)
+	if sel == "" {
+		return ""
+	}
+
+	r := v1.Range{Start: tc.Start, End: tc.End, Step: tc.Resolution}
+	refBuckets, refErr := c.refTarget.RangeQuery(ctx, sel, r)
+	testBuckets, testErr := c.testTarget.RangeQuery(ctx, sel, r)
+	if refErr != nil || testErr != nil {
+		return fmt.Sprintf("histogram bucket diagnostic for %s failed: reference error: %v, test error: %v", sel, refErr, testErr)
+	}
+	refMatrix, refOK := refBuckets.Value.(model.Matrix)
+	testMatrix, testOK := testBuckets.Value.(model.Matrix)
+	if !refOK || !testOK {
+		return fmt.Sprintf("histogram bucket diagnostic for %s failed: unexpected result types %s and %s", sel, refBuckets.Value.Type(), testBuckets.Value.Type())
+	}
+
+	refNonMonotonic := countNonMonotonicHistograms(refMatrix)
+	testNonMonotonic := countNonMonotonicHistograms(testMatrix)
+	if testNonMonotonic > 0 {
+		return fmt.Sprintf("the test target's raw buckets for %s are non-monotonic in %d histogram(s) (reference: %d), which points to a data problem", sel, testNonMonotonic, refNonMonotonic)
+	}
+	return fmt.Sprintf("the test target's raw buckets for %s are monotonic (reference: %d non-monotonic histogram(s)), which points to a computation problem", sel, refNonMonotonic)
+}
+
+type bucketSeries struct {
+	le     float64
+	values map[model.Time]model.SampleValue
+}
+
+// countNonMonotonicHistograms returns the number of histograms (bucket series grouped by all
+// labels except "le") whose cumulative bucket counts decrease with increasing "le" at any timestamp.
+func countNonMonotonicHistograms(m model.Matrix) int {
+	histograms := map[model.Fingerprint][]bucketSeries{}
+	for _, ss := range m {
+		le, err := strconv.ParseFloat(string(ss.Metric[model.BucketLabel]), 64)
+		if err != nil {
+			continue
+		}
+		lset := ss.Metric.Clone()
+		delete(lset, model.BucketLabel)
+		bs := bucketSeries{le: le, values: make(map[model.Time]model.SampleValue, len(ss.Values))}
+		for _, sp := range ss.Values {
+			bs.values[sp.Timestamp] = sp.Value
+		}
+		fp := lset.Fingerprint()
+		histograms[fp] = append(histograms[fp], bs)
+	}
+
+	count := 0
+	for _, buckets := range histograms {
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].le < buckets[j].le })
+		if !monotonic(buckets) {
+			count++
+		}
+	}
+	return count
+}
+
+func monotonic(buckets []bucketSeries) bool {
+	for i := 1; i < len(buckets); i++ {
+		for ts, v := range buckets[i].values {
+			if prev, ok := buckets[i-1].values[ts]; ok && v < prev {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// maxIngestionMetrics bounds the number of metrics whose ingestion parity is checked per test target.
+const maxIngestionMetrics = 100
+
+// IngestionParity compares the series and samples of a metric that the reference and test targets
+// ingested in a window.
+type IngestionParity struct {
+	Metric      string  `json:"metric"`
+	RefSeries   float64 `json:"refSeries"`
+	TestSeries  float64 `json:"testSeries"`
+	RefSamples  float64 `json:"refSamples"`
+	TestSamples float64 `json:"testSamples"`
+	// Matched is set if both the series and the sample counts are equal within the value tolerance.
+	Matched bool `json:"matched"`
+	// ParityPercent is the smaller of the sample counts as a percentage of the larger one, or 100 if
+	// the counts matched.
+	ParityPercent float64 `json:"parityPercent"`
+}
+
+// An IngestionReport holds the ingestion parity of the metrics of a test target.
+type IngestionReport struct {
+	TestTarget string             `json:"testTarget,omitempty"`
+	Start      time.Time          `json:"start"`
+	End        time.Time          `json:"end"`
+	Metrics    []*IngestionParity `json:"metrics"`
+	// OmittedMetrics is the number of metrics that were not checked, since there were more than
+	// maxIngestionMetrics.
+	OmittedMetrics int `json:"omittedMetrics,omitempty"`
+	// ParityPercent is the overall parity of the sample counts of all metrics.
+	ParityPercent float64 `json:"parityPercent"`
+}
+
+// CheckIngestionParity compares the numbers of series and samples of the metrics matching the
+// selectors that the targets ingested in [start, end]. The metrics are those with samples at end
+// on either target. Their counts are compared with the value tolerance of the comparer, so that
+// the parity is reported apart from the compliance of the query engine.
+func (c *Comparer) CheckIngestionParity(ctx context.Context, selectors []string, start, end time.Time) (*IngestionReport, error) {
+	report := &IngestionReport{TestTarget: c.opts.TestTargetName, Start: start, End: end, Metrics: []*IngestionParity{}}
+	window := model.Duration(end.Sub(start))
+
+	var metrics []string
+	selectorOf := map[string]string{}
+	for _, sel := range selectors {
+		refNames, err := c.metricNames(ctx, c.refTarget, sel, end)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing the metrics of %s on the reference target", sel)
+		}
+		testNames, err := c.metricNames(ctx, c.testTarget, config.RenameTestQuery(sel, c.queryTweaks), end)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing the metrics of %s on the test target", sel)
+		}
+		for _, name := range append(refNames, testNames...) {
+			if _, ok := selectorOf[name]; ok {
+				continue
+			}
+			metricSel, err := selectorWithName(sel, name)
+			if err != nil {
+				return nil, err
+			}
+			selectorOf[name] = metricSel
+			metrics = append(metrics, name)
+		}
+	}
+	sort.Strings(metrics)
+	if len(metrics) > maxIngestionMetrics {
+		report.OmittedMetrics = len(metrics) - maxIngestionMetrics
+		metrics = metrics[:maxIngestionMetrics]
+	}
+
+	equal := floatsEqual(c.fraction, c.margin)
+	var minSamples, maxSamples float64
+	for _, name := range metrics {
+		sel := selectorOf[name]
+		p := &IngestionParity{Metric: name}
+		var err error
+		series := fmt.Sprintf("count(count_over_time(%s[%s]))", sel, window)
+		samples := fmt.Sprintf("sum(count_over_time(%s[%s]))", sel, window)
+		if p.RefSeries, err = c.count(ctx, c.refTarget, series, end); err == nil {
+			if p.RefSamples, err = c.count(ctx, c.refTarget, samples, end); err == nil {
+				if p.TestSeries, err = c.count(ctx, c.testTarget, config.RenameTestQuery(series, c.queryTweaks), end); err == nil {
+					p.TestSamples, err = c.count(ctx, c.testTarget, config.RenameTestQuery(samples, c.queryTweaks), end)
+				}
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "counting the samples of %s", name)
+		}
+		lo, hi := math.Min(p.RefSamples, p.TestSamples), math.Max(p.RefSamples, p.TestSamples)
+		p.Matched = equal(p.RefSeries, p.TestSeries) && equal(p.RefSamples, p.TestSamples)
+		if p.Matched {
+			lo = hi
+		}
+		p.ParityPercent = 100
+		if hi > 0 {
+			p.ParityPercent = 100 * lo / hi
+		}
+		minSamples += lo
+		maxSamples += hi
+		report.Metrics = append(report.Metrics, p)
+	}
+	report.ParityPercent = 100
+	if maxSamples > 0 {
+		report.ParityPercent = 100 * minSamples / maxSamples
+	}
+	return report, nil
+}
+
+// metricNames returns the names of the metrics that match a selector at t.
+func (c *Comparer) metricNames(ctx context.Context, target QueryTarget, sel string, t time.Time) ([]string, error) {
+	res, err := target.InstantQuery(ctx, fmt.Sprintf("count by (__name__) (%s)", sel), t)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := res.Value.(model.Vector)
+	if !ok {
+		return nil, errors.Errorf("unexpected result type %s", res.Value.Type())
+	}
+	var names []string
+	for _, s := range v {
+		if name := s.Metric[model.MetricNameLabel]; name != "" {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+// count returns the value of an aggregation query at t, which is zero if it has no result.
+func (c *Comparer) count(ctx context.Context, target QueryTarget, query string, t time.Time) (float64, error) {
+	res, err := target.InstantQuery(ctx, query, t)
+	if err != nil {
+		return 0, err
+	}
+	v, ok := res.Value.(model.Vector)
+	if !ok {
+		return 0, errors.Errorf("unexpected result type %s of %q", res.Value.Type(), query)
+	}
+	if len(v) == 0 {
+		return 0, nil
+	}
+	return float64(v[0].Value), nil
+}
+
+// selectorWithName returns the selector of the metric with the given name out of those matching sel.
+func selectorWithName(sel, name string) (string, error) {
+	m := bareSelectorRegexp.FindStringSubmatch(sel)
+	if m == nil || (m[1] == "" && m[2] == "") {
+		return "", errors.Errorf("ingestion parity selector %q is not a vector selector", sel)
+	}
+	if m[1] != "" {
+		return strings.TrimSpace(sel), nil
+	}
+	matchers := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(m[2], "{"), "}"))
+	if matchers == "" {
+		return fmt.Sprintf("{__name__=%q}", name), nil
+	}
+	return fmt.Sprintf("{__name__=%q, %s}", name, matchers), nil
+}
@@ -0,0 +1,124 @@
+package comparer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// queryKindTarget is a fakeTarget that records the kind of the queries it answers and their evaluation time.
+type queryKindTarget struct {
+	fakeTarget
+	kinds []string
+	times []time.Time
+}
+
+func (t *queryKindTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*QueryResult, error) {
+	t.kinds = append(t.kinds, "instant")
+	t.times = append(t.times, ts)
+	return t.respond(ctx)
+}
+
+func (t *queryKindTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*QueryResult, error) {
+	t.kinds = append(t.kinds, "range")
+	return t.respond(ctx)
+}
+
+func TestCompareInstantQueries(t *testing.T) {
+	vector := func(values ...model.SampleValue) model.Vector {
+		var v model.Vector
+		for i, val := range values {
+			v = append(v, &model.Sample{Metric: model.Metric{"instance": model.LabelValue([]string{"a", "b", "c"}[i])}, Value: val, Timestamp: 1000})
+		}
+		return v
+	}
+	for _, tc := range []struct {
+		name      string
+		query     string
+		ref, test model.Value
+		wantDiff  string
+	}{
+		{
+			name:  "instant vector match",
+			query: "topk(2, demo)",
+			ref:   vector(3, 2),
+			test:  vector(3, 2),
+		},
+		{
+			name:  "instant vector match in a different series order",
+			query: "sort_desc(demo)",
+			ref:   model.Vector{vector(1, 2)[1], vector(1, 2)[0]},
+			test:  vector(1, 2),
+		},
+		{
+			name:     "instant vector mismatch",
+			query:    "topk(2, demo)",
+			ref:      vector(3, 2),
+			test:     vector(3, 1),
+			wantDiff: `{instance=\"b\"} => 1 @[1]`,
+		},
+		{
+			name:  "instant scalar match",
+			query: "scalar(sum(demo))",
+			ref:   &model.Scalar{Value: 5, Timestamp: 1000},
+			test:  &model.Scalar{Value: 5, Timestamp: 1000},
+		},
+		{
+			name:     "instant scalar mismatch",
+			query:    "scalar(sum(demo))",
+			ref:      &model.Scalar{Value: 5, Timestamp: 1000},
+			test:     &model.Scalar{Value: 6, Timestamp: 1000},
+			wantDiff: "Value",
+		},
+		{
+			name:     "type mismatch",
+			query:    "scalar(sum(demo))",
+			ref:      &model.Scalar{Value: 5, Timestamp: 1000},
+			test:     vector(5),
+			wantDiff: "result type mismatch: reference returned scalar, test returned vector",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ref := &queryKindTarget{fakeTarget: fakeTarget{value: tc.ref}}
+			test := &queryKindTarget{fakeTarget: fakeTarget{value: tc.test}}
+			evalTime := time.Unix(3600, 0)
+			res, err := New(ref, test, nil, Options{}).Compare(&TestCase{Query: tc.query, Type: config.QueryTypeInstant, Time: evalTime})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantDiff == "" && !res.Success() {
+				t.Errorf("expected the results to match, got diff %q", res.Diff)
+			}
+			if tc.wantDiff != "" && (!res.Failed() || !strings.Contains(res.Diff, tc.wantDiff)) {
+				t.Errorf("expected a failure with a diff containing %q, got %q", tc.wantDiff, res.Diff)
+			}
+			for _, target := range []*queryKindTarget{ref, test} {
+				if len(target.kinds) != 1 || target.kinds[0] != "instant" || !target.times[0].Equal(evalTime) {
+					t.Errorf("expected a single instant query at %v, got %v at %v", evalTime, target.kinds, target.times)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareRangeQueriesByDefault(t *testing.T) {
+	matrix := model.Matrix{&model.SampleStream{Metric: model.Metric{"job": "demo"}, Values: []model.SamplePair{{Timestamp: 0, Value: 1}}}}
+	ref := &queryKindTarget{fakeTarget: fakeTarget{value: matrix}}
+	test := &queryKindTarget{fakeTarget: fakeTarget{value: matrix}}
+	tc := &TestCase{Query: "demo", Type: config.QueryTypeRange, Start: time.Unix(0, 0), End: time.Unix(60, 0), Resolution: 10 * time.Second}
+	res, err := New(ref, test, nil, Options{}).Compare(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Success() {
+		t.Errorf("expected the results to match, got diff %q", res.Diff)
+	}
+	if len(ref.kinds) != 1 || ref.kinds[0] != "range" || len(test.kinds) != 1 || test.kinds[0] != "range" {
+		t.Errorf("expected a single range query per target, got %v and %v", ref.kinds, test.kinds)
+	}
+}
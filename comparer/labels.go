@@ -0,0 +1,107 @@
+package comparer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// labelTweaks returns the label tweaks that apply to a test case: those of the query tweaks,
+// followed by the test case's own.
+func (c *Comparer) labelTweaks(tc *TestCase) []*config.LabelTweak {
+	var tweaks []*config.LabelTweak
+	for _, qt := range c.queryTweaks {
+		if lt := qt.LabelTweak(); !lt.Empty() {
+			tweaks = append(tweaks, lt)
+		}
+	}
+	return append(tweaks, tc.LabelTweaks...)
+}
+
+// applyLabelTweaks drops and renames the labels of a query result's series in place. The reference
+// result is only changed by tweaks that apply to both results. It returns descriptions of the label
+// sets that several series of the result collapsed into, prefixed with the given side.
+func applyLabelTweaks(v model.Value, tweaks []*config.LabelTweak, side string) []string {
+	var metrics []*model.Metric
+	switch v := v.(type) {
+	case model.Matrix:
+		for _, ss := range v {
+			metrics = append(metrics, &ss.Metric)
+		}
+	case model.Vector:
+		for _, s := range v {
+			metrics = append(metrics, &s.Metric)
+		}
+	default:
+		return nil
+	}
+
+	changed := false
+	for _, lt := range tweaks {
+		if side == "reference" && lt.Scope == config.LabelTweakScopeTest {
+			continue
+		}
+		for _, m := range metrics {
+			if tweakLabels(m, lt) {
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	counts := map[model.Fingerprint]int{}
+	for _, m := range metrics {
+		counts[m.Fingerprint()]++
+	}
+	var collapsed []string
+	for _, m := range metrics {
+		fp := m.Fingerprint()
+		if n := counts[fp]; n > 1 {
+			collapsed = append(collapsed, fmt.Sprintf("%s: %d series became %s", side, n, *m))
+			delete(counts, fp)
+		}
+	}
+	sort.Strings(collapsed)
+	return collapsed
+}
+
+// tweakLabels applies a label tweak to a metric, cloning it before the first change. It returns
+// true if the metric was changed.
+func tweakLabels(m *model.Metric, lt *config.LabelTweak) bool {
+	changed := false
+	edit := func() model.Metric {
+		if !changed {
+			*m = m.Clone()
+			changed = true
+		}
+		return *m
+	}
+	for _, ln := range lt.DropResultLabels {
+		if _, ok := (*m)[ln]; ok {
+			delete(edit(), ln)
+		}
+	}
+	// Rename in a deterministic order, in case the renames overlap.
+	from := make(model.LabelNames, 0, len(lt.RenameResultLabels))
+	for ln := range lt.RenameResultLabels {
+		from = append(from, ln)
+	}
+	sort.Sort(from)
+	for _, ln := range from {
+		if val, ok := (*m)[ln]; ok {
+			mm := edit()
+			delete(mm, ln)
+			mm[lt.RenameResultLabels[ln]] = val
+		}
+	}
+	return changed
+}
+
+// collapsedSeriesDiff describes series that label tweaks made indistinguishable.
+func collapsedSeriesDiff(collapsed []string) string {
+	return fmt.Sprintf("result label tweaks made series indistinguishable, so they cannot be compared (%d label sets affected)", len(collapsed))
+}
@@ -0,0 +1,282 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// maxLimitViolations bounds the property violations listed in the diff of a limit aggregation.
+const maxLimitViolations = 20
+
+var (
+	limitAggregationRegexp = regexp.MustCompile(`^(limitk|limit_ratio)\s*(?:(by|without)\s*\(([^)]*)\)\s*)?\(`)
+	trailingGroupingRegexp = regexp.MustCompile(`^\s*(by|without)\s*\(([^)]*)\)\s*$`)
+)
+
+// A limitAggregation is a query whose outermost expression is a limitk() or limit_ratio()
+// aggregation. These select a subset of the series of the aggregated expression that is
+// intentionally implementation-specific, so their results are compared by properties instead.
+type limitAggregation struct {
+	op string
+	// param is the k of limitk() or the ratio of limit_ratio(), if it is a number literal.
+	param   float64
+	paramOK bool
+	// without is set if grouping lists the labels to group without instead of by.
+	without  bool
+	grouping []model.LabelName
+	// inner is the aggregated expression.
+	inner string
+}
+
+// parseLimitAggregation returns the limit aggregation of a query, if its outermost expression is
+// one. The query is not parsed as PromQL, so that limit aggregations nested in other expressions,
+// whose results cannot be checked by properties, are not recognized.
+func parseLimitAggregation(query string) (*limitAggregation, bool) {
+	q := stripOuterParens(strings.TrimSpace(query))
+	m := limitAggregationRegexp.FindStringSubmatchIndex(q)
+	if m == nil {
+		return nil, false
+	}
+	la := &limitAggregation{op: q[m[2]:m[3]]}
+	grouping := ""
+	if m[4] >= 0 {
+		la.without = q[m[4]:m[5]] == "without"
+		grouping = q[m[6]:m[7]]
+	}
+	open := m[1] - 1
+	end := closingParen(q, open)
+	if end < 0 {
+		return nil, false
+	}
+	if rest := q[end+1:]; strings.TrimSpace(rest) != "" {
+		g := trailingGroupingRegexp.FindStringSubmatch(rest)
+		if g == nil || m[4] >= 0 {
+			return nil, false
+		}
+		la.without = g[1] == "without"
+		grouping = g[2]
+	}
+	comma := topLevelComma(q[open+1 : end])
+	if comma < 0 {
+		return nil, false
+	}
+	la.inner = strings.TrimSpace(q[open+1+comma+1 : end])
+	param, err := strconv.ParseFloat(strings.TrimSpace(q[open+1:open+1+comma]), 64)
+	la.param, la.paramOK = param, err == nil
+	for _, l := range strings.Split(grouping, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			la.grouping = append(la.grouping, model.LabelName(l))
+		}
+	}
+	return la, true
+}
+
+// stripOuterParens removes parentheses that enclose the whole expression.
+func stripOuterParens(q string) string {
+	for strings.HasPrefix(q, "(") && closingParen(q, 0) == len(q)-1 {
+		q = strings.TrimSpace(q[1 : len(q)-1])
+	}
+	return q
+}
+
+// closingParen returns the index of the parenthesis closing the one at open, skipping string
+// literals, or -1 if there is none.
+func closingParen(q string, open int) int {
+	depth := 0
+	for i := open; i < len(q); i++ {
+		switch q[i] {
+		case '"', '\'', '`':
+			if i = skipString(q, i); i < 0 {
+				return -1
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// topLevelComma returns the index of the first comma in args that is not nested in brackets or
+// string literals, or -1 if there is none.
+func topLevelComma(args string) int {
+	depth := 0
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case '"', '\'', '`':
+			if i = skipString(args, i); i < 0 {
+				return -1
+			}
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// skipString returns the index of the quote that closes the string literal starting at i, or -1
+// if it is not closed.
+func skipString(q string, i int) int {
+	quote := q[i]
+	for j := i + 1; j < len(q); j++ {
+		switch {
+		case q[j] == '\\' && quote != '`':
+			j++
+		case q[j] == quote:
+			return j
+		}
+	}
+	return -1
+}
+
+// groupKey returns the key of the aggregation group of a series.
+func (la *limitAggregation) groupKey(m model.Metric) model.Fingerprint {
+	if la.without {
+		lset := m.Clone()
+		delete(lset, model.MetricNameLabel)
+		for _, l := range la.grouping {
+			delete(lset, l)
+		}
+		return lset.Fingerprint()
+	}
+	lset := model.Metric{}
+	for _, l := range la.grouping {
+		if v, ok := m[l]; ok {
+			lset[l] = v
+		}
+	}
+	return lset.Fingerprint()
+}
+
+// expectedCount returns the number of series that the aggregation selects per group and timestamp
+// out of n, and false if it cannot tell. limit_ratio() selects series by their hash, so that only
+// ratios selecting none or all of the series determine the count.
+func (la *limitAggregation) expectedCount(n int) (int, bool) {
+	if !la.paramOK {
+		return 0, false
+	}
+	switch la.op {
+	case "limitk":
+		k := int(math.Max(0, la.param))
+		if k < n {
+			return k, true
+		}
+		return n, true
+	default:
+		switch {
+		case la.param >= 1 || la.param <= -1:
+			return n, true
+		case la.param == 0:
+			return 0, true
+		}
+		return 0, false
+	}
+}
+
+// compareLimitAggregation checks the results of a limit aggregation by properties: the series of
+// both results must be part of the result of the aggregated expression on the reference target,
+// with matching values, and the number of series per group and timestamp must satisfy the limit.
+// It runs the aggregated expression as an extra reference query.
+func (c *Comparer) compareLimitAggregation(ctx context.Context, tc *TestCase, la *limitAggregation, refResult, testResult model.Value, fraction, margin float64) (*Result, error) {
+	innerTC := *tc
+	innerTC.Query = la.inner
+	innerTC.TestQuery = ""
+	inner, err := c.query(ctx, c.refTarget, c.opts.RefQueryTimeout, &innerTC)
+	if err != nil {
+		return nil, errors.Wrapf(err, "querying reference API for the aggregated expression %q", la.inner)
+	}
+	if tweaks := c.labelTweaks(tc); len(tweaks) > 0 {
+		applyLabelTweaks(inner.Value, tweaks, "reference")
+	}
+	if inner.Value.Type() != refResult.Type() {
+		return nil, errors.Errorf("the aggregated expression %q returned a %s instead of a %s", la.inner, inner.Value.Type(), refResult.Type())
+	}
+
+	equal := floatsEqual(fraction, margin)
+	values := map[model.Fingerprint]map[model.Time]model.SampleValue{}
+	groupSizes := map[model.Time]map[model.Fingerprint]int{}
+	for _, s := range seriesOf(inner.Value) {
+		fp := s.metric.Fingerprint()
+		values[fp] = make(map[model.Time]model.SampleValue, len(s.samples))
+		for _, sp := range s.samples {
+			values[fp][sp.Timestamp] = sp.Value
+			if groupSizes[sp.Timestamp] == nil {
+				groupSizes[sp.Timestamp] = map[model.Fingerprint]int{}
+			}
+			groupSizes[sp.Timestamp][la.groupKey(s.metric)]++
+		}
+	}
+
+	var violations []string
+	check := func(side string, v model.Value) {
+		counts := map[model.Time]map[model.Fingerprint]int{}
+		for _, s := range seriesOf(v) {
+			want, ok := values[s.metric.Fingerprint()]
+			if !ok {
+				violations = append(violations, fmt.Sprintf("%s series %s is not in the result of the aggregated expression", side, s.metric))
+				continue
+			}
+			for _, sp := range s.samples {
+				if counts[sp.Timestamp] == nil {
+					counts[sp.Timestamp] = map[model.Fingerprint]int{}
+				}
+				counts[sp.Timestamp][la.groupKey(s.metric)]++
+				if w, ok := want[sp.Timestamp]; !ok {
+					violations = append(violations, fmt.Sprintf("%s series %s has a sample at %v that the aggregated expression does not", side, s.metric, sp.Timestamp))
+				} else if !equal(float64(w), float64(sp.Value)) {
+					violations = append(violations, fmt.Sprintf("%s series %s has the value %v at %v instead of %v", side, s.metric, sp.Value, sp.Timestamp, w))
+				}
+			}
+		}
+		ts := make([]model.Time, 0, len(groupSizes))
+		for t := range groupSizes {
+			ts = append(ts, t)
+		}
+		sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+		for _, t := range ts {
+			var wrong []string
+			for g, n := range groupSizes[t] {
+				if want, ok := la.expectedCount(n); ok && counts[t][g] != want {
+					wrong = append(wrong, fmt.Sprintf("%s result has %d series in a group of %d series at %v, expected %d", side, counts[t][g], n, t, want))
+				}
+			}
+			// Groups are unordered, so sort their violations to keep the diff stable.
+			sort.Strings(wrong)
+			violations = append(violations, wrong...)
+		}
+	}
+	check("reference", refResult)
+	check("test", testResult)
+
+	res := &Result{TestCase: tc, LimitAggregation: la.op}
+	res.Notes = append(res.Notes, fmt.Sprintf("%s() selects series nondeterministically, so the results were compared by properties against the aggregated expression", la.op))
+	if !la.paramOK {
+		res.Notes = append(res.Notes, fmt.Sprintf("the parameter of %s() is not a number literal, so the number of selected series was not checked", la.op))
+	}
+	if len(violations) > 0 {
+		total := len(violations)
+		if total > maxLimitViolations {
+			violations = append(violations[:maxLimitViolations], fmt.Sprintf("... and %d more", total-maxLimitViolations))
+		}
+		res.Diff = fmt.Sprintf("%d %s() properties do not hold:\n%s", total, la.op, strings.Join(violations, "\n"))
+	}
+	return res, nil
+}
@@ -0,0 +1,125 @@
+package comparer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ResponseLimits bounds the size of the query responses read from a target.
+// Non-positive limits disable the respective check.
+type ResponseLimits struct {
+	// MaxBytes limits the size of a response body as transferred, i.e. before decompression.
+	MaxBytes int64 `json:"maxBytes"`
+	// MaxDecompressedBytes limits the size of a gzip-compressed response body after decompression.
+	MaxDecompressedBytes int64 `json:"maxDecompressedBytes"`
+}
+
+// A ResponseTooLargeError is returned when reading a response body that exceeds its size limit.
+type ResponseTooLargeError struct {
+	// Size is the size of the response as announced by the target, or -1 if it is unknown.
+	Size         int64
+	Limit        int64
+	Decompressed bool
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	what := "response"
+	if e.Decompressed {
+		what = "decompressed response"
+	}
+	if e.Size >= 0 {
+		return fmt.Sprintf("%s too large: %d bytes exceed the limit of %d bytes", what, e.Size, e.Limit)
+	}
+	return fmt.Sprintf("%s too large: more than the limit of %d bytes", what, e.Limit)
+}
+
+// limitingRoundTripper enforces ResponseLimits on the bodies of the responses it returns.
+type limitingRoundTripper struct {
+	next   http.RoundTripper
+	limits ResponseLimits
+}
+
+// NewLimitingRoundTripper returns a RoundTripper that fails reading response bodies from next once they
+// exceed the given limits, so that a misbehaving target cannot exhaust memory. Unless the request sets
+// an Accept-Encoding itself, the RoundTripper requests and decompresses gzip-compressed responses so
+// that the decompressed size can be limited separately.
+func NewLimitingRoundTripper(next http.RoundTripper, limits ResponseLimits) http.RoundTripper {
+	return &limitingRoundTripper{next: next, limits: limits}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *limitingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	requestedGzip := false
+	if req.Header.Get("Accept-Encoding") == "" && req.Method != http.MethodHead {
+		// Per RoundTrip's documentation, RoundTrip should not modify the request.
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", "gzip")
+		requestedGzip = true
+	}
+
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if rt.limits.MaxBytes > 0 && resp.ContentLength > rt.limits.MaxBytes {
+		resp.Body.Close()
+		return nil, &ResponseTooLargeError{Size: resp.ContentLength, Limit: rt.limits.MaxBytes}
+	}
+
+	body := limitReadCloser(resp.Body, resp.Body, rt.limits.MaxBytes, false)
+	if requestedGzip && resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		body = limitReadCloser(gz, resp.Body, rt.limits.MaxDecompressedBytes, true)
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// limitedReader reads from r and fails with a ResponseTooLargeError once more than limit bytes were read.
+type limitedReader struct {
+	r            io.Reader
+	c            io.Closer
+	remaining    int64
+	limit        int64
+	decompressed bool
+}
+
+func limitReadCloser(r io.Reader, c io.Closer, limit int64, decompressed bool) io.ReadCloser {
+	if limit <= 0 {
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, c}
+	}
+	// Allow reading one byte more than the limit to detect bodies that exceed it.
+	return &limitedReader{r: r, c: c, remaining: limit + 1, limit: limit, decompressed: decompressed}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, &ResponseTooLargeError{Size: -1, Limit: l.limit, Decompressed: l.decompressed}
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining <= 0 {
+		return n, &ResponseTooLargeError{Size: -1, Limit: l.limit, Decompressed: l.decompressed}
+	}
+	return n, err
+}
+
+func (l *limitedReader) Close() error {
+	return l.c.Close()
+}
@@ -0,0 +1,167 @@
+package comparer
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// vectorPrefix starts a vector query response whose samples are streamed by writeSamples.
+const vectorPrefix = `{"status":"success","data":{"resultType":"vector","result":[`
+
+// writeSamples writes samples of an instant vector until at least size bytes were written.
+func writeSamples(w interface{ Write([]byte) (int, error) }, size int) {
+	sample := []byte(`{"metric":{"job":"demo"},"value":[1,"1"]},`)
+	for n := 0; n < size; n += len(sample) {
+		w.Write(sample)
+	}
+	w.Write([]byte(`{"metric":{"job":"last"},"value":[1,"1"]}]}}`))
+}
+
+// limitedTarget returns a QueryTarget that queries url with the given response limits.
+func limitedTarget(t *testing.T, url string, limits ResponseLimits) QueryTarget {
+	t.Helper()
+	client, err := api.NewClient(api.Config{Address: url, RoundTripper: NewLimitingRoundTripper(http.DefaultTransport, limits)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAPITarget(v1.NewAPI(client))
+}
+
+func TestResponseLimits(t *testing.T) {
+	const limit = 1 << 20
+	for _, tc := range []struct {
+		name    string
+		limits  ResponseLimits
+		handler http.HandlerFunc
+		wantErr string
+	}{
+		{
+			name:   "announced size over the limit",
+			limits: ResponseLimits{MaxBytes: limit},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				body := vectorPrefix + `]}}`
+				w.Header().Set("Content-Length", fmt.Sprint(2*limit))
+				w.Write([]byte(body))
+			},
+			wantErr: fmt.Sprintf("response too large: %d bytes exceed the limit of %d bytes", 2*limit, limit),
+		},
+		{
+			name:   "streamed body over the limit",
+			limits: ResponseLimits{MaxBytes: limit},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(vectorPrefix))
+				writeSamples(w, 64<<20)
+			},
+			wantErr: fmt.Sprintf("response too large: more than the limit of %d bytes", limit),
+		},
+		{
+			name:   "decompressed body over the limit",
+			limits: ResponseLimits{MaxBytes: limit, MaxDecompressedBytes: limit},
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Accept-Encoding") != "gzip" {
+					t.Errorf("expected a gzip-compressed response to be requested, got %q", r.Header.Get("Accept-Encoding"))
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				defer gz.Close()
+				gz.Write([]byte(vectorPrefix))
+				// Repetitive samples compress well below the transferred size limit.
+				writeSamples(gz, 64<<20)
+			},
+			wantErr: fmt.Sprintf("decompressed response too large: more than the limit of %d bytes", limit),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(tc.handler)
+			defer srv.Close()
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			_, err := limitedTarget(t, srv.URL, tc.limits).InstantQuery(context.Background(), "demo", time.Unix(1, 0))
+			runtime.ReadMemStats(&after)
+
+			var tooLargeErr *ResponseTooLargeError
+			if !errors.As(err, &tooLargeErr) || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tc.wantErr, err)
+			}
+			// Decoding stops at the limit instead of reading the whole 64 MiB body.
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+				t.Errorf("expected reading the response to allocate less than 16 MiB, got %d bytes", alloc)
+			}
+		})
+	}
+}
+
+func TestResponseWithinLimits(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if !compressed {
+				w.Write([]byte(vectorPrefix))
+				writeSamples(w, 1<<10)
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			gz.Write([]byte(vectorPrefix))
+			writeSamples(gz, 1<<10)
+		}))
+		res, err := limitedTarget(t, srv.URL, ResponseLimits{MaxBytes: 1 << 20, MaxDecompressedBytes: 1 << 20}).InstantQuery(context.Background(), "demo", time.Unix(1, 0))
+		srv.Close()
+		if err != nil {
+			t.Fatalf("compressed=%v: %v", compressed, err)
+		}
+		if !strings.Contains(res.Value.String(), `{job="last"}`) {
+			t.Errorf("compressed=%v: expected the whole response to be decoded, got %d bytes", compressed, len(res.Value.String()))
+		}
+	}
+}
+
+func TestCompareResponseTooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(vectorPrefix))
+		writeSamples(w, 1<<20)
+	}))
+	defer srv.Close()
+	limits := ResponseLimits{MaxBytes: 1 << 10, MaxDecompressedBytes: 1 << 12}
+	c := New(&fakeTarget{value: fakeVector(1)}, limitedTarget(t, srv.URL, limits), nil, Options{TestResponseLimits: limits})
+
+	_, err := c.Compare(instantTestCase("demo"))
+	if err == nil || !strings.Contains(err.Error(), `querying test API for "demo": response too large`) {
+		t.Fatalf("expected the test API response to be too large, got %v", err)
+	}
+
+	// The limits are recorded in the effective settings of the report.
+	s := c.EffectiveSettings(instantTestCase("demo"))
+	if s.TestResponseLimits != limits {
+		t.Errorf("expected the test response limits %+v, got %+v", limits, s.TestResponseLimits)
+	}
+	want := map[string]string{"test_max_response_bytes": "1024", "test_max_decompressed_response_bytes": "4096"}
+	for _, l := range s.Chain {
+		if v, ok := want[l.Setting]; ok {
+			if l.Value != v || l.Layer != "test_target_config" {
+				t.Errorf("expected %s to be %s from test_target_config, got %+v", l.Setting, v, l)
+			}
+			delete(want, l.Setting)
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("expected the settings chain to contain %v, got %+v", want, s.Chain)
+	}
+}
@@ -0,0 +1,49 @@
+package comparer
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// reconcileNaNSeries finds instant vector series that have a NaN value on one side and are absent
+// on the other side. Under the "equal" policy, these NaN samples are removed from the vectors so
+// that they compare as equal to the absent series. It returns the modified vectors and a note for
+// each such series stating the interpretation that was applied.
+func reconcileNaNSeries(policy config.NaNMissingPolicy, ref, test model.Vector) (model.Vector, model.Vector, []string) {
+	refByFP := vectorByFingerprint(ref)
+	testByFP := vectorByFingerprint(test)
+
+	interpretation := "treated as distinct"
+	if policy == config.NaNMissingPolicyEqual {
+		interpretation = "treated as equal"
+	}
+
+	var notes []string
+	keep := func(v model.Vector, other map[model.Fingerprint]*model.Sample, side, otherSide string) model.Vector {
+		res := make(model.Vector, 0, len(v))
+		for _, s := range v {
+			if _, ok := other[s.Metric.Fingerprint()]; !ok && math.IsNaN(float64(s.Value)) {
+				notes = append(notes, fmt.Sprintf("series %s is NaN on the %s and absent on the %s (%s)", s.Metric, side, otherSide, interpretation))
+				if policy == config.NaNMissingPolicyEqual {
+					continue
+				}
+			}
+			res = append(res, s)
+		}
+		return res
+	}
+	ref = keep(ref, testByFP, "reference", "test target")
+	test = keep(test, refByFP, "test target", "reference")
+	return ref, test, notes
+}
+
+func vectorByFingerprint(v model.Vector) map[model.Fingerprint]*model.Sample {
+	m := make(map[model.Fingerprint]*model.Sample, len(v))
+	for _, s := range v {
+		m[s.Metric.Fingerprint()] = s
+	}
+	return m
+}
@@ -0,0 +1,433 @@
+package comparer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// maxHistogramDiffs bounds the series whose histogram differences are listed in the diff.
+const maxHistogramDiffs = 20
+
+// Kinds of native histogram mismatches, as listed in Result.HistogramMismatches.
+const (
+	HistogramMismatchKind    = "float vs. histogram"
+	HistogramMismatchMissing = "missing histogram"
+	HistogramMismatchCount   = "count"
+	HistogramMismatchSum     = "sum"
+	HistogramMismatchSchema  = "schema"
+	HistogramMismatchBucket  = "bucket"
+)
+
+// A histogramBucket is a bucket of a native histogram as returned by the Prometheus HTTP API.
+// Boundaries tells which of its bounds are inclusive: 0 is (lower, upper], 1 is [lower, upper),
+// 2 is (lower, upper), and 3 is [lower, upper].
+type histogramBucket struct {
+	boundaries   int
+	lower, upper float64
+	count        float64
+}
+
+// String formats the bucket in interval notation.
+func (b histogramBucket) String() string {
+	left, right := "(", "]"
+	switch b.boundaries {
+	case 1:
+		left, right = "[", ")"
+	case 2:
+		right = ")"
+	case 3:
+		left = "["
+	}
+	s := left + formatBound(b.lower) + "," + formatBound(b.upper) + right
+	if b.zero() {
+		return "zero bucket " + s
+	}
+	return s
+}
+
+// zero returns true if the bucket is the zero bucket, which is the only one that contains zero.
+func (b histogramBucket) zero() bool {
+	return b.lower <= 0 && b.upper >= 0
+}
+
+func formatBound(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// A nativeHistogram is a native histogram sample. The HTTP API neither returns the schema nor the
+// spans and deltas of the buckets, but their boundaries, so that both are compared through them.
+type nativeHistogram struct {
+	count, sum float64
+	buckets    []histogramBucket
+}
+
+// schema infers the schema of an exponential histogram from the widths of its buckets, and returns
+// false if it has no buckets besides the zero bucket or their widths do not agree on a schema.
+func (h *nativeHistogram) schema() (int, bool) {
+	schema, ok := 0, false
+	for _, b := range h.buckets {
+		if b.zero() {
+			continue
+		}
+		lo, hi := math.Abs(b.lower), math.Abs(b.upper)
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if lo == 0 || math.IsInf(hi, 0) {
+			return 0, false
+		}
+		s := -math.Log2(math.Log2(hi / lo))
+		if math.Abs(s-math.Round(s)) > 1e-6 || (ok && int(math.Round(s)) != schema) {
+			return 0, false
+		}
+		schema, ok = int(math.Round(s)), true
+	}
+	return schema, ok
+}
+
+// A histogramSeries holds the native histogram samples of a series in a raw query response, and
+// the timestamps of its float samples, which may be mixed with the histogram samples.
+type histogramSeries struct {
+	metric     model.Metric
+	histograms map[model.Time]*nativeHistogram
+	floats     map[model.Time]bool
+}
+
+type histogramCaptureKey struct{}
+
+// withHistogramCapture returns a context that makes capturing RoundTrippers record the complete
+// response bodies of requests made with it, to read the native histograms that model.Value lacks.
+func withHistogramCapture(ctx context.Context) (context.Context, *rawCapture) {
+	rc := &rawCapture{}
+	return context.WithValue(ctx, histogramCaptureKey{}, rc), rc
+}
+
+// parseNativeHistograms reads the native histogram and float samples of each series from a raw
+// query response body.
+func parseNativeHistograms(body []byte) ([]*histogramSeries, error) {
+	var resp struct {
+		Data struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	switch resp.Data.ResultType {
+	case model.ValVector.String(), model.ValMatrix.String():
+	default:
+		return nil, nil
+	}
+	var raw []struct {
+		Metric     model.Metric       `json:"metric"`
+		Value      *model.SamplePair  `json:"value"`
+		Values     []model.SamplePair `json:"values"`
+		Histogram  json.RawMessage    `json:"histogram"`
+		Histograms []json.RawMessage  `json:"histograms"`
+	}
+	if err := json.Unmarshal(resp.Data.Result, &raw); err != nil {
+		return nil, err
+	}
+	series := make([]*histogramSeries, 0, len(raw))
+	for _, r := range raw {
+		s := &histogramSeries{metric: r.Metric, histograms: map[model.Time]*nativeHistogram{}, floats: map[model.Time]bool{}}
+		if r.Value != nil {
+			s.floats[r.Value.Timestamp] = true
+		}
+		for _, sp := range r.Values {
+			s.floats[sp.Timestamp] = true
+		}
+		hs := r.Histograms
+		if len(r.Histogram) > 0 {
+			hs = append(hs, r.Histogram)
+		}
+		for _, h := range hs {
+			ts, nh, err := parseHistogramPair(h)
+			if err != nil {
+				return nil, errors.Wrapf(err, "series %s", r.Metric)
+			}
+			s.histograms[ts] = nh
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// parseHistogramPair parses a timestamp and native histogram pair like
+// [1.5, {"count": "2", "sum": "3", "buckets": [[0, "1", "2", "2"]]}].
+func parseHistogramPair(b []byte) (model.Time, *nativeHistogram, error) {
+	var pair struct {
+		ts model.Time
+		h  struct {
+			Count   string              `json:"count"`
+			Sum     string              `json:"sum"`
+			Buckets [][]json.RawMessage `json:"buckets"`
+		}
+	}
+	v := [...]interface{}{&pair.ts, &pair.h}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return 0, nil, errors.Wrap(err, "invalid histogram sample")
+	}
+	nh := &nativeHistogram{}
+	var err error
+	if nh.count, err = strconv.ParseFloat(pair.h.Count, 64); err != nil {
+		return 0, nil, errors.Wrap(err, "invalid histogram count")
+	}
+	if nh.sum, err = strconv.ParseFloat(pair.h.Sum, 64); err != nil {
+		return 0, nil, errors.Wrap(err, "invalid histogram sum")
+	}
+	for _, rb := range pair.h.Buckets {
+		if len(rb) != 4 {
+			return 0, nil, errors.Errorf("invalid histogram bucket with %d elements", len(rb))
+		}
+		var hb histogramBucket
+		var bounds [3]string
+		err := json.Unmarshal(rb[0], &hb.boundaries)
+		for i := range bounds {
+			if err == nil {
+				err = json.Unmarshal(rb[i+1], &bounds[i])
+			}
+		}
+		if err == nil {
+			hb.lower, err = strconv.ParseFloat(bounds[0], 64)
+		}
+		if err == nil {
+			hb.upper, err = strconv.ParseFloat(bounds[1], 64)
+		}
+		if err == nil {
+			hb.count, err = strconv.ParseFloat(bounds[2], 64)
+		}
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "invalid histogram bucket")
+		}
+		nh.buckets = append(nh.buckets, hb)
+	}
+	sort.Slice(nh.buckets, func(i, j int) bool {
+		if nh.buckets[i].lower != nh.buckets[j].lower {
+			return nh.buckets[i].lower < nh.buckets[j].lower
+		}
+		return nh.buckets[i].upper < nh.buckets[j].upper
+	})
+	return pair.ts, nh, nil
+}
+
+// tweakHistogramSeries returns the histogram series with the label tweaks applied to their
+// metrics, like to the decoded results. The series are not modified, since the comparisons against
+// several test targets share the reference series.
+func tweakHistogramSeries(series []*histogramSeries, tweaks []*config.LabelTweak, side string) []*histogramSeries {
+	m := make(model.Matrix, 0, len(series))
+	for _, s := range series {
+		m = append(m, &model.SampleStream{Metric: s.metric.Clone()})
+	}
+	applyLabelTweaks(m, tweaks, side)
+	tweaked := make([]*histogramSeries, 0, len(series))
+	for i, s := range series {
+		t := *s
+		t.metric = m[i].Metric
+		tweaked = append(tweaked, &t)
+	}
+	return tweaked
+}
+
+// histogramSampleCount returns the number of histogram samples of the series.
+func histogramSampleCount(series []*histogramSeries) int {
+	n := 0
+	for _, s := range series {
+		n += len(s.histograms)
+	}
+	return n
+}
+
+// diffNativeHistograms compares the native histogram samples of both results structurally,
+// with the same tolerance as float samples. It returns the first difference of each differing
+// series, sorted by series, and the kinds of the differences.
+func diffNativeHistograms(ref, test []*histogramSeries, equal func(a, b float64) bool) (diffs, kinds []string) {
+	index := func(series []*histogramSeries) map[model.Fingerprint]*histogramSeries {
+		m := make(map[model.Fingerprint]*histogramSeries, len(series))
+		for _, s := range series {
+			m[s.metric.Fingerprint()] = s
+		}
+		return m
+	}
+	refByFP, testByFP := index(ref), index(test)
+	type seriesDiff struct {
+		metric     string
+		diff, kind string
+	}
+	var found []seriesDiff
+	add := func(metric model.Metric, kind, format string, args ...interface{}) {
+		found = append(found, seriesDiff{metric: metric.String(), diff: fmt.Sprintf("%s: ", metric) + fmt.Sprintf(format, args...), kind: kind})
+	}
+	for fp, r := range refByFP {
+		t, ok := testByFP[fp]
+		if !ok {
+			if len(r.histograms) > 0 {
+				add(r.metric, HistogramMismatchMissing, "%d histogram samples only in the reference result", len(r.histograms))
+			}
+			continue
+		}
+		if kind, diff := seriesHistogramDiff(r, t, equal); diff != "" {
+			add(r.metric, kind, "%s", diff)
+		}
+	}
+	for fp, t := range testByFP {
+		if _, ok := refByFP[fp]; !ok && len(t.histograms) > 0 {
+			add(t.metric, HistogramMismatchMissing, "%d histogram samples only in the test result", len(t.histograms))
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].metric < found[j].metric })
+	seen := map[string]bool{}
+	for _, f := range found {
+		diffs = append(diffs, f.diff)
+		if !seen[f.kind] {
+			seen[f.kind] = true
+			kinds = append(kinds, f.kind)
+		}
+	}
+	sort.Strings(kinds)
+	return diffs, kinds
+}
+
+// seriesHistogramDiff returns the kind and description of the first difference between the
+// histogram samples of a series in both results, or an empty description if there is none.
+func seriesHistogramDiff(ref, test *histogramSeries, equal func(a, b float64) bool) (string, string) {
+	var ts []model.Time
+	for t := range ref.histograms {
+		ts = append(ts, t)
+	}
+	for t := range test.histograms {
+		if _, ok := ref.histograms[t]; !ok {
+			ts = append(ts, t)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+	for _, t := range ts {
+		rh, th := ref.histograms[t], test.histograms[t]
+		switch {
+		case rh == nil && ref.floats[t]:
+			return HistogramMismatchKind, fmt.Sprintf("at %v the reference result has a float sample, the test result a histogram sample", t)
+		case th == nil && test.floats[t]:
+			return HistogramMismatchKind, fmt.Sprintf("at %v the reference result has a histogram sample, the test result a float sample", t)
+		case rh == nil:
+			return HistogramMismatchMissing, fmt.Sprintf("at %v only the test result has a histogram sample", t)
+		case th == nil:
+			return HistogramMismatchMissing, fmt.Sprintf("at %v only the reference result has a histogram sample", t)
+		}
+		if kind, diff := histogramDiff(rh, th, equal); diff != "" {
+			return kind, fmt.Sprintf("at %v %s", t, diff)
+		}
+	}
+	return "", ""
+}
+
+// histogramDiff returns the kind and description of the first difference between two histogram
+// samples, or an empty description if they are equal. Buckets missing from one of them count as
+// empty, since targets may leave out empty buckets.
+func histogramDiff(ref, test *nativeHistogram, equal func(a, b float64) bool) (string, string) {
+	if !equal(ref.count, test.count) {
+		return HistogramMismatchCount, fmt.Sprintf("the count is %v in the reference and %v in the test result", ref.count, test.count)
+	}
+	if !equal(ref.sum, test.sum) {
+		return HistogramMismatchSum, fmt.Sprintf("the sum is %v in the reference and %v in the test result", ref.sum, test.sum)
+	}
+	if rs, ok := ref.schema(); ok {
+		if ts, ok := test.schema(); ok && rs != ts {
+			return HistogramMismatchSchema, fmt.Sprintf("the buckets have schema %d in the reference and %d in the test result", rs, ts)
+		}
+	}
+	i, j := 0, 0
+	for i < len(ref.buckets) || j < len(test.buckets) {
+		var rb, tb *histogramBucket
+		switch {
+		case j >= len(test.buckets):
+			rb = &ref.buckets[i]
+		case i >= len(ref.buckets):
+			tb = &test.buckets[j]
+		case ref.buckets[i].lower == test.buckets[j].lower && ref.buckets[i].upper == test.buckets[j].upper:
+			rb, tb = &ref.buckets[i], &test.buckets[j]
+		case ref.buckets[i].lower < test.buckets[j].lower ||
+			(ref.buckets[i].lower == test.buckets[j].lower && ref.buckets[i].upper < test.buckets[j].upper):
+			rb = &ref.buckets[i]
+		default:
+			tb = &test.buckets[j]
+		}
+		var desc string
+		switch {
+		case tb == nil:
+			i++
+			if !equal(rb.count, 0) {
+				desc = fmt.Sprintf("bucket %s has the count %v in the reference result, but is missing in the test result", rb, rb.count)
+			}
+		case rb == nil:
+			j++
+			if !equal(tb.count, 0) {
+				desc = fmt.Sprintf("bucket %s has the count %v in the test result, but is missing in the reference result", tb, tb.count)
+			}
+		default:
+			i++
+			j++
+			switch {
+			case !equal(rb.count, tb.count):
+				desc = fmt.Sprintf("bucket %s has the count %v in the reference and %v in the test result", rb, rb.count, tb.count)
+			case rb.boundaries != tb.boundaries:
+				desc = fmt.Sprintf("bucket %s is %s in the test result", rb, tb)
+			}
+		}
+		if desc != "" {
+			return HistogramMismatchBucket, desc
+		}
+	}
+	return "", ""
+}
+
+// nativeHistogramDiff formats the differences found by diffNativeHistograms.
+func nativeHistogramDiff(diffs []string) string {
+	total := len(diffs)
+	if total > maxHistogramDiffs {
+		diffs = append(diffs[:maxHistogramDiffs:maxHistogramDiffs], fmt.Sprintf("... and %d more", total-maxHistogramDiffs))
+	}
+	return fmt.Sprintf("native histogram samples differ in %d series:\n%s", total, strings.Join(diffs, "\n"))
+}
+
+// compareNativeHistograms compares the native histogram samples of the results of a test case
+// that expects them. The decoded results lack the histogram samples, so that they only compare
+// the float samples afterwards. It returns a result with a diff if the histogram samples differ.
+func (c *Comparer) compareNativeHistograms(tc *TestCase, ref, test *QueryResult, fraction, margin float64) *Result {
+	res := &Result{TestCase: tc}
+	var unread []string
+	if !ref.histogramsRead {
+		unread = append(unread, "reference")
+	}
+	if !test.histogramsRead {
+		unread = append(unread, "test")
+	}
+	if len(unread) > 0 {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("the native histogram samples were not compared, since the %s result was not read from an HTTP response", strings.Join(unread, " and ")))
+		return res
+	}
+	refSeries, testSeries := ref.nativeHistograms, test.nativeHistograms
+	if tweaks := c.labelTweaks(tc); len(tweaks) > 0 {
+		refSeries = tweakHistogramSeries(refSeries, tweaks, "reference")
+		testSeries = tweakHistogramSeries(testSeries, tweaks, "test")
+	}
+	res.NativeHistogramSamples = histogramSampleCount(refSeries) + histogramSampleCount(testSeries)
+	if res.NativeHistogramSamples == 0 {
+		res.Warnings = append(res.Warnings, "the test case expects native histograms, but neither result has native histogram samples")
+		return res
+	}
+	if diffs, kinds := diffNativeHistograms(refSeries, testSeries, floatsEqual(fraction, margin)); len(diffs) > 0 {
+		res.Diff = nativeHistogramDiff(diffs)
+		res.HistogramMismatches = kinds
+	}
+	return res
+}
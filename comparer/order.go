@@ -0,0 +1,39 @@
+package comparer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// checkSampleOrder returns the series of a range query result whose samples are not in strictly
+// ascending timestamp order, prefixed with the given side. If sortSamples is set, the samples of
+// these series are sorted by timestamp in place.
+func checkSampleOrder(m model.Matrix, side string, sortSamples bool) []string {
+	var series []string
+	for _, ss := range m {
+		inOrder := true
+		for i := 1; i < len(ss.Values); i++ {
+			if ss.Values[i].Timestamp <= ss.Values[i-1].Timestamp {
+				inOrder = false
+				break
+			}
+		}
+		if inOrder {
+			continue
+		}
+		series = append(series, fmt.Sprintf("%s: %s", side, ss.Metric))
+		if sortSamples {
+			vals := ss.Values
+			sort.SliceStable(vals, func(i, j int) bool { return vals[i].Timestamp < vals[j].Timestamp })
+		}
+	}
+	return series
+}
+
+// outOfOrderDiff describes out-of-order samples that prevented a value comparison.
+func outOfOrderDiff(series []string) string {
+	return fmt.Sprintf("samples out of timestamp order in %d series, not comparing values (set out_of_order_samples: %s to compare them anyway)", len(series), config.OutOfOrderPolicySort)
+}
@@ -0,0 +1,171 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// parityTimeParams are the query parameters holding timestamps, which configured time offsets shift.
+var parityTimeParams = map[string]bool{"time": true, "start": true, "end": true}
+
+// RequestParity records the query parameters that were sent to the reference and test targets for
+// a test case, after all rewriting by the targets and their transports.
+type RequestParity struct {
+	RefPath    string     `json:"refPath"`
+	TestPath   string     `json:"testPath"`
+	RefParams  url.Values `json:"refParams"`
+	TestParams url.Values `json:"testParams"`
+	// Drift lists the differences that the configured path prefixes and time offsets do not explain.
+	Drift []string `json:"drift,omitempty"`
+}
+
+type requestCaptureKey struct{}
+
+// requestCapture holds the path and parameters of the last query request made through a capturing
+// RoundTripper, and the time offset applied to its timestamps.
+type requestCapture struct {
+	mtx      sync.Mutex
+	captured bool
+	path     string
+	params   url.Values
+	offset   time.Duration
+}
+
+// withRequestCapture returns a context that makes capturing RoundTrippers record the query
+// parameters of requests made with it.
+func withRequestCapture(ctx context.Context) (context.Context, *requestCapture) {
+	rc := &requestCapture{}
+	return context.WithValue(ctx, requestCaptureKey{}, rc), rc
+}
+
+// setRequestTimeOffset records that the timestamps of the queries run with the context are shifted
+// by the given offset, if the context captures requests.
+func setRequestTimeOffset(ctx context.Context, offset time.Duration) {
+	if rc, ok := ctx.Value(requestCaptureKey{}).(*requestCapture); ok {
+		rc.mtx.Lock()
+		rc.offset = offset
+		rc.mtx.Unlock()
+	}
+}
+
+// record captures the path and the URL and form parameters of a request. The body of form-encoded
+// requests is read from a copy, so that the request is not modified.
+func (rc *requestCapture) record(req *http.Request) {
+	params := url.Values{}
+	for k, vs := range req.URL.Query() {
+		params[k] = append(params[k], vs...)
+	}
+	if req.GetBody != nil && strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if body, err := req.GetBody(); err == nil {
+			buf, err := ioutil.ReadAll(body)
+			body.Close()
+			if form, perr := url.ParseQuery(string(buf)); err == nil && perr == nil {
+				for k, vs := range form {
+					params[k] = append(params[k], vs...)
+				}
+			}
+		}
+	}
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.captured = true
+	rc.path = req.URL.Path
+	rc.params = params
+}
+
+// checkRequestParity compares the captured requests of both targets. It returns nil if either
+// target did not send a request, e.g. because its response came from a fixture or cache. The
+// queries are not compared if renamed is set, since the rename query tweaks rewrote the test query.
+func checkRequestParity(ref, test *requestCapture, renamed bool) *RequestParity {
+	ref.mtx.Lock()
+	defer ref.mtx.Unlock()
+	test.mtx.Lock()
+	defer test.mtx.Unlock()
+	if !ref.captured || !test.captured {
+		return nil
+	}
+	p := &RequestParity{RefPath: ref.path, TestPath: test.path, RefParams: ref.params, TestParams: test.params}
+	// Path prefixes are configured per target, but both targets must serve the same endpoint.
+	if path.Base(ref.path) != path.Base(test.path) {
+		p.Drift = append(p.Drift, fmt.Sprintf("endpoint differs: reference %s, test %s", path.Base(ref.path), path.Base(test.path)))
+	}
+
+	keys := map[string]bool{}
+	for k := range ref.params {
+		keys[k] = true
+	}
+	for k := range test.params {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		if renamed && k == "query" {
+			continue
+		}
+		rv, tv := ref.params[k], test.params[k]
+		if sameParam(k, rv, tv, ref.offset, test.offset) {
+			continue
+		}
+		p.Drift = append(p.Drift, fmt.Sprintf("parameter %q differs: reference %q, test %q", k, rv, tv))
+	}
+	return p
+}
+
+// sameParam returns true if the values of a query parameter match, once the time offsets of their
+// targets are removed from timestamps.
+func sameParam(key string, ref, test []string, refOffset, testOffset time.Duration) bool {
+	if len(ref) != len(test) {
+		return false
+	}
+	for i := range ref {
+		if ref[i] == test[i] {
+			continue
+		}
+		switch {
+		case parityTimeParams[key]:
+			rt, rerr := strconv.ParseFloat(ref[i], 64)
+			tt, terr := strconv.ParseFloat(test[i], 64)
+			if rerr != nil || terr != nil {
+				return false
+			}
+			// Timestamps have millisecond precision.
+			if math.Abs((rt-refOffset.Seconds())-(tt-testOffset.Seconds())) > 0.001 {
+				return false
+			}
+		case key == "step":
+			rs, rok := parseStep(ref[i])
+			ts, tok := parseStep(test[i])
+			if !rok || !tok || rs != ts {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseStep parses a step given in seconds or as a duration.
+func parseStep(s string) (time.Duration, bool) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), true
+	}
+	d, err := model.ParseDuration(s)
+	return time.Duration(d), err == nil
+}
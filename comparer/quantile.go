@@ -0,0 +1,54 @@
+package comparer
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+)
+
+// quantileLabelPrecision is the number of significant digits that quantile label values are
+// formatted with, so that values which only differ by float rounding are canonicalized identically.
+const quantileLabelPrecision = 12
+
+// canonicalizeQuantileLabels rewrites the "quantile" label of all series in the given vector or
+// matrix to a canonical float formatting (e.g. "0.90" to "0.9"). Label values that cannot be parsed
+// as floats are left untouched. It returns a description of each distinct rewrite that was applied.
+func canonicalizeQuantileLabels(v model.Value, side string) []string {
+	var metrics []model.Metric
+	switch v := v.(type) {
+	case model.Vector:
+		for _, s := range v {
+			metrics = append(metrics, s.Metric)
+		}
+	case model.Matrix:
+		for _, s := range v {
+			metrics = append(metrics, s.Metric)
+		}
+	}
+
+	rewrites := map[string]string{}
+	for _, m := range metrics {
+		orig, ok := m[model.QuantileLabel]
+		if !ok {
+			continue
+		}
+		f, err := strconv.ParseFloat(string(orig), 64)
+		if err != nil {
+			continue
+		}
+		canonical := model.LabelValue(strconv.FormatFloat(f, 'g', quantileLabelPrecision, 64))
+		if canonical != orig {
+			m[model.QuantileLabel] = canonical
+			rewrites[string(orig)] = string(canonical)
+		}
+	}
+
+	notes := make([]string, 0, len(rewrites))
+	for orig, canonical := range rewrites {
+		notes = append(notes, fmt.Sprintf("canonicalized %s label value %q to %q in %s results", model.QuantileLabel, orig, canonical, side))
+	}
+	sort.Strings(notes)
+	return notes
+}
@@ -0,0 +1,99 @@
+package comparer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// rateLimiter spaces out events evenly so that at most a given number happen per second. It is
+// safe for concurrent use, so that concurrent comparisons share the rate of a target.
+type rateLimiter struct {
+	interval time.Duration
+
+	mtx  sync.Mutex
+	next time.Time
+}
+
+// reserve reserves the next event and returns how long to wait until it is allowed.
+func (l *rateLimiter) reserve() time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	return at.Sub(now)
+}
+
+// rateLimitedAPI wraps a PromAPI and limits the rate of the queries sent to it.
+type rateLimitedAPI struct {
+	api     PromAPI
+	limiter *rateLimiter
+	waits   *WaitBudget
+	target  string
+}
+
+// NewRateLimitedAPI returns a PromAPI that sends at most maxQueriesPerSecond queries per second to
+// the given API, delaying queries as needed. A non-positive rate does not limit queries. The delays
+// are accounted to the target in the given budget, which may be nil.
+func NewRateLimitedAPI(api PromAPI, maxQueriesPerSecond float64, waits *WaitBudget, target string) PromAPI {
+	if maxQueriesPerSecond <= 0 {
+		return api
+	}
+	return &rateLimitedAPI{
+		api:     api,
+		limiter: &rateLimiter{interval: time.Duration(float64(time.Second) / maxQueriesPerSecond)},
+		waits:   waits,
+		target:  target,
+	}
+}
+
+// Query implements PromAPI.
+func (r *rateLimitedAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error) {
+	if err := r.wait(ctx); err != nil {
+		return nil, nil, err
+	}
+	return r.api.Query(ctx, query, ts)
+}
+
+// QueryRange implements PromAPI.
+func (r *rateLimitedAPI) QueryRange(ctx context.Context, query string, rng v1.Range) (model.Value, v1.Warnings, error) {
+	if err := r.wait(ctx); err != nil {
+		return nil, nil, err
+	}
+	return r.api.QueryRange(ctx, query, rng)
+}
+
+// wait waits for the limiter and adds the time spent waiting to the context's rate limit wait, if any.
+func (r *rateLimitedAPI) wait(ctx context.Context) error {
+	start := time.Now()
+	err := r.waits.sleep(ctx, r.target, WaitCauseRateLimit, r.limiter.reserve())
+	if w, ok := ctx.Value(rateLimitWaitKey{}).(*int64); ok {
+		atomic.AddInt64(w, int64(time.Since(start)))
+	}
+	return err
+}
+
+type rateLimitWaitKey struct{}
+
+// withRateLimitWait returns a context that makes rate-limited APIs add up the time that queries run
+// with it waited for the rate limit, so that it can be excluded from their durations.
+func withRateLimitWait(ctx context.Context) (context.Context, *int64) {
+	w := new(int64)
+	return context.WithValue(ctx, rateLimitWaitKey{}, w), w
+}
+
+// rateLimitWait returns the time that the queries run with the context have waited for rate limits so far.
+func rateLimitWait(ctx context.Context) time.Duration {
+	if w, ok := ctx.Value(rateLimitWaitKey{}).(*int64); ok {
+		return time.Duration(atomic.LoadInt64(w))
+	}
+	return 0
+}
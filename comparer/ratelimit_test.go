@@ -0,0 +1,109 @@
+package comparer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// countingAPI is a PromAPI that is safe for concurrent use and counts the queries it answers.
+type countingAPI struct {
+	mtx   sync.Mutex
+	calls int
+}
+
+func (a *countingAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.calls++
+	return fakeVector(1), nil, nil
+}
+
+func (a *countingAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, v1.Warnings, error) {
+	return a.Query(ctx, query, r.End)
+}
+
+func TestRateLimitedAPI(t *testing.T) {
+	const (
+		queries = 20
+		rate    = 100
+		workers = 4
+	)
+	api := &countingAPI{}
+	waits := NewWaitBudget(0)
+	limited := NewRateLimitedAPI(api, rate, waits, "test")
+
+	// The workers share the rate of the target.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < queries/workers; i++ {
+				var err error
+				if i%2 == 0 {
+					_, _, err = limited.Query(context.Background(), "demo", time.Unix(1, 0))
+				} else {
+					_, _, err = limited.QueryRange(context.Background(), "demo", v1.Range{End: time.Unix(1, 0)})
+				}
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if api.calls != queries {
+		t.Errorf("expected %d queries, got %d", queries, api.calls)
+	}
+	// The first query is sent right away, each of the others one interval after the previous one.
+	if want := time.Duration(queries-1) * time.Second / rate; elapsed < want {
+		t.Errorf("expected %d queries at %d per second to take at least %v, took %v", queries, rate, want, elapsed)
+	}
+	ws := waits.Waits()
+	if len(ws) != 1 || ws[0].Target != "test" || ws[0].Cause != WaitCauseRateLimit || ws[0].Count == 0 {
+		t.Errorf("expected the rate limit waits of the test target to be accounted, got %+v", ws)
+	}
+}
+
+func TestRateLimitedAPIUnlimited(t *testing.T) {
+	api := &countingAPI{}
+	if got := NewRateLimitedAPI(api, 0, nil, "test"); got != PromAPI(api) {
+		t.Errorf("expected a rate of 0 not to limit the API, got %T", got)
+	}
+}
+
+func TestRateLimitedAPICanceled(t *testing.T) {
+	limited := NewRateLimitedAPI(&countingAPI{}, 0.1, nil, "test")
+	if _, _, err := limited.Query(context.Background(), "demo", time.Unix(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// The next query would only be allowed after 10 seconds.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := limited.Query(ctx, "demo", time.Unix(1, 0)); err != context.DeadlineExceeded {
+		t.Errorf("expected waiting for the rate limit to end with the context, got %v", err)
+	}
+}
+
+func TestCompareExcludesRateLimitWait(t *testing.T) {
+	test := NewAPITarget(NewRateLimitedAPI(&countingAPI{}, 20, nil, "test"))
+	c := New(&fakeTarget{value: fakeVector(1)}, test, nil, Options{})
+	for i := 0; i < 3; i++ {
+		res, err := c.Compare(instantTestCase("demo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Waiting 50ms for the rate limit does not count towards the duration of the query.
+		if res.TestDuration > 25*time.Millisecond {
+			t.Errorf("expected the query duration to exclude the wait for the rate limit, got %v", res.TestDuration)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package comparer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// A RecordingTarget is a QueryTarget that records the responses of another target as Fixtures, so
+// that a fixture target can replay them to compare the results again without querying the target.
+type RecordingTarget struct {
+	next QueryTarget
+
+	mtx      sync.Mutex
+	fixtures map[fixtureKey]*Fixture
+}
+
+// NewRecordingTarget returns a RecordingTarget recording the responses of next.
+func NewRecordingTarget(next QueryTarget) *RecordingTarget {
+	return &RecordingTarget{next: next, fixtures: map[fixtureKey]*Fixture{}}
+}
+
+// InstantQuery implements QueryTarget.
+func (t *RecordingTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*QueryResult, error) {
+	res, err := t.next.InstantQuery(ctx, query, ts)
+	t.record(ctx, query, config.QueryTypeInstant, res, err)
+	return res, err
+}
+
+// RangeQuery implements QueryTarget.
+func (t *RecordingTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*QueryResult, error) {
+	res, err := t.next.RangeQuery(ctx, query, r)
+	t.record(ctx, query, config.QueryTypeRange, res, err)
+	return res, err
+}
+
+// record stores a response. Errors caused by the query's context being canceled or timing out are
+// not recorded, since they do not tell how the target evaluates the query.
+func (t *RecordingTarget) record(ctx context.Context, query string, typ config.QueryType, res *QueryResult, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	f := &Fixture{Query: query, Type: typ}
+	if err != nil {
+		f.Error = err.Error()
+	} else {
+		raw, merr := json.Marshal(res.Value)
+		if merr != nil {
+			return
+		}
+		f.Data.ResultType = res.Value.Type()
+		f.Data.Result = raw
+		f.Warnings = res.Warnings
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.fixtures[fixtureKey{query: query, typ: typ}] = f
+}
+
+// WriteFixtures writes the recorded responses, sorted by query and query type, to a fixture file.
+// Since fixtures are keyed by query and query type, only the last response is kept for queries that
+// ran at several evaluation times.
+func (t *RecordingTarget) WriteFixtures(filename string) error {
+	t.mtx.Lock()
+	fixtures := make([]*Fixture, 0, len(t.fixtures))
+	for _, f := range t.fixtures {
+		fixtures = append(fixtures, f)
+	}
+	t.mtx.Unlock()
+	sort.Slice(fixtures, func(i, j int) bool {
+		if fixtures[i].Query != fixtures[j].Query {
+			return fixtures[i].Query < fixtures[j].Query
+		}
+		return fixtures[i].Type < fixtures[j].Type
+	})
+	buf, err := json.MarshalIndent(fixtures, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(buf, '\n'), 0644)
+}
@@ -0,0 +1,57 @@
+package comparer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+var identifierRegexp = regexp.MustCompile(`[a-zA-Z_:][a-zA-Z0-9_:]*`)
+
+// compareOptionsFor returns the comparison options to use for a query, along with the
+// recording rule that applies to it, if any.
+func (c *Comparer) compareOptionsFor(query string) (cmp.Options, *config.RecordingRule) {
+	for i, rr := range c.opts.RecordingRules {
+		if referencesMetricPrefix(query, rr.MetricPrefixes) {
+			return c.recordingRuleOptions[i], rr
+		}
+	}
+	return c.compareOptions, nil
+}
+
+// referencesMetricPrefix returns true if any identifier in the query starts with one of the prefixes.
+func referencesMetricPrefix(query string, prefixes []string) bool {
+	for _, ident := range identifierRegexp.FindAllString(query, -1) {
+		for _, p := range prefixes {
+			if strings.HasPrefix(ident, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyFreshnessGrace drops the samples within the grace period before the end of the query
+// range from both results, since recorded results on the reference may not have caught up yet.
+func applyFreshnessGrace(rr *config.RecordingRule, end time.Time, refResult, testResult model.Matrix) {
+	if rr.FreshnessGraceSeconds <= 0 {
+		return
+	}
+	cutoff := model.TimeFromUnixNano(end.Add(-time.Duration(rr.FreshnessGraceSeconds * float64(time.Second))).UnixNano())
+	for _, m := range []model.Matrix{refResult, testResult} {
+		for _, ss := range m {
+			for len(ss.Values) > 0 && ss.Values[len(ss.Values)-1].Timestamp > cutoff {
+				ss.Values = ss.Values[:len(ss.Values)-1]
+			}
+		}
+	}
+}
+
+func recordingRuleNote(rr *config.RecordingRule) string {
+	return fmt.Sprintf("compared as recording-rule-backed (metric prefixes %s)", strings.Join(rr.MetricPrefixes, ", "))
+}
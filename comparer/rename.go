@@ -0,0 +1,25 @@
+package comparer
+
+import "github.com/promlabs/promql-compliance-tester/config"
+
+// testQuery returns the query to send to the test target for a test case. Test cases expanded
+// with the query tweaks already carry their rewritten query, others are rewritten here, so that
+// the rename query tweaks apply to all test cases alike.
+func (c *Comparer) testQuery(tc *TestCase) string {
+	if tc.TestQuery != "" {
+		return tc.TestQuery
+	}
+	return config.RenameTestQuery(tc.Query, c.queryTweaks)
+}
+
+// testTestCase returns the test case to run against the test target, whose query is the one
+// returned by testQuery.
+func (c *Comparer) testTestCase(tc *TestCase) *TestCase {
+	q := c.testQuery(tc)
+	if q == tc.Query {
+		return tc
+	}
+	testTC := *tc
+	testTC.Query = q
+	return &testTC
+}
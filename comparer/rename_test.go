@@ -0,0 +1,73 @@
+package comparer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// queryRecordingTarget is a fakeTarget that records the queries it answers.
+type queryRecordingTarget struct {
+	fakeTarget
+	queries []string
+}
+
+func (t *queryRecordingTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*QueryResult, error) {
+	t.queries = append(t.queries, query)
+	return t.respond(ctx)
+}
+
+func (t *queryRecordingTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*QueryResult, error) {
+	t.queries = append(t.queries, query)
+	return t.respond(ctx)
+}
+
+func TestCompareRenamedQueries(t *testing.T) {
+	tweaks := []*config.QueryTweak{{Rename: map[string]string{
+		`\bnode_cpu_seconds_total\b`: "node_cpu_seconds",
+		`\bnode_(\w+)_bytes_total\b`: "node_${1}_bytes",
+	}}}
+	for _, tc := range []struct {
+		name, query, want string
+	}{
+		{name: "simple rename", query: `rate(node_cpu_seconds_total{mode="idle"}[5m])`, want: `rate(node_cpu_seconds{mode="idle"}[5m])`},
+		{name: "rename with capture groups", query: "rate(node_network_receive_bytes_total[5m]) + rate(node_disk_read_bytes_total[5m])", want: "rate(node_network_receive_bytes[5m]) + rate(node_disk_read_bytes[5m])"},
+		{name: "no match", query: "rate(node_cpu_seconds_total_extra[5m])", want: "rate(node_cpu_seconds_total_extra[5m])"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Test cases expanded with the query tweaks carry their rewritten query, others are
+			// rewritten by the comparer.
+			expanded := instantTestCase(tc.query)
+			if tc.want != tc.query {
+				expanded.TestQuery = tc.want
+			}
+			for _, testCase := range []*TestCase{instantTestCase(tc.query), expanded} {
+				ref := &queryRecordingTarget{fakeTarget: fakeTarget{value: fakeVector(1)}}
+				test := &queryRecordingTarget{fakeTarget: fakeTarget{value: fakeVector(1)}}
+				res, err := New(ref, test, tweaks, Options{}).Compare(testCase)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(ref.queries) != 1 || ref.queries[0] != tc.query {
+					t.Errorf("expected the reference query %q to be untouched, got %q", tc.query, ref.queries)
+				}
+				if len(test.queries) != 1 || test.queries[0] != tc.want {
+					t.Errorf("expected the test query %q, got %q", tc.want, test.queries)
+				}
+				wantTestQuery := tc.want
+				if tc.want == tc.query {
+					wantTestQuery = ""
+				}
+				if res.TestQuery != wantTestQuery {
+					t.Errorf("expected the result to record the test query %q, got %q", wantTestQuery, res.TestQuery)
+				}
+				if !res.Success() {
+					t.Errorf("expected the renamed query to pass, got diff %q", res.Diff)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// A RequirementStatus is the outcome of checking a metric requirement against the reference target.
+type RequirementStatus struct {
+	Metric    string            `json:"metric"`
+	Type      config.MetricType `json:"type,omitempty"`
+	Series    float64           `json:"series"`
+	MinSeries int               `json:"minSeries"`
+	// MissingLabels lists the required labels that some of the series lack.
+	MissingLabels []string `json:"missingLabels,omitempty"`
+	// Problem describes why the requirement is not met, and is empty if it is.
+	Problem string `json:"problem,omitempty"`
+}
+
+// A RequirementsReport holds the outcome of checking declared requirements against the reference target.
+type RequirementsReport struct {
+	Source    string               `json:"source"`
+	Dataset   string               `json:"dataset,omitempty"`
+	Start     time.Time            `json:"start"`
+	End       time.Time            `json:"end"`
+	Metrics   []*RequirementStatus `json:"metrics"`
+	Satisfied bool                 `json:"satisfied"`
+}
+
+// Missing returns the names of the metrics whose requirements are not met.
+func (r *RequirementsReport) Missing() []string {
+	var names []string
+	for _, m := range r.Metrics {
+		if m.Problem != "" {
+			names = append(names, m.Metric)
+		}
+	}
+	return names
+}
+
+// CheckRequirements checks that the reference target has the metrics that req declares, with
+// samples in [start, end] and at least their minimal numbers of series, and that their series
+// have the required labels. Histograms must have _bucket series with an le label, and summaries
+// series with a quantile label.
+func (c *Comparer) CheckRequirements(ctx context.Context, req *config.Requirements, start, end time.Time) (*RequirementsReport, error) {
+	report := &RequirementsReport{Source: req.Source, Dataset: req.Dataset, Start: start, End: end, Metrics: []*RequirementStatus{}, Satisfied: true}
+	window := model.Duration(end.Sub(start))
+	countSeries := func(sel string) (float64, error) {
+		return c.count(ctx, c.refTarget, fmt.Sprintf("count(count_over_time(%s[%s]))", sel, window), end)
+	}
+	for _, m := range req.Metrics {
+		s := &RequirementStatus{Metric: m.Name, Type: m.Type, MinSeries: m.MinSeries}
+		if s.MinSeries == 0 {
+			s.MinSeries = 1
+		}
+		matchers := requirementMatchers(m)
+		var err error
+		if s.Series, err = countSeries("{" + strings.Join(matchers, ", ") + "}"); err != nil {
+			return nil, errors.Wrapf(err, "counting the series of %s", m.Name)
+		}
+		switch {
+		case s.Series == 0 && (m.Type == config.MetricTypeHistogram || m.Type == config.MetricTypeSummary):
+			related, err := countSeries(fmt.Sprintf(`{__name__=~"%s(_bucket|_count|_sum)?"}`, m.Name))
+			if err != nil {
+				return nil, errors.Wrapf(err, "counting the series of %s", m.Name)
+			}
+			if related > 0 {
+				s.Problem = fmt.Sprintf("has no series of a %s", m.Type)
+			} else {
+				s.Problem = "is missing"
+			}
+		case s.Series == 0:
+			s.Problem = "is missing"
+		case s.Series < float64(s.MinSeries):
+			s.Problem = fmt.Sprintf("has %v series, fewer than the required %d", s.Series, s.MinSeries)
+		}
+		if s.Series > 0 {
+			for _, l := range m.Labels {
+				n, err := countSeries("{" + strings.Join(append(matchers, l+`!=""`), ", ") + "}")
+				if err != nil {
+					return nil, errors.Wrapf(err, "counting the series of %s with the label %s", m.Name, l)
+				}
+				if n < s.Series {
+					s.MissingLabels = append(s.MissingLabels, l)
+				}
+			}
+			if len(s.MissingLabels) > 0 && s.Problem == "" {
+				s.Problem = fmt.Sprintf("has series without the labels %s", strings.Join(s.MissingLabels, ", "))
+			}
+		}
+		if s.Problem != "" {
+			report.Satisfied = false
+		}
+		report.Metrics = append(report.Metrics, s)
+	}
+	return report, nil
+}
+
+// requirementMatchers returns the label matchers of the series that a metric requirement looks for.
+func requirementMatchers(m *config.MetricRequirement) []string {
+	switch m.Type {
+	case config.MetricTypeHistogram:
+		return []string{fmt.Sprintf("__name__=%q", m.Name+"_bucket"), `le!=""`}
+	case config.MetricTypeSummary:
+		return []string{fmt.Sprintf("__name__=%q", m.Name), `quantile!=""`}
+	default:
+		return []string{fmt.Sprintf("__name__=%q", m.Name)}
+	}
+}
@@ -0,0 +1,101 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type headerCaptureKey struct{}
+
+// headerCapture holds the selected headers of the last response read through a capturing
+// RoundTripper.
+type headerCapture struct {
+	names []string
+
+	mtx     sync.Mutex
+	headers map[string]string
+}
+
+// withHeaderCapture returns a context that makes capturing RoundTrippers record the named headers
+// of the responses to requests made with it.
+func withHeaderCapture(ctx context.Context, names []string) (context.Context, *headerCapture) {
+	hc := &headerCapture{names: names}
+	return context.WithValue(ctx, headerCaptureKey{}, hc), hc
+}
+
+// record captures the selected headers of a response. Headers with several values are joined by
+// commas. Only the headers of the final attempt of retried queries are kept.
+func (hc *headerCapture) record(h http.Header) {
+	headers := map[string]string{}
+	for _, name := range hc.names {
+		if vs := h[http.CanonicalHeaderKey(name)]; len(vs) > 0 {
+			headers[http.CanonicalHeaderKey(name)] = strings.Join(vs, ", ")
+		}
+	}
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+	hc.headers = headers
+}
+
+func (hc *headerCapture) get() map[string]string {
+	hc.mtx.Lock()
+	defer hc.mtx.Unlock()
+	if len(hc.headers) == 0 {
+		return nil
+	}
+	return hc.headers
+}
+
+// capturedHeaders returns the names of the response headers recorded with the results, which
+// include the headers that the cache hit patterns apply to.
+func (c *Comparer) capturedHeaders() []string {
+	names := append([]string(nil), c.opts.ResponseHeaders...)
+	for name := range c.opts.CacheHitPatterns {
+		names = append(names, name)
+	}
+	return names
+}
+
+// setResponseHeaders records the captured response headers of the queries behind a result, if they
+// succeeded, and warns if the test response shows evidence of being served from a cache.
+func (c *Comparer) setResponseHeaders(res *Result, ref, test *QueryResult) {
+	if res == nil {
+		return
+	}
+	if ref != nil {
+		res.RefResponseHeaders = ref.ResponseHeaders
+	}
+	if test != nil {
+		res.TestResponseHeaders = test.ResponseHeaders
+	}
+	if res.CacheHit = cacheHitEvidence(res.TestResponseHeaders, c.opts.CacheHitPatterns); res.CacheHit != "" {
+		res.Warnings = append(res.Warnings, "the test response may have been served from a cache: "+res.CacheHit)
+	}
+}
+
+// cacheHitEvidence returns the headers that show a response was served from a cache, i.e. a
+// positive Age header or the headers whose values match their cache hit patterns, or an empty
+// string if there are none.
+func cacheHitEvidence(headers map[string]string, patterns map[string]*regexp.Regexp) string {
+	var evidence []string
+	if age, err := strconv.Atoi(strings.TrimSpace(headers["Age"])); err == nil && age > 0 {
+		evidence = append(evidence, fmt.Sprintf("Age: %d", age))
+	}
+	names := make([]string, 0, len(patterns))
+	for name := range patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if v, ok := headers[http.CanonicalHeaderKey(name)]; ok && patterns[name].MatchString(v) {
+			evidence = append(evidence, fmt.Sprintf("%s: %s", http.CanonicalHeaderKey(name), v))
+		}
+	}
+	return strings.Join(evidence, ", ")
+}
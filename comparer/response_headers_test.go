@@ -0,0 +1,114 @@
+package comparer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// headerTarget returns a target for a server that answers all queries with a fixed vector and the
+// given response headers.
+func headerTarget(t *testing.T, headers map[string]string) (QueryTarget, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"demo"},"value":[1,"1"]}]}}`)
+	}))
+	client, err := api.NewClient(api.Config{Address: srv.URL, RoundTripper: NewCapturingRoundTripper(http.DefaultTransport)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAPITarget(v1.NewAPI(client)), srv.Close
+}
+
+func TestCacheHitEvidence(t *testing.T) {
+	patterns := map[string]*regexp.Regexp{"X-Cache": regexp.MustCompile(`(?i)\bhit\b`), "via": regexp.MustCompile(`varnish`)}
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{name: "no headers"},
+		{name: "fresh response", headers: map[string]string{"Age": "0", "X-Cache": "MISS"}},
+		{name: "invalid age", headers: map[string]string{"Age": "soon"}},
+		{name: "positive age", headers: map[string]string{"Age": " 120 "}, want: "Age: 120"},
+		{name: "cache hit header", headers: map[string]string{"X-Cache": "Hit from cloudfront"}, want: "X-Cache: Hit from cloudfront"},
+		{name: "pattern without word boundary", headers: map[string]string{"X-Cache": "WHITELISTED"}},
+		{name: "all evidence", headers: map[string]string{"Age": "3", "Via": "1.1 varnish", "X-Cache": "HIT"}, want: "Age: 3, X-Cache: HIT, Via: 1.1 varnish"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := cacheHitEvidence(tc.headers, patterns); got != tc.want {
+				t.Errorf("expected the evidence %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCompareResponseHeaders(t *testing.T) {
+	opts := Options{
+		ResponseHeaders:  []string{"Age", "X-Cache", "Via", "Server"},
+		CacheHitPatterns: map[string]*regexp.Regexp{"X-Cache": regexp.MustCompile(`(?i)\bhit\b`)},
+	}
+	ref, closeRef := headerTarget(t, map[string]string{"Server": "prometheus", "X-Request-Id": "1"})
+	defer closeRef()
+	for _, tc := range []struct {
+		name        string
+		headers     map[string]string
+		wantHeaders map[string]string
+		wantHit     string
+	}{
+		{
+			name:        "not cached",
+			headers:     map[string]string{"Server": "greptime", "X-Cache": "MISS", "Age": "0"},
+			wantHeaders: map[string]string{"Server": "greptime", "X-Cache": "MISS", "Age": "0"},
+		},
+		{
+			name:        "stale proxy response",
+			headers:     map[string]string{"Age": "42", "Via": "1.1 nginx"},
+			wantHeaders: map[string]string{"Age": "42", "Via": "1.1 nginx"},
+			wantHit:     "Age: 42",
+		},
+		{
+			name:        "cache hit header",
+			headers:     map[string]string{"X-Cache": "HIT", "X-Request-Id": "2"},
+			wantHeaders: map[string]string{"X-Cache": "HIT"},
+			wantHit:     "X-Cache: HIT",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			test, closeTest := headerTarget(t, tc.headers)
+			defer closeTest()
+			res, err := New(ref, test, nil, opts).Compare(instantTestCase("demo"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Only the configured headers are recorded.
+			if want := map[string]string{"Server": "prometheus"}; !reflect.DeepEqual(res.RefResponseHeaders, want) {
+				t.Errorf("expected the reference headers %v, got %v", want, res.RefResponseHeaders)
+			}
+			if !reflect.DeepEqual(res.TestResponseHeaders, tc.wantHeaders) {
+				t.Errorf("expected the test headers %v, got %v", tc.wantHeaders, res.TestResponseHeaders)
+			}
+			if res.CacheHit != tc.wantHit {
+				t.Errorf("expected the cache hit %q, got %q", tc.wantHit, res.CacheHit)
+			}
+			warned := strings.Contains(strings.Join(res.Warnings, "\n"), "may have been served from a cache")
+			if warned != (tc.wantHit != "") {
+				t.Errorf("expected a cache warning %v, got the warnings %q", tc.wantHit != "", res.Warnings)
+			}
+			// A cached response alone does not fail the test case.
+			if !res.Success() {
+				t.Errorf("expected the test case to pass, got %+v", res)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package comparer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/prometheus/common/model"
+)
+
+// maxEnvelopeBytes bounds the leading bytes of a response body that are kept to check its declared
+// result type. They normally include the result type and the first element of the result.
+const maxEnvelopeBytes = 64 << 10
+
+// Result element shapes, as found by peekEnvelope.
+const (
+	shapeUnknown = ""
+	shapeSample  = "series with a single sample"
+	shapeSamples = "series with a list of samples"
+	shapePair    = "a timestamp and value pair"
+)
+
+// expectedShapes maps result types to the shape of their result elements.
+var expectedShapes = map[string]string{
+	model.ValVector.String(): shapeSample,
+	model.ValMatrix.String(): shapeSamples,
+	model.ValScalar.String(): shapePair,
+	model.ValString.String(): shapePair,
+}
+
+type envelopeCaptureKey struct{}
+
+// withEnvelopeCapture returns a context that makes capturing RoundTrippers record the start of the
+// response bodies of requests made with it.
+func withEnvelopeCapture(ctx context.Context) (context.Context, *rawCapture) {
+	rc := &rawCapture{limit: maxEnvelopeBytes}
+	return context.WithValue(ctx, envelopeCaptureKey{}, rc), rc
+}
+
+// checkResultType compares the result type that a raw query response body declares, and the shape
+// of its first result element, with the decoded result. It returns a description of the mismatch,
+// or an empty string if they match or the body does not tell.
+func checkResultType(body []byte, decoded model.Value) string {
+	if len(body) == 0 || decoded == nil {
+		return ""
+	}
+	declared, shape := peekEnvelope(body)
+	if declared == "" {
+		return ""
+	}
+	if declared != decoded.Type().String() {
+		return fmt.Sprintf("declared resultType %q, but the result was decoded as a %s", declared, decoded.Type())
+	}
+	if want, ok := expectedShapes[declared]; ok && shape != shapeUnknown && shape != want {
+		return fmt.Sprintf("declared resultType %q, but the result holds %s instead of %s", declared, shape, want)
+	}
+	return ""
+}
+
+// peekEnvelope returns the result type declared by a raw query response body and the shape of the
+// first element of its result, without decoding the rest of the result. The body may be truncated
+// after the first element. Either return value is empty if the body does not contain it.
+func peekEnvelope(body []byte) (resultType, shape string) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if !expectDelim(dec, '{') {
+		return "", shapeUnknown
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return "", shapeUnknown
+		}
+		if key != "data" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return "", shapeUnknown
+			}
+			continue
+		}
+		if !expectDelim(dec, '{') {
+			return "", shapeUnknown
+		}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return resultType, shape
+			}
+			switch key {
+			case "resultType":
+				if err := dec.Decode(&resultType); err != nil {
+					return "", shape
+				}
+			case "result":
+				shape = peekResultShape(dec)
+				// Prometheus declares the result type before the result, so it is known by now.
+				return resultType, shape
+			default:
+				var skip json.RawMessage
+				if err := dec.Decode(&skip); err != nil {
+					return resultType, shape
+				}
+			}
+		}
+		return resultType, shape
+	}
+	return "", shapeUnknown
+}
+
+// peekResultShape returns the shape of the first element of the result array that dec is at. It
+// only reads the element up to the first key that tells its shape, so that large series need not
+// be included in a truncated body.
+func peekResultShape(dec *json.Decoder) string {
+	if !expectDelim(dec, '[') || !dec.More() {
+		return shapeUnknown
+	}
+	t, err := dec.Token()
+	if err != nil {
+		return shapeUnknown
+	}
+	switch t := t.(type) {
+	case float64:
+		// Scalar and string results are a single timestamp and value pair.
+		return shapePair
+	case json.Delim:
+		if t != '{' {
+			return shapeUnknown
+		}
+	default:
+		return shapeUnknown
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return shapeUnknown
+		}
+		switch key {
+		case "value", "histogram":
+			return shapeSample
+		case "values", "histograms":
+			return shapeSamples
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return shapeUnknown
+		}
+	}
+	return shapeUnknown
+}
+
+// expectDelim reads the next token from dec and returns true if it is the given delimiter.
+func expectDelim(dec *json.Decoder, delim json.Delim) bool {
+	t, err := dec.Token()
+	return err == nil && t == delim
+}
@@ -0,0 +1,129 @@
+package comparer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestCheckResultType(t *testing.T) {
+	vector := model.Vector{&model.Sample{Metric: model.Metric{"job": "demo"}, Value: 1}}
+	matrix := model.Matrix{&model.SampleStream{Metric: model.Metric{"job": "demo"}}}
+	for _, tc := range []struct {
+		name    string
+		body    string
+		decoded model.Value
+		want    string
+	}{
+		{
+			name:    "vector",
+			body:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"demo"},"value":[1,"1"]}]}}`,
+			decoded: vector,
+		},
+		{
+			name:    "matrix",
+			body:    `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"demo"},"values":[[1,"1"]]}]}}`,
+			decoded: matrix,
+		},
+		{
+			name:    "scalar",
+			body:    `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+			decoded: &model.Scalar{Value: 1},
+		},
+		{
+			name:    "empty matrix",
+			body:    `{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+			decoded: model.Matrix{},
+		},
+		{
+			name:    "matrix declared with vector elements",
+			body:    `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"demo"},"value":[1,"1"]}]}}`,
+			decoded: matrix,
+			want:    `declared resultType "matrix", but the result holds series with a single sample instead of series with a list of samples`,
+		},
+		{
+			name:    "vector declared with matrix elements",
+			body:    `{"status":"success","data":{"resultType":"vector","result":[{"values":[[1,"1"]],"metric":{"job":"demo"}}]}}`,
+			decoded: vector,
+			want:    `declared resultType "vector", but the result holds series with a list of samples instead of series with a single sample`,
+		},
+		{
+			name:    "vector declared with a scalar result",
+			body:    `{"status":"success","data":{"resultType":"vector","result":[1,"1"]}}`,
+			decoded: vector,
+			want:    `declared resultType "vector", but the result holds a timestamp and value pair instead of series with a single sample`,
+		},
+		{
+			name:    "declared type differs from the decoded type",
+			body:    `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+			decoded: vector,
+			want:    `declared resultType "scalar", but the result was decoded as a vector`,
+		},
+		{
+			name:    "truncated after the first element",
+			body:    `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"demo"},"value":[1,"1"]},{"metric":`,
+			decoded: matrix,
+			want:    `declared resultType "matrix", but the result holds series with a single sample instead of series with a list of samples`,
+		},
+		{
+			name:    "no declared type",
+			body:    `{"status":"success","data":{"result":[]}}`,
+			decoded: matrix,
+		},
+		{
+			name:    "not JSON",
+			body:    `<html>`,
+			decoded: matrix,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := checkResultType([]byte(tc.body), tc.decoded); got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCompareDeclaredResultType(t *testing.T) {
+	// The test target declares a matrix, but returns vector elements.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		resultType := "vector"
+		if r.FormValue("query") == "inconsistent" {
+			resultType = "matrix"
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":%q,"result":[{"metric":{"job":"demo"},"value":[1,"1"]}]}}`, resultType)
+	}))
+	defer srv.Close()
+	client, err := api.NewClient(api.Config{Address: srv.URL, RoundTripper: NewCapturingRoundTripper(http.DefaultTransport)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(&fakeTarget{value: fakeVector(1)}, NewAPITarget(v1.NewAPI(client)), nil, Options{})
+
+	res, err := c.Compare(instantTestCase("consistent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Success() {
+		t.Errorf("expected a consistent response to pass, got diff %q", res.Diff)
+	}
+
+	res, err = c.Compare(instantTestCase("inconsistent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `result type mismatch: test API declared resultType "matrix", but the result holds series with a single sample instead of series with a list of samples`
+	if !res.Failed() || res.Diff != want {
+		t.Errorf("expected the failure %q, got %q", want, res.Diff)
+	}
+	if strings.Contains(res.Diff, "reference API") {
+		t.Errorf("expected only the test API to be named, got %q", res.Diff)
+	}
+}
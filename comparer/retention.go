@@ -0,0 +1,61 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+// DefaultRetentionCanary selects the series whose samples are probed to find a target's retention horizon.
+const DefaultRetentionCanary = `{__name__=~".+"}`
+
+// retentionProbeWindow is the range over which each probe looks for samples.
+const retentionProbeWindow = 5 * time.Minute
+
+// ProbeRetention estimates the earliest time in [lo, hi] from which on the target has samples of the
+// canary selector, using at most maxProbes instant queries. If the target has samples at lo, lo is
+// returned. Otherwise the time is found by binary search, assuming that samples are retained
+// contiguously up to hi, and the returned horizon may be later than the earliest sample by up to
+// (hi-lo)/2^(maxProbes-2).
+func ProbeRetention(ctx context.Context, target QueryTarget, canary string, lo, hi time.Time, maxProbes int) (time.Time, error) {
+	query := fmt.Sprintf("count(count_over_time(%s[%s]))", canary, model.Duration(retentionProbeWindow))
+	hasSamples := func(ts time.Time) (bool, error) {
+		res, err := target.InstantQuery(ctx, query, ts)
+		if err != nil {
+			return false, errors.Wrapf(err, "querying %s", query)
+		}
+		v, ok := res.Value.(model.Vector)
+		if !ok {
+			return false, errors.Errorf("unexpected result type %s for %s", res.Value.Type(), query)
+		}
+		return len(v) > 0, nil
+	}
+
+	ok, err := hasSamples(lo)
+	if err != nil || ok {
+		return lo, err
+	}
+	if ok, err = hasSamples(hi); err != nil {
+		return hi, err
+	}
+	if !ok {
+		return hi, errors.Errorf("no samples of %s found until %v", canary, hi.Format(time.RFC3339))
+	}
+	// Invariant: no samples at lo, samples at hi.
+	for probes := 2; probes < maxProbes && hi.Sub(lo) > retentionProbeWindow; probes++ {
+		mid := lo.Add(hi.Sub(lo) / 2)
+		ok, err := hasSamples(mid)
+		if err != nil {
+			return hi, err
+		}
+		if ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi, nil
+}
@@ -0,0 +1,164 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// retryingAPI wraps a PromAPI and retries queries that failed due to transient errors.
+type retryingAPI struct {
+	api        PromAPI
+	maxRetries int
+	baseDelay  time.Duration
+	waits      *WaitBudget
+	target     string
+}
+
+// NewRetryingAPI returns a PromAPI that retries failed queries against the given API with
+// exponential backoff. Only network errors and HTTP 5xx responses are retried, since other
+// errors (e.g. PromQL parse errors) are legitimate comparison results. The backoff and the failed
+// attempts are accounted to the target in the given budget, which may be nil.
+func NewRetryingAPI(api PromAPI, cfg config.RetryConfig, waits *WaitBudget, target string) PromAPI {
+	if cfg.MaxRetries <= 0 {
+		return api
+	}
+	return &retryingAPI{
+		api:        api,
+		maxRetries: cfg.MaxRetries,
+		baseDelay:  time.Duration(cfg.BaseDelaySeconds * float64(time.Second)),
+		waits:      waits,
+		target:     target,
+	}
+}
+
+// Query implements PromAPI.
+func (r *retryingAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error) {
+	var (
+		val      model.Value
+		warnings v1.Warnings
+	)
+	err := r.retry(ctx, query, func() error {
+		var err error
+		val, warnings, err = r.api.Query(ctx, query, ts)
+		return err
+	})
+	return val, warnings, err
+}
+
+// QueryRange implements PromAPI.
+func (r *retryingAPI) QueryRange(ctx context.Context, query string, rng v1.Range) (model.Value, v1.Warnings, error) {
+	var (
+		val      model.Value
+		warnings v1.Warnings
+	)
+	err := r.retry(ctx, query, func() error {
+		var err error
+		val, warnings, err = r.api.QueryRange(ctx, query, rng)
+		return err
+	})
+	return val, warnings, err
+}
+
+func (r *retryingAPI) retry(ctx context.Context, query string, f func() error) error {
+	delay := r.baseDelay
+	for attempt := 0; ; attempt++ {
+		start, waited := time.Now(), rateLimitWait(ctx)
+		err := f()
+		took := time.Since(start) - (rateLimitWait(ctx) - waited)
+		if d, ok := ctx.Value(attemptDurationKey{}).(*int64); ok {
+			atomic.StoreInt64(d, int64(took))
+		}
+		if err == nil || attempt >= r.maxRetries || ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+		rc, _ := ctx.Value(retryCountKey{}).(*retryCount)
+		if werr := r.waits.sleep(ctx, r.target, WaitCauseBackoff, delay); werr == errRetryWaitExhausted {
+			log.Debugf("Not retrying query %q after transient error, since the maximum retry wait of the run is exhausted: %v", query, err)
+			if rc != nil {
+				atomic.StoreInt32(&rc.exhausted, 1)
+			}
+			return err
+		} else if werr != nil {
+			return err
+		}
+		r.waits.failedAttempt(r.target, took)
+		log.Debugf("Retrying query %q after %v after transient error (retry %d of %d): %v", query, delay, attempt+1, r.maxRetries, err)
+		if rc != nil {
+			atomic.AddInt32(&rc.retries, 1)
+		}
+		delay *= 2
+	}
+}
+
+type retryCountKey struct{}
+
+// retryCount holds the number of retries of the queries run with a context, and whether a query
+// was not retried since the maximum retry wait of the run was exhausted.
+type retryCount struct {
+	retries   int32
+	exhausted int32
+}
+
+// withRetryCount returns a context that makes retrying APIs count the retries of queries run with it.
+func withRetryCount(ctx context.Context) (context.Context, *retryCount) {
+	rc := &retryCount{}
+	return context.WithValue(ctx, retryCountKey{}, rc), rc
+}
+
+type attemptDurationKey struct{}
+
+// withAttemptDuration returns a context that makes retrying APIs record the duration of the last
+// attempt of queries run with it, so that the time spent on failed attempts and backoff is excluded.
+func withAttemptDuration(ctx context.Context) (context.Context, *int64) {
+	d := new(int64)
+	return context.WithValue(ctx, attemptDurationKey{}, d), d
+}
+
+// retryNote describes the number of retries the queries against an API needed, if any.
+func retryNote(api string, rc *retryCount) string {
+	retries := atomic.LoadInt32(&rc.retries)
+	var note string
+	switch retries {
+	case 0:
+	case 1:
+		note = fmt.Sprintf("%s API queries needed 1 retry", api)
+	default:
+		note = fmt.Sprintf("%s API queries needed %d retries", api, retries)
+	}
+	if atomic.LoadInt32(&rc.exhausted) == 0 {
+		return note
+	}
+	if note != "" {
+		note += ", "
+	}
+	return note + fmt.Sprintf("%s API queries were not retried after a transient error, since the maximum retry wait of the run was exhausted", api)
+}
+
+// isTransient returns true if the error was caused by the network or by a server-side
+// failure and the query may succeed when it is retried.
+func isTransient(err error) bool {
+	var tooLargeErr *ResponseTooLargeError
+	if errors.As(err, &tooLargeErr) {
+		return false
+	}
+	var apiErr *v1.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Type == v1.ErrServer
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
@@ -0,0 +1,129 @@
+package comparer
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// flakyAPI is a PromAPI that fails the first failures queries with err and answers the others with
+// a fixed vector.
+type flakyAPI struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (a *flakyAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error) {
+	a.calls++
+	if a.calls <= a.failures {
+		return nil, nil, a.err
+	}
+	return fakeVector(1), nil, nil
+}
+
+func (a *flakyAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, v1.Warnings, error) {
+	return a.Query(ctx, query, r.End)
+}
+
+func TestRetryingAPI(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		failures  int
+		err       error
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "502 twice", failures: 2, err: &v1.Error{Type: v1.ErrServer, Msg: "502 Bad Gateway"}, wantCalls: 3},
+		{name: "connection reset twice", failures: 2, err: &net.OpError{Op: "read", Net: "tcp", Err: errConnReset{}}, wantCalls: 3},
+		{name: "400", failures: 1, err: &v1.Error{Type: v1.ErrBadData, Msg: "parse error"}, wantCalls: 1, wantErr: true},
+		{name: "query execution error", failures: 1, err: &v1.Error{Type: v1.ErrExec, Msg: "query processing would load too many samples"}, wantCalls: 1, wantErr: true},
+		{name: "retries exhausted", failures: 10, err: &v1.Error{Type: v1.ErrServer, Msg: "503 Service Unavailable"}, wantCalls: 4, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &flakyAPI{failures: tc.failures, err: tc.err}
+			waits := NewWaitBudget(0)
+			r := NewRetryingAPI(api, config.RetryConfig{MaxRetries: 3, BaseDelaySeconds: 0.001}, waits, "test")
+			ctx, rc := withRetryCount(context.Background())
+			val, _, err := r.Query(ctx, "demo", time.Unix(1, 0))
+			if api.calls != tc.wantCalls {
+				t.Errorf("expected %d calls, got %d", tc.wantCalls, api.calls)
+			}
+			if tc.wantErr {
+				if err != tc.err {
+					t.Errorf("expected the error %v, got %v", tc.err, err)
+				}
+			} else if err != nil || val == nil {
+				t.Errorf("expected the query to succeed after retrying, got %v", err)
+			}
+			if got := int(rc.retries); got != tc.wantCalls-1 {
+				t.Errorf("expected %d retries to be counted, got %d", tc.wantCalls-1, got)
+			}
+			var backoff time.Duration
+			for _, w := range waits.Waits() {
+				if w.Cause == WaitCauseBackoff {
+					backoff = w.Total
+				}
+			}
+			// The delay doubles with each retry.
+			if want := time.Duration(1<<uint(tc.wantCalls-1)-1) * time.Millisecond; backoff < want {
+				t.Errorf("expected a backoff of at least %v, got %v", want, backoff)
+			}
+		})
+	}
+}
+
+func TestRetryingAPIDisabled(t *testing.T) {
+	api := &flakyAPI{}
+	if r := NewRetryingAPI(api, config.RetryConfig{}, nil, "test"); r != PromAPI(api) {
+		t.Errorf("expected the API not to be wrapped without max_retries, got %T", r)
+	}
+}
+
+func TestRetryingAPIExhaustedRetryWait(t *testing.T) {
+	api := &flakyAPI{failures: 10, err: &v1.Error{Type: v1.ErrServer, Msg: "502 Bad Gateway"}}
+	waits := NewWaitBudget(5 * time.Millisecond)
+	r := NewRetryingAPI(api, config.RetryConfig{MaxRetries: 5, BaseDelaySeconds: 0.004}, waits, "test")
+	ctx, rc := withRetryCount(context.Background())
+	if _, _, err := r.Query(ctx, "demo", time.Unix(1, 0)); err == nil {
+		t.Fatal("expected the query to fail")
+	}
+	if api.calls != 2 {
+		t.Errorf("expected the second backoff not to fit into the retry wait, got %d calls", api.calls)
+	}
+	if rc.exhausted != 1 || !waits.RetriesExhausted() {
+		t.Error("expected the retry wait to be reported as exhausted")
+	}
+}
+
+func TestCompareNotesRetries(t *testing.T) {
+	ref := &flakyAPI{failures: 2, err: &v1.Error{Type: v1.ErrServer, Msg: "502 Bad Gateway"}}
+	retrying := NewRetryingAPI(ref, config.RetryConfig{MaxRetries: 3, BaseDelaySeconds: 0.001}, nil, "reference")
+	c := New(NewAPITarget(retrying), NewAPITarget(&flakyAPI{}), nil, Options{})
+	res, err := c.Compare(instantTestCase("demo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Success() {
+		t.Fatalf("expected the comparison to pass after retrying, got diff %q", res.Diff)
+	}
+	found := false
+	for _, n := range res.Notes {
+		found = found || n == "reference API queries needed 2 retries"
+	}
+	if !found {
+		t.Errorf("expected a note on the retries, got %v", res.Notes)
+	}
+}
+
+// errConnReset is a network error like a connection reset by the peer.
+type errConnReset struct{}
+
+func (errConnReset) Error() string   { return "connection reset by peer" }
+func (errConnReset) Timeout() bool   { return false }
+func (errConnReset) Temporary() bool { return true }
@@ -0,0 +1,191 @@
+package comparer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// A RuleHits counts how often a rule of the configuration applied during a run.
+type RuleHits struct {
+	// Rule is the rule as configured, e.g. "drop_result_labels: __tenant__", and Source the
+	// section that it is configured in, e.g. "query tweak 2".
+	Rule   string `json:"rule"`
+	Source string `json:"source"`
+	Hits   int    `json:"hits"`
+	// Unused explains why a rule that never applied did not, e.g. "never present in any result".
+	Unused string `json:"unused,omitempty"`
+}
+
+func (h RuleHits) String() string {
+	return fmt.Sprintf("%s (%s): %s", h.Rule, h.Source, h.Unused)
+}
+
+// labelRule is a label that a query tweak drops or renames.
+type labelRule struct {
+	hits  *RuleHits
+	label model.LabelName
+	// testOnly is set if the tweak only applies to the test results.
+	testOnly bool
+}
+
+// queryRule is a pattern of queries that a rule applies to.
+type queryRule struct {
+	hits *RuleHits
+	re   *regexp.Regexp
+}
+
+// A RuleUsage counts how often the result label tweaks and query renames of the query tweaks, and
+// the recording rules, applied during a run, to find the rules that never applied. These are stale
+// and may hide future differences. It is shared by the comparers of a run and safe for concurrent
+// use. A nil RuleUsage counts nothing.
+type RuleUsage struct {
+	mtx            sync.Mutex
+	rules          []*RuleHits
+	labels         []labelRule
+	renames        []queryRule
+	recordingRules []*config.RecordingRule
+	// recordingRuleHits holds the counts of recordingRules, in the same order.
+	recordingRuleHits []*RuleHits
+}
+
+// NewRuleUsage returns a RuleUsage for the rules of the query tweaks and recording rules.
+func NewRuleUsage(queryTweaks []*config.QueryTweak, recordingRules []*config.RecordingRule) *RuleUsage {
+	u := &RuleUsage{recordingRules: recordingRules}
+	add := func(rule, source, unused string) *RuleHits {
+		h := &RuleHits{Rule: rule, Source: source, Unused: unused}
+		u.rules = append(u.rules, h)
+		return h
+	}
+	for i, qt := range queryTweaks {
+		source := fmt.Sprintf("query tweak %d", i+1)
+		testOnly := qt.ResultLabelsScope == config.LabelTweakScopeTest
+		for _, ln := range qt.DropResultLabels {
+			u.labels = append(u.labels, labelRule{hits: add(fmt.Sprintf("drop_result_labels: %s", ln), source, "never present in any result"), label: ln, testOnly: testOnly})
+		}
+		from := make(model.LabelNames, 0, len(qt.RenameResultLabels))
+		for ln := range qt.RenameResultLabels {
+			from = append(from, ln)
+		}
+		sort.Sort(from)
+		for _, ln := range from {
+			u.labels = append(u.labels, labelRule{hits: add(fmt.Sprintf("rename_result_labels: %s: %s", ln, qt.RenameResultLabels[ln]), source, "never present in any result"), label: ln, testOnly: testOnly})
+		}
+		exprs := make([]string, 0, len(qt.Rename))
+		for expr := range qt.Rename {
+			exprs = append(exprs, expr)
+		}
+		sort.Strings(exprs)
+		for _, expr := range exprs {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				// Validate rejects invalid regular expressions.
+				continue
+			}
+			u.renames = append(u.renames, queryRule{hits: add(fmt.Sprintf("rename: %s", expr), source, "never matched any query"), re: re})
+		}
+	}
+	for i, rr := range recordingRules {
+		u.recordingRuleHits = append(u.recordingRuleHits, add(fmt.Sprintf("metric_prefixes: %v", rr.MetricPrefixes), fmt.Sprintf("recording rule %d", i+1), "never matched any query"))
+	}
+	return u
+}
+
+// observeQuery counts the query renames that change a query, and the recording rule that applies to it.
+func (u *RuleUsage) observeQuery(query string) {
+	if u == nil || query == "" {
+		return
+	}
+	var hits []*RuleHits
+	for _, r := range u.renames {
+		if r.re.MatchString(query) {
+			hits = append(hits, r.hits)
+		}
+	}
+	// Like compareOptionsFor, only the first matching recording rule applies.
+	for i, rr := range u.recordingRules {
+		if referencesMetricPrefix(query, rr.MetricPrefixes) {
+			hits = append(hits, u.recordingRuleHits[i])
+			break
+		}
+	}
+	u.hit(hits)
+}
+
+// observeResult counts the label tweaks whose labels are present in a query result, before the
+// tweaks are applied to it. Tweaks that only apply to the test results do not count reference results.
+func (u *RuleUsage) observeResult(v model.Value, side string) {
+	if u == nil || len(u.labels) == 0 {
+		return
+	}
+	var metrics []model.Metric
+	switch v := v.(type) {
+	case model.Matrix:
+		for _, ss := range v {
+			metrics = append(metrics, ss.Metric)
+		}
+	case model.Vector:
+		for _, s := range v {
+			metrics = append(metrics, s.Metric)
+		}
+	default:
+		return
+	}
+	var hits []*RuleHits
+	for _, r := range u.labels {
+		if side == "reference" && r.testOnly {
+			continue
+		}
+		for _, m := range metrics {
+			if _, ok := m[r.label]; ok {
+				hits = append(hits, r.hits)
+				break
+			}
+		}
+	}
+	u.hit(hits)
+}
+
+func (u *RuleUsage) hit(hits []*RuleHits) {
+	if len(hits) == 0 {
+		return
+	}
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	for _, h := range hits {
+		h.Hits++
+	}
+}
+
+// Usage returns the counts of all rules, in the order of the configuration.
+func (u *RuleUsage) Usage() []RuleHits {
+	if u == nil {
+		return nil
+	}
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	usage := make([]RuleHits, 0, len(u.rules))
+	for _, h := range u.rules {
+		rh := *h
+		if rh.Hits > 0 {
+			rh.Unused = ""
+		}
+		usage = append(usage, rh)
+	}
+	return usage
+}
+
+// Unused returns the rules that never applied, in the order of the configuration.
+func (u *RuleUsage) Unused() []RuleHits {
+	var unused []RuleHits
+	for _, h := range u.Usage() {
+		if h.Hits == 0 {
+			unused = append(unused, h)
+		}
+	}
+	return unused
+}
@@ -0,0 +1,83 @@
+package comparer
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+func TestRuleUsage(t *testing.T) {
+	tweaks := []*config.QueryTweak{
+		{
+			DropResultLabels:   []model.LabelName{"instance", "__tenant__"},
+			RenameResultLabels: map[model.LabelName]model.LabelName{"job": "service"},
+		},
+		{
+			// The replica label is only present in the reference results.
+			DropResultLabels:  []model.LabelName{"replica"},
+			ResultLabelsScope: config.LabelTweakScopeTest,
+			Rename:            map[string]string{`\bnode_cpu_seconds_total\b`: "node_cpu_seconds", `\bunknown_metric\b`: "unknown"},
+		},
+	}
+	recordingRules := []*config.RecordingRule{{MetricPrefixes: []string{"job:"}}, {MetricPrefixes: []string{"instance:"}}}
+	usage := NewRuleUsage(tweaks, recordingRules)
+
+	ref := &fakeTarget{value: model.Vector{&model.Sample{Metric: model.Metric{"job": "demo", "instance": "a", "replica": "r1"}, Value: 1, Timestamp: 1000}}}
+	test := &fakeTarget{value: model.Vector{&model.Sample{Metric: model.Metric{"job": "demo", "instance": "a"}, Value: 1, Timestamp: 1000}}}
+	c := New(ref, test, tweaks, Options{RuleUsage: usage, RecordingRules: recordingRules})
+
+	// The comparers of a run share the rule usage concurrently.
+	const workers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, q := range []string{"rate(node_cpu_seconds_total[5m])", "sum(job:demo:rate5m)"} {
+				if _, err := c.Compare(instantTestCase(q)); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := []RuleHits{
+		// Both the reference and the test results of each comparison have the label.
+		{Rule: "drop_result_labels: instance", Source: "query tweak 1", Hits: 4 * workers},
+		{Rule: "drop_result_labels: __tenant__", Source: "query tweak 1", Unused: "never present in any result"},
+		{Rule: "rename_result_labels: job: service", Source: "query tweak 1", Hits: 4 * workers},
+		{Rule: "drop_result_labels: replica", Source: "query tweak 2", Unused: "never present in any result"},
+		{Rule: `rename: \bnode_cpu_seconds_total\b`, Source: "query tweak 2", Hits: workers},
+		{Rule: `rename: \bunknown_metric\b`, Source: "query tweak 2", Unused: "never matched any query"},
+		{Rule: "metric_prefixes: [job:]", Source: "recording rule 1", Hits: workers},
+		{Rule: "metric_prefixes: [instance:]", Source: "recording rule 2", Unused: "never matched any query"},
+	}
+	if got := usage.Usage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the rule usage\n%+v\ngot\n%+v", want, got)
+	}
+
+	var unused []string
+	for _, r := range usage.Unused() {
+		unused = append(unused, r.String())
+	}
+	wantUnused := []string{
+		"drop_result_labels: __tenant__ (query tweak 1): never present in any result",
+		"drop_result_labels: replica (query tweak 2): never present in any result",
+		`rename: \bunknown_metric\b (query tweak 2): never matched any query`,
+		"metric_prefixes: [instance:] (recording rule 2): never matched any query",
+	}
+	if !reflect.DeepEqual(unused, wantUnused) {
+		t.Errorf("expected the unused rules %q, got %q", wantUnused, unused)
+	}
+
+	var nilUsage *RuleUsage
+	nilUsage.observeQuery("up")
+	nilUsage.observeResult(test.value, "test")
+	if nilUsage.Usage() != nil || nilUsage.Unused() != nil {
+		t.Error("expected a nil rule usage to count nothing")
+	}
+}
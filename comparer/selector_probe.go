@@ -0,0 +1,143 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+const (
+	// selectorProbeLookback is how far before the queried window the selector probes look for the
+	// missing series.
+	selectorProbeLookback = 24 * time.Hour
+	// defaultLookbackDelta is the lookback of instant vector selectors in Prometheus.
+	defaultLookbackDelta = 5 * time.Minute
+)
+
+var (
+	bareSelectorRegexp = regexp.MustCompile(`^\s*([a-zA-Z_:][a-zA-Z0-9_:]*)?\s*(\{[^}]*\})?\s*$`)
+	nameMatcherRegexp  = regexp.MustCompile(`__name__\s*=\s*"([a-zA-Z_:][a-zA-Z0-9_:]*)"`)
+)
+
+// selectorMetricName returns the metric name of a bare vector selector, and false if the query is
+// not one. The name is empty if the selector only has label matchers other than an equality
+// matcher on __name__.
+func selectorMetricName(query string) (string, bool) {
+	m := bareSelectorRegexp.FindStringSubmatch(query)
+	if m == nil || (m[1] == "" && m[2] == "") {
+		return "", false
+	}
+	if m[1] != "" {
+		return m[1], true
+	}
+	if n := nameMatcherRegexp.FindStringSubmatch(m[2]); n != nil {
+		return n[1], true
+	}
+	return "", true
+}
+
+// diagnoseSelector probes the test target for the series that a failing bare selector query is
+// missing in the test result. It runs count_over_time() of the selector over the queried window
+// widened by selectorProbeLookback and, for the series not found, present_over_time() of the metric
+// name alone. Each missing series is classified as present outside the queried window, present
+// with different labels, or absent entirely. It returns an empty string if the query is not a bare
+// selector, no series are missing, or the run's probes for the test target are used up.
+func (c *Comparer) diagnoseSelector(ctx context.Context, tc *TestCase, refResult, testResult model.Value) string {
+	name, ok := selectorMetricName(tc.Query)
+	if !ok || c.opts.SelectorDiagnosticsLimit <= 0 {
+		return ""
+	}
+	tweaks := c.labelTweaks(tc)
+	have := map[model.Fingerprint]bool{}
+	for _, s := range seriesOf(testResult) {
+		have[withoutName(s.metric).Fingerprint()] = true
+	}
+	var missing []model.Metric
+	for _, s := range seriesOf(refResult) {
+		if m := withoutName(s.metric); !have[m.Fingerprint()] {
+			missing = append(missing, m)
+		}
+	}
+	if len(missing) == 0 {
+		return ""
+	}
+	if atomic.AddInt32(&c.selectorProbes, 1) > int32(c.opts.SelectorDiagnosticsLimit) {
+		return ""
+	}
+
+	end, start := tc.End, tc.Start
+	if tc.Instant() {
+		end, start = tc.Time, tc.Time
+	}
+	window := model.Duration(end.Sub(start) + defaultLookbackDelta + selectorProbeLookback)
+	probe := func(query string) (map[model.Fingerprint]model.Metric, error) {
+		probeTC := *tc
+		probeTC.Query, probeTC.TestQuery = query, ""
+		probeTC.Type, probeTC.Time = config.QueryTypeInstant, end
+		res, err := c.query(ctx, c.testTarget, c.opts.TestQueryTimeout, &probeTC)
+		if err != nil {
+			return nil, err
+		}
+		applyLabelTweaks(res.Value, tweaks, "test")
+		found := map[model.Fingerprint]model.Metric{}
+		for _, s := range seriesOf(res.Value) {
+			m := withoutName(s.metric)
+			found[m.Fingerprint()] = m
+		}
+		return found, nil
+	}
+
+	inWider, err := probe(fmt.Sprintf("count_over_time(%s[%s])", c.testQuery(tc), window))
+	if err != nil {
+		return fmt.Sprintf("selector probe for the missing series failed: %v", err)
+	}
+	var outside, absent []model.Metric
+	for _, m := range missing {
+		if _, ok := inWider[m.Fingerprint()]; ok {
+			outside = append(outside, m)
+		} else {
+			absent = append(absent, m)
+		}
+	}
+	var relabeled []model.Metric
+	var example model.Metric
+	if len(absent) > 0 && name != "" {
+		byName, err := probe(fmt.Sprintf("present_over_time({__name__=%q}[%s])", config.RenameTestQuery(name, c.queryTweaks), window))
+		if err != nil {
+			return fmt.Sprintf("selector probe for the metric name %s failed: %v", name, err)
+		}
+		if len(byName) > 0 {
+			relabeled, absent = absent, nil
+			for _, m := range byName {
+				if example == nil || m.Before(example) {
+					example = m
+				}
+			}
+		}
+	}
+
+	var findings []string
+	if len(outside) > 0 {
+		findings = append(findings, fmt.Sprintf("%d exist on the test target only outside the queried window (e.g. %s)", len(outside), outside[0]))
+	}
+	if len(relabeled) > 0 {
+		findings = append(findings, fmt.Sprintf("%d are absent, but %s has series with different labels (e.g. %s)", len(relabeled), name, example))
+	}
+	if len(absent) > 0 {
+		findings = append(findings, fmt.Sprintf("%d are absent entirely (e.g. %s)", len(absent), absent[0]))
+	}
+	return fmt.Sprintf("of the %d series missing in the test result, probed over the last %s: %s", len(missing), window, strings.Join(findings, "; "))
+}
+
+// withoutName returns a copy of m without the metric name, which the probing functions drop.
+func withoutName(m model.Metric) model.Metric {
+	m = m.Clone()
+	delete(m, model.MetricNameLabel)
+	return m
+}
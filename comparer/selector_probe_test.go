@@ -0,0 +1,194 @@
+package comparer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestSelectorMetricName(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		wantName string
+		wantOK   bool
+	}{
+		{query: "demo_cpu_usage_seconds_total", wantName: "demo_cpu_usage_seconds_total", wantOK: true},
+		{query: `demo_num_cpus{instance="demo:9100"}`, wantName: "demo_num_cpus", wantOK: true},
+		{query: `{__name__="demo_num_cpus", job="demo"}`, wantName: "demo_num_cpus", wantOK: true},
+		{query: `{job="demo"}`, wantOK: true},
+		{query: "rate(demo_cpu_usage_seconds_total[5m])"},
+		{query: "demo_num_cpus[5m]"},
+		{query: "demo_num_cpus offset 5m"},
+		{query: ""},
+	} {
+		name, ok := selectorMetricName(tc.query)
+		if name != tc.wantName || ok != tc.wantOK {
+			t.Errorf("%q: expected %q and %v, got %q and %v", tc.query, tc.wantName, tc.wantOK, name, ok)
+		}
+	}
+}
+
+// probeTarget is a QueryTarget that answers the selector probes with the given results and all
+// other queries with result, recording the queries it answers.
+type probeTarget struct {
+	result, countOverTime, presentOverTime model.Vector
+	err                                    error
+	queries                                []string
+}
+
+func (t *probeTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*QueryResult, error) {
+	t.queries = append(t.queries, query)
+	switch {
+	case strings.HasPrefix(query, "count_over_time("):
+		if t.err != nil {
+			return nil, t.err
+		}
+		return &QueryResult{Value: t.countOverTime}, nil
+	case strings.HasPrefix(query, "present_over_time("):
+		return &QueryResult{Value: t.presentOverTime}, nil
+	}
+	return &QueryResult{Value: t.result}, nil
+}
+
+func (t *probeTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*QueryResult, error) {
+	return nil, errors.New("not implemented")
+}
+
+// demoSeries returns a vector with a demo_num_cpus series per instance, without the metric name
+// if the probe returned it.
+func demoSeries(probe bool, instances ...string) model.Vector {
+	v := model.Vector{}
+	for _, i := range instances {
+		m := model.Metric{"job": "demo", "instance": model.LabelValue(i)}
+		if !probe {
+			m[model.MetricNameLabel] = "demo_num_cpus"
+		}
+		v = append(v, &model.Sample{Metric: m, Value: 4, Timestamp: 1000})
+	}
+	return v
+}
+
+func TestDiagnoseSelector(t *testing.T) {
+	const query = `demo_num_cpus{job="demo"}`
+	ref := &fakeTarget{value: demoSeries(false, "a", "b", "c")}
+	for _, tc := range []struct {
+		name        string
+		query       string
+		test        *probeTarget
+		wantProbes  []string
+		wantFinding string
+	}{
+		{
+			name:        "present outside the window",
+			query:       query,
+			test:        &probeTarget{result: demoSeries(false, "a"), countOverTime: demoSeries(true, "a", "b", "c")},
+			wantProbes:  []string{`count_over_time(demo_num_cpus{job="demo"}[1d5m])`},
+			wantFinding: `of the 2 series missing in the test result, probed over the last 1d5m: 2 exist on the test target only outside the queried window (e.g. {instance="b", job="demo"})`,
+		},
+		{
+			name:  "present with different labels",
+			query: query,
+			test: &probeTarget{
+				result:          demoSeries(false, "a"),
+				countOverTime:   demoSeries(true, "a"),
+				presentOverTime: model.Vector{{Metric: model.Metric{"job": "demo", "host": "b"}, Value: 1}, {Metric: model.Metric{"job": "demo", "host": "a"}, Value: 1}},
+			},
+			wantProbes:  []string{`count_over_time(demo_num_cpus{job="demo"}[1d5m])`, `present_over_time({__name__="demo_num_cpus"}[1d5m])`},
+			wantFinding: `2 are absent, but demo_num_cpus has series with different labels (e.g. {host="a", job="demo"})`,
+		},
+		{
+			name:        "absent entirely",
+			query:       query,
+			test:        &probeTarget{result: demoSeries(false, "a")},
+			wantProbes:  []string{`count_over_time(demo_num_cpus{job="demo"}[1d5m])`, `present_over_time({__name__="demo_num_cpus"}[1d5m])`},
+			wantFinding: `2 are absent entirely (e.g. {instance="b", job="demo"})`,
+		},
+		{
+			name:        "outside the window and absent",
+			query:       query,
+			test:        &probeTarget{result: demoSeries(false, "a"), countOverTime: demoSeries(true, "c")},
+			wantProbes:  []string{`count_over_time(demo_num_cpus{job="demo"}[1d5m])`, `present_over_time({__name__="demo_num_cpus"}[1d5m])`},
+			wantFinding: `1 exist on the test target only outside the queried window (e.g. {instance="c", job="demo"}); 1 are absent entirely (e.g. {instance="b", job="demo"})`,
+		},
+		{
+			// Without a metric name, absent series cannot be looked up by their name.
+			name:        "selector without metric name",
+			query:       `{job="demo"}`,
+			test:        &probeTarget{result: demoSeries(false, "a")},
+			wantProbes:  []string{`count_over_time({job="demo"}[1d5m])`},
+			wantFinding: "2 are absent entirely",
+		},
+		{
+			name:        "failed probe",
+			query:       query,
+			test:        &probeTarget{result: demoSeries(false, "a"), err: errors.New("connection refused")},
+			wantProbes:  []string{`count_over_time(demo_num_cpus{job="demo"}[1d5m])`},
+			wantFinding: "selector probe for the missing series failed: connection refused",
+		},
+		{
+			name:  "not a bare selector",
+			query: `sum by (instance) (demo_num_cpus)`,
+			test:  &probeTarget{result: demoSeries(false, "a")},
+		},
+		{
+			// Series with different values are not missing.
+			name:  "no missing series",
+			query: query,
+			test:  &probeTarget{result: model.Vector{{Metric: demoSeries(false, "a")[0].Metric, Value: 2}, demoSeries(false, "b")[0], demoSeries(false, "c")[0]}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New(ref, tc.test, nil, Options{SelectorDiagnosticsLimit: 10})
+			res, err := c.Compare(instantTestCase(tc.query))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.Failed() {
+				t.Fatal("expected the test case to fail")
+			}
+			probes := tc.test.queries[1:]
+			if strings.Join(probes, "\n") != strings.Join(tc.wantProbes, "\n") {
+				t.Errorf("expected the probes %q, got %q", tc.wantProbes, probes)
+			}
+			got := strings.Join(res.Diagnostics, "\n")
+			if tc.wantFinding == "" {
+				if got != "" {
+					t.Errorf("expected no diagnostics, got %q", got)
+				}
+			} else if !strings.Contains(got, tc.wantFinding) {
+				t.Errorf("expected a diagnostic containing %q, got %q", tc.wantFinding, got)
+			}
+		})
+	}
+}
+
+func TestDiagnoseSelectorLimit(t *testing.T) {
+	test := &probeTarget{result: demoSeries(false, "a")}
+	c := New(&fakeTarget{value: demoSeries(false, "a", "b")}, test, nil, Options{SelectorDiagnosticsLimit: 2})
+	for i := 0; i < 4; i++ {
+		res, err := c.Compare(instantTestCase("demo_num_cpus"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(res.Diagnostics) > 0, i < 2; got != want {
+			t.Errorf("query %d: expected diagnostics %v, got %q", i+1, want, res.Diagnostics)
+		}
+	}
+	// Each probed query needs at most two probes.
+	if want := 4 + 2*2; len(test.queries) != want {
+		t.Errorf("expected %d queries, got %d: %q", want, len(test.queries), test.queries)
+	}
+
+	test.queries = nil
+	if _, err := New(&fakeTarget{value: demoSeries(false, "a", "b")}, test, nil, Options{}).Compare(instantTestCase("demo_num_cpus")); err != nil {
+		t.Fatal(err)
+	}
+	if len(test.queries) != 1 {
+		t.Errorf("expected no probes without a limit, got %q", test.queries)
+	}
+}
@@ -0,0 +1,98 @@
+package comparer
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// seriesAllowance returns the series allowance that applies to a test case, or nil if the
+// comparison is strict.
+func (c *Comparer) seriesAllowance(tc *TestCase) *config.SeriesAllowance {
+	a := c.opts.SeriesAllowance
+	if tc.SeriesAllowance != nil {
+		a = tc.SeriesAllowance
+	}
+	if a == nil || (a.MaxExtraSeries == 0 && a.MaxMissingSeries == 0) {
+		return nil
+	}
+	return a
+}
+
+// allowUnmatchedSeries counts the series that are only in the test result (extra) or only in the
+// reference result (missing) and records the counts in res. If they are within the test case's
+// allowance, the unmatched series are removed from both results so that only the series they
+// share are compared. Scalar results and strict comparisons are returned unchanged.
+func (c *Comparer) allowUnmatchedSeries(res *Result, refResult, testResult model.Value) (model.Value, model.Value) {
+	a := c.seriesAllowance(res.TestCase)
+	if a == nil {
+		return refResult, testResult
+	}
+	refKeys, testKeys := c.seriesKeys(refResult), c.seriesKeys(testResult)
+	if refKeys == nil || testKeys == nil {
+		return refResult, testResult
+	}
+	for k := range testKeys {
+		if !refKeys[k] {
+			res.ExtraSeries++
+		}
+	}
+	for k := range refKeys {
+		if !testKeys[k] {
+			res.MissingSeries++
+		}
+	}
+	if res.ExtraSeries == 0 && res.MissingSeries == 0 {
+		return refResult, testResult
+	}
+
+	allowedExtra, allowedMissing := a.Allowed(len(refKeys))
+	if res.ExtraSeries > allowedExtra || res.MissingSeries > allowedMissing {
+		res.Notes = append(res.Notes, fmt.Sprintf("found %d extra and %d missing series, more than the series allowance of %d extra and %d missing series", res.ExtraSeries, res.MissingSeries, allowedExtra, allowedMissing))
+		return refResult, testResult
+	}
+	res.Notes = append(res.Notes, fmt.Sprintf("compared only the series in both results: %d extra and %d missing series are within the series allowance of %d extra and %d missing series", res.ExtraSeries, res.MissingSeries, allowedExtra, allowedMissing))
+	return c.keepSeries(refResult, testKeys), c.keepSeries(testResult, refKeys)
+}
+
+// seriesKeys returns the keys of the series of a vector or matrix result, or nil for other results.
+func (c *Comparer) seriesKeys(v model.Value) map[string]bool {
+	keys := map[string]bool{}
+	switch v := v.(type) {
+	case model.Matrix:
+		for _, ss := range v {
+			keys[c.seriesKey(ss.Metric)] = true
+		}
+	case model.Vector:
+		for _, s := range v {
+			keys[c.seriesKey(s.Metric)] = true
+		}
+	default:
+		return nil
+	}
+	return keys
+}
+
+// keepSeries returns the series of a vector or matrix result whose keys are in keys.
+func (c *Comparer) keepSeries(v model.Value, keys map[string]bool) model.Value {
+	switch v := v.(type) {
+	case model.Matrix:
+		res := make(model.Matrix, 0, len(v))
+		for _, ss := range v {
+			if keys[c.seriesKey(ss.Metric)] {
+				res = append(res, ss)
+			}
+		}
+		return res
+	case model.Vector:
+		res := make(model.Vector, 0, len(v))
+		for _, s := range v {
+			if keys[c.seriesKey(s.Metric)] {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return v
+}
@@ -0,0 +1,203 @@
+package comparer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// EffectiveSettings are the settings that apply to the comparison of a single test case once all
+// configuration layers (defaults, global tolerance, query tweaks, recording rules, and per-case
+// overrides) have been resolved.
+type EffectiveSettings struct {
+	Fraction         float64       `json:"fraction"`
+	Margin           float64       `json:"margin"`
+	Start            time.Time     `json:"start"`
+	End              time.Time     `json:"end"`
+	Time             time.Time     `json:"time"`
+	Resolution       time.Duration `json:"resolution"`
+	Tags             []string      `json:"tags,omitempty"`
+	RefQueryTimeout  time.Duration `json:"refQueryTimeout"`
+	TestQueryTimeout time.Duration `json:"testQueryTimeout"`
+	// RefResponseLimits and TestResponseLimits are the response size limits of the targets.
+	RefResponseLimits  ResponseLimits `json:"refResponseLimits"`
+	TestResponseLimits ResponseLimits `json:"testResponseLimits"`
+	// QueryTweaks are the notes of the query tweaks that affect the comparison.
+	QueryTweaks []string `json:"queryTweaks,omitempty"`
+	// RecordingRule is set when the test case's query is compared as recording-rule-backed.
+	RecordingRule *config.RecordingRule `json:"recordingRule,omitempty"`
+	// Chain lists, in order of increasing precedence, the configuration layers that set each setting.
+	Chain []SettingLayer `json:"chain"`
+}
+
+// A SettingLayer records the value a configuration layer assigned to a setting.
+type SettingLayer struct {
+	Setting string `json:"setting"`
+	Layer   string `json:"layer"`
+	Value   string `json:"value"`
+}
+
+// EffectiveSettings resolves the settings that apply to the comparison of a test case.
+func (c *Comparer) EffectiveSettings(tc *TestCase) *EffectiveSettings {
+	s := &EffectiveSettings{
+		Start:              tc.Start,
+		End:                tc.End,
+		Time:               tc.Time,
+		Resolution:         tc.Resolution,
+		Tags:               tc.Tags,
+		RefQueryTimeout:    c.opts.RefQueryTimeout,
+		TestQueryTimeout:   c.opts.TestQueryTimeout,
+		RefResponseLimits:  c.opts.RefResponseLimits,
+		TestResponseLimits: c.opts.TestResponseLimits,
+	}
+	set := func(setting, layer string, value interface{}) {
+		s.Chain = append(s.Chain, SettingLayer{Setting: setting, Layer: layer, Value: fmt.Sprint(value)})
+	}
+
+	s.Fraction, s.Margin = defaultFraction, defaultMargin
+	set("fraction", "default", s.Fraction)
+	set("margin", "default", s.Margin)
+	if t := c.opts.Tolerance; t != nil {
+		s.Fraction, s.Margin = t.Relative, t.Absolute
+		set("fraction", "tolerance", s.Fraction)
+		set("margin", "tolerance", s.Margin)
+	}
+	applyTolerance := func(layer string, t *config.AdjustValueTolerance) {
+		if t == nil {
+			return
+		}
+		if t.Fraction != nil {
+			s.Fraction = *t.Fraction
+			set("fraction", layer, s.Fraction)
+		}
+		if t.Margin != nil {
+			s.Margin = *t.Margin
+			set("margin", layer, s.Margin)
+		}
+	}
+	for i, qt := range c.queryTweaks {
+		layer := fmt.Sprintf("query_tweaks[%d]", i)
+		if qt.Note != "" {
+			layer = fmt.Sprintf("%s (%s)", layer, qt.Note)
+		}
+		applyTolerance(layer, qt.AdjustValueTolerance)
+		if qt.TruncateTimestampsToMS != 0 {
+			set("truncate_timestamps_to_ms", layer, qt.TruncateTimestampsToMS)
+		}
+		if qt.AlignTimestampsToStep {
+			set("align_timestamps_to_step", layer, true)
+		}
+		if len(qt.DropResultLabels) != 0 {
+			set("drop_result_labels", layer, qt.DropResultLabels)
+		}
+		if len(qt.RenameResultLabels) != 0 {
+			set("rename_result_labels", layer, qt.RenameResultLabels)
+		}
+		if qt.ResultLabelsScope != "" && !qt.LabelTweak().Empty() {
+			set("result_labels_scope", layer, qt.ResultLabelsScope)
+		}
+		if qt.IgnoreFirstStep && !tc.Instant() {
+			set("ignore_first_step", layer, true)
+		}
+		if qt.SampleAlignment != "" && !tc.Instant() {
+			set("sample_alignment", layer, qt.SampleAlignment)
+		}
+		if qt.CanonicalizeQuantileLabel {
+			set("canonicalize_quantile_label", layer, true)
+		}
+		s.QueryTweaks = append(s.QueryTweaks, qt.Note)
+	}
+	if _, rr := c.compareOptionsFor(tc.Query); rr != nil {
+		s.RecordingRule = rr
+		layer := fmt.Sprintf("recording_rules (%s)", strings.Join(rr.MetricPrefixes, ", "))
+		applyTolerance(layer, rr.AdjustValueTolerance)
+		if rr.FreshnessGraceSeconds > 0 && !tc.Instant() {
+			set("freshness_grace_seconds", layer, rr.FreshnessGraceSeconds)
+		}
+	}
+	applyTolerance("test case adjust_value_tolerance", tc.ValueTolerance)
+	for i, lt := range tc.LabelTweaks {
+		layer := fmt.Sprintf("test case result_label_tweaks[%d]", i)
+		if len(lt.DropResultLabels) != 0 {
+			set("drop_result_labels", layer, lt.DropResultLabels)
+		}
+		if len(lt.RenameResultLabels) != 0 {
+			set("rename_result_labels", layer, lt.RenameResultLabels)
+		}
+		if lt.Scope != "" {
+			set("result_labels_scope", layer, lt.Scope)
+		}
+	}
+
+	for _, l := range []struct {
+		layer     string
+		allowance *config.SeriesAllowance
+	}{{"series_allowance", c.opts.SeriesAllowance}, {"test case series_allowance", tc.SeriesAllowance}} {
+		if l.allowance != nil {
+			set("max_extra_series", l.layer, l.allowance.MaxExtraSeries)
+			set("max_missing_series", l.layer, l.allowance.MaxMissingSeries)
+		}
+	}
+
+	if ra := tc.WithinReferenceRange; ra != nil {
+		layer := "test case within_reference_range"
+		set("lookback_seconds", layer, ra.LookbackSeconds)
+		set("range_margin", layer, ra.Margin)
+		set("range_relative_margin", layer, ra.RelativeMargin)
+	}
+
+	if tc.Instant() {
+		set("time", "query_time_parameters and query tweaks", tc.Time.Format(time.RFC3339Nano))
+	} else {
+		set("start", "query_time_parameters and query tweaks", tc.Start.Format(time.RFC3339Nano))
+		set("end", "query_time_parameters and query tweaks", tc.End.Format(time.RFC3339Nano))
+		set("resolution", "query_time_parameters", tc.Resolution)
+	}
+	if s.RefQueryTimeout != 0 {
+		set("reference_query_timeout", "reference_target_config", s.RefQueryTimeout)
+	}
+	if s.TestQueryTimeout != 0 {
+		set("test_query_timeout", "test_target_config", s.TestQueryTimeout)
+	}
+	for _, l := range []struct {
+		api, layer string
+		limits     ResponseLimits
+	}{
+		{"reference", "reference_target_config", s.RefResponseLimits},
+		{"test", "test_target_config", s.TestResponseLimits},
+	} {
+		if l.limits.MaxBytes > 0 {
+			set(l.api+"_max_response_bytes", l.layer, l.limits.MaxBytes)
+		}
+		if l.limits.MaxDecompressedBytes > 0 {
+			set(l.api+"_max_decompressed_response_bytes", l.layer, l.limits.MaxDecompressedBytes)
+		}
+	}
+	return s
+}
+
+// Explain writes the resolution chain of the settings, grouped by setting in order of first appearance.
+func (s *EffectiveSettings) Explain(w io.Writer) {
+	var settings []string
+	layers := map[string][]SettingLayer{}
+	for _, l := range s.Chain {
+		if _, ok := layers[l.Setting]; !ok {
+			settings = append(settings, l.Setting)
+		}
+		layers[l.Setting] = append(layers[l.Setting], l)
+	}
+	for _, setting := range settings {
+		ls := layers[setting]
+		fmt.Fprintf(w, "%s = %s\n", setting, ls[len(ls)-1].Value)
+		for i, l := range ls {
+			marker := "  "
+			if i == len(ls)-1 {
+				marker = "=>"
+			}
+			fmt.Fprintf(w, "  %s %-40s %s\n", marker, l.Layer, l.Value)
+		}
+	}
+}
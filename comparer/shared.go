@@ -0,0 +1,77 @@
+package comparer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/common/model"
+)
+
+type sharedReferenceKey struct{}
+
+// sharedReference holds the reference result of a test case for reuse by comparisons against
+// several test targets.
+type sharedReference struct {
+	mtx    sync.Mutex
+	tc     *TestCase
+	res    *QueryResult
+	err    error
+	cached bool
+}
+
+// WithSharedReference returns a context in which comparisons of the same test case query the reference
+// target only once and reuse its result. Comparers used with the context must share the same reference target.
+func WithSharedReference(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sharedReferenceKey{}, &sharedReference{})
+}
+
+// queryReference runs the test case's query against the reference target, reusing the result of an
+// earlier comparison of the same test case if the context allows it.
+func (c *Comparer) queryReference(ctx context.Context, tc *TestCase) (*QueryResult, error) {
+	shared, ok := ctx.Value(sharedReferenceKey{}).(*sharedReference)
+	if !ok {
+		return c.query(ctx, c.refTarget, c.opts.RefQueryTimeout, tc)
+	}
+
+	shared.mtx.Lock()
+	defer shared.mtx.Unlock()
+	if !shared.cached || shared.tc != tc {
+		shared.res, shared.err = c.query(ctx, c.refTarget, c.opts.RefQueryTimeout, tc)
+		shared.tc, shared.cached = tc, true
+	}
+	if shared.err != nil {
+		return nil, shared.err
+	}
+	// Comparisons modify the result values, so each of them needs its own copy.
+	res := *shared.res
+	res.Value = copyValue(shared.res.Value)
+	return &res, nil
+}
+
+// copyValue returns a deep copy of a query result value.
+func copyValue(v model.Value) model.Value {
+	switch v := v.(type) {
+	case model.Matrix:
+		m := make(model.Matrix, 0, len(v))
+		for _, ss := range v {
+			values := make([]model.SamplePair, len(ss.Values))
+			copy(values, ss.Values)
+			m = append(m, &model.SampleStream{Metric: ss.Metric.Clone(), Values: values})
+		}
+		return m
+	case model.Vector:
+		vec := make(model.Vector, 0, len(v))
+		for _, s := range v {
+			vec = append(vec, &model.Sample{Metric: s.Metric.Clone(), Value: s.Value, Timestamp: s.Timestamp})
+		}
+		return vec
+	case *model.Scalar:
+		s := *v
+		return &s
+	case *model.String:
+		s := *v
+		return &s
+	default:
+		return v
+	}
+}
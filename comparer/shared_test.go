@@ -0,0 +1,88 @@
+package comparer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestQueryReferenceCopiesSharedResult(t *testing.T) {
+	ref := &fakeTarget{value: fakeVector(1)}
+	c := New(ref, &fakeTarget{}, nil, Options{})
+	ctx := WithSharedReference(context.Background())
+	tc := instantTestCase("demo")
+
+	shared := ctx.Value(sharedReferenceKey{}).(*sharedReference)
+	shared.tc, shared.cached = tc, true
+	shared.res = &QueryResult{
+		Value:              fakeVector(1),
+		Warnings:           v1.Warnings{"warning"},
+		Metadata:           map[string]string{"source": "api"},
+		ResultTypeMismatch: "declared resultType \"matrix\", but the result was decoded as a vector",
+		ResponseHeaders:    map[string]string{"X-Served-By": "reference"},
+		histogramsRead:     true,
+	}
+
+	got, err := c.queryReference(ctx, tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.calls != 0 {
+		t.Fatalf("expected the shared result to be reused, but the reference target was queried %d times", ref.calls)
+	}
+	want := *shared.res
+	want.Value = nil
+	actual := *got
+	actual.Value = nil
+	if !reflect.DeepEqual(actual, want) {
+		t.Fatalf("expected a copy of the shared result %+v, got %+v", want, actual)
+	}
+	got.Value.(model.Vector)[0].Value = 2
+	if shared.res.Value.(model.Vector)[0].Value != 1 {
+		t.Fatal("modifying the copied result value modified the shared result value")
+	}
+}
+
+func TestSharedReferenceWithTwoTestTargets(t *testing.T) {
+	var requests int32
+	// The response declares an instant vector, but its series hold a list of samples first.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Served-By", "reference")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"demo"},"values":[[1,"1"]],"value":[1,"1"]}]}}`))
+	}))
+	defer srv.Close()
+	client, err := api.NewClient(api.Config{Address: srv.URL, RoundTripper: NewCapturingRoundTripper(http.DefaultTransport)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := NewAPITarget(v1.NewAPI(client))
+
+	ctx := WithSharedReference(context.Background())
+	tc := instantTestCase("demo")
+	for _, name := range []string{"target-a", "target-b"} {
+		c := New(ref, &fakeTarget{value: fakeVector(1)}, nil, Options{TestTargetName: name, ResponseHeaders: []string{"X-Served-By"}})
+		res, err := c.CompareContext(ctx, tc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.RefResponseHeaders["X-Served-By"]; got != "reference" {
+			t.Errorf("%s: expected the reference response headers to be recorded, got %v", name, res.RefResponseHeaders)
+		}
+		if !strings.Contains(res.Diff, "reference API declared resultType \"vector\"") {
+			t.Errorf("%s: expected the reference result type mismatch to fail the test case, got diff %q", name, res.Diff)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected the reference target to be queried once, got %d queries", n)
+	}
+}
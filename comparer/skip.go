@@ -0,0 +1,24 @@
+package comparer
+
+// Causes of test cases that were planned but not compared, as recorded in Result.SkipCause.
+const (
+	// SkipFilteredByRegex is a test case whose query template -query-include or -query-exclude
+	// filtered out. It is not expanded and has no results.
+	SkipFilteredByRegex = "filtered-by-regex"
+	// SkipExcludedTag is a test case that -include-tags or -exclude-tags filtered out. It is not
+	// expanded and has no results.
+	SkipExcludedTag = "excluded-tag"
+	// SkipBudgetExhausted is a test case that was not compared since a time budget that applies to
+	// it was exhausted.
+	SkipBudgetExhausted = "budget-exhausted"
+	// SkipAbortedEarly is a test case that was not compared since the run was interrupted or
+	// -run-timeout expired.
+	SkipAbortedEarly = "aborted-early"
+	// SkipPreconditionNotMet is a test case that was not compared since a target cannot answer it,
+	// e.g. since its window starts before the retention of the target.
+	SkipPreconditionNotMet = "precondition-not-met"
+	// SkipNotExpanded is a test case template that was not expanded, since a placeholder that it
+	// uses has no values and on_empty_expansion is skip_with_warning. Its results hold the query
+	// template.
+	SkipNotExpanded = "not-expanded"
+)
@@ -0,0 +1,178 @@
+package comparer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// QueryResult is the outcome of a successful query against a QueryTarget.
+type QueryResult struct {
+	Value    model.Value
+	Warnings v1.Warnings
+	// Metadata holds implementation-specific information about how the result was obtained.
+	Metadata map[string]string
+	// Duration is the wall-clock duration of the query. Only the final attempt of retried queries is measured.
+	Duration time.Duration
+	// ResultTypeMismatch describes how the result type declared in the raw response differs from the
+	// decoded result, if it does.
+	ResultTypeMismatch string
+	// ResponseHeaders holds the recorded headers of the response, if it was read over HTTP.
+	ResponseHeaders map[string]string
+
+	// nativeHistograms are the series of the raw response with their native histogram samples, if
+	// the test case expects them and histogramsRead is set. Responses that were not read over HTTP,
+	// e.g. from fixtures and caches, lack them.
+	nativeHistograms []*histogramSeries
+	histogramsRead   bool
+}
+
+// A QueryTarget runs PromQL queries. The Comparer only depends on this interface, so that
+// targets need not speak the Prometheus HTTP API.
+type QueryTarget interface {
+	// InstantQuery evaluates a query at a single timestamp.
+	InstantQuery(ctx context.Context, query string, ts time.Time) (*QueryResult, error)
+	// RangeQuery evaluates a query over a time range.
+	RangeQuery(ctx context.Context, query string, r v1.Range) (*QueryResult, error)
+}
+
+// apiTarget is a QueryTarget backed by a Prometheus-compatible HTTP API.
+type apiTarget struct {
+	api PromAPI
+}
+
+// NewAPITarget returns a QueryTarget that queries the given Prometheus-compatible API.
+func NewAPITarget(api PromAPI) QueryTarget {
+	return &apiTarget{api: api}
+}
+
+// InstantQuery implements QueryTarget.
+func (t *apiTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*QueryResult, error) {
+	val, warnings, err := t.api.Query(ctx, query, ts)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryResult{Value: val, Warnings: warnings, Metadata: map[string]string{"source": "api"}}, nil
+}
+
+// RangeQuery implements QueryTarget.
+func (t *apiTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*QueryResult, error) {
+	val, warnings, err := t.api.QueryRange(ctx, query, r)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryResult{Value: val, Warnings: warnings, Metadata: map[string]string{"source": "api"}}, nil
+}
+
+// A Fixture is a recorded query response that a fixture target replays.
+type Fixture struct {
+	Query string           `json:"query"`
+	Type  config.QueryType `json:"type"`
+	// Data is the "data" object of a Prometheus API query response.
+	Data struct {
+		ResultType model.ValueType `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+	// Error, if set, is returned instead of a result.
+	Error    string      `json:"error,omitempty"`
+	Warnings v1.Warnings `json:"warnings,omitempty"`
+}
+
+type fixtureKey struct {
+	query string
+	typ   config.QueryType
+}
+
+// fixtureTarget is a QueryTarget that replays recorded responses, keyed by query and query type.
+type fixtureTarget struct {
+	file     string
+	fixtures map[fixtureKey]*Fixture
+}
+
+// NewFixtureTarget returns a QueryTarget replaying the responses recorded in a JSON file
+// containing a list of Fixtures.
+func NewFixtureTarget(filename string) (QueryTarget, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []*Fixture
+	if err := json.Unmarshal(content, &fixtures); err != nil {
+		return nil, errors.Wrapf(err, "parsing fixture file %s", filename)
+	}
+	t := &fixtureTarget{file: filename, fixtures: make(map[fixtureKey]*Fixture, len(fixtures))}
+	for _, f := range fixtures {
+		if f.Type == "" {
+			f.Type = config.QueryTypeRange
+		}
+		t.fixtures[fixtureKey{query: f.Query, typ: f.Type}] = f
+	}
+	return t, nil
+}
+
+// InstantQuery implements QueryTarget.
+func (t *fixtureTarget) InstantQuery(_ context.Context, query string, _ time.Time) (*QueryResult, error) {
+	return t.replay(query, config.QueryTypeInstant)
+}
+
+// RangeQuery implements QueryTarget.
+func (t *fixtureTarget) RangeQuery(_ context.Context, query string, _ v1.Range) (*QueryResult, error) {
+	return t.replay(query, config.QueryTypeRange)
+}
+
+func (t *fixtureTarget) replay(query string, typ config.QueryType) (*QueryResult, error) {
+	f, ok := t.fixtures[fixtureKey{query: query, typ: typ}]
+	if !ok {
+		return nil, errors.Errorf("no %s query fixture for %q in %s", typ, query, t.file)
+	}
+	if f.Error != "" {
+		return nil, fixtureError(f.Error)
+	}
+	val, err := decodeValue(f.Data.ResultType, f.Data.Result)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding fixture for %q in %s", query, t.file)
+	}
+	return &QueryResult{Value: val, Warnings: f.Warnings, Metadata: map[string]string{"source": "fixture", "file": t.file}}, nil
+}
+
+// decodeValue decodes the "result" field of a Prometheus API query response.
+func decodeValue(typ model.ValueType, raw json.RawMessage) (model.Value, error) {
+	switch typ {
+	case model.ValMatrix:
+		var m model.Matrix
+		err := json.Unmarshal(raw, &m)
+		return m, err
+	case model.ValVector:
+		var v model.Vector
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	case model.ValScalar:
+		var s model.Scalar
+		err := json.Unmarshal(raw, &s)
+		return &s, err
+	case model.ValString:
+		var s model.String
+		err := json.Unmarshal(raw, &s)
+		return &s, err
+	default:
+		return nil, errors.Errorf("unknown result type %q", typ)
+	}
+}
+
+// fixtureError returns the error of a recorded response. Recorded bad_data and execution errors of
+// the Prometheus API are restored as such, so that query rejections are judged like live ones.
+func fixtureError(msg string) error {
+	for _, typ := range []v1.ErrorType{v1.ErrBadData, v1.ErrExec} {
+		if strings.HasPrefix(msg, string(typ)+": ") {
+			return &v1.Error{Type: typ, Msg: strings.TrimPrefix(msg, string(typ)+": ")}
+		}
+	}
+	return errors.New(msg)
+}
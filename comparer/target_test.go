@@ -0,0 +1,180 @@
+package comparer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// fakeTarget is a QueryTarget that returns a fixed result or error after an optional delay.
+type fakeTarget struct {
+	value   model.Value
+	err     error
+	delay   time.Duration
+	headers map[string]string
+
+	mtx   sync.Mutex
+	calls int
+	// deadlines records whether the context of each query had a deadline.
+	deadlines []bool
+}
+
+func (t *fakeTarget) InstantQuery(ctx context.Context, query string, ts time.Time) (*QueryResult, error) {
+	return t.respond(ctx)
+}
+
+func (t *fakeTarget) RangeQuery(ctx context.Context, query string, r v1.Range) (*QueryResult, error) {
+	return t.respond(ctx)
+}
+
+func (t *fakeTarget) respond(ctx context.Context) (*QueryResult, error) {
+	_, hasDeadline := ctx.Deadline()
+	t.mtx.Lock()
+	t.calls++
+	t.deadlines = append(t.deadlines, hasDeadline)
+	t.mtx.Unlock()
+	if t.delay > 0 {
+		select {
+		case <-time.After(t.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if t.err != nil {
+		return nil, t.err
+	}
+	return &QueryResult{Value: copyValue(t.value), ResponseHeaders: t.headers}, nil
+}
+
+// fakeVector returns an instant vector result with one sample.
+func fakeVector(v model.SampleValue) model.Vector {
+	return model.Vector{&model.Sample{Metric: model.Metric{"job": "demo"}, Value: v, Timestamp: 1000}}
+}
+
+// instantTestCase returns an instant query test case.
+func instantTestCase(query string) *TestCase {
+	return &TestCase{Query: query, Type: config.QueryTypeInstant, Time: time.Unix(1, 0)}
+}
+
+func TestCompareMockTargets(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		ref, test *fakeTarget
+		check     func(*Result) bool
+	}{
+		{
+			name:  "equal results",
+			ref:   &fakeTarget{value: fakeVector(1)},
+			test:  &fakeTarget{value: fakeVector(1)},
+			check: func(res *Result) bool { return res.Success() },
+		},
+		{
+			name:  "different results",
+			ref:   &fakeTarget{value: fakeVector(1)},
+			test:  &fakeTarget{value: fakeVector(2)},
+			check: func(res *Result) bool { return res.Failed() && res.Diff != "" },
+		},
+		{
+			name:  "test target failure",
+			ref:   &fakeTarget{value: fakeVector(1)},
+			test:  &fakeTarget{err: errors.New("rpc error: code = Unavailable")},
+			check: func(res *Result) bool { return res.Failed() && strings.Contains(res.UnexpectedFailure, "Unavailable") },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := New(tc.ref, tc.test, nil, Options{}).Compare(instantTestCase("demo"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.check(res) {
+				t.Errorf("unexpected result %+v", res)
+			}
+			if tc.ref.calls != 1 || tc.test.calls != 1 {
+				t.Errorf("expected each target to be queried once, got %d and %d queries", tc.ref.calls, tc.test.calls)
+			}
+		})
+	}
+}
+
+func TestAPITarget(t *testing.T) {
+	target := NewAPITarget(&flakyAPI{})
+	res, err := target.InstantQuery(context.Background(), "demo", time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Value.String() != fakeVector(1).String() || res.Metadata["source"] != "api" {
+		t.Errorf("unexpected instant query result %+v", res)
+	}
+	if res, err = target.RangeQuery(context.Background(), "demo", v1.Range{Start: time.Unix(0, 0), End: time.Unix(60, 0), Step: time.Minute}); err != nil || res.Value == nil {
+		t.Errorf("unexpected range query result %+v (%v)", res, err)
+	}
+
+	apiErr := &v1.Error{Type: v1.ErrBadData, Msg: "parse error"}
+	if _, err := NewAPITarget(&flakyAPI{failures: 1, err: apiErr}).InstantQuery(context.Background(), "demo(", time.Unix(1, 0)); err != apiErr {
+		t.Errorf("expected the API error to be returned, got %v", err)
+	}
+}
+
+func TestFixtureTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "fixtures.json")
+	fixtures := `[
+	{"query": "demo", "type": "instant", "data": {"resultType": "vector", "result": [{"metric": {"job": "demo"}, "value": [1, "1"]}]}},
+	{"query": "demo", "data": {"resultType": "matrix", "result": [{"metric": {"job": "demo"}, "values": [[0, "1"], [60, "2"]]}]}, "warnings": ["partial result"]},
+	{"query": "demo(", "type": "instant", "error": "bad_data: parse error"}
+]`
+	if err := ioutil.WriteFile(filename, []byte(fixtures), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	target, err := NewFixtureTarget(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := target.InstantQuery(context.Background(), "demo", time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Value.String() != fakeVector(1).String() || res.Metadata["source"] != "fixture" || res.Metadata["file"] != filename {
+		t.Errorf("unexpected instant query result %+v", res)
+	}
+	// Fixtures without a type are range query fixtures.
+	res, err = target.RangeQuery(context.Background(), "demo", v1.Range{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := res.Value.(model.Matrix); !ok || len(m) != 1 || len(m[0].Values) != 2 || len(res.Warnings) != 1 {
+		t.Errorf("unexpected range query result %+v", res)
+	}
+
+	var apiErr *v1.Error
+	if _, err := target.InstantQuery(context.Background(), "demo(", time.Unix(1, 0)); !errors.As(err, &apiErr) || apiErr.Type != v1.ErrBadData {
+		t.Errorf("expected the recorded bad_data error, got %v", err)
+	}
+	if _, err := target.RangeQuery(context.Background(), "other", v1.Range{}); err == nil || !strings.Contains(err.Error(), `no range query fixture for "other"`) {
+		t.Errorf("expected an error for a query without fixture, got %v", err)
+	}
+
+	// A fixture target can be compared against any other target.
+	res2, err := New(NewAPITarget(&flakyAPI{}), target, nil, Options{}).Compare(instantTestCase("demo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res2.Success() {
+		t.Errorf("expected the fixture to match the API result, got diff %q", res2.Diff)
+	}
+}
@@ -0,0 +1,189 @@
+package comparer
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+)
+
+// Causes of the time that a WaitBudget accounts for.
+const (
+	// WaitCauseBackoff is the time spent sleeping between the attempts of a retried query.
+	WaitCauseBackoff = "retry backoff"
+	// WaitCauseFailedAttempts is the time spent on the attempts of queries that were retried.
+	WaitCauseFailedAttempts = "failed attempts"
+	// WaitCauseRateLimit is the time that queries waited for the max_queries_per_second of a target.
+	WaitCauseRateLimit = "rate limit"
+)
+
+// warnRetriesExhausted reports that a budget disabled retries, which happens at most once per budget.
+var warnRetriesExhausted = func(retryWait, maxRetryWait time.Duration) {
+	log.Warnf("Retries took %v of the maximum retry wait of %v, further queries are not retried for the remainder of the run.", retryWait, maxRetryWait)
+}
+
+// errRetryWaitExhausted is returned instead of backing off once the retry wait of a run is exhausted.
+var errRetryWaitExhausted = errors.New("the maximum retry wait of the run is exhausted")
+
+// A WaitTime is the time that the queries of a run spent waiting on a target for a cause. The times
+// of concurrent queries add up, so that they can exceed the duration of the run.
+type WaitTime struct {
+	Target  string        `json:"target"`
+	Cause   string        `json:"cause"`
+	Count   int           `json:"count"`
+	Total   time.Duration `json:"-"`
+	Seconds float64       `json:"seconds"`
+}
+
+type waitKey struct {
+	target, cause string
+}
+
+// A WaitBudget accounts for the time that the queries of a run spend waiting, by target and cause,
+// and bounds the time spent on retries. All waits of the targets of a run go through their shared
+// budget, which is safe for concurrent use. A nil budget only waits.
+type WaitBudget struct {
+	maxRetryWait time.Duration
+
+	mtx       sync.Mutex
+	waits     map[waitKey]*WaitTime
+	retryWait time.Duration
+	exhausted bool
+}
+
+// NewWaitBudget returns a WaitBudget that disables further retries once the backoff and failed
+// attempts of retried queries added up to maxRetryWait. A non-positive maxRetryWait does not bound retries.
+func NewWaitBudget(maxRetryWait time.Duration) *WaitBudget {
+	return &WaitBudget{maxRetryWait: maxRetryWait, waits: map[waitKey]*WaitTime{}}
+}
+
+// sleep waits for d or until the context is done, and accounts the time waited to the target and
+// cause. A backoff must fit into the remaining retry wait, or errRetryWaitExhausted is returned
+// without waiting. It is reserved before waiting, so that concurrent retries cannot exceed it.
+func (b *WaitBudget) sleep(ctx context.Context, target, cause string, d time.Duration) error {
+	if cause == WaitCauseBackoff && !b.reserveRetryWait(d) {
+		return errRetryWaitExhausted
+	}
+	if d <= 0 {
+		return nil
+	}
+	start := time.Now()
+	var err error
+	t := time.NewTimer(d)
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	t.Stop()
+	waited := time.Since(start)
+	if cause == WaitCauseBackoff {
+		// Correct the reserved time by the time actually waited.
+		b.chargeRetryWait(waited - d)
+	}
+	b.record(target, cause, waited)
+	return err
+}
+
+// failedAttempt accounts the duration of an attempt of a query that is retried to the target.
+func (b *WaitBudget) failedAttempt(target string, d time.Duration) {
+	b.record(target, WaitCauseFailedAttempts, d)
+	b.chargeRetryWait(d)
+}
+
+// RetriesExhausted returns true once the budget disabled retries.
+func (b *WaitBudget) RetriesExhausted() bool {
+	if b == nil {
+		return false
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.exhausted
+}
+
+// MaxRetryWait returns the time that the retries of the run may take, or zero if it is not bounded.
+func (b *WaitBudget) MaxRetryWait() time.Duration {
+	if b == nil {
+		return 0
+	}
+	return b.maxRetryWait
+}
+
+// Waits returns the accounted waiting times, sorted by target and cause.
+func (b *WaitBudget) Waits() []WaitTime {
+	if b == nil {
+		return nil
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	waits := make([]WaitTime, 0, len(b.waits))
+	for _, w := range b.waits {
+		wt := *w
+		wt.Seconds = wt.Total.Seconds()
+		waits = append(waits, wt)
+	}
+	sort.Slice(waits, func(i, j int) bool {
+		if waits[i].Target != waits[j].Target {
+			return waits[i].Target < waits[j].Target
+		}
+		return waits[i].Cause < waits[j].Cause
+	})
+	return waits
+}
+
+func (b *WaitBudget) record(target, cause string, d time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	k := waitKey{target: target, cause: cause}
+	w, ok := b.waits[k]
+	if !ok {
+		w = &WaitTime{Target: target, Cause: cause}
+		b.waits[k] = w
+	}
+	w.Count++
+	w.Total += d
+}
+
+// reserveRetryWait adds d to the retry wait if it fits into the maximum, and disables retries otherwise.
+func (b *WaitBudget) reserveRetryWait(d time.Duration) bool {
+	if b == nil {
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.exhausted {
+		return false
+	}
+	if b.maxRetryWait > 0 && b.retryWait+d > b.maxRetryWait {
+		b.exhaust()
+		return false
+	}
+	b.retryWait += d
+	return true
+}
+
+func (b *WaitBudget) chargeRetryWait(d time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.retryWait += d
+	if b.maxRetryWait > 0 && b.retryWait >= b.maxRetryWait {
+		b.exhaust()
+	}
+}
+
+// exhaust disables retries. The caller must hold the mutex.
+func (b *WaitBudget) exhaust() {
+	if !b.exhausted {
+		b.exhausted = true
+		warnRetriesExhausted(b.retryWait, b.maxRetryWait)
+	}
+}
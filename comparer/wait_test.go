@@ -0,0 +1,111 @@
+package comparer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitBudgetConcurrentAccounting(t *testing.T) {
+	const (
+		workers      = 8
+		iterations   = 50
+		maxRetryWait = 40 * time.Millisecond
+		attempt      = time.Millisecond
+		reservation  = 500 * time.Microsecond
+		correction   = 50 * time.Microsecond
+		backoff      = 200 * time.Microsecond
+		rateLimit    = 100 * time.Microsecond
+	)
+	var exhaustions int32
+	defer func(warn func(time.Duration, time.Duration)) { warnRetriesExhausted = warn }(warnRetriesExhausted)
+	warnRetriesExhausted = func(time.Duration, time.Duration) { atomic.AddInt32(&exhaustions, 1) }
+
+	b := NewWaitBudget(maxRetryWait)
+	var (
+		mtx sync.Mutex
+		// granted is the retry wait that was reserved, directly or by backoffs.
+		granted time.Duration
+		// attempts, backoffs, and rateLimits count the accounted waits by target.
+		attempts   = map[string]time.Duration{}
+		backoffs   = map[string]int{}
+		rateLimits = map[string]int{}
+	)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				if b.reserveRetryWait(reservation) {
+					mtx.Lock()
+					granted += reservation
+					mtx.Unlock()
+				}
+				b.failedAttempt(target, attempt)
+				// Corrections of the reserved retry wait race with the reservations.
+				b.chargeRetryWait(correction)
+				err := b.sleep(context.Background(), target, WaitCauseBackoff, backoff)
+				if err != nil && err != errRetryWaitExhausted {
+					t.Error(err)
+				}
+				if err := b.sleep(context.Background(), target, WaitCauseRateLimit, rateLimit); err != nil {
+					t.Error(err)
+				}
+				mtx.Lock()
+				attempts[target] += attempt
+				if err == nil {
+					granted += backoff
+					backoffs[target]++
+				}
+				rateLimits[target]++
+				mtx.Unlock()
+			}
+		}([]string{"reference", "test"}[w%2])
+	}
+	wg.Wait()
+
+	if granted > maxRetryWait {
+		t.Errorf("expected at most %v of retry wait to be reserved, got %v", maxRetryWait, granted)
+	}
+	if !b.RetriesExhausted() || exhaustions != 1 {
+		t.Errorf("expected the retries to be disabled once, got %d times", exhaustions)
+	}
+	if b.reserveRetryWait(0) {
+		t.Error("expected no retry wait to be reserved once the retries are disabled")
+	}
+
+	got := map[waitKey]WaitTime{}
+	for _, w := range b.Waits() {
+		got[waitKey{target: w.Target, cause: w.Cause}] = w
+	}
+	for _, target := range []string{"reference", "test"} {
+		// Failed attempts are accounted with their durations, sleeps with the time actually waited.
+		if w := got[waitKey{target, WaitCauseFailedAttempts}]; w.Count != workers/2*iterations || w.Total != attempts[target] {
+			t.Errorf("%s: expected %d failed attempts taking %v, got %+v", target, workers/2*iterations, attempts[target], w)
+		}
+		if w := got[waitKey{target, WaitCauseBackoff}]; w.Count != backoffs[target] || w.Total < time.Duration(backoffs[target])*backoff {
+			t.Errorf("%s: expected %d backoffs taking at least %v, got %+v", target, backoffs[target], time.Duration(backoffs[target])*backoff, w)
+		}
+		if w := got[waitKey{target, WaitCauseRateLimit}]; w.Count != rateLimits[target] || w.Total < time.Duration(rateLimits[target])*rateLimit || w.Seconds != w.Total.Seconds() {
+			t.Errorf("%s: expected %d rate limit waits taking at least %v, got %+v", target, rateLimits[target], time.Duration(rateLimits[target])*rateLimit, w)
+		}
+	}
+	if len(got) != 6 {
+		t.Errorf("expected the waits of two targets for three causes, got %v", b.Waits())
+	}
+}
+
+func TestNilWaitBudget(t *testing.T) {
+	var b *WaitBudget
+	// A nil budget only waits.
+	if err := b.sleep(context.Background(), "test", WaitCauseBackoff, time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	b.failedAttempt("test", time.Second)
+	if b.RetriesExhausted() || b.Waits() != nil || b.MaxRetryWait() != 0 {
+		t.Error("expected a nil budget to account for nothing")
+	}
+}
@@ -0,0 +1,82 @@
+package comparer
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// warningAPI is a PromAPI that answers all queries with a fixed vector and the given warnings.
+type warningAPI struct {
+	warnings v1.Warnings
+}
+
+func (a *warningAPI) Query(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error) {
+	return fakeVector(1), a.warnings, nil
+}
+
+func (a *warningAPI) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, v1.Warnings, error) {
+	return a.Query(ctx, query, r.End)
+}
+
+func TestCompareWarnings(t *testing.T) {
+	const dropped = "PromQL info: metric might not be a counter, name does not end in _total"
+	for _, tc := range []struct {
+		name         string
+		ref, test    v1.Warnings
+		compare      bool
+		wantSuccess  bool
+		wantMismatch bool
+	}{
+		{name: "warning on the reference side only, not compared", ref: v1.Warnings{dropped}, wantSuccess: true},
+		{name: "warning on the reference side only", ref: v1.Warnings{dropped}, compare: true, wantMismatch: true},
+		{name: "warning on the test side only", test: v1.Warnings{dropped}, compare: true, wantMismatch: true},
+		{name: "same warnings", ref: v1.Warnings{dropped, "other"}, test: v1.Warnings{"other", dropped, dropped}, compare: true, wantSuccess: true},
+		{name: "no warnings", compare: true, wantSuccess: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New(NewAPITarget(&warningAPI{warnings: tc.ref}), NewAPITarget(&warningAPI{warnings: tc.test}), nil, Options{CompareWarnings: tc.compare})
+			res, err := c.Compare(instantTestCase("rate(demo[5m])"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Success() != tc.wantSuccess || res.WarningsMismatch != tc.wantMismatch {
+				t.Errorf("expected success %v and a warnings mismatch %v, got %+v", tc.wantSuccess, tc.wantMismatch, res)
+			}
+			// The warnings are recorded whether or not they are compared.
+			if !reflect.DeepEqual(res.RefAPIWarnings, []string(tc.ref)) || !reflect.DeepEqual(res.TestAPIWarnings, []string(tc.test)) {
+				t.Errorf("expected the warnings %q and %q, got %q and %q", tc.ref, tc.test, res.RefAPIWarnings, res.TestAPIWarnings)
+			}
+		})
+	}
+}
+
+func TestAPIWarningsInJSON(t *testing.T) {
+	c := New(NewAPITarget(&warningAPI{warnings: v1.Warnings{"partial result"}}), NewAPITarget(&warningAPI{}), nil, Options{})
+	res, err := c.Compare(instantTestCase("demo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded["refApiWarnings"]; !reflect.DeepEqual(got, []interface{}{"partial result"}) {
+		t.Errorf("expected the reference warnings in the JSON result, got %v", got)
+	}
+	if _, ok := decoded["testApiWarnings"]; ok {
+		t.Errorf("expected no test warnings in the JSON result, got %v", decoded["testApiWarnings"])
+	}
+	if _, ok := decoded["warningsMismatch"]; ok {
+		t.Error("expected no warnings mismatch when warnings are not compared")
+	}
+}
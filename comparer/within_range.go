@@ -0,0 +1,134 @@
+package comparer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// valueRange is the range of values that the reference returned for a series.
+type valueRange struct {
+	min, max float64
+}
+
+// compareWithinReferenceRange checks that the test target's value of each series at the test case's
+// evaluation time lies within the range of values the reference returned for the series over the
+// lookback window preceding it, widened by the assertion's margins.
+func (c *Comparer) compareWithinReferenceRange(refCtx, testCtx context.Context, tc *TestCase) (res *Result, err error) {
+	ra := tc.WithinReferenceRange
+	evalTime := tc.End
+	if tc.Instant() {
+		evalTime = tc.Time
+	}
+	lookback := time.Duration(ra.LookbackSeconds * float64(time.Second))
+
+	refTC := *tc
+	refTC.Type, refTC.Start, refTC.End = config.QueryTypeRange, evalTime.Add(-lookback), evalTime
+	testTC := *c.testTestCase(tc)
+	testTC.Type, testTC.Time = config.QueryTypeInstant, evalTime
+
+	refRes, refErr := c.query(refCtx, c.refTarget, c.opts.RefQueryTimeout, &refTC)
+	testRes, testErr := c.query(testCtx, c.testTarget, c.opts.TestQueryTimeout, &testTC)
+	defer func() {
+		setDurations(res, refRes, testRes)
+	}()
+	var timeoutErr *TimeoutError
+	if errors.As(refErr, &timeoutErr) {
+		timeoutErr.API = "reference"
+		return nil, timeoutErr
+	}
+	if errors.As(testErr, &timeoutErr) {
+		timeoutErr.API = "test"
+		return nil, timeoutErr
+	}
+	if refErr != nil {
+		return nil, errors.Wrapf(refErr, "querying reference API for %q over the lookback window", tc.Query)
+	}
+	if testErr != nil {
+		return &Result{TestCase: tc, UnexpectedFailure: testErr.Error()}, nil
+	}
+
+	refMatrix, ok := refRes.Value.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("reference API returned %s instead of a matrix for %q", refRes.Value.Type(), tc.Query)
+	}
+	var testVector model.Vector
+	switch v := testRes.Value.(type) {
+	case model.Vector:
+		testVector = v
+	case *model.Scalar:
+		testVector = model.Vector{{Metric: model.Metric{}, Value: v.Value, Timestamp: v.Timestamp}}
+	default:
+		return &Result{
+			TestCase: tc,
+			Diff:     fmt.Sprintf("result type mismatch: test returned %s, expected a vector or scalar", testRes.Value.Type()),
+		}, nil
+	}
+
+	if tweaks := c.labelTweaks(tc); len(tweaks) > 0 {
+		c.opts.RuleUsage.observeResult(refMatrix, "reference")
+		c.opts.RuleUsage.observeResult(testVector, "test")
+		collapsed := append(applyLabelTweaks(refMatrix, tweaks, "reference"), applyLabelTweaks(testVector, tweaks, "test")...)
+		if len(collapsed) > 0 {
+			return &Result{TestCase: tc, Diff: collapsedSeriesDiff(collapsed), CollapsedSeries: collapsed}, nil
+		}
+	}
+
+	ranges := make(map[model.Fingerprint]valueRange, len(refMatrix))
+	refMetrics := make(map[model.Fingerprint]model.Metric, len(refMatrix))
+	for _, ss := range refMatrix {
+		r := valueRange{min: math.Inf(1), max: math.Inf(-1)}
+		for _, sp := range ss.Values {
+			v := float64(sp.Value)
+			if math.IsNaN(v) {
+				continue
+			}
+			r.min, r.max = math.Min(r.min, v), math.Max(r.max, v)
+		}
+		if r.min > r.max {
+			// The series only had NaN values.
+			continue
+		}
+		fp := ss.Metric.Fingerprint()
+		ranges[fp], refMetrics[fp] = r, ss.Metric
+	}
+
+	var outOfRange []string
+	seen := make(map[model.Fingerprint]bool, len(testVector))
+	for _, s := range testVector {
+		fp := s.Metric.Fingerprint()
+		seen[fp] = true
+		r, ok := ranges[fp]
+		if !ok {
+			outOfRange = append(outOfRange, fmt.Sprintf("%s: %v, but the reference has no values for the series in the lookback window", s.Metric, s.Value))
+			continue
+		}
+		widen := ra.Margin + ra.RelativeMargin*(r.max-r.min)
+		lo, hi := r.min-widen, r.max+widen
+		if v := float64(s.Value); math.IsNaN(v) || v < lo || v > hi {
+			outOfRange = append(outOfRange, fmt.Sprintf("%s: %v outside the reference range [%v, %v] (with margins [%v, %v])", s.Metric, s.Value, r.min, r.max, lo, hi))
+		}
+	}
+	for fp, m := range refMetrics {
+		if !seen[fp] {
+			outOfRange = append(outOfRange, fmt.Sprintf("%s: missing in the test result", m))
+		}
+	}
+	sort.Strings(outOfRange)
+
+	res = &Result{
+		TestCase:         tc,
+		OutOfRangeValues: outOfRange,
+		Notes:            []string{fmt.Sprintf("compared the test values at %s against the reference's range of values over the preceding %v", evalTime.Format(time.RFC3339), lookback)},
+	}
+	if len(outOfRange) > 0 {
+		res.Diff = fmt.Sprintf("%d series outside the reference's recent range of values", len(outOfRange))
+	}
+	return res, nil
+}
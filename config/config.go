@@ -2,6 +2,9 @@ package config
 
 import (
 	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
@@ -10,26 +13,371 @@ import (
 
 // Config models the main configuration file.
 type Config struct {
-	ReferenceTargetConfig TargetConfig        `yaml:"reference_target_config"`
-	TestTargetConfig      TargetConfig        `yaml:"test_target_config"`
-	QueryTweaks           []*QueryTweak       `yaml:"query_tweaks"`
-	TestCases             []*TestCase         `yaml:"test_cases"`
-	QueryTimeParameters   QueryTimeParameters `yaml:"query_time_parameters"`
+	ReferenceTargetConfig TargetConfig           `yaml:"reference_target_config"`
+	TestTargetConfig      TargetConfig           `yaml:"test_target_config"`
+	QueryTweaks           []*QueryTweak          `yaml:"query_tweaks"`
+	TestCases             []*TestCase            `yaml:"test_cases"`
+	QueryTimeParameters   QueryTimeParameterSets `yaml:"query_time_parameters"`
+	DifferingErrorsPolicy ErrorPolicy            `yaml:"differing_errors_policy,omitempty"`
+	RetryConfig           RetryConfig            `yaml:"retry_config"`
+	// ErrorMatchRegexp selects the parts of error messages that are compared when both targets reject a
+	// query. If it has capturing groups, only their matches are compared.
+	ErrorMatchRegexp string `yaml:"error_match_regexp,omitempty"`
+	// CompareWarnings fails test cases whose targets return different sets of warnings with their results.
+	CompareWarnings bool `yaml:"compare_warnings,omitempty"`
+	// TestTargetConfigs lists several test targets to compare against the reference in a single run.
+	// It is mutually exclusive with TestTargetConfig, and Load sets it to TestTargetConfig if unset.
+	TestTargetConfigs []TargetConfig `yaml:"test_target_configs,omitempty"`
+	// ReferenceFallbackTargetConfigs are queried in order when the reference target fails a query or returns an empty result.
+	ReferenceFallbackTargetConfigs []TargetConfig `yaml:"reference_fallback_target_configs,omitempty"`
+	// Tolerance sets the default value tolerance, which query tweaks and test cases may override.
+	Tolerance *Tolerance `yaml:"tolerance,omitempty"`
+	// InstantNaNVsMissing decides whether a NaN series in an instant vector result equals an absent series.
+	InstantNaNVsMissing NaNMissingPolicy `yaml:"instant_nan_vs_missing,omitempty"`
+	RecordingRules      []*RecordingRule `yaml:"recording_rules,omitempty"`
+	// CategoryTimeBudgets caps the time spent comparing the test cases of each category. The
+	// "default" budget caps the test cases that no other category or tag budget applies to.
+	CategoryTimeBudgets map[string]model.Duration `yaml:"category_time_budgets,omitempty"`
+	// TagTimeBudgets caps the time spent comparing the test cases with each tag.
+	TagTimeBudgets map[string]model.Duration `yaml:"tag_time_budgets,omitempty"`
+	// OutOfOrderSamples decides whether range query results with out-of-order samples are still compared.
+	OutOfOrderSamples OutOfOrderPolicy `yaml:"out_of_order_samples,omitempty"`
+	// RetentionCanary selects the series whose samples are probed to find the targets' retention.
+	RetentionCanary string `yaml:"retention_canary,omitempty"`
+	// IncludeTestCases lists globs of files whose test cases are appended to TestCases.
+	IncludeTestCases []string `yaml:"include_test_cases,omitempty"`
+	// LabelConformanceSampleRate is the fraction of passing test cases whose raw test target responses
+	// are checked for unsorted or duplicate label names.
+	LabelConformanceSampleRate float64 `yaml:"label_conformance_sample_rate,omitempty"`
+	// ExactnessAuditSampleRate is the fraction of passing test cases whose raw reference and test
+	// target responses are compared for sample values that are not bit-identical.
+	ExactnessAuditSampleRate float64 `yaml:"exactness_audit_sample_rate,omitempty"`
+	// RequestParitySampleRate is the fraction of test cases whose query parameters, as sent to the
+	// reference and test targets, are compared for differences that the configuration does not explain.
+	RequestParitySampleRate float64 `yaml:"request_parity_sample_rate,omitempty"`
+	// SeriesAllowance sets the default number of unmatched series that test cases tolerate.
+	SeriesAllowance *SeriesAllowance `yaml:"series_allowance,omitempty"`
+	// MaxExpansionsPerCase caps the number of queries that a single test case template expands into.
+	MaxExpansionsPerCase int `yaml:"max_expansions_per_case,omitempty"`
+	// StrictEnvExpansion makes references to unset environment variables in target settings an
+	// error instead of expanding them to empty strings.
+	StrictEnvExpansion bool `yaml:"strict_env_expansion,omitempty"`
+	// Flags sets command line flags by name, e.g. output-format. Environment variables and the
+	// command line take precedence over them.
+	Flags map[string]string `yaml:"flags,omitempty"`
+	// IngestionParity compares the series and samples that the targets ingested before the test
+	// cases run.
+	IngestionParity *IngestionParityConfig `yaml:"ingestion_parity,omitempty"`
+	// PlaceholderOverrides restricts the built-in values of query placeholders by their names, e.g.
+	// to leave out an aggregation operator that a build of the test target cannot handle.
+	PlaceholderOverrides map[string]*PlaceholderOverride `yaml:"placeholder_overrides,omitempty"`
+	// OnEmptyExpansion decides whether test case templates using a placeholder without values fail
+	// loading the configuration or are reported as not expanded.
+	OnEmptyExpansion EmptyExpansionPolicy `yaml:"on_empty_expansion,omitempty"`
+	// OnInvalidCase decides whether invalid test case entries fail loading the configuration or
+	// are skipped.
+	OnInvalidCase InvalidCasePolicy `yaml:"on_invalid_case,omitempty"`
+	// InvalidTestCases lists the test case entries that were skipped since they are invalid.
+	InvalidTestCases []InvalidTestCase `yaml:"-"`
+	// UnsetEnvVars lists the references to unset environment variables in target settings, which
+	// expanded to empty strings.
+	UnsetEnvVars []UnsetEnvVar `yaml:"-"`
+	// ResponseHeaders selects the response headers that are recorded with the results, to spot
+	// caches and proxies in front of the targets.
+	ResponseHeaders *ResponseHeadersConfig `yaml:"response_headers,omitempty"`
+	// Requires declares the data that the test cases of the configuration file need.
+	Requires *Requirements `yaml:"requires,omitempty"`
+	// IncludedRequirements holds the requirements declared by the included test case files.
+	IncludedRequirements []*Requirements `yaml:"-"`
+
+	// testTargetConfigsSet is set if the configuration file lists test_target_configs, rather than
+	// them defaulting to test_target_config.
+	testTargetConfigsSet bool
+}
+
+// DefaultCapturedHeaders are the response headers recorded if response_headers is not configured.
+var DefaultCapturedHeaders = []string{"Age", "X-Cache", "Via", "Server"}
+
+// DefaultCacheHitPatterns are the cache hit patterns used if response_headers is not configured.
+var DefaultCacheHitPatterns = map[string]string{"X-Cache": `(?i)\bhit\b`}
+
+// ResponseHeadersConfig configures the response headers recorded with the results.
+type ResponseHeadersConfig struct {
+	// Capture lists the names of the recorded headers.
+	Capture []string `yaml:"capture,omitempty"`
+	// CacheHitPatterns maps header names to regular expressions whose matches in the values of the
+	// headers of test responses show that they were served from a cache. Their headers are
+	// recorded, too. A positive Age header always counts as a cache hit if it is recorded.
+	CacheHitPatterns map[string]string `yaml:"cache_hit_patterns,omitempty"`
+}
+
+// A PlaceholderOverride restricts the built-in values of a query placeholder. If both lists are
+// set, the values are restricted to IncludeOnly before Exclude is applied.
+type PlaceholderOverride struct {
+	IncludeOnly []string `yaml:"include_only,omitempty"`
+	Exclude     []string `yaml:"exclude,omitempty"`
+}
+
+// IngestionParityPolicy decides what happens when the ingestion parity is below its minimum.
+type IngestionParityPolicy string
+
+// Valid IngestionParityPolicy values.
+const (
+	// IngestionParityWarn logs the metrics with low parity and runs the test cases anyway.
+	IngestionParityWarn IngestionParityPolicy = "warn"
+	// IngestionParityGate exits without running the test cases.
+	IngestionParityGate IngestionParityPolicy = "gate"
+)
+
+// IngestionParityConfig configures the comparison of the data ingested by the targets.
+type IngestionParityConfig struct {
+	// Selectors are the vector selectors whose metrics are compared, e.g. '{job="node"}'.
+	Selectors []string `yaml:"selectors"`
+	// WindowSeconds is the length of the compared window, which ends at the latest end of the
+	// query time parameters. It defaults to the span of the windows of the test cases, but at
+	// least an hour.
+	WindowSeconds float64 `yaml:"window_seconds,omitempty"`
+	// MinParityPercent is the overall parity of the sample counts below which OnLowParity applies.
+	MinParityPercent float64               `yaml:"min_parity_percent,omitempty"`
+	OnLowParity      IngestionParityPolicy `yaml:"on_low_parity,omitempty"`
+}
+
+// A RecordingRule marks metrics that the reference serves from recording rules while the test
+// target computes them live. Since recorded results lag behind by up to one evaluation interval,
+// comparisons of queries on these metrics can use a looser tolerance and a freshness grace period.
+type RecordingRule struct {
+	MetricPrefixes        []string              `yaml:"metric_prefixes" json:"metricPrefixes"`
+	AdjustValueTolerance  *AdjustValueTolerance `yaml:"adjust_value_tolerance,omitempty" json:"adjustValueTolerance,omitempty"`
+	FreshnessGraceSeconds float64               `yaml:"freshness_grace_seconds,omitempty" json:"freshnessGraceSeconds,omitempty"`
+}
+
+// Tolerance sets within which relative and absolute difference two sample values are considered equal.
+// Values a and b are equal if |a-b| <= Absolute or |a-b| <= Relative*max(|a|,|b|).
+type Tolerance struct {
+	Relative float64 `yaml:"relative" json:"relative"`
+	Absolute float64 `yaml:"absolute" json:"absolute"`
 }
 
+// NaNMissingPolicy controls whether a series with a NaN value compares as equal to an absent series.
+type NaNMissingPolicy string
+
+// Valid NaNMissingPolicy values.
+const (
+	NaNMissingPolicyDistinct NaNMissingPolicy = "distinct"
+	NaNMissingPolicyEqual    NaNMissingPolicy = "equal"
+)
+
+// OutOfOrderPolicy controls how range query results whose samples are not in ascending
+// timestamp order are compared. Out-of-order samples always fail the test case.
+type OutOfOrderPolicy string
+
+// Valid OutOfOrderPolicy values.
+const (
+	// OutOfOrderPolicyFail fails the test case without comparing sample values.
+	OutOfOrderPolicyFail OutOfOrderPolicy = "fail"
+	// OutOfOrderPolicySort sorts the samples and compares their values anyway.
+	OutOfOrderPolicySort OutOfOrderPolicy = "sort"
+)
+
+// EmptyExpansionPolicy controls what happens to test case templates that use a placeholder without
+// values, e.g. one that placeholder_overrides left without values, and thus expand into no queries.
+type EmptyExpansionPolicy string
+
+// Valid EmptyExpansionPolicy values.
+const (
+	// EmptyExpansionError fails loading the configuration.
+	EmptyExpansionError EmptyExpansionPolicy = "error"
+	// EmptyExpansionSkipWithWarning warns about the templates and reports each of them as not
+	// expanded with a skipped result per time parameter set, so that they count in the totals.
+	EmptyExpansionSkipWithWarning EmptyExpansionPolicy = "skip_with_warning"
+)
+
+// RetryConfig controls retrying of queries that failed due to transient errors.
+type RetryConfig struct {
+	MaxRetries       int     `yaml:"max_retries"`
+	BaseDelaySeconds float64 `yaml:"base_delay_seconds"`
+	// BreakerFailures opens a circuit breaker once this many consecutive queries failed with
+	// transient errors despite their retries. While it is open, queries fail without being sent.
+	// Zero disables the breaker.
+	BreakerFailures int `yaml:"breaker_failures,omitempty"`
+	// BreakerCooldownSeconds is how long the breaker stays open before queries are sent again.
+	BreakerCooldownSeconds float64 `yaml:"breaker_cooldown_seconds,omitempty"`
+}
+
+// An ErrorPolicy controls how a comparison outcome is judged when it is ambiguous.
+type ErrorPolicy string
+
+// Valid ErrorPolicy values.
+const (
+	ErrorPolicyPass ErrorPolicy = "pass"
+	ErrorPolicyWarn ErrorPolicy = "warn"
+	ErrorPolicyFail ErrorPolicy = "fail"
+)
+
 type QueryTimeParameters struct {
+	// Name identifies the parameter set in reports and in the time_parameter_sets of test cases.
+	// It is required if several parameter sets are configured.
+	Name                string  `yaml:"name,omitempty"`
 	EndTime             string  `yaml:"end_time"`
 	RangeInSeconds      float64 `yaml:"range_in_seconds"`
 	ResolutionInSeconds float64 `yaml:"resolution_in_seconds"`
 }
 
+// QueryTimeParameterSets are the time parameters that each test case is run with. In YAML, a
+// single parameter set can be given as a mapping instead of a list.
+type QueryTimeParameterSets []QueryTimeParameters
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (s *QueryTimeParameterSets) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single QueryTimeParameters
+	if err := unmarshal(&single); err == nil {
+		*s = QueryTimeParameterSets{single}
+		return nil
+	}
+	return unmarshal((*[]QueryTimeParameters)(s))
+}
+
+// Sets returns the configured parameter sets, or a single set with the default parameters if none
+// are configured.
+func (s QueryTimeParameterSets) Sets() []QueryTimeParameters {
+	if len(s) == 0 {
+		return []QueryTimeParameters{{}}
+	}
+	return s
+}
+
 // TargetConfig represents the configuration of a single Prometheus API endpoint.
 type TargetConfig struct {
+	// Name identifies the target in reports. It defaults to the query URL or fixture file.
+	Name          string            `yaml:"name,omitempty"`
 	QueryURL      string            `yaml:"query_url"`
 	BasicAuthUser string            `yaml:"basic_auth_user"`
 	BasicAuthPass string            `yaml:"basic_auth_pass"`
 	Headers       map[string]string `yaml:"headers"`
 	TSDBPath      string            `yaml:"tsdb_path"`
+	// BasicAuthPassFile reads the basic auth password from a file, e.g. a mounted secret. Relative
+	// paths are resolved relative to the directory of the configuration file.
+	BasicAuthPassFile string `yaml:"basic_auth_pass_file,omitempty"`
+	// FixtureFile makes the target replay recorded responses from a JSON file instead of querying QueryURL.
+	FixtureFile string `yaml:"fixture_file,omitempty"`
+	// QueryTimeoutSeconds bounds the duration of each query against the target. Zero leaves them unbounded.
+	QueryTimeoutSeconds float64   `yaml:"query_timeout_seconds,omitempty"`
+	TLSConfig           TLSConfig `yaml:"tls_config,omitempty"`
+	// BearerToken is sent in the Authorization header of each request.
+	BearerToken string `yaml:"bearer_token,omitempty"`
+	// OAuth2 fetches and refreshes tokens with the OAuth2 client credentials flow.
+	OAuth2 *OAuth2Config `yaml:"oauth2,omitempty"`
+	// RetryConfig overrides the global retry_config for this target.
+	RetryConfig *RetryConfig `yaml:"retry_config,omitempty"`
+	// MaxResponseBytes limits the size of each response as transferred, and MaxDecompressedResponseBytes
+	// the size of each compressed response after decompression. Both default to 256MiB.
+	MaxResponseBytes             int64 `yaml:"max_response_bytes,omitempty"`
+	MaxDecompressedResponseBytes int64 `yaml:"max_decompressed_response_bytes,omitempty"`
+	// MaxQueriesPerSecond limits the rate of the queries sent to the target, including retries.
+	// Concurrent comparisons share the rate. Zero means unlimited.
+	MaxQueriesPerSecond float64 `yaml:"max_queries_per_second,omitempty"`
+	// HTTPMethod forces the HTTP method of query requests. By default, queries are sent as POST
+	// requests and resent as GET requests if the target does not allow POST.
+	HTTPMethod HTTPMethod `yaml:"http_method,omitempty"`
+	// PathPrefix is appended to the path of QueryURL, e.g. for targets behind a gateway.
+	PathPrefix string `yaml:"path_prefix,omitempty"`
+	// Chaos injects faults into the requests sent to the target. It only takes effect with the
+	// -chaos flag and is meant for testing the tester itself, never for compliance runs.
+	Chaos *ChaosConfig `yaml:"chaos,omitempty"`
+}
+
+// Faults that a ChaosConfig can inject.
+const (
+	ChaosFaultUnavailable = "503"
+	ChaosFaultRateLimited = "429"
+	ChaosFaultMalformed   = "malformed"
+)
+
+// ChaosConfig configures the faults that are injected into the requests sent to a target. The
+// schedule is deterministic for a seed, also when queries run concurrently.
+type ChaosConfig struct {
+	Seed int64 `yaml:"seed,omitempty"`
+	// DropEvery fails every Nth request with a network error before it is sent. Zero drops none.
+	DropEvery int `yaml:"drop_every,omitempty"`
+	// DelaySeconds delays each request before it is sent.
+	DelaySeconds float64 `yaml:"delay_seconds,omitempty"`
+	// FaultRate is the fraction of requests that are answered with one of Faults instead of being sent.
+	FaultRate float64 `yaml:"fault_rate,omitempty"`
+	// Faults lists the faults to inject, out of "503", "429", and "malformed". It defaults to all of them.
+	Faults []string `yaml:"faults,omitempty"`
+}
+
+// HTTPMethod is the HTTP method that query requests are sent with.
+type HTTPMethod string
+
+// Valid HTTPMethod values.
+const (
+	HTTPMethodGet  HTTPMethod = "get"
+	HTTPMethodPost HTTPMethod = "post"
+)
+
+// defaultMaxExpansionsPerCase is the default limit for the number of queries that a single test
+// case template expands into.
+const defaultMaxExpansionsPerCase = 500
+
+// defaultMaxResponseBytes is the default limit for the size of a query response.
+const defaultMaxResponseBytes = 256 << 20
+
+// OAuth2Config configures the OAuth2 client credentials flow.
+type OAuth2Config struct {
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	TokenURL     string   `yaml:"token_url"`
+	Scopes       []string `yaml:"scopes,omitempty"`
+}
+
+// DisplayName returns the name that identifies the target in reports.
+func (c TargetConfig) DisplayName() string {
+	switch {
+	case c.Name != "":
+		return c.Name
+	case c.FixtureFile != "":
+		return c.FixtureFile
+	default:
+		return c.QueryURL
+	}
+}
+
+// validateAuth checks that at most one authentication method is configured.
+func (c TargetConfig) validateAuth() error {
+	methods := 0
+	if c.BasicAuthUser != "" {
+		methods++
+	}
+	if c.BearerToken != "" {
+		methods++
+	}
+	if c.OAuth2 != nil {
+		methods++
+		if c.OAuth2.TokenURL == "" {
+			return errors.New("oauth2 requires a token_url")
+		}
+	}
+	if methods > 1 {
+		return errors.New("basic_auth_user, bearer_token, and oauth2 are mutually exclusive")
+	}
+	return nil
+}
+
+// TLSConfig configures the TLS connection to a target.
+type TLSConfig struct {
+	// CAFile is the CA certificate file to verify the target's certificate with.
+	CAFile string `yaml:"ca_file,omitempty"`
+	// CertFile and KeyFile are the client certificate and key files for mutual TLS.
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+// Enabled returns true if any TLS settings are configured.
+func (c TLSConfig) Enabled() bool {
+	return c != TLSConfig{}
 }
 
 // A QueryTweak restricts or modifies a query in certain ways that avoids certain systematic errors and/or later comparison problems.
@@ -41,40 +389,335 @@ type QueryTweak struct {
 	DropResultLabels       []model.LabelName     `yaml:"drop_result_labels" json:"dropResultLabels,omitempty"`
 	IgnoreFirstStep        bool                  `yaml:"ignore_first_step" json:"ignoreFirstStep,omitempty"`
 	AdjustValueTolerance   *AdjustValueTolerance `yaml:"adjust_value_tolerance" json:"adjustValueTolerance,omitempty"`
+	SampleAlignment        SampleAlignment       `yaml:"sample_alignment,omitempty" json:"sampleAlignment,omitempty"`
+	// CanonicalizeQuantileLabel compares "quantile" label values as floats instead of strings.
+	CanonicalizeQuantileLabel bool `yaml:"canonicalize_quantile_label,omitempty" json:"canonicalizeQuantileLabel,omitempty"`
+	// RenameResultLabels renames result labels before comparing, and ResultLabelsScope selects
+	// the results that DropResultLabels and RenameResultLabels apply to.
+	RenameResultLabels map[model.LabelName]model.LabelName `yaml:"rename_result_labels,omitempty" json:"renameResultLabels,omitempty"`
+	ResultLabelsScope  LabelTweakScope                     `yaml:"result_labels_scope,omitempty" json:"resultLabelsScope,omitempty"`
+	// Rename rewrites the queries sent to the test targets, e.g. to map metric and label names to
+	// the naming of the test target, while the reference target gets the original queries. Each
+	// regular expression is replaced by its replacement, which may refer to capture groups like
+	// ${1}, in the order of the sorted regular expressions.
+	Rename map[string]string `yaml:"rename,omitempty" json:"rename,omitempty"`
+}
+
+// RenameTestQuery returns the query to send to the test targets after applying the Rename tweaks.
+// Invalid regular expressions, which Validate rejects, are ignored.
+func RenameTestQuery(query string, tweaks []*QueryTweak) string {
+	for _, t := range tweaks {
+		exprs := make([]string, 0, len(t.Rename))
+		for expr := range t.Rename {
+			exprs = append(exprs, expr)
+		}
+		sort.Strings(exprs)
+		for _, expr := range exprs {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				continue
+			}
+			query = re.ReplaceAllString(query, t.Rename[expr])
+		}
+	}
+	return query
 }
 
+// LabelTweak returns the tweak's label changes.
+func (t *QueryTweak) LabelTweak() *LabelTweak {
+	return &LabelTweak{DropResultLabels: t.DropResultLabels, RenameResultLabels: t.RenameResultLabels, Scope: t.ResultLabelsScope}
+}
+
+// A LabelTweak drops and renames the labels of query results before they are compared.
+type LabelTweak struct {
+	DropResultLabels   []model.LabelName                   `yaml:"drop_result_labels,omitempty" json:"dropResultLabels,omitempty"`
+	RenameResultLabels map[model.LabelName]model.LabelName `yaml:"rename_result_labels,omitempty" json:"renameResultLabels,omitempty"`
+	Scope              LabelTweakScope                     `yaml:"result_labels_scope,omitempty" json:"resultLabelsScope,omitempty"`
+}
+
+// Empty returns true if the tweak changes no labels.
+func (t *LabelTweak) Empty() bool {
+	return len(t.DropResultLabels) == 0 && len(t.RenameResultLabels) == 0
+}
+
+// LabelTweakScope selects the query results that a label tweak applies to.
+type LabelTweakScope string
+
+// Valid LabelTweakScope values.
+const (
+	// LabelTweakScopeBoth applies a label tweak to both the reference and the test results.
+	LabelTweakScopeBoth LabelTweakScope = "both"
+	// LabelTweakScopeTest applies a label tweak to the test results only.
+	LabelTweakScopeTest LabelTweakScope = "test"
+)
+
+func validLabelTweakScope(s LabelTweakScope) bool {
+	return s == "" || s == LabelTweakScopeBoth || s == LabelTweakScopeTest
+}
+
+// SampleAlignment selects how reference and test samples are paired up when the two
+// targets emit samples on slightly different timestamp grids.
+type SampleAlignment string
+
+// Valid SampleAlignment values.
+const (
+	// SampleAlignmentStrict only pairs samples with identical timestamps.
+	SampleAlignmentStrict SampleAlignment = "strict"
+	// SampleAlignmentNearest pairs each reference sample with the nearest test sample within half a step.
+	SampleAlignmentNearest SampleAlignment = "nearest"
+	// SampleAlignmentInterpolate linearly interpolates reference samples onto nearby test samples' timestamps.
+	SampleAlignmentInterpolate SampleAlignment = "interpolate"
+	// SampleAlignmentSnap moves the samples of both results onto the nearest step of the query range.
+	// Samples of a series that land on the same step are reported as collisions.
+	SampleAlignmentSnap SampleAlignment = "snap"
+)
+
+// AdjustValueTolerance sets the relative (fraction) and absolute (margin) tolerance within which
+// sample values are considered equal. Timestamps, NaN and Inf values are always compared exactly.
 type AdjustValueTolerance struct {
 	Fraction *float64 `yaml:"fraction" json:"fraction,omitempty"`
 	Margin   *float64 `yaml:"margin" json:"margin,omitempty"`
 }
 
+// UnmarshalYAML implements yaml.Unmarshaler. A plain number is accepted as a shorthand for the fraction.
+func (t *AdjustValueTolerance) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var fraction float64
+	if err := unmarshal(&fraction); err == nil {
+		t.Fraction = &fraction
+		return nil
+	}
+	type plain AdjustValueTolerance
+	return unmarshal((*plain)(t))
+}
+
 // TestCase represents a given query (pattern) to be tested.
 type TestCase struct {
-	Query          string   `yaml:"query"`
-	VariantArgs    []string `yaml:"variant_args,omitempty"`
-	SkipComparison bool     `yaml:"skip_comparison,omitempty"`
-	ShouldFail     bool     `yaml:"should_fail,omitempty"`
+	Query          string    `yaml:"query"`
+	VariantArgs    []string  `yaml:"variant_args,omitempty"`
+	SkipComparison bool      `yaml:"skip_comparison,omitempty"`
+	ShouldFail     bool      `yaml:"should_fail,omitempty"`
+	Type           QueryType `yaml:"type,omitempty"`
+	Category       string    `yaml:"category,omitempty"`
+	// QueryType is an alias for Type.
+	QueryType QueryType `yaml:"query_type,omitempty"`
+	// AdjustValueTolerance overrides the value tolerance of the query tweaks for this test case.
+	AdjustValueTolerance *AdjustValueTolerance `yaml:"adjust_value_tolerance,omitempty"`
+	// EvalTimeOffsetSeconds moves the evaluation timestamp of instant queries back from the end time.
+	EvalTimeOffsetSeconds float64 `yaml:"eval_time_offset_seconds,omitempty"`
+	// Tags are free-form labels for selecting test cases.
+	Tags []string `yaml:"tags,omitempty"`
+	// ResultLabelTweaks drop and rename result labels for this test case in addition to the query tweaks.
+	ResultLabelTweaks []*LabelTweak `yaml:"result_label_tweaks,omitempty"`
+	// WithinReferenceRange replaces the comparison with the reference by a plausibility check.
+	WithinReferenceRange *RangeAssertion `yaml:"within_reference_range,omitempty"`
+	// SameAs replaces the comparison with the reference by an internal consistency check: the test
+	// target's result of the query must equal its result of SameAs, e.g. "sum without () (x)" for
+	// "sum(x)". SameAs is expanded with the same variant args as the query.
+	SameAs string `yaml:"same_as,omitempty"`
+	// SeriesAllowance overrides the default series allowance for this test case.
+	SeriesAllowance *SeriesAllowance `yaml:"series_allowance,omitempty"`
+	// TimeParameterSets restricts the test case to the named query time parameter sets. By default,
+	// it runs with all of them.
+	TimeParameterSets []string `yaml:"time_parameter_sets,omitempty"`
+	// PinWindow keeps the configured window of the test case, without shifting it by -time-jitter.
+	PinWindow bool `yaml:"pin_window,omitempty"`
+	// ExpectNativeHistograms compares the native histogram samples of the results structurally,
+	// and fails the test case if a target returns float samples where the other returns histograms.
+	ExpectNativeHistograms bool `yaml:"expect_native_histograms,omitempty"`
+}
+
+// A RangeAssertion passes a test case if each series' current value on the test target lies within
+// the range of values that the reference returned for the series over a lookback window.
+type RangeAssertion struct {
+	LookbackSeconds float64 `yaml:"lookback_seconds" json:"lookbackSeconds"`
+	// Margin widens the observed range by an absolute amount on both sides, and RelativeMargin
+	// by a fraction of the observed range's width.
+	Margin         float64 `yaml:"margin,omitempty" json:"margin,omitempty"`
+	RelativeMargin float64 `yaml:"relative_margin,omitempty" json:"relativeMargin,omitempty"`
+}
+
+// A SeriesAllowance lets a test case pass structurally when only a few series are present in just
+// one of the results, as long as the series that both results contain match. Values below 1 are
+// fractions of the number of reference series, values of 1 or more are absolute numbers of series.
+type SeriesAllowance struct {
+	// MaxExtraSeries bounds the series that are only in the test result.
+	MaxExtraSeries float64 `yaml:"max_extra_series,omitempty" json:"maxExtraSeries,omitempty"`
+	// MaxMissingSeries bounds the series that are only in the reference result.
+	MaxMissingSeries float64 `yaml:"max_missing_series,omitempty" json:"maxMissingSeries,omitempty"`
+}
+
+// Allowed returns the numbers of extra and missing series that are allowed for a reference result
+// with the given number of series. Fractional allowances are rounded down.
+func (a *SeriesAllowance) Allowed(refSeries int) (extra, missing int) {
+	if a == nil {
+		return 0, 0
+	}
+	resolve := func(v float64) int {
+		if v < 1 {
+			return int(math.Floor(v * float64(refSeries)))
+		}
+		return int(v)
+	}
+	return resolve(a.MaxExtraSeries), resolve(a.MaxMissingSeries)
+}
+
+func (a *SeriesAllowance) validate() error {
+	for _, v := range []float64{a.MaxExtraSeries, a.MaxMissingSeries} {
+		if v < 0 {
+			return errors.New("max_extra_series and max_missing_series must not be negative")
+		}
+		if v >= 1 && v != math.Trunc(v) {
+			return errors.Errorf("absolute series allowance %v must be a whole number", v)
+		}
+	}
+	return nil
 }
 
+// TagRegexp matches valid test case tags.
+var TagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.:-]+$`)
+
+// QueryType is the type of API query to run for a test case.
+type QueryType string
+
+// Valid QueryType values.
+const (
+	QueryTypeRange   QueryType = "range"
+	QueryTypeInstant QueryType = "instant"
+)
+
 // LoadFromFile parses the given YAML file into a Config.
 func LoadFromFile(filename string) (*Config, error) {
+	return LoadFromFileLenient(filename, false)
+}
+
+// LoadFromFileLenient parses the given YAML file into a Config like LoadFromFile. If lenient is
+// set, invalid test case entries are skipped and listed in InvalidTestCases, as with
+// on_invalid_case: skip.
+func LoadFromFileLenient(filename string, lenient bool) (*Config, error) {
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	cfg, err := Load(content)
+	cfg, err := load(content, filename, lenient)
 	if err != nil {
 		return nil, errors.Wrapf(err, "parsing YAML file %s", filename)
 	}
 	return cfg, nil
 }
 
-// Load parses the YAML input into a Config.
+// Load parses the YAML input into a Config. Relative include_test_cases globs are resolved
+// relative to the current working directory.
 func Load(content []byte) (*Config, error) {
+	return load(content, "", false)
+}
+
+// load parses the YAML input of the configuration file with the given name into a Config. If
+// lenient is set or the input sets on_invalid_case: skip, invalid test case entries are skipped.
+func load(content []byte, filename string, lenient bool) (*Config, error) {
 	cfg := &Config{}
+	lenient = lenient || onInvalidCase(content) == InvalidCaseSkip
+	var (
+		cases   []*TestCase
+		invalid []InvalidTestCase
+		// origins records where the test cases were defined, if invalid ones are skipped.
+		origins map[*TestCase]InvalidTestCase
+	)
+	if lenient {
+		var err error
+		source := filename
+		if source == "" {
+			source = "the main configuration"
+		}
+		origins = map[*TestCase]InvalidTestCase{}
+		content, cases, invalid, err = splitTestCases(content, source, origins)
+		if err != nil {
+			return nil, err
+		}
+	}
 	err := yaml.UnmarshalStrict(content, cfg)
 	if err != nil {
 		return nil, err
 	}
+	if lenient {
+		cfg.TestCases, cfg.InvalidTestCases, cfg.OnInvalidCase = cases, invalid, InvalidCaseSkip
+	}
+	if cfg.Requires != nil {
+		cfg.Requires.Source = filename
+		if filename == "" {
+			cfg.Requires.Source = "the main configuration"
+		}
+	}
+	if err := cfg.includeTestCases(filename, origins); err != nil {
+		return nil, err
+	}
+	if err := cfg.expandTargetSecrets(filename); err != nil {
+		return nil, err
+	}
+	// Unset settings get their defaults here, while Validate reports all invalid settings at once.
+	if cfg.OnInvalidCase == "" {
+		cfg.OnInvalidCase = InvalidCaseError
+	}
+	if cfg.DifferingErrorsPolicy == "" {
+		cfg.DifferingErrorsPolicy = ErrorPolicyPass
+	}
+	if cfg.MaxExpansionsPerCase == 0 {
+		cfg.MaxExpansionsPerCase = defaultMaxExpansionsPerCase
+	}
+	if cfg.InstantNaNVsMissing == "" {
+		cfg.InstantNaNVsMissing = NaNMissingPolicyDistinct
+	}
+	if cfg.ResponseHeaders == nil {
+		cfg.ResponseHeaders = &ResponseHeadersConfig{Capture: DefaultCapturedHeaders, CacheHitPatterns: DefaultCacheHitPatterns}
+	}
+	if cfg.OutOfOrderSamples == "" {
+		cfg.OutOfOrderSamples = OutOfOrderPolicyFail
+	}
+	if cfg.OnEmptyExpansion == "" {
+		cfg.OnEmptyExpansion = EmptyExpansionError
+	}
+	if len(cfg.TestTargetConfigs) == 0 {
+		cfg.TestTargetConfigs = []TargetConfig{cfg.TestTargetConfig}
+	} else {
+		cfg.testTargetConfigsSet = true
+	}
+	for _, t := range cfg.targets() {
+		if t.MaxResponseBytes == 0 {
+			t.MaxResponseBytes = defaultMaxResponseBytes
+		}
+		if t.MaxDecompressedResponseBytes == 0 {
+			t.MaxDecompressedResponseBytes = defaultMaxResponseBytes
+		}
+	}
+	if lenient {
+		cfg.skipInvalidTestCases(origins)
+	}
+	for _, tc := range cfg.TestCases {
+		tc.normalize()
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
+
+// normalize sets the defaults of a test case. Validate reports its invalid settings.
+func (tc *TestCase) normalize() {
+	if tc.Type == "" {
+		tc.Type = tc.QueryType
+	}
+	if tc.Type == "" {
+		tc.Type = QueryTypeRange
+	}
+}
+
+// targets returns the reference, test, and fallback reference targets of the configuration.
+func (c *Config) targets() []*TargetConfig {
+	targets := []*TargetConfig{&c.ReferenceTargetConfig}
+	for i := range c.TestTargetConfigs {
+		targets = append(targets, &c.TestTargetConfigs[i])
+	}
+	for i := range c.ReferenceFallbackTargetConfigs {
+		targets = append(targets, &c.ReferenceFallbackTargetConfigs[i])
+	}
+	return targets
+}
@@ -0,0 +1,44 @@
+package config
+
+import "testing"
+
+func TestRenameTestQuery(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		rename map[string]string
+		query  string
+		want   string
+	}{
+		{
+			name:   "simple rename",
+			rename: map[string]string{`\bnode_cpu_seconds_total\b`: "node_cpu_seconds"},
+			query:  `sum by (mode) (rate(node_cpu_seconds_total[5m]))`,
+			want:   `sum by (mode) (rate(node_cpu_seconds[5m]))`,
+		},
+		{
+			name:   "capture groups",
+			rename: map[string]string{`\b(\w+)_bytes_total\b`: "${1}_bytes", `\binstance="([^"]*)"`: `host="$1"`},
+			query:  `rate(node_network_receive_bytes_total{instance="demo:9100"}[5m])`,
+			want:   `rate(node_network_receive_bytes{host="demo:9100"}[5m])`,
+		},
+		{
+			// The expressions are applied in sorted order, so the second sees the result of the first.
+			name:   "chained renames",
+			rename: map[string]string{"a_total": "b_total", "b_total": "c"},
+			query:  "a_total",
+			want:   "c",
+		},
+		{
+			name:   "invalid expression",
+			rename: map[string]string{"(": "x"},
+			query:  "demo",
+			want:   "demo",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := RenameTestQuery(tc.query, []*QueryTweak{{Rename: tc.rename}}); got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
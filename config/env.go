@@ -0,0 +1,127 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// UnsetEnvVar is a reference to an unset environment variable in a target setting, which expanded
+// to an empty string since strict_env_expansion is not set.
+type UnsetEnvVar struct {
+	// Variable is the name of the environment variable.
+	Variable string
+	// Field names the setting and its target, e.g. basic_auth_pass of test_target_config.
+	Field string
+}
+
+// expandEnv replaces ${VAR} and $VAR references in s by the values of the environment variables,
+// and $$ by a literal $. If strict is set, a reference to an unset variable is an error naming it.
+// Otherwise, the unset variables are returned.
+func expandEnv(s string, strict bool) (string, []string, error) {
+	var unset []string
+	expanded := os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return v
+	})
+	if strict && len(unset) > 0 {
+		return "", nil, errors.Errorf("environment variable %q is not set", unset[0])
+	}
+	return expanded, unset, nil
+}
+
+// expandTargetSecrets expands environment variable references in the URLs, headers, and credentials
+// of all targets and reads basic auth passwords from their basic_auth_pass_file. Test case queries
+// are not expanded. References to unset variables are recorded in UnsetEnvVars, unless
+// strict_env_expansion makes them an error. Relative password files are resolved relative to the
+// directory of the configuration file with the given name.
+func (c *Config) expandTargetSecrets(filename string) error {
+	names := []string{"reference_target_config", "test_target_config"}
+	targets := []*TargetConfig{&c.ReferenceTargetConfig, &c.TestTargetConfig}
+	for i := range c.TestTargetConfigs {
+		names = append(names, fmt.Sprintf("test_target_configs entry %d", i+1))
+		targets = append(targets, &c.TestTargetConfigs[i])
+	}
+	for i := range c.ReferenceFallbackTargetConfigs {
+		names = append(names, fmt.Sprintf("reference_fallback_target_configs entry %d", i+1))
+		targets = append(targets, &c.ReferenceFallbackTargetConfigs[i])
+	}
+	for i, t := range targets {
+		unset, err := t.expandSecrets(filename, c.StrictEnvExpansion)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", names[i])
+		}
+		for _, u := range unset {
+			u.Field += " of " + names[i]
+			c.UnsetEnvVars = append(c.UnsetEnvVars, u)
+		}
+	}
+	return nil
+}
+
+// expandSecrets expands the settings of the target and returns the references to unset variables,
+// with the fields that they are in.
+func (t *TargetConfig) expandSecrets(filename string, strict bool) ([]UnsetEnvVar, error) {
+	var unset []UnsetEnvVar
+	fields := []string{"query_url", "basic_auth_user", "basic_auth_pass", "basic_auth_pass_file", "bearer_token"}
+	values := []*string{&t.QueryURL, &t.BasicAuthUser, &t.BasicAuthPass, &t.BasicAuthPassFile, &t.BearerToken}
+	if t.OAuth2 != nil {
+		fields = append(fields, "oauth2.client_id", "oauth2.client_secret", "oauth2.token_url")
+		values = append(values, &t.OAuth2.ClientID, &t.OAuth2.ClientSecret, &t.OAuth2.TokenURL)
+	}
+	for i, v := range values {
+		expanded, vars, err := expandEnv(*v, strict)
+		if err != nil {
+			return nil, errors.Wrap(err, fields[i])
+		}
+		for _, name := range vars {
+			unset = append(unset, UnsetEnvVar{Variable: name, Field: fields[i]})
+		}
+		*v = expanded
+	}
+	headers := make([]string, 0, len(t.Headers))
+	for h := range t.Headers {
+		headers = append(headers, h)
+	}
+	sort.Strings(headers)
+	for _, h := range headers {
+		v := t.Headers[h]
+		expanded, vars, err := expandEnv(v, strict)
+		if err != nil {
+			return nil, errors.Wrapf(err, "header %q", h)
+		}
+		for _, name := range vars {
+			unset = append(unset, UnsetEnvVar{Variable: name, Field: fmt.Sprintf("header %q", h)})
+		}
+		t.Headers[h] = expanded
+	}
+
+	if t.BasicAuthPassFile == "" {
+		return unset, nil
+	}
+	if t.BasicAuthPass != "" {
+		return nil, errors.New("basic_auth_pass and basic_auth_pass_file are mutually exclusive")
+	}
+	path := t.BasicAuthPassFile
+	if !filepath.IsAbs(path) && filename != "" {
+		path = filepath.Join(filepath.Dir(filename), path)
+	}
+	pass, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading basic_auth_pass_file")
+	}
+	// Secret files often end with a newline that is not part of the password.
+	t.BasicAuthPass = strings.TrimRight(string(pass), "\r\n")
+	return unset, nil
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandTargetSecrets(t *testing.T) {
+	os.Unsetenv("ssw0rd")
+	os.Setenv("PROMQL_COMPLIANCE_TOKEN", "tok")
+	defer os.Unsetenv("PROMQL_COMPLIANCE_TOKEN")
+
+	for _, tc := range []struct {
+		name     string
+		pass     string
+		strict   bool
+		expected string
+		unset    []UnsetEnvVar
+		err      string
+	}{
+		{
+			name:     "literal dollar",
+			pass:     "p$ssw0rd",
+			expected: "p",
+			unset:    []UnsetEnvVar{{Variable: "ssw0rd", Field: "basic_auth_pass of test_target_config"}},
+		},
+		{
+			name:     "escaped dollar",
+			pass:     "p$$ssw0rd",
+			expected: "p$ssw0rd",
+		},
+		{
+			name:     "set variable",
+			pass:     "${PROMQL_COMPLIANCE_TOKEN}",
+			expected: "tok",
+		},
+		{
+			name:   "literal dollar with strict expansion",
+			pass:   "p$ssw0rd",
+			strict: true,
+			err:    `invalid test_target_config: basic_auth_pass: environment variable "ssw0rd" is not set`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Config{
+				ReferenceTargetConfig: TargetConfig{QueryURL: "http://localhost:9090"},
+				TestTargetConfig:      TargetConfig{QueryURL: "http://localhost:4000", BasicAuthUser: "tester", BasicAuthPass: tc.pass},
+				StrictEnvExpansion:    tc.strict,
+			}
+			err := c.expandTargetSecrets("")
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.TestTargetConfig.BasicAuthPass; got != tc.expected {
+				t.Errorf("expected password %q, got %q", tc.expected, got)
+			}
+			if !reflect.DeepEqual(c.UnsetEnvVars, tc.unset) {
+				t.Errorf("expected unset variables %+v, got %+v", tc.unset, c.UnsetEnvVars)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// testCasesFile models a file included by include_test_cases.
+type testCasesFile struct {
+	TestCases []*TestCase   `yaml:"test_cases"`
+	Requires  *Requirements `yaml:"requires,omitempty"`
+}
+
+// testCaseKey identifies a test case for duplicate detection.
+type testCaseKey struct {
+	query      string
+	typ        QueryType
+	evalOffset float64
+}
+
+func keyOf(tc *TestCase) testCaseKey {
+	typ := tc.Type
+	if typ == "" {
+		typ = tc.QueryType
+	}
+	if typ == "" {
+		typ = QueryTypeRange
+	}
+	return testCaseKey{query: tc.Query, typ: typ, evalOffset: tc.EvalTimeOffsetSeconds}
+}
+
+// includeTestCases appends the test cases of the files matching the IncludeTestCases globs, in
+// order, to TestCases. Relative globs are resolved relative to the directory of the configuration
+// file with the given name. It returns an error if a glob matches no files or if a test case is
+// defined more than once. The requirements that the files declare are appended to
+// IncludedRequirements. If origins is set, invalid test case entries are skipped and appended to
+// InvalidTestCases, and origins records where the valid ones were defined.
+func (c *Config) includeTestCases(filename string, origins map[*TestCase]InvalidTestCase) error {
+	mainSource := filename
+	if mainSource == "" {
+		mainSource = "the main configuration"
+	}
+	sources := make(map[testCaseKey]string, len(c.TestCases))
+	add := func(tc *TestCase, source string) error {
+		k := keyOf(tc)
+		if first, ok := sources[k]; ok {
+			return errors.Errorf("duplicate %s test case %q in %s, first defined in %s", k.typ, tc.Query, source, first)
+		}
+		sources[k] = source
+		return nil
+	}
+	for _, tc := range c.TestCases {
+		if err := add(tc, mainSource); err != nil {
+			return err
+		}
+	}
+
+	included := map[string]bool{}
+	for _, pattern := range c.IncludeTestCases {
+		if !filepath.IsAbs(pattern) && filename != "" {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "invalid include_test_cases glob %q", pattern)
+		}
+		if len(files) == 0 {
+			return errors.Errorf("include_test_cases glob %q matches no files", pattern)
+		}
+		for _, file := range files {
+			if included[file] {
+				continue
+			}
+			included[file] = true
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			var f testCasesFile
+			if origins != nil {
+				rest, cases, invalid, err := splitTestCases(content, file, origins)
+				if err == nil {
+					err = yaml.UnmarshalStrict(rest, &f)
+				}
+				if err != nil {
+					return errors.Wrapf(err, "parsing test cases file %s", file)
+				}
+				f.TestCases = cases
+				c.InvalidTestCases = append(c.InvalidTestCases, invalid...)
+			} else if err := yaml.UnmarshalStrict(content, &f); err != nil {
+				return errors.Wrapf(err, "parsing test cases file %s", file)
+			}
+			for _, tc := range f.TestCases {
+				if err := add(tc, file); err != nil {
+					return err
+				}
+			}
+			c.TestCases = append(c.TestCases, f.TestCases...)
+			if f.Requires != nil {
+				f.Requires.Source = file
+				c.IncludedRequirements = append(c.IncludedRequirements, f.Requires)
+			}
+		}
+	}
+	return nil
+}
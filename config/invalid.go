@@ -0,0 +1,171 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// InvalidCasePolicy decides what happens to test case entries that cannot be loaded.
+type InvalidCasePolicy string
+
+// Valid InvalidCasePolicy values.
+const (
+	// InvalidCaseError fails loading the configuration at the first invalid test case entry.
+	InvalidCaseError InvalidCasePolicy = "error"
+	// InvalidCaseSkip skips invalid test case entries and records them in InvalidTestCases.
+	InvalidCaseSkip InvalidCasePolicy = "skip"
+)
+
+// An InvalidTestCase is a test case entry that was skipped since it could not be loaded.
+type InvalidTestCase struct {
+	File string `json:"file"`
+	// Line is the line of the file at which the entry starts, if it was found.
+	Line int `json:"line,omitempty"`
+	// Index is the 1-based index of the entry in the test cases of the file.
+	Index  int    `json:"index"`
+	Query  string `json:"query,omitempty"`
+	Reason string `json:"reason"`
+}
+
+func (tc InvalidTestCase) String() string {
+	loc := tc.File
+	if tc.Line > 0 {
+		loc = fmt.Sprintf("%s:%d", tc.File, tc.Line)
+	}
+	if tc.Query != "" {
+		return fmt.Sprintf("%s: test case %d (%q): %s", loc, tc.Index, tc.Query, tc.Reason)
+	}
+	return fmt.Sprintf("%s: test case %d: %s", loc, tc.Index, tc.Reason)
+}
+
+// yamlLineRegexp matches the line numbers in YAML errors, which refer to the re-encoded entry
+// rather than to the file.
+var yamlLineRegexp = regexp.MustCompile(`line \d+: `)
+
+// onInvalidCase returns the on_invalid_case setting of a configuration file, or an empty string
+// if it is not set or the file cannot be parsed.
+func onInvalidCase(content []byte) InvalidCasePolicy {
+	var c struct {
+		OnInvalidCase InvalidCasePolicy `yaml:"on_invalid_case"`
+	}
+	yaml.Unmarshal(content, &c)
+	return c.OnInvalidCase
+}
+
+// splitTestCases decodes the test_cases entries of a YAML document one by one, so that an invalid
+// entry does not fail the others. It returns the document without its test cases, the valid test
+// cases, and the invalid ones, and records in origins where the valid ones were defined in file.
+func splitTestCases(content []byte, file string, origins map[*TestCase]InvalidTestCase) ([]byte, []*TestCase, []InvalidTestCase, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, nil, nil, err
+	}
+	var entries []interface{}
+	for i, item := range doc {
+		if item.Key != "test_cases" {
+			continue
+		}
+		list, ok := item.Value.([]interface{})
+		if !ok && item.Value != nil {
+			return nil, nil, nil, errors.Errorf("test_cases must be a list, not %T", item.Value)
+		}
+		entries = list
+		doc[i].Value = []interface{}{}
+	}
+	rest, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	lines := testCaseLines(content)
+	var (
+		cases   []*TestCase
+		invalid []InvalidTestCase
+	)
+	for i, entry := range entries {
+		origin := InvalidTestCase{File: file, Index: i + 1}
+		if i < len(lines) {
+			origin.Line = lines[i]
+		}
+		// Entries of a document decoded into a MapSlice are MapSlices themselves.
+		if m, ok := entry.(yaml.MapSlice); ok {
+			for _, item := range m {
+				if q, ok := item.Value.(string); ok && item.Key == "query" {
+					origin.Query = q
+				}
+			}
+		}
+		tc := &TestCase{}
+		buf, err := yaml.Marshal(entry)
+		if err == nil {
+			err = yaml.UnmarshalStrict(buf, tc)
+		}
+		if err != nil {
+			origin.Reason = yamlLineRegexp.ReplaceAllString(strings.TrimPrefix(err.Error(), "yaml: unmarshal errors:\n  "), "")
+			invalid = append(invalid, origin)
+			continue
+		}
+		origins[tc] = origin
+		cases = append(cases, tc)
+	}
+	return rest, cases, invalid, nil
+}
+
+// testCaseLines returns the lines at which the entries of the top-level test_cases list of a YAML
+// document start. Lists in flow style are not recognized.
+func testCaseLines(content []byte) []int {
+	var lines []int
+	inList, indent := false, -1
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		trimmed := bytes.TrimLeft(line, " ")
+		if len(bytes.TrimSpace(trimmed)) == 0 || trimmed[0] == '#' {
+			continue
+		}
+		lineIndent := len(line) - len(trimmed)
+		if !inList {
+			inList = lineIndent == 0 && bytes.HasPrefix(bytes.TrimSpace(line), []byte("test_cases:")) && len(bytes.TrimSpace(line)) == len("test_cases:")
+			continue
+		}
+		isItem := bytes.HasPrefix(trimmed, []byte("- ")) || bytes.Equal(bytes.TrimSpace(trimmed), []byte("-"))
+		if indent < 0 {
+			if !isItem {
+				return lines
+			}
+			indent = lineIndent
+		}
+		switch {
+		case lineIndent < indent, lineIndent == indent && !isItem:
+			return lines
+		case lineIndent == indent:
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+// skipInvalidTestCases moves the test cases whose settings are invalid from TestCases to
+// InvalidTestCases, with their origins.
+func (c *Config) skipInvalidTestCases(origins map[*TestCase]InvalidTestCase) {
+	sets := map[string]bool{}
+	for _, p := range c.QueryTimeParameters {
+		sets[p.Name] = true
+	}
+	valid := c.TestCases[:0]
+	for _, tc := range c.TestCases {
+		tc.normalize()
+		problems := tc.problems(sets)
+		if len(problems) == 0 {
+			valid = append(valid, tc)
+			continue
+		}
+		origin := origins[tc]
+		origin.Query, origin.Reason = tc.Query, strings.Join(problems, "; ")
+		c.InvalidTestCases = append(c.InvalidTestCases, origin)
+	}
+	c.TestCases = valid
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// RequirementsPolicy decides what happens when the reference target lacks data that test cases require.
+type RequirementsPolicy string
+
+// Valid RequirementsPolicy values.
+const (
+	// RequirementsFail exits without running the test cases.
+	RequirementsFail RequirementsPolicy = "fail"
+	// RequirementsWarn logs the unmet requirements and runs the test cases anyway.
+	RequirementsWarn RequirementsPolicy = "warn"
+)
+
+// MetricType is the type of a required metric, which decides the series that are looked for.
+type MetricType string
+
+// Valid MetricType values.
+const (
+	MetricTypeCounter   MetricType = "counter"
+	MetricTypeGauge     MetricType = "gauge"
+	MetricTypeHistogram MetricType = "histogram"
+	MetricTypeSummary   MetricType = "summary"
+)
+
+var (
+	metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRegexp  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Requirements declares the data that the test cases of a file need the reference target to have,
+// e.g. the metrics of the PromLabs demo dataset.
+type Requirements struct {
+	// Dataset names the data that satisfies the requirements in messages about unmet ones, e.g.
+	// "the PromLabs demo dataset".
+	Dataset string               `yaml:"dataset,omitempty" json:"dataset,omitempty"`
+	Metrics []*MetricRequirement `yaml:"metrics" json:"metrics"`
+	// OnUnmet defaults to RequirementsFail.
+	OnUnmet RequirementsPolicy `yaml:"on_unmet,omitempty" json:"onUnmet,omitempty"`
+	// Source is the file that declares the requirements.
+	Source string `yaml:"-" json:"source"`
+}
+
+// A MetricRequirement declares a metric, the labels that its series must have, and how many series
+// it must have at least. Histograms are looked for by their _bucket series with an le label, and
+// summaries by their series with a quantile label.
+type MetricRequirement struct {
+	Name   string     `yaml:"name" json:"name"`
+	Type   MetricType `yaml:"type,omitempty" json:"type,omitempty"`
+	Labels []string   `yaml:"labels,omitempty" json:"labels,omitempty"`
+	// MinSeries defaults to 1.
+	MinSeries int `yaml:"min_series,omitempty" json:"minSeries,omitempty"`
+}
+
+// Requirements returns the requirements declared by the configuration file and by the included
+// test case files, in that order.
+func (c *Config) Requirements() []*Requirements {
+	var reqs []*Requirements
+	if c.Requires != nil {
+		reqs = append(reqs, c.Requires)
+	}
+	return append(reqs, c.IncludedRequirements...)
+}
+
+// problems returns the problems of the requirements that Validate reports.
+func (r *Requirements) problems() []string {
+	var problems []string
+	if len(r.Metrics) == 0 {
+		problems = append(problems, "lists no metrics")
+	}
+	switch r.OnUnmet {
+	case "", RequirementsFail, RequirementsWarn:
+	default:
+		problems = append(problems, fmt.Sprintf("has an invalid on_unmet %q, valid values are %s and %s", r.OnUnmet, RequirementsFail, RequirementsWarn))
+	}
+	for i, m := range r.Metrics {
+		if m == nil || !metricNameRegexp.MatchString(m.Name) {
+			name := ""
+			if m != nil {
+				name = m.Name
+			}
+			problems = append(problems, fmt.Sprintf("metric %d has the invalid name %q", i+1, name))
+			continue
+		}
+		switch m.Type {
+		case "", MetricTypeCounter, MetricTypeGauge, MetricTypeHistogram, MetricTypeSummary:
+		default:
+			problems = append(problems, fmt.Sprintf("metric %s has an invalid type %q, valid types are %s, %s, %s, and %s", m.Name, m.Type, MetricTypeCounter, MetricTypeGauge, MetricTypeHistogram, MetricTypeSummary))
+		}
+		for _, l := range m.Labels {
+			if !labelNameRegexp.MatchString(l) {
+				problems = append(problems, fmt.Sprintf("metric %s requires the invalid label name %q", m.Name, l))
+			}
+		}
+		if m.MinSeries < 0 {
+			problems = append(problems, fmt.Sprintf("metric %s has a negative min_series %d", m.Name, m.MinSeries))
+		}
+	}
+	return problems
+}
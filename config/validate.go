@@ -0,0 +1,313 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Validate checks the configuration for problems that would otherwise only show up as failing or
+// meaningless queries, and returns an error listing all of them.
+func (c *Config) Validate() error {
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch c.OnInvalidCase {
+	case "", InvalidCaseError, InvalidCaseSkip:
+	default:
+		addProblem("on_invalid_case %q is invalid, valid values are %s and %s", c.OnInvalidCase, InvalidCaseError, InvalidCaseSkip)
+	}
+	switch c.DifferingErrorsPolicy {
+	case "", ErrorPolicyPass, ErrorPolicyWarn, ErrorPolicyFail:
+	default:
+		addProblem("differing_errors_policy %q is invalid, valid values are %s, %s, and %s", c.DifferingErrorsPolicy, ErrorPolicyPass, ErrorPolicyWarn, ErrorPolicyFail)
+	}
+	switch c.InstantNaNVsMissing {
+	case "", NaNMissingPolicyDistinct, NaNMissingPolicyEqual:
+	default:
+		addProblem("instant_nan_vs_missing %q is invalid, valid values are %s and %s", c.InstantNaNVsMissing, NaNMissingPolicyDistinct, NaNMissingPolicyEqual)
+	}
+	switch c.OutOfOrderSamples {
+	case "", OutOfOrderPolicyFail, OutOfOrderPolicySort:
+	default:
+		addProblem("out_of_order_samples %q is invalid, valid values are %s and %s", c.OutOfOrderSamples, OutOfOrderPolicyFail, OutOfOrderPolicySort)
+	}
+	switch c.OnEmptyExpansion {
+	case "", EmptyExpansionError, EmptyExpansionSkipWithWarning:
+	default:
+		addProblem("on_empty_expansion %q is invalid, valid values are %s and %s", c.OnEmptyExpansion, EmptyExpansionError, EmptyExpansionSkipWithWarning)
+	}
+	for _, rate := range []struct {
+		name  string
+		value float64
+	}{
+		{"label_conformance_sample_rate", c.LabelConformanceSampleRate},
+		{"exactness_audit_sample_rate", c.ExactnessAuditSampleRate},
+		{"request_parity_sample_rate", c.RequestParitySampleRate},
+	} {
+		if rate.value < 0 || rate.value > 1 {
+			addProblem("%s %v must be between 0 and 1", rate.name, rate.value)
+		}
+	}
+	if a := c.SeriesAllowance; a != nil {
+		if err := a.validate(); err != nil {
+			addProblem("series_allowance is invalid: %v", err)
+		}
+	}
+	if c.MaxExpansionsPerCase < 0 {
+		addProblem("max_expansions_per_case %d must not be negative", c.MaxExpansionsPerCase)
+	}
+	overridden := make([]string, 0, len(c.PlaceholderOverrides))
+	for name := range c.PlaceholderOverrides {
+		overridden = append(overridden, name)
+	}
+	sort.Strings(overridden)
+	for _, name := range overridden {
+		if o := c.PlaceholderOverrides[name]; o == nil || (len(o.IncludeOnly) == 0 && len(o.Exclude) == 0) {
+			addProblem("placeholder_overrides of %q sets neither include_only nor exclude", name)
+		}
+	}
+	if t := c.Tolerance; t != nil && (t.Relative < 0 || t.Absolute < 0) {
+		addProblem("tolerance relative and absolute must not be negative")
+	}
+
+	checkRetry := func(name string, r RetryConfig) {
+		if r.MaxRetries < 0 || r.BaseDelaySeconds < 0 {
+			addProblem("%s max_retries and base_delay_seconds must not be negative", name)
+		}
+		if r.BreakerFailures < 0 || r.BreakerCooldownSeconds < 0 {
+			addProblem("%s breaker_failures and breaker_cooldown_seconds must not be negative", name)
+		}
+	}
+	checkRetry("retry_config", c.RetryConfig)
+
+	checkTarget := func(name string, t TargetConfig) {
+		if err := t.validateAuth(); err != nil {
+			addProblem("%s is invalid: %v", name, err)
+		}
+		if t.RetryConfig != nil {
+			checkRetry(name+".retry_config", *t.RetryConfig)
+		}
+		if t.MaxResponseBytes < 0 || t.MaxDecompressedResponseBytes < 0 {
+			addProblem("%s response size limits must not be negative", name)
+		}
+		switch t.HTTPMethod {
+		case "", HTTPMethodGet, HTTPMethodPost:
+		default:
+			addProblem("%s has an invalid http_method %q, valid methods are %s and %s", name, t.HTTPMethod, HTTPMethodGet, HTTPMethodPost)
+		}
+		if t.MaxQueriesPerSecond < 0 {
+			addProblem("%s max_queries_per_second %v must not be negative", name, t.MaxQueriesPerSecond)
+		}
+		if ch := t.Chaos; ch != nil {
+			if ch.DropEvery < 0 {
+				addProblem("%s.chaos.drop_every %d must not be negative", name, ch.DropEvery)
+			}
+			if ch.DelaySeconds < 0 {
+				addProblem("%s.chaos.delay_seconds %v must not be negative", name, ch.DelaySeconds)
+			}
+			if ch.FaultRate < 0 || ch.FaultRate > 1 {
+				addProblem("%s.chaos.fault_rate %v must be between 0 and 1", name, ch.FaultRate)
+			}
+			for _, f := range ch.Faults {
+				switch f {
+				case ChaosFaultUnavailable, ChaosFaultRateLimited, ChaosFaultMalformed:
+				default:
+					addProblem("%s.chaos has an invalid fault %q, valid faults are %s, %s, and %s", name, f, ChaosFaultUnavailable, ChaosFaultRateLimited, ChaosFaultMalformed)
+				}
+			}
+		}
+		if t.FixtureFile != "" {
+			return
+		}
+		if t.QueryURL == "" {
+			addProblem("%s has neither a query_url nor a fixture_file", name)
+			return
+		}
+		if u, err := url.Parse(t.QueryURL); err != nil {
+			addProblem("%s has an invalid query_url %q: %v", name, t.QueryURL, err)
+		} else if u.Scheme == "" || u.Host == "" {
+			addProblem("%s has an invalid query_url %q: must be an absolute URL like http://localhost:9090", name, t.QueryURL)
+		}
+	}
+	checkTarget("reference_target_config", c.ReferenceTargetConfig)
+	if c.testTargetConfigsSet && (c.TestTargetConfig.QueryURL != "" || c.TestTargetConfig.FixtureFile != "") {
+		addProblem("test_target_config and test_target_configs are mutually exclusive")
+	}
+	testTargetNames := map[string]bool{}
+	for i, t := range c.TestTargetConfigs {
+		if len(c.TestTargetConfigs) == 1 && t.Name == "" {
+			checkTarget("test_target_config", t)
+		} else {
+			checkTarget(fmt.Sprintf("test target %d (%q)", i+1, t.DisplayName()), t)
+		}
+		if testTargetNames[t.DisplayName()] {
+			addProblem("test_target_configs entry %d has the duplicate name %q", i+1, t.DisplayName())
+		}
+		testTargetNames[t.DisplayName()] = true
+	}
+	for i, t := range c.ReferenceFallbackTargetConfigs {
+		checkTarget(fmt.Sprintf("reference_fallback_target_configs entry %d", i+1), t)
+	}
+
+	sets := map[string]bool{}
+	for i, p := range c.QueryTimeParameters {
+		name := "query_time_parameters"
+		if len(c.QueryTimeParameters) > 1 {
+			name = fmt.Sprintf("query_time_parameters entry %d", i+1)
+			switch {
+			case p.Name == "":
+				addProblem("%s has no name, which is required if several parameter sets are configured", name)
+			case sets[p.Name]:
+				addProblem("%s has the duplicate name %q", name, p.Name)
+			}
+		}
+		sets[p.Name] = true
+		if p.RangeInSeconds < 0 {
+			addProblem("%s.range_in_seconds %v must not be negative", name, p.RangeInSeconds)
+		}
+		if p.ResolutionInSeconds < 0 {
+			addProblem("%s.resolution_in_seconds %v must not be negative", name, p.ResolutionInSeconds)
+		}
+	}
+
+	if c.ErrorMatchRegexp != "" {
+		if _, err := regexp.Compile(c.ErrorMatchRegexp); err != nil {
+			addProblem("error_match_regexp %q is invalid: %v", c.ErrorMatchRegexp, err)
+		}
+	}
+
+	if rh := c.ResponseHeaders; rh != nil {
+		for i, h := range rh.Capture {
+			if strings.TrimSpace(h) == "" {
+				addProblem("response_headers.capture entry %d is empty", i+1)
+			}
+		}
+		for h, p := range rh.CacheHitPatterns {
+			if _, err := regexp.Compile(p); err != nil {
+				addProblem("response_headers.cache_hit_patterns of %q is invalid: %v", h, err)
+			}
+		}
+	}
+
+	for i, tc := range c.TestCases {
+		for _, p := range tc.problems(sets) {
+			if strings.TrimSpace(tc.Query) == "" {
+				addProblem("test case %d %s", i+1, p)
+			} else {
+				addProblem("test case %d (%q) %s", i+1, tc.Query, p)
+			}
+		}
+	}
+
+	if ip := c.IngestionParity; ip != nil {
+		if len(ip.Selectors) == 0 {
+			addProblem("ingestion_parity has no selectors")
+		}
+		for i, sel := range ip.Selectors {
+			if strings.TrimSpace(sel) == "" {
+				addProblem("ingestion_parity selector %d is empty", i+1)
+			}
+		}
+		if ip.WindowSeconds < 0 {
+			addProblem("ingestion_parity.window_seconds %v must not be negative", ip.WindowSeconds)
+		}
+		if ip.MinParityPercent < 0 || ip.MinParityPercent > 100 {
+			addProblem("ingestion_parity.min_parity_percent %v must be between 0 and 100", ip.MinParityPercent)
+		}
+		switch ip.OnLowParity {
+		case "", IngestionParityWarn, IngestionParityGate:
+		default:
+			addProblem("ingestion_parity has an invalid on_low_parity %q, valid values are %s and %s", ip.OnLowParity, IngestionParityWarn, IngestionParityGate)
+		}
+	}
+
+	for _, r := range c.Requirements() {
+		for _, p := range r.problems() {
+			addProblem("requires of %s %s", r.Source, p)
+		}
+	}
+
+	for i, qt := range c.QueryTweaks {
+		switch qt.SampleAlignment {
+		case "", SampleAlignmentStrict, SampleAlignmentNearest, SampleAlignmentInterpolate, SampleAlignmentSnap:
+		default:
+			addProblem("query tweak %d has an invalid sample_alignment %q, valid values are %s, %s, %s, and %s", i+1, qt.SampleAlignment, SampleAlignmentStrict, SampleAlignmentNearest, SampleAlignmentInterpolate, SampleAlignmentSnap)
+		}
+		if !validLabelTweakScope(qt.ResultLabelsScope) {
+			addProblem("query tweak %d has an invalid result_labels_scope %q", i+1, qt.ResultLabelsScope)
+		}
+		for expr := range qt.Rename {
+			if _, err := regexp.Compile(expr); err != nil {
+				addProblem("query tweak %d has an invalid rename regular expression %q: %v", i+1, expr, err)
+			}
+		}
+	}
+
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return errors.Errorf("invalid configuration: %s", problems[0])
+	default:
+		return errors.Errorf("invalid configuration, found %d problems: %s", len(problems), strings.Join(problems, "; "))
+	}
+}
+
+// problems returns the problems of a test case that Validate reports, given the names of the
+// query time parameter sets.
+func (tc *TestCase) problems(sets map[string]bool) []string {
+	var problems []string
+	if strings.TrimSpace(tc.Query) == "" {
+		problems = append(problems, "has an empty query")
+	}
+	if tc.QueryType != "" && tc.Type != "" && tc.Type != tc.QueryType {
+		problems = append(problems, fmt.Sprintf("has the conflicting type %q and query_type %q", tc.Type, tc.QueryType))
+	}
+	switch tc.Type {
+	case "", QueryTypeRange, QueryTypeInstant:
+	default:
+		problems = append(problems, fmt.Sprintf("has an invalid type %q", tc.Type))
+	}
+	for _, tag := range tc.Tags {
+		if !TagRegexp.MatchString(tag) {
+			problems = append(problems, fmt.Sprintf("has an invalid tag %q", tag))
+		}
+	}
+	if ra := tc.WithinReferenceRange; ra != nil {
+		if ra.LookbackSeconds <= 0 {
+			problems = append(problems, "has a within_reference_range without a positive lookback_seconds")
+		}
+		if ra.Margin < 0 || ra.RelativeMargin < 0 {
+			problems = append(problems, "has negative within_reference_range margins")
+		}
+		if tc.ShouldFail || tc.SkipComparison {
+			problems = append(problems, "combines within_reference_range with should_fail or skip_comparison")
+		}
+	}
+	if tc.SameAs != "" && (tc.WithinReferenceRange != nil || tc.ShouldFail || tc.SkipComparison || tc.ExpectNativeHistograms) {
+		problems = append(problems, "combines same_as with within_reference_range, should_fail, skip_comparison, or expect_native_histograms")
+	}
+	if a := tc.SeriesAllowance; a != nil {
+		if err := a.validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("has an invalid series_allowance: %v", err))
+		}
+	}
+	for _, lt := range tc.ResultLabelTweaks {
+		if !validLabelTweakScope(lt.Scope) {
+			problems = append(problems, fmt.Sprintf("has an invalid result_labels_scope %q", lt.Scope))
+		}
+	}
+	for _, name := range tc.TimeParameterSets {
+		if name == "" || !sets[name] {
+			problems = append(problems, fmt.Sprintf("names the unknown query time parameter set %q", name))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,338 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const validConfig = `
+reference_target_config:
+  query_url: http://localhost:9090
+test_target_config:
+  query_url: http://localhost:4000/v1/prometheus
+query_time_parameters:
+  range_in_seconds: 3600
+  resolution_in_seconds: 10
+test_cases:
+- query: demo_memory_usage_bytes
+`
+
+func TestLoadValidConfig(t *testing.T) {
+	cfg, err := Load([]byte(validConfig))
+	if err != nil {
+		t.Fatalf("expected the configuration to be valid, got %v", err)
+	}
+	if got := cfg.TestCases[0].Type; got != QueryTypeRange {
+		t.Errorf("expected the test case type to default to %q, got %q", QueryTypeRange, got)
+	}
+	if len(cfg.TestTargetConfigs) != 1 || cfg.TestTargetConfigs[0].QueryURL != "http://localhost:4000/v1/prometheus" {
+		t.Errorf("expected test_target_configs to default to test_target_config, got %+v", cfg.TestTargetConfigs)
+	}
+}
+
+func TestLoadInvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:    "empty reference query_url",
+			config:  strings.Replace(validConfig, "query_url: http://localhost:9090", "query_url: ''", 1),
+			wantErr: "reference_target_config has neither a query_url nor a fixture_file",
+		},
+		{
+			name:    "relative test query_url",
+			config:  strings.Replace(validConfig, "query_url: http://localhost:4000/v1/prometheus", "query_url: localhost:4000", 1),
+			wantErr: `test_target_config has an invalid query_url "localhost:4000"`,
+		},
+		{
+			name:    "empty test query_url",
+			config:  strings.Replace(validConfig, "query_url: http://localhost:4000/v1/prometheus", "query_url: ''", 1),
+			wantErr: "test_target_config has neither a query_url nor a fixture_file",
+		},
+		{
+			name:    "unparsable reference query_url",
+			config:  strings.Replace(validConfig, "query_url: http://localhost:9090", "query_url: 'http://localhost:9090/%zz'", 1),
+			wantErr: `reference_target_config has an invalid query_url "http://localhost:9090/%zz"`,
+		},
+		{
+			name:    "negative resolution",
+			config:  strings.Replace(validConfig, "resolution_in_seconds: 10", "resolution_in_seconds: -10", 1),
+			wantErr: "query_time_parameters.resolution_in_seconds -10 must not be negative",
+		},
+		{
+			name:    "negative range",
+			config:  strings.Replace(validConfig, "range_in_seconds: 3600", "range_in_seconds: -1", 1),
+			wantErr: "query_time_parameters.range_in_seconds -1 must not be negative",
+		},
+		{
+			name:    "empty query",
+			config:  validConfig + "- query: ' '\n",
+			wantErr: "test case 2 has an empty query",
+		},
+		{
+			name:    "unknown query tweak type",
+			config:  validConfig + "query_tweaks:\n- sample_alignment: closest\n",
+			wantErr: `query tweak 1 has an invalid sample_alignment "closest"`,
+		},
+		{
+			name:    "invalid rename expression",
+			config:  validConfig + "query_tweaks:\n- rename:\n    'node_(cpu': node_cpu\n",
+			wantErr: `query tweak 1 has an invalid rename regular expression "node_(cpu"`,
+		},
+		{
+			name:    "invalid test case type",
+			config:  validConfig + "- query: up\n  type: range_vector\n",
+			wantErr: `test case 2 ("up") has an invalid type "range_vector"`,
+		},
+		{
+			name:    "invalid policy",
+			config:  validConfig + "differing_errors_policy: ignore\n",
+			wantErr: `differing_errors_policy "ignore" is invalid`,
+		},
+		{
+			name:    "invalid on_empty_expansion",
+			config:  validConfig + "on_empty_expansion: skip\n",
+			wantErr: `on_empty_expansion "skip" is invalid, valid values are error and skip_with_warning`,
+		},
+		{
+			name:    "test_target_config and test_target_configs",
+			config:  validConfig + "test_target_configs:\n- name: a\n  query_url: http://localhost:4001\n",
+			wantErr: "test_target_config and test_target_configs are mutually exclusive",
+		},
+		{
+			name:    "negative max_queries_per_second",
+			config:  strings.Replace(validConfig, "query_url: http://localhost:4000/v1/prometheus", "query_url: http://localhost:4000/v1/prometheus\n  max_queries_per_second: -5", 1),
+			wantErr: "test_target_config max_queries_per_second -5 must not be negative",
+		},
+		{
+			name:    "invalid chaos fault",
+			config:  strings.Replace(validConfig, "query_url: http://localhost:4000/v1/prometheus", "query_url: http://localhost:4000/v1/prometheus\n  chaos:\n    fault_rate: 0.5\n    faults: ['500']", 1),
+			wantErr: `test_target_config.chaos has an invalid fault "500"`,
+		},
+		{
+			name:    "chaos fault_rate above 1",
+			config:  strings.Replace(validConfig, "query_url: http://localhost:9090", "query_url: http://localhost:9090\n  chaos:\n    fault_rate: 2", 1),
+			wantErr: "reference_target_config.chaos.fault_rate 2 must be between 0 and 1",
+		},
+		{
+			name:    "negative breaker_failures",
+			config:  validConfig + "retry_config:\n  max_retries: 3\n  breaker_failures: -1\n",
+			wantErr: "retry_config breaker_failures and breaker_cooldown_seconds must not be negative",
+		},
+		{
+			name:    "negative target breaker_cooldown_seconds",
+			config:  strings.Replace(validConfig, "query_url: http://localhost:9090", "query_url: http://localhost:9090\n  retry_config:\n    breaker_cooldown_seconds: -1", 1),
+			wantErr: "reference_target_config.retry_config breaker_failures and breaker_cooldown_seconds must not be negative",
+		},
+		{
+			name:    "same_as with should_fail",
+			config:  validConfig + "  same_as: demo_memory_usage_bytes offset 0s\n  should_fail: true\n",
+			wantErr: "combines same_as with within_reference_range, should_fail, skip_comparison, or expect_native_histograms",
+		},
+		{
+			name:    "basic auth and bearer token",
+			config:  strings.Replace(validConfig, "query_url: http://localhost:9090", "query_url: http://localhost:9090\n  basic_auth_user: tester\n  bearer_token: token", 1),
+			wantErr: "reference_target_config is invalid: basic_auth_user, bearer_token, and oauth2 are mutually exclusive",
+		},
+		{
+			name:    "bearer token and oauth2",
+			config:  strings.Replace(validConfig, "query_url: http://localhost:4000/v1/prometheus", "query_url: http://localhost:4000/v1/prometheus\n  bearer_token: token\n  oauth2:\n    token_url: http://localhost:8080/token", 1),
+			wantErr: "basic_auth_user, bearer_token, and oauth2 are mutually exclusive",
+		},
+		{
+			name:    "oauth2 without token_url",
+			config:  strings.Replace(validConfig, "query_url: http://localhost:4000/v1/prometheus", "query_url: http://localhost:4000/v1/prometheus\n  oauth2:\n    client_id: tester", 1),
+			wantErr: "oauth2 requires a token_url",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Load([]byte(tc.config))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadReportsAllProblems(t *testing.T) {
+	config := `
+reference_target_config:
+  query_url: ''
+test_target_config:
+  query_url: http://localhost:4000
+  http_method: PUT
+query_time_parameters:
+  resolution_in_seconds: -10
+label_conformance_sample_rate: 2
+max_expansions_per_case: -1
+out_of_order_samples: drop
+test_cases:
+- query: ''
+- query: up
+  type: matrix
+  tags: ['not a tag']
+`
+	_, err := Load([]byte(config))
+	if err == nil {
+		t.Fatal("expected the configuration to be invalid")
+	}
+	want := []string{
+		"found 9 problems",
+		"out_of_order_samples \"drop\" is invalid",
+		"label_conformance_sample_rate 2 must be between 0 and 1",
+		"max_expansions_per_case -1 must not be negative",
+		"reference_target_config has neither a query_url nor a fixture_file",
+		`test_target_config has an invalid http_method "PUT"`,
+		"query_time_parameters.resolution_in_seconds -10 must not be negative",
+		"test case 1 has an empty query",
+		`test case 2 ("up") has an invalid type "matrix"`,
+		`test case 2 ("up") has an invalid tag "not a tag"`,
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("expected the error to contain %q, got %v", w, err)
+		}
+	}
+}
+
+func TestLoadSkipsInvalidTestCases(t *testing.T) {
+	cfg, err := Load([]byte(validConfig + "- query: up\n  type: matrix\non_invalid_case: skip\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.TestCases) != 1 || len(cfg.InvalidTestCases) != 1 {
+		t.Fatalf("expected one valid and one skipped test case, got %d and %d", len(cfg.TestCases), len(cfg.InvalidTestCases))
+	}
+	if got := cfg.InvalidTestCases[0].Reason; !strings.Contains(got, `has an invalid type "matrix"`) {
+		t.Errorf("expected the invalid type to be the reason of skipping the test case, got %q", got)
+	}
+}
+
+func TestLoadFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	valid := filepath.Join(dir, "valid.yml")
+	if err := ioutil.WriteFile(valid, []byte(validConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadFromFile(valid)
+	if err != nil {
+		t.Fatalf("expected the configuration to be valid, got %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected a loaded configuration to validate cleanly, got %v", err)
+	}
+
+	invalid := filepath.Join(dir, "invalid.yml")
+	content := strings.Replace(validConfig, "resolution_in_seconds: 10", "resolution_in_seconds: -10", 1) + "- query: ''\n"
+	if err := ioutil.WriteFile(invalid, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadFromFile(invalid)
+	if err == nil {
+		t.Fatal("expected the configuration to be invalid")
+	}
+	for _, w := range []string{"parsing YAML file " + invalid, "found 2 problems", "resolution_in_seconds -10 must not be negative", "test case 2 has an empty query"} {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("expected the error to contain %q, got %v", w, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg, err := Load([]byte(validConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Problems introduced after loading are found by validating again.
+	cfg.ReferenceTargetConfig.QueryURL = ""
+	cfg.QueryTweaks = append(cfg.QueryTweaks, &QueryTweak{SampleAlignment: "closest"})
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatal("expected the configuration to be invalid")
+	}
+	for _, w := range []string{"reference_target_config has neither a query_url nor a fixture_file", `query tweak 1 has an invalid sample_alignment "closest"`} {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("expected the error to contain %q, got %v", w, err)
+		}
+	}
+}
+
+func TestLoadInvalidTestCaseFixtures(t *testing.T) {
+	const (
+		file     = "testdata/invalid_cases/config.yml"
+		included = "testdata/invalid_cases/included.yml"
+	)
+	_, err := LoadFromFile(file)
+	if err == nil || !strings.Contains(err.Error(), "field unknown_field not found") {
+		t.Fatalf("expected strict loading to fail at the invalid entries, got %v", err)
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The copy of the configuration that skips invalid entries itself includes the fixture by its
+	// absolute path.
+	skipping := filepath.Join(dir, "config.yml")
+	absIncluded, err := filepath.Abs(included)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(skipping, []byte(strings.Replace("on_invalid_case: skip\n"+string(content), "- included.yml", "- "+absIncluded, 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		load   func() (*Config, error)
+		file   string
+		offset int
+	}{
+		{name: "-lenient-config", load: func() (*Config, error) { return LoadFromFileLenient(file, true) }, file: file},
+		// The on_invalid_case line shifts the lines of the main configuration by one.
+		{name: "on_invalid_case: skip", load: func() (*Config, error) { return LoadFromFileLenient(skipping, false) }, file: skipping, offset: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := tc.load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var queries []string
+			for _, c := range cfg.TestCases {
+				queries = append(queries, c.Query)
+			}
+			if want := []string{"demo_memory_usage_bytes", "rate(demo_cpu_usage_seconds_total[5m])", "demo_num_cpus"}; !reflect.DeepEqual(queries, want) {
+				t.Errorf("expected the valid test cases %q, got %q", want, queries)
+			}
+			includedFile := included
+			if tc.offset > 0 {
+				includedFile = absIncluded
+			}
+			want := []InvalidTestCase{
+				{File: tc.file, Line: 13 + tc.offset, Index: 2, Query: "{{.simpleAggrOp}}(demo_memory_usage_bytes)", Reason: "cannot unmarshal !!str `simpleA...` into []string"},
+				{File: tc.file, Line: 15 + tc.offset, Index: 3, Query: "up", Reason: "field unknown_field not found in type config.TestCase"},
+				{File: includedFile, Line: 3, Index: 2, Query: "demo_disk_usage_bytes", Reason: "cannot unmarshal !!str `maybe` into bool"},
+				{File: tc.file, Line: 19 + tc.offset, Index: 5, Query: "sum(demo_memory_usage_bytes)", Reason: `has an invalid type "matrix"`},
+			}
+			if !reflect.DeepEqual(cfg.InvalidTestCases, want) {
+				t.Errorf("expected the invalid test cases\n%v\ngot\n%v", want, cfg.InvalidTestCases)
+			}
+		})
+	}
+}
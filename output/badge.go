@@ -0,0 +1,163 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BadgeLabel is the label of compliance badges.
+const BadgeLabel = "PromQL compliance"
+
+// DefaultBadgeColors are the default color thresholds of compliance badges.
+const DefaultBadgeColors = "100:brightgreen,95:green,90:yellowgreen,80:yellow,60:orange,0:red"
+
+// badgeColors maps the named colors of shields.io badges to their values.
+var badgeColors = map[string]string{
+	"brightgreen": "#4c1",
+	"green":       "#97ca00",
+	"yellowgreen": "#a4a61d",
+	"yellow":      "#dfb317",
+	"orange":      "#fe7d37",
+	"red":         "#e05d44",
+	"blue":        "#007ec6",
+	"lightgrey":   "#9f9f9f",
+}
+
+var hexColorRegexp = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// A BadgeThreshold colors the badges of pass rates of at least Min percent.
+type BadgeThreshold struct {
+	Min   float64
+	Color string
+}
+
+// ParseBadgeThresholds parses comma-separated thresholds like "95:green,80:yellow,0:red". Colors
+// are shields.io color names or hex values like #4c1. The thresholds are returned sorted by
+// descending Min.
+func ParseBadgeThresholds(s string) ([]BadgeThreshold, error) {
+	var thresholds []BadgeThreshold
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.Index(part, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid badge threshold %q, must be <percent>:<color>", part)
+		}
+		min, err := strconv.ParseFloat(part[:i], 64)
+		if err != nil || min < 0 || min > 100 {
+			return nil, fmt.Errorf("invalid badge threshold %q, the percentage must be between 0 and 100", part)
+		}
+		color := part[i+1:]
+		if _, ok := badgeColors[color]; !ok && !hexColorRegexp.MatchString(color) {
+			return nil, fmt.Errorf("invalid badge threshold %q, the color must be a hex value or one of %s", part, strings.Join(sortedBadgeColors(), ", "))
+		}
+		thresholds = append(thresholds, BadgeThreshold{Min: min, Color: color})
+	}
+	if len(thresholds) == 0 {
+		return nil, fmt.Errorf("no badge thresholds in %q", s)
+	}
+	sort.SliceStable(thresholds, func(i, j int) bool { return thresholds[i].Min > thresholds[j].Min })
+	return thresholds, nil
+}
+
+func sortedBadgeColors() []string {
+	names := make([]string, 0, len(badgeColors))
+	for name := range badgeColors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BadgeOptions controls how compliance badges present a pass rate.
+type BadgeOptions struct {
+	// Precision is the number of decimals of the percentage. Pass rates are rounded down, so that
+	// a badge never shows a higher rate than the run achieved, e.g. 100% only if all test cases passed.
+	Precision int
+	// Thresholds color the badge, sorted by descending Min. Rates below all of them are lightgrey.
+	Thresholds []BadgeThreshold
+}
+
+// message returns the rounded percentage shown on a badge.
+func (o BadgeOptions) message(rate float64) string {
+	scale := math.Pow(10, float64(o.Precision))
+	// Work around floating point errors like 97.3*10 = 972.9999999999999.
+	floored := math.Floor(rate*scale+1e-9) / scale
+	return strconv.FormatFloat(floored, 'f', o.Precision, 64) + "%"
+}
+
+// color returns the color of the first threshold that the pass rate reaches.
+func (o BadgeOptions) color(rate float64) string {
+	for _, t := range o.Thresholds {
+		if rate >= t.Min {
+			return t.Color
+		}
+	}
+	return "lightgrey"
+}
+
+// BadgeSVG renders a self-contained shields.io-style SVG badge showing the pass rate, given in percent.
+func BadgeSVG(rate float64, opts BadgeOptions) []byte {
+	message := opts.message(rate)
+	color := opts.color(rate)
+	if c, ok := badgeColors[color]; ok {
+		color = c
+	}
+	// Text widths are estimated for 11px Verdana, with 5px padding on either side.
+	labelWidth, messageWidth := badgeTextWidth(BadgeLabel)+10, badgeTextWidth(message)+10
+	width := labelWidth + messageWidth
+	label, msg := html.EscapeString(BadgeLabel), html.EscapeString(message)
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[2]s: %[3]s">`+
+		`<title>%[2]s: %[3]s</title>`+
+		`<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`+
+		`<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>`+
+		`<g clip-path="url(#r)"><rect width="%[4]d" height="20" fill="#555"/><rect x="%[4]d" width="%[5]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>`+
+		`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`+
+		`<text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[2]s</text><text x="%[7]d" y="14">%[2]s</text>`+
+		`<text x="%[8]d" y="15" fill="#010101" fill-opacity=".3">%[3]s</text><text x="%[8]d" y="14">%[3]s</text>`+
+		`</g></svg>`+"\n",
+		width, label, msg, labelWidth, messageWidth, color, labelWidth/2, labelWidth+messageWidth/2,
+	))
+}
+
+// badgeTextWidth estimates the width in pixels of text in 11px Verdana.
+func badgeTextWidth(s string) int {
+	width := 0.0
+	for _, r := range s {
+		switch {
+		case r == ' ' || r == '.' || r == ',' || r == 'i' || r == 'l':
+			width += 3.9
+		case r == '%' || r == 'm' || r == 'M' || r == 'W':
+			width += 10.9
+		case r >= 'A' && r <= 'Z':
+			width += 7.6
+		default:
+			width += 7
+		}
+	}
+	return int(math.Ceil(width))
+}
+
+// BadgeEndpoint returns the JSON file of a shields.io endpoint badge showing the pass rate, given
+// in percent, for badges rendered by shields.io from a published file, see
+// https://shields.io/badges/endpoint-badge.
+func BadgeEndpoint(rate float64, opts BadgeOptions) ([]byte, error) {
+	buf, err := json.MarshalIndent(map[string]interface{}{
+		"schemaVersion": 1,
+		"label":         BadgeLabel,
+		"message":       opts.message(rate),
+		"color":         strings.TrimPrefix(opts.color(rate), "#"),
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
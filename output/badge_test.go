@@ -0,0 +1,129 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBadgeThresholds(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    []BadgeThreshold
+		wantErr string
+	}{
+		{value: "80:yellow, 95:green,0:red", want: []BadgeThreshold{{95, "green"}, {80, "yellow"}, {0, "red"}}},
+		{value: "90:#4c1,50:#FE7D37,", want: []BadgeThreshold{{90, "#4c1"}, {50, "#FE7D37"}}},
+		{value: "97.5:brightgreen", want: []BadgeThreshold{{97.5, "brightgreen"}}},
+		{value: "", wantErr: `no badge thresholds in ""`},
+		{value: "95-green", wantErr: `invalid badge threshold "95-green", must be <percent>:<color>`},
+		{value: "101:green", wantErr: "the percentage must be between 0 and 100"},
+		{value: "high:green", wantErr: "the percentage must be between 0 and 100"},
+		{value: "95:purple", wantErr: "the color must be a hex value or one of blue, brightgreen, green, lightgrey, orange, red, yellow, yellowgreen"},
+		{value: "95:#4c", wantErr: "the color must be a hex value"},
+	} {
+		got, err := ParseBadgeThresholds(tc.value)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%q: expected an error containing %q, got %v", tc.value, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: expected %v, got %v and %v", tc.value, tc.want, got, err)
+		}
+	}
+	if _, err := ParseBadgeThresholds(DefaultBadgeColors); err != nil {
+		t.Errorf("expected the default badge colors to be valid, got %v", err)
+	}
+}
+
+func TestBadgeMessageAndColor(t *testing.T) {
+	thresholds, err := ParseBadgeThresholds(DefaultBadgeColors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		rate      float64
+		precision int
+		message   string
+		color     string
+	}{
+		{rate: 100, precision: 1, message: "100.0%", color: "brightgreen"},
+		// Pass rates are rounded down, so that only runs without failures show 100%.
+		{rate: 99.99, precision: 1, message: "99.9%", color: "green"},
+		{rate: 99.99, precision: 0, message: "99%", color: "green"},
+		{rate: 97.3, precision: 1, message: "97.3%", color: "green"},
+		{rate: 97.36, precision: 2, message: "97.36%", color: "green"},
+		{rate: 94.99, precision: 1, message: "94.9%", color: "yellowgreen"},
+		{rate: 59.9, precision: 1, message: "59.9%", color: "red"},
+		{rate: 0, precision: 1, message: "0.0%", color: "red"},
+	} {
+		opts := BadgeOptions{Precision: tc.precision, Thresholds: thresholds}
+		if got := opts.message(tc.rate); got != tc.message {
+			t.Errorf("%v with precision %d: expected the message %q, got %q", tc.rate, tc.precision, tc.message, got)
+		}
+		if got := opts.color(tc.rate); got != tc.color {
+			t.Errorf("%v: expected the color %q, got %q", tc.rate, tc.color, got)
+		}
+	}
+	if got := (BadgeOptions{Thresholds: []BadgeThreshold{{90, "green"}}}).color(50); got != "lightgrey" {
+		t.Errorf("expected rates below all thresholds to be lightgrey, got %q", got)
+	}
+}
+
+func TestBadgeSVG(t *testing.T) {
+	thresholds, err := ParseBadgeThresholds(DefaultBadgeColors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := BadgeSVG(97.3, BadgeOptions{Precision: 1, Thresholds: thresholds})
+	// The badge is well-formed XML.
+	if err := xml.Unmarshal(svg, new(interface{})); err != nil {
+		t.Fatalf("expected a well-formed SVG, got %v", err)
+	}
+	for _, w := range []string{`aria-label="PromQL compliance: 97.3%"`, `fill="#97ca00"`} {
+		if !bytes.Contains(svg, []byte(w)) {
+			t.Errorf("expected the badge to contain %q, got:\n%s", w, svg)
+		}
+	}
+
+	golden := filepath.Join("testdata", "badge", "badge.svg")
+	if *updateGolden {
+		if err := ioutil.WriteFile(golden, svg, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(svg, want) {
+		t.Errorf("expected the badge of %s, run with -update to update it, got:\n%s", golden, svg)
+	}
+
+	// Custom hex colors are used as they are.
+	if svg := BadgeSVG(50, BadgeOptions{Thresholds: []BadgeThreshold{{0, "#123456"}}}); !bytes.Contains(svg, []byte(`fill="#123456"`)) || !bytes.Contains(svg, []byte("50%")) {
+		t.Errorf("expected a badge with the custom color, got:\n%s", svg)
+	}
+}
+
+func TestBadgeEndpoint(t *testing.T) {
+	buf, err := BadgeEndpoint(97.36, BadgeOptions{Precision: 1, Thresholds: []BadgeThreshold{{95, "#4c1"}, {0, "red"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"schemaVersion": 1.0, "label": "PromQL compliance", "message": "97.3%", "color": "4c1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the endpoint badge %v, got %v", want, got)
+	}
+}
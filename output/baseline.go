@@ -0,0 +1,185 @@
+package output
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// A CaseOutcome is the outcome of an expanded test case against a test target, identified so that
+// it can be matched with the same test case in the JSON report of another run.
+type CaseOutcome struct {
+	ID               string `json:"id"`
+	Query            string `json:"query"`
+	TestTarget       string `json:"testTarget,omitempty"`
+	TimeParameterSet string `json:"timeParameterSet,omitempty"`
+	Category         string `json:"category,omitempty"`
+	Outcome          string `json:"outcome"`
+}
+
+// ResultID returns a stable identifier of the expanded test case of a result and its test target.
+// It is derived from the query and the time parameters relative to the end of the query window,
+// so that it changes neither when the configuration is reordered nor with the time of the run.
+func ResultID(res *comparer.Result) string {
+	tc := res.TestCase
+	var evalOffset int64
+	if tc.Instant() {
+		evalOffset = int64(tc.End.Sub(tc.Time))
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00%d\x00%s\x00%s", tc.Type, tc.Query, tc.End.Sub(tc.Start), tc.Resolution, evalOffset, tc.TimeParameterSet, res.TestTarget)
+	// Consistency checks are told apart from the comparison of the same query with the reference.
+	if tc.SameAs != "" {
+		fmt.Fprintf(h, "\x00%s", tc.SameAs)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// NewCaseOutcome returns the outcome of a result.
+func NewCaseOutcome(res *comparer.Result) CaseOutcome {
+	return CaseOutcome{
+		ID:               ResultID(res),
+		Query:            res.TestCase.Query,
+		TestTarget:       res.TestTarget,
+		TimeParameterSet: res.TestCase.TimeParameterSet,
+		Category:         res.TestCase.Category,
+		Outcome:          Outcome(res),
+	}
+}
+
+// caseOutcomes returns the outcomes of all results, including passing ones.
+func caseOutcomes(results []*comparer.Result) []CaseOutcome {
+	outcomes := make([]CaseOutcome, 0, len(results))
+	for _, res := range results {
+		outcomes = append(outcomes, NewCaseOutcome(res))
+	}
+	return outcomes
+}
+
+// ReadBaseline returns the test case outcomes recorded in a JSON report.
+func ReadBaseline(filename string) ([]CaseOutcome, error) {
+	outcomes, _, err := readReport(filename, "baseline")
+	return outcomes, err
+}
+
+// readReport returns the test case outcomes and the target version recorded in a JSON report,
+// which is described as kind in errors.
+func readReport(filename, kind string) ([]CaseOutcome, string, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	var doc struct {
+		Outcomes      *[]CaseOutcome `json:"outcomes"`
+		TargetVersion string         `json:"targetVersion"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	if err := dec.Decode(&doc); err != nil {
+		return nil, "", errors.Wrapf(err, "parsing %s %q", kind, filename)
+	}
+	if doc.Outcomes != nil {
+		return *doc.Outcomes, doc.TargetVersion, nil
+	}
+	outcomes, version, err := readJSONLinesOutcomes(buf)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "parsing %s %q", kind, filename)
+	}
+	if outcomes == nil {
+		return nil, "", errors.Errorf("%s %q lists no test case outcomes, it must be a JSON report written by -output-format json", kind, filename)
+	}
+	return outcomes, version, nil
+}
+
+// readJSONLinesOutcomes reads the test case outcomes from the records of a JSON lines report. The
+// report of a run that died lacks the final summary record, and its last record may be cut off,
+// so that a last line that does not parse is ignored. The target version is read from the summary
+// record, if any.
+func readJSONLinesOutcomes(buf []byte) ([]CaseOutcome, string, error) {
+	var outcomes []CaseOutcome
+	var version string
+	lines := bytes.Split(bytes.TrimRight(buf, "\n"), []byte("\n"))
+	for i, l := range lines {
+		var line jsonLine
+		if err := json.Unmarshal(l, &line); err != nil {
+			if i == len(lines)-1 && i > 0 {
+				break
+			}
+			return nil, "", errors.Wrapf(err, "line %d", i+1)
+		}
+		if line.Outcome != nil {
+			outcomes = append(outcomes, *line.Outcome)
+		}
+		if v, ok := line.Summary["targetVersion"].(string); ok {
+			version = v
+		}
+	}
+	return outcomes, version, nil
+}
+
+// A BaselineDiff lists the test cases whose outcomes changed between a baseline run and the
+// current run. Test cases that were skipped in either run are not compared.
+type BaselineDiff struct {
+	NewlyFailing  []CaseOutcome `json:"newlyFailing"`
+	NewlyErroring []CaseOutcome `json:"newlyErroring"`
+	NewlyPassing  []CaseOutcome `json:"newlyPassing"`
+	// OnlyInBaseline and OnlyInCurrent are the test cases that only one of the runs contains, e.g.
+	// because test cases were added or changed.
+	OnlyInBaseline []CaseOutcome `json:"onlyInBaseline"`
+	OnlyInCurrent  []CaseOutcome `json:"onlyInCurrent"`
+}
+
+// Regressed returns true if any test case newly failed or newly could not be executed.
+func (d *BaselineDiff) Regressed() bool {
+	return len(d.NewlyFailing) > 0 || len(d.NewlyErroring) > 0
+}
+
+// failingOutcome returns true for the outcomes of non-compliant results.
+func failingOutcome(outcome string) bool {
+	return outcome == "fail" || outcome == "unsupported"
+}
+
+// CompareBaseline compares the outcomes of the current run with those of a baseline run. The lists
+// keep the order of the current run, and OnlyInBaseline that of the baseline.
+func CompareBaseline(baseline, current []CaseOutcome) *BaselineDiff {
+	d := &BaselineDiff{
+		NewlyFailing:   []CaseOutcome{},
+		NewlyErroring:  []CaseOutcome{},
+		NewlyPassing:   []CaseOutcome{},
+		OnlyInBaseline: []CaseOutcome{},
+		OnlyInCurrent:  []CaseOutcome{},
+	}
+	previous := make(map[string]string, len(baseline))
+	for _, o := range baseline {
+		previous[o.ID] = o.Outcome
+	}
+	seen := make(map[string]bool, len(current))
+	for _, o := range current {
+		seen[o.ID] = true
+		was, ok := previous[o.ID]
+		switch {
+		case !ok:
+			d.OnlyInCurrent = append(d.OnlyInCurrent, o)
+		case was == "skipped" || o.Outcome == "skipped":
+		case failingOutcome(o.Outcome) && !failingOutcome(was):
+			d.NewlyFailing = append(d.NewlyFailing, o)
+		case o.Outcome == "error" && was != "error":
+			d.NewlyErroring = append(d.NewlyErroring, o)
+		case o.Outcome == "pass" && was != "pass":
+			d.NewlyPassing = append(d.NewlyPassing, o)
+		}
+	}
+	for _, o := range baseline {
+		if !seen[o.ID] {
+			d.OnlyInBaseline = append(d.OnlyInBaseline, o)
+			// Report test cases listed more than once in the baseline only once.
+			seen[o.ID] = true
+		}
+	}
+	return d
+}
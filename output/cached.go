@@ -0,0 +1,59 @@
+package output
+
+import (
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// maxCachedExamples bounds the number of test cases with cached test responses listed in reports.
+const maxCachedExamples = 10
+
+// A CachedSummary counts the test cases whose test responses show evidence of being served from a
+// cache, e.g. by a caching proxy in front of the test target, which makes their results stale.
+type CachedSummary struct {
+	Cached   int             `json:"cached"`
+	Examples []CachedExample `json:"examples"`
+}
+
+// A CachedExample lists the cache hit evidence of a test case.
+type CachedExample struct {
+	Query      string `json:"query"`
+	TestTarget string `json:"testTarget,omitempty"`
+	Evidence   string `json:"evidence"`
+}
+
+// cachedBuilder collects the cache hits of results as they are written.
+type cachedBuilder struct {
+	summary CachedSummary
+}
+
+func newCachedBuilder() *cachedBuilder {
+	return &cachedBuilder{summary: CachedSummary{Examples: []CachedExample{}}}
+}
+
+func (cb *cachedBuilder) add(res *comparer.Result) {
+	if res.CacheHit == "" {
+		return
+	}
+	cb.summary.Cached++
+	if len(cb.summary.Examples) < maxCachedExamples {
+		cb.summary.Examples = append(cb.summary.Examples, CachedExample{Query: res.TestCase.Query, TestTarget: res.TestTarget, Evidence: res.CacheHit})
+	}
+}
+
+// build returns the summary, or nil if no test responses were cached.
+func (cb *cachedBuilder) build() *CachedSummary {
+	if cb.summary.Cached == 0 {
+		return nil
+	}
+	return &cb.summary
+}
+
+// Cached summarizes the cache hits of the test responses of results, or returns nil if there are
+// none.
+func Cached(results []*comparer.Result) *CachedSummary {
+	cb := newCachedBuilder()
+	for _, res := range results {
+		cb.add(res)
+	}
+	return cb.build()
+}
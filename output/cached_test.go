@@ -0,0 +1,66 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+func TestCached(t *testing.T) {
+	if c := Cached(jsonLinesResults(3)); c != nil {
+		t.Errorf("expected no summary without cache hits, got %+v", c)
+	}
+
+	var results []*comparer.Result
+	for i := 0; i < maxCachedExamples+5; i++ {
+		res := &comparer.Result{TestCase: &comparer.TestCase{Query: fmt.Sprintf("demo_%d", i)}}
+		if i%2 == 0 {
+			res.CacheHit = fmt.Sprintf("Age: %d", i+1)
+			res.TestTarget = "greptime"
+		}
+		results = append(results, res)
+	}
+	c := Cached(results)
+	if c == nil || c.Cached != 8 || len(c.Examples) != 8 {
+		t.Fatalf("expected 8 cached test responses, got %+v", c)
+	}
+	if want := (CachedExample{Query: "demo_2", TestTarget: "greptime", Evidence: "Age: 3"}); c.Examples[1] != want {
+		t.Errorf("expected the example %+v, got %+v", want, c.Examples[1])
+	}
+
+	for _, res := range results {
+		res.CacheHit = "X-Cache: HIT"
+	}
+	if c := Cached(results); c.Cached != len(results) || len(c.Examples) != maxCachedExamples {
+		t.Errorf("expected %d cached test responses with %d examples, got %d with %d", len(results), maxCachedExamples, c.Cached, len(c.Examples))
+	}
+}
+
+func TestCachedInReports(t *testing.T) {
+	results := jsonLinesResults(3)
+	results[0].CacheHit = "Age: 42"
+
+	var text bytes.Buffer
+	Text(&text, results, false, nil)
+	for _, w := range []string{"Cached test responses:", "1 test cases had test responses that show evidence of being served from a cache", "*  rate(demo_0[5m]): Age: 42"} {
+		if !strings.Contains(text.String(), w) {
+			t.Errorf("expected the text report to contain %q, got:\n%s", w, text.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	JSON(&buf, results, false, nil)
+	var doc struct {
+		CachedResponses *CachedSummary `json:"cachedResponses"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if c := doc.CachedResponses; c == nil || c.Cached != 1 || c.Examples[0].Evidence != "Age: 42" {
+		t.Errorf("expected the cached response in the JSON report, got %+v", c)
+	}
+}
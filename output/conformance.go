@@ -0,0 +1,60 @@
+package output
+
+import (
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// maxConformanceSummaryExamples bounds the number of examples listed per kind of API conformance finding.
+const maxConformanceSummaryExamples = 5
+
+// A ConformanceSummary counts the test cases with API conformance findings of one kind.
+type ConformanceSummary struct {
+	Kind     string               `json:"kind"`
+	Cases    int                  `json:"cases"`
+	Examples []ConformanceExample `json:"examples"`
+}
+
+// A ConformanceExample is an API conformance finding of a test case.
+type ConformanceExample struct {
+	Query      string `json:"query"`
+	TestTarget string `json:"testTarget,omitempty"`
+	Example    string `json:"example"`
+}
+
+// conformanceBuilder collects the API conformance findings of results as they are written.
+type conformanceBuilder struct {
+	summaries []*ConformanceSummary
+	byKind    map[string]*ConformanceSummary
+}
+
+func newConformanceBuilder() *conformanceBuilder {
+	return &conformanceBuilder{byKind: map[string]*ConformanceSummary{}}
+}
+
+func (cb *conformanceBuilder) add(res *comparer.Result) {
+	counted := map[string]bool{}
+	for _, f := range res.ConformanceFindings {
+		s, ok := cb.byKind[f.Kind]
+		if !ok {
+			s = &ConformanceSummary{Kind: f.Kind}
+			cb.byKind[f.Kind] = s
+			cb.summaries = append(cb.summaries, s)
+		}
+		if !counted[f.Kind] {
+			counted[f.Kind] = true
+			s.Cases++
+		}
+		if len(s.Examples) < maxConformanceSummaryExamples {
+			s.Examples = append(s.Examples, ConformanceExample{Query: res.TestCase.Query, TestTarget: res.TestTarget, Example: f.Example})
+		}
+	}
+}
+
+// Conformance summarizes the API conformance findings of results by kind, in order of first appearance.
+func Conformance(results []*comparer.Result) []*ConformanceSummary {
+	cb := newConformanceBuilder()
+	for _, res := range results {
+		cb.add(res)
+	}
+	return cb.summaries
+}
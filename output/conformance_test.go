@@ -0,0 +1,67 @@
+package output
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+func TestConformance(t *testing.T) {
+	unsorted := func(query, target, example string) *comparer.Result {
+		return &comparer.Result{
+			TestCase:            &comparer.TestCase{Query: query},
+			TestTarget:          target,
+			ConformanceFindings: []comparer.ConformanceFinding{{Kind: comparer.ConformanceUnsortedLabels, Example: example}},
+		}
+	}
+	results := []*comparer.Result{
+		unsorted("up", "greptime", `{"job":"demo","instance":"a"}`),
+		{TestCase: &comparer.TestCase{Query: "rate(demo[1m])"}},
+		{
+			TestCase: &comparer.TestCase{Query: "sum by (b, a) (demo)"},
+			ConformanceFindings: []comparer.ConformanceFinding{
+				{Kind: comparer.ConformanceDuplicateLabels, Example: `{"a":"1","a":"1"}`},
+				{Kind: comparer.ConformanceUnsortedLabels, Example: `{"b":"2","a":"1"}`},
+				{Kind: comparer.ConformanceUnsortedLabels, Example: `{"b":"3","a":"1"}`},
+			},
+		},
+	}
+	for i := 0; i < 10; i++ {
+		results = append(results, unsorted("demo", "", `{"z":"1","a":"1"}`))
+	}
+
+	summaries := Conformance(results)
+	if len(summaries) != 2 || summaries[0].Kind != comparer.ConformanceUnsortedLabels || summaries[1].Kind != comparer.ConformanceDuplicateLabels {
+		t.Fatalf("expected a summary per kind in order of first appearance, got %+v", summaries)
+	}
+	if summaries[0].Cases != 12 || len(summaries[0].Examples) != maxConformanceSummaryExamples {
+		t.Errorf("expected 12 test cases with unsorted labels and %d examples, got %+v", maxConformanceSummaryExamples, summaries[0])
+	}
+	want := []ConformanceExample{
+		{Query: "up", TestTarget: "greptime", Example: `{"job":"demo","instance":"a"}`},
+		{Query: "sum by (b, a) (demo)", Example: `{"b":"2","a":"1"}`},
+		{Query: "sum by (b, a) (demo)", Example: `{"b":"3","a":"1"}`},
+	}
+	if !reflect.DeepEqual(summaries[0].Examples[:3], want) {
+		t.Errorf("expected the examples %+v, got %+v", want, summaries[0].Examples[:3])
+	}
+	if summaries[1].Cases != 1 {
+		t.Errorf("expected one test case with duplicate labels, got %d", summaries[1].Cases)
+	}
+
+	var buf bytes.Buffer
+	Text(&buf, results, false, nil)
+	for _, w := range []string{
+		"API conformance:",
+		"*  unsorted label names in 12 test cases",
+		`    e.g. {"job":"demo","instance":"a"} in up`,
+		"*  duplicate label names in 1 test cases",
+	} {
+		if !strings.Contains(buf.String(), w) {
+			t.Errorf("expected the text output to contain %q, got:\n%s", w, buf.String())
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package output
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+func TestConsistencyViolationReports(t *testing.T) {
+	res := &comparer.Result{
+		TestCase:             &comparer.TestCase{Query: "sum(demo)", SameAs: "sum without () (demo)"},
+		Diff:                 "different values",
+		ConsistencyViolation: true,
+	}
+	if got, want := failureFingerprint(res), "internal consistency violation"; got != want {
+		t.Errorf("expected the fingerprint %q, got %q", want, got)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		report func(*bytes.Buffer)
+		want   string
+	}{
+		{
+			name:   "text",
+			report: func(b *bytes.Buffer) { Text(b, []*comparer.Result{res}, false, nil) },
+			want:   "Internal consistency violation: the test API returned different results for the query (-) and its same_as query (+) sum without () (demo):",
+		},
+		{
+			name:   "junit",
+			report: func(b *bytes.Buffer) { JUnit(b, []*comparer.Result{res}, false, nil) },
+			want:   "internal consistency violation: query returned a different result than its same_as query",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tc.report(&buf)
+			if !strings.Contains(buf.String(), tc.want) {
+				t.Errorf("expected the report to contain %q, got:\n%s", tc.want, buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package output
+
+import (
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// maxExactnessSummaryExamples bounds the number of examples listed per kind of exactness difference.
+const maxExactnessSummaryExamples = 5
+
+// An ExactnessSummary adds up the exactness audits of the passing test cases, to tell how many of
+// them returned bit-identical results rather than results within the value tolerance.
+type ExactnessSummary struct {
+	// Cases is the number of audited test cases, of which BitIdentical returned the same float64s.
+	Cases        int `json:"cases"`
+	BitIdentical int `json:"bitIdentical"`
+	// Samples is the number of audited samples, of which Identical had the same textual values.
+	Samples   int `json:"samples"`
+	Identical int `json:"identical"`
+	// FormatDiffers, LastULP, and Inexact count the audited samples whose values differed by kind.
+	FormatDiffers int                `json:"formatDiffers"`
+	LastULP       int                `json:"lastULP"`
+	Inexact       int                `json:"inexact"`
+	Examples      []ExactnessExample `json:"examples"`
+}
+
+// An ExactnessExample is a sample of a test case whose textual values differ between the targets.
+type ExactnessExample struct {
+	Query      string `json:"query"`
+	TestTarget string `json:"testTarget,omitempty"`
+	comparer.ExactnessFinding
+}
+
+// IdenticalPercent returns the percentage of audited test cases with bit-identical results.
+func (s *ExactnessSummary) IdenticalPercent() float64 {
+	return 100 * float64(s.BitIdentical) / float64(s.Cases)
+}
+
+// exactnessBuilder collects the exactness audits of results as they are written.
+type exactnessBuilder struct {
+	summary ExactnessSummary
+	counts  map[string]int
+}
+
+func newExactnessBuilder() *exactnessBuilder {
+	return &exactnessBuilder{summary: ExactnessSummary{Examples: []ExactnessExample{}}, counts: map[string]int{}}
+}
+
+func (eb *exactnessBuilder) add(res *comparer.Result) {
+	a := res.Exactness
+	if a == nil {
+		return
+	}
+	s := &eb.summary
+	s.Cases++
+	if a.BitIdentical() {
+		s.BitIdentical++
+	}
+	s.Samples += a.Samples
+	s.Identical += a.Identical
+	s.FormatDiffers += a.FormatDiffers
+	s.LastULP += a.LastULP
+	s.Inexact += a.Inexact
+	for _, f := range a.Examples {
+		if eb.counts[f.Kind] < maxExactnessSummaryExamples {
+			eb.counts[f.Kind]++
+			s.Examples = append(s.Examples, ExactnessExample{Query: res.TestCase.Query, TestTarget: res.TestTarget, ExactnessFinding: f})
+		}
+	}
+}
+
+// build returns the exactness summary, or nil if no test case was audited.
+func (eb *exactnessBuilder) build() *ExactnessSummary {
+	if eb.summary.Cases == 0 {
+		return nil
+	}
+	return &eb.summary
+}
+
+// Exactness summarizes the exactness audits of the results, or returns nil if none was audited.
+func Exactness(results []*comparer.Result) *ExactnessSummary {
+	eb := newExactnessBuilder()
+	for _, res := range results {
+		eb.add(res)
+	}
+	return eb.build()
+}
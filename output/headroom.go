@@ -0,0 +1,88 @@
+package output
+
+import (
+	"sort"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// headroomTopN is the number of passing test cases closest to their value tolerance that are
+// listed in the headroom summary.
+const headroomTopN = 10
+
+// A HeadroomSummary lists the passing test cases that came closest to exceeding their value
+// tolerance, which shows numeric drift before it makes them fail.
+type HeadroomSummary struct {
+	// WithinTolerance is the number of passing test cases whose sample values differed.
+	WithinTolerance int `json:"withinTolerance"`
+	// Closest lists the test cases that used up the largest fractions of their value tolerance,
+	// largest first.
+	Closest []HeadroomCase `json:"closest"`
+}
+
+// A HeadroomCase is a passing test case with the largest deviations of its sample values.
+type HeadroomCase struct {
+	Query                string  `json:"query"`
+	TestTarget           string  `json:"testTarget,omitempty"`
+	ToleranceUsage       float64 `json:"toleranceUsage"`
+	MaxAbsoluteDeviation float64 `json:"maxAbsoluteDeviation"`
+	MaxRelativeDeviation float64 `json:"maxRelativeDeviation"`
+}
+
+// UsedPercent returns the tolerance usage as a percentage.
+func (c HeadroomCase) UsedPercent() float64 {
+	return 100 * c.ToleranceUsage
+}
+
+// headroomBuilder collects the tolerance usage of passing results as they are written.
+type headroomBuilder struct {
+	summary HeadroomSummary
+}
+
+func newHeadroomBuilder() *headroomBuilder {
+	return &headroomBuilder{summary: HeadroomSummary{Closest: []HeadroomCase{}}}
+}
+
+func (hb *headroomBuilder) add(res *comparer.Result) {
+	if !res.Success() || res.ToleranceUsage <= 0 {
+		return
+	}
+	hb.summary.WithinTolerance++
+	hc := HeadroomCase{
+		Query:                res.TestCase.Query,
+		TestTarget:           res.TestTarget,
+		ToleranceUsage:       res.ToleranceUsage,
+		MaxAbsoluteDeviation: res.MaxAbsoluteDeviation,
+		MaxRelativeDeviation: res.MaxRelativeDeviation,
+	}
+	closest := hb.summary.Closest
+	i := sort.Search(len(closest), func(i int) bool { return closest[i].ToleranceUsage < hc.ToleranceUsage })
+	if i >= headroomTopN {
+		return
+	}
+	closest = append(closest, HeadroomCase{})
+	copy(closest[i+1:], closest[i:])
+	closest[i] = hc
+	if len(closest) > headroomTopN {
+		closest = closest[:headroomTopN]
+	}
+	hb.summary.Closest = closest
+}
+
+// build returns the headroom summary, or nil if no passing test case used any of its tolerance.
+func (hb *headroomBuilder) build() *HeadroomSummary {
+	if hb.summary.WithinTolerance == 0 {
+		return nil
+	}
+	return &hb.summary
+}
+
+// Headroom summarizes the tolerance usage of the passing results, or returns nil if none used
+// any of its value tolerance.
+func Headroom(results []*comparer.Result) *HeadroomSummary {
+	hb := newHeadroomBuilder()
+	for _, res := range results {
+		hb.add(res)
+	}
+	return hb.build()
+}
@@ -0,0 +1,85 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// headroomResults returns n passing results with increasing tolerance usages of 1%, 2%, ..., and a
+// failing and an exactly matching result.
+func headroomResults(n int) []*comparer.Result {
+	var results []*comparer.Result
+	for i := 1; i <= n; i++ {
+		results = append(results, &comparer.Result{
+			TestCase:             &comparer.TestCase{Query: fmt.Sprintf("demo_%d", i)},
+			ToleranceUsage:       float64(i) / 100,
+			MaxAbsoluteDeviation: float64(i) / 1000,
+			MaxRelativeDeviation: float64(i) / 1e6,
+		})
+	}
+	return append(results,
+		&comparer.Result{TestCase: &comparer.TestCase{Query: "failed"}, Diff: "different values", ToleranceUsage: 2},
+		&comparer.Result{TestCase: &comparer.TestCase{Query: "exact"}},
+	)
+}
+
+func TestHeadroom(t *testing.T) {
+	if h := Headroom(headroomResults(0)); h != nil {
+		t.Errorf("expected no headroom summary without deviations, got %+v", h)
+	}
+
+	h := Headroom(headroomResults(headroomTopN + 5))
+	if h == nil || h.WithinTolerance != headroomTopN+5 || len(h.Closest) != headroomTopN {
+		t.Fatalf("expected the %d closest of %d passing test cases, got %+v", headroomTopN, headroomTopN+5, h)
+	}
+	for i, c := range h.Closest {
+		if want := fmt.Sprintf("demo_%d", headroomTopN+5-i); c.Query != want {
+			t.Errorf("position %d: expected %s, got %s", i+1, want, c.Query)
+		}
+	}
+	if got := h.Closest[0].UsedPercent(); got != 15 {
+		t.Errorf("expected the closest test case to use 15%% of its tolerance, got %v", got)
+	}
+}
+
+func TestHeadroomInReports(t *testing.T) {
+	results := headroomResults(3)
+
+	var text bytes.Buffer
+	Text(&text, results, false, nil)
+	for _, w := range []string{"Tolerance headroom:", "3 passing test cases only matched within the value tolerance", "USED", "3.0%", "demo_3"} {
+		if !strings.Contains(text.String(), w) {
+			t.Errorf("expected the text report to contain %q, got:\n%s", w, text.String())
+		}
+	}
+	if i, j := strings.Index(text.String(), "demo_3"), strings.Index(text.String(), "demo_1"); i < 0 || j < i {
+		t.Errorf("expected the closest test case to be listed first, got:\n%s", text.String())
+	}
+
+	var buf bytes.Buffer
+	JSON(&buf, results, false, nil)
+	var doc struct {
+		Headroom *HeadroomSummary `json:"headroom"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if h := doc.Headroom; h == nil || len(h.Closest) != 3 || h.Closest[0].MaxAbsoluteDeviation != 0.003 {
+		t.Errorf("expected the headroom summary in the JSON report, got %+v", h)
+	}
+
+	var html bytes.Buffer
+	r, err := HTML("example-output.html", 0, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r(&html, results, false, nil)
+	if !strings.Contains(html.String(), "Tolerance headroom: 3 passing test cases") {
+		t.Errorf("expected the html report to contain the headroom section")
+	}
+}
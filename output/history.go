@@ -0,0 +1,186 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// A HistoryRecord stores the pass counts of a run in the history file, which holds one JSON
+// record per line, so that reports can show trends across runs.
+type HistoryRecord struct {
+	Time       time.Time                 `json:"time"`
+	Total      int                       `json:"total"`
+	Passed     int                       `json:"passed"`
+	Categories map[string]*HistoryCounts `json:"categories,omitempty"`
+	// Templates holds the pass counts of the test cases expanded from each query template.
+	Templates map[string]*HistoryCounts `json:"templates,omitempty"`
+	// Failing lists the failed and errored test cases by FailureKey, so that later runs can tell
+	// which failures are new.
+	Failing []string `json:"failing,omitempty"`
+}
+
+// HistoryCounts are the pass counts of the test cases of one category.
+type HistoryCounts struct {
+	Total  int `json:"total"`
+	Passed int `json:"passed"`
+}
+
+// NewHistoryRecord returns the history record of a run with the given results.
+func NewHistoryRecord(t time.Time, results []*comparer.Result) *HistoryRecord {
+	rec := &HistoryRecord{Time: t}
+	for _, res := range results {
+		rec.Add(res)
+	}
+	return rec
+}
+
+// Add counts a result in the record. Skipped results are not counted.
+func (r *HistoryRecord) Add(res *comparer.Result) {
+	if res.Skipped() {
+		return
+	}
+	passed := 0
+	if res.Success() {
+		passed = 1
+	}
+	r.Total++
+	r.Passed += passed
+	if res.Failed() || res.Errored() {
+		r.Failing = append(r.Failing, FailureKey(res))
+	}
+	if cat := res.TestCase.Category; cat != "" {
+		if r.Categories == nil {
+			r.Categories = map[string]*HistoryCounts{}
+		}
+		addHistoryCounts(r.Categories, cat, passed)
+	}
+	if tmpl := res.TestCase.Template; tmpl != "" {
+		if r.Templates == nil {
+			r.Templates = map[string]*HistoryCounts{}
+		}
+		addHistoryCounts(r.Templates, tmpl, passed)
+	}
+}
+
+// addHistoryCounts counts a result with the given number of passes, 0 or 1, under key.
+func addHistoryCounts(counts map[string]*HistoryCounts, key string, passed int) {
+	c, ok := counts[key]
+	if !ok {
+		c = &HistoryCounts{}
+		counts[key] = c
+	}
+	c.Total++
+	c.Passed += passed
+}
+
+// FailureKey identifies the test case of a result across runs by its query, its time parameter set,
+// and, if several test targets are compared, its test target.
+func FailureKey(res *comparer.Result) string {
+	if res.TestTarget != "" {
+		return fmt.Sprintf("%s [%s]", res.TestCase.Name(), res.TestTarget)
+	}
+	return res.TestCase.Name()
+}
+
+// ReadHistory returns the last n records of the history file. A missing file has no records.
+func ReadHistory(filename string, n int) ([]*HistoryRecord, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return []*HistoryRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []*HistoryRecord{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, errors.Wrapf(err, "parsing line %d of history file %q", line, filename)
+		}
+		records = append(records, &rec)
+		if n > 0 && len(records) > n {
+			records = records[1:]
+		}
+	}
+	return records, scanner.Err()
+}
+
+// AppendHistory appends a record to the history file, creating it if necessary.
+func AppendHistory(filename string, rec *HistoryRecord) error {
+	buf, err := MarshalJSON(rec, "")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// A Trend is the pass rate history of all test cases or of the test cases of one category.
+type Trend struct {
+	Name string
+	// Rates are the pass rates in percent, from the oldest to the latest run.
+	Rates []float64
+}
+
+// Latest returns the pass rate of the latest run.
+func (t *Trend) Latest() float64 {
+	return t.Rates[len(t.Rates)-1]
+}
+
+// Trends returns the overall pass rate trend followed by the trends of each category, sorted by name.
+// Trends with fewer than two runs are omitted, so short histories yield no trends.
+func Trends(history []*HistoryRecord) []*Trend {
+	overall := &Trend{Name: "all test cases"}
+	categories := map[string]*Trend{}
+	for _, rec := range history {
+		if rec.Total > 0 {
+			overall.Rates = append(overall.Rates, 100*float64(rec.Passed)/float64(rec.Total))
+		}
+		for cat, c := range rec.Categories {
+			t, ok := categories[cat]
+			if !ok {
+				t = &Trend{Name: cat}
+				categories[cat] = t
+			}
+			if c.Total > 0 {
+				t.Rates = append(t.Rates, 100*float64(c.Passed)/float64(c.Total))
+			}
+		}
+	}
+
+	var trends []*Trend
+	if len(overall.Rates) >= 2 {
+		trends = append(trends, overall)
+	}
+	cats := make([]string, 0, len(categories))
+	for cat := range categories {
+		cats = append(cats, cat)
+	}
+	sort.Strings(cats)
+	for _, cat := range cats {
+		if t := categories[cat]; len(t.Rates) >= 2 {
+			trends = append(trends, t)
+		}
+	}
+	return trends
+}
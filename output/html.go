@@ -1,16 +1,24 @@
 package output
 
 import (
+	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/promlabs/promql-compliance-tester/comparer"
 	"github.com/promlabs/promql-compliance-tester/config"
 )
 
+// htmlChunkSize is the number of results that are rendered per "results" template execution.
+const htmlChunkSize = 500
+
 var funcMap = map[string]interface{}{
 	"include": func(includePassing bool, result *comparer.Result) bool {
 		return includePassing || !result.Success()
@@ -30,34 +38,255 @@ var funcMap = map[string]interface{}{
 	"numFailed": func(results []*comparer.Result) int {
 		num := 0
 		for _, r := range results {
-			if !r.Success() {
+			if r.Failed() {
+				num++
+			}
+		}
+		return num
+	},
+	"numErrored": func(results []*comparer.Result) int {
+		num := 0
+		for _, r := range results {
+			if r.Errored() {
 				num++
 			}
 		}
 		return num
 	},
+	"numSkipped": func(results []*comparer.Result) int {
+		num := 0
+		for _, r := range results {
+			if r.Skipped() {
+				num++
+			}
+		}
+		return num
+	},
+	"triage":    Triage,
+	"matrix":    Matrix,
+	"latency":   Latency,
+	"headroom":  Headroom,
+	"exactness": Exactness,
+	"sections":  Sections,
 	"percent": func(part, total int) float64 {
 		return 100 * float64(part) / float64(total)
 	},
+	"trends": Trends,
+	"sparkline": func(rates []float64) template.HTML {
+		return Sparkline(rates, 0, 100, 120, 24)
+	},
+	"formatInt":   formatInt,
+	"formatFloat": formatFloat,
+}
+
+// HTMLPage describes one page of a paginated HTML report.
+type HTMLPage struct {
+	Number   int
+	File     string
+	FirstIdx int
+	LastIdx  int
+}
+
+// HTMLResult is a single result along with its position in the report.
+type HTMLResult struct {
+	*comparer.Result
+	// Index is the result's position in the overall report and is used as its anchor.
+	Index int
+}
+
+// htmlData is the data passed to the HTML templates.
+type htmlData struct {
+	// AllResults is used for the summary statistics of the whole report.
+	AllResults     []*comparer.Result
+	Results        []HTMLResult
+	IncludePassing bool
+	Pages          []HTMLPage
+	Page           *HTMLPage
+	// History holds the records of earlier runs followed by the current run, if a history file is used.
+	History []*HistoryRecord
+	// Regressions are the pass rates that regressed against the history baseline, if one is used.
+	Regressions []*HistoryRegression
 }
 
 // HTML produces HTML output for a number of query results.
-func HTML(tplFile string) (Outputter, error) {
+//
+// If the template defines "header", "results" and "footer" templates, the results are
+// rendered in chunks. If pageSize is positive, the report is split into pages of pageSize
+// results each, written into outputDir along with an index page. If history is non-nil, it holds
+// the records of earlier runs, which are used to chart pass rate trends. If baseline is non-nil, the
+// pass rates that regressed against it are listed.
+//
+// The template is executed against a synthetic report before any results are available, so that
+// errors in it are reported up front rather than once a run completed.
+func HTML(tplFile string, pageSize int, outputDir string, history []*HistoryRecord, baseline *HistoryBaseline) (Outputter, error) {
+	r, err := newHTMLRenderer(tplFile, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	if pageSize > 0 && outputDir == "" {
+		return nil, errors.New("an output directory is required for paginated HTML output")
+	}
+	if err := r.validate(history != nil, baseline != nil); err != nil {
+		return nil, errors.Wrapf(err, "validating template file %q", tplFile)
+	}
+
+	return func(w io.Writer, results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak) {
+		var err error
+		if pageSize > 0 {
+			err = os.MkdirAll(outputDir, 0o755)
+		}
+		if err == nil {
+			err = r.render(w, results, includePassing, history, baseline, func(file string, write func(w io.Writer) error) error {
+				return writeHTMLFile(filepath.Join(outputDir, file), write)
+			})
+		}
+		if err != nil {
+			log.Println("executing template:", err)
+		}
+	}, nil
+}
+
+// ValidateHTMLTemplate executes a template against synthetic reports with and without the pass
+// rate history, as HTML would with the given page size, and returns the first error.
+func ValidateHTMLTemplate(tplFile string, pageSize int) error {
+	r, err := newHTMLRenderer(tplFile, pageSize)
+	if err != nil {
+		return err
+	}
+	for _, history := range []bool{false, true} {
+		if err := r.validate(history, history); err != nil {
+			return errors.Wrapf(err, "validating template file %q", tplFile)
+		}
+	}
+	return nil
+}
+
+// htmlRenderer renders reports with a parsed HTML template.
+type htmlRenderer struct {
+	t         *template.Template
+	pageSize  int
+	streaming bool
+}
+
+func newHTMLRenderer(tplFile string, pageSize int) (*htmlRenderer, error) {
 	t, err := template.New(path.Base(tplFile)).Funcs(funcMap).ParseFiles(tplFile)
 	if err != nil {
 		return nil, errors.Wrapf(err, "parsing template file %q", tplFile)
 	}
+	streaming := t.Lookup("header") != nil && t.Lookup("results") != nil && t.Lookup("footer") != nil
+	if pageSize > 0 && (!streaming || t.Lookup("index") == nil) {
+		return nil, errors.Errorf("template file %q must define \"header\", \"results\", \"footer\" and \"index\" templates for pagination", tplFile)
+	}
+	return &htmlRenderer{t: t, pageSize: pageSize, streaming: streaming}, nil
+}
+
+// render writes the report of the results to w, or its pages with writeFile if it is paginated.
+func (r *htmlRenderer) render(w io.Writer, results []*comparer.Result, includePassing bool, history []*HistoryRecord, baseline *HistoryBaseline, writeFile func(file string, write func(w io.Writer) error) error) error {
+	current := NewHistoryRecord(time.Now(), results)
+	var runs []*HistoryRecord
+	if history != nil {
+		runs = append(append(runs, history...), current)
+	}
+	regressions := baseline.Regressions(current)
+	switch {
+	case r.pageSize > 0:
+		return writeHTMLPages(r.t, r.pageSize, results, includePassing, runs, regressions, writeFile)
+	case r.streaming:
+		return writeHTMLPage(r.t, w, htmlData{AllResults: results, IncludePassing: includePassing, History: runs, Regressions: regressions}, results, 0)
+	default:
+		data := htmlData{AllResults: results, IncludePassing: includePassing, Results: htmlResults(results, 0), History: runs, Regressions: regressions}
+		return r.t.Execute(w, data)
+	}
+}
+
+// validate renders a synthetic report, discarding the output. If history or baseline are set, the
+// report charts a synthetic history of earlier runs or lists regressions against it.
+func (r *htmlRenderer) validate(history, baseline bool) error {
+	results := syntheticResults()
+	var runs []*HistoryRecord
+	var hb *HistoryBaseline
+	if history || baseline {
+		runs = syntheticHistory(results)
+	}
+	if baseline {
+		hb = &HistoryBaseline{Runs: runs, Threshold: 1}
+	}
+	if !history {
+		runs = nil
+	}
+	return r.render(ioutil.Discard, results, true, runs, hb, func(_ string, write func(w io.Writer) error) error {
+		return write(ioutil.Discard)
+	})
+}
+
+func htmlResults(results []*comparer.Result, offset int) []HTMLResult {
+	res := make([]HTMLResult, 0, len(results))
+	for i, r := range results {
+		res = append(res, HTMLResult{Result: r, Index: offset + i})
+	}
+	return res
+}
+
+// writeHTMLPage renders the results into a single page, executing the "results" template
+// once per chunk so that the rendering memory does not grow with the number of results.
+func writeHTMLPage(t *template.Template, w io.Writer, data htmlData, results []*comparer.Result, offset int) error {
+	if err := t.ExecuteTemplate(w, "header", data); err != nil {
+		return err
+	}
+	for start := 0; start < len(results); start += htmlChunkSize {
+		end := start + htmlChunkSize
+		if end > len(results) {
+			end = len(results)
+		}
+		data.Results = htmlResults(results[start:end], offset+start)
+		if err := t.ExecuteTemplate(w, "results", data); err != nil {
+			return err
+		}
+	}
+	data.Results = nil
+	return t.ExecuteTemplate(w, "footer", data)
+}
+
+func writeHTMLPages(t *template.Template, pageSize int, results []*comparer.Result, includePassing bool, history []*HistoryRecord, regressions []*HistoryRegression, writeFile func(file string, write func(w io.Writer) error) error) error {
+	var pages []HTMLPage
+	for start := 0; start < len(results); start += pageSize {
+		end := start + pageSize
+		if end > len(results) {
+			end = len(results)
+		}
+		pages = append(pages, HTMLPage{
+			Number:   len(pages) + 1,
+			File:     fmt.Sprintf("page-%d.html", len(pages)+1),
+			FirstIdx: start,
+			LastIdx:  end - 1,
+		})
+	}
 
-	return func(results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak) {
-		err := t.Execute(os.Stdout, struct {
-			Results        []*comparer.Result
-			includePassing bool
-		}{
-			Results:        results,
-			includePassing: includePassing,
+	for i := range pages {
+		p := &pages[i]
+		data := htmlData{AllResults: results, IncludePassing: includePassing, Pages: pages, Page: p}
+		err := writeFile(p.File, func(w io.Writer) error {
+			return writeHTMLPage(t, w, data, results[p.FirstIdx:p.LastIdx+1], p.FirstIdx)
 		})
 		if err != nil {
-			log.Println("executing template:", err)
+			return err
 		}
-	}, nil
+	}
+
+	data := htmlData{AllResults: results, IncludePassing: includePassing, Pages: pages, History: history, Regressions: regressions}
+	return writeFile("index.html", func(w io.Writer) error {
+		return t.ExecuteTemplate(w, "index", data)
+	})
+}
+
+func writeHTMLFile(filename string, write func(w io.Writer) error) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "writing %q", filename)
+	}
+	return f.Close()
 }
@@ -0,0 +1,175 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// manyResults returns n results of instant queries, of which every third failed.
+func manyResults(n int) []*comparer.Result {
+	results := make([]*comparer.Result, 0, n)
+	for i := 0; i < n; i++ {
+		res := &comparer.Result{TestCase: &comparer.TestCase{Query: fmt.Sprintf("demo_%d", i), Type: config.QueryTypeInstant, Time: time.Unix(1, 0)}}
+		if i%3 == 0 {
+			res.Diff = fmt.Sprintf("-demo_%d 1\n+demo_%d 2\n", i, i)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// memFiles collects the files written by paginated HTML outputs.
+type memFiles map[string]*bytes.Buffer
+
+func (f memFiles) write(file string, write func(w io.Writer) error) error {
+	buf := &bytes.Buffer{}
+	f[file] = buf
+	return write(buf)
+}
+
+func TestHTMLPagination(t *testing.T) {
+	r, err := newHTMLRenderer("example-output.html", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := manyResults(25)
+	files := memFiles{}
+	if err := r.render(ioutil.Discard, results, true, nil, nil, files.write); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("expected 3 pages and an index, got the files %v", files)
+	}
+
+	anchors := map[string]string{}
+	anchorRe := regexp.MustCompile(`id="case-(\d+)"`)
+	for file, buf := range files {
+		for _, m := range anchorRe.FindAllStringSubmatch(buf.String(), -1) {
+			if other, ok := anchors[m[1]]; ok {
+				t.Errorf("case %s is on %s and %s", m[1], other, file)
+			}
+			anchors[m[1]] = file
+		}
+	}
+	if len(anchors) != len(results) {
+		t.Errorf("expected an anchor for each of the %d results, got %d", len(results), len(anchors))
+	}
+	if anchors["0"] != "page-1.html" || anchors["10"] != "page-2.html" || anchors["24"] != "page-3.html" {
+		t.Errorf("expected the cases to be split into pages of 10, got %v", anchors)
+	}
+
+	// Each deep link of the index leads to the page that holds the case.
+	index := files["index.html"].String()
+	links := regexp.MustCompile(`href="(page-\d+\.html)#case-(\d+)"`).FindAllStringSubmatch(index, -1)
+	if len(links) != 6 {
+		t.Fatalf("expected links to the first and last case of each page, got %v", links)
+	}
+	for _, l := range links {
+		if anchors[l[2]] != l[1] {
+			t.Errorf("link to case %s on %s, but it is on %s", l[2], l[1], anchors[l[2]])
+		}
+	}
+	if page := files["page-2.html"].String(); !strings.Contains(page, `<a href="index.html">Index</a> | Page 2 of 3`) {
+		t.Error("expected page 2 to link back to the index")
+	}
+}
+
+func TestHTMLRendersResultsInChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "html-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tpl := filepath.Join(dir, "chunks.html")
+	content := `{{ define "header" }}header {{ numResults .AllResults }}
+{{ end }}{{ define "results" }}chunk {{ len .Results }} from {{ (index .Results 0).Index }}
+{{ end }}{{ define "footer" }}footer{{ end }}{{ define "index" }}index{{ end }}`
+	if err := ioutil.WriteFile(tpl, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	results := manyResults(2*htmlChunkSize + 200)
+	r, err := newHTMLRenderer(tpl, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := r.render(&buf, results, true, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("header %d\nchunk %d from 0\nchunk %d from %d\nchunk 200 from %d\nfooter", len(results), htmlChunkSize, htmlChunkSize, htmlChunkSize, 2*htmlChunkSize)
+	if buf.String() != want {
+		t.Errorf("expected the output\n%s\ngot\n%s", want, buf.String())
+	}
+
+	// Pages are rendered in chunks as well, with indexes that continue across pages.
+	r, err = newHTMLRenderer(tpl, htmlChunkSize+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := memFiles{}
+	if err := r.render(ioutil.Discard, results, true, nil, nil, files.write); err != nil {
+		t.Fatal(err)
+	}
+	want = fmt.Sprintf("header %d\nchunk %d from %d\nchunk 100 from %d\nfooter", len(results), htmlChunkSize, htmlChunkSize+100, 2*htmlChunkSize+100)
+	if got := files["page-2.html"].String(); got != want {
+		t.Errorf("expected page 2\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestHTMLPaginationRequiresTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "html-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tpl := filepath.Join(dir, "single.html")
+	if err := ioutil.WriteFile(tpl, []byte(`{{ range .Results }}{{ .TestCase.Query }}{{ end }}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newHTMLRenderer(tpl, 100); err == nil || !strings.Contains(err.Error(), "for pagination") {
+		t.Errorf("expected a template without header, results, footer, and index to be rejected for pagination, got %v", err)
+	}
+	if _, err := HTML("example-output.html", 100, "", nil, nil); err == nil || !strings.Contains(err.Error(), "output directory") {
+		t.Errorf("expected pagination without an output directory to be rejected, got %v", err)
+	}
+}
+
+// discardFiles discards the files written by paginated HTML outputs.
+func discardFiles(_ string, write func(w io.Writer) error) error {
+	return write(ioutil.Discard)
+}
+
+// BenchmarkHTML reports the allocations of rendering large reports. The memory that rendering the
+// results holds at a time is bounded by htmlChunkSize and the page size rather than by the number
+// of results, so that the bytes allocated per result stay flat as the number of results grows.
+func BenchmarkHTML(b *testing.B) {
+	for _, n := range []int{5000, 50000} {
+		results := manyResults(n)
+		for _, pageSize := range []int{0, 2000} {
+			r, err := newHTMLRenderer("example-output.html", pageSize)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("results=%d/page-size=%d", n, pageSize), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if err := r.render(ioutil.Discard, results, true, nil, nil, discardFiles); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -1,23 +1,78 @@
 package output
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/promlabs/promql-compliance-tester/comparer"
 	"github.com/promlabs/promql-compliance-tester/config"
 )
 
 // JSON produces JSON-based output for a number of query results.
-func JSON(results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak) {
-	buf, err := json.Marshal(map[string]interface{}{
+func JSON(w io.Writer, results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak) {
+	JSONWithHistory(nil)(w, results, includePassing, tweaks)
+}
+
+// JSONWithHistory returns an Outputter producing JSON-based output that also lists the pass rates
+// that regressed against the baseline of earlier runs.
+func JSONWithHistory(baseline *HistoryBaseline) Outputter {
+	return func(w io.Writer, results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak) {
+		writeJSON(w, results, includePassing, tweaks, baseline)
+	}
+}
+
+func writeJSON(w io.Writer, results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak, baseline *HistoryBaseline) {
+	results = sortedResults(results)
+	doc := map[string]interface{}{
 		"totalResults":   len(results), // Needed because we may exclude passing results.
-		"results":        results,
 		"includePassing": includePassing,
 		"queryTweaks":    tweaks,
-	})
+		"triage":         Triage(results),
+		"latency":        Latency(results),
+		"apiConformance": Conformance(results),
+		"requestParity":  Parity(results),
+		// The outcomes of all results, including passing ones, are listed for -baseline.
+		"outcomes": caseOutcomes(results),
+	}
+	if c := Cached(results); c != nil {
+		doc["cachedResponses"] = c
+	}
+	if h := Headroom(results); h != nil {
+		doc["headroom"] = h
+	}
+	if e := Exactness(results); e != nil {
+		doc["exactness"] = e
+	}
+	if s := Sections(results); s != nil {
+		doc["documentationSections"] = s
+	}
+	if anyChaos(results) {
+		doc["chaos"] = true
+	}
+	if targetVersion != "" {
+		doc["targetVersion"] = targetVersion
+	}
+	if baseline != nil {
+		doc["historyRegressions"] = baseline.Regressions(NewHistoryRecord(time.Time{}, results))
+	}
+	if m := Matrix(results); m != nil {
+		// Nest the results of runs against several test targets by target name.
+		byTarget := make(map[string][]*comparer.Result, len(m.Targets))
+		for _, t := range m.Targets {
+			byTarget[t] = []*comparer.Result{}
+		}
+		for _, res := range results {
+			byTarget[res.TestTarget] = append(byTarget[res.TestTarget], res)
+		}
+		doc["resultsByTarget"] = byTarget
+		doc["matrix"] = m
+	} else {
+		doc["results"] = results
+	}
+	buf, err := MarshalJSON(doc, "")
 	if err != nil {
 		panic(err)
 	}
-	fmt.Print(string(buf))
+	fmt.Fprint(w, string(buf))
 }
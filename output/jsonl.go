@@ -0,0 +1,88 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// A jsonLine is a record of the JSON lines output. Each result is written as a record with its
+// outcome, and with the result itself unless it passed and passing results are excluded. The
+// summary is written as the final record once all results are written.
+type jsonLine struct {
+	Outcome *CaseOutcome           `json:"outcome,omitempty"`
+	Result  *comparer.Result       `json:"result,omitempty"`
+	Summary map[string]interface{} `json:"summary,omitempty"`
+}
+
+// jsonLinesWriter streams results as JSON lines. Each record is written with a single write as soon
+// as its result is available, so that the output of a run that died holds all completed results.
+type jsonLinesWriter struct {
+	w              io.Writer
+	includePassing bool
+	baseline       *HistoryBaseline
+	// results are retained for the summaries of the final record.
+	results []*comparer.Result
+}
+
+func newJSONLinesWriter(w io.Writer, includePassing bool, baseline *HistoryBaseline) *jsonLinesWriter {
+	return &jsonLinesWriter{w: w, includePassing: includePassing, baseline: baseline}
+}
+
+func (jw *jsonLinesWriter) WriteResult(res *comparer.Result) {
+	jw.results = append(jw.results, res)
+	outcome := NewCaseOutcome(res)
+	line := jsonLine{Outcome: &outcome}
+	if jw.includePassing || !res.Success() {
+		line.Result = res
+	}
+	jw.write(line)
+}
+
+func (jw *jsonLinesWriter) Finish(tweaks []*config.QueryTweak) {
+	summary := map[string]interface{}{
+		"totalResults":   len(jw.results),
+		"includePassing": jw.includePassing,
+		"queryTweaks":    tweaks,
+		"triage":         Triage(jw.results),
+		"latency":        Latency(jw.results),
+		"apiConformance": Conformance(jw.results),
+		"requestParity":  Parity(jw.results),
+	}
+	if m := Matrix(jw.results); m != nil {
+		summary["matrix"] = m
+	}
+	if c := Cached(jw.results); c != nil {
+		summary["cachedResponses"] = c
+	}
+	if h := Headroom(jw.results); h != nil {
+		summary["headroom"] = h
+	}
+	if e := Exactness(jw.results); e != nil {
+		summary["exactness"] = e
+	}
+	if s := Sections(jw.results); s != nil {
+		summary["documentationSections"] = s
+	}
+	if anyChaos(jw.results) {
+		summary["chaos"] = true
+	}
+	if targetVersion != "" {
+		summary["targetVersion"] = targetVersion
+	}
+	if jw.baseline != nil {
+		summary["historyRegressions"] = jw.baseline.Regressions(NewHistoryRecord(time.Time{}, jw.results))
+	}
+	jw.write(jsonLine{Summary: summary})
+}
+
+func (jw *jsonLinesWriter) write(line jsonLine) {
+	buf, err := MarshalJSON(line, "")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprint(jw.w, string(append(buf, '\n')))
+}
@@ -0,0 +1,165 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// jsonLinesResults returns passing, failing, and erroring results of distinct range queries.
+func jsonLinesResults(n int) []*comparer.Result {
+	var results []*comparer.Result
+	for i := 0; i < n; i++ {
+		res := &comparer.Result{TestCase: &comparer.TestCase{
+			Query:      fmt.Sprintf("rate(demo_%d[5m])", i),
+			Start:      time.Unix(0, 0),
+			End:        time.Unix(3600, 0),
+			Resolution: time.Minute,
+		}}
+		switch i % 3 {
+		case 1:
+			res.Diff = "different values"
+		case 2:
+			res.ExecutionError = "connection refused"
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// writeCounter counts the writes to a buffer.
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestJSONLinesOutputOfInterruptedRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	results := jsonLinesResults(6)
+	var w writeCounter
+	out, err := NewStreamOutputter("json", &w, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The run dies while writing the fifth record, before the summary is written.
+	for _, res := range results[:4] {
+		out.WriteResult(res)
+	}
+	if w.writes != 4 {
+		t.Errorf("expected each record to be written with a single write, got %d writes for 4 records", w.writes)
+	}
+	var complete bytes.Buffer
+	newJSONLinesWriter(&complete, false, nil).WriteResult(results[4])
+	partial := append(w.Bytes(), complete.Bytes()[:complete.Len()/2]...)
+	filename := filepath.Join(dir, "partial.jsonl")
+	if err := ioutil.WriteFile(filename, partial, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// All complete records parse on their own.
+	scanner := bufio.NewScanner(bytes.NewReader(w.Bytes()))
+	var records []jsonLine
+	for scanner.Scan() {
+		var line jsonLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("expected each line to be a JSON record, got %v", err)
+		}
+		records = append(records, line)
+	}
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+	for i, r := range records {
+		// Passing results are only recorded by their outcome without -include-passing.
+		if r.Outcome == nil || r.Outcome.Query != results[i].TestCase.Query || (r.Result != nil) != !results[i].Success() {
+			t.Errorf("record %d: expected the outcome of %q, got %+v", i+1, results[i].TestCase.Query, r)
+		}
+	}
+
+	outcomes, err := ReadBaseline(filename)
+	if err != nil {
+		t.Fatalf("expected the partial output to be a valid baseline, got %v", err)
+	}
+	if want := caseOutcomes(results[:4]); !reflect.DeepEqual(outcomes, want) {
+		t.Errorf("expected the outcomes of the completed results %v, got %v", want, outcomes)
+	}
+}
+
+func TestReadReportForms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	results := jsonLinesResults(5)
+	var monolithic, lines bytes.Buffer
+	JSON(&monolithic, results, false, nil)
+	out, err := NewStreamOutputter("json", &lines, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range results {
+		out.WriteResult(res)
+	}
+	out.Finish(nil)
+
+	var last jsonLine
+	all := bytes.Split(bytes.TrimRight(lines.Bytes(), "\n"), []byte("\n"))
+	if err := json.Unmarshal(all[len(all)-1], &last); err != nil {
+		t.Fatal(err)
+	}
+	if last.Summary == nil || last.Summary["totalResults"] != float64(len(results)) {
+		t.Errorf("expected the final record to be the summary of %d results, got %+v", len(results), last)
+	}
+
+	for _, tc := range []struct {
+		name string
+		buf  []byte
+	}{
+		{name: "monolithic", buf: monolithic.Bytes()},
+		{name: "json lines", buf: lines.Bytes()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(dir, tc.name+".json")
+			if err := ioutil.WriteFile(filename, tc.buf, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			outcomes, err := ReadBaseline(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := caseOutcomes(results); !reflect.DeepEqual(outcomes, want) {
+				t.Errorf("expected the outcomes %v, got %v", want, outcomes)
+			}
+		})
+	}
+
+	// Only the last line of a JSON lines report may be cut off.
+	corrupt := filepath.Join(dir, "corrupt.jsonl")
+	if err := ioutil.WriteFile(corrupt, bytes.Replace(lines.Bytes(), []byte("\n"), []byte("\n{\"outcome\":\n"), 1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBaseline(corrupt); err == nil {
+		t.Error("expected a record in the middle that does not parse to be an error")
+	}
+}
@@ -0,0 +1,135 @@
+package output
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+const junitDefaultSuite = "promql-compliance"
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// JUnit produces JUnit XML output for a number of query results, with one test suite per
+// test case category. Passing test cases are always included so that the totals are correct.
+func JUnit(w io.Writer, results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak) {
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	suites := map[string]*junitTestSuite{}
+	for _, res := range sortedResults(results) {
+		name := res.TestCase.Category
+		if name == "" {
+			name = junitDefaultSuite
+		}
+		suite, ok := suites[name]
+		if !ok {
+			suite = &junitTestSuite{Name: name, Timestamp: timestamp}
+			suites[name] = suite
+		}
+
+		tc := junitTestCase{Name: res.TestCase.Name(), ClassName: name}
+		switch {
+		case res.Skipped():
+			tc.Skipped = &junitMessage{Message: res.SkipReason}
+			suite.Skipped++
+		case res.Errored():
+			tc.Error = &junitMessage{Message: "execution error", Body: res.ExecutionError}
+			suite.Errors++
+		case res.Success():
+		case res.Unsupported:
+			tc.Failure = &junitMessage{Message: "unsupported", Body: res.UnexpectedFailure}
+			suite.Failures++
+		case res.UnexpectedFailure != "":
+			tc.Error = &junitMessage{Message: "query failed unexpectedly", Body: res.UnexpectedFailure}
+			suite.Errors++
+		default:
+			tc.Failure = &junitMessage{Message: junitFailureMessage(res), Body: res.Diff}
+			if res.ErrorMismatch {
+				tc.Failure.Body = fmt.Sprintf("reference error: %s\ntest error: %s", res.RefError, res.TestError)
+			} else if res.UnexpectedSuccess && res.RefError != "" {
+				tc.Failure.Body = fmt.Sprintf("reference error: %s", res.RefError)
+			}
+			suite.Failures++
+		}
+		suite.Tests++
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	doc := junitTestSuites{}
+	names := make([]string, 0, len(suites))
+	for name := range suites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := suites[name]
+		doc.Tests += s.Tests
+		doc.Failures += s.Failures
+		doc.Errors += s.Errors
+		doc.Skipped += s.Skipped
+		doc.Suites = append(doc.Suites, *s)
+	}
+
+	buf, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprint(w, xml.Header)
+	fmt.Fprintln(w, string(buf))
+}
+
+func junitFailureMessage(res *comparer.Result) string {
+	var msgs []string
+	if res.UnexpectedSuccess && res.RefError != "" {
+		msgs = append(msgs, "query succeeded, but the reference API rejected it")
+	} else if res.UnexpectedSuccess {
+		msgs = append(msgs, "query succeeded, but should have failed")
+	}
+	if res.ErrorMismatch {
+		msgs = append(msgs, "query failed with different errors")
+	}
+	if res.WarningsMismatch {
+		msgs = append(msgs, "query returned different warnings")
+	}
+	if res.ConsistencyViolation {
+		msgs = append(msgs, "internal consistency violation: query returned a different result than its same_as query")
+	} else if res.Diff != "" {
+		msgs = append(msgs, "query returned different results")
+	}
+	return strings.Join(msgs, "; ")
+}
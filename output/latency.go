@@ -0,0 +1,133 @@
+package output
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// latencyTopN is the number of slowest queries listed in the latency summary.
+const latencyTopN = 10
+
+// LatencySummary summarizes the query durations of a run.
+type LatencySummary struct {
+	// Targets lists the duration percentiles of the reference target, followed by those of the test targets.
+	Targets []TargetLatency `json:"targets"`
+	// Slowest lists the test queries with the highest ratio of test to reference duration, highest first.
+	Slowest []SlowQuery `json:"slowest"`
+}
+
+// TargetLatency holds the duration percentiles of the queries against a target.
+type TargetLatency struct {
+	Target  string        `json:"target"`
+	Queries int           `json:"queries"`
+	P50     time.Duration `json:"p50"`
+	P95     time.Duration `json:"p95"`
+}
+
+// A SlowQuery is a test case whose test query took long relative to its reference query.
+type SlowQuery struct {
+	Query        string        `json:"query"`
+	TestTarget   string        `json:"testTarget,omitempty"`
+	RefDuration  time.Duration `json:"refDuration"`
+	TestDuration time.Duration `json:"testDuration"`
+	Ratio        float64       `json:"ratio"`
+}
+
+// latencyBuilder collects the query durations of results as they are written. Durations of
+// errored results and of queries that needed retries are left out, since they do not reflect
+// the duration of a single query.
+type latencyBuilder struct {
+	targets   []string
+	durations map[string][]time.Duration
+	// refSeen tracks the test cases whose reference duration was recorded, since comparisons
+	// against several test targets share one reference query.
+	refSeen map[*comparer.TestCase]bool
+	slowest []SlowQuery
+}
+
+func newLatencyBuilder() *latencyBuilder {
+	return &latencyBuilder{durations: map[string][]time.Duration{}, refSeen: map[*comparer.TestCase]bool{}}
+}
+
+func (lb *latencyBuilder) record(target string, d time.Duration) {
+	if _, ok := lb.durations[target]; !ok {
+		lb.targets = append(lb.targets, target)
+	}
+	lb.durations[target] = append(lb.durations[target], d)
+}
+
+// add records the query durations of a result.
+func (lb *latencyBuilder) add(res *comparer.Result) {
+	if res.Errored() {
+		return
+	}
+	refOK := res.RefDuration > 0 && res.RefRetries == 0
+	testOK := res.TestDuration > 0 && res.TestRetries == 0
+	if refOK && !lb.refSeen[res.TestCase] {
+		lb.refSeen[res.TestCase] = true
+		lb.record("reference", res.RefDuration)
+	}
+	if testOK {
+		target := res.TestTarget
+		if target == "" {
+			target = "test"
+		}
+		lb.record(target, res.TestDuration)
+	}
+	if !refOK || !testOK {
+		return
+	}
+
+	sq := SlowQuery{
+		Query:        res.TestCase.Query,
+		TestTarget:   res.TestTarget,
+		RefDuration:  res.RefDuration,
+		TestDuration: res.TestDuration,
+		Ratio:        float64(res.TestDuration) / float64(res.RefDuration),
+	}
+	i := sort.Search(len(lb.slowest), func(i int) bool { return lb.slowest[i].Ratio < sq.Ratio })
+	if i >= latencyTopN {
+		return
+	}
+	lb.slowest = append(lb.slowest, SlowQuery{})
+	copy(lb.slowest[i+1:], lb.slowest[i:])
+	lb.slowest[i] = sq
+	if len(lb.slowest) > latencyTopN {
+		lb.slowest = lb.slowest[:latencyTopN]
+	}
+}
+
+// build returns the latency summary, or nil if no query durations were recorded.
+func (lb *latencyBuilder) build() *LatencySummary {
+	if len(lb.targets) == 0 {
+		return nil
+	}
+	s := &LatencySummary{Slowest: lb.slowest}
+	for _, t := range lb.targets {
+		ds := lb.durations[t]
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		s.Targets = append(s.Targets, TargetLatency{Target: t, Queries: len(ds), P50: percentile(ds, 0.5), P95: percentile(ds, 0.95)})
+	}
+	return s
+}
+
+// percentile returns the nearest-rank percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// Latency returns the latency summary of results, or nil if no query durations were recorded.
+func Latency(results []*comparer.Result) *LatencySummary {
+	lb := newLatencyBuilder()
+	for _, res := range results {
+		lb.add(res)
+	}
+	return lb.build()
+}
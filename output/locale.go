@@ -0,0 +1,99 @@
+package output
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A NumberLocale controls how numbers are rendered in human-facing reports. Machine-readable
+// formats like JSON, TSV, and JUnit always use the canonical number formatting.
+type NumberLocale struct {
+	Decimal string
+	// Group separates groups of three integer digits. If empty, digits are not grouped.
+	Group string
+}
+
+// numberLocales maps language codes to their number formatting conventions.
+var numberLocales = map[string]NumberLocale{
+	"de": {Decimal: ",", Group: "."},
+	"en": {Decimal: ".", Group: ","},
+	"es": {Decimal: ",", Group: "."},
+	"fr": {Decimal: ",", Group: " "},
+	"it": {Decimal: ",", Group: "."},
+	"ja": {Decimal: ".", Group: ","},
+	"nl": {Decimal: ",", Group: "."},
+	"pt": {Decimal: ",", Group: "."},
+	"ru": {Decimal: ",", Group: " "},
+	"sv": {Decimal: ",", Group: " "},
+	"zh": {Decimal: ".", Group: ","},
+}
+
+// reportLocale is the number locale of the text and HTML reports. The default renders numbers
+// without grouping and with a decimal point.
+var reportLocale = NumberLocale{Decimal: "."}
+
+// SetLocale selects the number formatting of the text and HTML reports by a locale name like
+// "de" or "de_DE.UTF-8". Only the language part of the name is considered.
+func SetLocale(name string) error {
+	if name == "" || name == "C" || name == "POSIX" {
+		reportLocale = NumberLocale{Decimal: "."}
+		return nil
+	}
+	var l NumberLocale
+	ok := false
+	if parts := strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' || r == '.' }); len(parts) > 0 {
+		l, ok = numberLocales[strings.ToLower(parts[0])]
+	}
+	if !ok {
+		langs := make([]string, 0, len(numberLocales))
+		for lang := range numberLocales {
+			langs = append(langs, lang)
+		}
+		sort.Strings(langs)
+		return fmt.Errorf("unsupported locale %q, supported languages: %s", name, strings.Join(langs, ", "))
+	}
+	reportLocale = l
+	return nil
+}
+
+// formatInt renders an integer according to the report locale.
+func formatInt(n int) string {
+	return reportLocale.format(strconv.Itoa(n))
+}
+
+// formatFloat renders a float with the given number of decimals according to the report locale.
+func formatFloat(f float64, prec int) string {
+	return reportLocale.format(strconv.FormatFloat(f, 'f', prec, 64))
+}
+
+// format localizes a canonically formatted decimal number.
+func (l NumberLocale) format(s string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	// Leave non-finite values like "NaN" and "+Inf" as they are.
+	if _, err := strconv.Atoi(intPart); err != nil {
+		return sign + s
+	}
+
+	var b strings.Builder
+	b.WriteString(sign)
+	for i, d := range intPart {
+		if l.Group != "" && i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(l.Group)
+		}
+		b.WriteRune(d)
+	}
+	if fracPart != "" {
+		b.WriteString(l.Decimal)
+		b.WriteString(fracPart)
+	}
+	return b.String()
+}
@@ -0,0 +1,232 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// markdownMiscGroup is the section of test cases without a category.
+const markdownMiscGroup = "misc"
+
+// Markdown produces Markdown output for a number of query results: a summary of the outcomes and
+// the failure triage, followed by a table of results for each test case category. Categories and
+// the results within them are sorted, so that the output of repeated runs only differs where the
+// results do.
+func Markdown(w io.Writer, results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak) {
+	var passed, failed, unsupported, errored, skipped int
+	byGroup := map[string][]*comparer.Result{}
+	multiTarget, multiRange := false, false
+	for _, res := range results {
+		switch Outcome(res) {
+		case "pass":
+			passed++
+		case "fail":
+			failed++
+		case "unsupported":
+			unsupported++
+		case "error":
+			errored++
+		case "skipped":
+			skipped++
+		}
+		if res.TestTarget != "" {
+			multiTarget = true
+		}
+		if res.TestCase.TimeParameterSet != "" {
+			multiRange = true
+		}
+		group := res.TestCase.Category
+		if group == "" {
+			group = markdownMiscGroup
+		}
+		byGroup[group] = append(byGroup[group], res)
+	}
+
+	run := len(results) - skipped
+	share := func(n int) string {
+		if run == 0 {
+			return "-"
+		}
+		return formatFloat(100*float64(n)/float64(run), 2) + "%"
+	}
+	fmt.Fprintln(w, "# PromQL compliance results")
+	fmt.Fprintln(w)
+	if anyChaos(results) {
+		fmt.Fprintf(w, "**%s**\n\n", chaosWarning)
+	}
+	fmt.Fprintln(w, "| Outcome | Test cases | Share |")
+	fmt.Fprintln(w, "| --- | ---: | ---: |")
+	fmt.Fprintf(w, "| Passed | %s | %s |\n", formatInt(passed), share(passed))
+	fmt.Fprintf(w, "| Failed | %s | %s |\n", formatInt(failed), share(failed))
+	fmt.Fprintf(w, "| Unsupported | %s | %s |\n", formatInt(unsupported), share(unsupported))
+	fmt.Fprintf(w, "| Execution errors | %s | %s |\n", formatInt(errored), share(errored))
+	fmt.Fprintf(w, "| Skipped | %s | |\n", formatInt(skipped))
+	fmt.Fprintf(w, "| Total | %s | |\n", formatInt(len(results)))
+	markdownSections(w, Sections(results))
+	markdownTriage(w, Triage(results))
+
+	groups := make([]string, 0, len(byGroup))
+	for g := range byGroup {
+		if g != markdownMiscGroup {
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+	if _, ok := byGroup[markdownMiscGroup]; ok {
+		groups = append(groups, markdownMiscGroup)
+	}
+
+	for _, g := range groups {
+		rs := byGroup[g]
+		sort.SliceStable(rs, func(i, j int) bool {
+			a, b := rs[i].TestCase, rs[j].TestCase
+			if a.Query != b.Query {
+				return a.Query < b.Query
+			}
+			if a.Type != b.Type {
+				return a.Type < b.Type
+			}
+			if a.TimeParameterSet != b.TimeParameterSet {
+				return a.TimeParameterSet < b.TimeParameterSet
+			}
+			return rs[i].TestTarget < rs[j].TestTarget
+		})
+		groupPassed := 0
+		for _, res := range rs {
+			if res.Success() {
+				groupPassed++
+			}
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "## %s\n", g)
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "%s of %s test cases passed.\n", formatInt(groupPassed), formatInt(len(rs)))
+		fmt.Fprintln(w)
+		header := []string{"Query", "Type"}
+		if multiRange {
+			header = append(header, "Time parameters")
+		}
+		if multiTarget {
+			header = append(header, "Target")
+		}
+		header = append(header, "Status", "Diff")
+		fmt.Fprintf(w, "| %s |\n", strings.Join(header, " | "))
+		fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(header)))
+		for _, res := range rs {
+			if res.Success() && !includePassing {
+				continue
+			}
+			cells := []string{markdownCode(res.TestCase.Query), string(res.TestCase.Type)}
+			if multiRange {
+				cells = append(cells, markdownCell(res.TestCase.TimeParameterSet))
+			}
+			if multiTarget {
+				cells = append(cells, markdownCell(res.TestTarget))
+			}
+			cells = append(cells, Outcome(res), markdownCell(markdownReason(res)))
+			fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+		}
+	}
+}
+
+// markdownSections writes the pass rates of the results by PromQL documentation section.
+func markdownSections(w io.Writer, report *SectionReport) {
+	if report == nil {
+		return
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "## Results by documentation section")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "| Section | Passed | Run | Pass rate |")
+	fmt.Fprintln(w, "| --- | ---: | ---: | ---: |")
+	sections := report.Sections
+	if report.Uncategorized != nil {
+		sections = append(sections[:len(sections):len(sections)], report.Uncategorized)
+	}
+	for _, s := range sections {
+		title := markdownCell(s.Title)
+		if s.URL != "" {
+			title = fmt.Sprintf("[%s](%s)", title, s.URL)
+		}
+		fmt.Fprintf(w, "| %s | %s | %s | %.1f%% |\n", title, formatInt(s.Passed), formatInt(s.Run()), s.PassRate())
+	}
+	if len(report.UnmappedFeatures) > 0 {
+		features := make([]string, 0, len(report.UnmappedFeatures))
+		for _, f := range report.UnmappedFeatures {
+			features = append(features, fmt.Sprintf("%s (%s)", markdownCode(f.Feature), formatInt(f.Results)))
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Features without a documentation section: %s.\n", strings.Join(features, ", "))
+	}
+}
+
+// markdownTriage writes the buckets of failures that share a suspected root cause, if there are any.
+func markdownTriage(w io.Writer, buckets []*TriageBucket) {
+	if len(buckets) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "## Failure triage")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "| Heuristic | Shared attribute | Failures | Examples |")
+	fmt.Fprintln(w, "| --- | --- | ---: | --- |")
+	for _, b := range buckets {
+		examples := make([]string, 0, len(b.Examples))
+		for _, ex := range b.Examples {
+			examples = append(examples, markdownCode(ex))
+		}
+		fmt.Fprintf(w, "| %s | %s | %s | %s |\n", markdownCell(b.Heuristic), markdownCell(b.Attribute), formatInt(b.Size), strings.Join(examples, ", "))
+	}
+}
+
+// markdownReason returns the first line of the reason why a result did not pass, if it did not.
+func markdownReason(res *comparer.Result) string {
+	var reason string
+	switch {
+	case res.Success():
+		return ""
+	case res.Skipped():
+		reason = res.SkipReason
+	case res.Errored():
+		reason = res.ExecutionError
+	case res.UnexpectedFailure != "":
+		reason = res.UnexpectedFailure
+	case res.UnexpectedSuccess && res.RefError != "":
+		reason = "query succeeded, but the reference API rejected it: " + res.RefError
+	case res.UnexpectedSuccess:
+		reason = "query succeeded, but should have failed"
+	case res.ErrorMismatch:
+		reason = "query failed with different errors"
+	case res.StructuredDiff != nil:
+		// Keep the first mismatched sample of a series with the series header.
+		lines := strings.SplitN(res.StructuredDiff.String(), "\n", 3)
+		if len(lines) > 1 && strings.HasSuffix(lines[0], ":") {
+			return lines[0] + " " + strings.TrimSpace(lines[1])
+		}
+		return lines[0]
+	case res.Diff == "" && res.WarningsMismatch:
+		reason = "query returned different warnings"
+	default:
+		reason = res.Diff
+	}
+	return strings.SplitN(strings.TrimSpace(reason), "\n", 2)[0]
+}
+
+// markdownCell escapes text for a Markdown table cell.
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
+
+// markdownCode renders text as code in a Markdown table cell. Text with backticks, like PromQL raw
+// strings, is delimited by double backticks.
+func markdownCode(s string) string {
+	if strings.Contains(s, "`") {
+		return "`` " + markdownCell(s) + " ``"
+	}
+	return "`" + markdownCell(s) + "`"
+}
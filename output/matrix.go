@@ -0,0 +1,113 @@
+package output
+
+import (
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// ComplianceMatrix summarizes a run against several test targets, with one row per test case
+// and one column per test target.
+type ComplianceMatrix struct {
+	Targets []string     `json:"targets"`
+	Rows    []*MatrixRow `json:"rows"`
+	// SuccessRates maps test target names to the percentage of test cases that passed against them.
+	SuccessRates map[string]float64 `json:"successRates"`
+}
+
+// MatrixRow holds the outcomes of a single test case against each test target.
+type MatrixRow struct {
+	Query string           `json:"query"`
+	Type  config.QueryType `json:"type"`
+	// Outcomes maps test target names to the test case's outcome against them.
+	Outcomes map[string]string `json:"outcomes"`
+}
+
+// Cells returns the row's outcomes in the order of the given targets.
+func (r *MatrixRow) Cells(targets []string) []string {
+	cells := make([]string, 0, len(targets))
+	for _, t := range targets {
+		cells = append(cells, r.Outcomes[t])
+	}
+	return cells
+}
+
+// Outcome returns a short description of a result's outcome.
+func Outcome(res *comparer.Result) string {
+	switch {
+	case res.Skipped():
+		return "skipped"
+	case res.Errored():
+		return "error"
+	case res.Success():
+		return "pass"
+	case res.Unsupported:
+		return "unsupported"
+	default:
+		return "fail"
+	}
+}
+
+// matrixBuilder collects the outcomes of results as they are written.
+type matrixBuilder struct {
+	matrix ComplianceMatrix
+	rows   map[*comparer.TestCase]*MatrixRow
+	// seen tracks the test targets already in matrix.Targets.
+	seen map[string]bool
+}
+
+func newMatrixBuilder() *matrixBuilder {
+	return &matrixBuilder{rows: map[*comparer.TestCase]*MatrixRow{}, seen: map[string]bool{}}
+}
+
+// add records the outcome of a result. Results without a test target name are ignored.
+func (mb *matrixBuilder) add(res *comparer.Result) {
+	if res.TestTarget == "" {
+		return
+	}
+	if !mb.seen[res.TestTarget] {
+		mb.seen[res.TestTarget] = true
+		mb.matrix.Targets = append(mb.matrix.Targets, res.TestTarget)
+	}
+	row, ok := mb.rows[res.TestCase]
+	if !ok {
+		row = &MatrixRow{Query: res.TestCase.Name(), Type: res.TestCase.Type, Outcomes: map[string]string{}}
+		mb.rows[res.TestCase] = row
+		mb.matrix.Rows = append(mb.matrix.Rows, row)
+	}
+	row.Outcomes[res.TestTarget] = Outcome(res)
+}
+
+// build returns the matrix, or nil if no result named a test target.
+func (mb *matrixBuilder) build() *ComplianceMatrix {
+	if len(mb.matrix.Targets) == 0 {
+		return nil
+	}
+	mb.matrix.SuccessRates = make(map[string]float64, len(mb.matrix.Targets))
+	for i, n := range mb.matrix.PassCounts() {
+		mb.matrix.SuccessRates[mb.matrix.Targets[i]] = 100 * float64(n) / float64(len(mb.matrix.Rows))
+	}
+	return &mb.matrix
+}
+
+// Matrix returns the compliance matrix of results from several test targets, or nil if the
+// results do not name their test targets.
+func Matrix(results []*comparer.Result) *ComplianceMatrix {
+	mb := newMatrixBuilder()
+	for _, res := range results {
+		mb.add(res)
+	}
+	return mb.build()
+}
+
+// PassCounts returns the number of passing test cases for each target, in the order of m.Targets.
+func (m *ComplianceMatrix) PassCounts() []int {
+	counts := make([]int, len(m.Targets))
+	for _, row := range m.Rows {
+		for i, t := range m.Targets {
+			if row.Outcomes[t] == "pass" {
+				counts[i]++
+			}
+		}
+	}
+	return counts
+}
@@ -0,0 +1,239 @@
+package output
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// maxNotificationFingerprintLen is the length that failure fingerprints are cut to when the
+// notification is too large.
+const maxNotificationFingerprintLen = 120
+
+// NotificationReport is the outcome of a run that a notification summarizes.
+type NotificationReport struct {
+	Total, Passed, Failed, Errored, Skipped int
+	Interrupted                             bool
+	// Chaos is set if faults were injected into the requests of the run.
+	Chaos bool
+	// Failures are the failed and errored results.
+	Failures []*comparer.Result
+	// Previous is the history record of the previous run, if known.
+	Previous *HistoryRecord
+	// ReportLink is the URL or path of the full report.
+	ReportLink string
+	// Regressions are the pass rates that regressed against the history baseline, if one is used.
+	Regressions []*HistoryRegression
+}
+
+// NotificationLimits bound the size of a notification.
+type NotificationLimits struct {
+	// MaxBytes is the maximum size of the JSON payload.
+	MaxBytes int
+	// MaxBuckets and MaxNewlyFailing bound the numbers of failure buckets and newly failing
+	// test cases that are listed before any truncation to MaxBytes.
+	MaxBuckets      int
+	MaxNewlyFailing int
+}
+
+// A Notification is the payload sent to notification webhooks after a run. Failures are grouped
+// by fingerprint rather than listed individually, so that runs with many failures do not flood
+// the receiver.
+type Notification struct {
+	Total       int    `json:"total"`
+	Passed      int    `json:"passed"`
+	Failed      int    `json:"failed"`
+	Errored     int    `json:"errored"`
+	Skipped     int    `json:"skipped"`
+	Interrupted bool   `json:"interrupted,omitempty"`
+	Chaos       bool   `json:"chaos,omitempty"`
+	ReportLink  string `json:"reportLink,omitempty"`
+	// Buckets lists the most common failure fingerprints, most common first.
+	Buckets        []NotificationBucket `json:"buckets"`
+	OmittedBuckets int                  `json:"omittedBuckets,omitempty"`
+	// NewlyFailing lists the test cases that failed in this run but not in the previous one. It is
+	// nil if the previous run's failures are unknown.
+	NewlyFailing        []string `json:"newlyFailing"`
+	OmittedNewlyFailing int      `json:"omittedNewlyFailing,omitempty"`
+	// Regressions lists the pass rates that dropped below their mean over earlier runs. It is nil if
+	// no history baseline is used.
+	Regressions []*HistoryRegression `json:"regressions,omitempty"`
+	// Truncated lists the truncation stages that were applied to fit the payload into its size limit.
+	Truncated []string `json:"truncated,omitempty"`
+}
+
+// A NotificationBucket counts the failures that share a fingerprint.
+type NotificationBucket struct {
+	Fingerprint string   `json:"fingerprint"`
+	Count       int      `json:"count"`
+	Examples    []string `json:"examples,omitempty"`
+}
+
+// Notification truncation stages, in the order in which they are applied.
+const (
+	NotificationTruncateExamples     = "bucket examples"
+	NotificationTruncateFingerprints = "fingerprints"
+	NotificationTruncateNewlyFailing = "newly failing"
+	NotificationTruncateBuckets      = "buckets"
+)
+
+// failureFingerprint returns a description of why a result failed that is shared by failures with
+// the same cause, with numbers in error messages replaced by N.
+func failureFingerprint(res *comparer.Result) string {
+	switch {
+	case res.Errored():
+		return "execution error: " + triageNumberRe.ReplaceAllString(res.ExecutionError, "N")
+	case res.UnexpectedFailure != "":
+		return "unexpected failure: " + triageNumberRe.ReplaceAllString(res.UnexpectedFailure, "N")
+	case res.UnexpectedSuccess:
+		return "query succeeded, but should have failed"
+	case res.ErrorMismatch:
+		return "query failed with different errors"
+	case res.WarningsMismatch && res.Diff == "":
+		return "query returned different warnings"
+	case res.ConsistencyViolation:
+		return "internal consistency violation"
+	case strings.HasPrefix(res.Diff, "result type mismatch"):
+		return res.Diff
+	default:
+		return "query returned different results"
+	}
+}
+
+// ShapeNotification builds the notification of a run and returns its JSON payload. If the payload
+// exceeds limits.MaxBytes, it is truncated progressively: first the bucket examples are dropped,
+// then the fingerprints are shortened, then the newly failing test cases and finally the buckets
+// are halved until the payload fits. It fails if even the counts alone do not fit.
+func ShapeNotification(r NotificationReport, limits NotificationLimits) ([]byte, error) {
+	n := &Notification{
+		Total:       r.Total,
+		Passed:      r.Passed,
+		Failed:      r.Failed,
+		Errored:     r.Errored,
+		Skipped:     r.Skipped,
+		Interrupted: r.Interrupted,
+		Chaos:       r.Chaos,
+		ReportLink:  r.ReportLink,
+		Buckets:     []NotificationBucket{},
+		Regressions: r.Regressions,
+	}
+
+	buckets := map[string]*NotificationBucket{}
+	for _, res := range r.Failures {
+		fp := failureFingerprint(res)
+		b, ok := buckets[fp]
+		if !ok {
+			b = &NotificationBucket{Fingerprint: fp}
+			buckets[fp] = b
+		}
+		b.Count++
+		if len(b.Examples) < triageMaxExamples {
+			b.Examples = append(b.Examples, FailureKey(res))
+		}
+	}
+	for _, b := range buckets {
+		n.Buckets = append(n.Buckets, *b)
+	}
+	sort.Slice(n.Buckets, func(i, j int) bool {
+		if n.Buckets[i].Count != n.Buckets[j].Count {
+			return n.Buckets[i].Count > n.Buckets[j].Count
+		}
+		return n.Buckets[i].Fingerprint < n.Buckets[j].Fingerprint
+	})
+	if limits.MaxBuckets > 0 {
+		n.limitBuckets(limits.MaxBuckets)
+	}
+
+	// Old history records without failing test cases only show that there were no failures if all
+	// of their test cases passed.
+	if p := r.Previous; p != nil && (len(p.Failing) > 0 || p.Passed == p.Total) {
+		previous := make(map[string]bool, len(p.Failing))
+		for _, key := range p.Failing {
+			previous[key] = true
+		}
+		n.NewlyFailing = []string{}
+		for _, res := range r.Failures {
+			if key := FailureKey(res); !previous[key] {
+				n.NewlyFailing = append(n.NewlyFailing, key)
+			}
+		}
+		if limits.MaxNewlyFailing > 0 {
+			n.limitNewlyFailing(limits.MaxNewlyFailing)
+		}
+	}
+
+	var (
+		buf []byte
+		err error
+	)
+	fits := func() bool {
+		buf, err = json.Marshal(n)
+		return err != nil || limits.MaxBytes <= 0 || len(buf) <= limits.MaxBytes
+	}
+	if fits() {
+		return buf, err
+	}
+
+	n.Truncated = append(n.Truncated, NotificationTruncateExamples)
+	for i := range n.Buckets {
+		n.Buckets[i].Examples = nil
+	}
+	if fits() {
+		return buf, err
+	}
+
+	n.Truncated = append(n.Truncated, NotificationTruncateFingerprints)
+	for i, b := range n.Buckets {
+		if len(b.Fingerprint) > maxNotificationFingerprintLen {
+			n.Buckets[i].Fingerprint = strings.ToValidUTF8(b.Fingerprint[:maxNotificationFingerprintLen], "") + "..."
+		}
+	}
+	if fits() {
+		return buf, err
+	}
+
+	if len(n.NewlyFailing) > 0 {
+		n.Truncated = append(n.Truncated, NotificationTruncateNewlyFailing)
+		for len(n.NewlyFailing) > 0 {
+			n.limitNewlyFailing(len(n.NewlyFailing) / 2)
+			if fits() {
+				return buf, err
+			}
+		}
+	}
+
+	if len(n.Buckets) > 0 {
+		n.Truncated = append(n.Truncated, NotificationTruncateBuckets)
+		for len(n.Buckets) > 0 {
+			n.limitBuckets(len(n.Buckets) / 2)
+			if fits() {
+				return buf, err
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, errors.Errorf("notification of %d bytes exceeds the limit of %d bytes", len(buf), limits.MaxBytes)
+}
+
+// limitBuckets keeps the first max buckets, counting the others as omitted.
+func (n *Notification) limitBuckets(max int) {
+	if len(n.Buckets) <= max {
+		return
+	}
+	n.OmittedBuckets += len(n.Buckets) - max
+	n.Buckets = n.Buckets[:max]
+}
+
+// limitNewlyFailing keeps the first max newly failing test cases, counting the others as omitted.
+func (n *Notification) limitNewlyFailing(max int) {
+	if len(n.NewlyFailing) <= max {
+		return
+	}
+	n.OmittedNewlyFailing += len(n.NewlyFailing) - max
+	n.NewlyFailing = n.NewlyFailing[:max]
+}
@@ -0,0 +1,150 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// notificationReport returns a report of a run with four results that returned different results,
+// one whose test query failed with a long error, and no failures in the previous run.
+func notificationReport() NotificationReport {
+	var failures []*comparer.Result
+	for i := 0; i < 4; i++ {
+		failures = append(failures, &comparer.Result{TestCase: &comparer.TestCase{Query: fmt.Sprintf("rate(demo_%s_%d[5m])", strings.Repeat("x", 200), i)}, Diff: "different values"})
+	}
+	failures = append(failures, &comparer.Result{TestCase: &comparer.TestCase{Query: "demo_unsupported"}, UnexpectedFailure: "bad_data: " + strings.Repeat("unsupported expression ", 50)})
+	return NotificationReport{Total: 10, Passed: 5, Failed: 5, Failures: failures, Previous: &HistoryRecord{Total: 10, Passed: 10}}
+}
+
+func TestShapeNotificationTruncation(t *testing.T) {
+	shape := func(maxBytes int) (*Notification, int, error) {
+		payload, err := ShapeNotification(notificationReport(), NotificationLimits{MaxBytes: maxBytes})
+		if err != nil {
+			return nil, 0, err
+		}
+		var n Notification
+		if err := json.Unmarshal(payload, &n); err != nil {
+			t.Fatal(err)
+		}
+		return &n, len(payload), nil
+	}
+	size := func(n *Notification) int {
+		buf, err := json.Marshal(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(buf)
+	}
+	full, fullSize, err := shape(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Truncated != nil || len(full.Buckets) != 2 || len(full.Buckets[0].Examples) != triageMaxExamples || len(full.NewlyFailing) != 5 {
+		t.Fatalf("expected the untruncated notification to list all buckets, examples, and newly failing test cases, got %+v", full)
+	}
+
+	// Each limit is one byte below the payload that the previous stage produced, so that each
+	// stage has to be applied in turn.
+	limit := fullSize - 1
+	for _, tc := range []struct {
+		stage               string
+		wantTruncated       []string
+		wantBuckets         int
+		wantOmittedBuckets  int
+		wantNewlyFailing    int
+		wantOmittedFailing  int
+		wantFingerprintsCut bool
+		// next, if set, returns the payload size that the next stage has to undercut.
+		next func(n *Notification) int
+	}{
+		{
+			stage:         NotificationTruncateExamples,
+			wantTruncated: []string{NotificationTruncateExamples},
+			wantBuckets:   2, wantNewlyFailing: 5,
+		},
+		{
+			stage:         NotificationTruncateFingerprints,
+			wantTruncated: []string{NotificationTruncateExamples, NotificationTruncateFingerprints},
+			wantBuckets:   2, wantNewlyFailing: 5, wantFingerprintsCut: true,
+		},
+		{
+			stage:         NotificationTruncateNewlyFailing,
+			wantTruncated: []string{NotificationTruncateExamples, NotificationTruncateFingerprints, NotificationTruncateNewlyFailing},
+			wantBuckets:   2, wantNewlyFailing: 2, wantOmittedFailing: 3, wantFingerprintsCut: true,
+			// The buckets are only halved once all newly failing test cases are dropped.
+			next: func(n *Notification) int {
+				n.NewlyFailing, n.OmittedNewlyFailing = []string{}, 5
+				return size(n)
+			},
+		},
+		{
+			stage:         NotificationTruncateBuckets,
+			wantTruncated: []string{NotificationTruncateExamples, NotificationTruncateFingerprints, NotificationTruncateNewlyFailing, NotificationTruncateBuckets},
+			wantBuckets:   1, wantOmittedBuckets: 1, wantOmittedFailing: 5, wantFingerprintsCut: true,
+			next: func(n *Notification) int {
+				n.Buckets, n.OmittedBuckets = []NotificationBucket{}, 2
+				return size(n)
+			},
+		},
+	} {
+		t.Run(tc.stage, func(t *testing.T) {
+			n, got, err := shape(limit)
+			if err != nil {
+				t.Fatalf("expected the notification to fit into %d bytes, got %v", limit, err)
+			}
+			if got > limit {
+				t.Errorf("expected at most %d bytes, got %d", limit, got)
+			}
+			if !reflect.DeepEqual(n.Truncated, tc.wantTruncated) {
+				t.Errorf("expected the truncation stages %q, got %q", tc.wantTruncated, n.Truncated)
+			}
+			if len(n.Buckets) != tc.wantBuckets || n.OmittedBuckets != tc.wantOmittedBuckets {
+				t.Errorf("expected %d buckets with %d omitted, got %d with %d omitted", tc.wantBuckets, tc.wantOmittedBuckets, len(n.Buckets), n.OmittedBuckets)
+			}
+			if len(n.NewlyFailing) != tc.wantNewlyFailing || n.OmittedNewlyFailing != tc.wantOmittedFailing {
+				t.Errorf("expected %d newly failing test cases with %d omitted, got %d with %d omitted", tc.wantNewlyFailing, tc.wantOmittedFailing, len(n.NewlyFailing), n.OmittedNewlyFailing)
+			}
+			for _, b := range n.Buckets {
+				if b.Examples != nil {
+					t.Errorf("expected no examples, got %q", b.Examples)
+				}
+				long := strings.HasPrefix(b.Fingerprint, "unexpected failure")
+				if cut := strings.HasSuffix(b.Fingerprint, "..."); long && cut != tc.wantFingerprintsCut {
+					t.Errorf("expected the long fingerprint to be cut %v, got %q", tc.wantFingerprintsCut, b.Fingerprint)
+				}
+				if tc.wantFingerprintsCut && len(b.Fingerprint) > maxNotificationFingerprintLen+len("...") {
+					t.Errorf("expected fingerprints of at most %d characters, got %q", maxNotificationFingerprintLen, b.Fingerprint)
+				}
+			}
+			if tc.next != nil {
+				got = tc.next(n)
+			}
+			limit = got - 1
+		})
+	}
+
+	// Not even the counts fit into the limit of the last stage.
+	if _, err := ShapeNotification(notificationReport(), NotificationLimits{MaxBytes: limit}); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("exceeds the limit of %d bytes", limit)) {
+		t.Errorf("expected a notification that does not fit into %d bytes to be an error, got %v", limit, err)
+	}
+}
+
+func TestShapeNotificationLimits(t *testing.T) {
+	payload, err := ShapeNotification(notificationReport(), NotificationLimits{MaxBuckets: 1, MaxNewlyFailing: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n Notification
+	if err := json.Unmarshal(payload, &n); err != nil {
+		t.Fatal(err)
+	}
+	// The counts limit the lists without any truncation to a size.
+	if n.Truncated != nil || len(n.Buckets) != 1 || n.OmittedBuckets != 1 || n.Buckets[0].Count != 4 || len(n.NewlyFailing) != 2 || n.OmittedNewlyFailing != 3 {
+		t.Errorf("expected the most common bucket and 2 newly failing test cases, got %+v", n)
+	}
+}
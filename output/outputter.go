@@ -1,9 +1,24 @@
 package output
 
 import (
+	"io"
+
 	"github.com/promlabs/promql-compliance-tester/comparer"
 	"github.com/promlabs/promql-compliance-tester/config"
 )
 
 // An Outputter outputs a number of test results.
-type Outputter func(results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak)
+type Outputter func(w io.Writer, results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak)
+
+// chaosWarning heads the outputs of runs with injected faults.
+const chaosWarning = "WARNING: faults were injected into the requests of this run with -chaos, the results are not compliance data."
+
+// anyChaos returns true if any of the results was produced with injected faults.
+func anyChaos(results []*comparer.Result) bool {
+	for _, res := range results {
+		if res.Chaos {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestChaosResultsAreMarked(t *testing.T) {
+	results := jsonLinesResults(3)
+	results[1].Chaos = true
+
+	var text bytes.Buffer
+	Text(&text, results, false, nil)
+	// The text output is streamed, so that the warning heads its summary.
+	if !strings.Contains(text.String(), chaosWarning) {
+		t.Errorf("expected the text output to contain the chaos warning, got:\n%s", text.String())
+	}
+
+	var buf bytes.Buffer
+	JSON(&buf, results, false, nil)
+	var doc map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["chaos"] != true {
+		t.Errorf("expected the json output to be marked as chaos, got %v", doc["chaos"])
+	}
+
+	var lines bytes.Buffer
+	out := newJSONLinesWriter(&lines, false, nil)
+	for _, res := range results {
+		out.WriteResult(res)
+	}
+	out.Finish(nil)
+	all := bytes.Split(bytes.TrimRight(lines.Bytes(), "\n"), []byte("\n"))
+	var summary jsonLine
+	if err := json.Unmarshal(all[len(all)-1], &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Summary["chaos"] != true {
+		t.Errorf("expected the JSON lines summary to be marked as chaos, got %v", summary.Summary)
+	}
+
+	results[1].Chaos = false
+	buf.Reset()
+	JSON(&buf, results, false, nil)
+	if strings.Contains(buf.String(), `"chaos"`) {
+		t.Error("expected the json output of a run without chaos not to mention it")
+	}
+}
@@ -0,0 +1,64 @@
+package output
+
+import (
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// maxParitySummaryExamples bounds the number of test cases with request drift listed in reports.
+const maxParitySummaryExamples = 10
+
+// A ParitySummary counts the test cases whose requests to the reference and test targets were
+// compared, and those that were sent differing query parameters.
+type ParitySummary struct {
+	Checked  int             `json:"checked"`
+	Drifted  int             `json:"drifted"`
+	Examples []ParityExample `json:"examples"`
+}
+
+// A ParityExample lists the request drift of a test case.
+type ParityExample struct {
+	Query      string   `json:"query"`
+	TestTarget string   `json:"testTarget,omitempty"`
+	Drift      []string `json:"drift"`
+}
+
+// parityBuilder collects the request parity checks of results as they are written.
+type parityBuilder struct {
+	summary ParitySummary
+}
+
+func newParityBuilder() *parityBuilder {
+	return &parityBuilder{summary: ParitySummary{Examples: []ParityExample{}}}
+}
+
+func (pb *parityBuilder) add(res *comparer.Result) {
+	p := res.RequestParity
+	if p == nil {
+		return
+	}
+	pb.summary.Checked++
+	if len(p.Drift) == 0 {
+		return
+	}
+	pb.summary.Drifted++
+	if len(pb.summary.Examples) < maxParitySummaryExamples {
+		pb.summary.Examples = append(pb.summary.Examples, ParityExample{Query: res.TestCase.Query, TestTarget: res.TestTarget, Drift: p.Drift})
+	}
+}
+
+// build returns the summary, or nil if no requests were compared.
+func (pb *parityBuilder) build() *ParitySummary {
+	if pb.summary.Checked == 0 {
+		return nil
+	}
+	return &pb.summary
+}
+
+// Parity summarizes the request parity checks of results, or returns nil if none were checked.
+func Parity(results []*comparer.Result) *ParitySummary {
+	pb := newParityBuilder()
+	for _, res := range results {
+		pb.add(res)
+	}
+	return pb.build()
+}
@@ -0,0 +1,91 @@
+package output
+
+import (
+	"sort"
+)
+
+// A HistoryBaseline holds the history records of earlier runs that the pass rates of the current
+// run are compared with to find regressions.
+type HistoryBaseline struct {
+	// Runs are the records of the earlier runs in the trailing window, from the oldest to the latest.
+	Runs []*HistoryRecord
+	// Threshold is the drop in percentage points below the trailing mean pass rate that counts as
+	// a regression.
+	Threshold float64
+}
+
+// A HistoryRegression is a drop of the pass rate of all test cases, of the test cases of one
+// category, or of the test cases expanded from one query template below its mean pass rate over
+// the earlier runs of a HistoryBaseline.
+type HistoryRegression struct {
+	Name string `json:"name"`
+	// Template is set if Name is a query template rather than a category.
+	Template bool `json:"template,omitempty"`
+	// Rate is the pass rate of the current run and TrailingMean the mean pass rate of the earlier
+	// runs that included the test cases, both in percent.
+	Rate         float64 `json:"rate"`
+	TrailingMean float64 `json:"trailingMean"`
+	Runs         int     `json:"runs"`
+	// Drop is the difference between TrailingMean and Rate in percentage points.
+	Drop float64 `json:"drop"`
+}
+
+// Title returns the name of the regressed test cases for reports.
+func (r *HistoryRegression) Title() string {
+	if r.Template {
+		return "template " + r.Name
+	}
+	return r.Name
+}
+
+// Regressions returns the pass rates of the current run that dropped by more than the threshold
+// below their trailing means, the overall pass rate first, followed by the categories and then the
+// query templates, each sorted by name. A nil baseline yields no regressions.
+func (b *HistoryBaseline) Regressions(current *HistoryRecord) []*HistoryRegression {
+	if b == nil {
+		return nil
+	}
+	regressions := []*HistoryRegression{}
+	check := func(name string, template bool, counts func(*HistoryRecord) (total, passed int)) {
+		total, passed := counts(current)
+		if total == 0 {
+			return
+		}
+		var sum float64
+		runs := 0
+		for _, rec := range b.Runs {
+			if t, p := counts(rec); t > 0 {
+				sum += 100 * float64(p) / float64(t)
+				runs++
+			}
+		}
+		if runs == 0 {
+			return
+		}
+		r := &HistoryRegression{Name: name, Template: template, Rate: 100 * float64(passed) / float64(total), TrailingMean: sum / float64(runs), Runs: runs}
+		if r.Drop = r.TrailingMean - r.Rate; r.Drop > b.Threshold {
+			regressions = append(regressions, r)
+		}
+	}
+	checkGroups := func(groups map[string]*HistoryCounts, template bool, of func(*HistoryRecord) map[string]*HistoryCounts) {
+		names := make([]string, 0, len(groups))
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			name := name
+			check(name, template, func(rec *HistoryRecord) (int, int) {
+				if c, ok := of(rec)[name]; ok {
+					return c.Total, c.Passed
+				}
+				return 0, 0
+			})
+		}
+	}
+
+	check("all test cases", false, func(rec *HistoryRecord) (int, int) { return rec.Total, rec.Passed })
+	checkGroups(current.Categories, false, func(rec *HistoryRecord) map[string]*HistoryCounts { return rec.Categories })
+	checkGroups(current.Templates, true, func(rec *HistoryRecord) map[string]*HistoryCounts { return rec.Templates })
+	return regressions
+}
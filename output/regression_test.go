@@ -0,0 +1,214 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// historyResults returns the results of a run in which the given numbers of the 10 test cases of
+// each category passed. The test cases of the histograms category are expanded from a template.
+func historyResults(passedByCategory map[string]int) []*comparer.Result {
+	var results []*comparer.Result
+	for _, cat := range []string{"aggregations", "histograms"} {
+		for i := 0; i < 10; i++ {
+			tc := &comparer.TestCase{Query: fmt.Sprintf("%s_%d", cat, i), Category: cat}
+			if cat == "histograms" {
+				tc.Query = fmt.Sprintf("histogram_quantile(0.%d, rate(demo_bucket[5m]))", i)
+				tc.Template = "histogram_quantile({{.quantile}}, rate(demo_bucket[{{.range}}]))"
+			}
+			res := &comparer.Result{TestCase: tc}
+			if i >= passedByCategory[cat] {
+				res.Diff = "different values"
+			}
+			results = append(results, res)
+		}
+	}
+	return results
+}
+
+// historySequence returns the history records of runs with the given pass counts of the histograms
+// category, in which all aggregations pass.
+func historySequence(histogramsPassed ...int) []*HistoryRecord {
+	var runs []*HistoryRecord
+	for i, n := range histogramsPassed {
+		runs = append(runs, NewHistoryRecord(time.Unix(int64(i)*86400, 0), historyResults(map[string]int{"aggregations": 10, "histograms": n})))
+	}
+	return runs
+}
+
+func TestHistoryRegressions(t *testing.T) {
+	const template = "histogram_quantile({{.quantile}}, rate(demo_bucket[{{.range}}]))"
+	// The mean of three runs in which all and four runs in which 9 of the 10 histograms passed.
+	var mean float64 = 660.0 / 7
+	for _, tc := range []struct {
+		name      string
+		runs      []*HistoryRecord
+		current   map[string]int
+		threshold float64
+		want      []*HistoryRegression
+	}{
+		{
+			name:      "stable",
+			runs:      historySequence(9, 9, 9, 9, 9, 9, 9),
+			current:   map[string]int{"aggregations": 10, "histograms": 9},
+			threshold: 5,
+			want:      []*HistoryRegression{},
+		},
+		{
+			name:    "drop of one category",
+			runs:    historySequence(10, 9, 10, 9, 10, 9, 9),
+			current: map[string]int{"aggregations": 10, "histograms": 8},
+			// The overall pass rate drops by 7.14 points only.
+			threshold: 10,
+			want: []*HistoryRegression{
+				{Name: "histograms", Rate: 80, TrailingMean: mean, Runs: 7, Drop: mean - 80},
+				{Name: template, Template: true, Rate: 80, TrailingMean: mean, Runs: 7, Drop: mean - 80},
+			},
+		},
+		{
+			name:      "drop equal to the threshold",
+			runs:      historySequence(10, 10, 10),
+			current:   map[string]int{"aggregations": 10, "histograms": 9},
+			threshold: 10,
+			want:      []*HistoryRegression{},
+		},
+		{
+			name:      "drop of all test cases",
+			runs:      historySequence(10, 10),
+			current:   map[string]int{"aggregations": 5, "histograms": 0},
+			threshold: 5,
+			want: []*HistoryRegression{
+				{Name: "all test cases", Rate: 25, TrailingMean: 100, Runs: 2, Drop: 75},
+				{Name: "aggregations", Rate: 50, TrailingMean: 100, Runs: 2, Drop: 50},
+				{Name: "histograms", Rate: 0, TrailingMean: 100, Runs: 2, Drop: 100},
+				{Name: template, Template: true, Rate: 0, TrailingMean: 100, Runs: 2, Drop: 100},
+			},
+		},
+		{
+			name: "category missing in earlier runs",
+			runs: []*HistoryRecord{
+				NewHistoryRecord(time.Unix(0, 0), historyResults(map[string]int{"aggregations": 10, "histograms": 10})[:10]),
+				NewHistoryRecord(time.Unix(86400, 0), historyResults(map[string]int{"aggregations": 10, "histograms": 10})),
+			},
+			current:   map[string]int{"aggregations": 10, "histograms": 5},
+			threshold: 5,
+			want: []*HistoryRegression{
+				{Name: "all test cases", Rate: 75, TrailingMean: 100, Runs: 2, Drop: 25},
+				// Only the run that included the histograms counts towards their trailing mean.
+				{Name: "histograms", Rate: 50, TrailingMean: 100, Runs: 1, Drop: 50},
+				{Name: template, Template: true, Rate: 50, TrailingMean: 100, Runs: 1, Drop: 50},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &HistoryBaseline{Runs: tc.runs, Threshold: tc.threshold}
+			got := b.Regressions(NewHistoryRecord(time.Now(), historyResults(tc.current)))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected the regressions %s, got %s", regressionsString(tc.want), regressionsString(got))
+			}
+		})
+	}
+
+	var nilBaseline *HistoryBaseline
+	if got := nilBaseline.Regressions(NewHistoryRecord(time.Now(), historyResults(nil))); got != nil {
+		t.Errorf("expected no regressions without a baseline, got %s", regressionsString(got))
+	}
+}
+
+func regressionsString(rs []*HistoryRegression) string {
+	var s []string
+	for _, r := range rs {
+		s = append(s, fmt.Sprintf("%+v", *r))
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+func TestHistoryTemplatesRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "history.jsonl")
+
+	for _, rec := range historySequence(10, 9, 8) {
+		if err := AppendHistory(filename, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runs, err := ReadHistory(filename, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("expected the last 2 runs, got %d", len(runs))
+	}
+	want := map[string]*HistoryCounts{"histogram_quantile({{.quantile}}, rate(demo_bucket[{{.range}}]))": {Total: 10, Passed: 8}}
+	if !reflect.DeepEqual(runs[1].Templates, want) {
+		t.Errorf("expected the template counts %v, got %v", want, runs[1].Templates)
+	}
+	if got := runs[1].Categories["aggregations"]; got == nil || got.Passed != 10 {
+		t.Errorf("expected all aggregations to pass, got %+v", got)
+	}
+}
+
+func TestHistoryRegressionsInReports(t *testing.T) {
+	baseline := &HistoryBaseline{Runs: historySequence(10, 10, 10, 10, 10, 10, 10), Threshold: 5}
+	results := historyResults(map[string]int{"aggregations": 10, "histograms": 7})
+
+	var text bytes.Buffer
+	TextWithHistory(baseline)(&text, results, false, nil)
+	for _, w := range []string{
+		"Regressions vs. history:",
+		"*  histograms: 70.00% passed, 30.00 points below the mean of 100.00% over the last 7 runs",
+		"*  template histogram_quantile({{.quantile}}, rate(demo_bucket[{{.range}}])): 70.00% passed",
+	} {
+		if !strings.Contains(text.String(), w) {
+			t.Errorf("expected the text report to contain %q, got:\n%s", w, text.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	JSONWithHistory(baseline)(&buf, results, false, nil)
+	var doc struct {
+		HistoryRegressions []*HistoryRegression `json:"historyRegressions"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.HistoryRegressions) != 3 || !doc.HistoryRegressions[2].Template {
+		t.Errorf("expected the overall, category, and template regressions in the JSON report, got %s", regressionsString(doc.HistoryRegressions))
+	}
+
+	payload, err := ShapeNotification(NotificationReport{Total: len(results), Passed: 17, Failed: 3, Regressions: baseline.Regressions(NewHistoryRecord(time.Now(), results))}, NotificationLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n Notification
+	if err := json.Unmarshal(payload, &n); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(n.Regressions, doc.HistoryRegressions) {
+		t.Errorf("expected the regressions %s in the notification, got %s", regressionsString(doc.HistoryRegressions), regressionsString(n.Regressions))
+	}
+
+	var html bytes.Buffer
+	r, err := HTML("example-output.html", 0, "", nil, baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r(&html, results, false, nil)
+	if !strings.Contains(html.String(), "template histogram_quantile") {
+		t.Errorf("expected the html report to list the template regression")
+	}
+}
@@ -0,0 +1,323 @@
+package output
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"gopkg.in/yaml.v2"
+)
+
+// uncategorizedSection is the ID of the section of results that no documentation section applies to.
+const uncategorizedSection = "uncategorized"
+
+// maxSectionExamples bounds the number of failing queries listed per documentation section.
+const maxSectionExamples = 5
+
+// sectionMappingYAML maps the PromQL features of the test cases to the sections of the PromQL
+// documentation that specify them. A test case counts towards the section of each of its features,
+// and of each of its tags that a section lists. Features are functions and aggregation operators
+// like "rate" and "sum", binary operators like "+" and "and", the keywords "on", "ignoring",
+// "group_left", "group_right", "bool", and "offset", and "@", "range selector", "subquery", and
+// "selector" for queries without any other feature.
+const sectionMappingYAML = `
+base_url: https://prometheus.io/docs/prometheus/latest/querying/
+sections:
+- id: instant-vector-selectors
+  title: Instant vector selectors
+  anchor: basics/#instant-vector-selectors
+  features: [selector]
+- id: range-vector-selectors
+  title: Range vector selectors
+  anchor: basics/#range-vector-selectors
+  features: [range selector]
+- id: offset-modifier
+  title: Offset modifier
+  anchor: basics/#offset-modifier
+  features: [offset]
+- id: at-modifier
+  title: '@ modifier'
+  anchor: basics/#modifier
+  features: ['@']
+- id: subqueries
+  title: Subqueries
+  anchor: basics/#subquery
+  features: [subquery]
+- id: arithmetic-binary-operators
+  title: Arithmetic binary operators
+  anchor: operators/#arithmetic-binary-operators
+  features: ['+', '-', '*', '/', '%', '^', atan2]
+- id: comparison-binary-operators
+  title: Comparison binary operators
+  anchor: operators/#comparison-binary-operators
+  features: ['==', '!=', '>', '<', '>=', '<=', bool]
+- id: logical-set-binary-operators
+  title: Logical/set binary operators
+  anchor: operators/#logical-set-binary-operators
+  features: [and, or, unless]
+- id: vector-matching
+  title: Vector matching
+  anchor: operators/#vector-matching
+  features: ['on', ignoring, group_left, group_right]
+- id: aggregation-operators
+  title: Aggregation operators
+  anchor: operators/#aggregation-operators
+  features: [sum, min, max, avg, group, stddev, stdvar, count, count_values, bottomk, topk, quantile, limitk, limit_ratio]
+- id: rate-functions
+  title: Rates and deltas
+  anchor: functions/#rate
+  features: [rate, irate, increase, delta, idelta, deriv, predict_linear, changes, resets]
+- id: over-time-functions
+  title: Aggregation over time
+  anchor: functions/#aggregation_over_time
+  features: [avg_over_time, min_over_time, max_over_time, sum_over_time, count_over_time, quantile_over_time, stddev_over_time, stdvar_over_time, last_over_time, present_over_time, absent_over_time, mad_over_time]
+- id: math-functions
+  title: Mathematical functions
+  anchor: functions/#abs
+  features: [abs, ceil, floor, exp, sqrt, ln, log2, log10, round, sgn, clamp, clamp_min, clamp_max, acos, acosh, asin, asinh, atan, atanh, cos, cosh, sin, sinh, tan, tanh, deg, rad, pi]
+- id: histogram-functions
+  title: Histogram functions
+  anchor: functions/#histogram_quantile
+  features: [histogram_quantile, histogram_count, histogram_sum, histogram_fraction, histogram_avg, histogram_stddev, histogram_stdvar]
+- id: time-functions
+  title: Time and date functions
+  anchor: functions/#time
+  features: [time, timestamp, day_of_month, day_of_week, day_of_year, days_in_month, hour, minute, month, year]
+- id: label-functions
+  title: Label manipulation functions
+  anchor: functions/#label_replace
+  features: [label_replace, label_join]
+- id: smoothing-functions
+  title: Smoothing functions
+  anchor: functions/#holt_winters
+  features: [holt_winters, double_exponential_smoothing]
+- id: absence-functions
+  title: Absence functions
+  anchor: functions/#absent
+  features: [absent]
+- id: sorting-functions
+  title: Sorting functions
+  anchor: functions/#sort
+  features: [sort, sort_desc, sort_by_label, sort_by_label_desc]
+- id: conversion-functions
+  title: Type conversion functions
+  anchor: functions/#scalar
+  features: [scalar, vector]
+`
+
+// A sectionMapping maps PromQL features and test case tags to documentation sections.
+type sectionMapping struct {
+	BaseURL  string `yaml:"base_url"`
+	Sections []struct {
+		ID       string   `yaml:"id"`
+		Title    string   `yaml:"title"`
+		Anchor   string   `yaml:"anchor"`
+		Features []string `yaml:"features"`
+		Tags     []string `yaml:"tags"`
+	} `yaml:"sections"`
+	// byFeature and byTag map features and tags to the indexes of their sections.
+	byFeature map[string]int
+	byTag     map[string]int
+}
+
+// builtinSections is the parsed sectionMappingYAML.
+var builtinSections = mustParseSectionMapping(sectionMappingYAML)
+
+func mustParseSectionMapping(s string) *sectionMapping {
+	m := &sectionMapping{byFeature: map[string]int{}, byTag: map[string]int{}}
+	if err := yaml.UnmarshalStrict([]byte(s), m); err != nil {
+		panic(fmt.Sprintf("invalid documentation section mapping: %v", err))
+	}
+	for i, s := range m.Sections {
+		for _, f := range s.Features {
+			if j, ok := m.byFeature[f]; ok {
+				panic(fmt.Sprintf("invalid documentation section mapping: feature %q is in sections %q and %q", f, m.Sections[j].ID, s.ID))
+			}
+			m.byFeature[f] = i
+		}
+		for _, t := range s.Tags {
+			m.byTag[t] = i
+		}
+	}
+	return m
+}
+
+var (
+	sectionStringRe      = regexp.MustCompile("\"(?:[^\"\\\\]|\\\\.)*\"|'(?:[^'\\\\]|\\\\.)*'|`[^`]*`")
+	sectionMatchersRe    = regexp.MustCompile(`\{[^}]*\}`)
+	sectionRangeRe       = regexp.MustCompile(`\[[^\]]*\]`)
+	sectionCallRe        = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)\s*\(`)
+	sectionKeywordRe     = regexp.MustCompile(`\b(and|or|unless|on|ignoring|group_left|group_right|bool|offset|by|without)\b`)
+	sectionGroupedAggrRe = regexp.MustCompile(`([a-z_]+)\s+(?:by|without)\s*\(`)
+	sectionComparisonRe  = regexp.MustCompile(`==|!=|>=|<=|>|<`)
+	sectionArithRe       = regexp.MustCompile(`[a-zA-Z0-9_)\]]\s*([-+*/%^])`)
+)
+
+// queryFeatures returns the PromQL features that a query uses, in the terms of sectionMappingYAML.
+func queryFeatures(query string) []string {
+	seen := map[string]bool{}
+	var features []string
+	add := func(f string) {
+		if !seen[f] {
+			seen[f] = true
+			features = append(features, f)
+		}
+	}
+	q := sectionStringRe.ReplaceAllString(query, `""`)
+	q = sectionMatchersRe.ReplaceAllString(q, "")
+	for _, r := range sectionRangeRe.FindAllString(q, -1) {
+		if strings.Contains(r, ":") {
+			add("subquery")
+		} else {
+			add("range selector")
+		}
+	}
+	q = sectionRangeRe.ReplaceAllString(q, "")
+	if strings.Contains(q, "@") {
+		add("@")
+	}
+	for _, m := range sectionKeywordRe.FindAllStringSubmatch(q, -1) {
+		if m[1] != "by" && m[1] != "without" {
+			add(m[1])
+		}
+	}
+	for _, m := range sectionCallRe.FindAllStringSubmatch(q, -1) {
+		// Keywords followed by "(", like the label lists of grouping and matching clauses, are not calls.
+		if !sectionKeywordRe.MatchString(m[1]) {
+			add(m[1])
+		}
+	}
+	// Aggregations with a leading grouping clause, like "sum by (job) (...)", are not followed by "(".
+	for _, m := range sectionGroupedAggrRe.FindAllStringSubmatch(q, -1) {
+		add(m[1])
+	}
+	for _, op := range sectionComparisonRe.FindAllString(q, -1) {
+		add(op)
+	}
+	// Signs following a "(" or another operator are unary and not arithmetic.
+	for _, m := range sectionArithRe.FindAllStringSubmatch(q, -1) {
+		add(m[1])
+	}
+	if len(features) == 0 {
+		add("selector")
+	}
+	return features
+}
+
+// A SectionReport groups results by the sections of the PromQL documentation that specify the
+// features of their queries, to publish the results organized like the documentation.
+type SectionReport struct {
+	Sections []*SectionSummary `json:"sections"`
+	// Uncategorized holds the results that no section applies to, if any, and UnmappedFeatures the
+	// features of all results that no section lists, so that the mapping can be maintained.
+	Uncategorized    *SectionSummary   `json:"uncategorized,omitempty"`
+	UnmappedFeatures []UnmappedFeature `json:"unmappedFeatures"`
+}
+
+// A SectionSummary counts the outcomes of the results in a documentation section. A result counts
+// towards each section of its features.
+type SectionSummary struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	URL   string `json:"url,omitempty"`
+	// Results counts the results of the section, of which Passed passed and Skipped were skipped.
+	Results int `json:"results"`
+	Passed  int `json:"passed"`
+	Skipped int `json:"skipped"`
+	// Failing lists the queries of some of the results that did not pass.
+	Failing []string `json:"failing"`
+}
+
+// Run returns the number of results of the section that were not skipped.
+func (s *SectionSummary) Run() int {
+	return s.Results - s.Skipped
+}
+
+// PassRate returns the percentage of the results of the section that were not skipped and passed,
+// or zero if all of them were skipped.
+func (s *SectionSummary) PassRate() float64 {
+	if s.Run() == 0 {
+		return 0
+	}
+	return 100 * float64(s.Passed) / float64(s.Run())
+}
+
+func (s *SectionSummary) add(res *comparer.Result) {
+	s.Results++
+	switch {
+	case res.Skipped():
+		s.Skipped++
+	case res.Success():
+		s.Passed++
+	default:
+		if len(s.Failing) < maxSectionExamples {
+			s.Failing = append(s.Failing, res.TestCase.Query)
+		}
+	}
+}
+
+// An UnmappedFeature is a feature of the queries that no documentation section lists.
+type UnmappedFeature struct {
+	Feature string `json:"feature"`
+	Results int    `json:"results"`
+}
+
+// Sections groups the results by documentation section, in the order of the mapping. Sections
+// without results are left out. It returns nil if there are no results.
+func Sections(results []*comparer.Result) *SectionReport {
+	if len(results) == 0 {
+		return nil
+	}
+	m := builtinSections
+	summaries := make([]*SectionSummary, len(m.Sections))
+	unmapped := map[string]int{}
+	var uncategorized *SectionSummary
+	for _, res := range results {
+		in := map[int]bool{}
+		for _, f := range queryFeatures(res.TestCase.Query) {
+			if i, ok := m.byFeature[f]; ok {
+				in[i] = true
+			} else {
+				unmapped[f]++
+			}
+		}
+		for _, t := range res.TestCase.Tags {
+			if i, ok := m.byTag[t]; ok {
+				in[i] = true
+			}
+		}
+		if len(in) == 0 {
+			if uncategorized == nil {
+				uncategorized = &SectionSummary{ID: uncategorizedSection, Title: "Uncategorized", Failing: []string{}}
+			}
+			uncategorized.add(res)
+			continue
+		}
+		for i := range in {
+			if summaries[i] == nil {
+				s := m.Sections[i]
+				summaries[i] = &SectionSummary{ID: s.ID, Title: s.Title, URL: m.BaseURL + s.Anchor, Failing: []string{}}
+			}
+			summaries[i].add(res)
+		}
+	}
+	report := &SectionReport{Sections: []*SectionSummary{}, Uncategorized: uncategorized, UnmappedFeatures: []UnmappedFeature{}}
+	for _, s := range summaries {
+		if s != nil {
+			report.Sections = append(report.Sections, s)
+		}
+	}
+	for f, n := range unmapped {
+		report.UnmappedFeatures = append(report.UnmappedFeatures, UnmappedFeature{Feature: f, Results: n})
+	}
+	sort.Slice(report.UnmappedFeatures, func(i, j int) bool {
+		a, b := report.UnmappedFeatures[i], report.UnmappedFeatures[j]
+		if a.Results != b.Results {
+			return a.Results > b.Results
+		}
+		return a.Feature < b.Feature
+	})
+	return report
+}
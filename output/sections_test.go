@@ -0,0 +1,189 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/testcases"
+)
+
+func TestQueryFeatures(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{query: "demo_memory_usage_bytes", want: []string{"selector"}},
+		{query: `demo_memory_usage_bytes{instance=~"a|b", job!="and"}`, want: []string{"selector"}},
+		{query: "rate(demo_cpu_usage_seconds_total[5m])", want: []string{"range selector", "rate"}},
+		{query: "max_over_time(rate(demo[1m])[5m:1m])", want: []string{"range selector", "subquery", "max_over_time", "rate"}},
+		{query: "demo offset 5m", want: []string{"offset"}},
+		{query: "demo @ 3600", want: []string{"@"}},
+		{query: "sum by (job) (demo)", want: []string{"sum"}},
+		{query: "sum without (instance) (demo) > bool 1", want: []string{"bool", "sum", ">"}},
+		{query: "demo_a * on (job) group_left (instance) demo_b", want: []string{"on", "group_left", "*"}},
+		{query: "demo_a and ignoring (mode) demo_b", want: []string{"and", "ignoring"}},
+		// Unary signs are not arithmetic.
+		{query: "-demo + (-1)", want: []string{"+"}},
+		{query: `label_replace(demo, "dst", "$1", "src", "(.*)")`, want: []string{"label_replace"}},
+		{query: "histogram_quantile(0.9, rate(demo_bucket[5m]))", want: []string{"range selector", "histogram_quantile", "rate"}},
+	} {
+		if got := queryFeatures(tc.query); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: expected the features %q, got %q", tc.query, tc.want, got)
+		}
+	}
+}
+
+func TestBuiltinPlaceholdersMapToSections(t *testing.T) {
+	for name, values := range testcases.BuiltinPlaceholders() {
+		for _, v := range values {
+			// Durations and numeric parameters are not features.
+			if _, err := model.ParseDuration(v); err == nil {
+				continue
+			}
+			if _, err := strconv.ParseFloat(v, 64); err == nil {
+				continue
+			}
+			if _, ok := builtinSections.byFeature[v]; !ok {
+				t.Errorf("placeholder %s: value %q maps to no documentation section", name, v)
+			}
+		}
+	}
+}
+
+func TestSectionMapping(t *testing.T) {
+	ids := map[string]bool{}
+	for _, s := range builtinSections.Sections {
+		if ids[s.ID] {
+			t.Errorf("duplicate section %q", s.ID)
+		}
+		ids[s.ID] = true
+		if s.Title == "" || s.Anchor == "" || len(s.Features)+len(s.Tags) == 0 {
+			t.Errorf("section %q: expected a title, an anchor, and features or tags, got %+v", s.ID, s)
+		}
+	}
+	if ids[uncategorizedSection] {
+		t.Errorf("expected no section to use the ID %q", uncategorizedSection)
+	}
+}
+
+func TestSections(t *testing.T) {
+	if Sections(nil) != nil {
+		t.Error("expected no section report without results")
+	}
+	result := func(query string, diff string, tags ...string) *comparer.Result {
+		return &comparer.Result{TestCase: &comparer.TestCase{Query: query, Tags: tags}, Diff: diff}
+	}
+	results := []*comparer.Result{
+		result("rate(demo[5m])", ""),
+		result("irate(demo[5m])", "different values"),
+		result("sum(rate(demo[5m]))", ""),
+		result("demo", ""),
+		{TestCase: &comparer.TestCase{Query: "demo offset 1m"}, SkipReason: "skipped"},
+		result("custom_func(demo)", "different values"),
+		result("custom_func(demo) + 1", ""),
+	}
+	report := Sections(results)
+
+	type counts struct{ results, passed, skipped int }
+	got := map[string]counts{}
+	var order []string
+	for _, s := range report.Sections {
+		got[s.ID] = counts{s.Results, s.Passed, s.Skipped}
+		order = append(order, s.ID)
+	}
+	want := map[string]counts{
+		"instant-vector-selectors":    {1, 1, 0},
+		"range-vector-selectors":      {3, 2, 0},
+		"offset-modifier":             {1, 0, 1},
+		"arithmetic-binary-operators": {1, 1, 0},
+		"aggregation-operators":       {1, 1, 0},
+		"rate-functions":              {3, 2, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the section counts %v, got %v", want, got)
+	}
+	// The sections are in the order of the mapping.
+	if !sort.SliceIsSorted(order, func(i, j int) bool { return sectionIndex(order[i]) < sectionIndex(order[j]) }) {
+		t.Errorf("expected the sections in the order of the mapping, got %q", order)
+	}
+
+	var rates *SectionSummary
+	for _, s := range report.Sections {
+		if s.ID == "rate-functions" {
+			rates = s
+		}
+	}
+	if rates.URL != "https://prometheus.io/docs/prometheus/latest/querying/functions/#rate" || rates.PassRate() != 200.0/3 || !reflect.DeepEqual(rates.Failing, []string{"irate(demo[5m])"}) {
+		t.Errorf("unexpected rate functions section %+v", rates)
+	}
+	if u := report.Uncategorized; u == nil || u.Results != 1 || !reflect.DeepEqual(u.Failing, []string{"custom_func(demo)"}) {
+		t.Errorf("expected the query with only an unknown function to be uncategorized, got %+v", u)
+	}
+	if want := []UnmappedFeature{{Feature: "custom_func", Results: 2}}; !reflect.DeepEqual(report.UnmappedFeatures, want) {
+		t.Errorf("expected the unmapped features %v, got %v", want, report.UnmappedFeatures)
+	}
+	skipped := &SectionSummary{Results: 2, Skipped: 2}
+	if skipped.PassRate() != 0 {
+		t.Errorf("expected no pass rate of a skipped section, got %v", skipped.PassRate())
+	}
+}
+
+func sectionIndex(id string) int {
+	for i, s := range builtinSections.Sections {
+		if s.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestSectionsInReports(t *testing.T) {
+	results := []*comparer.Result{
+		{TestCase: &comparer.TestCase{Query: "rate(demo[5m])"}},
+		{TestCase: &comparer.TestCase{Query: "custom_func(demo)"}, Diff: "different values"},
+	}
+
+	var md bytes.Buffer
+	Markdown(&md, results, false, nil)
+	for _, w := range []string{
+		"## Results by documentation section",
+		"| [Rates and deltas](https://prometheus.io/docs/prometheus/latest/querying/functions/#rate) | 1 | 1 | 100.0% |",
+		"| Uncategorized | 0 | 1 | 0.0% |",
+		"Features without a documentation section: `custom_func` (1).",
+	} {
+		if !strings.Contains(md.String(), w) {
+			t.Errorf("expected the markdown report to contain %q, got:\n%s", w, md.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	JSON(&buf, results, false, nil)
+	var doc struct {
+		Sections *SectionReport `json:"documentationSections"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if s := doc.Sections; s == nil || len(s.Sections) != 2 || s.Uncategorized == nil || s.Uncategorized.ID != uncategorizedSection {
+		t.Errorf("expected the sections in the JSON report, got %+v", s)
+	}
+
+	var html bytes.Buffer
+	r, err := HTML("example-output.html", 0, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r(&html, results, false, nil)
+	for _, w := range []string{`<a href="https://prometheus.io/docs/prometheus/latest/querying/functions/#rate">Rates and deltas</a>`, "<td>Uncategorized</td>", "Features without a documentation section: custom_func (1)"} {
+		if !strings.Contains(html.String(), w) {
+			t.Errorf("expected the html report to contain %q", w)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package output
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+
+	// Register the pure-Go "sqlite" database/sql driver.
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations contains the schema DDL, indexed by schema version minus one. The versions that
+// a database file records in schema_migrations are not applied again. To change the schema, append
+// a new version instead of modifying an existing one.
+var sqliteMigrations = [][]string{
+	{
+		`CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at TEXT NOT NULL,
+	total INTEGER NOT NULL,
+	passed INTEGER NOT NULL,
+	failed INTEGER NOT NULL,
+	unsupported INTEGER NOT NULL,
+	skipped INTEGER NOT NULL
+)`,
+		`CREATE TABLE IF NOT EXISTS cases (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	run_id INTEGER NOT NULL REFERENCES runs(id),
+	query TEXT NOT NULL,
+	type TEXT NOT NULL,
+	category TEXT NOT NULL,
+	start_time TEXT,
+	end_time TEXT,
+	step_seconds REAL,
+	eval_time TEXT
+)`,
+		`CREATE TABLE IF NOT EXISTS results (
+	case_id INTEGER PRIMARY KEY REFERENCES cases(id),
+	status TEXT NOT NULL,
+	unexpected_failure TEXT NOT NULL,
+	unexpected_success INTEGER NOT NULL,
+	ref_error TEXT NOT NULL,
+	test_error TEXT NOT NULL,
+	skip_reason TEXT NOT NULL
+)`,
+		`CREATE TABLE IF NOT EXISTS diffs (
+	case_id INTEGER PRIMARY KEY REFERENCES cases(id),
+	diff TEXT NOT NULL,
+	within_tolerance INTEGER NOT NULL
+)`,
+	},
+	{
+		`CREATE TABLE IF NOT EXISTS execution_errors (
+	case_id INTEGER PRIMARY KEY REFERENCES cases(id),
+	error TEXT NOT NULL
+)`,
+	},
+	{
+		`ALTER TABLE runs ADD COLUMN errored INTEGER NOT NULL DEFAULT 0`,
+	},
+}
+
+// A SQLiteRun counts the outcomes of the results of a run, as recorded in the runs table.
+type SQLiteRun struct {
+	Total, Passed, Failed, Unsupported, Skipped, Errored int
+}
+
+// NewSQLiteRun counts the outcomes of the results.
+func NewSQLiteRun(results []*comparer.Result) SQLiteRun {
+	run := SQLiteRun{Total: len(results)}
+	for _, res := range results {
+		switch resultStatus(res) {
+		case "passed":
+			run.Passed++
+		case "failed":
+			run.Failed++
+		case "unsupported":
+			run.Unsupported++
+		case "skipped":
+			run.Skipped++
+		case "error":
+			run.Errored++
+		}
+	}
+	return run
+}
+
+// WriteSQLite appends a run with the results to the SQLite database file with the given name, and
+// creates the file if it does not exist. Pending schema migrations are applied first, so that a
+// single database file accumulates the history of all runs:
+//
+//	promql-compliance-tester -output-format sqlite -output-file results.db
+//
+// Passing test cases are always included so that the aggregates can be computed in SQL.
+func WriteSQLite(filename string, results []*comparer.Result) error {
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		return errors.Wrap(err, "opening SQLite database")
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "starting SQLite transaction")
+	}
+	if err := migrateSQLite(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := insertSQLiteRun(tx, sortedResults(results)); err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "inserting run")
+	}
+	return errors.Wrap(tx.Commit(), "committing SQLite transaction")
+}
+
+// migrateSQLite applies the schema versions that the database does not record yet.
+func migrateSQLite(tx *sql.Tx) error {
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return errors.Wrap(err, "creating schema_migrations")
+	}
+	var current int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return errors.Wrap(err, "reading schema version")
+	}
+	for i := current; i < len(sqliteMigrations); i++ {
+		for _, stmt := range sqliteMigrations[i] {
+			if _, err := tx.Exec(stmt); err != nil {
+				return errors.Wrapf(err, "applying schema version %d", i+1)
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			return errors.Wrapf(err, "recording schema version %d", i+1)
+		}
+	}
+	return nil
+}
+
+func insertSQLiteRun(tx *sql.Tx, results []*comparer.Result) error {
+	run := NewSQLiteRun(results)
+	r, err := tx.Exec(`INSERT INTO runs (created_at, total, passed, failed, unsupported, skipped, errored) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		time.Now().UTC().Format(time.RFC3339), run.Total, run.Passed, run.Failed, run.Unsupported, run.Skipped, run.Errored)
+	if err != nil {
+		return err
+	}
+	runID, err := r.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, res := range results {
+		tc := res.TestCase
+		if tc.Instant() {
+			r, err = tx.Exec(`INSERT INTO cases (run_id, query, type, category, eval_time) VALUES (?, ?, ?, ?, ?)`,
+				runID, tc.Query, string(tc.Type), tc.Category, tc.Time.UTC().Format(time.RFC3339Nano))
+		} else {
+			r, err = tx.Exec(`INSERT INTO cases (run_id, query, type, category, start_time, end_time, step_seconds) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				runID, tc.Query, string(tc.Type), tc.Category, tc.Start.UTC().Format(time.RFC3339Nano), tc.End.UTC().Format(time.RFC3339Nano), tc.Resolution.Seconds())
+		}
+		if err != nil {
+			return err
+		}
+		caseID, err := r.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO results (case_id, status, unexpected_failure, unexpected_success, ref_error, test_error, skip_reason) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			caseID, resultStatus(res), res.UnexpectedFailure, sqlBool(res.UnexpectedSuccess), res.RefError, res.TestError, res.SkipReason); err != nil {
+			return err
+		}
+		if res.Errored() {
+			if _, err := tx.Exec(`INSERT INTO execution_errors (case_id, error) VALUES (?, ?)`, caseID, res.ExecutionError); err != nil {
+				return err
+			}
+		}
+		switch {
+		case res.Diff != "":
+			_, err = tx.Exec(`INSERT INTO diffs (case_id, diff, within_tolerance) VALUES (?, ?, 0)`, caseID, res.Diff)
+		case res.ToleranceDiff != "":
+			_, err = tx.Exec(`INSERT INTO diffs (case_id, diff, within_tolerance) VALUES (?, ?, 1)`, caseID, res.ToleranceDiff)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resultStatus(res *comparer.Result) string {
+	switch {
+	case res.Skipped():
+		return "skipped"
+	case res.Errored():
+		return "error"
+	case res.Success():
+		return "passed"
+	case res.Unsupported:
+		return "unsupported"
+	default:
+		return "failed"
+	}
+}
+
+func sqlBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
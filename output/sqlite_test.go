@@ -0,0 +1,130 @@
+package output
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteSQLiteAppendsRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "results.db")
+
+	results := syntheticResults()
+	want := NewSQLiteRun(results)
+	if want.Passed == 0 || want.Failed == 0 || want.Unsupported == 0 || want.Skipped == 0 || want.Errored == 0 {
+		t.Fatalf("synthetic results do not cover every outcome: %+v", want)
+	}
+	for i := 0; i < 2; i++ {
+		if err := WriteSQLite(filename, results); err != nil {
+			t.Fatalf("writing run %d: %v", i+1, err)
+		}
+	}
+
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var version int
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("got schema version %d, want %d", version, len(sqliteMigrations))
+	}
+
+	rows, err := db.Query(`SELECT id, total, passed, failed, unsupported, skipped, errored FROM runs ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var runIDs []int
+	for rows.Next() {
+		var id int
+		var got SQLiteRun
+		if err := rows.Scan(&id, &got.Total, &got.Passed, &got.Failed, &got.Unsupported, &got.Skipped, &got.Errored); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("run %d: got counts %+v, want %+v", id, got, want)
+		}
+		runIDs = append(runIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(runIDs) != 2 {
+		t.Fatalf("got %d runs, want 2", len(runIDs))
+	}
+
+	for _, id := range runIDs {
+		var cases, errored, failing int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM cases WHERE run_id = ?`, id).Scan(&cases); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.QueryRow(`SELECT COUNT(*) FROM execution_errors JOIN cases ON cases.id = execution_errors.case_id WHERE run_id = ?`, id).Scan(&errored); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.QueryRow(`SELECT COUNT(*) FROM results JOIN cases ON cases.id = results.case_id WHERE run_id = ? AND status = 'failed'`, id).Scan(&failing); err != nil {
+			t.Fatal(err)
+		}
+		if cases != want.Total || errored != want.Errored || failing != want.Failed {
+			t.Errorf("run %d: got %d cases, %d execution errors, and %d failed results, want %d, %d, and %d", id, cases, errored, failing, want.Total, want.Errored, want.Failed)
+		}
+	}
+}
+
+func TestWriteSQLiteMigratesEarlierSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "results.db")
+
+	// Set up a database file of schema version 2, before runs counted execution errors.
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		t.Fatal(err)
+	}
+	for i, stmts := range sqliteMigrations[:2] {
+		for _, stmt := range stmts {
+			if _, err := db.Exec(stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO runs (created_at, total, passed, failed, unsupported, skipped) VALUES ('2020-01-01T00:00:00Z', 1, 1, 0, 0, 0)`); err != nil {
+		t.Fatal(err)
+	}
+
+	results := syntheticResults()
+	if err := WriteSQLite(filename, results); err != nil {
+		t.Fatal(err)
+	}
+	var old, errored int
+	if err := db.QueryRow(`SELECT errored FROM runs WHERE id = 1`).Scan(&old); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT errored FROM runs WHERE id = 2`).Scan(&errored); err != nil {
+		t.Fatal(err)
+	}
+	if old != 0 || errored != NewSQLiteRun(results).Errored {
+		t.Errorf("got errored counts %d and %d, want 0 and %d", old, errored, NewSQLiteRun(results).Errored)
+	}
+}
@@ -0,0 +1,65 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// stableOutput is set if the machine-readable outputs are written in a canonical order.
+var stableOutput bool
+
+// SetStableOutput sets whether the json, tsv, junit, and sqlite outputs list the results sorted by
+// their ResultID rather than in the order of the test cases, and whether the JSON outputs sort the
+// keys of all objects by name rather than listing the fields of structs in declaration order. The
+// outputs of runs with the same results are then byte-identical even if the configuration was
+// reordered, so that they can be diffed.
+func SetStableOutput(stable bool) {
+	stableOutput = stable
+}
+
+// sortedResults returns the results sorted by ResultID for stable outputs, and otherwise as they are.
+func sortedResults(results []*comparer.Result) []*comparer.Result {
+	if !stableOutput {
+		return results
+	}
+	ids := make(map[*comparer.Result]string, len(results))
+	for _, res := range results {
+		ids[res] = ResultID(res)
+	}
+	sorted := append([]*comparer.Result(nil), results...)
+	sort.SliceStable(sorted, func(i, j int) bool { return ids[sorted[i]] < ids[sorted[j]] })
+	return sorted
+}
+
+// MarshalJSON encodes v as JSON, indented by indent unless it is empty. For stable outputs, the keys
+// of all objects are sorted by name.
+func MarshalJSON(v interface{}, indent string) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if stableOutput {
+		// Decoding into generic values turns all objects into maps, which are encoded sorted by key.
+		// Numbers are kept as they were encoded.
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.UseNumber()
+		var generic interface{}
+		if err := dec.Decode(&generic); err != nil {
+			return nil, err
+		}
+		if buf, err = json.Marshal(generic); err != nil {
+			return nil, err
+		}
+	}
+	if indent == "" {
+		return buf, nil
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, buf, "", indent); err != nil {
+		return nil, err
+	}
+	return indented.Bytes(), nil
+}
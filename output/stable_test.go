@@ -0,0 +1,194 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// stableResults returns results with maps and lists in all the sections of the reports, in the given
+// order of their test cases.
+func stableResults(reverse bool) []*comparer.Result {
+	results := jsonLinesResults(12)
+	for i, res := range results {
+		res.RefResponseHeaders = map[string]string{"Content-Type": "application/json", "Age": "3", "X-Cache": "HIT"}
+		res.TestResponseHeaders = map[string]string{"Via": "1.1 varnish", "Date": "Thu, 01 Jan 1970 00:00:00 GMT"}
+		res.RefDuration = time.Duration(i+1) * time.Millisecond
+		res.TestDuration = time.Duration(2*i+1) * time.Millisecond
+		res.TestCase.Tags = []string{"b", "a"}
+		if i%4 == 0 {
+			res.CacheHit = "X-Cache: HIT"
+		}
+		if i%3 == 1 {
+			res.ConformanceFindings = []comparer.ConformanceFinding{{Kind: "non-string label value", Example: `{"job":1}`}}
+		}
+	}
+	if reverse {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+	}
+	return results
+}
+
+var stableTweaks = []*config.QueryTweak{{
+	Note:               "renamed metrics",
+	Rename:             map[string]string{`\bdemo_1\b`: "demo_one", `\bdemo_2\b`: "demo_two", `\bdemo_3\b`: "demo_three"},
+	RenameResultLabels: map[model.LabelName]model.LabelName{"job": "service", "instance": "host"},
+}}
+
+// junitTimestampRe matches the time at which the junit output was written.
+var junitTimestampRe = regexp.MustCompile(`timestamp="[^"]*"`)
+
+func TestStableOutput(t *testing.T) {
+	SetStableOutput(true)
+	defer SetStableOutput(false)
+
+	render := func(format string, reverse bool) string {
+		var buf bytes.Buffer
+		results := stableResults(reverse)
+		switch format {
+		case "json":
+			JSON(&buf, results, true, stableTweaks)
+		case "tsv":
+			TSV(&buf, results, true, stableTweaks)
+		case "junit":
+			JUnit(&buf, results, true, stableTweaks)
+		case "jsonl":
+			jw := newJSONLinesWriter(&buf, true, nil)
+			for _, res := range results {
+				jw.WriteResult(res)
+			}
+			jw.Finish(stableTweaks)
+		}
+		return junitTimestampRe.ReplaceAllString(buf.String(), "")
+	}
+	for _, format := range []string{"json", "tsv", "junit"} {
+		t.Run(format, func(t *testing.T) {
+			first := render(format, false)
+			for i := 0; i < 5; i++ {
+				if got := render(format, false); got != first {
+					t.Fatalf("expected the same output for the same results, got:\n%s\nand:\n%s", first, got)
+				}
+			}
+			// Reordering the test cases does not change the outputs.
+			if got := render(format, true); got != first {
+				t.Errorf("expected the same output for reordered test cases, got:\n%s\nand:\n%s", first, got)
+			}
+		})
+	}
+	// The JSON lines stay in the order of the streamed results, but their keys are sorted.
+	first := render("jsonl", false)
+	for i := 0; i < 5; i++ {
+		if got := render("jsonl", false); got != first {
+			t.Fatalf("expected the same JSON lines for the same results, got:\n%s\nand:\n%s", first, got)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSpace(first), "\n") {
+		assertSortedKeys(t, []byte(line))
+	}
+	assertSortedKeys(t, []byte(render("json", false)))
+}
+
+func TestUnstableOutputKeepsOrder(t *testing.T) {
+	var buf bytes.Buffer
+	TSV(&buf, stableResults(true), true, nil)
+	lines := strings.Split(buf.String(), "\n")
+	if !strings.HasPrefix(lines[1], "rate(demo_11[5m])") {
+		t.Errorf("expected the results in the order of the test cases, got %q", lines[1])
+	}
+	buf.Reset()
+	JSON(&buf, stableResults(false), true, nil)
+	// Struct fields are in declaration order.
+	if i, j := strings.Index(buf.String(), `"testCase"`), strings.Index(buf.String(), `"diff"`); i < 0 || j < 0 || i > j {
+		t.Errorf("expected the fields of the results in declaration order")
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	v := struct {
+		Zebra  int               `json:"zebra"`
+		Apple  float64           `json:"apple"`
+		Nested map[string]string `json:"nested"`
+		Big    uint64            `json:"big"`
+	}{Zebra: 1, Apple: 0.1, Nested: map[string]string{"b": "2", "a": "1"}, Big: 1<<63 + 1}
+
+	for _, tc := range []struct {
+		stable bool
+		indent string
+		want   string
+	}{
+		{want: `{"zebra":1,"apple":0.1,"nested":{"a":"1","b":"2"},"big":9223372036854775809}`},
+		// Numbers keep their encoding rather than being rounded to float64.
+		{stable: true, want: `{"apple":0.1,"big":9223372036854775809,"nested":{"a":"1","b":"2"},"zebra":1}`},
+		{stable: true, indent: "  ", want: "{\n  \"apple\": 0.1,\n  \"big\": 9223372036854775809,\n  \"nested\": {\n    \"a\": \"1\",\n    \"b\": \"2\"\n  },\n  \"zebra\": 1\n}"},
+	} {
+		SetStableOutput(tc.stable)
+		buf, err := MarshalJSON(v, tc.indent)
+		SetStableOutput(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != tc.want {
+			t.Errorf("stable %v, indent %q: expected %s, got %s", tc.stable, tc.indent, tc.want, buf)
+		}
+	}
+}
+
+// assertSortedKeys fails the test if an object of the JSON document has keys out of order.
+func assertSortedKeys(t *testing.T, doc []byte) {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	// Each open object holds its last key, and whether the next string token is a key. Open arrays
+	// are nil.
+	type object struct {
+		last      string
+		expectKey bool
+	}
+	var stack []*object
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return
+		}
+		var top *object
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			if top != nil {
+				top.expectKey = true
+			}
+			var opened *object
+			if tok == json.Delim('{') {
+				opened = &object{expectKey: true}
+			}
+			stack = append(stack, opened)
+			continue
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if top == nil {
+			continue
+		}
+		if top.expectKey {
+			key := tok.(string)
+			if key < top.last {
+				t.Errorf("expected the keys of all objects sorted, got %q after %q", key, top.last)
+			}
+			top.last = key
+			top.expectKey = false
+		} else {
+			top.expectKey = true
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package output
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// A StreamOutputter writes query results one by one as they become available, instead of
+// requiring all results up front. It only retains what it needs for the final summary.
+type StreamOutputter interface {
+	// WriteResult writes a single result.
+	WriteResult(res *comparer.Result)
+	// Finish writes the summary after all results have been written.
+	Finish(tweaks []*config.QueryTweak)
+}
+
+// NewStreamOutputter returns a StreamOutputter for the given output format. Only formats that
+// do not need all results before writing the first one support streaming. The json format streams
+// JSON lines, one per result followed by a summary. If baseline is set, the text and json outputs
+// list the pass rates that regressed against it.
+func NewStreamOutputter(format string, w io.Writer, includePassing bool, baseline *HistoryBaseline) (StreamOutputter, error) {
+	switch format {
+	case "text":
+		tw := newTextWriter(w, includePassing)
+		tw.baseline = baseline
+		return tw, nil
+	case "tsv":
+		return newTSVWriter(w), nil
+	case "json":
+		return newJSONLinesWriter(w, includePassing, baseline), nil
+	default:
+		return nil, errors.Errorf("output format %q does not support streaming", format)
+	}
+}
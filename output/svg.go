@@ -0,0 +1,36 @@
+package output
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+)
+
+// Sparkline renders the values as an inline SVG line chart of the given size, scaling the
+// range [min, max] to the chart's height. It returns an empty string for fewer than two values.
+func Sparkline(values []float64, min, max float64, width, height int) template.HTML {
+	if len(values) < 2 || max <= min {
+		return ""
+	}
+	const pad = 2.0
+	w, h := float64(width)-2*pad, float64(height)-2*pad
+	points := make([]string, 0, len(values))
+	for i, v := range values {
+		if v < min {
+			v = min
+		}
+		if v > max {
+			v = max
+		}
+		x := pad + w*float64(i)/float64(len(values)-1)
+		y := pad + h*(max-v)/(max-min)
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	last := strings.Split(points[len(points)-1], ",")
+	return template.HTML(fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+
+			`<polyline fill="none" stroke="steelblue" stroke-width="1.5" points="%s"/>`+
+			`<circle cx="%s" cy="%s" r="2" fill="steelblue"/></svg>`,
+		width, height, width, height, strings.Join(points, " "), last[0], last[1],
+	))
+}
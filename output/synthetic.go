@@ -0,0 +1,115 @@
+package output
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// syntheticResults returns results against two test targets that cover every outcome and the
+// optional details of results, for executing report templates before a run produced any results.
+func syntheticResults() []*comparer.Result {
+	end := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rangeCase := func(query, category string) *comparer.TestCase {
+		return &comparer.TestCase{Query: query, Type: config.QueryTypeRange, Category: category, Tags: []string{"synthetic"}, Start: end.Add(-time.Hour), End: end, Resolution: time.Minute}
+	}
+	instantCase := func(query, category string) *comparer.TestCase {
+		return &comparer.TestCase{Query: query, Type: config.QueryTypeInstant, Category: category, Start: end.Add(-time.Hour), End: end, Time: end}
+	}
+	expected, actual := model.SampleValue(1), model.SampleValue(2)
+	samples := make([]*comparer.SampleDiff, 0, 3)
+	for i := 0; i < 3; i++ {
+		samples = append(samples, &comparer.SampleDiff{Timestamp: model.TimeFromUnixNano(end.UnixNano()), Expected: &expected, Actual: &actual})
+	}
+	samples[2].Expected = nil
+	structuredDiff := &comparer.StructuredDiff{
+		Series: []*comparer.SeriesDiff{
+			{Metric: model.Metric{"__name__": "demo_cpu_usage_seconds_total", "mode": "idle"}, Samples: samples, MoreSamples: 57},
+			{Metric: model.Metric{"__name__": "demo_cpu_usage_seconds_total", "mode": "user"}, OnlyIn: "reference", OnlyValue: "NaN"},
+		},
+		MoreSeries: 12,
+	}
+	notExpanded := rangeCase("rate(demo_cpu_usage_seconds_total[{{.range}}])", "rate")
+	notExpanded.NotExpanded = "range"
+	fraction, margin := 0.001, 1e-9
+	renamed := rangeCase("rate(demo_cpu_usage_seconds_total[5m])", "rate")
+	renamed.Template, renamed.TestQuery = "rate(demo_cpu_usage_seconds_total[{{.range}}])", "rate(demo_cpu_seconds[5m])"
+	renamed.ValueTolerance = &config.AdjustValueTolerance{Fraction: &fraction, Margin: &margin}
+	renamed.LabelTweaks = []*config.LabelTweak{{DropResultLabels: []model.LabelName{"__tenant__"}, RenameResultLabels: map[model.LabelName]model.LabelName{"host": "instance"}}}
+	renamed.TimeParameterSet, renamed.TimeJitter = "recent", 15*time.Second
+	allowance := rangeCase("sum by (mode) (demo_cpu_usage_seconds_total)", "aggregation")
+	allowance.SeriesAllowance = &config.SeriesAllowance{MaxExtraSeries: 1, MaxMissingSeries: 1}
+	allowance.WithinReferenceRange = &config.RangeAssertion{LookbackSeconds: 3600, Margin: 0.1}
+	histograms := instantCase("histogram_count(demo_native_histogram)", "histograms")
+	histograms.ExpectNativeHistograms = true
+	consistency := instantCase("sum(demo)", "consistency")
+	consistency.SameAs = "sum without () (demo)"
+	shouldFail := instantCase("demo[5m] + 1", "errors")
+	shouldFail.ShouldFail = true
+	skipComparison := instantCase("rand()", "functions")
+	skipComparison.SkipComparison = true
+	settings := &comparer.EffectiveSettings{Chain: []comparer.SettingLayer{{Setting: "test_query_timeout", Layer: "test_target_config", Value: "1m0s"}}}
+
+	var results []*comparer.Result
+	for _, target := range []string{"target-a", "target-b"} {
+		results = append(results,
+			&comparer.Result{
+				TestCase: renamed, TestTarget: target, TestQuery: renamed.TestQuery,
+				RefDuration: 20 * time.Millisecond, TestDuration: 80 * time.Millisecond,
+				PassedWithinTolerance: true, ToleranceDiff: "value 1 vs. 1.0000001",
+				MaxAbsoluteDeviation: 1e-7, MaxRelativeDeviation: 1e-7, ToleranceUsage: 0.9,
+				Exactness: &comparer.ExactnessAudit{Samples: 2, Identical: 1, LastULP: 1, Examples: []comparer.ExactnessFinding{
+					{Kind: comparer.ExactnessLastULP, Series: `{mode="idle"}`, Timestamp: "1577836800", Reference: "0.30000000000000004", Test: "0.3"},
+				}},
+				RequestParity:       &comparer.RequestParity{RefPath: "/api/v1/query_range", TestPath: "/v1/prometheus/api/v1/query_range", RefParams: url.Values{"query": {"demo"}}, TestParams: url.Values{"query": {"demo"}}, Drift: []string{"step: 60 vs. 30"}},
+				TestResponseHeaders: map[string]string{"X-Cache": "HIT"}, CacheHit: "X-Cache: HIT",
+				Warnings:        []string{"test query took 4.0x as long as the reference query (80ms vs. 20ms)"},
+				Notes:           []string{"aligned samples to the step"},
+				SampleAlignment: config.SampleAlignmentSnap, AlignedSeries: []string{`{mode="idle"}`}, SnapCollisions: []string{`{mode="idle"} at 1577836800`},
+				RefResponseHeaders: map[string]string{"Content-Type": "application/json"}, RefRetries: 1, TestAPIWarnings: []string{"PromQL info: metric might not be a counter"},
+			},
+			&comparer.Result{
+				TestCase: allowance, TestTarget: target, ExtraSeries: 2, MissingSeries: 1,
+				CollapsedSeries: []string{`{mode="idle"}`}, OutOfRangeValues: []string{`{mode="idle"} at 1577836800: 2 outside [0.9, 1.1]`},
+				Diff: strings.Repeat("-demo_cpu_usage_seconds_total{mode=\"idle\"} 1\n+demo_cpu_usage_seconds_total{mode=\"idle\"} 2\n", 20), StructuredDiff: structuredDiff,
+				RefDuration: 10 * time.Millisecond, TestDuration: 15 * time.Millisecond, EffectiveSettings: settings,
+				Diagnostics: []string{"the test result lacks the series of the reference result"}, OutOfOrderSeries: []string{`{mode="idle"}`},
+				ConformanceFindings: []comparer.ConformanceFinding{{Kind: "metric name in result", Example: `{"__name__":"demo"}`}},
+				RefAPIWarnings:      []string{"PromQL info: metric might not be a counter"}, WarningsMismatch: true,
+			},
+			&comparer.Result{TestCase: histograms, TestTarget: target, Diff: "-{} {count:4}\n+{} {count:5}\n", NativeHistogramSamples: 2, HistogramMismatches: []string{comparer.HistogramMismatchCount}},
+			&comparer.Result{TestCase: consistency, TestTarget: target, Diff: "-{} 1\n+{} 2\n", ConsistencyViolation: true},
+			&comparer.Result{TestCase: shouldFail, TestTarget: target, UnexpectedSuccess: true},
+			&comparer.Result{TestCase: skipComparison, TestTarget: target},
+			&comparer.Result{TestCase: instantCase("limitk(2, demo)", "aggregation"), TestTarget: target, LimitAggregation: "limitk", Chaos: true},
+			&comparer.Result{TestCase: instantCase("histogram_quantile(0.9, demo_bucket)", "histograms"), TestTarget: target, UnexpectedFailure: "bad_data: unknown function", EffectiveSettings: settings},
+			&comparer.Result{TestCase: instantCase("demo @ end()", "modifiers"), TestTarget: target, Unsupported: true, RefQueryCanceled: true, UnexpectedFailure: "501: not implemented"},
+			&comparer.Result{TestCase: instantCase(`label_replace(demo, "a", "$1", "b", "(.*)")`, "labels"), TestTarget: target, ErrorMismatch: true, RefError: "bad_data: invalid regex", TestError: "bad_data: invalid parameter"},
+			&comparer.Result{TestCase: rangeCase("max_over_time(demo[1h:1m])", "subqueries"), TestTarget: target, ExecutionError: "test API query timed out after 30s", QueryTimeout: 30 * time.Second, TestRetries: 2, RetriesExhausted: true},
+			&comparer.Result{TestCase: rangeCase("demo offset 1w", "modifiers"), TestTarget: target, SkipReason: "the query window starts before the retention of the test target", SkipCause: comparer.SkipPreconditionNotMet},
+			&comparer.Result{TestCase: instantCase("time()", ""), TestTarget: target, SkipReason: "not run: the run was interrupted", SkipCause: comparer.SkipAbortedEarly, NotRun: true},
+			&comparer.Result{TestCase: notExpanded, TestTarget: target, SkipReason: "not expanded, since placeholder range has no values", SkipCause: comparer.SkipNotExpanded},
+		)
+	}
+	return results
+}
+
+// syntheticHistory returns the history records of earlier runs with pass rates above those of the
+// results, so that the pass rates of the results regress against them.
+func syntheticHistory(results []*comparer.Result) []*HistoryRecord {
+	var history []*HistoryRecord
+	for i := 3; i > 0; i-- {
+		rec := NewHistoryRecord(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -i), nil)
+		for _, res := range results {
+			passing := *res
+			passing.Diff, passing.UnexpectedFailure, passing.ErrorMismatch, passing.ExecutionError, passing.WarningsMismatch, passing.OutOfOrderSeries = "", "", false, "", false, nil
+			rec.Add(&passing)
+		}
+		history = append(history, rec)
+	}
+	return history
+}
@@ -0,0 +1,114 @@
+package output
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+func TestSyntheticResultsCoverReportModel(t *testing.T) {
+	results := syntheticResults()
+	for _, typ := range []reflect.Type{reflect.TypeOf(comparer.Result{}), reflect.TypeOf(comparer.TestCase{})} {
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			set := false
+			for _, res := range results {
+				v := reflect.ValueOf(*res)
+				if typ == reflect.TypeOf(comparer.TestCase{}) {
+					v = reflect.ValueOf(*res.TestCase)
+				}
+				if !v.Field(i).IsZero() {
+					set = true
+					break
+				}
+			}
+			if !set {
+				t.Errorf("expected a synthetic result to set %s.%s, so that templates using it are validated", typ.Name(), f.Name)
+			}
+		}
+	}
+}
+
+func TestSyntheticResultsCoverOutcomes(t *testing.T) {
+	// The synthetic results cover every outcome and skip cause that reports tell apart.
+	outcomes := map[string]bool{}
+	for _, res := range syntheticResults() {
+		outcomes[NewCaseOutcome(res).Outcome] = true
+		if res.SkipCause != "" {
+			outcomes["skip cause "+res.SkipCause] = true
+		}
+	}
+	for _, want := range []string{"pass", "fail", "error", "unsupported", "skipped", "skip cause " + comparer.SkipPreconditionNotMet, "skip cause " + comparer.SkipAbortedEarly, "skip cause " + comparer.SkipNotExpanded} {
+		if !outcomes[want] {
+			t.Errorf("expected a synthetic result with the outcome %q, got %v", want, outcomes)
+		}
+	}
+}
+
+func TestValidateHTMLTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "html-template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ValidateHTMLTemplate("example-output.html", 0); err != nil {
+		t.Errorf("expected the example template to be valid, got %v", err)
+	}
+	if err := ValidateHTMLTemplate("example-output.html", 10); err != nil {
+		t.Errorf("expected the paginated example template to be valid, got %v", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		template string
+		pageSize int
+		wantErr  string
+		// historyOnly is set if the error is only reached with a history file or baseline.
+		historyOnly bool
+	}{
+		{name: "valid", template: `{{ range .Results }}{{ .TestCase.Query }}{{ end }}`},
+		{name: "unknown function", template: `{{ numResult .AllResults }}`, wantErr: `function "numResult" not defined`},
+		{name: "misspelled field", template: `{{ range .Results }}{{ .TestCase.Qurey }}{{ end }}`, wantErr: "can't evaluate field Qurey"},
+		// Fields of optional details are only reached for the results that have them.
+		{name: "field of a structured diff", template: `{{ range .Results }}{{ with .StructuredDiff }}{{ .MoreSerie }}{{ end }}{{ end }}`, wantErr: "can't evaluate field MoreSerie"},
+		{name: "field of a skipped result", template: `{{ range .Results }}{{ if .Skipped }}{{ .SkipReson }}{{ end }}{{ end }}`, wantErr: "can't evaluate field SkipReson"},
+		// The synthetic report charts a history of earlier runs.
+		{name: "field of the history", template: `{{ range .History }}{{ .Rate }}{{ end }}`, wantErr: "can't evaluate field Rate", historyOnly: true},
+		{name: "field of a regression", template: `{{ range .Regressions }}{{ .Drops }}{{ end }}`, wantErr: "can't evaluate field Drops", historyOnly: true},
+		{
+			name:     "field of the index page",
+			template: `{{ define "header" }}{{ end }}{{ define "results" }}{{ end }}{{ define "footer" }}{{ end }}{{ define "index" }}{{ range .Pages }}{{ .Numbr }}{{ end }}{{ end }}`,
+			pageSize: 5,
+			wantErr:  "can't evaluate field Numbr",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tpl := filepath.Join(dir, strings.Replace(tc.name, " ", "-", -1)+".html")
+			if err := ioutil.WriteFile(tpl, []byte(tc.template), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := ValidateHTMLTemplate(tpl, tc.pageSize)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("expected the template to be valid, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tc.wantErr, err)
+			}
+			// The HTML output validates the template before any test cases are run.
+			if tc.historyOnly {
+				return
+			}
+			if _, err := HTML(tpl, tc.pageSize, dir, nil, nil); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("expected the html output to reject the template with %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
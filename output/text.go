@@ -2,59 +2,349 @@ package output
 
 import (
 	"fmt"
+	"io"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/promlabs/promql-compliance-tester/comparer"
 	"github.com/promlabs/promql-compliance-tester/config"
 )
 
 // Text produces text-based output for a number of query results.
-func Text(results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak) {
-	successes := 0
-	unsupported := 0
-	for _, res := range results {
-		if res.Success() {
-			successes++
-			if !includePassing {
-				continue
-			}
+func Text(w io.Writer, results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak) {
+	TextWithHistory(nil)(w, results, includePassing, tweaks)
+}
+
+// TextWithHistory returns an Outputter producing text-based output that also lists the pass rates
+// that regressed against the baseline of earlier runs.
+func TextWithHistory(baseline *HistoryBaseline) Outputter {
+	return func(w io.Writer, results []*comparer.Result, includePassing bool, tweaks []*config.QueryTweak) {
+		tw := newTextWriter(w, includePassing)
+		tw.baseline = baseline
+		for _, res := range results {
+			tw.WriteResult(res)
 		}
-		if res.Unsupported {
-			unsupported++
+		tw.Finish(tweaks)
+	}
+}
+
+// textWriter writes text-based output one result at a time.
+type textWriter struct {
+	w              io.Writer
+	includePassing bool
+
+	total       int
+	successes   int
+	unsupported int
+	skipped     int
+	errored     int
+	// failures are retained for the failure triage summary.
+	failures []*comparer.Result
+	// chaos is set once a result was produced with injected faults.
+	chaos   bool
+	matrix  *matrixBuilder
+	latency *latencyBuilder
+	// conformance collects the API conformance findings, which passing results can have, too.
+	conformance *conformanceBuilder
+	parity      *parityBuilder
+	cached      *cachedBuilder
+	headroom    *headroomBuilder
+	exactness   *exactnessBuilder
+	// baseline, if set, holds the earlier runs that current is compared with to find regressions.
+	baseline *HistoryBaseline
+	current  *HistoryRecord
+}
+
+func newTextWriter(w io.Writer, includePassing bool) *textWriter {
+	return &textWriter{w: w, includePassing: includePassing, matrix: newMatrixBuilder(), latency: newLatencyBuilder(), conformance: newConformanceBuilder(), parity: newParityBuilder(), cached: newCachedBuilder(), headroom: newHeadroomBuilder(), exactness: newExactnessBuilder(), current: &HistoryRecord{}}
+}
+
+func (tw *textWriter) WriteResult(res *comparer.Result) {
+	w := tw.w
+	tw.total++
+	tw.matrix.add(res)
+	tw.latency.add(res)
+	tw.conformance.add(res)
+	tw.parity.add(res)
+	tw.cached.add(res)
+	tw.headroom.add(res)
+	tw.exactness.add(res)
+	tw.current.Add(res)
+	tw.chaos = tw.chaos || res.Chaos
+	if res.Skipped() {
+		tw.skipped++
+	}
+	if res.Errored() {
+		tw.errored++
+	}
+	if res.Success() {
+		tw.successes++
+		if !tw.includePassing {
+			return
 		}
+	}
+	if res.Unsupported {
+		tw.unsupported++
+	}
+	if res.Failed() || res.Errored() {
+		tw.failures = append(tw.failures, res)
+	}
 
-		fmt.Println(strings.Repeat("-", 80))
-		fmt.Printf("QUERY: %v\n", res.TestCase.Query)
-		fmt.Printf("START: %v, STOP: %v, STEP: %v\n", res.TestCase.Start, res.TestCase.End, res.TestCase.Resolution)
-		fmt.Printf("RESULT: ")
-		if res.Success() {
-			fmt.Println("PASSED")
-		} else if res.Unsupported {
-			fmt.Println("UNSUPPORTED: ")
-			fmt.Printf("Query is unsupported: %v\n", res.UnexpectedFailure)
-		} else {
-			fmt.Printf("FAILED: ")
-			if res.UnexpectedFailure != "" {
-				fmt.Printf("Query failed unexpectedly: %v\n", res.UnexpectedFailure)
-			}
-			if res.UnexpectedSuccess {
-				fmt.Println("Query succeeded, but should have failed.")
+	fmt.Fprintln(w, strings.Repeat("-", 80))
+	fmt.Fprintf(w, "QUERY: %v\n", res.TestCase.Query)
+	if res.TestQuery != "" {
+		fmt.Fprintf(w, "TEST QUERY: %v\n", res.TestQuery)
+	}
+	if res.TestTarget != "" {
+		fmt.Fprintf(w, "TEST TARGET: %v\n", res.TestTarget)
+	}
+	if res.TestCase.TimeParameterSet != "" {
+		fmt.Fprintf(w, "TIME PARAMETER SET: %v\n", res.TestCase.TimeParameterSet)
+	}
+	if res.LimitAggregation != "" {
+		fmt.Fprintf(w, "COMPARED BY PROPERTIES: %v()\n", res.LimitAggregation)
+	}
+	if res.NativeHistogramSamples > 0 {
+		fmt.Fprintf(w, "NATIVE HISTOGRAM SAMPLES: %d\n", res.NativeHistogramSamples)
+	}
+	if res.TestCase.TimeJitter != 0 {
+		fmt.Fprintf(w, "TIME JITTER: -%v\n", res.TestCase.TimeJitter)
+	}
+	if res.TestCase.Instant() {
+		fmt.Fprintf(w, "INSTANT QUERY TIME: %v\n", res.TestCase.Time)
+	} else {
+		fmt.Fprintf(w, "RANGE QUERY START: %v, STOP: %v, STEP: %v\n", res.TestCase.Start, res.TestCase.End, res.TestCase.Resolution)
+	}
+	fmt.Fprintf(w, "RESULT: ")
+	if res.Skipped() {
+		fmt.Fprintf(w, "SKIPPED: %v\n", res.SkipReason)
+	} else if res.Errored() {
+		fmt.Fprintf(w, "EXECUTION ERROR: %v\n", res.ExecutionError)
+	} else if res.Success() {
+		fmt.Fprintln(w, "PASSED")
+		if res.PassedWithinTolerance {
+			fmt.Fprintln(w, "Query results only matched within tolerance:")
+			fmt.Fprintln(w, res.ToleranceDiff)
+		}
+	} else if res.Unsupported {
+		fmt.Fprintln(w, "UNSUPPORTED: ")
+		fmt.Fprintf(w, "Query is unsupported: %v\n", res.UnexpectedFailure)
+	} else {
+		fmt.Fprintf(w, "FAILED: ")
+		if res.UnexpectedFailure != "" {
+			fmt.Fprintf(w, "Query failed unexpectedly on the test API: %v\n", res.UnexpectedFailure)
+		}
+		if res.UnexpectedSuccess && res.RefError != "" {
+			fmt.Fprintln(w, "Query succeeded on the test API, but the reference API rejected it.")
+		} else if res.UnexpectedSuccess {
+			fmt.Fprintln(w, "Query succeeded, but should have failed.")
+		}
+		if res.ErrorMismatch {
+			fmt.Fprintln(w, "Query failed with different errors:")
+		}
+		if res.WarningsMismatch {
+			fmt.Fprintln(w, "Query returned different warnings:")
+			for _, warning := range res.RefAPIWarnings {
+				fmt.Fprintf(w, "REFERENCE WARNING: %v\n", warning)
 			}
-			if res.Diff != "" {
-				fmt.Println("Query returned different results:")
-				fmt.Println(res.Diff)
+			for _, warning := range res.TestAPIWarnings {
+				fmt.Fprintf(w, "TEST WARNING: %v\n", warning)
 			}
 		}
+		if len(res.OutOfOrderSeries) > 0 && res.Diff == "" {
+			fmt.Fprintln(w, "Query returned samples out of timestamp order, which matched after sorting.")
+		}
+		if res.Diff != "" && res.ConsistencyViolation {
+			fmt.Fprintf(w, "Internal consistency violation: the test API returned different results for the query (-) and its same_as query (+) %s:\n", res.TestCase.SameAs)
+			fmt.Fprintln(w, res.Diff)
+		} else if res.Diff != "" {
+			fmt.Fprintln(w, "Query returned different results:")
+			fmt.Fprintln(w, res.Diff)
+		}
+		if res.StructuredDiff != nil {
+			fmt.Fprintln(w, "Differing series and samples:")
+			fmt.Fprint(w, res.StructuredDiff)
+		}
+	}
+	if res.RefError != "" {
+		fmt.Fprintf(w, "REFERENCE ERROR: %v\n", res.RefError)
+	}
+	if res.TestError != "" {
+		fmt.Fprintf(w, "TEST ERROR: %v\n", res.TestError)
+	}
+	for _, s := range res.OutOfOrderSeries {
+		fmt.Fprintf(w, "OUT-OF-ORDER SAMPLES: %v\n", s)
+	}
+	for _, s := range res.CollapsedSeries {
+		fmt.Fprintf(w, "COLLAPSED SERIES: %v\n", s)
+	}
+	for _, s := range res.OutOfRangeValues {
+		fmt.Fprintf(w, "OUT OF RANGE: %v\n", s)
+	}
+	for _, s := range res.AlignedSeries {
+		fmt.Fprintf(w, "ALIGNED (%v): %v\n", res.SampleAlignment, s)
+	}
+	for _, s := range res.SnapCollisions {
+		fmt.Fprintf(w, "SNAP COLLISION: %v\n", s)
 	}
+	for _, n := range res.Notes {
+		fmt.Fprintf(w, "NOTE: %v\n", n)
+	}
+	for _, d := range res.Diagnostics {
+		fmt.Fprintf(w, "DIAGNOSTIC: %v\n", d)
+	}
+	for _, warning := range res.Warnings {
+		fmt.Fprintf(w, "WARNING: %v\n", warning)
+	}
+	for _, f := range res.ConformanceFindings {
+		fmt.Fprintf(w, "API CONFORMANCE (%v): %v\n", f.Kind, f.Example)
+	}
+	if res.RefDuration > 0 || res.TestDuration > 0 {
+		fmt.Fprintf(w, "DURATION: reference %v, test %v\n", res.RefDuration, res.TestDuration)
+	}
+}
 
-	fmt.Println(strings.Repeat("=", 80))
-	fmt.Println("General query tweaks:")
+func (tw *textWriter) Finish(tweaks []*config.QueryTweak) {
+	w := tw.w
+	if tw.chaos {
+		fmt.Fprintln(w, strings.Repeat("=", 80))
+		fmt.Fprintln(w, chaosWarning)
+	}
+	fmt.Fprintln(w, strings.Repeat("=", 80))
+	fmt.Fprintln(w, "General query tweaks:")
 	if len(tweaks) == 0 {
-		fmt.Println("None.")
+		fmt.Fprintln(w, "None.")
 	}
 	for _, t := range tweaks {
-		fmt.Println("* ", t.Note)
+		fmt.Fprintln(w, "* ", t.Note)
+	}
+	fmt.Fprintln(w, strings.Repeat("=", 80))
+	fmt.Fprintln(w, "Failure triage:")
+	buckets := Triage(tw.failures)
+	if len(buckets) == 0 {
+		fmt.Fprintln(w, "None.")
+	}
+	for _, b := range buckets {
+		fmt.Fprintln(w, "* ", b)
+		for _, ex := range b.Examples {
+			fmt.Fprintln(w, "    e.g.", ex)
+		}
+	}
+	if m := tw.matrix.build(); m != nil {
+		fmt.Fprintln(w, strings.Repeat("=", 80))
+		fmt.Fprintln(w, "Compliance matrix:")
+		mw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(mw, "QUERY\t%s\n", strings.Join(m.Targets, "\t"))
+		for _, row := range m.Rows {
+			fmt.Fprintf(mw, "%s\t%s\n", row.Query, strings.Join(row.Cells(m.Targets), "\t"))
+		}
+		passed := make([]string, 0, len(m.Targets))
+		for i, n := range m.PassCounts() {
+			passed = append(passed, fmt.Sprintf("%s / %s (%.2f%%)", formatInt(n), formatInt(len(m.Rows)), m.SuccessRates[m.Targets[i]]))
+		}
+		fmt.Fprintf(mw, "PASSED\t%s\n", strings.Join(passed, "\t"))
+		mw.Flush()
+	}
+	if len(tw.conformance.summaries) > 0 {
+		fmt.Fprintln(w, strings.Repeat("=", 80))
+		fmt.Fprintln(w, "API conformance:")
+		for _, s := range tw.conformance.summaries {
+			fmt.Fprintf(w, "*  %s in %s test cases\n", s.Kind, formatInt(s.Cases))
+			for _, ex := range s.Examples {
+				fmt.Fprintf(w, "    e.g. %s in %s\n", ex.Example, ex.Query)
+			}
+		}
+	}
+	if p := tw.parity.build(); p != nil {
+		fmt.Fprintln(w, strings.Repeat("=", 80))
+		fmt.Fprintln(w, "Request parity:")
+		fmt.Fprintf(w, "%s of %s sampled test cases sent differing query parameters to the targets\n", formatInt(p.Drifted), formatInt(p.Checked))
+		for _, ex := range p.Examples {
+			target := ""
+			if ex.TestTarget != "" {
+				target = " [" + ex.TestTarget + "]"
+			}
+			fmt.Fprintf(w, "*  %s%s\n", ex.Query, target)
+			for _, d := range ex.Drift {
+				fmt.Fprintf(w, "    %s\n", d)
+			}
+		}
+	}
+	if c := tw.cached.build(); c != nil {
+		fmt.Fprintln(w, strings.Repeat("=", 80))
+		fmt.Fprintln(w, "Cached test responses:")
+		fmt.Fprintf(w, "%s test cases had test responses that show evidence of being served from a cache, so that their results may be stale\n", formatInt(c.Cached))
+		for _, ex := range c.Examples {
+			target := ""
+			if ex.TestTarget != "" {
+				target = " [" + ex.TestTarget + "]"
+			}
+			fmt.Fprintf(w, "*  %s%s: %s\n", ex.Query, target, ex.Evidence)
+		}
+	}
+	if h := tw.headroom.build(); h != nil {
+		fmt.Fprintln(w, strings.Repeat("=", 80))
+		fmt.Fprintln(w, "Tolerance headroom:")
+		fmt.Fprintf(w, "%s passing test cases only matched within the value tolerance, closest to exceeding it:\n", formatInt(h.WithinTolerance))
+		hw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(hw, "USED\tABSOLUTE\tRELATIVE\tQUERY")
+		for _, c := range h.Closest {
+			target := ""
+			if c.TestTarget != "" {
+				target = " [" + c.TestTarget + "]"
+			}
+			fmt.Fprintf(hw, "%s%%\t%g\t%.3g\t%s%s\n", formatFloat(c.UsedPercent(), 1), c.MaxAbsoluteDeviation, c.MaxRelativeDeviation, c.Query, target)
+		}
+		hw.Flush()
+	}
+	if e := tw.exactness.build(); e != nil {
+		fmt.Fprintln(w, strings.Repeat("=", 80))
+		fmt.Fprintln(w, "Exactness audit:")
+		fmt.Fprintf(w, "%s of %s audited passing test cases (%s%%) returned bit-identical sample values\n", formatInt(e.BitIdentical), formatInt(e.Cases), formatFloat(e.IdenticalPercent(), 1))
+		fmt.Fprintf(w, "%s of %s samples were textually identical, %s only differed in formatting, %s differed in the last ULP, and %s by more\n", formatInt(e.Identical), formatInt(e.Samples), formatInt(e.FormatDiffers), formatInt(e.LastULP), formatInt(e.Inexact))
+		for _, ex := range e.Examples {
+			target := ""
+			if ex.TestTarget != "" {
+				target = " [" + ex.TestTarget + "]"
+			}
+			fmt.Fprintf(w, "*  %s: %s @%s: reference %q, test %q in %s%s\n", ex.Kind, ex.Series, ex.Timestamp, ex.Reference, ex.Test, ex.Query, target)
+		}
+	}
+	if l := tw.latency.build(); l != nil {
+		fmt.Fprintln(w, strings.Repeat("=", 80))
+		fmt.Fprintln(w, "Query latency:")
+		lw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(lw, "TARGET\tQUERIES\tP50\tP95")
+		for _, t := range l.Targets {
+			fmt.Fprintf(lw, "%s\t%s\t%v\t%v\n", t.Target, formatInt(t.Queries), t.P50, t.P95)
+		}
+		lw.Flush()
+		if len(l.Slowest) > 0 {
+			fmt.Fprintln(w, "Slowest test queries relative to the reference:")
+		}
+		for _, sq := range l.Slowest {
+			target := ""
+			if sq.TestTarget != "" {
+				target = " [" + sq.TestTarget + "]"
+			}
+			fmt.Fprintf(w, "*  %sx (%v vs. %v)%s: %s\n", formatFloat(sq.Ratio, 1), sq.TestDuration, sq.RefDuration, target, sq.Query)
+		}
+	}
+	if tw.baseline != nil {
+		fmt.Fprintln(w, strings.Repeat("=", 80))
+		fmt.Fprintln(w, "Regressions vs. history:")
+		regressions := tw.baseline.Regressions(tw.current)
+		if len(regressions) == 0 {
+			fmt.Fprintln(w, "None.")
+		}
+		for _, r := range regressions {
+			fmt.Fprintf(w, "*  %s: %s%% passed, %s points below the mean of %s%% over the last %s runs\n",
+				r.Title(), formatFloat(r.Rate, 2), formatFloat(r.Drop, 2), formatFloat(r.TrailingMean, 2), formatInt(r.Runs))
+		}
 	}
-	fmt.Println(strings.Repeat("=", 80))
-	fmt.Printf("Total: %d / %d (%.2f%%) passed, %d unsupported\n", successes, len(results), 100*float64(successes)/float64(len(results)), unsupported)
+	fmt.Fprintln(w, strings.Repeat("=", 80))
+	run := tw.total - tw.skipped
+	fmt.Fprintf(w, "Total: %s / %s (%s%%) passed, %s unsupported, %s execution errors, %s skipped\n",
+		formatInt(tw.successes), formatInt(run), formatFloat(100*float64(tw.successes)/float64(run), 2),
+		formatInt(tw.unsupported), formatInt(tw.errored), formatInt(tw.skipped))
 }
@@ -0,0 +1,235 @@
+package output
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+const (
+	// triageMinBucketSize is the minimum number of failures that must share an attribute to form a bucket.
+	triageMinBucketSize = 2
+	// triageMaxExamples is the maximum number of example queries listed per bucket.
+	triageMaxExamples = 3
+)
+
+var (
+	triageNumberRe   = regexp.MustCompile(`[0-9]+(\.[0-9]+)?`)
+	triageSubqueryRe = regexp.MustCompile(`\[[^\]]*:[^\]]*\]`)
+	triageFunctionRe = regexp.MustCompile(`([a-z_]+)\(`)
+)
+
+// TriageBucket groups failed test cases that share an attribute hinting at a common root cause.
+type TriageBucket struct {
+	Heuristic string   `json:"heuristic"`
+	Attribute string   `json:"attribute"`
+	Size      int      `json:"size"`
+	Examples  []string `json:"examples"`
+}
+
+// triageHeuristic returns the attribute values of a failed result that it should be grouped by.
+type triageHeuristic struct {
+	name       string
+	attributes func(res *comparer.Result) []string
+}
+
+var triageHeuristics = []triageHeuristic{
+	{
+		name: "error fingerprint",
+		attributes: func(res *comparer.Result) []string {
+			msg := res.UnexpectedFailure
+			if res.Errored() {
+				msg = res.ExecutionError
+			}
+			if msg == "" {
+				return nil
+			}
+			return []string{triageNumberRe.ReplaceAllString(msg, "N")}
+		},
+	},
+	{
+		name: "result type mismatch",
+		attributes: func(res *comparer.Result) []string {
+			if strings.HasPrefix(res.Diff, "result type mismatch") {
+				return []string{res.Diff}
+			}
+			return nil
+		},
+	},
+	{
+		name: "NaN vs. empty result",
+		attributes: func(res *comparer.Result) []string {
+			d := res.StructuredDiff
+			if d == nil {
+				return nil
+			}
+			var attrs []string
+			if d.NaNVsEmpty() {
+				attrs = append(attrs, "NaN samples where the other result has none")
+			}
+			for _, s := range d.Series {
+				if s.OnlyValue == "0" {
+					attrs = append(attrs, "zero-valued series where the other result has none")
+					break
+				}
+			}
+			return attrs
+		},
+	},
+	{
+		name: "internal consistency violation",
+		attributes: func(res *comparer.Result) []string {
+			if !res.ConsistencyViolation {
+				return nil
+			}
+			return []string{"the test target returned different results for queries declared the same with same_as"}
+		},
+	},
+	{
+		name: "out-of-order samples",
+		attributes: func(res *comparer.Result) []string {
+			if len(res.OutOfOrderSeries) == 0 {
+				return nil
+			}
+			return []string{"samples out of timestamp order"}
+		},
+	},
+	{
+		name: "collapsed series",
+		attributes: func(res *comparer.Result) []string {
+			if len(res.CollapsedSeries) == 0 {
+				return nil
+			}
+			return []string{"result label tweaks made series indistinguishable"}
+		},
+	},
+	{
+		name: "retries exhausted",
+		attributes: func(res *comparer.Result) []string {
+			if !res.RetriesExhausted {
+				return nil
+			}
+			return []string{"not retried after the maximum retry wait of the run was exhausted"}
+		},
+	},
+	{
+		name: "snap collisions",
+		attributes: func(res *comparer.Result) []string {
+			if len(res.SnapCollisions) == 0 {
+				return nil
+			}
+			return []string{"samples snapped to the same query step"}
+		},
+	},
+	{
+		name: "outside reference range",
+		attributes: func(res *comparer.Result) []string {
+			if len(res.OutOfRangeValues) == 0 {
+				return nil
+			}
+			return []string{"values outside the reference's recent range"}
+		},
+	},
+	{
+		name: "nondeterministic aggregation",
+		attributes: func(res *comparer.Result) []string {
+			if res.LimitAggregation == "" {
+				return nil
+			}
+			return []string{res.LimitAggregation + "()"}
+		},
+	},
+	{
+		name:       "native histogram mismatch",
+		attributes: func(res *comparer.Result) []string { return res.HistogramMismatches },
+	},
+	{
+		// Targets that lack newer PromQL functions reject the queries that the other target runs.
+		name: "feature availability mismatch",
+		attributes: func(res *comparer.Result) []string {
+			switch {
+			case res.LimitAggregation == "":
+				return nil
+			case res.UnexpectedFailure != "":
+				return []string{res.LimitAggregation + "() is not available on the test target"}
+			case res.UnexpectedSuccess && res.RefError != "":
+				return []string{res.LimitAggregation + "() is not available on the reference target"}
+			}
+			return nil
+		},
+	},
+	{
+		name: "category",
+		attributes: func(res *comparer.Result) []string {
+			if res.TestCase.Category == "" {
+				return nil
+			}
+			return []string{res.TestCase.Category}
+		},
+	},
+	{
+		name: "query feature",
+		attributes: func(res *comparer.Result) []string {
+			var attrs []string
+			if triageSubqueryRe.MatchString(res.TestCase.Query) {
+				attrs = append(attrs, "subquery")
+			}
+			seen := map[string]bool{}
+			for _, m := range triageFunctionRe.FindAllStringSubmatch(res.TestCase.Query, -1) {
+				if !seen[m[1]] {
+					seen[m[1]] = true
+					attrs = append(attrs, m[1]+"()")
+				}
+			}
+			return attrs
+		},
+	},
+}
+
+// Triage clusters the failed and errored results into buckets of failures that share an attribute, using
+// simple deterministic heuristics. Buckets are sorted by decreasing size.
+func Triage(results []*comparer.Result) []*TriageBucket {
+	var buckets []*TriageBucket
+	for _, h := range triageHeuristics {
+		byAttr := map[string]*TriageBucket{}
+		for _, res := range results {
+			if !res.Failed() && !res.Errored() {
+				continue
+			}
+			for _, attr := range h.attributes(res) {
+				b, ok := byAttr[attr]
+				if !ok {
+					b = &TriageBucket{Heuristic: h.name, Attribute: attr}
+					byAttr[attr] = b
+				}
+				b.Size++
+				if len(b.Examples) < triageMaxExamples {
+					b.Examples = append(b.Examples, res.TestCase.Query)
+				}
+			}
+		}
+		for _, b := range byAttr {
+			if b.Size >= triageMinBucketSize {
+				buckets = append(buckets, b)
+			}
+		}
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if buckets[i].Size != buckets[j].Size {
+			return buckets[i].Size > buckets[j].Size
+		}
+		if buckets[i].Heuristic != buckets[j].Heuristic {
+			return buckets[i].Heuristic < buckets[j].Heuristic
+		}
+		return buckets[i].Attribute < buckets[j].Attribute
+	})
+	return buckets
+}
+
+// String describes the bucket in a single line.
+func (b *TriageBucket) String() string {
+	return fmt.Sprintf("%d failures share %s %q", b.Size, b.Heuristic, b.Attribute)
+}
@@ -0,0 +1,235 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// failedResult returns a failed result of the query with a diff, modified by fn.
+func failedResult(query string, fn func(res *comparer.Result)) *comparer.Result {
+	res := &comparer.Result{TestCase: &comparer.TestCase{Query: query}, Diff: "-a\n+b\n"}
+	if fn != nil {
+		fn(res)
+	}
+	return res
+}
+
+func triageHeuristicByName(t *testing.T, name string) triageHeuristic {
+	for _, h := range triageHeuristics {
+		if h.name == name {
+			return h
+		}
+	}
+	t.Fatalf("no triage heuristic %q", name)
+	return triageHeuristic{}
+}
+
+func TestTriageHeuristics(t *testing.T) {
+	nan := model.SampleValue(math.NaN())
+	for _, tc := range []struct {
+		heuristic string
+		res       *comparer.Result
+		want      []string
+	}{
+		{
+			heuristic: "error fingerprint",
+			res: failedResult("a", func(res *comparer.Result) {
+				res.Diff, res.UnexpectedFailure = "", "bad_data: 1:12: parse error at char 12"
+			}),
+			want: []string{"bad_data: N:N: parse error at char N"},
+		},
+		{
+			heuristic: "error fingerprint",
+			res:       failedResult("a", func(res *comparer.Result) { res.Diff, res.ExecutionError = "", "test API query timed out after 30s" }),
+			want:      []string{"test API query timed out after Ns"},
+		},
+		{heuristic: "error fingerprint", res: failedResult("a", nil)},
+		{
+			heuristic: "result type mismatch",
+			res:       failedResult("a", func(res *comparer.Result) { res.Diff = "result type mismatch: vector vs. matrix" }),
+			want:      []string{"result type mismatch: vector vs. matrix"},
+		},
+		{heuristic: "result type mismatch", res: failedResult("a", nil)},
+		{
+			heuristic: "NaN vs. empty result",
+			res: failedResult("a", func(res *comparer.Result) {
+				res.StructuredDiff = &comparer.StructuredDiff{Series: []*comparer.SeriesDiff{{Samples: []*comparer.SampleDiff{{Expected: &nan}}}}}
+			}),
+			want: []string{"NaN samples where the other result has none"},
+		},
+		{
+			heuristic: "NaN vs. empty result",
+			res: failedResult("a", func(res *comparer.Result) {
+				res.StructuredDiff = &comparer.StructuredDiff{Series: []*comparer.SeriesDiff{{OnlyIn: "test", OnlyValue: "0"}, {OnlyIn: "test", OnlyValue: "0"}}}
+			}),
+			want: []string{"zero-valued series where the other result has none"},
+		},
+		{heuristic: "NaN vs. empty result", res: failedResult("a", func(res *comparer.Result) { res.StructuredDiff = &comparer.StructuredDiff{} })},
+		{
+			heuristic: "internal consistency violation",
+			res:       failedResult("a", func(res *comparer.Result) { res.ConsistencyViolation = true }),
+			want:      []string{"the test target returned different results for queries declared the same with same_as"},
+		},
+		{
+			heuristic: "out-of-order samples",
+			res:       failedResult("a", func(res *comparer.Result) { res.OutOfOrderSeries = []string{`{job="a"}`, `{job="b"}`} }),
+			want:      []string{"samples out of timestamp order"},
+		},
+		{
+			heuristic: "collapsed series",
+			res:       failedResult("a", func(res *comparer.Result) { res.CollapsedSeries = []string{`{}`} }),
+			want:      []string{"result label tweaks made series indistinguishable"},
+		},
+		{
+			heuristic: "retries exhausted",
+			res:       failedResult("a", func(res *comparer.Result) { res.RetriesExhausted = true }),
+			want:      []string{"not retried after the maximum retry wait of the run was exhausted"},
+		},
+		{
+			heuristic: "snap collisions",
+			res:       failedResult("a", func(res *comparer.Result) { res.SnapCollisions = []string{"x"} }),
+			want:      []string{"samples snapped to the same query step"},
+		},
+		{
+			heuristic: "outside reference range",
+			res:       failedResult("a", func(res *comparer.Result) { res.OutOfRangeValues = []string{"x"} }),
+			want:      []string{"values outside the reference's recent range"},
+		},
+		{
+			heuristic: "nondeterministic aggregation",
+			res:       failedResult("limitk(2, a)", func(res *comparer.Result) { res.LimitAggregation = "limitk" }),
+			want:      []string{"limitk()"},
+		},
+		{
+			heuristic: "native histogram mismatch",
+			res:       failedResult("a", func(res *comparer.Result) { res.HistogramMismatches = []string{"bucket counts", "schema"} }),
+			want:      []string{"bucket counts", "schema"},
+		},
+		{
+			heuristic: "feature availability mismatch",
+			res: failedResult("limitk(2, a)", func(res *comparer.Result) {
+				res.Diff, res.LimitAggregation, res.UnexpectedFailure = "", "limitk", "bad_data: unknown function"
+			}),
+			want: []string{"limitk() is not available on the test target"},
+		},
+		{
+			heuristic: "feature availability mismatch",
+			res: failedResult("limit_ratio(0.5, a)", func(res *comparer.Result) {
+				res.Diff, res.LimitAggregation, res.UnexpectedSuccess, res.RefError = "", "limit_ratio", true, "bad_data: unknown function"
+			}),
+			want: []string{"limit_ratio() is not available on the reference target"},
+		},
+		{heuristic: "feature availability mismatch", res: failedResult("limitk(2, a)", func(res *comparer.Result) { res.LimitAggregation = "limitk" })},
+		{
+			heuristic: "category",
+			res:       failedResult("a", func(res *comparer.Result) { res.TestCase.Category = "subqueries" }),
+			want:      []string{"subqueries"},
+		},
+		{heuristic: "category", res: failedResult("a", nil)},
+		{
+			heuristic: "query feature",
+			res:       failedResult("max_over_time(rate(a[1m])[5m:]) + rate(b[1m])", nil),
+			want:      []string{"subquery", "max_over_time()", "rate()"},
+		},
+		{heuristic: "query feature", res: failedResult("a", nil)},
+	} {
+		got := triageHeuristicByName(t, tc.heuristic).attributes(tc.res)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s of %q: expected the attributes %q, got %q", tc.heuristic, tc.res.TestCase.Query, tc.want, got)
+		}
+	}
+}
+
+func TestTriage(t *testing.T) {
+	timeout := func(res *comparer.Result) { res.Diff, res.ExecutionError = "", "test API query timed out after 30s" }
+	results := []*comparer.Result{
+		failedResult("rate(a[5m])", timeout),
+		failedResult("rate(b[5m])", timeout),
+		failedResult("rate(c[5m])", timeout),
+		failedResult("rate(d[5m])", timeout),
+		failedResult("sum(a)", func(res *comparer.Result) { res.OutOfOrderSeries = []string{"x"} }),
+		// A single failure does not form a bucket.
+		failedResult("count(a)", func(res *comparer.Result) { res.ConsistencyViolation = true }),
+		// Passing and skipped results are not triaged.
+		{TestCase: &comparer.TestCase{Query: "rate(e[5m])"}},
+		{TestCase: &comparer.TestCase{Query: "rate(f[5m])"}, SkipReason: "skipped", UnexpectedFailure: "test API query timed out after 30s"},
+	}
+	want := []*TriageBucket{
+		{Heuristic: "error fingerprint", Attribute: "test API query timed out after Ns", Size: 4, Examples: []string{"rate(a[5m])", "rate(b[5m])", "rate(c[5m])"}},
+		{Heuristic: "query feature", Attribute: "rate()", Size: 4, Examples: []string{"rate(a[5m])", "rate(b[5m])", "rate(c[5m])"}},
+	}
+	if got := Triage(results); !reflect.DeepEqual(got, want) {
+		t.Error("unexpected triage buckets")
+		for _, b := range want {
+			t.Logf("want %v %v", b, b.Examples)
+		}
+		for _, b := range got {
+			t.Logf("got %v %v", b, b.Examples)
+		}
+	}
+
+	// Buckets of the same size are sorted by heuristic and attribute.
+	results = append(results, failedResult("avg(a)", func(res *comparer.Result) { res.OutOfOrderSeries = []string{"y"} }))
+	got := Triage(results)
+	if len(got) != 3 || got[2].Heuristic != "out-of-order samples" || got[2].Size != 2 {
+		t.Errorf("expected a third bucket of out-of-order samples, got %v", got)
+	}
+	if s := got[2].String(); s != `2 failures share out-of-order samples "samples out of timestamp order"` {
+		t.Errorf("unexpected bucket description %q", s)
+	}
+	if Triage(nil) != nil {
+		t.Error("expected no buckets without results")
+	}
+}
+
+func TestTriageRendering(t *testing.T) {
+	timeout := func(res *comparer.Result) { res.Diff, res.ExecutionError = "", "test API query timed out after 30s" }
+	results := []*comparer.Result{failedResult("rate(a[5m])", timeout), failedResult("rate(b[5m])", timeout)}
+	for _, tc := range []struct {
+		format string
+		outp   Outputter
+		want   []string
+	}{
+		{format: "text", outp: Text, want: []string{`2 failures share error fingerprint "test API query timed out after Ns"`, "e.g. rate(b[5m])"}},
+		{format: "markdown", outp: Markdown, want: []string{"## Failure triage", "| error fingerprint | test API query timed out after Ns | 2 | `rate(a[5m])`, `rate(b[5m])` |"}},
+	} {
+		var buf bytes.Buffer
+		tc.outp(&buf, results, false, nil)
+		for _, want := range tc.want {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("expected the %s output to contain %q, got\n%s", tc.format, want, buf.String())
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	JSON(&buf, results, false, nil)
+	var report struct {
+		Triage []*TriageBucket `json:"triage"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if want := Triage(results); !reflect.DeepEqual(report.Triage, want) {
+		t.Errorf("expected the json output to hold the triage buckets %v, got %v", want, report.Triage)
+	}
+
+	r, err := newHTMLRenderer("example-output.html", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := r.render(&buf, results, false, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Failure triage:") || !strings.Contains(buf.String(), "test API query timed out after Ns") {
+		t.Errorf("expected the HTML output to list the triage bucket, got\n%s", buf.String())
+	}
+}
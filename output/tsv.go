@@ -2,38 +2,93 @@ package output
 
 import (
 	"fmt"
+	"io"
+	"time"
+
 	"github.com/promlabs/promql-compliance-tester/comparer"
 	"github.com/promlabs/promql-compliance-tester/config"
 )
 
 // TSV produces tab separated values output for a number of query results.
-func TSV(results []*comparer.Result, passing bool, tweaks []*config.QueryTweak) {
-	successes := 0
-	unsupported := 0
-
-	fmt.Println("QUERY\tSTART\tSTOP\tSTEP\tRESULT")
-
-	for _, res := range results {
-		if res.Success() {
-			successes++
-		}
-		if res.Unsupported {
-			unsupported++
-		}
-
-		fmt.Printf("%v\t%v\t%v\t%v\t", res.TestCase.Query, res.TestCase.Start, res.TestCase.End, res.TestCase.Resolution)
-		if res.Success() {
-			fmt.Println("PASSED")
-		} else if res.Unsupported {
-			fmt.Println("UNSUPPORTED")
-		} else {
-			fmt.Println("FAILED")
-		}
-	}
-	totalTestCases := len(results)
-	totalFailed := totalTestCases - successes - unsupported
-	fmt.Printf("\n\t\tPASSED\t%v\t%.4f\n", successes, float64(successes)/float64(totalTestCases))
-	fmt.Printf("\t\tFAILED\t%v\t%.4f\n", totalFailed, float64(totalFailed)/float64(totalTestCases))
-	fmt.Printf("\t\tUNSUPPORTED\t%v\t%.4f\n", unsupported, float64(unsupported)/float64(totalTestCases))
-	fmt.Printf("\t\tTOTAL\t%v\t%.4f\n", totalTestCases, float64(1))
+func TSV(w io.Writer, results []*comparer.Result, passing bool, tweaks []*config.QueryTweak) {
+	tw := newTSVWriter(w)
+	for _, res := range sortedResults(results) {
+		tw.WriteResult(res)
+	}
+	tw.Finish(tweaks)
+}
+
+// tsvWriter writes tab separated values output one result at a time.
+type tsvWriter struct {
+	w io.Writer
+
+	total       int
+	successes   int
+	unsupported int
+	skipped     int
+	errored     int
+}
+
+func newTSVWriter(w io.Writer) *tsvWriter {
+	fmt.Fprintln(w, "QUERY\tTYPE\tSTART\tSTOP\tSTEP\tRESULT\tDIFF\tREF_SECONDS\tTEST_SECONDS")
+	return &tsvWriter{w: w}
+}
+
+func (tw *tsvWriter) WriteResult(res *comparer.Result) {
+	w := tw.w
+	tw.total++
+	if res.Success() {
+		tw.successes++
+	}
+	if res.Unsupported {
+		tw.unsupported++
+	}
+	if res.Skipped() {
+		tw.skipped++
+	}
+	if res.Errored() {
+		tw.errored++
+	}
+
+	if res.TestCase.Instant() {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t\t", res.TestCase.Query, res.TestCase.Type, res.TestCase.Time, res.TestCase.Time)
+	} else {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t", res.TestCase.Query, res.TestCase.Type, res.TestCase.Start, res.TestCase.End, res.TestCase.Resolution)
+	}
+	if res.Skipped() {
+		fmt.Fprint(w, "SKIPPED")
+	} else if res.Errored() {
+		fmt.Fprint(w, "ERROR")
+	} else if res.Success() {
+		fmt.Fprint(w, "PASSED")
+	} else if res.Unsupported {
+		fmt.Fprint(w, "UNSUPPORTED")
+	} else {
+		fmt.Fprint(w, "FAILED")
+	}
+	fmt.Fprint(w, "\t")
+	if res.StructuredDiff != nil {
+		fmt.Fprint(w, res.StructuredDiff.Summary())
+	}
+	fmt.Fprintf(w, "\t%s\t%s\n", tsvSeconds(res.RefDuration), tsvSeconds(res.TestDuration))
+}
+
+// tsvSeconds formats a query duration in seconds, or as an empty field if the query did not succeed.
+func tsvSeconds(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.6f", d.Seconds())
+}
+
+func (tw *tsvWriter) Finish(tweaks []*config.QueryTweak) {
+	w := tw.w
+	totalTestCases := tw.total
+	totalFailed := totalTestCases - tw.successes - tw.unsupported - tw.skipped - tw.errored
+	fmt.Fprintf(w, "\n\t\t\tPASSED\t%v\t%.4f\n", tw.successes, float64(tw.successes)/float64(totalTestCases))
+	fmt.Fprintf(w, "\t\t\tFAILED\t%v\t%.4f\n", totalFailed, float64(totalFailed)/float64(totalTestCases))
+	fmt.Fprintf(w, "\t\t\tUNSUPPORTED\t%v\t%.4f\n", tw.unsupported, float64(tw.unsupported)/float64(totalTestCases))
+	fmt.Fprintf(w, "\t\t\tERROR\t%v\t%.4f\n", tw.errored, float64(tw.errored)/float64(totalTestCases))
+	fmt.Fprintf(w, "\t\t\tSKIPPED\t%v\t%.4f\n", tw.skipped, float64(tw.skipped)/float64(totalTestCases))
+	fmt.Fprintf(w, "\t\t\tTOTAL\t%v\t%.4f\n", totalTestCases, float64(1))
 }
@@ -0,0 +1,329 @@
+package output
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// targetVersion is the version of the test target that is recorded in the JSON reports.
+var targetVersion string
+
+// SetTargetVersion sets the version of the test target that the JSON reports are stamped with, so
+// that the reports of several runs can be compared in a version matrix.
+func SetTargetVersion(version string) {
+	targetVersion = version
+}
+
+// A VersionReport holds the test case outcomes of a run against a version of the test target.
+type VersionReport struct {
+	Version  string
+	Outcomes []CaseOutcome
+}
+
+// ReadVersionReport reads the outcomes of a JSON report. Its version is the target version that
+// the report is stamped with, or the name of the file without its extension.
+func ReadVersionReport(filename string) (*VersionReport, error) {
+	outcomes, version, err := readReport(filename, "report")
+	if err != nil {
+		return nil, err
+	}
+	if version == "" {
+		version = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	}
+	return &VersionReport{Version: version, Outcomes: outcomes}, nil
+}
+
+// A VersionMatrix compares the pass rates of the categories of test cases across versions of the
+// test target. Only the test cases that all reports contain are compared.
+type VersionMatrix struct {
+	Versions []string
+	Rows     []VersionMatrixRow
+	// Common is the number of test cases that all reports contain, and NotOverlapping the number of
+	// test cases of each report that were left out, by version.
+	Common         int
+	NotOverlapping []int
+	// Changes lists the test cases whose outcomes changed between adjacent versions.
+	Changes []VersionChange
+}
+
+// A VersionMatrixRow holds the pass rates of a category of test cases, one per version. A rate is
+// negative if all test cases of the category were skipped in that version.
+type VersionMatrixRow struct {
+	Category  string
+	Cases     int
+	PassRates []float64
+}
+
+// A VersionChange lists the test cases that newly passed or newly failed in a version.
+type VersionChange struct {
+	From, To    string
+	NewlyFixed  []CaseOutcome
+	NewlyBroken []CaseOutcome
+}
+
+// NewVersionMatrix builds the version matrix of reports, which are ordered from the oldest to the
+// newest version.
+func NewVersionMatrix(reports []*VersionReport) *VersionMatrix {
+	m := &VersionMatrix{}
+	byID := make([]map[string]CaseOutcome, len(reports))
+	for i, r := range reports {
+		m.Versions = append(m.Versions, r.Version)
+		byID[i] = make(map[string]CaseOutcome, len(r.Outcomes))
+		for _, o := range r.Outcomes {
+			byID[i][o.ID] = o
+		}
+	}
+	if len(reports) == 0 {
+		return m
+	}
+
+	var common []string
+	for id := range byID[0] {
+		inAll := true
+		for _, outcomes := range byID[1:] {
+			if _, ok := outcomes[id]; !ok {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			common = append(common, id)
+		}
+	}
+	// Order the test cases like the other reports, by query first.
+	sort.Slice(common, func(i, j int) bool {
+		a, b := byID[0][common[i]], byID[0][common[j]]
+		if a.Query != b.Query {
+			return a.Query < b.Query
+		}
+		return common[i] < common[j]
+	})
+	m.Common = len(common)
+	for _, outcomes := range byID {
+		m.NotOverlapping = append(m.NotOverlapping, len(outcomes)-len(common))
+	}
+
+	type counts struct{ cases, run, passed []int }
+	byCategory := map[string]*counts{}
+	for _, id := range common {
+		// The category is taken from the newest report, in case test cases were recategorized.
+		category := byID[len(byID)-1][id].Category
+		if category == "" {
+			category = markdownMiscGroup
+		}
+		c, ok := byCategory[category]
+		if !ok {
+			c = &counts{cases: make([]int, len(reports)), run: make([]int, len(reports)), passed: make([]int, len(reports))}
+			byCategory[category] = c
+		}
+		for i, outcomes := range byID {
+			c.cases[i]++
+			switch outcomes[id].Outcome {
+			case "skipped":
+			case "pass":
+				c.run[i]++
+				c.passed[i]++
+			default:
+				c.run[i]++
+			}
+		}
+	}
+	categories := make([]string, 0, len(byCategory))
+	for category := range byCategory {
+		if category != markdownMiscGroup {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+	if _, ok := byCategory[markdownMiscGroup]; ok {
+		categories = append(categories, markdownMiscGroup)
+	}
+	for _, category := range categories {
+		c := byCategory[category]
+		row := VersionMatrixRow{Category: category, Cases: c.cases[0]}
+		for i := range reports {
+			rate := -1.0
+			if c.run[i] > 0 {
+				rate = 100 * float64(c.passed[i]) / float64(c.run[i])
+			}
+			row.PassRates = append(row.PassRates, rate)
+		}
+		m.Rows = append(m.Rows, row)
+	}
+
+	for i := 1; i < len(reports); i++ {
+		ch := VersionChange{From: m.Versions[i-1], To: m.Versions[i]}
+		for _, id := range common {
+			before, after := byID[i-1][id], byID[i][id]
+			switch {
+			case before.Outcome == "skipped" || after.Outcome == "skipped" || (before.Outcome == "pass") == (after.Outcome == "pass"):
+			case after.Outcome == "pass":
+				ch.NewlyFixed = append(ch.NewlyFixed, after)
+			default:
+				ch.NewlyBroken = append(ch.NewlyBroken, after)
+			}
+		}
+		m.Changes = append(m.Changes, ch)
+	}
+	return m
+}
+
+// changed returns true if the pass rate of row in version i differs from the one in the previous
+// version. Versions that skipped all test cases of the row are not compared.
+func (r VersionMatrixRow) changed(i int) bool {
+	return i > 0 && r.PassRates[i] >= 0 && r.PassRates[i-1] >= 0 && r.PassRates[i] != r.PassRates[i-1]
+}
+
+func formatPassRate(rate float64) string {
+	if rate < 0 {
+		return "-"
+	}
+	return formatFloat(rate, 2) + "%"
+}
+
+// VersionMatrixMarkdown writes the version matrix as Markdown. Pass rates that changed against the
+// previous version are set in bold with an arrow.
+func VersionMatrixMarkdown(w io.Writer, m *VersionMatrix) {
+	fmt.Fprintln(w, "# PromQL compliance across versions")
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "%s test cases are in all reports.", formatInt(m.Common))
+	for i, n := range m.NotOverlapping {
+		if n > 0 {
+			fmt.Fprintf(w, " %s test cases of %s are not in all reports.", formatInt(n), markdownCell(m.Versions[i]))
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w)
+	header := append([]string{"Category", "Test cases"}, m.Versions...)
+	for i := range header {
+		header[i] = markdownCell(header[i])
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(header, " | "))
+	fmt.Fprintf(w, "| --- |%s\n", strings.Repeat(" ---: |", len(header)-1))
+	for _, row := range m.Rows {
+		cells := []string{markdownCell(row.Category), formatInt(row.Cases)}
+		for i, rate := range row.PassRates {
+			cell := formatPassRate(rate)
+			if row.changed(i) {
+				arrow := "↑"
+				if rate < row.PassRates[i-1] {
+					arrow = "↓"
+				}
+				cell = "**" + cell + " " + arrow + "**"
+			}
+			cells = append(cells, cell)
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+	}
+	for _, ch := range m.Changes {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "## %s to %s\n", markdownCell(ch.From), markdownCell(ch.To))
+		for _, list := range []struct {
+			title    string
+			outcomes []CaseOutcome
+		}{{"Newly fixed", ch.NewlyFixed}, {"Newly broken", ch.NewlyBroken}} {
+			fmt.Fprintln(w)
+			fmt.Fprintf(w, "%s: %s\n", list.title, formatInt(len(list.outcomes)))
+			if len(list.outcomes) > 0 {
+				fmt.Fprintln(w)
+			}
+			for _, o := range list.outcomes {
+				if o.Outcome == "pass" {
+					fmt.Fprintf(w, "- %s\n", markdownCode(o.Query))
+				} else {
+					fmt.Fprintf(w, "- %s (%s)\n", markdownCode(o.Query), o.Outcome)
+				}
+			}
+		}
+	}
+}
+
+// VersionMatrixCSV writes the version matrix as CSV, with a row per category and a column per
+// version. Pass rates are percentages, and empty if all test cases were skipped.
+func VersionMatrixCSV(w io.Writer, m *VersionMatrix) error {
+	cw := csv.NewWriter(w)
+	cw.Write(append([]string{"category", "test_cases"}, m.Versions...))
+	for _, row := range m.Rows {
+		record := []string{row.Category, fmt.Sprint(row.Cases)}
+		for _, rate := range row.PassRates {
+			if rate < 0 {
+				record = append(record, "")
+			} else {
+				record = append(record, fmt.Sprintf("%.2f", rate))
+			}
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+var versionMatrixHTMLTemplate = template.Must(template.New("versions").Funcs(template.FuncMap{
+	"rate":   formatPassRate,
+	"number": formatInt,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>PromQL compliance across versions</title>
+<style>
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; }
+td.rate { text-align: right; }
+td.up { background: #d4f7d4; font-weight: bold; }
+td.down { background: #f7d4d4; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>PromQL compliance across versions</h1>
+<p>{{number .Matrix.Common}} test cases are in all reports.{{range $i, $n := .Matrix.NotOverlapping}}{{if $n}} {{number $n}} test cases of {{index $.Matrix.Versions $i}} are not in all reports.{{end}}{{end}}</p>
+<table>
+<tr><th>Category</th><th>Test cases</th>{{range .Matrix.Versions}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr><td>{{.Category}}</td><td class="rate">{{number .Cases}}</td>{{range .Cells}}<td class="rate {{.Class}}">{{rate .Rate}}</td>{{end}}</tr>
+{{end}}</table>
+{{range .Matrix.Changes}}<h2>{{.From}} to {{.To}}</h2>
+<h3>Newly fixed: {{len .NewlyFixed}}</h3>
+<ul>{{range .NewlyFixed}}<li><code>{{.Query}}</code></li>{{end}}</ul>
+<h3>Newly broken: {{len .NewlyBroken}}</h3>
+<ul>{{range .NewlyBroken}}<li><code>{{.Query}}</code> ({{.Outcome}})</li>{{end}}</ul>
+{{end}}</body>
+</html>
+`))
+
+// VersionMatrixHTML writes the version matrix as a standalone HTML page. Pass rates that changed
+// against the previous version are highlighted.
+func VersionMatrixHTML(w io.Writer, m *VersionMatrix) error {
+	type cell struct {
+		Rate  float64
+		Class string
+	}
+	type row struct {
+		Category string
+		Cases    int
+		Cells    []cell
+	}
+	rows := make([]row, 0, len(m.Rows))
+	for _, r := range m.Rows {
+		hr := row{Category: r.Category, Cases: r.Cases}
+		for i, rate := range r.PassRates {
+			c := cell{Rate: rate}
+			if r.changed(i) {
+				c.Class = "up"
+				if rate < r.PassRates[i-1] {
+					c.Class = "down"
+				}
+			}
+			hr.Cells = append(hr.Cells, c)
+		}
+		rows = append(rows, hr)
+	}
+	return versionMatrixHTMLTemplate.Execute(w, struct {
+		Matrix *VersionMatrix
+		Rows   []row
+	}{m, rows})
+}
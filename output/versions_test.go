@@ -0,0 +1,94 @@
+package output
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "Update the golden files of the tests.")
+
+// testVersionMatrix returns the version matrix of the fixture reports, one of which is written as
+// JSON lines and one of which is not stamped with a target version.
+func testVersionMatrix(t *testing.T) *VersionMatrix {
+	t.Helper()
+	var reports []*VersionReport
+	for _, f := range []string{"v0.9.json", "v0.10.jsonl", "v0.11.json"} {
+		r, err := ReadVersionReport(filepath.Join("testdata", "versions", f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, r)
+	}
+	return NewVersionMatrix(reports)
+}
+
+func TestVersionMatrix(t *testing.T) {
+	m := testVersionMatrix(t)
+	if want := []string{"v0.9.0", "v0.10.0", "v0.11"}; !reflect.DeepEqual(m.Versions, want) {
+		t.Errorf("expected the versions %q, got %q", want, m.Versions)
+	}
+	// avg() is only in the first report, max() not in the first.
+	if m.Common != 5 || !reflect.DeepEqual(m.NotOverlapping, []int{1, 1, 1}) {
+		t.Errorf("expected 5 common test cases and 1 left out per report, got %d and %v", m.Common, m.NotOverlapping)
+	}
+	if len(m.Changes) != 2 {
+		t.Fatalf("expected changes between 2 pairs of versions, got %d", len(m.Changes))
+	}
+	for i, want := range []struct{ fixed, broken []string }{
+		{fixed: []string{"stdvar(demo_num_cpus)"}, broken: []string{"histogram_quantile(0.5, rate(demo_api_request_duration_seconds_bucket[5m]))"}},
+		// Test cases skipped in either version are neither fixed nor broken.
+		{fixed: []string{"histogram_quantile(0.9, rate(demo_api_request_duration_seconds_bucket[5m]))"}, broken: []string{"time()"}},
+	} {
+		ch := m.Changes[i]
+		if got := outcomeQueries(ch.NewlyFixed); !reflect.DeepEqual(got, want.fixed) {
+			t.Errorf("%s to %s: expected the newly fixed test cases %q, got %q", ch.From, ch.To, want.fixed, got)
+		}
+		if got := outcomeQueries(ch.NewlyBroken); !reflect.DeepEqual(got, want.broken) {
+			t.Errorf("%s to %s: expected the newly broken test cases %q, got %q", ch.From, ch.To, want.broken, got)
+		}
+	}
+}
+
+func TestVersionMatrixGolden(t *testing.T) {
+	m := testVersionMatrix(t)
+	for _, tc := range []struct {
+		golden string
+		write  func(*bytes.Buffer) error
+	}{
+		{golden: "matrix.md", write: func(b *bytes.Buffer) error { VersionMatrixMarkdown(b, m); return nil }},
+		{golden: "matrix.html", write: func(b *bytes.Buffer) error { return VersionMatrixHTML(b, m) }},
+		{golden: "matrix.csv", write: func(b *bytes.Buffer) error { return VersionMatrixCSV(b, m) }},
+	} {
+		t.Run(tc.golden, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tc.write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", "versions", tc.golden)
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("expected the output of %s, run with -update to update it, got:\n%s", golden, buf.String())
+			}
+		})
+	}
+}
+
+func outcomeQueries(outcomes []CaseOutcome) []string {
+	var queries []string
+	for _, o := range outcomes {
+		queries = append(queries, o.Query)
+	}
+	return queries
+}
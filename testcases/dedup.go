@@ -0,0 +1,54 @@
+package testcases
+
+import (
+	"fmt"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+)
+
+// TestCaseKey identifies the query that an expanded test case sends, including its type and time
+// parameters, and the same_as query that it is checked against, if any.
+func TestCaseKey(tc *comparer.TestCase) string {
+	key := fmt.Sprintf("%s\x00%s\x00%d\x00%d\x00%d\x00%d", tc.Type, tc.Query, tc.Start.UnixNano(), tc.End.UnixNano(), tc.Resolution, tc.Time.UnixNano())
+	if tc.SameAs != "" {
+		key += "\x00" + tc.SameAs
+	}
+	return key
+}
+
+// A Deduplicator drops expanded test cases that send the same query as an earlier test case, e.g.
+// because different templates expand to the same query.
+type Deduplicator struct {
+	seen map[string]bool
+	// Removed is the number of test cases dropped so far.
+	Removed int
+}
+
+// NewDeduplicator returns a Deduplicator that has not seen any test cases yet.
+func NewDeduplicator() *Deduplicator {
+	return &Deduplicator{seen: map[string]bool{}}
+}
+
+// Keep returns true if tc is the first test case sending its query, and counts it as removed otherwise.
+func (d *Deduplicator) Keep(tc *comparer.TestCase) bool {
+	key := TestCaseKey(tc)
+	if d.seen[key] {
+		d.Removed++
+		return false
+	}
+	d.seen[key] = true
+	return true
+}
+
+// DedupTestCases returns the test cases without those that send the same query as an earlier one,
+// keeping the order of the remaining test cases, and the number of test cases removed.
+func DedupTestCases(tcs []*comparer.TestCase) ([]*comparer.TestCase, int) {
+	d := NewDeduplicator()
+	res := make([]*comparer.TestCase, 0, len(tcs))
+	for _, tc := range tcs {
+		if d.Keep(tc) {
+			res = append(res, tc)
+		}
+	}
+	return res, d.Removed
+}
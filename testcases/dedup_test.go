@@ -0,0 +1,95 @@
+package testcases
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/comparer"
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+func TestDedupTestCases(t *testing.T) {
+	cases := []*config.TestCase{
+		{Query: "{{.simpleAggrOp}}(demo)", Type: config.QueryTypeRange, VariantArgs: []string{"simpleAggrOp"}},
+		// Duplicates the sum expansion of the first template.
+		{Query: "sum(demo)", Type: config.QueryTypeRange},
+		{Query: "{{.extremeAggrOp}}(demo)", Type: config.QueryTypeRange, VariantArgs: []string{"extremeAggrOp"}},
+		// The same query as an instant query is not a duplicate.
+		{Query: "sum(demo)", Type: config.QueryTypeInstant},
+		// Neither is a query that is checked against another query.
+		{Query: "sum(demo)", Type: config.QueryTypeRange, SameAs: "sum(demo offset 0s)"},
+	}
+	ranges := []TimeRange{
+		{Name: "1h", Start: time.Unix(0, 0), End: time.Unix(3600, 0), Resolution: time.Minute},
+		{Name: "1d", Start: time.Unix(0, 0), End: time.Unix(86400, 0), Resolution: time.Hour},
+	}
+	placeholders := BuiltinPlaceholders()
+	placeholders["extremeAggrOp"] = []string{"min", "max"}
+	tcs, err := ExpandTestCases(cases, placeholders, nil, ranges, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deduped, removed := DedupTestCases(tcs)
+	// For each time range, the sum of the second template and the min and max of the third
+	// template duplicate expansions of the first template.
+	if wantRemoved := 3 * len(ranges); removed != wantRemoved {
+		t.Errorf("expected %d duplicates to be removed, got %d", wantRemoved, removed)
+	}
+	if len(deduped) != len(tcs)-removed {
+		t.Fatalf("expected %d test cases to be kept, got %d", len(tcs)-removed, len(deduped))
+	}
+
+	// The first occurrences, i.e. the expansions of the first template, are kept in order.
+	var got []string
+	for _, tc := range deduped {
+		got = append(got, fmt.Sprintf("%s %s %s", tc.Type, tc.TimeParameterSet, tc.Query))
+	}
+	var want []string
+	for _, op := range []string{"sum", "avg", "max", "min", "count", "stddev", "stdvar"} {
+		want = append(want, "range 1h "+op+"(demo)", "range 1d "+op+"(demo)")
+	}
+	want = append(want, "instant 1h sum(demo)", "instant 1d sum(demo)", "range 1h sum(demo)", "range 1d sum(demo)")
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the test cases %q, got %q", want, got)
+	}
+	for i, tc := range deduped[:14] {
+		if tc != tcs[i] {
+			t.Errorf("test case %d: expected the expansion of the first template to be kept, got %+v", i+1, tc)
+		}
+	}
+	if last := deduped[len(deduped)-1]; last.SameAs == "" {
+		t.Errorf("expected the same_as test case to be kept, got %+v", last)
+	}
+
+	again, removed := DedupTestCases(deduped)
+	if removed != 0 || len(again) != len(deduped) {
+		t.Errorf("expected deduplicated test cases to have no duplicates, %d were removed", removed)
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	tc := &comparer.TestCase{Query: "sum(demo)", Type: config.QueryTypeRange, Start: time.Unix(0, 0), End: time.Unix(3600, 0), Resolution: time.Minute}
+	d := NewDeduplicator()
+	for i, c := range []struct {
+		tc   *comparer.TestCase
+		keep bool
+	}{
+		{tc, true},
+		{&comparer.TestCase{Query: tc.Query, Type: tc.Type, Start: tc.Start, End: tc.End, Resolution: tc.Resolution}, false},
+		{&comparer.TestCase{Query: tc.Query, Type: tc.Type, Start: tc.Start, End: tc.End, Resolution: 2 * time.Minute}, true},
+		{&comparer.TestCase{Query: tc.Query, Type: tc.Type, Start: tc.Start, End: time.Unix(7200, 0), Resolution: tc.Resolution}, true},
+		{&comparer.TestCase{Query: tc.Query, Type: config.QueryTypeInstant, Time: time.Unix(3600, 0)}, true},
+		{&comparer.TestCase{Query: tc.Query, Type: config.QueryTypeInstant, Time: time.Unix(3600, 0)}, false},
+		{&comparer.TestCase{Query: tc.Query, Type: config.QueryTypeInstant, Time: time.Unix(7200, 0)}, true},
+	} {
+		if got := d.Keep(c.tc); got != c.keep {
+			t.Errorf("test case %d: expected keep %v, got %v", i+1, c.keep, got)
+		}
+	}
+	if d.Removed != 2 {
+		t.Errorf("expected 2 test cases to be removed, got %d", d.Removed)
+	}
+}
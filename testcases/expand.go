@@ -33,7 +33,10 @@ package testcases
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
+	"sort"
 	"text/template"
 	"time"
 
@@ -46,6 +49,8 @@ var testVariantArgs = map[string][]string{
 	"offset": {"1m", "5m", "10m"},
 	// TODO: Add "group" aggregator and new duration formats, but it is so new that vendor implementations need time to catch up first.
 	"simpleAggrOp": {"sum", "avg", "max", "min", "count", "stddev", "stdvar"},
+	// quantile_over_time takes an extra parameter and has its own test cases.
+	"overTimeFunc": {"avg_over_time", "min_over_time", "max_over_time", "sum_over_time", "count_over_time", "last_over_time", "stddev_over_time", "stdvar_over_time"},
 	"topBottomOp":  {"topk", "bottomk"},
 	"quantile": {
 		"-0.5",
@@ -71,28 +76,37 @@ var testVariantArgs = map[string][]string{
 }
 
 // tprintf replaces template arguments in a string with their instantiations from the provided map.
-func tprintf(tmpl string, data map[string]string) string {
-	t := template.Must(template.New("Query").Parse(tmpl))
+// Referencing an argument that is not in the map is an error.
+func tprintf(tmpl string, data map[string]string) (string, error) {
+	t, err := template.New("Query").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
 	buf := &bytes.Buffer{}
 	if err := t.Execute(buf, data); err != nil {
-		panic(err)
+		return "", err
 	}
-	return buf.String()
+	return buf.String(), nil
 }
 
-// getVariants returns every possible combinations (variants) of a template query.
-func getVariants(query string, remainingVariantArgs []string, args map[string]string) []string {
+// getVariantArgs returns every possible combination of the values of the variant args, on top of
+// the args filled out already.
+func getVariantArgs(placeholders Placeholders, remainingVariantArgs []string, args map[string]string) ([]map[string]string, error) {
 	// Either this Query had no variants defined to begin with or they have
 	// been fully filled out in "args" from recursive parent calls.
 	if len(remainingVariantArgs) == 0 {
-		return []string{tprintf(query, args)}
+		filled := make(map[string]string, len(args))
+		for k, v := range args {
+			filled[k] = v
+		}
+		return []map[string]string{filled}, nil
 	}
 
 	// Recursively iterate through the values for each variant arg dimension,
 	// selecting one dimension (arg) to vary per recursion level and let the
 	// other recursion levels iterate through the remaining dimensions until
 	// all args are defined.
-	var queries []string
+	var argSets []map[string]string
 	vArg := remainingVariantArgs[0]
 	filteredVArgs := make([]string, 0, len(remainingVariantArgs)-1)
 	for _, va := range remainingVariantArgs {
@@ -101,50 +115,259 @@ func getVariants(query string, remainingVariantArgs []string, args map[string]st
 		}
 	}
 
-	vals := testVariantArgs[vArg]
-	if len(vals) == 0 {
-		panic(fmt.Errorf("unknown variant arg %q", vArg))
+	vals, ok := placeholders[vArg]
+	if !ok {
+		return nil, fmt.Errorf("unknown variant arg %q", vArg)
 	}
 	for _, variantVal := range vals {
 		args[vArg] = variantVal
-		qs := getVariants(query, filteredVArgs, args)
-		queries = append(queries, qs...)
+		as, err := getVariantArgs(placeholders, filteredVArgs, args)
+		if err != nil {
+			return nil, err
+		}
+		argSets = append(argSets, as...)
+	}
+	return argSets, nil
+}
+
+// getPairedVariants returns every possible combination (variant) of a template query, each paired
+// with the variant of its same_as query that has the same variant arg values.
+func getPairedVariants(placeholders Placeholders, query, sameAs string, variantArgs []string) ([][2]string, error) {
+	argSets, err := getVariantArgs(placeholders, variantArgs, make(map[string]string))
+	if err != nil {
+		return nil, err
+	}
+	pairs := make([][2]string, 0, len(argSets))
+	for _, a := range argSets {
+		q, err := tprintf(query, a)
+		if err != nil {
+			return nil, err
+		}
+		s, err := tprintf(sameAs, a)
+		if err != nil {
+			return nil, fmt.Errorf("same_as: %v", err)
+		}
+		pairs = append(pairs, [2]string{q, s})
+	}
+	return pairs, nil
+}
+
+// ExpansionCount returns the number of queries that a test case template expands into with the
+// given placeholders, without expanding it.
+func ExpansionCount(tc *config.TestCase, placeholders Placeholders) (int, error) {
+	n := 1
+	seen := map[string]bool{}
+	for _, va := range tc.VariantArgs {
+		if seen[va] {
+			continue
+		}
+		seen[va] = true
+		vals, ok := placeholders[va]
+		if !ok {
+			return 0, fmt.Errorf("unknown variant arg %q", va)
+		}
+		n *= len(vals)
+	}
+	return n, nil
+}
+
+// A TemplateExpansion is the number of queries that a test case template expands into.
+type TemplateExpansion struct {
+	Query string `json:"query"`
+	Count int    `json:"count"`
+}
+
+// TopExpansions returns the n test case templates that expand into the most queries, most first.
+// Templates with unknown variant args are left out, since expanding them fails anyway, and so are
+// templates that expand into no queries, which EmptyExpansions lists.
+func TopExpansions(cases []*config.TestCase, placeholders Placeholders, n int) []TemplateExpansion {
+	var es []TemplateExpansion
+	for _, tc := range cases {
+		if count, err := ExpansionCount(tc, placeholders); err == nil && count > 0 {
+			es = append(es, TemplateExpansion{Query: tc.Query, Count: count})
+		}
+	}
+	sort.SliceStable(es, func(i, j int) bool { return es[i].Count > es[j].Count })
+	if len(es) > n {
+		es = es[:n]
+	}
+	return es
+}
+
+// CheckExpansions returns an error if any test case template expands into more than max queries,
+// or if onEmpty is error and any template expands into none, since a placeholder that it uses has
+// no values.
+func CheckExpansions(cases []*config.TestCase, placeholders Placeholders, max int, onEmpty config.EmptyExpansionPolicy) error {
+	for _, tc := range cases {
+		if p := placeholders.emptyPlaceholder(tc); p != "" && onEmpty != config.EmptyExpansionSkipWithWarning {
+			return fmt.Errorf("test case %q expands into no queries, since placeholder %q has no values, set on_empty_expansion: %s to report it as not expanded", tc.Query, p, config.EmptyExpansionSkipWithWarning)
+		}
+		count, err := ExpansionCount(tc, placeholders)
+		if err != nil {
+			return fmt.Errorf("test case %q: %v", tc.Query, err)
+		}
+		if count > max {
+			return fmt.Errorf("test case %q expands into %d queries, more than max_expansions_per_case %d", tc.Query, count, max)
+		}
 	}
-	return queries
+	return nil
 }
 
 func applyQueryTweaks(tc *comparer.TestCase, tweaks []*config.QueryTweak) *comparer.TestCase {
 	resTC := *tc
+	if q := config.RenameTestQuery(resTC.Query, tweaks); q != resTC.Query {
+		resTC.TestQuery = q
+	}
+	resTC.SameAs = config.RenameTestQuery(resTC.SameAs, tweaks)
 	for _, t := range tweaks {
 		if d := time.Duration(t.TruncateTimestampsToMS) * time.Millisecond; d != 0 {
 			resTC.Start = resTC.Start.Truncate(d)
 			resTC.End = resTC.End.Truncate(d)
+			resTC.Time = resTC.Time.Truncate(d)
 		}
 		if t.AlignTimestampsToStep {
 			resTC.Start = resTC.Start.Truncate(resTC.Resolution)
 			resTC.End = resTC.End.Truncate(resTC.Resolution)
+			resTC.Time = resTC.Time.Truncate(resTC.Resolution)
 		}
 	}
 	return &resTC
 }
 
-// ExpandTestCases returns the fully expanded test cases for a given set of templates test cases.
-func ExpandTestCases(cases []*config.TestCase, tweaks []*config.QueryTweak, start, end time.Time, resolution time.Duration) []*comparer.TestCase {
+// A TimeRange holds the time parameters of a query time parameter set.
+type TimeRange struct {
+	// Name is the name of the parameter set, which is empty if it has none.
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Resolution time.Duration
+	// Jitter, if positive, shifts the window of each test case back by a pseudo-random amount of
+	// less than Jitter, derived from JitterSeed and the test case, so that window boundaries do not
+	// always fall on the same offset within scrape intervals.
+	Jitter     time.Duration
+	JitterSeed int64
+}
+
+// jitterFor returns the amount by which the window of a test case is shifted back. It only depends
+// on the seed, the query, its type, and the time range, at millisecond precision.
+func (r TimeRange) jitterFor(tc *comparer.TestCase) time.Duration {
+	steps := uint64(r.Jitter / time.Millisecond)
+	if steps == 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, r.JitterSeed)
+	fmt.Fprintf(h, "%s\x00%s\x00%s", tc.Type, tc.Query, r.Name)
+	return time.Duration(h.Sum64()%steps) * time.Millisecond
+}
+
+// AppliesTo returns true if the test case runs with the time range's parameter set.
+func (r TimeRange) AppliesTo(tc *config.TestCase) bool {
+	if len(tc.TimeParameterSets) == 0 {
+		return true
+	}
+	for _, name := range tc.TimeParameterSets {
+		if name == r.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandTestCases returns the fully expanded test cases for a given set of templates test cases,
+// whose placeholders expand into the given values. Each query is expanded once for each time range
+// that applies to its template.
+//
+// Placeholders that cannot be resolved cause an error. If allowRawBraces is set, queries
+// that fail to expand are passed through literally instead. Templates using a placeholder without
+// values expand into a test case with the query template for each time range instead, which has
+// NotExpanded set and is not compared.
+func ExpandTestCases(cases []*config.TestCase, placeholders Placeholders, tweaks []*config.QueryTweak, ranges []TimeRange, allowRawBraces bool) ([]*comparer.TestCase, error) {
 	tcs := make([]*comparer.TestCase, 0)
+	err := StreamTestCases(cases, placeholders, tweaks, ranges, allowRawBraces, func(tc *comparer.TestCase) error {
+		tcs = append(tcs, tc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tcs, nil
+}
+
+// StreamTestCases expands the test cases like ExpandTestCases, but passes each expanded test case
+// to fn as soon as it is generated instead of collecting all of them. Expansion stops at the first
+// error, including errors returned by fn.
+func StreamTestCases(cases []*config.TestCase, placeholders Placeholders, tweaks []*config.QueryTweak, ranges []TimeRange, allowRawBraces bool, fn func(*comparer.TestCase) error) error {
 	for _, q := range cases {
-		vs := getVariants(q.Query, q.VariantArgs, make(map[string]string))
+		if p := placeholders.emptyPlaceholder(q); p != "" {
+			for _, r := range ranges {
+				if !r.AppliesTo(q) {
+					continue
+				}
+				tc := expandTestCase(q, q.Query, r)
+				tc.SameAs, tc.NotExpanded = q.SameAs, p
+				if err := fn(tc); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		vs, err := getPairedVariants(placeholders, q.Query, q.SameAs, q.VariantArgs)
+		if err != nil {
+			if !allowRawBraces {
+				return fmt.Errorf("expanding test case %q: %v", q.Query, err)
+			}
+			vs = [][2]string{{q.Query, q.SameAs}}
+		}
 		for _, v := range vs {
-			tc := &comparer.TestCase{
-				Query:          v,
-				SkipComparison: q.SkipComparison,
-				ShouldFail:     q.ShouldFail,
-				Start:          start,
-				End:            end,
-				Resolution:     resolution,
+			for _, r := range ranges {
+				if !r.AppliesTo(q) {
+					continue
+				}
+				tc := expandTestCase(q, v[0], r)
+				tc.SameAs = v[1]
+				if err := fn(applyQueryTweaks(tc, tweaks)); err != nil {
+					return err
+				}
 			}
+		}
+	}
+	return nil
+}
 
-			tcs = append(tcs, applyQueryTweaks(tc, tweaks))
+// expandTestCase returns the test case running query, an expansion of the template q, with the
+// time parameters of r.
+func expandTestCase(q *config.TestCase, query string, r TimeRange) *comparer.TestCase {
+	tc := &comparer.TestCase{
+		Query:                  query,
+		SkipComparison:         q.SkipComparison,
+		ShouldFail:             q.ShouldFail,
+		Type:                   q.Type,
+		Category:               q.Category,
+		Tags:                   q.Tags,
+		ValueTolerance:         q.AdjustValueTolerance,
+		LabelTweaks:            q.ResultLabelTweaks,
+		WithinReferenceRange:   q.WithinReferenceRange,
+		SeriesAllowance:        q.SeriesAllowance,
+		ExpectNativeHistograms: q.ExpectNativeHistograms,
+		Start:                  r.Start,
+		End:                    r.End,
+		Resolution:             r.Resolution,
+		TimeParameterSet:       r.Name,
+	}
+	if len(q.VariantArgs) > 0 {
+		tc.Template = q.Query
+	}
+	if q.Type == config.QueryTypeInstant {
+		tc.Time = r.End.Add(-time.Duration(q.EvalTimeOffsetSeconds * float64(time.Second)))
+	}
+	if r.Jitter > 0 && !q.PinWindow {
+		tc.TimeJitter = r.jitterFor(tc)
+		tc.Start = tc.Start.Add(-tc.TimeJitter)
+		tc.End = tc.End.Add(-tc.TimeJitter)
+		if !tc.Time.IsZero() {
+			tc.Time = tc.Time.Add(-tc.TimeJitter)
 		}
 	}
-	return tcs
+	return tc
 }
@@ -0,0 +1,192 @@
+package testcases
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+func TestExpansionCount(t *testing.T) {
+	placeholders := Placeholders{"a": {"1", "2", "3"}, "b": {"x", "y"}}
+	for _, tc := range []struct {
+		variantArgs []string
+		want        int
+		wantErr     string
+	}{
+		{variantArgs: nil, want: 1},
+		{variantArgs: []string{"a"}, want: 3},
+		{variantArgs: []string{"a", "b"}, want: 6},
+		// Repeated variant args expand once.
+		{variantArgs: []string{"a", "b", "a"}, want: 6},
+		{variantArgs: []string{"a", "c"}, wantErr: `unknown variant arg "c"`},
+	} {
+		got, err := ExpansionCount(&config.TestCase{Query: "q", VariantArgs: tc.variantArgs}, placeholders)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%v: expected an error containing %q, got %v", tc.variantArgs, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%v: expected %d expansions, got %d (%v)", tc.variantArgs, tc.want, got, err)
+		}
+	}
+}
+
+func TestTopAndCheckExpansions(t *testing.T) {
+	placeholders := Placeholders{"a": {"1", "2", "3"}, "b": {"x", "y"}}
+	cases := []*config.TestCase{
+		{Query: "a", VariantArgs: []string{"a"}},
+		{Query: "none"},
+		{Query: "ab", VariantArgs: []string{"a", "b"}},
+		{Query: "unknown", VariantArgs: []string{"c"}},
+		{Query: "b", VariantArgs: []string{"b"}},
+	}
+	want := []TemplateExpansion{{Query: "ab", Count: 6}, {Query: "a", Count: 3}}
+	if got := TopExpansions(cases, placeholders, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the top expansions %v, got %v", want, got)
+	}
+
+	if err := CheckExpansions(cases[:3], placeholders, 6, config.EmptyExpansionError); err != nil {
+		t.Errorf("expected no template to exceed 6 expansions, got %v", err)
+	}
+	if err := CheckExpansions(cases[:3], placeholders, 5, config.EmptyExpansionError); err == nil || !strings.Contains(err.Error(), `test case "ab" expands into 6 queries`) {
+		t.Errorf("expected the template with 6 expansions to exceed the maximum of 5, got %v", err)
+	}
+	if err := CheckExpansions(cases, placeholders, 10, config.EmptyExpansionError); err == nil || !strings.Contains(err.Error(), `unknown variant arg "c"`) {
+		t.Errorf("expected the unknown variant arg to be an error, got %v", err)
+	}
+}
+
+func TestExpandTestCasesUnknownPlaceholders(t *testing.T) {
+	placeholders := Placeholders{"simpleAggrOp": {"sum", "max"}}
+	ranges := []TimeRange{{End: time.Unix(3600, 0), Start: time.Unix(0, 0), Resolution: time.Minute}}
+	for _, tc := range []struct {
+		name string
+		tc   *config.TestCase
+	}{
+		{name: "misspelled placeholder", tc: &config.TestCase{Query: "{{.simpleAggregationOp}}(demo)", VariantArgs: []string{"simpleAggrOp"}}},
+		{name: "placeholder without variant arg", tc: &config.TestCase{Query: "{{.simpleAggregationOp}}(demo)"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.tc.Type = config.QueryTypeRange
+			_, err := ExpandTestCases([]*config.TestCase{tc.tc}, placeholders, nil, ranges, false)
+			if err == nil {
+				t.Fatal("expected the unknown placeholder to be an error")
+			}
+			for _, want := range []string{tc.tc.Query, "simpleAggregationOp"} {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected the error to contain %q, got %v", want, err)
+				}
+			}
+
+			tcs, err := ExpandTestCases([]*config.TestCase{tc.tc}, placeholders, nil, ranges, true)
+			if err != nil {
+				t.Fatalf("expected the query to be passed through with allowRawBraces, got %v", err)
+			}
+			if len(tcs) != 1 || tcs[0].Query != tc.tc.Query {
+				t.Errorf("expected the literal query %q, got %v", tc.tc.Query, tcs)
+			}
+		})
+	}
+}
+
+func TestExpandTestCasesBracesInLabelValues(t *testing.T) {
+	placeholders := Placeholders{"simpleAggrOp": {"sum"}}
+	ranges := []TimeRange{{End: time.Unix(3600, 0), Start: time.Unix(0, 0), Resolution: time.Minute}}
+	for _, tc := range []struct {
+		query       string
+		variantArgs []string
+		want        string
+	}{
+		{query: `demo{path=~"/api/v[0-9]{1,2}/.*"}`, want: `demo{path=~"/api/v[0-9]{1,2}/.*"}`},
+		{query: `{{.simpleAggrOp}}(demo{instance=~"demo-[a-z]{3}:.+"})`, variantArgs: []string{"simpleAggrOp"}, want: `sum(demo{instance=~"demo-[a-z]{3}:.+"})`},
+		{query: `{__name__=~"demo_.{3,}"}`, want: `{__name__=~"demo_.{3,}"}`},
+		// Literal double braces in label values are escaped as template strings.
+		{query: `label_replace(demo, "tmpl", "{{"{{"}}.x{{"}}"}}", "", "")`, want: `label_replace(demo, "tmpl", "{{.x}}", "", "")`},
+	} {
+		tcs, err := ExpandTestCases([]*config.TestCase{{Query: tc.query, Type: config.QueryTypeRange, VariantArgs: tc.variantArgs}}, placeholders, nil, ranges, false)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", tc.query, err)
+			continue
+		}
+		if len(tcs) != 1 || tcs[0].Query != tc.want {
+			t.Errorf("%s: expected the query %q, got %v", tc.query, tc.want, tcs)
+		}
+	}
+}
+
+func TestExpandTestCasesTemplate(t *testing.T) {
+	placeholders := Placeholders{"simpleAggrOp": {"sum", "max"}}
+	ranges := []TimeRange{{End: time.Unix(3600, 0), Start: time.Unix(0, 0), Resolution: time.Minute}}
+	tcs, err := ExpandTestCases([]*config.TestCase{
+		{Query: "{{.simpleAggrOp}}(demo)", Type: config.QueryTypeRange, VariantArgs: []string{"simpleAggrOp"}},
+		{Query: "rate(demo[5m])", Type: config.QueryTypeRange},
+	}, placeholders, nil, ranges, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tc := range tcs {
+		got = append(got, tc.Template)
+	}
+	// Only the expansions of queries with placeholders record their template.
+	if want := []string{"{{.simpleAggrOp}}(demo)", "{{.simpleAggrOp}}(demo)", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the templates %q, got %q", want, got)
+	}
+}
+
+func TestExpandTestCasesRename(t *testing.T) {
+	tweaks := []*config.QueryTweak{{Rename: map[string]string{
+		`\bnode_cpu_seconds_total\b`: "node_cpu_seconds",
+		`\bnode_(\w+)_bytes_total\b`: "node_${1}_bytes",
+	}}}
+	ranges := []TimeRange{{End: time.Unix(3600, 0), Start: time.Unix(0, 0), Resolution: time.Minute}}
+	for _, tc := range []struct {
+		query, want string
+	}{
+		{query: `rate(node_cpu_seconds_total{mode="idle"}[5m])`, want: `rate(node_cpu_seconds{mode="idle"}[5m])`},
+		{query: "rate(node_network_receive_bytes_total[5m])", want: "rate(node_network_receive_bytes[5m])"},
+		// Queries that no expression matches have no separate test query.
+		{query: "rate(node_cpu_seconds_total_extra[5m])", want: ""},
+	} {
+		tcs, err := ExpandTestCases([]*config.TestCase{{Query: tc.query, Type: config.QueryTypeRange}}, nil, tweaks, ranges, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tcs) != 1 || tcs[0].Query != tc.query || tcs[0].TestQuery != tc.want {
+			t.Errorf("%s: expected the test query %q with the reference query untouched, got %+v", tc.query, tc.want, tcs[0])
+		}
+	}
+}
+
+func TestExpandTestCasesSameAs(t *testing.T) {
+	placeholders := Placeholders{"simpleAggrOp": {"sum", "max"}}
+	ranges := []TimeRange{{End: time.Unix(3600, 0), Start: time.Unix(0, 0), Resolution: time.Minute}}
+	tcs, err := ExpandTestCases([]*config.TestCase{
+		{Query: "{{.simpleAggrOp}}(demo)", SameAs: "{{.simpleAggrOp}} without () (demo)", Type: config.QueryTypeRange, VariantArgs: []string{"simpleAggrOp"}},
+		{Query: "rate(demo[5m])", Type: config.QueryTypeRange},
+	}, placeholders, nil, ranges, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][2]string
+	for _, tc := range tcs {
+		got = append(got, [2]string{tc.Query, tc.SameAs})
+	}
+	// Each variant is paired with the same_as variant of the same placeholder values.
+	want := [][2]string{{"sum(demo)", "sum without () (demo)"}, {"max(demo)", "max without () (demo)"}, {"rate(demo[5m])", ""}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the query pairs %q, got %q", want, got)
+	}
+
+	_, err = ExpandTestCases([]*config.TestCase{
+		{Query: "{{.simpleAggrOp}}(demo)", SameAs: "{{.simpleAggrOp(demo)", Type: config.QueryTypeRange, VariantArgs: []string{"simpleAggrOp"}},
+	}, placeholders, nil, ranges, false)
+	if err == nil || !strings.Contains(err.Error(), "same_as:") {
+		t.Errorf("expected an error expanding the same_as query, got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package testcases
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+// Placeholders maps the names of query placeholders to the values that they expand into.
+type Placeholders map[string][]string
+
+// BuiltinPlaceholders returns the built-in values of the query placeholders.
+func BuiltinPlaceholders() Placeholders {
+	p := make(Placeholders, len(testVariantArgs))
+	for name, vals := range testVariantArgs {
+		p[name] = vals
+	}
+	return p
+}
+
+// A PlaceholderCoverage records the built-in values of a query placeholder that its override left
+// out, so that the reduced coverage shows in the reports.
+type PlaceholderCoverage struct {
+	Placeholder string   `json:"placeholder"`
+	Values      []string `json:"values"`
+	Omitted     []string `json:"omitted"`
+}
+
+// OverridePlaceholders returns the built-in placeholders with their values restricted by the
+// overrides, for expanding the test cases with. Overrides are validated against the built-in
+// values: naming an unknown placeholder and including or excluding a value that the placeholder
+// does not have are errors. Leaving a placeholder without values is an error, too, unless onEmpty
+// is skip_with_warning. It returns the coverage of the overridden placeholders, sorted by name.
+func OverridePlaceholders(overrides map[string]*config.PlaceholderOverride, onEmpty config.EmptyExpansionPolicy) (Placeholders, []PlaceholderCoverage, error) {
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	placeholders := BuiltinPlaceholders()
+	var coverage []PlaceholderCoverage
+	for _, name := range names {
+		o := overrides[name]
+		builtin, ok := testVariantArgs[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("placeholder_overrides: unknown placeholder %q", name)
+		}
+		has := make(map[string]bool, len(builtin))
+		for _, v := range builtin {
+			has[v] = true
+		}
+		for _, list := range []struct {
+			key  string
+			vals []string
+		}{{"include_only", o.IncludeOnly}, {"exclude", o.Exclude}} {
+			for _, v := range list.vals {
+				if !has[v] {
+					return nil, nil, fmt.Errorf("placeholder_overrides: %s of %q lists %q, which is not one of its values %v", list.key, name, v, builtin)
+				}
+			}
+		}
+
+		keep := has
+		if len(o.IncludeOnly) > 0 {
+			keep = make(map[string]bool, len(o.IncludeOnly))
+			for _, v := range o.IncludeOnly {
+				keep[v] = true
+			}
+		}
+		excluded := make(map[string]bool, len(o.Exclude))
+		for _, v := range o.Exclude {
+			excluded[v] = true
+		}
+		c := PlaceholderCoverage{Placeholder: name, Values: []string{}, Omitted: []string{}}
+		// Keep the built-in order, so that the expanded test cases are ordered as without overrides.
+		for _, v := range builtin {
+			if keep[v] && !excluded[v] {
+				c.Values = append(c.Values, v)
+			} else {
+				c.Omitted = append(c.Omitted, v)
+			}
+		}
+		if len(c.Values) == 0 && onEmpty != config.EmptyExpansionSkipWithWarning {
+			return nil, nil, fmt.Errorf("placeholder_overrides: no values of %q are left, set on_empty_expansion: %s to report the test cases using it as not expanded", name, config.EmptyExpansionSkipWithWarning)
+		}
+		placeholders[name] = c.Values
+		coverage = append(coverage, c)
+	}
+	return placeholders, coverage, nil
+}
+
+// An EmptyExpansion is a test case template that expands into no queries, since a placeholder that
+// it uses has no values.
+type EmptyExpansion struct {
+	Query       string `json:"query"`
+	Placeholder string `json:"placeholder"`
+}
+
+// emptyPlaceholder returns the first variant arg of a test case template whose placeholder has no
+// values, or an empty string if there is none. Unknown variant args are not empty.
+func (p Placeholders) emptyPlaceholder(tc *config.TestCase) string {
+	for _, va := range tc.VariantArgs {
+		if vals, ok := p[va]; ok && len(vals) == 0 {
+			return va
+		}
+	}
+	return ""
+}
+
+// EmptyExpansions returns the test case templates that expand into no queries with the given
+// placeholders, with the first of their placeholders that has no values.
+func EmptyExpansions(cases []*config.TestCase, placeholders Placeholders) []EmptyExpansion {
+	var es []EmptyExpansion
+	for _, tc := range cases {
+		if p := placeholders.emptyPlaceholder(tc); p != "" {
+			es = append(es, EmptyExpansion{Query: tc.Query, Placeholder: p})
+		}
+	}
+	return es
+}
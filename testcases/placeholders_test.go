@@ -0,0 +1,219 @@
+package testcases
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/promlabs/promql-compliance-tester/config"
+)
+
+func TestOverridePlaceholders(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		override    *config.PlaceholderOverride
+		wantValues  []string
+		wantOmitted []string
+	}{
+		{
+			name:        "include_only",
+			override:    &config.PlaceholderOverride{IncludeOnly: []string{"5m", "1m"}},
+			wantValues:  []string{"1m", "5m"},
+			wantOmitted: []string{"1s", "15s", "15m", "1h"},
+		},
+		{
+			name:        "exclude",
+			override:    &config.PlaceholderOverride{Exclude: []string{"1s", "1h"}},
+			wantValues:  []string{"15s", "1m", "5m", "15m"},
+			wantOmitted: []string{"1s", "1h"},
+		},
+		{
+			name:        "include_only and exclude",
+			override:    &config.PlaceholderOverride{IncludeOnly: []string{"1m", "5m", "15m"}, Exclude: []string{"5m"}},
+			wantValues:  []string{"1m", "15m"},
+			wantOmitted: []string{"1s", "15s", "5m", "1h"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			placeholders, coverage, err := OverridePlaceholders(map[string]*config.PlaceholderOverride{"range": tc.override}, config.EmptyExpansionError)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := placeholders["range"]; !reflect.DeepEqual(got, tc.wantValues) {
+				t.Errorf("expected the values %v, got %v", tc.wantValues, got)
+			}
+			want := []PlaceholderCoverage{{Placeholder: "range", Values: tc.wantValues, Omitted: tc.wantOmitted}}
+			if !reflect.DeepEqual(coverage, want) {
+				t.Errorf("expected the coverage %+v, got %+v", want, coverage)
+			}
+			if got := placeholders["offset"]; !reflect.DeepEqual(got, testVariantArgs["offset"]) {
+				t.Errorf("expected placeholders without overrides to keep their built-in values, got %v", got)
+			}
+			if got := BuiltinPlaceholders()["range"]; !reflect.DeepEqual(got, testVariantArgs["range"]) || len(got) != 6 {
+				t.Errorf("expected overriding not to change the built-in values, got %v", got)
+			}
+		})
+	}
+}
+
+func TestOverridePlaceholdersErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		overrides map[string]*config.PlaceholderOverride
+		wantErr   string
+	}{
+		{
+			name:      "unknown placeholder",
+			overrides: map[string]*config.PlaceholderOverride{"rangeDuration": {Exclude: []string{"1m"}}},
+			wantErr:   `unknown placeholder "rangeDuration"`,
+		},
+		{
+			name:      "excluding a value that the placeholder does not have",
+			overrides: map[string]*config.PlaceholderOverride{"simpleAggrOp": {Exclude: []string{"group"}}},
+			wantErr:   `exclude of "simpleAggrOp" lists "group"`,
+		},
+		{
+			name:      "including a value that the placeholder does not have",
+			overrides: map[string]*config.PlaceholderOverride{"range": {IncludeOnly: []string{"2m"}}},
+			wantErr:   `include_only of "range" lists "2m"`,
+		},
+		{
+			name:      "excluding all included values",
+			overrides: map[string]*config.PlaceholderOverride{"offset": {IncludeOnly: []string{"1m"}, Exclude: []string{"1m"}}},
+			wantErr:   `no values of "offset" are left`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := OverridePlaceholders(tc.overrides, config.EmptyExpansionError)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestExpandTestCasesWithOverriddenPlaceholders(t *testing.T) {
+	placeholders, _, err := OverridePlaceholders(map[string]*config.PlaceholderOverride{
+		"simpleAggrOp": {Exclude: []string{"stddev", "stdvar"}},
+		"range":        {IncludeOnly: []string{"1m", "5m"}},
+	}, config.EmptyExpansionError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []*config.TestCase{{Query: "{{.simpleAggrOp}}(rate(demo[{{.range}}]))", Type: config.QueryTypeRange, VariantArgs: []string{"simpleAggrOp", "range"}}}
+	ranges := []TimeRange{{End: time.Unix(3600, 0), Start: time.Unix(0, 0), Resolution: time.Minute}}
+
+	tcs, err := ExpandTestCases(cases, placeholders, nil, ranges, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries []string
+	for _, tc := range tcs {
+		queries = append(queries, tc.Query)
+	}
+	want := []string{
+		"sum(rate(demo[1m]))", "sum(rate(demo[5m]))",
+		"avg(rate(demo[1m]))", "avg(rate(demo[5m]))",
+		"max(rate(demo[1m]))", "max(rate(demo[5m]))",
+		"min(rate(demo[1m]))", "min(rate(demo[5m]))",
+		"count(rate(demo[1m]))", "count(rate(demo[5m]))",
+	}
+	if !reflect.DeepEqual(queries, want) {
+		t.Fatalf("expected the queries %v, got %v", want, queries)
+	}
+	if n, err := ExpansionCount(cases[0], placeholders); err != nil || n != len(want) {
+		t.Errorf("expected an expansion count of %d, got %d (%v)", len(want), n, err)
+	}
+
+	builtin, err := ExpandTestCases(cases, BuiltinPlaceholders(), nil, ranges, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builtin) != 7*6 {
+		t.Errorf("expected the built-in placeholders to expand into %d test cases after overriding, got %d", 7*6, len(builtin))
+	}
+}
+
+func TestEmptyBuiltinPlaceholder(t *testing.T) {
+	overrides := map[string]*config.PlaceholderOverride{"offset": {IncludeOnly: []string{"1m"}, Exclude: []string{"1m"}}}
+	if _, _, err := OverridePlaceholders(overrides, config.EmptyExpansionError); err == nil || !strings.Contains(err.Error(), `no values of "offset" are left`) {
+		t.Fatalf("expected leaving offset without values to be an error, got %v", err)
+	}
+	placeholders, coverage, err := OverridePlaceholders(overrides, config.EmptyExpansionSkipWithWarning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vals, ok := placeholders["offset"]; !ok || len(vals) != 0 {
+		t.Fatalf("expected offset to be left without values, got %v", vals)
+	}
+	if len(coverage) != 1 || len(coverage[0].Values) != 0 || len(coverage[0].Omitted) != 3 {
+		t.Errorf("expected the coverage to show that all values of offset were left out, got %+v", coverage)
+	}
+	checkNotExpanded(t, placeholders, "offset", []*config.TestCase{
+		{Query: "demo offset {{.offset}}", Type: config.QueryTypeInstant, VariantArgs: []string{"offset"}},
+		{Query: "demo[{{.range}}] offset {{.offset}}", Type: config.QueryTypeRange, VariantArgs: []string{"range", "offset"}},
+	})
+}
+
+func TestEmptyCustomPlaceholder(t *testing.T) {
+	placeholders := BuiltinPlaceholders()
+	// E.g. label values that were discovered on the reference target, of which there were none.
+	placeholders["jobLabel"] = []string{}
+	checkNotExpanded(t, placeholders, "jobLabel", []*config.TestCase{
+		{Query: `demo{job="{{.jobLabel}}"}`, Type: config.QueryTypeInstant, VariantArgs: []string{"jobLabel"}},
+		{Query: `{{.simpleAggrOp}}(demo{job="{{.jobLabel}}"})`, Type: config.QueryTypeRange, VariantArgs: []string{"simpleAggrOp", "jobLabel"}},
+	})
+}
+
+// checkNotExpanded checks that the templates of cases, the last ones of which use the placeholder
+// without values, are reported as not expanded, while the first one still expands.
+func checkNotExpanded(t *testing.T, placeholders Placeholders, placeholder string, empty []*config.TestCase) {
+	t.Helper()
+	cases := append([]*config.TestCase{{Query: "{{.topBottomOp}}(1, demo)", Type: config.QueryTypeRange, VariantArgs: []string{"topBottomOp"}}}, empty...)
+	ranges := []TimeRange{
+		{Name: "1h", Start: time.Unix(0, 0), End: time.Unix(3600, 0), Resolution: time.Minute},
+		{Name: "1d", Start: time.Unix(0, 0), End: time.Unix(86400, 0), Resolution: time.Hour},
+	}
+
+	err := CheckExpansions(cases, placeholders, 500, config.EmptyExpansionError)
+	if err == nil || !strings.Contains(err.Error(), `placeholder "`+placeholder+`" has no values`) {
+		t.Fatalf("expected the empty placeholder to be an error, got %v", err)
+	}
+	if err := CheckExpansions(cases, placeholders, 500, config.EmptyExpansionSkipWithWarning); err != nil {
+		t.Fatalf("expected skip_with_warning to allow the empty placeholder, got %v", err)
+	}
+
+	var want []EmptyExpansion
+	for _, tc := range empty {
+		want = append(want, EmptyExpansion{Query: tc.Query, Placeholder: placeholder})
+	}
+	if got := EmptyExpansions(cases, placeholders); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the empty expansions %+v, got %+v", want, got)
+	}
+	for _, tc := range empty {
+		if n, err := ExpansionCount(tc, placeholders); err != nil || n != 0 {
+			t.Errorf("%s: expected no expansions, got %d (%v)", tc.Query, n, err)
+		}
+	}
+
+	tcs, err := ExpandTestCases(cases, placeholders, nil, ranges, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first template expands into topk and bottomk, the others into a test case per time range.
+	if len(tcs) != 2*len(ranges)+len(empty)*len(ranges) {
+		t.Fatalf("expected %d test cases, got %d", 2*len(ranges)+len(empty)*len(ranges), len(tcs))
+	}
+	for i, tc := range tcs[:2*len(ranges)] {
+		if tc.NotExpanded != "" || strings.Contains(tc.Query, "{{") {
+			t.Errorf("test case %d: expected an expanded query, got %q (not expanded: %q)", i+1, tc.Query, tc.NotExpanded)
+		}
+	}
+	for i, tc := range tcs[2*len(ranges):] {
+		template := empty[i/len(ranges)]
+		if tc.NotExpanded != placeholder || tc.Query != template.Query || tc.TimeParameterSet != ranges[i%len(ranges)].Name {
+			t.Errorf("expected the template %q to be not expanded for time range %q, got %+v", template.Query, ranges[i%len(ranges)].Name, tc)
+		}
+	}
+}